@@ -0,0 +1,219 @@
+// The affinity package keeps the pins that send a client's traffic for a
+// service to one particular instance, e.g. to try out a canary. A client is
+// picked out by its source address, or by the value of the SidecarPin
+// cookie for HTTP services. Pins are for debugging, so they always expire,
+// and they only apply to the proxy of the Sidecar they were added to.
+package affinity
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The cookie that picks out a client pinned by cookie
+	CookieName = "SidecarPin"
+
+	// How long a pin lasts when it's added without an expiry
+	DefaultDuration = 15 * time.Minute
+	// The longest a pin can last
+	MaxDuration = 24 * time.Hour
+	// How often Run looks for expired pins
+	ExpireInterval = 10 * time.Second
+)
+
+var validCookie = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// A Pin sends the traffic of a client for a service to one of its
+// instances. Exactly one of Source and Cookie is set.
+type Pin struct {
+	ID       string
+	Service  string
+	ServerID string // The ID of the service instance
+	Source   string // A client IP address or CIDR
+	Cookie   string // The value of the SidecarPin cookie
+	Author   string
+	Created  time.Time
+	Expires  time.Time
+}
+
+// Expired tells us whether the pin has run out at this time
+func (p *Pin) Expired(t time.Time) bool {
+	return !t.Before(p.Expires)
+}
+
+// A Store holds the pins in effect. OnChange is called whenever pins are
+// added, removed, or expire, and is usually the proxy's reload.
+type Store struct {
+	OnChange func()
+	pins     map[string]*Pin
+	lastID   int
+	sync.RWMutex
+}
+
+func NewStore() *Store {
+	return &Store{pins: make(map[string]*Pin)}
+}
+
+// Add validates a pin and puts it in effect, returning it with its ID. The
+// expiry defaults to DefaultDuration from now, and can't be more than
+// MaxDuration away.
+func (s *Store) Add(pin Pin) (Pin, error) {
+	if pin.Service == "" || pin.ServerID == "" {
+		return Pin{}, fmt.Errorf("Error adding pin: a service and server ID are required")
+	}
+
+	if pin.Author == "" {
+		return Pin{}, fmt.Errorf("Error adding pin: an author is required")
+	}
+
+	if (pin.Source == "") == (pin.Cookie == "") {
+		return Pin{}, fmt.Errorf("Error adding pin: exactly one of a source or cookie is required")
+	}
+
+	if pin.Source != "" {
+		source, err := normalizeSource(pin.Source)
+		if err != nil {
+			return Pin{}, fmt.Errorf("Error adding pin: %s", err)
+		}
+		pin.Source = source
+	}
+
+	if pin.Cookie != "" && !validCookie.MatchString(pin.Cookie) {
+		return Pin{}, fmt.Errorf("Error adding pin: invalid cookie value '%s'", pin.Cookie)
+	}
+
+	now := time.Now().UTC()
+	pin.Created = now
+	if pin.Expires.IsZero() {
+		pin.Expires = now.Add(DefaultDuration)
+	}
+	if pin.Expired(now) {
+		return Pin{}, fmt.Errorf("Error adding pin: already expired at %s", pin.Expires)
+	}
+	if pin.Expires.After(now.Add(MaxDuration)) {
+		return Pin{}, fmt.Errorf("Error adding pin: can't last longer than %s", MaxDuration)
+	}
+
+	s.Lock()
+	s.lastID++
+	pin.ID = strconv.Itoa(s.lastID)
+	s.pins[pin.ID] = &pin
+	s.Unlock()
+
+	log.Infof("Pinned %s%s to %s instance %s until %s (by %s)",
+		pin.Source, pin.Cookie, pin.Service, pin.ServerID, pin.Expires, pin.Author)
+
+	s.changed()
+
+	return pin, nil
+}
+
+// normalizeSource turns an IP address or CIDR into a CIDR
+func normalizeSource(source string) (string, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+
+	_, network, err := net.ParseCIDR(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid source '%s'", source)
+	}
+
+	return network.String(), nil
+}
+
+// Remove takes a pin out of effect
+func (s *Store) Remove(id string) error {
+	s.Lock()
+	if _, ok := s.pins[id]; !ok {
+		s.Unlock()
+		return fmt.Errorf("Error removing pin: no pin with ID %s", id)
+	}
+	delete(s.pins, id)
+	s.Unlock()
+
+	s.changed()
+
+	return nil
+}
+
+// Pins returns the pins in effect, oldest first
+func (s *Store) Pins() []Pin {
+	s.RLock()
+	defer s.RUnlock()
+
+	now := time.Now().UTC()
+	var result []Pin
+	for _, pin := range s.pins {
+		if !pin.Expired(now) {
+			result = append(result, *pin)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Created.Equal(result[j].Created) {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Created.Before(result[j].Created)
+	})
+
+	return result
+}
+
+// ForService returns the pins in effect for a service, oldest first
+func (s *Store) ForService(name string) []Pin {
+	var result []Pin
+	for _, pin := range s.Pins() {
+		if pin.Service == name {
+			result = append(result, pin)
+		}
+	}
+
+	return result
+}
+
+// Expire drops the pins that have run out
+func (s *Store) Expire() {
+	now := time.Now().UTC()
+	var expired bool
+
+	s.Lock()
+	for id, pin := range s.pins {
+		if pin.Expired(now) {
+			log.Infof("Pin %s of %s%s to %s expired", id, pin.Source, pin.Cookie, pin.ServerID)
+			delete(s.pins, id)
+			expired = true
+		}
+	}
+	s.Unlock()
+
+	if expired {
+		s.changed()
+	}
+}
+
+// Run drops expired pins on each iteration of the looper
+func (s *Store) Run(looper director.Looper) {
+	looper.Loop(func() error {
+		s.Expire()
+		return nil
+	})
+}
+
+func (s *Store) changed() {
+	if s.OnChange != nil {
+		s.OnChange()
+	}
+}
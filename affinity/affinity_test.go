@@ -0,0 +1,92 @@
+package affinity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Store(t *testing.T) {
+	Convey("The pin Store", t, func() {
+		store := NewStore()
+		var changes int
+		store.OnChange = func() { changes++ }
+
+		Convey("Adds pins with sequential IDs and a default expiry", func() {
+			pin, err := store.Add(Pin{Service: "web", ServerID: "deadbeef123", Source: "10.0.0.9", Author: "jane"})
+			So(err, ShouldBeNil)
+			So(pin.ID, ShouldEqual, "1")
+			So(pin.Source, ShouldEqual, "10.0.0.9/32")
+			So(pin.Expires, ShouldHappenWithin, time.Second, pin.Created.Add(DefaultDuration))
+
+			pin, err = store.Add(Pin{Service: "web", ServerID: "deadbeef123", Source: "10.1.0.0/16", Author: "jane"})
+			So(err, ShouldBeNil)
+			So(pin.ID, ShouldEqual, "2")
+
+			So(len(store.Pins()), ShouldEqual, 2)
+			So(changes, ShouldEqual, 2)
+		})
+
+		Convey("Normalizes IPv6 sources", func() {
+			pin, err := store.Add(Pin{Service: "web", ServerID: "deadbeef123", Source: "fd00::9", Author: "jane"})
+			So(err, ShouldBeNil)
+			So(pin.Source, ShouldEqual, "fd00::9/128")
+		})
+
+		Convey("Rejects invalid pins", func() {
+			valid := Pin{Service: "web", ServerID: "deadbeef123", Cookie: "tester", Author: "jane"}
+
+			noAuthor := valid
+			noAuthor.Author = ""
+			both := valid
+			both.Source = "10.0.0.9"
+			badCookie := valid
+			badCookie.Cookie = "a; b"
+			badSource := valid
+			badSource.Cookie, badSource.Source = "", "10.0.0"
+			tooLong := valid
+			tooLong.Expires = time.Now().UTC().Add(MaxDuration + time.Hour)
+			expired := valid
+			expired.Expires = time.Now().UTC().Add(-1 * time.Second)
+
+			for _, pin := range []Pin{noAuthor, both, badCookie, badSource, tooLong, expired} {
+				_, err := store.Add(pin)
+				So(err, ShouldNotBeNil)
+			}
+			So(store.Pins(), ShouldBeEmpty)
+			So(changes, ShouldEqual, 0)
+		})
+
+		Convey("Removes pins", func() {
+			pin, _ := store.Add(Pin{Service: "web", ServerID: "deadbeef123", Cookie: "tester", Author: "jane"})
+			So(store.Remove(pin.ID), ShouldBeNil)
+			So(store.Remove(pin.ID), ShouldNotBeNil)
+			So(store.Pins(), ShouldBeEmpty)
+			So(changes, ShouldEqual, 2)
+		})
+
+		Convey("Finds the pins for a service", func() {
+			store.Add(Pin{Service: "web", ServerID: "deadbeef123", Cookie: "tester", Author: "jane"})
+			store.Add(Pin{Service: "api", ServerID: "deadbeef456", Cookie: "tester", Author: "jane"})
+
+			pins := store.ForService("api")
+			So(len(pins), ShouldEqual, 1)
+			So(pins[0].ServerID, ShouldEqual, "deadbeef456")
+		})
+
+		Convey("Drops pins once they expire", func() {
+			pin, _ := store.Add(Pin{Service: "web", ServerID: "deadbeef123", Cookie: "tester", Author: "jane"})
+			store.pins[pin.ID].Expires = time.Now().UTC().Add(-1 * time.Second)
+			So(store.Pins(), ShouldBeEmpty)
+
+			store.Run(director.NewFreeLooper(director.ONCE, nil))
+			So(store.pins, ShouldBeEmpty)
+			So(changes, ShouldEqual, 2)
+
+			store.Expire()
+			So(changes, ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,83 @@
+package catalog
+
+import (
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// BootstrapInterval is how often a bootstrapping state counts the peers
+var BootstrapInterval = 250 * time.Millisecond
+
+// Bootstrap holds back what would act on an incomplete state until this
+// host has seen at least expect peers, or the timeout has passed. Until
+// then, the services of other hosts aren't tombstoned for going quiet, nor
+// when their hosts leave, and WaitForBootstrap blocks. An expect of zero
+// doesn't hold anything back. The peers are counted in the background.
+func (state *ServicesState) Bootstrap(expect int, timeout time.Duration, peers func() int) {
+	if expect < 1 {
+		return
+	}
+
+	done := make(chan struct{})
+	state.bootstrapLock.Lock()
+	state.bootstrapped = done
+	state.bootstrapLock.Unlock()
+
+	go state.countPeers(expect, timeout, peers, done)
+}
+
+// countPeers closes done once there are expect peers, or the timeout has
+// passed
+func (state *ServicesState) countPeers(expect int, timeout time.Duration, peers func() int, done chan struct{}) {
+	defer close(done)
+
+	clk := clock.OrReal(state.Clock)
+	deadline := clk.Now().Add(timeout)
+
+	for {
+		seen := peers()
+		if seen >= expect {
+			log.Infof("Bootstrapped after seeing %d of %d expected peers", seen, expect)
+			return
+		}
+
+		if !clk.Now().Before(deadline) {
+			log.Warnf("Bootstrapping anyway after %s with %d of %d expected peers", timeout, seen, expect)
+			return
+		}
+
+		<-clk.After(BootstrapInterval)
+	}
+}
+
+// Bootstrapping tells us whether the state is still waiting for its peers
+func (state *ServicesState) Bootstrapping() bool {
+	state.bootstrapLock.Lock()
+	done := state.bootstrapped
+	state.bootstrapLock.Unlock()
+
+	if done == nil {
+		return false
+	}
+
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
+// WaitForBootstrap blocks until the state has seen the peers it expects, or
+// has given up on them. It returns right away when there's no Bootstrap.
+func (state *ServicesState) WaitForBootstrap() {
+	state.bootstrapLock.Lock()
+	done := state.bootstrapped
+	state.bootstrapLock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
@@ -0,0 +1,88 @@
+package catalog
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Bootstrap(t *testing.T) {
+	Convey("Bootstrapping the state", t, func() {
+		fake := clock.NewFake(time.Now().UTC())
+		state := NewServicesState()
+		state.Hostname = hostname
+		state.Clock = fake
+
+		var peers int32
+		countPeers := func() int { return int(atomic.LoadInt32(&peers)) }
+
+		waitForCount := func() {
+			for fake.Waiters() < 1 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		waited := func() chan struct{} {
+			done := make(chan struct{})
+			go func() {
+				state.WaitForBootstrap()
+				close(done)
+			}()
+			return done
+		}
+
+		Convey("doesn't wait without an expected number of peers", func() {
+			state.Bootstrap(0, time.Minute, countPeers)
+			So(state.Bootstrapping(), ShouldBeFalse)
+			state.WaitForBootstrap()
+		})
+
+		Convey("waits until it has seen the peers it expects", func() {
+			state.Bootstrap(2, time.Minute, countPeers)
+			So(state.Bootstrapping(), ShouldBeTrue)
+			done := waited()
+
+			waitForCount()
+			atomic.StoreInt32(&peers, 2)
+			fake.Advance(BootstrapInterval)
+
+			<-done
+			So(state.Bootstrapping(), ShouldBeFalse)
+		})
+
+		Convey("gives up on them after the timeout", func() {
+			state.Bootstrap(2, time.Second, countPeers)
+			done := waited()
+
+			waitForCount()
+			fake.Advance(time.Second)
+
+			<-done
+			So(state.Bootstrapping(), ShouldBeFalse)
+		})
+
+		Convey("doesn't tombstone the services of others in the meantime", func() {
+			svc := service.Service{
+				ID: "deadbeef123", Name: "bocaccio", Hostname: anotherHostname,
+				Updated: fake.Now().Add(0 - ALIVE_LIFESPAN - 5*time.Second),
+			}
+			state.AddServiceEntry(svc)
+			state.Bootstrap(2, time.Minute, countPeers)
+
+			So(state.TombstoneOthersServices(), ShouldBeEmpty)
+			state.ExpireServer(anotherHostname)
+			So(state.Servers[anotherHostname].Services[svc.ID].IsAlive(), ShouldBeTrue)
+
+			waitForCount()
+			atomic.StoreInt32(&peers, 2)
+			fake.Advance(BootstrapInterval)
+			state.WaitForBootstrap()
+
+			So(state.TombstoneOthersServices(), ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,261 @@
+package catalog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultChangeLogSize          = 1000     // Changes kept in memory
+	DefaultChangeLogSpillMaxBytes = 10 << 20 // How big the spill file gets before it's moved aside
+)
+
+// A LoggedChange is one change to the state, as recorded in the ChangeLog
+type LoggedChange struct {
+	Index          uint64    // The state version the change took it to
+	Time           time.Time // When this host made the change
+	Service        service.Service
+	PreviousStatus int
+}
+
+// A ChangeReplay is a run of changes from the ChangeLog
+type ChangeReplay struct {
+	Changes   []LoggedChange
+	Oldest    uint64 // The oldest index still in the log
+	Latest    uint64 // The latest index in the log
+	Truncated bool   // Some of the changes asked for are no longer in the log
+	More      bool   // There are more changes after these, past the limit
+}
+
+// A ChangeLog records every change to the state, in order, so that how the
+// state got to where it is can be replayed. The latest changes are kept in
+// memory. If there is a SpillFile, the older ones are appended to it as they
+// are evicted, one JSON object per line. Once the file grows past
+// SpillMaxBytes it's moved to SpillFile + ".1", replacing the one before.
+type ChangeLog struct {
+	SpillFile     string
+	SpillMaxBytes int64
+	changes       []LoggedChange
+	start         int
+	count         int
+	latest        uint64
+	spill         *os.File
+	spillBytes    int64
+	spillOldest   uint64 // The oldest index still on disk, zero for none
+	spillFirst    uint64 // The first index in the current SpillFile
+	sync.RWMutex
+}
+
+// NewChangeLog returns a ChangeLog that keeps up to size changes in memory
+func NewChangeLog(size int) *ChangeLog {
+	if size < 1 {
+		size = DefaultChangeLogSize
+	}
+
+	return &ChangeLog{
+		SpillMaxBytes: DefaultChangeLogSpillMaxBytes,
+		changes:       make([]LoggedChange, size),
+	}
+}
+
+// Record appends a change to the log
+func (l *ChangeLog) Record(change LoggedChange) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.count == len(l.changes) {
+		l.spillOne(l.changes[l.start])
+		l.changes[l.start] = LoggedChange{}
+		l.start = (l.start + 1) % len(l.changes)
+		l.count--
+	}
+
+	l.changes[(l.start+l.count)%len(l.changes)] = change
+	l.count++
+	l.latest = change.Index
+}
+
+// Since returns up to limit changes, oldest first, starting at the index
+// passed in. Changes that were evicted from memory are read back from the
+// SpillFile, if there is one. A limit of zero means no limit.
+func (l *ChangeLog) Since(index uint64, limit int) (*ChangeReplay, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	replay := &ChangeReplay{Latest: l.latest, Changes: []LoggedChange{}}
+	if l.count > 0 {
+		replay.Oldest = l.changes[l.start].Index
+	}
+
+	// Returns true when we've hit the limit
+	add := func(change LoggedChange) bool {
+		if change.Index < index {
+			return false
+		}
+		if limit > 0 && len(replay.Changes) >= limit {
+			replay.More = true
+			return true
+		}
+		replay.Changes = append(replay.Changes, change)
+		return false
+	}
+
+	if l.spillOldest > 0 {
+		replay.Oldest = l.spillOldest
+		if index < l.firstInMemory() {
+			for _, file := range []string{l.SpillFile + ".1", l.SpillFile} {
+				done, err := readSpilled(file, add)
+				if err != nil {
+					return nil, err
+				}
+				if done {
+					break
+				}
+			}
+		}
+	}
+
+	if !replay.More {
+		for i := 0; i < l.count; i++ {
+			if add(l.changes[(l.start+i)%len(l.changes)]) {
+				break
+			}
+		}
+	}
+
+	// Versions start at 1, so anything from before the oldest we have is lost
+	replay.Truncated = replay.Oldest > 1 && index < replay.Oldest
+
+	return replay, nil
+}
+
+// firstInMemory returns the oldest index still in memory. Must be called
+// while holding the lock.
+func (l *ChangeLog) firstInMemory() uint64 {
+	if l.count < 1 {
+		return l.latest + 1
+	}
+	return l.changes[l.start].Index
+}
+
+// spillOne appends an evicted change to the SpillFile, moving the file aside
+// when it's full. Changes are dropped when there is no SpillFile, or it can't
+// be written. Must be called while holding the lock.
+func (l *ChangeLog) spillOne(change LoggedChange) {
+	if l.SpillFile == "" {
+		metrics.IncrCounter([]string{"change_log", "evicted"}, 1)
+		return
+	}
+
+	err := l.openSpill()
+	if err == nil && l.SpillMaxBytes > 0 && l.spillBytes >= l.SpillMaxBytes {
+		err = l.rotateSpill()
+	}
+	if err != nil {
+		log.Errorf("Error spilling state change %d: %s", change.Index, err)
+		metrics.IncrCounter([]string{"change_log", "errors"}, 1)
+		return
+	}
+
+	encoded, err := json.Marshal(&change)
+	if err != nil {
+		log.Errorf("Error encoding state change %d: %s", change.Index, err)
+		metrics.IncrCounter([]string{"change_log", "errors"}, 1)
+		return
+	}
+
+	written, err := l.spill.Write(append(encoded, '\n'))
+	l.spillBytes += int64(written)
+	if err != nil {
+		log.Errorf("Error spilling state change %d: %s", change.Index, err)
+		metrics.IncrCounter([]string{"change_log", "errors"}, 1)
+		return
+	}
+
+	if l.spillFirst == 0 {
+		l.spillFirst = change.Index
+	}
+	if l.spillOldest == 0 {
+		l.spillOldest = change.Index
+	}
+}
+
+// openSpill opens the SpillFile the first time it's needed. What's left in
+// it from a previous run is from another set of versions, so it's thrown
+// away. Must be called while holding the lock.
+func (l *ChangeLog) openSpill() error {
+	if l.spill != nil {
+		return nil
+	}
+
+	os.Remove(l.SpillFile + ".1")
+	spill, err := os.OpenFile(l.SpillFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening change log spill file %s: %s", l.SpillFile, err)
+	}
+	l.spill = spill
+
+	return nil
+}
+
+// rotateSpill moves the full SpillFile aside and starts a new one. Must be
+// called while holding the lock.
+func (l *ChangeLog) rotateSpill() error {
+	l.spill.Close()
+	l.spill = nil
+
+	if err := os.Rename(l.SpillFile, l.SpillFile+".1"); err != nil {
+		return fmt.Errorf("Error rotating change log spill file %s: %s", l.SpillFile, err)
+	}
+
+	spill, err := os.OpenFile(l.SpillFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening change log spill file %s: %s", l.SpillFile, err)
+	}
+
+	l.spill = spill
+	l.spillBytes = 0
+	l.spillOldest = l.spillFirst
+	l.spillFirst = 0
+
+	return nil
+}
+
+// readSpilled passes the changes in a spill file to fn, oldest first, until
+// fn returns true. A missing file has no changes in it.
+func readSpilled(file string, fn func(LoggedChange) bool) (bool, error) {
+	spill, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error reading change log spill file %s: %s", file, err)
+	}
+	defer spill.Close()
+
+	scanner := bufio.NewScanner(spill)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var change LoggedChange
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return false, fmt.Errorf("Error decoding change log spill file %s: %s", file, err)
+		}
+		if fn(change) {
+			return true, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("Error reading change log spill file %s: %s", file, err)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,123 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ChangeLog(t *testing.T) {
+	Convey("The ChangeLog", t, func() {
+		changeLog := NewChangeLog(3)
+
+		// Records changes with the indexes passed in
+		record := func(indexes ...uint64) {
+			for _, index := range indexes {
+				changeLog.Record(LoggedChange{
+					Index:   index,
+					Service: service.Service{ID: "deadbeef123", Name: "bocaccio"},
+				})
+			}
+		}
+
+		// Returns the indexes of the changes in a replay
+		indexesOf := func(replay *ChangeReplay) []uint64 {
+			var indexes []uint64
+			for _, change := range replay.Changes {
+				indexes = append(indexes, change.Index)
+			}
+			return indexes
+		}
+
+		Convey("replays the changes from an index", func() {
+			record(1, 2, 3)
+
+			replay, err := changeLog.Since(2, 0)
+			So(err, ShouldBeNil)
+			So(indexesOf(replay), ShouldResemble, []uint64{2, 3})
+			So(replay.Oldest, ShouldEqual, 1)
+			So(replay.Latest, ShouldEqual, 3)
+			So(replay.Truncated, ShouldBeFalse)
+			So(replay.More, ShouldBeFalse)
+		})
+
+		Convey("stops at the limit", func() {
+			record(1, 2, 3)
+
+			replay, _ := changeLog.Since(0, 2)
+			So(indexesOf(replay), ShouldResemble, []uint64{1, 2})
+			So(replay.More, ShouldBeTrue)
+		})
+
+		Convey("says when the changes asked for were evicted", func() {
+			record(1, 2, 3, 4, 5)
+
+			replay, _ := changeLog.Since(1, 0)
+			So(indexesOf(replay), ShouldResemble, []uint64{3, 4, 5})
+			So(replay.Oldest, ShouldEqual, 3)
+			So(replay.Truncated, ShouldBeTrue)
+		})
+
+		Convey("with a spill file", func() {
+			dir, _ := ioutil.TempDir("", "change-log")
+			defer os.RemoveAll(dir)
+			changeLog.SpillFile = filepath.Join(dir, "changes.json")
+
+			Convey("reads the evicted changes back from it", func() {
+				record(1, 2, 3, 4, 5)
+
+				replay, err := changeLog.Since(2, 0)
+				So(err, ShouldBeNil)
+				So(indexesOf(replay), ShouldResemble, []uint64{2, 3, 4, 5})
+				So(replay.Oldest, ShouldEqual, 1)
+				So(replay.Truncated, ShouldBeFalse)
+				So(replay.Changes[0].Service.Name, ShouldEqual, "bocaccio")
+			})
+
+			Convey("moves it aside when it's full", func() {
+				changeLog.SpillMaxBytes = 1
+				record(1, 2, 3, 4, 5, 6)
+
+				// 1 was in the file moved aside, then replaced
+				replay, err := changeLog.Since(0, 0)
+				So(err, ShouldBeNil)
+				So(indexesOf(replay), ShouldResemble, []uint64{2, 3, 4, 5, 6})
+				So(replay.Oldest, ShouldEqual, 2)
+				So(replay.Truncated, ShouldBeTrue)
+			})
+
+			Convey("throws away what's left from a previous run", func() {
+				ioutil.WriteFile(changeLog.SpillFile, []byte("not json\n"), 0644)
+				record(1, 2, 3, 4)
+
+				replay, err := changeLog.Since(0, 0)
+				So(err, ShouldBeNil)
+				So(indexesOf(replay), ShouldResemble, []uint64{1, 2, 3, 4})
+			})
+		})
+	})
+
+	Convey("The state records its changes in the ChangeLog", t, func() {
+		state := NewServicesState()
+		state.ChangeLog = NewChangeLog(10)
+
+		svc := service.Service{ID: "deadbeef123", Name: "bocaccio", Hostname: hostname, Updated: time.Now().UTC()}
+		state.AddServiceEntry(svc)
+
+		svc.Status = service.UNHEALTHY
+		svc.Updated = svc.Updated.Add(time.Second)
+		state.AddServiceEntry(svc)
+
+		replay, err := state.ChangeLog.Since(0, 0)
+		So(err, ShouldBeNil)
+		So(replay.Changes, ShouldHaveLength, 2)
+		So(replay.Changes[1].Index, ShouldEqual, state.Version())
+		So(replay.Changes[1].PreviousStatus, ShouldEqual, service.ALIVE)
+		So(replay.Changes[1].Service.Status, ShouldEqual, service.UNHEALTHY)
+	})
+}
@@ -0,0 +1,230 @@
+package catalog
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+// A scheduled drain puts the instances of a service on this host into
+// DRAINING at a set time, ahead of maintenance, and ends it after a while.
+// The drained records carry the end with them, so once it has passed every
+// host in the cluster takes the instances back when they are next announced
+// alive, not only this one.
+
+const (
+	// How often RunScheduledDrains looks for drains that are due
+	DrainCheckInterval = 10 * time.Second
+	// How long a drain lasts unless it says otherwise
+	DefaultDrainDuration = 30 * time.Minute
+	// The longest a drain can last
+	MaxDrainDuration = 24 * time.Hour
+	// How far ahead a drain can be scheduled
+	MaxDrainLeadTime = 7 * 24 * time.Hour
+)
+
+// A ScheduledDrain is a drain of the local instances of a service, from
+// Start until End
+type ScheduledDrain struct {
+	ID        string
+	Service   string
+	Start     time.Time
+	End       time.Time
+	Author    string
+	Reason    string
+	Created   time.Time
+	Started   bool     // Whether the instances have been drained yet
+	Instances []string // The IDs of the instances it drained
+}
+
+// Ended tells us whether the drain is over at this time
+func (d *ScheduledDrain) Ended(t time.Time) bool {
+	return !t.Before(d.End)
+}
+
+// ScheduleDrain queues a drain of the local instances of a service. It
+// starts now if Start isn't set, and lasts DefaultDrainDuration if End isn't.
+func (state *ServicesState) ScheduleDrain(drain ScheduledDrain) (ScheduledDrain, error) {
+	if drain.Service == "" || drain.Author == "" {
+		return ScheduledDrain{}, fmt.Errorf("Error scheduling drain: a service and an author are required")
+	}
+
+	now := state.now()
+	drain.Created = now
+	drain.Started = false
+	drain.Instances = nil
+	if drain.Start.IsZero() {
+		drain.Start = now
+	}
+	if drain.End.IsZero() {
+		drain.End = drain.Start.Add(DefaultDrainDuration)
+	}
+	if !drain.End.After(drain.Start) {
+		return ScheduledDrain{}, fmt.Errorf("Error scheduling drain of %s: it has to end after it starts", drain.Service)
+	}
+	if drain.Ended(now) {
+		return ScheduledDrain{}, fmt.Errorf("Error scheduling drain of %s: already ended at %s", drain.Service, drain.End)
+	}
+	if drain.End.Sub(drain.Start) > MaxDrainDuration {
+		return ScheduledDrain{}, fmt.Errorf("Error scheduling drain of %s: can't last longer than %s", drain.Service, MaxDrainDuration)
+	}
+	if drain.Start.After(now.Add(MaxDrainLeadTime)) {
+		return ScheduledDrain{}, fmt.Errorf("Error scheduling drain of %s: can't start more than %s from now", drain.Service, MaxDrainLeadTime)
+	}
+
+	state.drainLock.Lock()
+	if state.drains == nil {
+		state.drains = make(map[string]*ScheduledDrain)
+	}
+	state.lastDrainID++
+	drain.ID = strconv.Itoa(state.lastDrainID)
+	state.drains[drain.ID] = &drain
+	state.drainLock.Unlock()
+
+	log.Infof("Scheduled drain %s of %s from %s until %s (by %s): %s",
+		drain.ID, drain.Service, drain.Start, drain.End, drain.Author, drain.Reason)
+
+	return drain, nil
+}
+
+// CancelDrain removes a scheduled drain. If it already started, it ends it
+// now, and the instances come back when they are next announced alive.
+func (state *ServicesState) CancelDrain(id string) error {
+	state.drainLock.Lock()
+	drain, ok := state.drains[id]
+	delete(state.drains, id)
+	state.drainLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Error cancelling drain: no drain %s is scheduled", id)
+	}
+
+	if drain.Started {
+		now := state.now()
+		for _, svc := range state.localInstances(drain.Instances) {
+			if svc.IsDraining() && svc.DrainedUntil != nil && svc.DrainedUntil.Equal(drain.End) {
+				svc.DrainedUntil = &now
+				svc.Updated = now
+				state.UpdateService(svc)
+			}
+		}
+	}
+
+	log.Infof("Cancelled drain %s of %s", drain.ID, drain.Service)
+
+	return nil
+}
+
+// ScheduledDrains returns the drains that haven't ended, soonest first.
+// The ones that have are dropped.
+func (state *ServicesState) ScheduledDrains() []ScheduledDrain {
+	state.drainLock.Lock()
+	defer state.drainLock.Unlock()
+
+	now := state.now()
+	result := make([]ScheduledDrain, 0, len(state.drains))
+	for id, drain := range state.drains {
+		if drain.Ended(now) {
+			delete(state.drains, id)
+			continue
+		}
+		result = append(result, *drain)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Start.Equal(result[j].Start) {
+			return result[i].Start.Before(result[j].Start)
+		}
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+// StartScheduledDrains drains the local instances of the services whose
+// drains are due. Instances that are already draining for good are left as
+// they are, so a drain ending doesn't bring them back.
+func (state *ServicesState) StartScheduledDrains() {
+	now := state.now()
+
+	var due []ScheduledDrain
+	for _, drain := range state.ScheduledDrains() {
+		if !drain.Started && !now.Before(drain.Start) {
+			due = append(due, drain)
+		}
+	}
+
+	for _, drain := range due {
+		var drained []string
+		for _, svc := range state.localServicesNamed(drain.Service) {
+			if svc.IsTombstone() || (svc.IsDraining() && svc.DrainedUntil == nil) {
+				continue
+			}
+
+			end := drain.End
+			svc.Status = service.DRAINING
+			svc.DrainedUntil = &end
+			svc.Updated = now
+			state.UpdateService(svc)
+
+			drained = append(drained, svc.ID)
+		}
+
+		if len(drained) < 1 {
+			log.Warnf("Scheduled drain %s found no instances of %s to drain", drain.ID, drain.Service)
+		} else {
+			log.Warnf("Scheduled drain %s drained %d instances of %s until %s (by %s): %s",
+				drain.ID, len(drained), drain.Service, drain.End, drain.Author, drain.Reason)
+		}
+
+		state.drainLock.Lock()
+		if scheduled, ok := state.drains[drain.ID]; ok {
+			scheduled.Started = true
+			scheduled.Instances = drained
+		}
+		state.drainLock.Unlock()
+	}
+}
+
+// RunScheduledDrains starts the drains that are due on each iteration of
+// the looper
+func (state *ServicesState) RunScheduledDrains(looper director.Looper) {
+	looper.Loop(func() error {
+		state.StartScheduledDrains()
+		return nil
+	})
+}
+
+// localServicesNamed returns copies of the local instances of a service
+func (state *ServicesState) localServicesNamed(name string) []service.Service {
+	state.RLock()
+	defer state.RUnlock()
+
+	var result []service.Service
+	if server, ok := state.Servers[state.Hostname]; ok {
+		for _, svc := range server.Services {
+			if svc.Name == name {
+				result = append(result, *svc)
+			}
+		}
+	}
+
+	return result
+}
+
+// localInstances returns copies of the local instances with these IDs
+func (state *ServicesState) localInstances(ids []string) []service.Service {
+	var result []service.Service
+	for _, id := range ids {
+		if svc, err := state.GetLocalServiceByID(id); err == nil {
+			result = append(result, svc)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,133 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ScheduledDrains(t *testing.T) {
+	Convey("Scheduled drains", t, func() {
+		fake := clock.NewFake(time.Now().UTC())
+		state := NewServicesState()
+		state.Hostname = hostname
+		state.Clock = fake
+
+		svc := service.Service{ID: "deadbeef123", Name: "bocaccio", Hostname: hostname, Updated: fake.Now()}
+		state.AddServiceEntry(svc)
+
+		// Applies the updates queued for the state
+		processMsgs := func() {
+			for len(state.ServiceMsgs) > 0 {
+				state.AddServiceEntry(<-state.ServiceMsgs)
+			}
+		}
+
+		// Returns the local instance as the state has it now
+		current := func() service.Service {
+			found, _ := state.GetLocalServiceByID(svc.ID)
+			return found
+		}
+
+		// Announces the instance again a second later, as discovery does
+		announce := func() {
+			fake.Advance(time.Second)
+			svc.Updated = fake.Now()
+			state.AddServiceEntry(svc)
+		}
+
+		Convey("drain the local instances when they're due", func() {
+			drain, err := state.ScheduleDrain(ScheduledDrain{
+				Service: "bocaccio", Author: "jane", Start: fake.Now().Add(time.Hour),
+			})
+			So(err, ShouldBeNil)
+			So(drain.ID, ShouldEqual, "1")
+			So(drain.End, ShouldEqual, drain.Start.Add(DefaultDrainDuration))
+
+			state.StartScheduledDrains()
+			processMsgs()
+			So(current().Status, ShouldEqual, service.ALIVE)
+
+			fake.Advance(time.Hour)
+			state.StartScheduledDrains()
+			processMsgs()
+			So(current().Status, ShouldEqual, service.DRAINING)
+			So(*current().DrainedUntil, ShouldEqual, drain.End)
+
+			drains := state.ScheduledDrains()
+			So(drains[0].Started, ShouldBeTrue)
+			So(drains[0].Instances, ShouldResemble, []string{"deadbeef123"})
+
+			Convey("and keep them draining while it lasts", func() {
+				fake.Advance(time.Minute)
+				announce()
+				So(current().Status, ShouldEqual, service.DRAINING)
+				So(*current().DrainedUntil, ShouldEqual, drain.End)
+			})
+
+			Convey("and take them back once it ends", func() {
+				fake.Advance(DefaultDrainDuration)
+				So(state.ScheduledDrains(), ShouldBeEmpty)
+
+				announce()
+				So(current().Status, ShouldEqual, service.ALIVE)
+				So(current().DrainedUntil, ShouldBeNil)
+			})
+
+			Convey("and take them back when it's cancelled", func() {
+				fake.Advance(time.Minute)
+				So(state.CancelDrain(drain.ID), ShouldBeNil)
+				So(state.CancelDrain(drain.ID), ShouldNotBeNil)
+				processMsgs()
+
+				announce()
+				So(current().Status, ShouldEqual, service.ALIVE)
+			})
+		})
+
+		Convey("leave instances that were drained for good alone", func() {
+			svc.Status = service.DRAINING
+			announce()
+
+			state.ScheduleDrain(ScheduledDrain{Service: "bocaccio", Author: "jane"})
+			state.StartScheduledDrains()
+			processMsgs()
+			So(current().DrainedUntil, ShouldBeNil)
+
+			fake.Advance(DefaultDrainDuration)
+			svc.Status = service.ALIVE
+			announce()
+			So(current().Status, ShouldEqual, service.DRAINING)
+		})
+
+		Convey("show up in the formatted state", func() {
+			state.ScheduleDrain(ScheduledDrain{Service: "bocaccio", Author: "jane", Start: fake.Now().Add(time.Hour)})
+			output := state.Format(nil)
+			So(output, ShouldContainSubstring, "Scheduled Drains")
+			So(output, ShouldContainSubstring, "scheduled")
+		})
+
+		Convey("are validated", func() {
+			_, err := state.ScheduleDrain(ScheduledDrain{Service: "bocaccio"})
+			So(err, ShouldNotBeNil)
+
+			_, err = state.ScheduleDrain(ScheduledDrain{
+				Service: "bocaccio", Author: "jane", End: fake.Now().Add(-time.Minute),
+			})
+			So(err, ShouldNotBeNil)
+
+			_, err = state.ScheduleDrain(ScheduledDrain{
+				Service: "bocaccio", Author: "jane", End: fake.Now().Add(MaxDrainDuration + time.Minute),
+			})
+			So(err, ShouldNotBeNil)
+
+			_, err = state.ScheduleDrain(ScheduledDrain{
+				Service: "bocaccio", Author: "jane", Start: fake.Now().Add(MaxDrainLeadTime + time.Minute),
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,133 @@
+package catalog
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NinesStack/sidecar/service"
+)
+
+// Several hosts can announce the same service on behalf of another host,
+// e.g. an external dependency that each of them health checks. Each of those
+// reports carries the name of the host that made it, in the Reporter field.
+// Rather than letting one host with a network problem flap routing for
+// everyone, the reports for the same endpoint are merged: it is alive as
+// long as at least half of the hosts that report on it see it alive.
+
+// An Opinion is the merged view of the hosts reporting on an endpoint
+type Opinion struct {
+	Name      string
+	Hostname  string
+	Status    string            // The merged status
+	Alive     int               // How many hosts see it alive...
+	Total     int               // ...out of how many are reporting on it
+	Reporters map[string]string // The status each host sees
+}
+
+// endpointKey identifies the endpoint that a report is about
+func endpointKey(svc *service.Service) string {
+	ports := make([]string, 0, len(svc.Ports))
+	for _, port := range svc.Ports {
+		ports = append(ports, port.IP+":"+strconv.FormatInt(port.Port, 10))
+	}
+	sort.Strings(ports)
+
+	return svc.Name + "/" + svc.Hostname + "/" + strings.Join(ports, ",")
+}
+
+// reports groups the reported services by the endpoint they are about. Must
+// be called while holding at least a read lock.
+func (state *ServicesState) reports() map[string][]*service.Service {
+	groups := make(map[string][]*service.Service)
+
+	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		if svc.Reporter == "" {
+			return
+		}
+		key := endpointKey(svc)
+		groups[key] = append(groups[key], svc)
+	})
+
+	return groups
+}
+
+// mergeReports returns a copy of the newest report with the merged status.
+// Tombstoned reports don't get a say, unless there is nothing else.
+func mergeReports(reports []*service.Service) (*service.Service, *Opinion) {
+	newest := reports[0]
+	for _, svc := range reports {
+		if svc.Updated.After(newest.Updated) {
+			newest = svc
+		}
+	}
+
+	opinion := &Opinion{
+		Name:      newest.Name,
+		Hostname:  newest.Hostname,
+		Reporters: make(map[string]string, len(reports)),
+	}
+
+	var newestDown *service.Service
+	for _, svc := range reports {
+		opinion.Reporters[svc.Reporter] = svc.StatusString()
+		if svc.IsTombstone() {
+			continue
+		}
+
+		opinion.Total++
+		if svc.IsAlive() {
+			opinion.Alive++
+		} else if newestDown == nil || svc.Updated.After(newestDown.Updated) {
+			newestDown = svc
+		}
+	}
+
+	merged := *newest
+	switch {
+	case opinion.Total == 0:
+		// All tombstones, leave it be
+	case opinion.Alive*2 >= opinion.Total:
+		merged.Status = service.ALIVE
+	default:
+		merged.Status = newestDown.Status
+	}
+	opinion.Status = merged.StatusString()
+
+	return &merged, opinion
+}
+
+// Opinions returns the merged view of every endpoint that is reported on by
+// other hosts, sorted by name and hostname
+func (state *ServicesState) Opinions() []Opinion {
+	var opinions []Opinion
+	for _, reports := range state.reports() {
+		_, opinion := mergeReports(reports)
+		opinions = append(opinions, *opinion)
+	}
+
+	sort.Slice(opinions, func(i, j int) bool {
+		if opinions[i].Name == opinions[j].Name {
+			return opinions[i].Hostname < opinions[j].Hostname
+		}
+		return opinions[i].Name < opinions[j].Name
+	})
+
+	return opinions
+}
+
+// EachServiceMerged is like EachService, but calls fn once for each endpoint
+// that other hosts report on, with a copy of the newest report that has the
+// merged status. This is the view that should be used for routing.
+func (state *ServicesState) EachServiceMerged(fn func(hostname *string, serviceId *string, svc *service.Service)) {
+	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		if svc.Reporter == "" {
+			fn(hostname, serviceId, svc)
+		}
+	})
+
+	for _, reports := range state.reports() {
+		merged, _ := mergeReports(reports)
+		fn(&merged.Hostname, &merged.ID, merged)
+	}
+}
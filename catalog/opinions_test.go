@@ -0,0 +1,76 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Opinions(t *testing.T) {
+	Convey("Merging the opinions of hosts reporting on an endpoint", t, func() {
+		state := NewServicesState()
+		baseTime := time.Now().UTC().Round(time.Second)
+		ports := []service.Port{{Type: "tcp", Port: 5432, ServicePort: 5432, IP: "10.1.1.1"}}
+
+		report := func(id string, reporter string, status int, age time.Duration) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: "postgres", Hostname: "db-external", Reporter: reporter,
+				Status: status, Ports: ports, Updated: baseTime.Add(-age),
+			})
+		}
+
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef001", Name: "web", Hostname: "chaucer", Updated: baseTime,
+		})
+
+		mergedServices := func() []*service.Service {
+			var services []*service.Service
+			state.EachServiceMerged(func(hostname *string, id *string, svc *service.Service) {
+				services = append(services, svc)
+			})
+			return services
+		}
+
+		Convey("marks the endpoint down when most hosts see it down", func() {
+			report("deadbeef101", "alpha", service.ALIVE, 0)
+			report("deadbeef102", "beta", service.UNHEALTHY, time.Second)
+			report("deadbeef103", "gamma", service.UNHEALTHY, 2*time.Second)
+
+			opinions := state.Opinions()
+			So(len(opinions), ShouldEqual, 1)
+			So(opinions[0].Alive, ShouldEqual, 1)
+			So(opinions[0].Total, ShouldEqual, 3)
+			So(opinions[0].Status, ShouldEqual, "Unhealthy")
+			So(opinions[0].Reporters["beta"], ShouldEqual, "Unhealthy")
+
+			services := mergedServices()
+			So(len(services), ShouldEqual, 2)
+			So(len(state.ByService()["postgres"]), ShouldEqual, 1)
+			So(state.ByService()["postgres"][0].Status, ShouldEqual, service.UNHEALTHY)
+		})
+
+		Convey("keeps the endpoint up when one host sees it down", func() {
+			report("deadbeef101", "alpha", service.ALIVE, time.Second)
+			report("deadbeef102", "beta", service.UNHEALTHY, 0)
+
+			So(state.Opinions()[0].Status, ShouldEqual, "Alive")
+			So(state.ByService()["postgres"][0].Status, ShouldEqual, service.ALIVE)
+			So(state.ByService()["postgres"][0].ID, ShouldEqual, "deadbeef102") // The newest
+		})
+
+		Convey("doesn't count tombstoned reports", func() {
+			report("deadbeef101", "alpha", service.TOMBSTONE, 0)
+			report("deadbeef102", "beta", service.UNHEALTHY, time.Second)
+
+			So(state.Opinions()[0].Total, ShouldEqual, 1)
+			So(state.Opinions()[0].Status, ShouldEqual, "Unhealthy")
+		})
+
+		Convey("leaves services without a reporter alone", func() {
+			So(state.Opinions(), ShouldBeEmpty)
+			So(len(mergedServices()), ShouldEqual, 1)
+		})
+	})
+}
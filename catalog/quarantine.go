@@ -0,0 +1,142 @@
+package catalog
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// A peer with a broken clock or bad discovery data can keep pushing records
+// that are wrong, and newer than the right ones. Quarantining it ignores the
+// updates to the records it owns, or reports on, until the quarantine is
+// lifted or expires. The records we already had from it age out as usual.
+// Gossip doesn't tell us which peer passed an update on, so it's the origin
+// of the records that counts, not the peer that relayed them.
+
+const (
+	// How long a quarantine lasts unless it says otherwise
+	DefaultQuarantineDuration = 30 * time.Minute
+	// The longest a quarantine can last
+	MaxQuarantineDuration = 24 * time.Hour
+)
+
+// A Quarantine is a peer whose updates are being ignored
+type Quarantine struct {
+	Hostname string
+	Reason   string
+	Author   string
+	Created  time.Time
+	Expires  time.Time
+	Ignored  int // How many updates have been ignored so far
+}
+
+// Expired tells us whether the quarantine has run out at this time
+func (q *Quarantine) Expired(t time.Time) bool {
+	return !t.Before(q.Expires)
+}
+
+// QuarantinePeer starts ignoring the updates from a peer, replacing any
+// quarantine it was already in. The expiry defaults to
+// DefaultQuarantineDuration from now, and can't be more than
+// MaxQuarantineDuration away. Our own host can't be quarantined.
+func (state *ServicesState) QuarantinePeer(quarantine Quarantine) (Quarantine, error) {
+	if quarantine.Hostname == "" || quarantine.Author == "" {
+		return Quarantine{}, fmt.Errorf("Error quarantining peer: a hostname and an author are required")
+	}
+	if quarantine.Hostname == state.Hostname {
+		return Quarantine{}, fmt.Errorf("Error quarantining peer: %s is this host", quarantine.Hostname)
+	}
+
+	now := state.now()
+	quarantine.Created = now
+	quarantine.Ignored = 0
+	if quarantine.Expires.IsZero() {
+		quarantine.Expires = now.Add(DefaultQuarantineDuration)
+	}
+	if quarantine.Expired(now) {
+		return Quarantine{}, fmt.Errorf("Error quarantining peer %s: already expired at %s", quarantine.Hostname, quarantine.Expires)
+	}
+	if quarantine.Expires.After(now.Add(MaxQuarantineDuration)) {
+		return Quarantine{}, fmt.Errorf("Error quarantining peer %s: can't last longer than %s", quarantine.Hostname, MaxQuarantineDuration)
+	}
+
+	state.quarantineLock.Lock()
+	if state.quarantines == nil {
+		state.quarantines = make(map[string]*Quarantine)
+	}
+	state.quarantines[quarantine.Hostname] = &quarantine
+	state.quarantineLock.Unlock()
+
+	log.Warnf("Quarantined peer %s until %s (by %s): %s",
+		quarantine.Hostname, quarantine.Expires, quarantine.Author, quarantine.Reason)
+
+	return quarantine, nil
+}
+
+// ReleasePeer lifts the quarantine on a peer before it expires
+func (state *ServicesState) ReleasePeer(hostname string) error {
+	state.quarantineLock.Lock()
+	defer state.quarantineLock.Unlock()
+
+	if _, ok := state.quarantines[hostname]; !ok {
+		return fmt.Errorf("Error releasing peer: %s is not quarantined", hostname)
+	}
+	delete(state.quarantines, hostname)
+
+	log.Warnf("Released peer %s from quarantine", hostname)
+
+	return nil
+}
+
+// Quarantines returns the quarantines still in effect, sorted by hostname
+func (state *ServicesState) Quarantines() []Quarantine {
+	state.quarantineLock.Lock()
+	defer state.quarantineLock.Unlock()
+
+	now := state.now()
+	result := make([]Quarantine, 0, len(state.quarantines))
+	for _, quarantine := range state.quarantines {
+		if !quarantine.Expired(now) {
+			result = append(result, *quarantine)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Hostname < result[j].Hostname })
+
+	return result
+}
+
+// quarantined tells us whether an update comes from a quarantined peer, and
+// counts it if it does. Quarantines that have expired are dropped.
+func (state *ServicesState) quarantined(svc *service.Service) bool {
+	state.quarantineLock.Lock()
+	defer state.quarantineLock.Unlock()
+
+	if len(state.quarantines) < 1 {
+		return false
+	}
+
+	now := state.now()
+	for _, hostname := range []string{svc.Hostname, svc.Reporter} {
+		quarantine, ok := state.quarantines[hostname]
+		if !ok {
+			continue
+		}
+
+		if quarantine.Expired(now) {
+			log.Warnf("Quarantine of peer %s expired after ignoring %d updates", hostname, quarantine.Ignored)
+			delete(state.quarantines, hostname)
+			continue
+		}
+
+		quarantine.Ignored++
+		metrics.IncrCounter([]string{"services_state", "quarantined"}, 1)
+		return true
+	}
+
+	return false
+}
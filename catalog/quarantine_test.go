@@ -0,0 +1,74 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Quarantine(t *testing.T) {
+	Convey("Quarantining peers", t, func() {
+		fake := clock.NewFake(time.Now().UTC())
+		state := NewServicesState()
+		state.Hostname = hostname
+		state.Clock = fake
+
+		svc := service.Service{ID: "deadbeef123", Name: "bocaccio", Hostname: anotherHostname, Updated: fake.Now()}
+
+		Convey("ignores the updates from the peer", func() {
+			_, err := state.QuarantinePeer(Quarantine{Hostname: anotherHostname, Author: "jane"})
+			So(err, ShouldBeNil)
+
+			state.AddServiceEntry(svc)
+			So(state.HasServer(anotherHostname), ShouldBeFalse)
+			So(state.Quarantines()[0].Ignored, ShouldEqual, 1)
+		})
+
+		Convey("ignores the reports the peer makes on other hosts", func() {
+			state.QuarantinePeer(Quarantine{Hostname: anotherHostname, Author: "jane"})
+
+			svc.Hostname = "gower"
+			svc.Reporter = anotherHostname
+			state.AddServiceEntry(svc)
+			So(state.HasServer("gower"), ShouldBeFalse)
+		})
+
+		Convey("takes the updates again once released", func() {
+			state.QuarantinePeer(Quarantine{Hostname: anotherHostname, Author: "jane"})
+			So(state.ReleasePeer(anotherHostname), ShouldBeNil)
+			So(state.ReleasePeer(anotherHostname), ShouldNotBeNil)
+
+			state.AddServiceEntry(svc)
+			So(state.HasServer(anotherHostname), ShouldBeTrue)
+		})
+
+		Convey("takes the updates again once it expires", func() {
+			quarantine, _ := state.QuarantinePeer(Quarantine{Hostname: anotherHostname, Author: "jane"})
+			So(quarantine.Expires, ShouldEqual, fake.Now().Add(DefaultQuarantineDuration))
+
+			fake.Advance(DefaultQuarantineDuration)
+			So(state.Quarantines(), ShouldBeEmpty)
+
+			svc.Updated = fake.Now()
+			state.AddServiceEntry(svc)
+			So(state.HasServer(anotherHostname), ShouldBeTrue)
+		})
+
+		Convey("validates the quarantine", func() {
+			_, err := state.QuarantinePeer(Quarantine{Hostname: anotherHostname})
+			So(err, ShouldNotBeNil)
+
+			_, err = state.QuarantinePeer(Quarantine{Hostname: hostname, Author: "jane"})
+			So(err, ShouldNotBeNil)
+
+			_, err = state.QuarantinePeer(Quarantine{
+				Hostname: anotherHostname, Author: "jane", Expires: fake.Now().Add(MaxQuarantineDuration + time.Minute),
+			})
+			So(err, ShouldNotBeNil)
+			So(state.Quarantines(), ShouldBeEmpty)
+		})
+	})
+}
@@ -3,17 +3,22 @@ package catalog
 //go:generate ffjson $GOFILE
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NinesStack/memberlist"
+	"github.com/NinesStack/sidecar/clock"
 	"github.com/NinesStack/sidecar/output"
 	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/wire"
 	"github.com/armon/go-metrics"
 	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
@@ -43,6 +48,7 @@ type ChangeEvent struct {
 	Service        service.Service
 	PreviousStatus int
 	Time           time.Time
+	Version        uint64 // The state version after this change
 }
 
 // Holds the state about one server in our cluster
@@ -68,14 +74,29 @@ func NewServer(name string) *Server {
 
 // Holds the state about all the servers in the cluster
 type ServicesState struct {
+	version             uint64 // Accessed atomically, keep it first for alignment
 	Servers             map[string]*Server
 	LastChanged         time.Time
 	ClusterName         string
 	Hostname            string
 	Broadcasts          chan [][]byte        `json:"-"`
 	ServiceMsgs         chan service.Service `json:"-"`
+	Clock               clock.Clock          `json:"-"` // Tells the time for expiry and broadcasts
+	ChangeLog           *ChangeLog           `json:"-"` // Optional record of every change
+	Uptime              *UptimeTracker       `json:"-"` // Optional availability of each service
 	listeners           map[string]Listener
 	tombstoneRetransmit time.Duration
+	changed             chan struct{} // Closed and replaced on every change
+	changedLock         sync.Mutex
+	quarantines         map[string]*Quarantine // Peers whose updates we ignore
+	quarantineLock      sync.Mutex
+	drains              map[string]*ScheduledDrain // Drains of our services, by ID
+	lastDrainID         int
+	drainLock           sync.Mutex
+	bootstrapped        chan struct{} // Closed once Bootstrap is done waiting for the peers
+	bootstrapLock       sync.Mutex
+	wireEncoder         wire.Encoder // What the services are broadcast in
+	wireLock            sync.Mutex
 	sync.RWMutex
 }
 
@@ -86,6 +107,15 @@ type Listener interface {
 	Managed() bool          // Is this managed by us? (e.g. auto-added/removed)
 }
 
+// A Proxy routes to the services in the state and follows its changes.
+// HAproxy, nginx, and Envoy all are one, so Sidecar can be started with
+// whichever of them SIDECAR_PROXY picks.
+type Proxy interface {
+	Watch(state *ServicesState)                // Follow the state's changes, blocking
+	WriteAndReload(state *ServicesState) error // Send the proxy the state as it is now
+	Name() string                              // The name of this proxy
+}
+
 // Returns a pointer to a properly configured ServicesState
 func NewServicesState() *ServicesState {
 	var err error
@@ -96,6 +126,7 @@ func NewServicesState() *ServicesState {
 		tombstoneRetransmit: TOMBSTONE_RETRANSMIT,
 		ServiceMsgs:         make(chan service.Service, 25),
 		listeners:           make(map[string]Listener),
+		Clock:               clock.Real{},
 	}
 	state.Hostname, err = os.Hostname()
 	if err != nil {
@@ -156,6 +187,13 @@ func (state *ServicesState) ExpireServer(hostname string) {
 		return
 	}
 
+	// They expire on their own once we're done bootstrapping, if the host
+	// doesn't come back
+	if state.Bootstrapping() {
+		log.Infof("Not expiring %s while bootstrapping", hostname)
+		return
+	}
+
 	hasLiveServices := false
 	for _, svc := range state.Servers[hostname].Services {
 		if !svc.IsTombstone() {
@@ -194,9 +232,72 @@ func (state *ServicesState) ExpireServer(hostname string) {
 // Tell the state that a particular service transitioned from one state to another.
 func (state *ServicesState) ServiceChanged(svc *service.Service, previousStatus int, updated time.Time) {
 	state.serverChanged(svc.Hostname, updated)
+	state.bumpVersion()
+	if state.ChangeLog != nil {
+		state.ChangeLog.Record(LoggedChange{
+			Index:          state.Version(),
+			Time:           state.now(),
+			Service:        *svc,
+			PreviousStatus: previousStatus,
+		})
+	}
+	if state.Uptime != nil {
+		state.Uptime.Record(svc)
+	}
 	state.NotifyListeners(svc, previousStatus, state.LastChanged)
 }
 
+// Version returns the change index of the state. It goes up by one on every
+// change, and is local to this node: peers will have different versions for
+// the same state.
+func (state *ServicesState) Version() uint64 {
+	return atomic.LoadUint64(&state.version)
+}
+
+// WaitForChange blocks until the version is greater than index, or until the
+// timeout passes. It returns the version at that point.
+func (state *ServicesState) WaitForChange(index uint64, timeout time.Duration) uint64 {
+	timeoutChan := clock.OrReal(state.Clock).After(timeout)
+
+	for {
+		state.changedLock.Lock()
+		if state.changed == nil {
+			state.changed = make(chan struct{})
+		}
+		changed := state.changed
+		state.changedLock.Unlock()
+
+		// Checked after we have the channel, so we can't miss a change
+		version := state.Version()
+		if version > index {
+			return version
+		}
+
+		select {
+		case <-changed:
+		case <-timeoutChan:
+			return state.Version()
+		}
+	}
+}
+
+// now returns the current time in UTC from the state's Clock
+func (state *ServicesState) now() time.Time {
+	return clock.OrReal(state.Clock).Now().UTC()
+}
+
+// bumpVersion increments the version and wakes up anyone waiting on a change
+func (state *ServicesState) bumpVersion() {
+	atomic.AddUint64(&state.version, 1)
+
+	state.changedLock.Lock()
+	if state.changed != nil {
+		close(state.changed)
+		state.changed = nil
+	}
+	state.changedLock.Unlock()
+}
+
 // Tell the state that something changed on a particular server so that it
 // can keep the timestamps up to date.
 // Note: not synchronized!
@@ -222,9 +323,10 @@ func (state *ServicesState) NotifyListeners(svc *service.Service, previousStatus
 		return
 	}
 
-	log.Debugf("Notifying listeners of change at %s", changedTime.String())
+	version := state.Version()
+	log.Debugf("Notifying listeners of change at %s (version %d)", changedTime.String(), version)
 
-	event := ChangeEvent{Service: *svc, PreviousStatus: previousStatus, Time: changedTime}
+	event := ChangeEvent{Service: *svc, PreviousStatus: previousStatus, Time: changedTime, Version: version}
 	for _, listener := range listeners {
 		if listener == nil {
 			continue
@@ -299,7 +401,7 @@ func (state *ServicesState) AddServiceEntry(newSvc service.Service) {
 	// Some weird edge cases can cause very old stuff to get broadcast.  This
 	// can end up in a broadcast/tombstone/broadcast loop. We'll attempt to
 	// prevent that by dropping anything older than the tombstone window.
-	if newSvc.IsStale(TOMBSTONE_LIFESPAN) {
+	if newSvc.IsStaleAt(TOMBSTONE_LIFESPAN, state.now()) {
 		log.Warnf(
 			"Dropping stale service received on gossip: %s:%s (%s)",
 			newSvc.Hostname, newSvc.Name, newSvc.ID,
@@ -307,6 +409,14 @@ func (state *ServicesState) AddServiceEntry(newSvc service.Service) {
 		return
 	}
 
+	if state.quarantined(&newSvc) {
+		log.Debugf(
+			"Ignoring service from quarantined peer: %s:%s (%s)",
+			newSvc.Hostname, newSvc.Name, newSvc.ID,
+		)
+		return
+	}
+
 	if !state.HasServer(newSvc.Hostname) {
 		state.Servers[newSvc.Hostname] = NewServer(newSvc.Hostname)
 	}
@@ -325,9 +435,12 @@ func (state *ServicesState) AddServiceEntry(newSvc service.Service) {
 		// Store the previous newSvc so we can compare it
 		oldEntry := server.Services[newSvc.ID]
 
-		// Make sure we preserve the DRAINING status for services
-		if oldEntry.Status == service.DRAINING && newSvc.Status == service.ALIVE {
+		// Make sure we preserve the DRAINING status for services, unless
+		// it was a scheduled drain that has ended
+		if oldEntry.Status == service.DRAINING && newSvc.Status == service.ALIVE &&
+			!oldEntry.DrainEnded(state.now()) {
 			newSvc.Status = oldEntry.Status
+			newSvc.DrainedUntil = oldEntry.DrainedUntil
 		}
 
 		// Update the new one
@@ -381,8 +494,10 @@ func (state *ServicesState) retransmit(svc service.Service) {
 		return
 	}
 
+	// Pick the encoder now, so the goroutine doesn't touch the state
+	encoder := state.WireEncoder()
 	go func() {
-		encoded, err := svc.Encode()
+		encoded, err := svc.EncodeWith(encoder)
 		if err != nil {
 			log.Errorf("ERROR encoding message to forward: (%s)", err.Error())
 			return
@@ -396,7 +511,7 @@ func (state *ServicesState) retransmit(svc service.Service) {
 func (state *ServicesState) Format(list *memberlist.Memberlist) string {
 	var outStr string
 
-	refTime := time.Now().UTC()
+	refTime := state.now()
 
 	var servers []*Server
 	for _, svr := range state.Servers {
@@ -421,6 +536,20 @@ func (state *ServicesState) Format(list *memberlist.Memberlist) string {
 		outStr += "\n"
 	}
 
+	if drains := state.ScheduledDrains(); len(drains) > 0 {
+		outStr += "Scheduled Drains ----------------------\n"
+		for _, drain := range drains {
+			status := "scheduled"
+			if drain.Started {
+				status = "draining"
+			}
+			outStr += fmt.Sprintf("  %-4s %-30s %s - %s  %-9s %s\n",
+				drain.ID, drain.Service, drain.Start.Format(time.RFC3339),
+				drain.End.Format(time.RFC3339), status, drain.Author)
+		}
+		outStr += "\n"
+	}
+
 	// Don't show member list
 	if list == nil {
 		return outStr
@@ -436,6 +565,29 @@ func (state *ServicesState) Format(list *memberlist.Memberlist) string {
 	return outStr
 }
 
+// Hash summarizes the services in the state, so that two hosts can tell
+// whether they agree on it. Timestamps and tombstones are left out, because
+// they legitimately differ for a while as changes spread around the cluster.
+// Note: Not synchronized!
+func (state *ServicesState) Hash() string {
+	var lines []string
+	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		if svc.IsTombstone() {
+			return
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s %d %s %v",
+			*hostname, *serviceId, svc.Name, svc.Status, svc.ProxyMode, svc.Ports))
+	})
+	sort.Strings(lines)
+
+	hash := sha1.New()
+	for _, line := range lines {
+		fmt.Fprintln(hash, line)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
 // Print the formatted struct
 func (state *ServicesState) Print(list *memberlist.Memberlist) {
 	log.Println(state.Format(list))
@@ -517,6 +669,15 @@ func (state *ServicesState) IsNewService(svc *service.Service) bool {
 		return true
 	}
 
+	// A named port whose own check changed status is news too
+	if !svc.IsTombstone() && len(svc.Ports) == len(found.Ports) {
+		for i, port := range svc.Ports {
+			if port.Status != found.Ports[i].Status {
+				return true
+			}
+		}
+	}
+
 	return false
 }
 
@@ -544,7 +705,7 @@ func (state *ServicesState) BroadcastServices(fn func() []service.Service, loope
 				haveNewServices = true
 				services = append(services, svc)
 				// Check that refresh window... is it time?
-			} else if time.Now().UTC().Add(0 - ALIVE_BROADCAST_INTERVAL).After(lastTime) {
+			} else if state.now().Add(0 - ALIVE_BROADCAST_INTERVAL).After(lastTime) {
 				services = append(services, svc)
 			}
 		}
@@ -557,7 +718,7 @@ func (state *ServicesState) BroadcastServices(fn func() []service.Service, loope
 				runCount = ALIVE_COUNT
 			}
 
-			lastTime = time.Now().UTC()
+			lastTime = state.now()
 			state.SendServices(
 				services,
 				director.NewTimedLooper(runCount, state.tombstoneRetransmit, nil),
@@ -573,6 +734,22 @@ func (state *ServicesState) BroadcastServices(fn func() []service.Service, loope
 	})
 }
 
+// AnnounceServices immediately broadcasts all the services returned by fn,
+// without waiting for the next refresh window. Used to force a re-announce,
+// e.g. after a network issue has been fixed.
+func (state *ServicesState) AnnounceServices(fn func() []service.Service) {
+	services := fn()
+	if len(services) < 1 {
+		return
+	}
+
+	log.Infof("Re-announcing %d local services", len(services))
+	state.SendServices(
+		services,
+		director.NewImmediateTimedLooper(ALIVE_COUNT, state.tombstoneRetransmit, nil),
+	)
+}
+
 // Actually transmit an encoded service record into the channel. Runs a
 // background goroutine that continues the broadcast for 10 seconds so we
 // have a pretty good idea that it was delivered.
@@ -587,7 +764,7 @@ func (state *ServicesState) SendServices(services []service.Service, looper dire
 
 			for _, svc := range services {
 				svc.Updated = svc.Updated.Add(additionalTime)
-				encoded, err := svc.Encode()
+				encoded, err := svc.EncodeWith(state.WireEncoder())
 				if err != nil {
 					log.Errorf("ERROR encoding container: (%s)", err.Error())
 				}
@@ -636,6 +813,7 @@ func (state *ServicesState) TombstoneOthersServices() []service.Service {
 	defer metrics.MeasureSince([]string{"services_state", "TombstoneOthersServices"}, time.Now())
 
 	var result []service.Service
+	bootstrapping := state.Bootstrapping()
 
 	// Manage tombstone life so we don't keep them forever. We have to do this
 	// even for hosts that aren't running services now, because they might have
@@ -643,7 +821,7 @@ func (state *ServicesState) TombstoneOthersServices() []service.Service {
 	// time at all.
 	state.EachService(func(hostname *string, id *string, svc *service.Service) {
 		if svc.IsTombstone() &&
-			svc.Updated.Before(time.Now().UTC().Add(0-TOMBSTONE_LIFESPAN)) {
+			svc.Updated.Before(state.now().Add(0-TOMBSTONE_LIFESPAN)) {
 			delete(state.Servers[*hostname].Services, *id)
 
 			// If this is the last service, remove the server
@@ -657,9 +835,10 @@ func (state *ServicesState) TombstoneOthersServices() []service.Service {
 			svcLifespan = DRAINING_LIFESPAN
 		}
 		// Everything that is not tombstoned needs to be considered for
-		// removal if it exceeds the allowed ALIVE_TIMESPAN
-		if !svc.IsTombstone() &&
-			svc.Updated.Before(time.Now().UTC().Add(0-svcLifespan)) {
+		// removal if it exceeds the allowed ALIVE_TIMESPAN. Until we've
+		// seen our peers, it may just be that we haven't heard from them.
+		if !svc.IsTombstone() && !bootstrapping &&
+			svc.Updated.Before(state.now().Add(0-svcLifespan)) {
 			log.Warnf("Found expired service %s ID %s from %s, tombstoning",
 				svc.Name, svc.ID, svc.Hostname,
 			)
@@ -770,10 +949,17 @@ func makeServiceMapping(svcList []service.Service) map[string]*service.Service {
 	return mapping
 }
 
-// Take a byte slice and return a properly reconstituted state struct
+// Take a byte slice, in any of the wire formats, and return a properly
+// reconstituted state struct
 func Decode(data []byte) (*ServicesState, error) {
 	newState := NewServicesState()
-	err := newState.UnmarshalJSON(data)
+
+	var err error
+	if encoder := wire.Detect(data); encoder.Name() == wire.JSON {
+		err = newState.UnmarshalJSON(data)
+	} else {
+		err = newState.decodeWire(encoder, data)
+	}
 	if err != nil {
 		log.Errorf("Error decoding state! (%s)", err.Error())
 	}
@@ -57,6 +57,8 @@ func (j *ChangeEvent) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
 		buf.Write(obj)
 
 	}
+	buf.WriteString(`,"Version":`)
+	fflib.FormatBits2(buf, uint64(j.Version), 10, false)
 	buf.WriteByte('}')
 	return nil
 }
@@ -70,6 +72,8 @@ const (
 	ffjtChangeEventPreviousStatus
 
 	ffjtChangeEventTime
+
+	ffjtChangeEventVersion
 )
 
 var ffjKeyChangeEventService = []byte("Service")
@@ -78,6 +82,8 @@ var ffjKeyChangeEventPreviousStatus = []byte("PreviousStatus")
 
 var ffjKeyChangeEventTime = []byte("Time")
 
+var ffjKeyChangeEventVersion = []byte("Version")
+
 // UnmarshalJSON umarshall json - template of ffjson
 func (j *ChangeEvent) UnmarshalJSON(input []byte) error {
 	fs := fflib.NewFFLexer(input)
@@ -163,6 +169,20 @@ mainparse:
 						goto mainparse
 					}
 
+				case 'V':
+
+					if bytes.Equal(ffjKeyChangeEventVersion, kn) {
+						currentKey = ffjtChangeEventVersion
+						state = fflib.FFParse_want_colon
+						goto mainparse
+					}
+
+				}
+
+				if fflib.EqualFoldRight(ffjKeyChangeEventVersion, kn) {
+					currentKey = ffjtChangeEventVersion
+					state = fflib.FFParse_want_colon
+					goto mainparse
 				}
 
 				if fflib.SimpleLetterEqualFold(ffjKeyChangeEventTime, kn) {
@@ -209,6 +229,9 @@ mainparse:
 				case ffjtChangeEventTime:
 					goto handle_Time
 
+				case ffjtChangeEventVersion:
+					goto handle_Version
+
 				case ffjtChangeEventnosuchkey:
 					err = fs.SkipField(tok)
 					if err != nil {
@@ -298,6 +321,36 @@ handle_Time:
 	state = fflib.FFParse_after_value
 	goto mainparse
 
+handle_Version:
+
+	/* handler: j.Version type=uint64 kind=uint64 quoted=false*/
+
+	{
+		if tok != fflib.FFTok_integer && tok != fflib.FFTok_null {
+			return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for uint64", tok))
+		}
+	}
+
+	{
+
+		if tok == fflib.FFTok_null {
+
+		} else {
+
+			tval, err := fflib.ParseUint(fs.Output.Bytes(), 10, 64)
+
+			if err != nil {
+				return fs.WrapErr(err)
+			}
+
+			j.Version = uint64(tval)
+
+		}
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
 wantedvalue:
 	return fs.WrapErr(fmt.Errorf("wanted value token, but got token: %v", tok))
 wrongtokenerror:
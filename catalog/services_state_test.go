@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/NinesStack/sidecar/clock"
 	"github.com/NinesStack/sidecar/service"
 	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
@@ -399,6 +401,21 @@ func Test_TrackingAndBroadcasting(t *testing.T) {
 			So(readBroadcasts[1], ShouldMatch, "^{\"ID\":\"runs\".*\"Status\":1}$")
 		})
 
+		Convey("AnnounceServices() broadcasts all the services immediately", func() {
+			state.Broadcasts = make(chan [][]byte, ALIVE_COUNT)
+			state.AnnounceServices(containerFn)
+
+			readBroadcasts := <-state.Broadcasts
+			So(len(readBroadcasts), ShouldEqual, 2)
+			So(readBroadcasts[0], ShouldMatch, "^{\"ID\":\"deadbeef123\"")
+		})
+
+		Convey("AnnounceServices() does nothing without services", func() {
+			state.Broadcasts = make(chan [][]byte, 1)
+			state.AnnounceServices(func() []service.Service { return nil })
+			So(len(state.Broadcasts), ShouldEqual, 0)
+		})
+
 		Convey("The timestamp is incremented on each subsequent service broadcast background run", func() {
 			state.Broadcasts = make(chan [][]byte, 4)
 			looper := director.NewFreeLooper(2, make(chan error))
@@ -453,6 +470,7 @@ func Test_TrackingAndBroadcasting(t *testing.T) {
 
 		Convey("Tombstones have a lifespan, then expire", func() {
 			service1.Tombstone()
+			state.Clock = clock.NewFake(service1.Updated)
 			service1.Updated = service1.Updated.Add(0 - TOMBSTONE_LIFESPAN - 1*time.Minute)
 			state.AddServiceEntry(service1)
 			state.AddServiceEntry(service2)
@@ -540,6 +558,22 @@ func Test_TrackingAndBroadcasting(t *testing.T) {
 			So(svcs["unknown_shakespeare"].Status, ShouldEqual, service.TOMBSTONE)
 		})
 
+		Convey("Services expire by the state's clock", func() {
+			fake := clock.NewFake(baseTime)
+			state.Clock = fake
+			state.AddServiceEntry(service1)
+			svc := state.Servers[hostname].Services[service1.ID]
+			svc.Updated = baseTime
+
+			fake.Advance(ALIVE_LIFESPAN)
+			state.TombstoneOthersServices()
+			So(svc.Status, ShouldEqual, service.ALIVE)
+
+			fake.Advance(time.Second)
+			state.TombstoneOthersServices()
+			So(svc.Status, ShouldEqual, service.TOMBSTONE)
+		})
+
 		Convey("Tombstones aren't re-tombstoned", func() {
 			tombstonedService := service.Service{ID: "dead_shakespeare", Hostname: hostname, Updated: baseTime, Status: service.TOMBSTONE}
 			state.AddServiceEntry(tombstonedService)
@@ -558,6 +592,16 @@ func Test_TrackingAndBroadcasting(t *testing.T) {
 			So(state.IsNewService(&services[0]), ShouldBeTrue)
 		})
 
+		Convey("Can detect a change in the health of a named port", func() {
+			service1.Ports = []service.Port{{Port: 10450, ServicePort: 8080, Name: "admin"}}
+			state.AddServiceEntry(service1)
+
+			changed := service1
+			changed.Ports = []service.Port{{Port: 10450, ServicePort: 8080, Name: "admin", Status: service.UNHEALTHY}}
+			So(state.IsNewService(&service1), ShouldBeFalse)
+			So(state.IsNewService(&changed), ShouldBeTrue)
+		})
+
 		Convey("Doesn't call tombstones new services", func() {
 			// service1 and services[0] are copies of the same service
 			service1.Status = service.UNHEALTHY
@@ -623,6 +667,8 @@ func Test_Listeners(t *testing.T) {
 			wg.Wait()
 			So(result.Service.Hostname, ShouldEqual, hostname)
 			So(result2.Service.Hostname, ShouldEqual, hostname)
+			So(result.Version, ShouldBeGreaterThan, 0)
+			So(result2.Version, ShouldEqual, result.Version)
 		})
 
 		Convey("GetListeners() returns all the listeners", func() {
@@ -743,6 +789,89 @@ func Test_ClusterMembershipManagement(t *testing.T) {
 	})
 }
 
+func Test_Version(t *testing.T) {
+	Convey("Tracking the state version", t, func() {
+		state := NewServicesState()
+		svc := service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Hostname: hostname,
+			Updated:  time.Now().UTC(),
+		}
+
+		Convey("starts at zero and counts changes", func() {
+			So(state.Version(), ShouldEqual, 0)
+			state.AddServiceEntry(svc)
+			So(state.Version(), ShouldEqual, 1)
+
+			// No change, no new version
+			state.AddServiceEntry(svc)
+			So(state.Version(), ShouldEqual, 1)
+		})
+
+		Convey("WaitForChange() returns right away for an old index", func() {
+			state.AddServiceEntry(svc)
+			So(state.WaitForChange(0, time.Minute), ShouldEqual, 1)
+		})
+
+		Convey("WaitForChange() wakes up on a change", func() {
+			go func() {
+				time.Sleep(5 * time.Millisecond)
+				state.AddServiceEntry(svc)
+			}()
+
+			So(state.WaitForChange(0, time.Minute), ShouldEqual, 1)
+		})
+
+		Convey("WaitForChange() gives up at the timeout", func() {
+			fake := clock.NewFake(time.Now())
+			state.Clock = fake
+
+			go func() {
+				for fake.Waiters() == 0 {
+					runtime.Gosched()
+				}
+				fake.Advance(time.Minute)
+			}()
+
+			So(state.WaitForChange(0, time.Minute), ShouldEqual, 0)
+		})
+	})
+}
+
+func Test_Hash(t *testing.T) {
+	Convey("Hashing the state", t, func() {
+		state := NewServicesState()
+		other := NewServicesState()
+		svc := service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Hostname: hostname,
+			Updated:  time.Now().UTC(),
+		}
+		state.AddServiceEntry(svc)
+
+		Convey("matches when the services do, whenever they were updated", func() {
+			svc.Updated = svc.Updated.Add(time.Second)
+			other.AddServiceEntry(svc)
+			So(state.Hash(), ShouldEqual, other.Hash())
+		})
+
+		Convey("differs when a service's status does", func() {
+			svc.Status = service.UNHEALTHY
+			other.AddServiceEntry(svc)
+			So(state.Hash(), ShouldNotEqual, other.Hash())
+		})
+
+		Convey("leaves out tombstones", func() {
+			empty := NewServicesState().Hash()
+			svc.Tombstone()
+			other.AddServiceEntry(svc)
+			So(other.Hash(), ShouldEqual, empty)
+		})
+	})
+}
+
 func Test_DecodeStream(t *testing.T) {
 	Convey("Test decoding stream", t, func() {
 		serv := service.Service{ID: "007", Name: "api", Hostname: "some-aws-host", Status: 1, Updated: time.Now().UTC()}
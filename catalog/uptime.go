@@ -0,0 +1,243 @@
+package catalog
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+)
+
+const (
+	DefaultUptimeWindow = 7 * 24 * time.Hour // How far back availability is computed over
+	DefaultUptimeTarget = 99.9               // Percent availability the error budget is for
+)
+
+const (
+	uptimeGone = iota // No instances that count, e.g. all tombstoned or draining
+	uptimeUp          // At least one instance is alive
+	uptimeDown        // There are instances, but none of them is alive
+)
+
+// An UptimeReport is how available a service was over the UptimeTracker's
+// Window, or since we started tracking it if that's later. Time when the
+// service had no instances, or only draining ones, isn't counted.
+type UptimeReport struct {
+	Service              string
+	Since                time.Time     // The start of the time counted
+	Up                   time.Duration // Time with at least one alive instance
+	Down                 time.Duration // Time with instances, but none alive
+	Availability         float64       // Percent of the time counted that it was up
+	Target               float64       // Percent availability the error budget is for
+	ErrorBudgetRemaining float64       // Percent of the allowed downtime left, negative when overspent
+	BurnRate             float64       // How fast it's spending the budget, 1 uses it up in exactly the time counted
+}
+
+// An uptimePeriod is a stretch of time a service was up, or down
+type uptimePeriod struct {
+	Start time.Time
+	End   time.Time // Zero while it lasts
+	Up    bool
+}
+
+type serviceUptime struct {
+	instances map[string]int // Status by hostname/ID
+	periods   []uptimePeriod // Oldest first
+}
+
+// An UptimeTracker keeps how long each service spent up and down over a
+// rolling Window, from the state changes, and computes its availability and
+// error budget from that. A service is up when at least one of its instances
+// is alive, anywhere in the cluster. It only knows what happened while this
+// Sidecar was running.
+type UptimeTracker struct {
+	Window   time.Duration
+	Target   float64
+	Clock    clock.Clock
+	services map[string]*serviceUptime
+	sync.Mutex
+}
+
+// NewUptimeTracker returns an UptimeTracker, with the defaults in place of a
+// window or target that isn't valid
+func NewUptimeTracker(window time.Duration, target float64) *UptimeTracker {
+	if window <= 0 {
+		window = DefaultUptimeWindow
+	}
+
+	if target <= 0 || target > 100 {
+		target = DefaultUptimeTarget
+	}
+
+	return &UptimeTracker{
+		Window:   window,
+		Target:   target,
+		services: make(map[string]*serviceUptime),
+	}
+}
+
+// Record updates the service an instance belongs to with its new status
+func (u *UptimeTracker) Record(svc *service.Service) {
+	now := clock.OrReal(u.Clock).Now()
+
+	u.Lock()
+	defer u.Unlock()
+
+	tracked, ok := u.services[svc.Name]
+	if !ok {
+		tracked = &serviceUptime{instances: make(map[string]int)}
+		u.services[svc.Name] = tracked
+	}
+
+	key := svc.Hostname + "/" + svc.ID
+	if svc.IsTombstone() {
+		delete(tracked.instances, key)
+	} else {
+		tracked.instances[key] = svc.Status
+	}
+
+	tracked.update(now)
+	u.prune(now)
+}
+
+// currently returns whether the service is up, down, or gone now
+func (s *serviceUptime) currently() int {
+	state := uptimeGone
+	for _, status := range s.instances {
+		switch status {
+		case service.ALIVE:
+			return uptimeUp
+		case service.UNHEALTHY, service.UNKNOWN:
+			state = uptimeDown
+		}
+	}
+
+	return state
+}
+
+// update ends the current period when the service went up, down, or away,
+// and starts the next one
+func (s *serviceUptime) update(now time.Time) {
+	state := s.currently()
+
+	var current *uptimePeriod
+	if len(s.periods) > 0 && s.periods[len(s.periods)-1].End.IsZero() {
+		current = &s.periods[len(s.periods)-1]
+	}
+
+	if current != nil {
+		if state != uptimeGone && current.Up == (state == uptimeUp) {
+			return
+		}
+		current.End = now
+	}
+
+	if state != uptimeGone {
+		s.periods = append(s.periods, uptimePeriod{Start: now, Up: state == uptimeUp})
+	}
+}
+
+// prune drops the periods that ended before the Window, and the services
+// with nothing left. Must be called with the lock held.
+func (u *UptimeTracker) prune(now time.Time) {
+	cutoff := now.Add(-u.Window)
+
+	for name, tracked := range u.services {
+		var i int
+		for i < len(tracked.periods) && !tracked.periods[i].End.IsZero() && tracked.periods[i].End.Before(cutoff) {
+			i++
+		}
+		tracked.periods = tracked.periods[i:]
+
+		if len(tracked.periods) == 0 && len(tracked.instances) == 0 {
+			delete(u.services, name)
+		}
+	}
+}
+
+// Report returns the UptimeReport for one service, and false if we don't
+// have one for it
+func (u *UptimeTracker) Report(name string) (UptimeReport, bool) {
+	now := clock.OrReal(u.Clock).Now()
+
+	u.Lock()
+	defer u.Unlock()
+
+	tracked, ok := u.services[name]
+	if !ok || len(tracked.periods) == 0 {
+		return UptimeReport{}, false
+	}
+
+	return u.report(name, tracked, now), true
+}
+
+// Reports returns the UptimeReports for every service, sorted by name
+func (u *UptimeTracker) Reports() []UptimeReport {
+	now := clock.OrReal(u.Clock).Now()
+
+	u.Lock()
+	defer u.Unlock()
+
+	reports := make([]UptimeReport, 0, len(u.services))
+	for name, tracked := range u.services {
+		if len(tracked.periods) > 0 {
+			reports = append(reports, u.report(name, tracked, now))
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Service < reports[j].Service })
+
+	return reports
+}
+
+func (u *UptimeTracker) report(name string, tracked *serviceUptime, now time.Time) UptimeReport {
+	report := UptimeReport{Service: name, Target: u.Target}
+	cutoff := now.Add(-u.Window)
+
+	for _, period := range tracked.periods {
+		start, end := period.Start, period.End
+		if start.Before(cutoff) {
+			start = cutoff
+		}
+		if end.IsZero() {
+			end = now
+		}
+		if !end.After(start) {
+			continue
+		}
+
+		if report.Since.IsZero() {
+			report.Since = start
+		}
+
+		if period.Up {
+			report.Up += end.Sub(start)
+		} else {
+			report.Down += end.Sub(start)
+		}
+	}
+
+	total := report.Up + report.Down
+	if total <= 0 {
+		report.Availability = 100
+		report.ErrorBudgetRemaining = 100
+		return report
+	}
+
+	downFraction := float64(report.Down) / float64(total)
+	report.Availability = 100 * (1 - downFraction)
+
+	allowed := (100 - u.Target) / 100
+	switch {
+	case allowed > 0:
+		report.BurnRate = downFraction / allowed
+		report.ErrorBudgetRemaining = 100 * (1 - report.BurnRate)
+	case report.Down > 0:
+		report.ErrorBudgetRemaining = 0
+	default:
+		report.ErrorBudgetRemaining = 100
+	}
+
+	return report
+}
@@ -0,0 +1,103 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_UptimeTracker(t *testing.T) {
+	Convey("The UptimeTracker", t, func() {
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		fakeClock := clock.NewFake(start)
+
+		tracker := NewUptimeTracker(10*time.Hour, 99)
+		tracker.Clock = fakeClock
+
+		svc := service.Service{ID: "deadbeef123", Name: "bocaccio", Hostname: "chaucer"}
+		record := func(status int) {
+			svc.Status = status
+			tracker.Record(&svc)
+		}
+
+		Convey("computes the availability and error budget", func() {
+			record(service.ALIVE)
+			fakeClock.Advance(99 * time.Minute)
+			record(service.UNHEALTHY)
+			fakeClock.Advance(time.Minute / 2)
+
+			report, ok := tracker.Report("bocaccio")
+			So(ok, ShouldBeTrue)
+			So(report.Since, ShouldEqual, start)
+			So(report.Up, ShouldEqual, 99*time.Minute)
+			So(report.Down, ShouldEqual, 30*time.Second)
+			So(report.Availability, ShouldAlmostEqual, 99.4975, 0.0001)
+			So(report.BurnRate, ShouldAlmostEqual, 0.5025, 0.0001)
+			So(report.ErrorBudgetRemaining, ShouldAlmostEqual, 49.7487, 0.0001)
+		})
+
+		Convey("counts the service as up while any instance is alive", func() {
+			record(service.ALIVE)
+			other := service.Service{ID: "deadbeef456", Name: "bocaccio", Hostname: "dante", Status: service.UNHEALTHY}
+			tracker.Record(&other)
+			fakeClock.Advance(time.Hour)
+
+			report, _ := tracker.Report("bocaccio")
+			So(report.Down, ShouldEqual, 0)
+			So(report.Availability, ShouldEqual, 100)
+		})
+
+		Convey("doesn't count the time the service was gone or draining", func() {
+			record(service.ALIVE)
+			fakeClock.Advance(time.Hour)
+			record(service.DRAINING)
+			fakeClock.Advance(time.Hour)
+			record(service.TOMBSTONE)
+			fakeClock.Advance(time.Hour)
+			record(service.UNHEALTHY)
+			fakeClock.Advance(time.Hour)
+
+			report, _ := tracker.Report("bocaccio")
+			So(report.Up, ShouldEqual, time.Hour)
+			So(report.Down, ShouldEqual, time.Hour)
+			So(report.ErrorBudgetRemaining, ShouldBeLessThan, 0)
+		})
+
+		Convey("only counts the time inside the window", func() {
+			record(service.UNHEALTHY)
+			fakeClock.Advance(2 * time.Hour)
+			record(service.ALIVE)
+			fakeClock.Advance(9 * time.Hour)
+
+			report, _ := tracker.Report("bocaccio")
+			So(report.Since, ShouldEqual, start.Add(time.Hour))
+			So(report.Up, ShouldEqual, 9*time.Hour)
+			So(report.Down, ShouldEqual, time.Hour)
+		})
+
+		Convey("forgets services that are gone for longer than the window", func() {
+			record(service.ALIVE)
+			fakeClock.Advance(time.Hour)
+			record(service.TOMBSTONE)
+			fakeClock.Advance(11 * time.Hour)
+
+			tracker.Record(&service.Service{ID: "deadbeef456", Name: "chaucer", Hostname: "dante"})
+
+			_, ok := tracker.Report("bocaccio")
+			So(ok, ShouldBeFalse)
+
+			reports := tracker.Reports()
+			So(len(reports), ShouldEqual, 1)
+			So(reports[0].Service, ShouldEqual, "chaucer")
+		})
+
+		Convey("falls back to the defaults", func() {
+			tracker := NewUptimeTracker(0, 100.5)
+			So(tracker.Window, ShouldEqual, DefaultUptimeWindow)
+			So(tracker.Target, ShouldEqual, DefaultUptimeTarget)
+		})
+	})
+}
@@ -11,9 +11,11 @@ import (
 
 // ServicesState -------------------------
 
+// EachServiceSorted calls fn for each service, oldest first. Services that
+// other hosts report on are merged, as in EachServiceMerged.
 func (state *ServicesState) EachServiceSorted(fn func(hostname *string, serviceId *string, svc *service.Service)) {
 	var services []*service.Service
-	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+	state.EachServiceMerged(func(hostname *string, serviceId *string, svc *service.Service) {
 		services = append(services, svc)
 	})
 
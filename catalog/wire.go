@@ -0,0 +1,80 @@
+package catalog
+
+import (
+	"time"
+
+	"github.com/NinesStack/sidecar/wire"
+	log "github.com/sirupsen/logrus"
+)
+
+// wireState is what of the state goes on the wire in the formats that
+// don't have a marshaler generated for the ServicesState
+type wireState struct {
+	Servers     map[string]*Server
+	LastChanged time.Time
+	ClusterName string
+	Hostname    string
+}
+
+// EncodeWith encodes the state for the wire in the Encoder's format. JSON
+// is the same as Encode.
+func (state *ServicesState) EncodeWith(encoder wire.Encoder) []byte {
+	if encoder == nil || encoder.Name() == wire.JSON {
+		return state.Encode()
+	}
+
+	data, err := encoder.Marshal(&wireState{
+		Servers:     state.Servers,
+		LastChanged: state.LastChanged,
+		ClusterName: state.ClusterName,
+		Hostname:    state.Hostname,
+	})
+	if err != nil {
+		log.Errorf("ERROR: Failed to encode state as %s: %s", encoder.Name(), err)
+		return []byte{}
+	}
+
+	return data
+}
+
+// decodeWire fills in the state from a message that isn't JSON
+func (state *ServicesState) decodeWire(encoder wire.Encoder, data []byte) error {
+	var decoded wireState
+	if err := encoder.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	if decoded.Servers != nil {
+		state.Servers = decoded.Servers
+	}
+	state.LastChanged = decoded.LastChanged
+	state.ClusterName = decoded.ClusterName
+	state.Hostname = decoded.Hostname
+
+	return nil
+}
+
+// SetWireEncoder sets the format the services are broadcast in, usually the
+// one the peers negotiated
+func (state *ServicesState) SetWireEncoder(encoder wire.Encoder) {
+	state.wireLock.Lock()
+	defer state.wireLock.Unlock()
+
+	if state.wireEncoder == nil || state.wireEncoder.Name() != encoder.Name() {
+		log.Infof("Gossiping in %s", encoder.Name())
+	}
+	state.wireEncoder = encoder
+}
+
+// WireEncoder returns the format the services are broadcast in, JSON unless
+// another was set
+func (state *ServicesState) WireEncoder() wire.Encoder {
+	state.wireLock.Lock()
+	defer state.wireLock.Unlock()
+
+	if state.wireEncoder == nil {
+		encoder, _ := wire.ForName(wire.JSON)
+		return encoder
+	}
+	return state.wireEncoder
+}
@@ -0,0 +1,45 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/wire"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_WireFormats(t *testing.T) {
+	Convey("Encoding the state for the wire", t, func() {
+		baseTime := time.Now().UTC()
+		state := NewServicesState()
+		state.Hostname = hostname
+		state.ClusterName = "cluster"
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef123", Name: "bocaccio", Hostname: hostname, Updated: baseTime,
+			Ports: []service.Port{{Type: "tcp", Port: 32768, ServicePort: 8080}},
+		})
+
+		Convey("is JSON by default", func() {
+			So(state.WireEncoder().Name(), ShouldEqual, wire.JSON)
+			So(string(state.EncodeWith(state.WireEncoder())), ShouldEqual, string(state.Encode()))
+		})
+
+		Convey("decodes msgpack into the same state", func() {
+			encoder, _ := wire.ForName(wire.Msgpack)
+			state.SetWireEncoder(encoder)
+
+			encoded := state.EncodeWith(state.WireEncoder())
+			So(len(encoded), ShouldBeLessThan, len(state.Encode()))
+
+			decoded, err := Decode(encoded)
+			So(err, ShouldBeNil)
+			So(decoded.Hostname, ShouldEqual, hostname)
+			So(decoded.ClusterName, ShouldEqual, "cluster")
+			svc := decoded.Servers[hostname].Services["deadbeef123"]
+			So(svc.Name, ShouldEqual, "bocaccio")
+			So(svc.Updated.Equal(baseTime), ShouldBeTrue)
+			So(svc.Ports, ShouldResemble, []service.Port{{Type: "tcp", Port: 32768, ServicePort: 8080}})
+		})
+	})
+}
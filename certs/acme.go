@@ -0,0 +1,290 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+// The Let's Encrypt production directory
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// An ACMESource issues certificates for public hostnames from an ACME CA
+// like Let's Encrypt, proving control of the hostnames with the HTTP-01
+// challenge. The proxy routes the challenge requests to the source, which
+// is an http.Handler for them. A certificate is only issued again once it is
+// within RenewBefore of expiring.
+type ACMESource struct {
+	DirectoryURL   string
+	Email          string
+	AccountKeyFile string
+	RenewBefore    time.Duration
+	Timeout        time.Duration
+	client         *acme.Client
+	accountLock    sync.Mutex
+	challenges     map[string]string // Response bodies by request path
+	sync.RWMutex
+}
+
+func NewACMESource(directoryURL string, accountKeyFile string) *ACMESource {
+	return &ACMESource{
+		DirectoryURL:   directoryURL,
+		AccountKeyFile: accountKeyFile,
+		RenewBefore:    30 * 24 * time.Hour,
+		Timeout:        5 * time.Minute,
+		challenges:     make(map[string]string),
+	}
+}
+
+// Certificate returns the current certificate while it covers the hostnames
+// and isn't due for renewal, and otherwise issues a new one
+func (a *ACMESource) Certificate(request Request) (*Certificate, error) {
+	if len(request.Hostnames) < 1 {
+		return nil, fmt.Errorf("Error issuing certificate '%s': no public hostnames", request.Name)
+	}
+
+	if current := request.Current; current != nil &&
+		time.Now().Add(a.RenewBefore).Before(current.Expires) &&
+		covers(current.Hostnames, request.Hostnames) {
+		return current, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+	defer cancel()
+
+	client, err := a.account(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Requesting certificate '%s' for %s", request.Name, strings.Join(request.Hostnames, ", "))
+
+	cert, err := a.issue(ctx, client, request)
+	if err != nil {
+		return nil, fmt.Errorf("Error issuing certificate '%s': %s", request.Name, err)
+	}
+
+	return cert, nil
+}
+
+// covers tells us whether a certificate for these names serves all of the
+// hostnames
+func covers(names []string, hostnames []string) bool {
+	have := make(map[string]bool, len(names))
+	for _, name := range names {
+		have[strings.ToLower(name)] = true
+	}
+
+	for _, hostname := range hostnames {
+		if !have[hostname] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// account returns a client for our ACME account, creating the account and
+// its key the first time around
+func (a *ACMESource) account(ctx context.Context) (*acme.Client, error) {
+	a.accountLock.Lock()
+	defer a.accountLock.Unlock()
+
+	if a.client != nil {
+		return a.client, nil
+	}
+
+	key, err := a.accountKey()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: a.DirectoryURL}
+
+	account := &acme.Account{}
+	if a.Email != "" {
+		account.Contact = []string{"mailto:" + a.Email}
+	}
+
+	_, err = client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("Error registering ACME account: %s", err)
+	}
+
+	a.client = client
+	return client, nil
+}
+
+// accountKey loads the account key, or generates and saves one if there
+// isn't one yet. Losing it means registering a new account.
+func (a *ACMESource) accountKey() (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(a.AccountKeyFile)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("Error reading ACME account key from %s: no PEM data", a.AccountKeyFile)
+		}
+
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading ACME account key from %s: %s", a.AccountKeyFile, err)
+		}
+		return key, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Error reading ACME account key: %s", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating ACME account key: %s", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding ACME account key: %s", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(a.AccountKeyFile), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(a.AccountKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error saving ACME account key: %s", err)
+	}
+
+	return key, nil
+}
+
+// issue orders a certificate for the hostnames, answering the HTTP-01
+// challenges for each of them
+func (a *ACMESource) issue(ctx context.Context, client *acme.Client, request Request) (*Certificate, error) {
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(request.Hostnames...))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := a.authorize(ctx, client, authzURL); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: request.Hostnames}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	return NewCertificate(request.Name, certPEM, keyPEM)
+}
+
+// authorize answers the HTTP-01 challenge for one hostname and waits for
+// the CA to check it
+func (a *ACMESource) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	path := client.HTTP01ChallengePath(challenge.Token)
+	a.setChallenge(path, response)
+	defer a.setChallenge(path, "")
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// setChallenge adds the response for a challenge path, or removes it when
+// the response is empty
+func (a *ACMESource) setChallenge(path string, response string) {
+	a.Lock()
+	defer a.Unlock()
+
+	if response == "" {
+		delete(a.challenges, path)
+		return
+	}
+	a.challenges[path] = response
+}
+
+// ServeHTTP answers the CA's HTTP-01 challenge requests
+func (a *ACMESource) ServeHTTP(response http.ResponseWriter, req *http.Request) {
+	a.RLock()
+	body, ok := a.challenges[req.URL.Path]
+	a.RUnlock()
+
+	if !ok {
+		http.NotFound(response, req)
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/plain")
+	response.Write([]byte(body))
+}
@@ -0,0 +1,79 @@
+package certs
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ACMESource(t *testing.T) {
+	Convey("ACMESource", t, func() {
+		dir, err := ioutil.TempDir("", "acme")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		// Nothing listens here, so anything that reaches the CA fails
+		source := NewACMESource("http://127.0.0.1:1/directory", filepath.Join(dir, "account.key"))
+		source.Timeout = time.Second
+
+		Convey("keeps the current certificate until it's due for renewal", func() {
+			cert, key := selfSigned("www.example.com", time.Now().Add(60*24*time.Hour))
+			current, err := NewCertificate("www.example.com", cert, key)
+			So(err, ShouldBeNil)
+
+			request := Request{Name: "www.example.com", Hostnames: []string{"www.example.com"}, Current: current}
+			issued, err := source.Certificate(request)
+			So(err, ShouldBeNil)
+			So(issued, ShouldEqual, current)
+
+			source.RenewBefore = 90 * 24 * time.Hour
+			_, err = source.Certificate(request)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("orders a new certificate when the hostnames change", func() {
+			cert, key := selfSigned("www.example.com", time.Now().Add(60*24*time.Hour))
+			current, _ := NewCertificate("www.example.com", cert, key)
+
+			_, err := source.Certificate(Request{
+				Name:      "www.example.com",
+				Hostnames: []string{"example.com", "www.example.com"},
+				Current:   current,
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("needs hostnames to issue a certificate for", func() {
+			_, err := source.Certificate(Request{Name: "www"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("generates an account key once and keeps using it", func() {
+			key, err := source.accountKey()
+			So(err, ShouldBeNil)
+
+			again, err := source.accountKey()
+			So(err, ShouldBeNil)
+			So(again, ShouldResemble, key)
+		})
+
+		Convey("answers the challenges it's working on", func() {
+			source.setChallenge("/.well-known/acme-challenge/token", "token.thumbprint")
+
+			recorder := httptest.NewRecorder()
+			source.ServeHTTP(recorder, httptest.NewRequest("GET", "/.well-known/acme-challenge/token", nil))
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldEqual, "token.thumbprint")
+
+			source.setChallenge("/.well-known/acme-challenge/token", "")
+			recorder = httptest.NewRecorder()
+			source.ServeHTTP(recorder, httptest.NewRequest("GET", "/.well-known/acme-challenge/token", nil))
+			So(recorder.Code, ShouldEqual, 404)
+		})
+	})
+}
@@ -0,0 +1,123 @@
+// The certs package keeps the certificates that the proxy terminates TLS
+// with up to date. Services name the certificate they want with their
+// TLSCert, or get one issued for their PublicHostnames, and a Manager fetches
+// each one from a Source, writes it into the proxy's certificate directory,
+// and reloads the proxy when one changes.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/NinesStack/sidecar/secrets"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// A Certificate is a PEM encoded certificate chain and its private key
+type Certificate struct {
+	Name      string
+	Cert      []byte
+	Key       []byte
+	Hostnames []string
+	Expires   time.Time
+}
+
+// A Request asks a Source for a certificate. Current is the one we already
+// have, if any, so a Source can skip fetching it again while it's still
+// good.
+type Request struct {
+	Name      string
+	Hostnames []string
+	Current   *Certificate
+}
+
+// A Source is somewhere certificates can be fetched from
+type Source interface {
+	Certificate(req Request) (*Certificate, error)
+}
+
+// NameFor returns the name of the certificate a service's frontends use,
+// or an empty string if they don't terminate TLS. When certificates are
+// issued for public hostnames, a service without a TLSCert gets one named
+// after its first hostname.
+func NameFor(svc *service.Service, issueForHostnames bool) string {
+	if svc.TLSCert != "" {
+		return svc.TLSCert
+	}
+
+	if issueForHostnames && len(svc.PublicHostnames) > 0 {
+		return svc.PublicHostnames[0]
+	}
+
+	return ""
+}
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// ValidName tells us whether a certificate name is safe to use as a file
+// name and in a path in the Source
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// NewCertificate checks that the certificate and key go together and works
+// out when the certificate expires
+func NewCertificate(name string, cert []byte, key []byte) (*Certificate, error) {
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading certificate '%s': %s", name, err)
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing certificate '%s': %s", name, err)
+	}
+
+	return &Certificate{
+		Name:      name,
+		Cert:      cert,
+		Key:       key,
+		Hostnames: leaf.DNSNames,
+		Expires:   leaf.NotAfter,
+	}, nil
+}
+
+// PEM returns the certificate chain followed by the key, which is the form
+// HAproxy loads them in
+func (c *Certificate) PEM() []byte {
+	pem := make([]byte, 0, len(c.Cert)+len(c.Key)+1)
+	pem = append(pem, c.Cert...)
+	if len(pem) > 0 && pem[len(pem)-1] != '\n' {
+		pem = append(pem, '\n')
+	}
+
+	return append(pem, c.Key...)
+}
+
+// A SecretsSource gets certificates from a secrets.Provider, as the secrets
+// "<name>.crt" and "<name>.key"
+type SecretsSource struct {
+	Provider secrets.Provider
+}
+
+func NewSecretsSource(provider secrets.Provider) *SecretsSource {
+	return &SecretsSource{Provider: provider}
+}
+
+// Certificate looks up the named certificate and its key
+func (s *SecretsSource) Certificate(req Request) (*Certificate, error) {
+	cert, err := s.Provider.Secret(req.Name + ".crt")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.Provider.Secret(req.Name + ".key")
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCertificate(req.Name, []byte(cert), []byte(key))
+}
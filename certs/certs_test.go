@@ -0,0 +1,130 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// selfSigned returns a PEM encoded self-signed certificate and key for the
+// host, expiring at the time passed in
+func selfSigned(host string, expires time.Time) ([]byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     expires,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+type mapSecrets map[string]string
+
+func (m mapSecrets) Secret(name string) (string, error) {
+	value, ok := m[name]
+	if !ok {
+		return "", fmt.Errorf("no secret %s", name)
+	}
+	return value, nil
+}
+
+func Test_NewCertificate(t *testing.T) {
+	Convey("NewCertificate", t, func() {
+		expires := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+		cert, key := selfSigned("www.example.com", expires)
+
+		Convey("works out when it expires", func() {
+			certificate, err := NewCertificate("www", cert, key)
+			So(err, ShouldBeNil)
+			So(certificate.Expires, ShouldEqual, expires)
+			So(string(certificate.PEM()), ShouldStartWith, "-----BEGIN CERTIFICATE-----")
+			So(string(certificate.PEM()), ShouldEndWith, "-----END EC PRIVATE KEY-----\n")
+		})
+
+		Convey("rejects a key that doesn't match", func() {
+			_, otherKey := selfSigned("www.example.com", expires)
+			_, err := NewCertificate("www", cert, otherKey)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("only allows names that are safe as file names", func() {
+			So(ValidName("www.example.com"), ShouldBeTrue)
+			So(ValidName("../etc/passwd"), ShouldBeFalse)
+			So(ValidName(""), ShouldBeFalse)
+		})
+	})
+}
+
+func Test_SecretsSource(t *testing.T) {
+	Convey("SecretsSource looks up the certificate and key", t, func() {
+		cert, key := selfSigned("www.example.com", time.Now().Add(time.Hour))
+		source := NewSecretsSource(mapSecrets{"www.crt": string(cert), "www.key": string(key)})
+
+		certificate, err := source.Certificate(Request{Name: "www"})
+		So(err, ShouldBeNil)
+		So(certificate.Cert, ShouldResemble, cert)
+
+		_, err = source.Certificate(Request{Name: "api"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func Test_VaultSource(t *testing.T) {
+	Convey("VaultSource", t, func() {
+		cert, key := selfSigned("www.example.com", time.Now().Add(time.Hour))
+
+		var requested, token string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = r.URL.Path
+			token = r.Header.Get("X-Vault-Token")
+
+			if r.URL.Path != "/v1/secret/data/sidecar/certs/www" {
+				w.WriteHeader(404)
+				fmt.Fprint(w, `{"errors": []}`)
+				return
+			}
+			fmt.Fprintf(w, `{"data": {"data": {"certificate": %q, "private_key": %q}}}`, cert, key)
+		}))
+		defer server.Close()
+
+		source := NewVaultSource(server.URL+"/", "s.token")
+
+		Convey("fetches certificates from the KV store", func() {
+			certificate, err := source.Certificate(Request{Name: "www"})
+			So(err, ShouldBeNil)
+			So(certificate.Key, ShouldResemble, key)
+			So(requested, ShouldEqual, "/v1/secret/data/sidecar/certs/www")
+			So(token, ShouldEqual, "s.token")
+		})
+
+		Convey("returns an error for missing certificates", func() {
+			_, err := source.Certificate(Request{Name: "api"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "404")
+		})
+
+		Convey("refuses names that would change the path", func() {
+			_, err := source.Certificate(Request{Name: "../../sys/seal"})
+			So(err, ShouldNotBeNil)
+			So(requested, ShouldBeEmpty)
+		})
+	})
+}
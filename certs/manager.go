@@ -0,0 +1,327 @@
+package certs
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often the Manager checks for certificates that are missing or due to
+// be renewed
+const SyncInterval = time.Minute
+
+// A Manager fetches the certificates the services in the state ask for and
+// writes them into Dir, where the proxy config refers to them. Certificates
+// are fetched again every RenewInterval, so rotating one in the Source gets
+// it to the proxy. OnRotate is called whenever a certificate file has been
+// written, and is usually the proxy's verified reload. When it fails, the
+// files written are put back the way they were, so a certificate the proxy
+// won't load doesn't block its later reloads. When IssueForHostnames is set,
+// services with PublicHostnames but no TLSCert get a certificate too.
+type Manager struct {
+	Dir               string
+	Source            Source
+	RenewInterval     time.Duration
+	IssueForHostnames bool
+	OnRotate          func() error
+	fetched           map[string]time.Time
+	replaced          map[string][]byte // What the files written held before, nil if they were new
+	eventChannel      chan catalog.ChangeEvent
+	sync.Mutex
+}
+
+func NewManager(dir string, source Source) *Manager {
+	return &Manager{
+		Dir:           dir,
+		Source:        source,
+		RenewInterval: time.Hour,
+		fetched:       make(map[string]time.Time),
+		replaced:      make(map[string][]byte),
+	}
+}
+
+// Path returns where the named certificate is written in the directory
+func Path(dir string, name string) string {
+	return filepath.Join(dir, name+".pem")
+}
+
+// wanted returns requests for the certificates the alive services ask for,
+// sorted by name. Each one covers the public hostnames of all the services
+// that share it.
+func (m *Manager) wanted(state *catalog.ServicesState) []Request {
+	hostnames := make(map[string]map[string]struct{})
+
+	state.RLock()
+	state.EachServiceMerged(func(hostname *string, serviceId *string, svc *service.Service) {
+		name := NameFor(svc, m.IssueForHostnames)
+		if name == "" || !svc.IsAlive() {
+			return
+		}
+
+		if hostnames[name] == nil {
+			hostnames[name] = make(map[string]struct{})
+		}
+		for _, publicName := range svc.PublicHostnames {
+			hostnames[name][publicName] = struct{}{}
+		}
+	})
+	state.RUnlock()
+
+	var requests []Request
+	for name, names := range hostnames {
+		request := Request{Name: name}
+		for publicName := range names {
+			request.Hostnames = append(request.Hostnames, publicName)
+		}
+		sort.Strings(request.Hostnames)
+		requests = append(requests, request)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Name < requests[j].Name })
+
+	return requests
+}
+
+// Sync fetches the certificates that are missing from the directory or are
+// due to be renewed, and writes out the ones that have changed. It returns
+// whether any were written. A certificate that can't be fetched doesn't stop
+// the others.
+func (m *Manager) Sync(state *catalog.ServicesState) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var changed bool
+	var problems []string
+
+	now := time.Now().UTC()
+	for _, request := range m.wanted(state) {
+		name := request.Name
+		if !ValidName(name) {
+			problems = append(problems, fmt.Sprintf("invalid certificate name '%s'", name))
+			continue
+		}
+
+		request.Current = m.current(name)
+		if request.Current != nil && now.Sub(m.fetched[name]) < m.RenewInterval {
+			continue
+		}
+
+		written, err := m.fetch(request)
+		if err != nil {
+			metrics.IncrCounter([]string{"certs", "errors"}, 1)
+			problems = append(problems, err.Error())
+			continue
+		}
+		m.fetched[name] = now
+
+		if written {
+			metrics.IncrCounter([]string{"certs", "rotated"}, 1)
+			changed = true
+		}
+	}
+
+	if len(problems) > 0 {
+		return changed, fmt.Errorf("Error syncing certificates: %s", strings.Join(problems, "; "))
+	}
+
+	return changed, nil
+}
+
+// current loads the certificate we already have in the directory, if any
+func (m *Manager) current(name string) *Certificate {
+	data, err := ioutil.ReadFile(Path(m.Dir, name))
+	if err != nil {
+		return nil
+	}
+
+	// The file has the chain followed by the key
+	var certPEM, keyPEM []byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+
+	cert, err := NewCertificate(name, certPEM, keyPEM)
+	if err != nil {
+		log.Warnf("Replacing unreadable certificate '%s': %s", name, err)
+		return nil
+	}
+
+	return cert
+}
+
+// fetch gets a certificate from the Source and writes it out, unless the
+// file already has the same contents. Returns whether it wrote the file.
+func (m *Manager) fetch(request Request) (bool, error) {
+	name := request.Name
+
+	cert, err := m.Source.Certificate(request)
+	if err != nil {
+		return false, err
+	}
+
+	if time.Now().After(cert.Expires) {
+		log.Warnf("Certificate '%s' expired at %s", name, cert.Expires)
+	}
+
+	data := cert.PEM()
+	path := Path(m.Dir, name)
+
+	existing, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(existing, data) {
+		return false, nil
+	}
+
+	if err := m.write(name, data); err != nil {
+		return false, err
+	}
+
+	// Keep the oldest contents until the proxy has loaded the new ones
+	if _, ok := m.replaced[name]; !ok {
+		m.replaced[name] = existing
+	}
+
+	log.Infof("Wrote certificate '%s', expiring %s", name, cert.Expires)
+
+	return true, nil
+}
+
+// write writes a certificate file to the side and moves it into place, so
+// the proxy never loads half a certificate
+func (m *Manager) write(name string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(m.Dir, ".cert")
+	if err != nil {
+		return fmt.Errorf("Error writing certificate '%s': %s", name, err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("Error writing certificate '%s': %s", name, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("Error writing certificate '%s': %s", name, err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), Path(m.Dir, name)); err != nil {
+		return fmt.Errorf("Error writing certificate '%s': %s", name, err)
+	}
+
+	return nil
+}
+
+// rollBack puts the certificate files written since the proxy last loaded
+// them back the way they were. They aren't fetched again until they are next
+// due, so a CA isn't asked for a new certificate on every sync.
+func (m *Manager) rollBack() {
+	m.Lock()
+	defer m.Unlock()
+
+	for name, previous := range m.replaced {
+		var err error
+		if previous == nil {
+			err = os.Remove(Path(m.Dir, name))
+		} else {
+			err = m.write(name, previous)
+		}
+
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error rolling back certificate '%s': %s", name, err)
+			continue
+		}
+
+		log.Warnf("Rolled back certificate '%s' that the proxy wouldn't load", name)
+		metrics.IncrCounter([]string{"certs", "rolled_back"}, 1)
+	}
+
+	m.replaced = make(map[string][]byte)
+}
+
+// loaded forgets what the files written held before, once the proxy has
+// loaded them
+func (m *Manager) loaded() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.replaced = make(map[string][]byte)
+}
+
+// syncAndRotate syncs the certificates and calls OnRotate if any changed,
+// rolling them back if it fails
+func (m *Manager) syncAndRotate(state *catalog.ServicesState) {
+	changed, err := m.Sync(state)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	if !changed {
+		return
+	}
+	if m.OnRotate == nil {
+		m.loaded()
+		return
+	}
+
+	if err := m.OnRotate(); err != nil {
+		log.Errorf("Error reloading after certificate rotation: %s", err)
+		m.rollBack()
+		return
+	}
+	m.loaded()
+}
+
+// Run syncs the certificates on each iteration of the looper, picking up
+// renewals
+func (m *Manager) Run(state *catalog.ServicesState, looper director.Looper) {
+	looper.Loop(func() error {
+		m.syncAndRotate(state)
+		return nil
+	})
+}
+
+// Watch syncs the certificates whenever the state changes, so a new service
+// gets its certificate without waiting for the next renewal
+func (m *Manager) Watch(state *catalog.ServicesState) {
+	m.eventChannel = make(chan catalog.ChangeEvent, 2)
+	state.AddListener(m)
+
+	for range m.eventChannel {
+		m.syncAndRotate(state)
+	}
+
+	err := state.RemoveListener(m.Name())
+	if err != nil {
+		log.Warnf("Failed to remove certificate manager listener: %s", err)
+	}
+}
+
+// Name is part of the catalog.Listener interface. Returns the listener name.
+func (m *Manager) Name() string {
+	return "CertManager"
+}
+
+// Managed is part of the catalog.Listener interface. Like the proxies, the
+// manager is added and removed by hand.
+func (m *Manager) Managed() bool {
+	return false
+}
+
+// Chan is part of the catalog.Listener interface. Returns the channel we listen on.
+func (m *Manager) Chan() chan catalog.ChangeEvent {
+	return m.eventChannel
+}
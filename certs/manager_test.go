@@ -0,0 +1,126 @@
+package certs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Manager(t *testing.T) {
+	Convey("Manager", t, func() {
+		dir, err := ioutil.TempDir("", "certs")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		cert, key := selfSigned("www.example.com", time.Now().Add(time.Hour))
+		secrets := mapSecrets{"www.crt": string(cert), "www.key": string(key)}
+
+		state := catalog.NewServicesState()
+		state.Hostname = "alpha"
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef0001", Name: "web", Hostname: "alpha", TLSCert: "www",
+			Status: service.ALIVE, Created: time.Now().UTC(), Updated: time.Now().UTC(),
+		})
+
+		manager := NewManager(dir, NewSecretsSource(secrets))
+
+		Convey("writes out the certificates the services ask for", func() {
+			changed, err := manager.Sync(state)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeTrue)
+
+			written, err := ioutil.ReadFile(Path(dir, "www"))
+			So(err, ShouldBeNil)
+			So(string(written), ShouldContainSubstring, "PRIVATE KEY")
+		})
+
+		Convey("doesn't fetch again until the certificate is due for renewal", func() {
+			manager.Sync(state)
+			delete(secrets, "www.crt")
+
+			changed, err := manager.Sync(state)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeFalse)
+		})
+
+		Convey("writes out rotated certificates when they are renewed", func() {
+			manager.RenewInterval = 0
+			manager.Sync(state)
+
+			changed, err := manager.Sync(state)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeFalse) // Nothing new
+
+			cert, key := selfSigned("www.example.com", time.Now().Add(2*time.Hour))
+			secrets["www.crt"], secrets["www.key"] = string(cert), string(key)
+
+			changed, err = manager.Sync(state)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeTrue)
+		})
+
+		Convey("reloads when a certificate changes", func() {
+			var rotations int
+			manager.OnRotate = func() error { rotations++; return nil }
+
+			manager.syncAndRotate(state)
+			manager.syncAndRotate(state)
+			So(rotations, ShouldEqual, 1)
+		})
+
+		Convey("rolls back certificates the proxy won't load", func() {
+			manager.RenewInterval = 0
+			manager.OnRotate = func() error { return nil }
+			manager.syncAndRotate(state)
+			before, _ := ioutil.ReadFile(Path(dir, "www"))
+
+			cert, key := selfSigned("www.example.com", time.Now().Add(2*time.Hour))
+			secrets["www.crt"], secrets["www.key"] = string(cert), string(key)
+			manager.OnRotate = func() error { return errors.New("verification failed") }
+			manager.syncAndRotate(state)
+
+			after, _ := ioutil.ReadFile(Path(dir, "www"))
+			So(string(after), ShouldEqual, string(before))
+			So(manager.replaced, ShouldBeEmpty)
+
+			Convey("and removes the new ones", func() {
+				os.Remove(Path(dir, "www"))
+				manager.syncAndRotate(state)
+
+				_, err := os.Stat(Path(dir, "www"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("asks for certificates for public hostnames when issuing them", func() {
+			state.AddServiceEntry(service.Service{
+				ID: "deadbeef0002", Name: "shop", Hostname: "alpha",
+				PublicHostnames: []string{"shop.example.com", "example.com"},
+				Status:          service.ALIVE, Created: time.Now().UTC(), Updated: time.Now().UTC(),
+			})
+
+			So(len(manager.wanted(state)), ShouldEqual, 1)
+
+			manager.IssueForHostnames = true
+			requests := manager.wanted(state)
+			So(len(requests), ShouldEqual, 2)
+			So(requests[0].Name, ShouldEqual, "shop.example.com")
+			So(requests[0].Hostnames, ShouldResemble, []string{"example.com", "shop.example.com"})
+			So(requests[1].Name, ShouldEqual, "www")
+		})
+
+		Convey("reports certificates it can't fetch", func() {
+			delete(secrets, "www.key")
+
+			changed, err := manager.Sync(state)
+			So(err, ShouldNotBeNil)
+			So(changed, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package certs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A VaultSource reads certificates from a Vault KV version 2 secrets engine.
+// Each certificate is a secret at <Mount>/<Prefix>/<name> with the fields
+// "certificate" and "private_key".
+type VaultSource struct {
+	Address string
+	Token   string
+	Mount   string
+	Prefix  string
+	Client  *http.Client
+}
+
+func NewVaultSource(address string, token string) *VaultSource {
+	return &VaultSource{
+		Address: strings.TrimRight(address, "/"),
+		Token:   token,
+		Mount:   "secret",
+		Prefix:  "sidecar/certs",
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type vaultResponse struct {
+	Data struct {
+		Data map[string]string `json:"data"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// Certificate fetches the named certificate from Vault
+func (v *VaultSource) Certificate(request Request) (*Certificate, error) {
+	name := request.Name
+	if !ValidName(name) {
+		return nil, fmt.Errorf("Error fetching certificate: invalid name '%s'", name)
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/data/%s/%s", v.Address, v.Mount, strings.Trim(v.Prefix, "/"), name)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error building Vault request: %s", err)
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching certificate '%s' from Vault: %s", name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading certificate '%s' from Vault: %s", name, err)
+	}
+
+	var result vaultResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("Error decoding certificate '%s' from Vault: %s", name, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching certificate '%s' from Vault: got status %d %s",
+			name, resp.StatusCode, strings.Join(result.Errors, ", "))
+	}
+
+	fields := result.Data.Data
+	if fields["certificate"] == "" || fields["private_key"] == "" {
+		return nil, fmt.Errorf("Error fetching certificate '%s' from Vault: missing certificate or private_key", name)
+	}
+
+	return NewCertificate(name, []byte(fields["certificate"]), []byte(fields["private_key"]))
+}
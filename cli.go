@@ -8,12 +8,21 @@ import (
 )
 
 type CliOpts struct {
+	Command      string
+	Format       *string
+	SidecarURL   *string
 	AdvertiseIP  *string
 	ClusterIPs   *[]string
 	ClusterName  *string
 	CpuProfile   *bool
 	Discover     *[]string
 	LoggingLevel *string
+	StateDir     *string
+	FixtureFile  *string
+	Anonymize    *bool
+	Once         *bool
+	Verify       *bool
+	Reload       *bool
 }
 
 func exitWithError(err error, message string) {
@@ -33,9 +42,28 @@ func parseCommandLine() *CliOpts {
 	opts.CpuProfile = app.Flag("cpuprofile", "Enable CPU profiling").Short('p').Bool()
 	opts.Discover = app.Flag("discover", "Method of discovery").Short('d').NoEnvar().Strings()
 	opts.LoggingLevel = app.Flag("logging-level", "Set the logging level").Short('l').String()
+	opts.Format = app.Flag("format", "Output format for commands (text, json)").Default("text").Enum("text", "json")
+	opts.SidecarURL = app.Flag("url", "The Sidecar to query for commands").Default("http://localhost:7777").String()
 
-	_, err := app.Parse(os.Args[1:])
+	run := app.Command("run", "Run Sidecar").Default()
+	opts.Once = run.Flag("once", "Discover the local services, write the HAproxy config for them, and exit").Bool()
+	opts.Verify = run.Flag("verify", "Verify the config written by --once, and keep the old one if it fails").Default("true").Bool()
+	opts.Reload = run.Flag("reload", "Reload HAproxy after --once writes a new config").Bool()
+	app.Command("render", "Render the HAproxy config from a running Sidecar's state")
+	replay := app.Command("replay", "Render the HAproxy config for each state snapshot in a directory and report the churn")
+	opts.StateDir = replay.Arg("dir", "The directory of state snapshots").Required().String()
+	fixture := app.Command("fixture", "Capture a running Sidecar's state as a snapshot for render tests")
+	opts.FixtureFile = fixture.Arg("file", "Where to write the snapshot, instead of stdout").String()
+	opts.Anonymize = fixture.Flag("anonymize", "Replace the hostnames and IP addresses in the snapshot").Bool()
+	app.Command("check-config", "Validate the configuration in the environment")
+	app.Command("services", "List the services known to a running Sidecar")
+	app.Command("checks", "List the health checks of a running Sidecar")
+	app.Command("consistency", "Compare the state and proxy config across the cluster")
+	app.Command("encrypt-secrets", "Encrypt a JSON object of secrets from stdin for SIDECAR_SECRETS_FILE")
+
+	command, err := app.Parse(os.Args[1:])
 	exitWithError(err, "Failed to parse CLI opts")
+	opts.Command = command
 
 	return &opts
 }
@@ -0,0 +1,122 @@
+// Package clock is the time source for the parts of Sidecar that act on
+// the time, like expiring services and scheduling health checks. Tests, and
+// anyone embedding Sidecar, can swap in a Fake to move the time themselves.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and waits on it
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the system clock
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// OrReal returns the clock passed in, or the Real one when it's nil, so that
+// structs built without their constructor still work
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real{}
+	}
+	return c
+}
+
+// A Fake clock only moves when it's told to. Anything waiting on After fires
+// once the clock is moved past its deadline.
+type Fake struct {
+	now     time.Time
+	waiters []waiter
+	sync.Mutex
+}
+
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewFake returns a Fake clock set to the time passed in
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.Lock()
+	defer f.Unlock()
+
+	// Buffered, so firing never blocks on a waiter that went away
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+
+	f.waiters = append(f.waiters, waiter{deadline: f.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward and fires the waiters that are now due
+func (f *Fake) Advance(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.setLocked(f.now.Add(d))
+}
+
+// Set moves the clock to the time passed in and fires the waiters that are
+// now due. It can move the clock backward, which fires nothing.
+func (f *Fake) Set(now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.setLocked(now)
+}
+
+// Waiters returns how many callers of After haven't fired yet. Tests use it
+// to know another goroutine is waiting before they move the clock.
+func (f *Fake) Waiters() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return len(f.waiters)
+}
+
+// setLocked moves the clock and fires the due waiters in deadline order.
+// Note: the lock must be held!
+func (f *Fake) setLocked(now time.Time) {
+	f.now = now
+
+	sort.SliceStable(f.waiters, func(i, j int) bool {
+		return f.waiters[i].deadline.Before(f.waiters[j].deadline)
+	})
+
+	var pending []waiter
+	for _, w := range f.waiters {
+		if w.deadline.After(now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- now
+	}
+	f.waiters = pending
+}
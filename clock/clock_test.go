@@ -0,0 +1,52 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Fake(t *testing.T) {
+	Convey("A Fake clock", t, func() {
+		start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		fake := NewFake(start)
+
+		Convey("only moves when it's told to", func() {
+			So(fake.Now(), ShouldEqual, start)
+
+			fake.Advance(time.Minute)
+			So(fake.Now(), ShouldEqual, start.Add(time.Minute))
+
+			fake.Set(start)
+			So(fake.Now(), ShouldEqual, start)
+		})
+
+		Convey("fires the waiters once their deadline passes", func() {
+			soon := fake.After(time.Second)
+			later := fake.After(time.Minute)
+			So(fake.Waiters(), ShouldEqual, 2)
+
+			fake.Advance(30 * time.Second)
+			So(<-soon, ShouldEqual, start.Add(30*time.Second))
+			So(later, ShouldHaveLength, 0)
+			So(fake.Waiters(), ShouldEqual, 1)
+
+			fake.Set(start.Add(time.Hour))
+			So(<-later, ShouldEqual, start.Add(time.Hour))
+			So(fake.Waiters(), ShouldEqual, 0)
+		})
+
+		Convey("fires right away when there's nothing to wait for", func() {
+			So(<-fake.After(0), ShouldEqual, start)
+			So(fake.Waiters(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("OrReal()", t, func() {
+		So(OrReal(nil), ShouldHaveSameTypeAs, Real{})
+
+		fake := NewFake(time.Now())
+		So(OrReal(fake), ShouldEqual, fake)
+	})
+}
@@ -0,0 +1,850 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NinesStack/memberlist"
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/config"
+	"github.com/NinesStack/sidecar/consistency"
+	"github.com/NinesStack/sidecar/discovery"
+	"github.com/NinesStack/sidecar/haproxy"
+	"github.com/NinesStack/sidecar/healthy"
+	"github.com/NinesStack/sidecar/secrets"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/sidecarhttp"
+)
+
+// Exit codes for the CLI commands. These are part of the interface for
+// anything embedding Sidecar in a deployment pipeline, so don't renumber them.
+const (
+	exitOK                = 0
+	exitError             = 1
+	exitConfigInvalid     = 2
+	exitDaemonUnreachable = 3
+	exitPartialData       = 4
+	exitDivergent         = 5
+	exitDiscoveryFailed   = 6
+	exitVerifyFailed      = 7
+)
+
+const commandTimeout = 10 * time.Second
+
+// Where commands that take input read it from. Replaced in tests.
+var commandInput io.Reader = os.Stdin
+
+// commandError pairs an error with the exit code the command should return
+type commandError struct {
+	Status   string
+	Message  string
+	ExitCode int
+}
+
+func (e *commandError) Error() string {
+	return e.Message
+}
+
+func newCommandError(code int, format string, args ...interface{}) *commandError {
+	return &commandError{Status: "error", Message: fmt.Sprintf(format, args...), ExitCode: code}
+}
+
+// runCommand runs one of the non-daemon CLI commands, writing the results
+// to output, and returns the exit code for the process.
+func runCommand(opts *CliOpts, output io.Writer) int {
+	var code int
+	var err *commandError
+
+	switch opts.Command {
+	case "run":
+		code, err = onceCommand(opts, output)
+	case "check-config":
+		code, err = checkConfigCommand(opts, output)
+	case "render":
+		code, err = renderCommand(opts, output)
+	case "replay":
+		code, err = replayCommand(opts, output)
+	case "fixture":
+		code, err = fixtureCommand(opts, output)
+	case "services":
+		code, err = servicesCommand(opts, output)
+	case "checks":
+		code, err = checksCommand(opts, output)
+	case "consistency":
+		code, err = consistencyCommand(opts, output)
+	case "encrypt-secrets":
+		code, err = encryptSecretsCommand(opts, output)
+	default:
+		err = newCommandError(exitError, "Unknown command: %s", opts.Command)
+	}
+
+	if err != nil {
+		writeCommandError(*opts.Format, output, err)
+		return err.ExitCode
+	}
+
+	return code
+}
+
+func writeCommandError(format string, output io.Writer, cmdErr *commandError) {
+	if format == "json" {
+		writeJson(output, cmdErr)
+		return
+	}
+
+	fmt.Fprintf(output, "Error: %s\n", cmdErr.Message)
+}
+
+func writeJson(output io.Writer, data interface{}) {
+	jsonBytes, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		fmt.Fprintf(output, "Error marshaling output: %s\n", err)
+		return
+	}
+
+	fmt.Fprintln(output, string(jsonBytes))
+}
+
+// loadCommandConfig loads the config from the environment and applies the
+// CLI overrides, the same way the daemon does it.
+func loadCommandConfig(opts *CliOpts) (*config.Config, *commandError) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, newCommandError(exitConfigInvalid, "Can't parse environment config: %s", err)
+	}
+	configureOverrides(cfg, opts)
+
+	return cfg, nil
+}
+
+// fetchFromSidecar fetches a path from the running Sidecar's API and returns
+// the response body.
+func fetchFromSidecar(opts *CliOpts, path string) ([]byte, *commandError) {
+	url := strings.TrimRight(*opts.SidecarURL, "/") + path
+	client := &http.Client{Timeout: commandTimeout}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, newCommandError(exitDaemonUnreachable, "Error contacting Sidecar at %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newCommandError(exitDaemonUnreachable, "Error reading response from %s: %s", url, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newCommandError(exitDaemonUnreachable, "Error fetching %s: got status %d", url, resp.StatusCode)
+	}
+
+	return body, nil
+}
+
+// checkConfigCommand validates the environment config and the templates it
+// points to, without starting anything.
+func checkConfigCommand(opts *CliOpts, output io.Writer) (int, *commandError) {
+	cfg, cmdErr := loadCommandConfig(opts)
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	var problems []string
+
+	if _, err := configureServiceNamer(cfg); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid service namer: %s", err))
+	}
+
+	if _, err := discovery.NewServiceIdentifier(cfg.Services.Identity); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid service identity: %s", err))
+	}
+
+	if len(cfg.Services.PortRanges) > 0 {
+		if _, err := discovery.ParsePortRanges(cfg.Services.PortRanges); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid service port ranges: %s", err))
+		}
+	}
+
+	if !cfg.HAproxy.Disable {
+		proxy, err := configureHAproxy(cfg)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid HAproxy config: %s", err))
+		} else if err := proxy.WriteConfig(catalog.NewServicesState(), ioutil.Discard); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid HAproxy template: %s", err))
+		} else if err := validateHAproxyTuning(proxy); err != nil {
+			problems = append(problems, err.Error())
+		} else if proxy.CertDir != "" {
+			if _, err := configureCerts(cfg, proxy, catalog.NewServicesState()); err != nil {
+				problems = append(problems, fmt.Sprintf("Invalid certificate config: %s", err))
+			}
+		}
+
+		if _, err := configureOutliers(cfg, nil); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid outlier detection config: %s", err))
+		}
+
+		if _, err := configureLoadWeigher(cfg, nil); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid load weighting config: %s", err))
+		}
+	}
+
+	if _, err := configureConsistency(cfg, nil, nil, nil); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid consistency checker config: %s", err))
+	}
+
+	if len(problems) > 0 {
+		return 0, newCommandError(exitConfigInvalid, "%s", strings.Join(problems, "; "))
+	}
+
+	if *opts.Format == "json" {
+		writeJson(output, struct{ Status string }{Status: "ok"})
+	} else {
+		fmt.Fprintln(output, "Config OK")
+	}
+
+	return exitOK, nil
+}
+
+// renderCommand renders the HAproxy config from the state of a running
+// Sidecar, using the local HAproxy settings.
+func renderCommand(opts *CliOpts, output io.Writer) (int, *commandError) {
+	cfg, cmdErr := loadCommandConfig(opts)
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	body, cmdErr := fetchFromSidecar(opts, "/api/state.json")
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	state, err := catalog.Decode(body)
+	if err != nil {
+		return 0, newCommandError(exitError, "Error decoding state: %s", err)
+	}
+
+	proxy, err := configureHAproxy(cfg)
+	if err != nil {
+		return 0, newCommandError(exitConfigInvalid, "Can't configure HAproxy: %s", err)
+	}
+
+	var rendered strings.Builder
+	err = proxy.WriteConfig(state, &rendered)
+	if err != nil {
+		return 0, newCommandError(exitConfigInvalid, "Error rendering HAproxy config: %s", err)
+	}
+
+	if *opts.Format == "json" {
+		writeJson(output, struct{ Config string }{Config: rendered.String()})
+	} else {
+		fmt.Fprint(output, rendered.String())
+	}
+
+	return exitOK, nil
+}
+
+// A onceReport is what running Sidecar once did to the HAproxy config
+type onceReport struct {
+	ConfigFile string
+	Services   int
+	Changed    bool
+	Verified   bool
+	Reloaded   bool
+}
+
+// onceCommand discovers the services on this host, renders the HAproxy
+// config for them, and writes it out, then exits. It's for hosts managed by
+// cron or config management rather than running the daemon. The config is
+// only written when it changed, leaving out the comments, and when it fails
+// to verify the old one is put back.
+func onceCommand(opts *CliOpts, output io.Writer) (int, *commandError) {
+	cfg, cmdErr := loadCommandConfig(opts)
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	publishedIP, err := getPublishedIP(cfg.Sidecar.ExcludeIPs, cfg.Sidecar.AdvertiseIP)
+	if err != nil {
+		return 0, newCommandError(exitConfigInvalid, "Can't find the address to advertise: %s", err)
+	}
+
+	hostname, _ := os.Hostname()
+	disco := configureDiscovery(cfg, publishedIP, &memberlist.Node{Name: hostname}, nil)
+	if err := disco.Refresh(); err != nil {
+		return 0, newCommandError(exitDiscoveryFailed, "Error discovering services: %s", err)
+	}
+
+	services := disco.Services()
+	state := catalog.NewServicesState()
+	state.ClusterName = cfg.Sidecar.ClusterName
+	for _, svc := range services {
+		state.AddServiceEntry(svc)
+	}
+
+	proxy, err := configureHAproxy(cfg)
+	if err != nil {
+		return 0, newCommandError(exitConfigInvalid, "Can't configure HAproxy: %s", err)
+	}
+
+	var rendered bytes.Buffer
+	err = proxy.WriteConfig(state, &rendered)
+	if err != nil {
+		return 0, newCommandError(exitConfigInvalid, "Error rendering HAproxy config: %s", err)
+	}
+
+	report := onceReport{ConfigFile: proxy.ConfigFile, Services: len(services)}
+
+	previous, err := ioutil.ReadFile(proxy.ConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, newCommandError(exitError, "Error reading %s: %s", proxy.ConfigFile, err)
+	}
+	existed := err == nil
+	report.Changed = !existed || haproxy.HashConfig(previous) != haproxy.HashConfig(rendered.Bytes())
+
+	if report.Changed {
+		err := proxy.InstallConfig(rendered.Bytes(), *opts.Verify)
+		if verifyErr, ok := err.(*haproxy.VerifyError); ok {
+			return 0, newCommandError(exitVerifyFailed, "Failed to verify HAproxy config, kept the old one: %s", verifyErr.Err)
+		}
+		if err != nil {
+			return 0, newCommandError(exitError, "Error writing %s: %s", proxy.ConfigFile, err)
+		}
+		report.Verified = *opts.Verify
+
+		if *opts.Reload {
+			if err := proxy.Reload(); err != nil {
+				return 0, newCommandError(exitError, "Error reloading HAproxy: %s", err)
+			}
+			report.Reloaded = true
+		}
+	}
+
+	if *opts.Format == "json" {
+		writeJson(output, report)
+		return exitOK, nil
+	}
+
+	if !report.Changed {
+		fmt.Fprintf(output, "%s is up to date with %d services\n", report.ConfigFile, report.Services)
+		return exitOK, nil
+	}
+
+	fmt.Fprintf(output, "Wrote %s with %d services", report.ConfigFile, report.Services)
+	if report.Verified {
+		fmt.Fprint(output, ", verified")
+	}
+	if report.Reloaded {
+		fmt.Fprint(output, ", reloaded")
+	}
+	fmt.Fprintln(output)
+
+	return exitOK, nil
+}
+
+// A replayStep is what rendering one state snapshot would have changed
+type replayStep struct {
+	File    string
+	Servers int
+	Reload  bool
+	Added   []string `json:",omitempty"` // As backend/server
+	Removed []string `json:",omitempty"`
+	Error   string   `json:",omitempty"` // Set when the snapshot couldn't be rendered
+}
+
+// A replayReport adds up the churn over all of the snapshots
+type replayReport struct {
+	Snapshots      int
+	Reloads        int
+	ServersAdded   int
+	ServersRemoved int
+	Skipped        int
+	Steps          []replayStep
+}
+
+// replayCommand renders the HAproxy config for each of the state snapshots
+// in a directory, in the order of their file names, and reports how often
+// HAproxy would have been reloaded and which servers came and went. It
+// reports partial data when any of the snapshots couldn't be rendered.
+func replayCommand(opts *CliOpts, output io.Writer) (int, *commandError) {
+	cfg, cmdErr := loadCommandConfig(opts)
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	proxy, err := configureHAproxy(cfg)
+	if err != nil {
+		return 0, newCommandError(exitConfigInvalid, "Can't configure HAproxy: %s", err)
+	}
+
+	entries, err := ioutil.ReadDir(*opts.StateDir)
+	if err != nil {
+		return 0, newCommandError(exitError, "Error reading snapshots: %s", err)
+	}
+
+	var report replayReport
+	var lastHash string
+	var lastServers map[string]bool
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		step := replayStep{File: entry.Name()}
+		hash, servers, err := renderSnapshot(proxy, filepath.Join(*opts.StateDir, entry.Name()))
+		if err != nil {
+			step.Error = err.Error()
+			report.Skipped++
+			report.Steps = append(report.Steps, step)
+			continue
+		}
+
+		step.Servers = len(servers)
+		if lastServers != nil {
+			step.Reload = hash != lastHash
+			step.Added = serversMissingFrom(servers, lastServers)
+			step.Removed = serversMissingFrom(lastServers, servers)
+		}
+		lastHash, lastServers = hash, servers
+
+		report.Snapshots++
+		if step.Reload {
+			report.Reloads++
+		}
+		report.ServersAdded += len(step.Added)
+		report.ServersRemoved += len(step.Removed)
+		report.Steps = append(report.Steps, step)
+	}
+
+	if report.Snapshots == 0 && report.Skipped == 0 {
+		return 0, newCommandError(exitError, "No snapshots found in %s", *opts.StateDir)
+	}
+
+	code := exitOK
+	if report.Skipped > 0 {
+		code = exitPartialData
+	}
+
+	if *opts.Format == "json" {
+		writeJson(output, report)
+		return code, nil
+	}
+
+	writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "SNAPSHOT\tSERVERS\tADDED\tREMOVED\tRELOAD")
+	for _, step := range report.Steps {
+		if step.Error != "" {
+			fmt.Fprintf(writer, "%s\t-\t-\t-\tskipped: %s\n", step.File, step.Error)
+			continue
+		}
+
+		reload := "no"
+		if step.Reload {
+			reload = "yes"
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%s\n", step.File, step.Servers, len(step.Added), len(step.Removed), reload)
+	}
+	writer.Flush()
+
+	fmt.Fprintf(output, "\n%d snapshots, %d reloads, %d servers added, %d removed",
+		report.Snapshots, report.Reloads, report.ServersAdded, report.ServersRemoved)
+	if report.Skipped > 0 {
+		fmt.Fprintf(output, ", %d skipped", report.Skipped)
+	}
+	fmt.Fprintln(output)
+
+	return code, nil
+}
+
+// renderSnapshot renders the HAproxy config for a state snapshot, and returns
+// a hash of it and the servers in it, as backend/server. Comments are left
+// out of the hash, as they are when Sidecar decides whether to reload.
+func renderSnapshot(proxy *haproxy.HAproxy, path string) (string, map[string]bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error reading snapshot: %s", err)
+	}
+
+	state, err := catalog.Decode(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error decoding state: %s", err)
+	}
+
+	var rendered strings.Builder
+	if err := proxy.WriteConfig(state, &rendered); err != nil {
+		return "", nil, fmt.Errorf("Error rendering HAproxy config: %s", err)
+	}
+
+	hash := sha1.New()
+	servers := make(map[string]bool)
+	var backend string
+	for _, line := range strings.Split(rendered.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		hash.Write([]byte(line + "\n"))
+
+		switch {
+		case fields[0] == "backend" && len(fields) > 1:
+			backend = fields[1]
+		case fields[0] == "frontend", fields[0] == "listen", fields[0] == "global", fields[0] == "defaults":
+			backend = ""
+		case fields[0] == "server" && len(fields) > 1 && backend != "":
+			servers[backend+"/"+fields[1]] = true
+		}
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), servers, nil
+}
+
+// serversMissingFrom returns the servers that are in one set but not the
+// other, sorted
+func serversMissingFrom(servers map[string]bool, other map[string]bool) []string {
+	var missing []string
+	for server := range servers {
+		if !other[server] {
+			missing = append(missing, server)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
+
+// A fixtureReport is what fixtureCommand captured
+type fixtureReport struct {
+	File       string
+	Hosts      int
+	Services   int
+	Anonymized bool
+}
+
+// fixtureCommand captures the state of a running Sidecar as a snapshot that
+// render tests and replay can read, optionally with the hostnames and IP
+// addresses replaced. It goes to stdout unless a file is given.
+func fixtureCommand(opts *CliOpts, output io.Writer) (int, *commandError) {
+	body, cmdErr := fetchFromSidecar(opts, "/api/state.json")
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	state, err := catalog.Decode(body)
+	if err != nil {
+		return 0, newCommandError(exitError, "Error decoding state: %s", err)
+	}
+
+	if *opts.Anonymize {
+		anonymizeState(state)
+	}
+
+	report := fixtureReport{File: *opts.FixtureFile, Hosts: len(state.Servers), Anonymized: *opts.Anonymize}
+	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		report.Services++
+	})
+
+	if report.File == "" {
+		fmt.Fprintln(output, string(state.Encode()))
+		return exitOK, nil
+	}
+
+	if err := ioutil.WriteFile(report.File, state.Encode(), 0644); err != nil {
+		return 0, newCommandError(exitError, "Error writing %s: %s", report.File, err)
+	}
+
+	if *opts.Format == "json" {
+		writeJson(output, report)
+		return exitOK, nil
+	}
+
+	fmt.Fprintf(output, "Wrote %s with %d services on %d hosts", report.File, report.Services, report.Hosts)
+	if report.Anonymized {
+		fmt.Fprint(output, ", anonymized")
+	}
+	fmt.Fprintln(output)
+
+	return exitOK, nil
+}
+
+// anonymizeState replaces the hostnames, public hostnames, and IP addresses
+// in the state with made up ones. The same name always gets the same
+// replacement, so the snapshot renders the same config, only with other
+// names in it.
+func anonymizeState(state *catalog.ServicesState) {
+	hostnames := newReplacer(func(i int) string { return fmt.Sprintf("host-%d", i) })
+	publicNames := newReplacer(func(i int) string { return fmt.Sprintf("public-%d.example.com", i) })
+	ips := newReplacer(func(i int) string { return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String() })
+
+	// Numbered in sorted order, so the same state always comes out the same
+	var names []string
+	for name := range state.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	servers := make(map[string]*catalog.Server, len(state.Servers))
+	for _, name := range names {
+		server := state.Servers[name]
+		server.Name = hostnames.replace(server.Name)
+
+		var ids []string
+		for id := range server.Services {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			svc := server.Services[id]
+			svc.Hostname = hostnames.replace(svc.Hostname)
+			if svc.Reporter != "" {
+				svc.Reporter = hostnames.replace(svc.Reporter)
+			}
+			for i, public := range svc.PublicHostnames {
+				svc.PublicHostnames[i] = publicNames.replace(public)
+			}
+			for i, port := range svc.Ports {
+				if ip := net.ParseIP(port.IP); ip != nil && !ip.IsLoopback() {
+					svc.Ports[i].IP = ips.replace(port.IP)
+				}
+			}
+		}
+
+		servers[hostnames.replace(name)] = server
+	}
+
+	state.Servers = servers
+	state.Hostname = hostnames.replace(state.Hostname)
+}
+
+// A replacer hands out a made up value for each one it's given, the same
+// one each time it's given the same value
+type replacer struct {
+	replaced map[string]string
+	next     func(i int) string
+}
+
+func newReplacer(next func(i int) string) *replacer {
+	return &replacer{replaced: make(map[string]string), next: next}
+}
+
+func (r *replacer) replace(value string) string {
+	if replacement, ok := r.replaced[value]; ok {
+		return replacement
+	}
+
+	replacement := r.next(len(r.replaced) + 1)
+	r.replaced[value] = replacement
+
+	return replacement
+}
+
+// servicesCommand lists the services known to a running Sidecar. It reports
+// partial data when any cluster member hasn't sent us anything.
+func servicesCommand(opts *CliOpts, output io.Writer) (int, *commandError) {
+	body, cmdErr := fetchFromSidecar(opts, "/api/services.json")
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	var result sidecarhttp.ApiServices
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, newCommandError(exitError, "Error decoding services: %s", err)
+	}
+
+	code := exitOK
+	for _, member := range result.ClusterMembers {
+		if member.LastUpdated.Unix() <= 0 {
+			code = exitPartialData
+		}
+	}
+
+	if *opts.Format == "json" {
+		writeJson(output, result)
+		return code, nil
+	}
+
+	var names []string
+	for name := range result.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "SERVICE\tINSTANCES\tALIVE")
+	for _, name := range names {
+		var alive int
+		for _, svc := range result.Services[name] {
+			if svc.IsAlive() {
+				alive++
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%d\n", name, len(result.Services[name]), alive)
+	}
+	writer.Flush()
+
+	return code, nil
+}
+
+// checksCommand lists the health checks on a running Sidecar. It reports
+// partial data when any of the checks has not yet run.
+func checksCommand(opts *CliOpts, output io.Writer) (int, *commandError) {
+	body, cmdErr := fetchFromSidecar(opts, "/api/checks.json")
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	var result struct {
+		Checks []healthy.CheckStatus
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, newCommandError(exitError, "Error decoding checks: %s", err)
+	}
+
+	code := exitOK
+	for _, check := range result.Checks {
+		// Checks that are configured wrong are never going to run
+		if check.LastRun.IsZero() && check.ConfigError == "" {
+			code = exitPartialData
+		}
+	}
+
+	if *opts.Format == "json" {
+		writeJson(output, result)
+		return code, nil
+	}
+
+	writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tTYPE\tSTATUS\tLAST RUN\tANNOTATION")
+	for _, check := range result.Checks {
+		lastRun := "never"
+		if !check.LastRun.IsZero() {
+			lastRun = check.LastRun.Format(time.RFC3339)
+		}
+		if check.ConfigError != "" {
+			lastRun = "never (invalid)"
+		}
+
+		annotation := ""
+		if check.Annotation != nil {
+			annotation = fmt.Sprintf("%s (%s)", check.Annotation.Note, check.Annotation.Author)
+			if check.Annotation.Silence {
+				annotation = "[silenced] " + annotation
+			}
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", check.ID, check.Type, check.Status, lastRun, annotation)
+	}
+	writer.Flush()
+
+	return code, nil
+}
+
+// consistencyCommand has a running Sidecar compare the state and proxy config
+// hashes of all of the cluster members, and lists the hosts that differ from
+// the rest. It reports partial data when any of them couldn't be reached.
+func consistencyCommand(opts *CliOpts, output io.Writer) (int, *commandError) {
+	body, cmdErr := fetchFromSidecar(opts, "/api/consistency/cluster.json")
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	var report consistency.Report
+	if err := json.Unmarshal(body, &report); err != nil {
+		return 0, newCommandError(exitError, "Error decoding consistency report: %s", err)
+	}
+
+	code := exitOK
+	if len(report.Unreachable) > 0 {
+		code = exitPartialData
+	}
+	if !report.Consistent() {
+		code = exitDivergent
+	}
+
+	if *opts.Format == "json" {
+		writeJson(output, report)
+		return code, nil
+	}
+
+	writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "HOST\tSTATE\tCONFIG\tSTATUS")
+	for _, member := range report.Members {
+		status := "ok"
+		switch {
+		case member.Error != "":
+			status = "unreachable: " + member.Error
+		case member.Divergent:
+			status = "divergent"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n",
+			member.Name, shortHash(member.StateHash), shortHash(member.ConfigHash), status)
+	}
+	writer.Flush()
+
+	return code, nil
+}
+
+// shortHash shortens a hash for display, like git does
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	if hash == "" {
+		return "-"
+	}
+
+	return hash
+}
+
+// encryptSecretsCommand reads a JSON object of secret names to values and
+// writes it out encrypted with the SIDECAR_SECRETS_KEY_FILE, ready to be
+// used as the SIDECAR_SECRETS_FILE.
+func encryptSecretsCommand(opts *CliOpts, output io.Writer) (int, *commandError) {
+	cfg, cmdErr := loadCommandConfig(opts)
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+
+	if cfg.Sidecar.SecretsKeyFile == "" {
+		return 0, newCommandError(exitConfigInvalid, "SIDECAR_SECRETS_KEY_FILE is not set")
+	}
+
+	key, err := secrets.ReadKey(cfg.Sidecar.SecretsKeyFile)
+	if err != nil {
+		return 0, newCommandError(exitConfigInvalid, "%s", err)
+	}
+
+	plaintext, err := ioutil.ReadAll(commandInput)
+	if err != nil {
+		return 0, newCommandError(exitError, "Error reading secrets: %s", err)
+	}
+
+	// Catch mistakes now rather than when the proxy config is next rendered
+	var values map[string]string
+	if err := json.Unmarshal(plaintext, &values); err != nil {
+		return 0, newCommandError(exitError, "Secrets must be a JSON object of names to values: %s", err)
+	}
+
+	ciphertext, err := secrets.Encrypt(plaintext, key)
+	if err != nil {
+		return 0, newCommandError(exitError, "Error encrypting secrets: %s", err)
+	}
+
+	if _, err := output.Write(ciphertext); err != nil {
+		return 0, newCommandError(exitError, "Error writing secrets: %s", err)
+	}
+
+	return exitOK, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/secrets"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func commandOpts(command string, format string, url string) *CliOpts {
+	empty := ""
+	var emptyList []string
+	once, verify, reload, anonymize := command == "run", true, false, false
+
+	return &CliOpts{
+		Command:      command,
+		Format:       &format,
+		SidecarURL:   &url,
+		AdvertiseIP:  &empty,
+		ClusterIPs:   &emptyList,
+		ClusterName:  &empty,
+		Discover:     &emptyList,
+		LoggingLevel: &empty,
+		StateDir:     &empty,
+		FixtureFile:  &empty,
+		Anonymize:    &anonymize,
+		Once:         &once,
+		Verify:       &verify,
+		Reload:       &reload,
+	}
+}
+
+func Test_runCommand(t *testing.T) {
+	Convey("Running CLI commands", t, func() {
+		var output bytes.Buffer
+		var body string
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+		defer server.Close()
+
+		Convey("check-config passes with the defaults", func() {
+			code := runCommand(commandOpts("check-config", "json", server.URL), &output)
+			So(code, ShouldEqual, exitOK)
+			So(output.String(), ShouldContainSubstring, `"Status": "ok"`)
+		})
+
+		Convey("check-config reports an invalid config", func() {
+			os.Setenv("SERVICES_IDENTITY", "bogus")
+			defer os.Unsetenv("SERVICES_IDENTITY")
+
+			code := runCommand(commandOpts("check-config", "json", server.URL), &output)
+			So(code, ShouldEqual, exitConfigInvalid)
+
+			var result commandError
+			So(json.Unmarshal(output.Bytes(), &result), ShouldBeNil)
+			So(result.Status, ShouldEqual, "error")
+			So(result.ExitCode, ShouldEqual, exitConfigInvalid)
+			So(result.Message, ShouldContainSubstring, "service identity")
+		})
+
+		Convey("check-config reports a verify command without the config file", func() {
+			os.Setenv("HAPROXY_VERIFY_COMMAND", "haproxy -c -f /etc/haproxy.cfg")
+			defer os.Unsetenv("HAPROXY_VERIFY_COMMAND")
+
+			code := runCommand(commandOpts("check-config", "text", server.URL), &output)
+			So(code, ShouldEqual, exitConfigInvalid)
+			So(output.String(), ShouldContainSubstring, "{{.ConfigFile}}")
+		})
+
+		Convey("check-config reports an invalid role", func() {
+			os.Setenv("SIDECAR_ROLE", "bogus")
+			defer os.Unsetenv("SIDECAR_ROLE")
+
+			code := runCommand(commandOpts("check-config", "text", server.URL), &output)
+			So(code, ShouldEqual, exitConfigInvalid)
+			So(output.String(), ShouldContainSubstring, "Invalid role")
+		})
+
+		Convey("reports when the daemon is unreachable", func() {
+			code := runCommand(commandOpts("services", "text", "http://127.0.0.1:1"), &output)
+			So(code, ShouldEqual, exitDaemonUnreachable)
+			So(output.String(), ShouldStartWith, "Error: ")
+		})
+
+		Convey("services lists the services", func() {
+			body = fmt.Sprintf(`{"Services": {"web": [{"ID": "abc", "Status": 0}]},
+				"ClusterMembers": {"alpha": {"Name": "alpha", "LastUpdated": %q}}}`,
+				time.Now().UTC().Format(time.RFC3339))
+
+			code := runCommand(commandOpts("services", "text", server.URL), &output)
+			So(code, ShouldEqual, exitOK)
+			So(output.String(), ShouldContainSubstring, "web")
+		})
+
+		Convey("services reports partial data when a member has no services", func() {
+			body = `{"Services": {}, "ClusterMembers": {"alpha": {"Name": "alpha", "LastUpdated": "1970-01-01T00:00:00Z"}}}`
+
+			code := runCommand(commandOpts("services", "json", server.URL), &output)
+			So(code, ShouldEqual, exitPartialData)
+		})
+
+		Convey("checks reports partial data when a check has not run", func() {
+			body = `{"Checks": [{"ID": "abc", "Type": "HttpGet", "Status": "Unknown"}]}`
+
+			code := runCommand(commandOpts("checks", "text", server.URL), &output)
+			So(code, ShouldEqual, exitPartialData)
+			So(output.String(), ShouldContainSubstring, "never")
+		})
+
+		Convey("checks shows the checks that are configured wrong", func() {
+			body = `{"Checks": [{"ID": "abc", "Type": "HtpGet", "Status": "Failed", "ConfigError": "unknown check type"}]}`
+
+			code := runCommand(commandOpts("checks", "text", server.URL), &output)
+			So(code, ShouldEqual, exitOK)
+			So(output.String(), ShouldContainSubstring, "never (invalid)")
+		})
+
+		Convey("consistency lists the hosts that differ", func() {
+			body = `{"StateHash": "aaa", "Members": [{"Name": "gower", "StateHash": "bbb", "Divergent": true},
+				{"Name": "chaucer", "StateHash": "aaa"}], "Divergent": ["gower"]}`
+
+			code := runCommand(commandOpts("consistency", "text", server.URL), &output)
+			So(code, ShouldEqual, exitDivergent)
+			So(output.String(), ShouldContainSubstring, "divergent")
+		})
+
+		Convey("consistency reports partial data when a host is unreachable", func() {
+			body = `{"StateHash": "aaa", "Members": [{"Name": "gower", "Error": "connection refused"},
+				{"Name": "chaucer", "StateHash": "aaa"}], "Unreachable": ["gower"]}`
+
+			code := runCommand(commandOpts("consistency", "text", server.URL), &output)
+			So(code, ShouldEqual, exitPartialData)
+			So(output.String(), ShouldContainSubstring, "unreachable: connection refused")
+		})
+
+		Convey("encrypt-secrets encrypts the secrets with the key", func() {
+			keyFile, _ := ioutil.TempFile("", "secrets-key")
+			defer os.Remove(keyFile.Name())
+			keyFile.WriteString(strings.Repeat("ab", 32))
+			keyFile.Close()
+
+			os.Setenv("SIDECAR_SECRETS_KEY_FILE", keyFile.Name())
+			defer os.Unsetenv("SIDECAR_SECRETS_KEY_FILE")
+
+			commandInput = strings.NewReader(`{"stats_password": "hunter2"}`)
+			defer func() { commandInput = os.Stdin }()
+
+			code := runCommand(commandOpts("encrypt-secrets", "text", server.URL), &output)
+			So(code, ShouldEqual, exitOK)
+			So(output.String(), ShouldNotContainSubstring, "hunter2")
+
+			key, _ := secrets.ReadKey(keyFile.Name())
+			plaintext, err := secrets.Decrypt(output.Bytes(), key)
+			So(err, ShouldBeNil)
+			So(string(plaintext), ShouldContainSubstring, "hunter2")
+		})
+
+		Convey("encrypt-secrets requires a key", func() {
+			code := runCommand(commandOpts("encrypt-secrets", "text", server.URL), &output)
+			So(code, ShouldEqual, exitConfigInvalid)
+		})
+
+		Convey("replay reports the churn across the snapshots", func() {
+			dir, _ := ioutil.TempDir("", "snapshots")
+			defer os.RemoveAll(dir)
+
+			state := catalog.NewServicesState()
+			snapshot := func(name string, svc service.Service) {
+				svc.Name = "web"
+				svc.Updated = time.Now().UTC()
+				svc.Ports = []service.Port{{Type: "tcp", Port: 32768, ServicePort: 8080, IP: "10.0.0.1"}}
+				state.AddServiceEntry(svc)
+				ioutil.WriteFile(filepath.Join(dir, name), state.Encode(), 0644)
+			}
+			snapshot("01.json", service.Service{ID: "deadbeef001", Hostname: "alpha"})
+			// Only the state version changes
+			snapshot("02.json", service.Service{ID: "deadbeef001", Hostname: "alpha"})
+			snapshot("03.json", service.Service{ID: "deadbeef002", Hostname: "beta"})
+			ioutil.WriteFile(filepath.Join(dir, "04.json"), []byte("not a state"), 0644)
+
+			opts := commandOpts("replay", "json", server.URL)
+			*opts.StateDir = dir
+			code := runCommand(opts, &output)
+			So(code, ShouldEqual, exitPartialData)
+
+			var report replayReport
+			So(json.Unmarshal(output.Bytes(), &report), ShouldBeNil)
+			So(report.Snapshots, ShouldEqual, 3)
+			So(report.Reloads, ShouldEqual, 1)
+			So(report.ServersAdded, ShouldEqual, 1)
+			So(report.Skipped, ShouldEqual, 1)
+			So(report.Steps[1].Reload, ShouldBeFalse)
+			So(report.Steps[2].Added, ShouldResemble, []string{"web-8080/beta-deadbeef002"})
+		})
+
+		Convey("fixture captures the state, and can anonymize it", func() {
+			state := catalog.NewServicesState()
+			state.Hostname = "alpha.internal"
+			state.AddServiceEntry(service.Service{
+				ID: "deadbeef001", Name: "web", Hostname: "alpha.internal", Updated: time.Now().UTC(),
+				PublicHostnames: []string{"web.example.net"},
+				Ports:           []service.Port{{Type: "tcp", Port: 32768, ServicePort: 8080, IP: "192.168.1.10"}},
+			})
+			body = string(state.Encode())
+
+			dir, _ := ioutil.TempDir("", "fixture")
+			defer os.RemoveAll(dir)
+
+			opts := commandOpts("fixture", "text", server.URL)
+			*opts.FixtureFile = filepath.Join(dir, "state.json")
+			*opts.Anonymize = true
+			code := runCommand(opts, &output)
+			So(code, ShouldEqual, exitOK)
+			So(output.String(), ShouldContainSubstring, "with 1 services on 1 hosts, anonymized")
+
+			written, _ := ioutil.ReadFile(*opts.FixtureFile)
+			So(string(written), ShouldNotContainSubstring, "alpha.internal")
+			So(string(written), ShouldNotContainSubstring, "192.168.1.10")
+			So(string(written), ShouldNotContainSubstring, "web.example.net")
+
+			fixture, err := catalog.Decode(written)
+			So(err, ShouldBeNil)
+			So(fixture.Hostname, ShouldEqual, "host-1")
+			svc, err := fixture.GetLocalServiceByID("deadbeef001")
+			So(err, ShouldBeNil)
+			So(svc.Hostname, ShouldEqual, "host-1")
+			So(svc.Ports[0].IP, ShouldEqual, "10.0.0.1")
+			So(svc.PublicHostnames, ShouldResemble, []string{"public-1.example.com"})
+
+			Convey("and writes it to stdout without a file", func() {
+				output.Reset()
+				code := runCommand(commandOpts("fixture", "text", server.URL), &output)
+				So(code, ShouldEqual, exitOK)
+				So(output.String(), ShouldContainSubstring, "alpha.internal")
+			})
+		})
+
+		Convey("run --once", func() {
+			dir, _ := ioutil.TempDir("", "once")
+			defer os.RemoveAll(dir)
+			configFile := filepath.Join(dir, "haproxy.cfg")
+
+			// Static services need an ID to be the same from one run to the next
+			staticFile := filepath.Join(dir, "static.json")
+			ioutil.WriteFile(staticFile, []byte(`[{"Service": {"ID": "deadbeef001", "Name": "some_service",
+				"Ports": [{"Type": "tcp", "Port": 10234, "ServicePort": 9999}], "ProxyMode": "http"}}]`), 0644)
+
+			env := map[string]string{
+				"SIDECAR_DISCOVERY":      "static",
+				"SIDECAR_ADVERTISE_IP":   "10.0.0.1",
+				"STATIC_CONFIG_FILE":     staticFile,
+				"HAPROXY_CONFIG_FILE":    configFile,
+				"HAPROXY_VERIFY_COMMAND": "true {{.ConfigFile}}",
+			}
+			for name, value := range env {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+
+			Convey("writes the config, then leaves it alone when nothing changed", func() {
+				code := runCommand(commandOpts("run", "json", server.URL), &output)
+				So(code, ShouldEqual, exitOK)
+
+				var report onceReport
+				So(json.Unmarshal(output.Bytes(), &report), ShouldBeNil)
+				So(report.Services, ShouldEqual, 1)
+				So(report.Changed, ShouldBeTrue)
+				So(report.Verified, ShouldBeTrue)
+
+				written, _ := ioutil.ReadFile(configFile)
+				So(string(written), ShouldContainSubstring, "some_service")
+
+				output.Reset()
+				code = runCommand(commandOpts("run", "text", server.URL), &output)
+				So(code, ShouldEqual, exitOK)
+				So(output.String(), ShouldContainSubstring, "is up to date with 1 services")
+			})
+
+			Convey("keeps the old config when the new one doesn't verify", func() {
+				ioutil.WriteFile(configFile, []byte("global\n"), 0644)
+				os.Setenv("HAPROXY_VERIFY_COMMAND", "false {{.ConfigFile}}")
+
+				code := runCommand(commandOpts("run", "text", server.URL), &output)
+				So(code, ShouldEqual, exitVerifyFailed)
+				So(output.String(), ShouldContainSubstring, "kept the old one")
+
+				written, _ := ioutil.ReadFile(configFile)
+				So(string(written), ShouldEqual, "global\n")
+			})
+
+			Convey("reports when discovery fails", func() {
+				os.Setenv("STATIC_CONFIG_FILE", filepath.Join(dir, "missing.json"))
+
+				code := runCommand(commandOpts("run", "text", server.URL), &output)
+				So(code, ShouldEqual, exitDiscoveryFailed)
+
+				_, err := os.Stat(configFile)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+}
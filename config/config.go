@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -13,16 +15,108 @@ type ListenerUrlsConfig struct {
 }
 
 type HAproxyConfig struct {
-	ReloadCmd    string `envconfig:"RELOAD_COMMAND"`
-	VerifyCmd    string `envconfig:"VERIFY_COMMAND"`
-	BindIP       string `envconfig:"BIND_IP" default:"192.168.168.168"`
-	TemplateFile string `envconfig:"TEMPLATE_FILE" default:"views/haproxy.cfg"`
-	ConfigFile   string `envconfig:"CONFIG_FILE" default:"/etc/haproxy.cfg"`
-	PidFile      string `envconfig:"PID_FILE" default:"/var/run/haproxy.pid"`
-	Disable      bool   `envconfig:"DISABLE"`
-	User         string `envconfig:"USER" default:"haproxy"`
-	Group        string `envconfig:"GROUP" default:""`
-	UseHostnames bool   `envconfig:"USE_HOSTNAMES"`
+	ReloadCmd            string        `envconfig:"RELOAD_COMMAND"`
+	VerifyCmd            string        `envconfig:"VERIFY_COMMAND"`
+	BindIP               string        `envconfig:"BIND_IP" default:"192.168.168.168"`
+	BindIPv6             string        `envconfig:"BIND_IPV6"`
+	BindInterfaces       []string      `envconfig:"BIND_INTERFACES"`
+	DualStack            bool          `envconfig:"DUAL_STACK"`
+	TemplateFile         string        `envconfig:"TEMPLATE_FILE" default:"views/haproxy.cfg"`
+	TemplateOverlayFile  string        `envconfig:"TEMPLATE_OVERLAY_FILE"`
+	ConfigFile           string        `envconfig:"CONFIG_FILE" default:"/etc/haproxy.cfg"`
+	PidFile              string        `envconfig:"PID_FILE" default:"/var/run/haproxy.pid"`
+	Disable              bool          `envconfig:"DISABLE"`
+	User                 string        `envconfig:"USER" default:"haproxy"`
+	Group                string        `envconfig:"GROUP" default:""`
+	Chroot               string        `envconfig:"CHROOT"`
+	MaxConn              int           `envconfig:"MAXCONN" default:"4096"`
+	NbThread             int           `envconfig:"NBTHREAD"`
+	NbProc               int           `envconfig:"NBPROC"`
+	CPUMap               []string      `envconfig:"CPU_MAP"`
+	NoReusePort          bool          `envconfig:"NO_REUSEPORT"`
+	BindOptions          string        `envconfig:"BIND_OPTIONS"`
+	Binary               string        `envconfig:"BINARY" default:"haproxy"`
+	VersionCheckInterval time.Duration `envconfig:"VERSION_CHECK_INTERVAL" default:"5m"`
+	HTTP2                bool          `envconfig:"HTTP2"`
+	LogTarget            string        `envconfig:"LOG_TARGET" default:"127.0.0.1"`
+	SyslogAddr           string        `envconfig:"SYSLOG_ADDR"`
+	SlowRequestThreshold time.Duration `envconfig:"SLOW_REQUEST_THRESHOLD" default:"1s"`
+	RequestSampleRate    float64       `envconfig:"REQUEST_SAMPLE_RATE" default:"0"`
+	UseHostnames         bool          `envconfig:"USE_HOSTNAMES"`
+	ErrorFilesDir        string        `envconfig:"ERROR_FILES_DIR"`
+	NoBackends           string        `envconfig:"NO_BACKENDS" default:"maintenance"`
+	NoBackendsOverrides  []string      `envconfig:"NO_BACKENDS_OVERRIDES"`
+	CertDir              string        `envconfig:"CERT_DIR"`
+	CertRenewInterval    time.Duration `envconfig:"CERT_RENEW_INTERVAL" default:"1h"`
+	CertFiles            []string      `envconfig:"CERT_FILES"`
+	DefaultCertFile      string        `envconfig:"DEFAULT_CERT_FILE"`
+	HTTPSRedirect        bool          `envconfig:"HTTPS_REDIRECT"`
+	StatsSocket          string        `envconfig:"STATS_SOCKET" default:"/var/run/haproxy_stats.sock"`
+	ReloadDebounce       time.Duration `envconfig:"RELOAD_DEBOUNCE" default:"2s"`
+	ReloadBackoff        time.Duration `envconfig:"RELOAD_BACKOFF" default:"1s"`
+	MaxReloadBackoff     time.Duration `envconfig:"MAX_RELOAD_BACKOFF" default:"1m"`
+	RuntimeUpdates       bool          `envconfig:"RUNTIME_UPDATES"`
+	DataPlaneURL         string        `envconfig:"DATAPLANE_URL"`
+	DataPlaneUser        string        `envconfig:"DATAPLANE_USER" default:"admin"`
+	DataPlanePassword    string        `envconfig:"DATAPLANE_PASSWORD"`
+	VirtualHostPort      int           `envconfig:"VHOST_PORT"`
+	SNIPort              int           `envconfig:"SNI_PORT"`
+	SPOEAgentAddr        string        `envconfig:"SPOE_AGENT_ADDR"`
+	SPOEConfigFile       string        `envconfig:"SPOE_CONFIG_FILE" default:"/etc/haproxy-spoe.conf"`
+	OutlierDetection     bool          `envconfig:"OUTLIER_DETECTION"`
+	OutlierErrorRate     float64       `envconfig:"OUTLIER_ERROR_RATE" default:"0.5"`
+	OutlierMinRequests   int64         `envconfig:"OUTLIER_MIN_REQUESTS" default:"20"`
+	OutlierWeight        int           `envconfig:"OUTLIER_WEIGHT" default:"10"`
+	OutlierInterval      time.Duration `envconfig:"OUTLIER_INTERVAL" default:"10s"`
+	OutlierCooldown      time.Duration `envconfig:"OUTLIER_COOLDOWN" default:"1m"`
+	LoadWeighting        bool          `envconfig:"LOAD_WEIGHTING"`
+	LoadWeightInterval   time.Duration `envconfig:"LOAD_WEIGHT_INTERVAL" default:"30s"`
+	LoadMinWeight        int           `envconfig:"LOAD_MIN_WEIGHT" default:"20"`
+	LoadHeadroom         float64       `envconfig:"LOAD_HEADROOM" default:"10"`
+	ClientRates          bool          `envconfig:"CLIENT_RATES"`
+	ClientRatesInterval  time.Duration `envconfig:"CLIENT_RATES_INTERVAL" default:"10s"`
+	ClientRatesTop       int           `envconfig:"CLIENT_RATES_TOP" default:"10"`
+	TrafficStats         bool          `envconfig:"TRAFFIC_STATS"`
+	TrafficInterval      time.Duration `envconfig:"TRAFFIC_INTERVAL" default:"10s"`
+	ReloadDelaySessions  int           `envconfig:"RELOAD_DELAY_SESSIONS"`
+	MaxReloadDelay       time.Duration `envconfig:"MAX_RELOAD_DELAY" default:"1m"`
+	LongLivedSession     time.Duration `envconfig:"LONG_LIVED_SESSION" default:"1m"`
+	ConnLimits           bool          `envconfig:"CONN_LIMITS"`
+	MemoryPerConn        string        `envconfig:"MEMORY_PER_CONN" default:"1M"`
+	MinServerConn        int           `envconfig:"MIN_SERVER_CONN" default:"10"`
+	ShowExclusions       bool          `envconfig:"SHOW_EXCLUSIONS"`
+	ActiveChecks         bool          `envconfig:"ACTIVE_CHECKS"`
+	ConnectTimeout       time.Duration `envconfig:"CONNECT_TIMEOUT" default:"5s"`
+	ClientTimeout        time.Duration `envconfig:"CLIENT_TIMEOUT" default:"1m"`
+	ServerTimeout        time.Duration `envconfig:"SERVER_TIMEOUT" default:"1m"`
+	Retries              int           `envconfig:"RETRIES" default:"3"`
+	TimeoutsFile         string        `envconfig:"TIMEOUTS_FILE"`
+	DrainPeriod          time.Duration `envconfig:"DRAIN_PERIOD"`
+	MeshPort             int           `envconfig:"MESH_PORT"`
+	MeshCertFile         string        `envconfig:"MESH_CERT_FILE"`
+	MeshCAFile           string        `envconfig:"MESH_CA_FILE"`
+}
+
+type NginxConfig struct {
+	UDPEnable             bool   `envconfig:"UDP_ENABLE"`
+	ReloadCmd             string `envconfig:"RELOAD_COMMAND"`
+	VerifyCmd             string `envconfig:"VERIFY_COMMAND"`
+	BindIP                string `envconfig:"BIND_IP" default:"192.168.168.168"`
+	StreamTemplate        string `envconfig:"STREAM_TEMPLATE_FILE" default:"views/nginx-stream.conf"`
+	StreamTemplateOverlay string `envconfig:"STREAM_TEMPLATE_OVERLAY_FILE"`
+	StreamConfigFile      string `envconfig:"STREAM_CONFIG_FILE" default:"/etc/nginx/stream.d/sidecar.conf"`
+	UseHostnames          bool   `envconfig:"USE_HOSTNAMES"`
+	ProxyEnable           bool   `envconfig:"PROXY_ENABLE"`
+	ProxyTemplate         string `envconfig:"PROXY_TEMPLATE_FILE" default:"views/nginx-proxy.conf"`
+	ProxyTemplateOverlay  string `envconfig:"PROXY_TEMPLATE_OVERLAY_FILE"`
+	ProxyConfigFile       string `envconfig:"PROXY_CONFIG_FILE" default:"/etc/nginx/conf.d/sidecar.conf"`
+}
+
+type IPVSConfig struct {
+	Enable    bool   `envconfig:"ENABLE"`
+	BindIP    string `envconfig:"BIND_IP" default:"192.168.168.169"`
+	Scheduler string `envconfig:"SCHEDULER" default:"rr"`
+	Command   string `envconfig:"COMMAND" default:"ipvsadm"`
 }
 
 type EnvoyConfig struct {
@@ -32,33 +126,129 @@ type EnvoyConfig struct {
 	GRPCPort     string `envconfig:"GRPC_PORT" default:"7776"`
 }
 
+type VaultConfig struct {
+	Addr      string `envconfig:"ADDR"`
+	Token     string `envconfig:"TOKEN"`
+	CertMount string `envconfig:"CERT_MOUNT" default:"secret"`
+	CertPath  string `envconfig:"CERT_PATH" default:"sidecar/certs"`
+}
+
+type ACMEConfig struct {
+	Enable         bool          `envconfig:"ENABLE"`
+	DirectoryURL   string        `envconfig:"DIRECTORY_URL" default:"https://acme-v02.api.letsencrypt.org/directory"`
+	Email          string        `envconfig:"EMAIL"`
+	AccountKeyFile string        `envconfig:"ACCOUNT_KEY_FILE" default:"/etc/sidecar/acme-account.key"`
+	HTTPBind       string        `envconfig:"HTTP_BIND" default:"0.0.0.0:80"`
+	ResponderAddr  string        `envconfig:"RESPONDER_ADDR" default:"127.0.0.1:7779"`
+	RenewBefore    time.Duration `envconfig:"RENEW_BEFORE" default:"720h"`
+}
+
 type ServicesConfig struct {
-	NameMatch    string `envconfig:"NAME_MATCH"`
-	ServiceNamer string `envconfig:"NAMER" default:"docker_label"`
-	NameLabel    string `envconfig:"NAME_LABEL" default:"ServiceName"`
+	NameMatch      string   `envconfig:"NAME_MATCH"`
+	ServiceNamer   string   `envconfig:"NAMER" default:"docker_label"`
+	NameLabel      string   `envconfig:"NAME_LABEL" default:"ServiceName"`
+	NamerOverrides []string `envconfig:"NAMER_OVERRIDES"`
+	Identity       string   `envconfig:"IDENTITY" default:"container"`
+	PortRanges     []string `envconfig:"PORT_RANGES"`
+	NamespaceLabel string   `envconfig:"NAMESPACE_LABEL" default:"Namespace"`
+}
+
+// The subsystems that can be switched on and off independently
+const (
+	ModuleDiscovery = "discovery"
+	ModuleHealthy   = "healthy"
+	ModuleProxy     = "proxy"
+	ModuleAPI       = "api"
+	ModuleMetrics   = "metrics"
+)
+
+var allModules = []string{ModuleDiscovery, ModuleHealthy, ModuleProxy, ModuleAPI, ModuleMetrics}
+
+const (
+	// RoleProxy nodes run everything, including a local proxy for the
+	// services in the cluster. RoleWorker is the same thing.
+	RoleProxy  = "proxy"
+	RoleWorker = "worker"
+	// RoleConsumer nodes take part in state exchange and health checking,
+	// but never render or reload a local proxy
+	RoleConsumer = "consumer"
+	// RoleEdge nodes route traffic to the cluster but run no services
+	RoleEdge = "edge"
+	// RoleObserver nodes only follow the cluster state
+	RoleObserver = "observer"
+)
+
+// The proxies SIDECAR_PROXY can pick from
+const (
+	ProxyHAproxy = "haproxy"
+	ProxyNginx   = "nginx"
+	ProxyEnvoy   = "envoy"
+)
+
+// roleModules are the modules each role runs unless SIDECAR_MODULES says
+// otherwise
+var roleModules = map[string][]string{
+	RoleProxy:    allModules,
+	RoleWorker:   allModules,
+	RoleConsumer: {ModuleDiscovery, ModuleHealthy, ModuleAPI, ModuleMetrics},
+	RoleEdge:     {ModuleProxy, ModuleAPI, ModuleMetrics},
+	RoleObserver: {ModuleAPI, ModuleMetrics},
 }
 
 type SidecarConfig struct {
+	Role                   string        `envconfig:"ROLE" default:"proxy"`
+	Modules                []string      `envconfig:"MODULES"`
+	Proxy                  string        `envconfig:"PROXY"`
 	ExcludeIPs             []string      `envconfig:"EXCLUDE_IPS" default:"192.168.168.168"`
 	Discovery              []string      `envconfig:"DISCOVERY" default:"docker"`
 	StatsAddr              string        `envconfig:"STATS_ADDR"`
 	PushPullInterval       time.Duration `envconfig:"PUSH_PULL_INTERVAL" default:"20s"`
 	GossipMessages         int           `envconfig:"GOSSIP_MESSAGES" default:"15"`
 	GossipInterval         time.Duration `envconfig:"GOSSIP_INTERVAL" default:"200ms"`
+	WireFormat             string        `envconfig:"WIRE_FORMAT" default:"json"`
 	HandoffQueueDepth      int           `envconfig:"HANDOFF_QUEUE_DEPTH" default:"1024"`
 	LoggingFormat          string        `envconfig:"LOGGING_FORMAT"`
 	LoggingLevel           string        `envconfig:"LOGGING_LEVEL" default:"info"`
 	DefaultCheckEndpoint   string        `envconfig:"DEFAULT_CHECK_ENDPOINT" default:"/version"`
+	CheckDNSCacheTTL       time.Duration `envconfig:"CHECK_DNS_CACHE_TTL" default:"0s"`
+	CheckAnnotationsFile   string        `envconfig:"CHECK_ANNOTATIONS_FILE"`
+	CheckHistorySize       int           `envconfig:"CHECK_HISTORY_SIZE" default:"20"`
+	CheckHistoryMaxBytes   int           `envconfig:"CHECK_HISTORY_MAX_BYTES" default:"1048576"`
+	CheckViaProxy          bool          `envconfig:"CHECK_VIA_PROXY"`
+	CheckTracing           bool          `envconfig:"CHECK_TRACING"`
+	EventsSize             int           `envconfig:"EVENTS_SIZE" default:"500"`
+	EventsMaxBytes         int           `envconfig:"EVENTS_MAX_BYTES" default:"1048576"`
+	TimelineRetention      time.Duration `envconfig:"TIMELINE_RETENTION" default:"24h"`
+	TimelineMassFailures   int           `envconfig:"TIMELINE_MASS_FAILURES" default:"3"`
+	ChangeLogSize          int           `envconfig:"CHANGE_LOG_SIZE" default:"1000"`
+	ChangeLogSpillFile     string        `envconfig:"CHANGE_LOG_SPILL_FILE"`
+	ChangeLogSpillMaxBytes int64         `envconfig:"CHANGE_LOG_SPILL_MAX_BYTES" default:"10485760"`
+	UptimeWindow           time.Duration `envconfig:"UPTIME_WINDOW" default:"168h"`
+	UptimeTarget           float64       `envconfig:"UPTIME_TARGET" default:"99.9"`
+	ConsistencyInterval    time.Duration `envconfig:"CONSISTENCY_INTERVAL" default:"5m"`
+	ConsistencyThreshold   int           `envconfig:"CONSISTENCY_THRESHOLD" default:"3"`
+	SecretsFile            string        `envconfig:"SECRETS_FILE"`
+	SecretsKeyFile         string        `envconfig:"SECRETS_KEY_FILE"`
+	SecretsCommand         string        `envconfig:"SECRETS_COMMAND"`
 	Seeds                  []string      `envconfig:"SEEDS"`
 	ClusterName            string        `envconfig:"CLUSTER_NAME" default:"default"`
 	AdvertiseIP            string        `envconfig:"ADVERTISE_IP"`
 	BindPort               int           `envconfig:"BIND_PORT" default:"7946"`
 	Debug                  bool          `envconfig:"DEBUG" default:"false"`
 	DiscoverySleepInterval time.Duration `envconfig:"DISCOVERY_SLEEP_INTERVAL" default:"1s"`
+	DiscoveryGracePeriod   time.Duration `envconfig:"DISCOVERY_GRACE_PERIOD" default:"1m"`
+	StartupTimeout         time.Duration `envconfig:"STARTUP_TIMEOUT" default:"0s"`
+	BootstrapExpect        int           `envconfig:"BOOTSTRAP_EXPECT" default:"0"`
+	BootstrapTimeout       time.Duration `envconfig:"BOOTSTRAP_TIMEOUT" default:"1m"`
+	HandoffSocket          string        `envconfig:"HANDOFF_SOCKET"`
+	HandoffTimeout         time.Duration `envconfig:"HANDOFF_TIMEOUT" default:"10s"`
+	GRPCPort               int           `envconfig:"GRPC_PORT" default:"7778"`
 }
 
 type DockerConfig struct {
-	DockerURL string `envconfig:"URL" default:"unix:///var/run/docker.sock"`
+	DockerURL     string        `envconfig:"URL" default:"unix:///var/run/docker.sock"`
+	CollectStats  bool          `envconfig:"COLLECT_STATS"`
+	StatsInterval time.Duration `envconfig:"STATS_INTERVAL" default:"30s"`
 }
 
 type StaticConfig struct {
@@ -81,11 +271,17 @@ type Config struct {
 	K8sAPIDiscovery K8sAPIConfig       // K8S_
 	Services        ServicesConfig     // SERVICES_
 	HAproxy         HAproxyConfig      // HAPROXY_
+	Nginx           NginxConfig        // NGINX_
+	IPVS            IPVSConfig         // IPVS_
 	Envoy           EnvoyConfig        // ENVOY_
 	Listeners       ListenerUrlsConfig // LISTENERS_
+	Vault           VaultConfig        // VAULT_
+	ACME            ACMEConfig         // ACME_
 }
 
-func ParseConfig() *Config {
+// Load parses the config from the environment, returning an error if any
+// of it is invalid.
+func Load() (*Config, error) {
 	var config Config
 
 	errs := []error{
@@ -95,16 +291,116 @@ func ParseConfig() *Config {
 		envconfig.Process("k8s", &config.K8sAPIDiscovery),
 		envconfig.Process("services", &config.Services),
 		envconfig.Process("haproxy", &config.HAproxy),
+		envconfig.Process("nginx", &config.Nginx),
+		envconfig.Process("ipvs", &config.IPVS),
 		envconfig.Process("envoy", &config.Envoy),
 		envconfig.Process("listeners", &config.Listeners),
+		envconfig.Process("vault", &config.Vault),
+		envconfig.Process("acme", &config.ACME),
 	}
 
 	for _, err := range errs {
 		if err != nil {
-			rubberneck.Print(config)
-			log.Fatalf("Can't parse environment config: %s", err)
+			return &config, err
 		}
 	}
 
-	return &config
+	if err := config.applyProxy(); err != nil {
+		return &config, err
+	}
+
+	err := config.applyRole()
+
+	return &config, err
+}
+
+// applyProxy switches on the proxy SIDECAR_PROXY picks, and switches off the
+// others. Without it, each proxy's own settings say whether it runs.
+func (c *Config) applyProxy() error {
+	switch c.Sidecar.Proxy {
+	case "":
+		return nil
+	case ProxyHAproxy, ProxyNginx, ProxyEnvoy:
+	default:
+		return fmt.Errorf(
+			"Invalid proxy '%s', must be one of: %s, %s, %s", c.Sidecar.Proxy,
+			ProxyHAproxy, ProxyNginx, ProxyEnvoy,
+		)
+	}
+
+	c.HAproxy.Disable = c.Sidecar.Proxy != ProxyHAproxy
+	c.Nginx.ProxyEnable = c.Sidecar.Proxy == ProxyNginx
+	c.Envoy.UseGRPCAPI = c.Sidecar.Proxy == ProxyEnvoy
+
+	return nil
+}
+
+// applyRole works out which modules are active from the role, or from the
+// explicit list of modules if there is one, and switches off anything that
+// isn't.
+func (c *Config) applyRole() error {
+	modules, ok := roleModules[c.Sidecar.Role]
+	if !ok {
+		return fmt.Errorf(
+			"Invalid role '%s', must be one of: %s, %s, %s, %s, %s", c.Sidecar.Role,
+			RoleProxy, RoleWorker, RoleConsumer, RoleEdge, RoleObserver,
+		)
+	}
+
+	if len(c.Sidecar.Modules) > 0 {
+		for _, module := range c.Sidecar.Modules {
+			if !isModule(module) {
+				return fmt.Errorf("Invalid module '%s', must be one of: %s", module, strings.Join(allModules, ", "))
+			}
+		}
+		modules = c.Sidecar.Modules
+	}
+
+	c.Sidecar.Modules = modules
+
+	if !c.ModuleEnabled(ModuleProxy) {
+		c.HAproxy.Disable = true
+		c.Nginx.UDPEnable = false
+		c.Nginx.ProxyEnable = false
+		c.IPVS.Enable = false
+		c.Envoy.UseGRPCAPI = false
+	}
+
+	if !c.ModuleEnabled(ModuleDiscovery) {
+		c.Sidecar.Discovery = []string{}
+	}
+
+	return nil
+}
+
+func isModule(name string) bool {
+	for _, module := range allModules {
+		if module == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ModuleEnabled returns whether the named module should run on this node
+func (c *Config) ModuleEnabled(name string) bool {
+	for _, module := range c.Sidecar.Modules {
+		if module == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseConfig parses the config from the environment and exits if it's invalid
+func ParseConfig() *Config {
+	config, err := Load()
+	if err != nil {
+		rubberneck.Print(config)
+		log.Fatalf("Can't parse environment config: %s", err)
+	}
+
+	return config
 }
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Roles(t *testing.T) {
+	Convey("When loading the config", t, func() {
+		Reset(func() {
+			os.Unsetenv("SIDECAR_ROLE")
+			os.Unsetenv("SIDECAR_MODULES")
+			os.Unsetenv("NGINX_UDP_ENABLE")
+			os.Unsetenv("NGINX_PROXY_ENABLE")
+			os.Unsetenv("SIDECAR_PROXY")
+			os.Unsetenv("HAPROXY_DISABLE")
+		})
+
+		Convey("runs everything by default", func() {
+			config, err := Load()
+			So(err, ShouldBeNil)
+			So(config.Sidecar.Modules, ShouldResemble, allModules)
+			So(config.HAproxy.Disable, ShouldBeFalse)
+			So(config.Sidecar.Discovery, ShouldResemble, []string{"docker"})
+		})
+
+		Convey("switches off the proxies for consumers", func() {
+			os.Setenv("SIDECAR_ROLE", "consumer")
+
+			config, err := Load()
+			So(err, ShouldBeNil)
+			So(config.ModuleEnabled(ModuleProxy), ShouldBeFalse)
+			So(config.ModuleEnabled(ModuleHealthy), ShouldBeTrue)
+			So(config.HAproxy.Disable, ShouldBeTrue)
+			So(config.Envoy.UseGRPCAPI, ShouldBeFalse)
+		})
+
+		Convey("switches off nginx with the proxy module", func() {
+			os.Setenv("SIDECAR_MODULES", "discovery,api")
+			os.Setenv("NGINX_UDP_ENABLE", "true")
+			os.Setenv("NGINX_PROXY_ENABLE", "true")
+
+			config, err := Load()
+			So(err, ShouldBeNil)
+			So(config.Nginx.UDPEnable, ShouldBeFalse)
+			So(config.Nginx.ProxyEnable, ShouldBeFalse)
+		})
+
+		Convey("switches off discovery for observers", func() {
+			os.Setenv("SIDECAR_ROLE", "observer")
+
+			config, err := Load()
+			So(err, ShouldBeNil)
+			So(config.Sidecar.Modules, ShouldResemble, []string{ModuleAPI, ModuleMetrics})
+			So(config.Sidecar.Discovery, ShouldBeEmpty)
+			So(config.HAproxy.Disable, ShouldBeTrue)
+		})
+
+		Convey("lets the modules override the role", func() {
+			os.Setenv("SIDECAR_ROLE", "edge")
+			os.Setenv("SIDECAR_MODULES", "discovery,api")
+
+			config, err := Load()
+			So(err, ShouldBeNil)
+			So(config.ModuleEnabled(ModuleDiscovery), ShouldBeTrue)
+			So(config.ModuleEnabled(ModuleProxy), ShouldBeFalse)
+		})
+
+		Convey("runs only the proxy SIDECAR_PROXY picks", func() {
+			os.Setenv("SIDECAR_PROXY", "envoy")
+			config, err := Load()
+			So(err, ShouldBeNil)
+			So(config.HAproxy.Disable, ShouldBeTrue)
+			So(config.Nginx.ProxyEnable, ShouldBeFalse)
+			So(config.Envoy.UseGRPCAPI, ShouldBeTrue)
+
+			os.Setenv("SIDECAR_PROXY", "haproxy")
+			os.Setenv("HAPROXY_DISABLE", "true")
+			config, err = Load()
+			So(err, ShouldBeNil)
+			So(config.HAproxy.Disable, ShouldBeFalse)
+			So(config.Envoy.UseGRPCAPI, ShouldBeFalse)
+
+			os.Setenv("SIDECAR_PROXY", "nginx")
+			config, err = Load()
+			So(err, ShouldBeNil)
+			So(config.HAproxy.Disable, ShouldBeTrue)
+			So(config.Nginx.ProxyEnable, ShouldBeTrue)
+			So(config.Envoy.UseGRPCAPI, ShouldBeFalse)
+
+			Convey("unless the proxy module is off", func() {
+				os.Setenv("SIDECAR_ROLE", "consumer")
+				config, err := Load()
+				So(err, ShouldBeNil)
+				So(config.Nginx.ProxyEnable, ShouldBeFalse)
+			})
+		})
+
+		Convey("rejects unknown proxies", func() {
+			os.Setenv("SIDECAR_PROXY", "traefik")
+			_, err := Load()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "traefik")
+		})
+
+		Convey("rejects unknown roles and modules", func() {
+			os.Setenv("SIDECAR_ROLE", "bogus")
+			_, err := Load()
+			So(err, ShouldNotBeNil)
+
+			os.Setenv("SIDECAR_ROLE", "proxy")
+			os.Setenv("SIDECAR_MODULES", "api,bogus")
+			_, err = Load()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "bogus")
+		})
+	})
+}
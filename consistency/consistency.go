@@ -0,0 +1,294 @@
+// The consistency package compares the state and the proxy config of all
+// of the Sidecars in a cluster, to catch hosts that are stuck with a stale
+// view. Each Sidecar serves hashes of its own over the API, and a Checker
+// collects them from every cluster member and reports the hosts that differ
+// from the rest.
+package consistency
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/armon/go-metrics"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Where each Sidecar's API serves its Hashes
+	HashesPath = "/api/consistency.json"
+	// How long we wait on each cluster member
+	ClientTimeout = 3 * time.Second
+	// How many checks in a row a host has to differ in before it's reported
+	DefaultThreshold = 3
+)
+
+// Hashes summarize what one Sidecar knows. The StateHash covers the services
+// in its state, and the ConfigHash the proxy config it last loaded. The
+// ConfigHash is empty when the Sidecar doesn't run HAproxy.
+type Hashes struct {
+	Hostname   string
+	StateHash  string
+	ConfigHash string `json:",omitempty"`
+}
+
+// A Member is a Sidecar in the cluster, and the base URL of its API
+type Member struct {
+	Name string
+	URL  string
+}
+
+// A MemberReport is what we found out about one cluster member
+type MemberReport struct {
+	Name       string
+	StateHash  string `json:",omitempty"`
+	ConfigHash string `json:",omitempty"`
+	Divergent  bool
+	Error      string `json:",omitempty"` // Set when the member couldn't be reached
+}
+
+// A Report compares the hashes of all of the cluster members. The hashes
+// most of the members have are taken to be the right ones.
+type Report struct {
+	Time        time.Time
+	StateHash   string
+	ConfigHash  string `json:",omitempty"`
+	Members     []MemberReport
+	Divergent   []string
+	Unreachable []string
+}
+
+// Consistent tells us whether every member that answered agrees
+func (r *Report) Consistent() bool {
+	return len(r.Divergent) == 0
+}
+
+// NewReport compares the hashes of the members, marking the ones that differ
+// from the majority. Ties go to the lowest hash, so every run agrees on which
+// side is divergent. Members that don't run HAproxy aren't compared on their
+// ConfigHash.
+func NewReport(members []MemberReport, now time.Time) *Report {
+	report := &Report{Time: now}
+
+	stateCounts := make(map[string]int)
+	configCounts := make(map[string]int)
+	for _, member := range members {
+		if member.Error != "" {
+			continue
+		}
+		stateCounts[member.StateHash]++
+		if member.ConfigHash != "" {
+			configCounts[member.ConfigHash]++
+		}
+	}
+	report.StateHash = majority(stateCounts)
+	report.ConfigHash = majority(configCounts)
+
+	for _, member := range members {
+		switch {
+		case member.Error != "":
+			report.Unreachable = append(report.Unreachable, member.Name)
+		case member.StateHash != report.StateHash,
+			member.ConfigHash != "" && member.ConfigHash != report.ConfigHash:
+			member.Divergent = true
+			report.Divergent = append(report.Divergent, member.Name)
+		}
+		report.Members = append(report.Members, member)
+	}
+
+	sort.Slice(report.Members, func(i, j int) bool { return report.Members[i].Name < report.Members[j].Name })
+	sort.Strings(report.Divergent)
+	sort.Strings(report.Unreachable)
+
+	return report
+}
+
+// majority returns the most common of the hashes
+func majority(counts map[string]int) string {
+	var best string
+	for hash, count := range counts {
+		if best == "" || count > counts[best] || (count == counts[best] && hash < best) {
+			best = hash
+		}
+	}
+
+	return best
+}
+
+// A Checker collects the Hashes from each of the cluster members and compares
+// them. When Run, it reports hosts that differ in Threshold checks in a row,
+// so that changes that are still spreading around the cluster don't count.
+type Checker struct {
+	Members    func() []Member
+	ConfigHash func() string // The hash of the local proxy config, if there is one
+	Client     *http.Client
+	Events     *events.Bus
+	Threshold  int
+	last       *Report
+	streaks    map[string]int
+	sync.RWMutex
+}
+
+// NewChecker returns a Checker with the default settings
+func NewChecker(members func() []Member) *Checker {
+	return &Checker{
+		Members:   members,
+		Client:    &http.Client{Timeout: ClientTimeout},
+		Threshold: DefaultThreshold,
+		streaks:   make(map[string]int),
+	}
+}
+
+// Hashes returns the Hashes for this Sidecar
+func (c *Checker) Hashes(state *catalog.ServicesState) Hashes {
+	state.RLock()
+	hashes := Hashes{Hostname: state.Hostname, StateHash: state.Hash()}
+	state.RUnlock()
+
+	if c.ConfigHash != nil {
+		hashes.ConfigHash = c.ConfigHash()
+	}
+
+	return hashes
+}
+
+// Check fetches the Hashes from all of the members at once and compares them
+func (c *Checker) Check() *Report {
+	members := c.Members()
+	results := make([]MemberReport, len(members))
+
+	var wg sync.WaitGroup
+	for i, member := range members {
+		wg.Add(1)
+		go func(i int, member Member) {
+			defer wg.Done()
+
+			result := MemberReport{Name: member.Name}
+			hashes, err := c.fetch(member)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.StateHash = hashes.StateHash
+				result.ConfigHash = hashes.ConfigHash
+			}
+			results[i] = result
+		}(i, member)
+	}
+	wg.Wait()
+
+	return NewReport(results, time.Now().UTC())
+}
+
+func (c *Checker) fetch(member Member) (*Hashes, error) {
+	url := strings.TrimRight(member.URL, "/") + HashesPath
+
+	resp, err := c.Client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Error contacting %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response from %s: %s", url, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching %s: got status %d", url, resp.StatusCode)
+	}
+
+	var hashes Hashes
+	if err := json.Unmarshal(body, &hashes); err != nil {
+		return nil, fmt.Errorf("Error decoding hashes from %s: %s", url, err)
+	}
+
+	return &hashes, nil
+}
+
+// Last returns the report from the most recent Run, or nil before the first
+func (c *Checker) Last() *Report {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.last
+}
+
+// record keeps the report and counts how many checks in a row each host has
+// differed in, reporting the ones that reach the Threshold
+func (c *Checker) record(report *Report) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.last = report
+
+	streaks := make(map[string]int, len(report.Divergent))
+	for _, name := range report.Divergent {
+		streaks[name] = c.streaks[name] + 1
+		if streaks[name] == c.Threshold {
+			c.reportDivergent(report, name)
+		}
+	}
+
+	for name, streak := range c.streaks {
+		if _, ok := streaks[name]; !ok && streak >= c.Threshold {
+			log.Infof("Host %s agrees with the rest of the cluster again", name)
+		}
+	}
+	c.streaks = streaks
+
+	var stuck int
+	for _, streak := range streaks {
+		if streak >= c.Threshold {
+			stuck++
+		}
+	}
+	metrics.SetGauge([]string{"consistency", "divergent"}, float32(stuck))
+	metrics.SetGauge([]string{"consistency", "unreachable"}, float32(len(report.Unreachable)))
+}
+
+func (c *Checker) reportDivergent(report *Report, name string) {
+	var member MemberReport
+	for _, member = range report.Members {
+		if member.Name == name {
+			break
+		}
+	}
+
+	log.Warnf("Host %s has differed from the rest of the cluster for %d checks (state %s, config %s)",
+		name, c.Threshold, member.StateHash, member.ConfigHash)
+
+	if c.Events == nil {
+		return
+	}
+	c.Events.Publish(events.Event{
+		Time:    report.Time,
+		Type:    "ConfigDivergent",
+		Source:  "consistency",
+		Subject: name,
+		Message: fmt.Sprintf("Host %s has differed from the rest of the cluster for %d checks", name, c.Threshold),
+		Details: map[string]string{
+			"StateHash":         member.StateHash,
+			"ConfigHash":        member.ConfigHash,
+			"ClusterStateHash":  report.StateHash,
+			"ClusterConfigHash": report.ConfigHash,
+			"ConsecutiveChecks": strconv.Itoa(c.Threshold),
+		},
+	})
+}
+
+// Run checks the cluster on each iteration of the looper
+func (c *Checker) Run(looper director.Looper) {
+	looper.Loop(func() error {
+		c.record(c.Check())
+		return nil
+	})
+}
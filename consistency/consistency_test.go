@@ -0,0 +1,119 @@
+package consistency
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/events"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_NewReport(t *testing.T) {
+	Convey("NewReport()", t, func() {
+		now := time.Now().UTC()
+
+		Convey("marks the hosts that differ from the majority", func() {
+			report := NewReport([]MemberReport{
+				{Name: "gower", StateHash: "aaa", ConfigHash: "111"},
+				{Name: "chaucer", StateHash: "bbb", ConfigHash: "111"},
+				{Name: "langland", StateHash: "bbb", ConfigHash: "222"},
+				{Name: "lydgate", StateHash: "bbb", ConfigHash: "111"},
+			}, now)
+
+			So(report.StateHash, ShouldEqual, "bbb")
+			So(report.ConfigHash, ShouldEqual, "111")
+			So(report.Divergent, ShouldResemble, []string{"gower", "langland"})
+			So(report.Consistent(), ShouldBeFalse)
+			So(report.Members[0].Name, ShouldEqual, "chaucer")
+			So(report.Members[1].Divergent, ShouldBeTrue)
+		})
+
+		Convey("doesn't compare the config of hosts without one", func() {
+			report := NewReport([]MemberReport{
+				{Name: "gower", StateHash: "aaa", ConfigHash: "111"},
+				{Name: "chaucer", StateHash: "aaa"},
+			}, now)
+
+			So(report.Consistent(), ShouldBeTrue)
+		})
+
+		Convey("leaves unreachable hosts out of the comparison", func() {
+			report := NewReport([]MemberReport{
+				{Name: "gower", StateHash: "aaa"},
+				{Name: "chaucer", Error: "connection refused"},
+			}, now)
+
+			So(report.Consistent(), ShouldBeTrue)
+			So(report.Unreachable, ShouldResemble, []string{"chaucer"})
+		})
+
+		Convey("breaks ties the same way every time", func() {
+			report := NewReport([]MemberReport{
+				{Name: "gower", StateHash: "bbb"},
+				{Name: "chaucer", StateHash: "aaa"},
+			}, now)
+
+			So(report.StateHash, ShouldEqual, "aaa")
+			So(report.Divergent, ShouldResemble, []string{"gower"})
+		})
+	})
+}
+
+func Test_Checker(t *testing.T) {
+	Convey("The Checker", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != HashesPath {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `{"Hostname": "gower", "StateHash": "aaa"}`)
+		}))
+		defer server.Close()
+
+		checker := NewChecker(func() []Member {
+			return []Member{
+				{Name: "chaucer", URL: server.URL + "/somewhere/else"},
+				{Name: "gower", URL: server.URL},
+				{Name: "langland", URL: "http://127.0.0.1:1"},
+			}
+		})
+		bus := events.NewBus(10)
+		checker.Events = bus
+
+		Convey("fetches the hashes from the members", func() {
+			report := checker.Check()
+
+			So(report.Members[1].StateHash, ShouldEqual, "aaa")
+			So(report.Unreachable, ShouldResemble, []string{"chaucer", "langland"})
+		})
+
+		Convey("reports hosts that differ in Threshold checks in a row", func() {
+			report := func(divergent ...string) *Report {
+				members := []MemberReport{{Name: "chaucer", StateHash: "aaa"}, {Name: "lydgate", StateHash: "aaa"}}
+				for _, name := range divergent {
+					members = append(members, MemberReport{Name: name, StateHash: "bbb"})
+				}
+				return NewReport(members, time.Now().UTC())
+			}
+
+			checker.record(report("gower"))
+			checker.record(report())
+			checker.record(report("gower"))
+			checker.record(report("gower"))
+			So(bus.Recent(), ShouldBeEmpty)
+
+			checker.record(report("gower"))
+			So(len(bus.Recent()), ShouldEqual, 1)
+			So(bus.Recent()[0].Type, ShouldEqual, "ConfigDivergent")
+			So(bus.Recent()[0].Subject, ShouldEqual, "gower")
+
+			// Only once per streak
+			checker.record(report("gower"))
+			So(len(bus.Recent()), ShouldEqual, 1)
+			So(checker.Last().Divergent, ShouldResemble, []string{"gower"})
+		})
+	})
+}
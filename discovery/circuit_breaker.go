@@ -0,0 +1,158 @@
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// A StatusReporter is a Discoverer that can tell us whether its last attempt
+// to talk to its backend (e.g. the Docker API) succeeded.
+type StatusReporter interface {
+	LastError() error
+}
+
+// A CircuitBreaker wraps a Discoverer and protects the state from it when it
+// misbehaves. While the wrapped source is reporting errors, it is flagged as
+// degraded and we keep announcing the last known good set of services for up
+// to the GracePeriod, rather than letting everything it found be tombstoned.
+// After the GracePeriod we trust whatever the source tells us again.
+type CircuitBreaker struct {
+	Discoverer
+	Name          string
+	GracePeriod   time.Duration
+	Events        *events.Bus // Optional, for when the source degrades and recovers
+	lastGood      []service.Service
+	degradedSince time.Time
+	lastError     string
+	sync.Mutex
+}
+
+// A SourceStatus is whether a discovery source is degraded, and why
+type SourceStatus struct {
+	Name          string
+	Degraded      bool
+	DegradedSince time.Time `json:",omitempty"`
+	LastError     string    `json:",omitempty"`
+}
+
+// NewCircuitBreaker wraps a Discoverer in a CircuitBreaker
+func NewCircuitBreaker(name string, disco Discoverer, gracePeriod time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Discoverer:  disco,
+		Name:        name,
+		GracePeriod: gracePeriod,
+	}
+}
+
+// Services returns the services from the wrapped Discoverer, or the last
+// known good list if it is degraded and we're inside the GracePeriod.
+func (c *CircuitBreaker) Services() []service.Service {
+	services := c.Discoverer.Services()
+
+	var err error
+	if reporter, ok := c.Discoverer.(StatusReporter); ok {
+		err = reporter.LastError()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err == nil {
+		if !c.degradedSince.IsZero() {
+			log.Infof("Discovery source %s recovered", c.Name)
+			c.publish("DiscoveryRecovered", "Discovery source recovered", nil)
+			c.degradedSince = time.Time{}
+			c.lastError = ""
+		}
+		metrics.SetGauge([]string{"discovery", c.Name, "degraded"}, 0)
+		c.lastGood = services
+		return services
+	}
+
+	c.lastError = err.Error()
+	if c.degradedSince.IsZero() {
+		log.Warnf("Discovery source %s degraded, holding last known good services: %s", c.Name, err)
+		c.degradedSince = time.Now()
+		c.publish("DiscoveryDegraded", "Discovery source degraded, holding last known good services",
+			map[string]string{"Error": c.lastError, "GracePeriod": c.GracePeriod.String()})
+	}
+	metrics.SetGauge([]string{"discovery", c.Name, "degraded"}, 1)
+
+	if time.Since(c.degradedSince) > c.GracePeriod {
+		return services
+	}
+
+	return c.lastGood
+}
+
+// Status tells us whether the wrapped Discoverer is currently failing
+func (c *CircuitBreaker) Status() SourceStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	return SourceStatus{
+		Name:          c.Name,
+		Degraded:      !c.degradedSince.IsZero(),
+		DegradedSince: c.degradedSince,
+		LastError:     c.lastError,
+	}
+}
+
+// publish sends an event about the source to the Events bus, if there is one
+func (c *CircuitBreaker) publish(eventType string, message string, details map[string]string) {
+	if c.Events == nil {
+		return
+	}
+
+	c.Events.Publish(events.Event{
+		Type:    eventType,
+		Source:  "discovery",
+		Subject: c.Name,
+		Message: message,
+		Details: details,
+	})
+}
+
+// Refresh passes through to the wrapped Discoverer, if it supports it
+func (c *CircuitBreaker) Refresh() error {
+	if refresher, ok := c.Discoverer.(Refresher); ok {
+		return refresher.Refresh()
+	}
+
+	return nil
+}
+
+// CheckSchedule passes through to the wrapped Discoverer, if it supports
+// check schedules
+func (c *CircuitBreaker) CheckSchedule(svc *service.Service) string {
+	if scheduler, ok := c.Discoverer.(CheckScheduler); ok {
+		return scheduler.CheckSchedule(svc)
+	}
+
+	return ""
+}
+
+// PortHealthCheck passes through to the wrapped Discoverer, if it supports
+// checks for named ports
+func (c *CircuitBreaker) PortHealthCheck(svc *service.Service, port *service.Port) (string, string) {
+	if checker, ok := c.Discoverer.(PortChecker); ok {
+		return checker.PortHealthCheck(svc, port)
+	}
+
+	return "", ""
+}
+
+// CheckViaProxy passes through to the wrapped Discoverer, if it supports
+// checking through the proxy
+func (c *CircuitBreaker) CheckViaProxy(svc *service.Service) string {
+	if proxier, ok := c.Discoverer.(CheckProxier); ok {
+		return proxier.CheckViaProxy(svc)
+	}
+
+	return ""
+}
@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type flakyDiscoverer struct {
+	services []service.Service
+	err      error
+}
+
+func (f *flakyDiscoverer) Services() []service.Service                       { return f.services }
+func (f *flakyDiscoverer) HealthCheck(svc *service.Service) (string, string) { return "", "" }
+func (f *flakyDiscoverer) Listeners() []ChangeListener                       { return nil }
+func (f *flakyDiscoverer) Run(director.Looper)                               {}
+func (f *flakyDiscoverer) LastError() error                                  { return f.err }
+
+func Test_CircuitBreaker(t *testing.T) {
+	Convey("The CircuitBreaker", t, func() {
+		good := []service.Service{{ID: "deadbeef123"}, {ID: "deadbeef456"}}
+		source := &flakyDiscoverer{services: good}
+		breaker := NewCircuitBreaker("flaky", source, time.Minute)
+		bus := events.NewBus(10)
+		breaker.Events = bus
+
+		So(breaker.Services(), ShouldResemble, good)
+
+		Convey("passes through results while the source is healthy", func() {
+			source.services = good[:1]
+			So(breaker.Services(), ShouldResemble, good[:1])
+			So(breaker.Status().Degraded, ShouldBeFalse)
+		})
+
+		Convey("holds the last known good services while the source errors", func() {
+			source.services = nil
+			source.err = errors.New("Docker went away")
+
+			So(breaker.Services(), ShouldResemble, good)
+			So(breaker.Status().Degraded, ShouldBeTrue)
+			So(breaker.Status().LastError, ShouldEqual, "Docker went away")
+
+			recent := bus.Recent()
+			So(recent, ShouldHaveLength, 1)
+			So(recent[0].Type, ShouldEqual, "DiscoveryDegraded")
+			So(recent[0].Subject, ShouldEqual, "flaky")
+			So(recent[0].Details["Error"], ShouldEqual, "Docker went away")
+		})
+
+		Convey("lets the source through once the grace period is over", func() {
+			source.services = nil
+			source.err = errors.New("Docker went away")
+			breaker.Services()
+			breaker.degradedSince = time.Now().Add(-2 * time.Minute)
+
+			So(breaker.Services(), ShouldBeEmpty)
+		})
+
+		Convey("recovers when the source does", func() {
+			source.err = errors.New("Docker went away")
+			breaker.Services()
+
+			source.err = nil
+			source.services = good[1:]
+			So(breaker.Services(), ShouldResemble, good[1:])
+			So(breaker.Status().Degraded, ShouldBeFalse)
+			So(breaker.Status().LastError, ShouldBeEmpty)
+
+			recent := bus.Recent()
+			So(recent, ShouldHaveLength, 2)
+			So(recent[1].Type, ShouldEqual, "DiscoveryRecovered")
+		})
+
+		Convey("shows up in the sources of a MultiDiscovery", func() {
+			disco := &MultiDiscovery{Discoverers: []Discoverer{breaker, &MultiDiscovery{}}}
+			So(disco.Sources(), ShouldResemble, []SourceStatus{{Name: "flaky"}})
+		})
+
+		Convey("works with sources that don't report status", func() {
+			breaker := NewCircuitBreaker("static", &MultiDiscovery{}, time.Minute)
+			So(breaker.Services(), ShouldBeEmpty)
+			So(breaker.Status().Degraded, ShouldBeFalse)
+		})
+	})
+}
@@ -3,6 +3,7 @@ package discovery
 import (
 	"time"
 
+	"github.com/NinesStack/sidecar/recovery"
 	"github.com/NinesStack/sidecar/service"
 	"github.com/relistan/go-director"
 )
@@ -36,12 +37,71 @@ type Discoverer interface {
 	Run(director.Looper)
 }
 
+// A CheckScheduler is a Discoverer that can restrict when the health check
+// for a service runs. See healthy.ParseSchedule for the format.
+type CheckScheduler interface {
+	CheckSchedule(svc *service.Service) string
+}
+
+// A CheckProxier is a Discoverer that can say whether the health check for
+// a service should go through the proxy. It returns "true" or "false", or
+// an empty string to leave it to the Monitor's default.
+type CheckProxier interface {
+	CheckViaProxy(svc *service.Service) string
+}
+
+// A PortChecker is a Discoverer that can give a named port of a service a
+// health check of its own. It returns the check type and args like
+// HealthCheck does, or empty strings when the port has no check.
+type PortChecker interface {
+	PortHealthCheck(svc *service.Service, port *service.Port) (string, string)
+}
+
+// A Refresher is a Discoverer that can do a single round of discovery
+// synchronously, instead of in the background from Run(). It returns the
+// error, if any, from talking to its backend. Used when Sidecar renders the
+// proxy config once and exits. Discoverers that don't implement it always
+// know their services.
+type Refresher interface {
+	Refresh() error
+}
+
 // A MultiDiscovery is a wrapper around zero or more Discoverers.
 // It allows the use of potentially multiple Discoverers in place of one.
 type MultiDiscovery struct {
 	Discoverers []Discoverer
 }
 
+// Sources returns the status of each of the Discoverers guarded by a
+// CircuitBreaker
+func (d *MultiDiscovery) Sources() []SourceStatus {
+	var statuses []SourceStatus
+	for _, disco := range d.Discoverers {
+		if breaker, ok := disco.(*CircuitBreaker); ok {
+			statuses = append(statuses, breaker.Status())
+		}
+	}
+	return statuses
+}
+
+// Refresh does a round of discovery with each of the Discoverers that
+// support it, and returns the first error
+func (d *MultiDiscovery) Refresh() error {
+	var firstErr error
+	for _, disco := range d.Discoverers {
+		refresher, ok := disco.(Refresher)
+		if !ok {
+			continue
+		}
+
+		if err := refresher.Refresh(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
 // Get the health check and health check args for a service
 func (d *MultiDiscovery) HealthCheck(svc *service.Service) (string, string) {
 	for _, disco := range d.Discoverers {
@@ -53,6 +113,43 @@ func (d *MultiDiscovery) HealthCheck(svc *service.Service) (string, string) {
 	return "", ""
 }
 
+// Get the health check for a named port of a service, if any
+func (d *MultiDiscovery) PortHealthCheck(svc *service.Service, port *service.Port) (string, string) {
+	for _, disco := range d.Discoverers {
+		if checker, ok := disco.(PortChecker); ok {
+			if checkType, args := checker.PortHealthCheck(svc, port); checkType != "" {
+				return checkType, args
+			}
+		}
+	}
+	return "", ""
+}
+
+// Get the health check schedule for a service, if any
+func (d *MultiDiscovery) CheckSchedule(svc *service.Service) string {
+	for _, disco := range d.Discoverers {
+		if scheduler, ok := disco.(CheckScheduler); ok {
+			if schedule := scheduler.CheckSchedule(svc); schedule != "" {
+				return schedule
+			}
+		}
+	}
+	return ""
+}
+
+// Get whether the health check for a service goes through the proxy, if any
+// Discoverer says
+func (d *MultiDiscovery) CheckViaProxy(svc *service.Service) string {
+	for _, disco := range d.Discoverers {
+		if proxier, ok := disco.(CheckProxier); ok {
+			if viaProxy := proxier.CheckViaProxy(svc); viaProxy != "" {
+				return viaProxy
+			}
+		}
+	}
+	return ""
+}
+
 // Aggregates all the service slices from the discoverers
 func (d *MultiDiscovery) Services() []service.Service {
 	var aggregate []service.Service
@@ -85,10 +182,12 @@ func (d *MultiDiscovery) Listeners() []ChangeListener {
 func (d *MultiDiscovery) Run(looper director.Looper) {
 	var loopers []director.Looper
 
+	// Each Discoverer recovers from panics on its own, so one can't take
+	// the others down with it
 	for _, disco := range d.Discoverers {
 		l := director.NewFreeLooper(director.FOREVER, make(chan error))
 		loopers = append(loopers, l)
-		disco.Run(l)
+		disco.Run(recovery.NewLooper("discovery", l))
 	}
 
 	// Waiting for a quit on the Looper's channel
@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/NinesStack/sidecar/service"
@@ -42,6 +43,17 @@ func (m *mockDiscoverer) HealthCheck(svc *service.Service) (string, string) {
 	return "", ""
 }
 
+type mockRefresher struct {
+	mockDiscoverer
+	RefreshInvoked bool
+	RefreshErr     error
+}
+
+func (m *mockRefresher) Refresh() error {
+	m.RefreshInvoked = true
+	return m.RefreshErr
+}
+
 func Test_MultiDiscovery(t *testing.T) {
 	Convey("MultiDiscovery", t, func() {
 		looper := director.NewFreeLooper(director.ONCE, nil)
@@ -115,5 +127,17 @@ func Test_MultiDiscovery(t *testing.T) {
 			So(check, ShouldEqual, "")
 			So(args, ShouldEqual, "")
 		})
+
+		Convey("Refresh() refreshes the discoverers that support it", func() {
+			refresher1 := &mockRefresher{}
+			refresher2 := &mockRefresher{RefreshErr: errors.New("oh no")}
+			multi.Discoverers = append(multi.Discoverers, refresher1, refresher2)
+
+			err := multi.Refresh()
+
+			So(refresher1.RefreshInvoked, ShouldBeTrue)
+			So(refresher2.RefreshInvoked, ShouldBeTrue)
+			So(err, ShouldEqual, refresher2.RefreshErr)
+		})
 	})
 }
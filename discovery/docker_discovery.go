@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
@@ -26,15 +27,22 @@ type DockerClient interface {
 }
 
 type DockerDiscovery struct {
-	events         chan *docker.APIEvents       // Where events are announced to us
-	endpoint       string                       // The Docker endpoint to talk to
-	services       []*service.Service           // The list of services we know about
-	ClientProvider func() (DockerClient, error) // Return the client we'll use to connect
-	serviceNamer   ServiceNamer                 // The service namer implementation
-	advertiseIp    string                       // The address we'll advertise for services
-	containerCache *ContainerCache              // Stores full container data for fast lookups
-	sleepInterval  time.Duration                // The sleep interval for event processing and reconnection
-	sync.RWMutex                                // Reader/Writer lock
+	events         chan *docker.APIEvents        // Where events are announced to us
+	endpoint       string                        // The Docker endpoint to talk to
+	services       []*service.Service            // The list of services we know about
+	ClientProvider func() (DockerClient, error)  // Return the client we'll use to connect
+	serviceNamer   ServiceNamer                  // The service namer implementation
+	Identifier     ServiceIdentifier             // Decides which ID services are announced under
+	containerIDs   map[string]string             // Maps service IDs to container IDs when they differ
+	advertiseIp    string                        // The address we'll advertise for services
+	containerCache *ContainerCache               // Stores full container data for fast lookups
+	sleepInterval  time.Duration                 // The sleep interval for event processing and reconnection
+	lastErr        error                         // The last error talking to Docker, cleared on success
+	PortRanges     *PortRanges                   // Optional ServicePort ranges reserved per namespace
+	NamespaceLabel string                        // The label that holds the namespace for PortRanges
+	StatsInterval  time.Duration                 // How often to collect container stats, or zero not to
+	resources      map[string]*service.Resources // The last stats collected, by service ID
+	sync.RWMutex                                 // Reader/Writer lock
 }
 
 func NewDockerDiscovery(endpoint string, svcNamer ServiceNamer, ip string) *DockerDiscovery {
@@ -43,6 +51,9 @@ func NewDockerDiscovery(endpoint string, svcNamer ServiceNamer, ip string) *Dock
 		events:         make(chan *docker.APIEvents),
 		containerCache: NewContainerCache(),
 		serviceNamer:   svcNamer,
+		Identifier:     &ContainerIdentifier{},
+		containerIDs:   make(map[string]string),
+		resources:      make(map[string]*service.Resources),
 		advertiseIp:    ip,
 		sleepInterval:  DefaultSleepInterval,
 	}
@@ -70,6 +81,16 @@ func (d *DockerDiscovery) getDockerClient() (DockerClient, error) {
 	return client, nil
 }
 
+// Ping returns an error if we can't currently talk to Docker
+func (d *DockerDiscovery) Ping() error {
+	client, err := d.ClientProvider()
+	if err != nil {
+		return err
+	}
+
+	return client.Ping()
+}
+
 // HealthCheck looks up a health check using Docker container labels to
 // pass the type of check and the arguments to pass to it.
 func (d *DockerDiscovery) HealthCheck(svc *service.Service) (string, string) {
@@ -81,6 +102,42 @@ func (d *DockerDiscovery) HealthCheck(svc *service.Service) (string, string) {
 	return container.Config.Labels["HealthCheck"], container.Config.Labels["HealthCheckArgs"]
 }
 
+// PortHealthCheck looks up the health check for a named port in the
+// container labels, e.g. "HealthCheck_admin" and "HealthCheckArgs_admin"
+func (d *DockerDiscovery) PortHealthCheck(svc *service.Service, port *service.Port) (string, string) {
+	if port.Name == "" {
+		return "", ""
+	}
+
+	container, err := d.inspectContainer(svc)
+	if err != nil {
+		return "", ""
+	}
+
+	return container.Config.Labels["HealthCheck_"+port.Name], container.Config.Labels["HealthCheckArgs_"+port.Name]
+}
+
+// CheckSchedule looks up the health check schedule in the container labels
+func (d *DockerDiscovery) CheckSchedule(svc *service.Service) string {
+	container, err := d.inspectContainer(svc)
+	if err != nil {
+		return ""
+	}
+
+	return container.Config.Labels["HealthCheckSchedule"]
+}
+
+// CheckViaProxy looks up whether the health check goes through the proxy in
+// the container labels
+func (d *DockerDiscovery) CheckViaProxy(svc *service.Service) string {
+	container, err := d.inspectContainer(svc)
+	if err != nil {
+		return ""
+	}
+
+	return container.Config.Labels["HealthCheckViaProxy"]
+}
+
 func (d *DockerDiscovery) inspectContainer(svc *service.Service) (*docker.Container, error) {
 	// If we have it cached, return it!
 	container := d.containerCache.Get(svc.ID)
@@ -95,7 +152,7 @@ func (d *DockerDiscovery) inspectContainer(svc *service.Service) (*docker.Contai
 		return nil, err
 	}
 
-	container, err = client.InspectContainer(svc.ID)
+	container, err = client.InspectContainer(d.containerIDFor(svc.ID))
 	if err != nil {
 		log.Errorf("Error inspecting container : %v\n", svc.ID)
 		return nil, err
@@ -113,6 +170,10 @@ func (d *DockerDiscovery) Run(looper director.Looper) {
 
 	go d.manageConnection(connQuitChan)
 
+	if d.StatsInterval > 0 {
+		go d.CollectStats(director.NewTimedLooper(director.FOREVER, d.StatsInterval, nil))
+	}
+
 	go func() {
 		// Loop around, process any events which came in, and
 		// periodically fetch the whole container list
@@ -149,11 +210,27 @@ func (d *DockerDiscovery) Services() []service.Service {
 
 	for i, svc := range d.services {
 		svcList[i] = *svc
+		svcList[i].Resources = d.resources[svc.ID]
 	}
 
 	return svcList
 }
 
+// LastError is part of the StatusReporter interface. It returns the last
+// error we had talking to Docker, or nil if the last poll succeeded.
+func (d *DockerDiscovery) LastError() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	return d.lastErr
+}
+
+func (d *DockerDiscovery) setLastError(err error) {
+	d.Lock()
+	d.lastErr = err
+	d.Unlock()
+}
+
 // Listeners returns any containers we found that had the
 // SidecarListener label set to a valid ServicePort.
 func (d *DockerDiscovery) Listeners() []ChangeListener {
@@ -174,9 +251,20 @@ func (d *DockerDiscovery) Listeners() []ChangeListener {
 	return listeners
 }
 
-func (d *DockerDiscovery) findServiceByID(id string) *service.Service {
+// containerIDFor returns the container ID backing the service with this ID.
+// These are the same unless we are using a ServiceIdentifier that assigns
+// its own IDs.
+func (d *DockerDiscovery) containerIDFor(svcID string) string {
+	if containerID, ok := d.containerIDs[svcID]; ok {
+		return containerID
+	}
+
+	return svcID
+}
+
+func (d *DockerDiscovery) findServiceByContainerID(id string) *service.Service {
 	for _, svc := range d.services {
-		if svc.ID == id {
+		if d.containerIDFor(svc.ID) == id {
 			return svc
 		}
 	}
@@ -201,7 +289,7 @@ func (d *DockerDiscovery) listenerForContainer(cntnr *docker.Container) *ChangeL
 		id = id[:12]
 	}
 
-	svc := d.findServiceByID(id)
+	svc := d.findServiceByContainerID(id)
 	if svc == nil {
 		return nil
 	}
@@ -244,24 +332,37 @@ func portForServicePort(svc *service.Service, portStr string, pType string) *ser
 	return nil
 }
 
+// Refresh is part of the Refresher interface. It fetches the container list
+// from Docker and returns the error, if there was one.
+func (d *DockerDiscovery) Refresh() error {
+	d.getContainers()
+	return d.LastError()
+}
+
 func (d *DockerDiscovery) getContainers() {
 	// New connection every time
 	client, err := d.ClientProvider()
 	if err != nil {
 		log.Errorf("Error when creating Docker client: %s\n", err.Error())
+		d.setLastError(err)
 		return
 	}
 
 	containers, err := client.ListContainers(docker.ListContainersOptions{All: false})
 	if err != nil {
+		d.setLastError(err)
 		return
 	}
 
 	d.Lock()
 	defer d.Unlock()
 
+	d.lastErr = nil
+
 	// Temporary set to track if we have seen a container (for cache pruning)
 	containerMap := make(map[string]interface{})
+	containerIDs := make(map[string]string)
+	namespaces := make(map[string]string)
 
 	// Build up the service list, and prepare to prune the containerCache
 	d.services = make([]*service.Service, 0, len(containers))
@@ -273,13 +374,43 @@ func (d *DockerDiscovery) getContainers() {
 
 		svc := service.ToService(&container, d.advertiseIp)
 		svc.Name = d.serviceNamer.ServiceName(&container)
+
+		containerID := svc.ID
+		svc.ID = d.identifier().ServiceID(&svc)
+		if _, ok := containerIDs[svc.ID]; ok {
+			log.Warnf("Skipping container %s, service ID %s is already in use", containerID, svc.ID)
+			continue
+		}
+		containerIDs[svc.ID] = containerID
+		namespaces[svc.ID] = container.Labels[d.NamespaceLabel]
+
 		d.services = append(d.services, &svc)
-		containerMap[svc.ID] = true
+
+		// If a different container now backs this service ID, the cached
+		// copy is stale and needs to be pruned.
+		if d.containerIDFor(svc.ID) == containerID {
+			containerMap[svc.ID] = true
+		}
+	}
+
+	d.containerIDs = containerIDs
+
+	if d.PortRanges != nil {
+		d.PortRanges.Enforce(d.services, namespaces)
 	}
 
 	d.containerCache.Prune(containerMap)
 }
 
+// identifier returns the configured ServiceIdentifier or the default
+func (d *DockerDiscovery) identifier() ServiceIdentifier {
+	if d.Identifier == nil {
+		return &ContainerIdentifier{}
+	}
+
+	return d.Identifier
+}
+
 func (d *DockerDiscovery) configureDockerConnection() DockerClient {
 	client, err := d.ClientProvider()
 	if err != nil {
@@ -304,6 +435,7 @@ func (d *DockerDiscovery) manageConnection(quit chan bool) {
 		// Is the client connected?
 		if client == nil || client.Ping() != nil {
 			log.Warn("Lost connection to Docker, re-connecting")
+			d.setLastError(errors.New("lost connection to Docker"))
 			if client != nil {
 				// Swallow errors since we're overwriting the client anyway
 				_ = client.RemoveEventListener(d.events)
@@ -330,11 +462,18 @@ func (d *DockerDiscovery) handleEvent(event docker.APIEvents) {
 		d.Lock()
 		defer d.Unlock()
 
+		// When services have stable IDs, a dying container may be about to be
+		// restarted. We leave it to the next poll to find out, so the service
+		// isn't tombstoned in the meantime.
+		if _, ok := d.identifier().(*HashIdentifier); ok {
+			return
+		}
+
 		for i, service := range d.services {
 			if len(event.ID) < 12 {
 				continue
 			}
-			if event.ID[:12] == service.ID {
+			if event.ID[:12] == d.containerIDFor(service.ID) {
 				log.Printf("Deleting %s based on Docker '%s' event\n", service.ID, event.Status)
 				// Delete the entry in the slice
 				d.services[i] = nil
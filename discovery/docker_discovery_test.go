@@ -17,6 +17,7 @@ type stubDockerClient struct {
 	ErrorOnInspectContainer bool
 	ErrorOnPing             bool
 	PingChan                chan struct{}
+	Containers              []docker.APIContainers
 }
 
 func (s *stubDockerClient) InspectContainer(id string) (*docker.Container, error) {
@@ -30,10 +31,12 @@ func (s *stubDockerClient) InspectContainer(id string) (*docker.Container, error
 			ID: "deadbeef1231",
 			Config: &docker.Config{
 				Labels: map[string]string{
-					"HealthCheck":     "HttpGet",
-					"HealthCheckArgs": "service1 check arguments",
-					"ServicePort_80":  "10000",
-					"SidecarListener": "10000",
+					"HealthCheck":           "HttpGet",
+					"HealthCheckArgs":       "service1 check arguments",
+					"ServicePort_80":        "10000",
+					"SidecarListener":       "10000",
+					"HealthCheck_admin":     "HttpGet",
+					"HealthCheckArgs_admin": "service1 admin check arguments",
 				},
 			},
 		}, nil
@@ -48,7 +51,7 @@ func (s *stubDockerClient) InspectContainer(id string) (*docker.Container, error
 }
 
 func (s *stubDockerClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
-	return nil, nil
+	return s.Containers, nil
 }
 
 func (s *stubDockerClient) AddEventListener(listener chan<- *docker.APIEvents) error {
@@ -146,6 +149,85 @@ func Test_DockerDiscovery(t *testing.T) {
 			So(result[0].Format(), ShouldEqual, service2.Format())
 		})
 
+		Convey("with a HashIdentifier", func() {
+			disco.Identifier = &HashIdentifier{}
+			client.Containers = []docker.APIContainers{
+				{
+					ID:      "deadbeef1231aaaa",
+					Names:   []string{"/beowulf-deadbeef1231"},
+					Image:   "beowulf:1.0",
+					Created: baseTime.Unix(),
+					Ports:   []docker.APIPort{{PrivatePort: 80, PublicPort: 32768, Type: "tcp"}},
+					Labels:  map[string]string{"ServicePort_80": "10000"},
+				},
+			}
+
+			disco.getContainers()
+			firstID := disco.Services()[0].ID
+
+			Convey("announces services under the stable ID", func() {
+				So(firstID, ShouldNotEqual, "deadbeef1231")
+				So(disco.containerIDFor(firstID), ShouldEqual, "deadbeef1231")
+			})
+
+			Convey("keeps the ID when the container is replaced", func() {
+				client.Containers[0].ID = "cafebabe9999bbbb"
+				client.Containers[0].Ports[0].PublicPort = 32999
+				disco.getContainers()
+
+				services := disco.Services()
+				So(len(services), ShouldEqual, 1)
+				So(services[0].ID, ShouldEqual, firstID)
+				So(services[0].Ports[0].Port, ShouldEqual, 32999)
+				So(disco.containerIDFor(firstID), ShouldEqual, "cafebabe9999")
+			})
+
+			Convey("prunes the cached container when it is replaced", func() {
+				disco.containerCache.Set(&disco.Services()[0], &docker.Container{Path: "cached"})
+				client.Containers[0].ID = "cafebabe9999bbbb"
+				disco.getContainers()
+
+				So(disco.containerCache.Get(firstID), ShouldBeNil)
+			})
+
+			Convey("doesn't drop services on Docker events", func() {
+				disco.handleEvent(docker.APIEvents{ID: "deadbeef1231aaaa", Status: "die"})
+				So(len(disco.Services()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("enforces PortRanges on discovered services", func() {
+			disco.PortRanges, _ = ParsePortRanges([]string{"teamA:10000-10999"})
+			disco.NamespaceLabel = "Namespace"
+			client.Containers = []docker.APIContainers{
+				{
+					ID:     "deadbeef1231aaaa",
+					Names:  []string{"/beowulf-deadbeef1231"},
+					Ports:  []docker.APIPort{{PrivatePort: 80, PublicPort: 32768, Type: "tcp"}},
+					Labels: map[string]string{"ServicePort_80": "10000", "Namespace": "teamB"},
+				},
+			}
+
+			disco.getContainers()
+			So(disco.Services()[0].Ports[0].ServicePort, ShouldEqual, 0)
+		})
+
+		Convey("LastError()", func() {
+			Convey("reports errors talking to Docker", func() {
+				disco.ClientProvider = func() (DockerClient, error) {
+					return nil, errors.New("Oh no!")
+				}
+				disco.getContainers()
+				So(disco.LastError(), ShouldNotBeNil)
+			})
+
+			Convey("clears once Docker responds again", func() {
+				disco.setLastError(errors.New("Oh no!"))
+				disco.getContainers()
+				So(disco.LastError(), ShouldBeNil)
+			})
+		})
+
 		Convey("HealthCheck()", func() {
 			Convey("returns a valid health check when it's defined", func() {
 				check, args := disco.HealthCheck(&service1)
@@ -172,6 +254,22 @@ func Test_DockerDiscovery(t *testing.T) {
 			})
 		})
 
+		Convey("PortHealthCheck()", func() {
+			Convey("returns the check for a named port", func() {
+				check, args := disco.PortHealthCheck(&service1, &service.Port{Name: "admin"})
+				So(check, ShouldEqual, "HttpGet")
+				So(args, ShouldEqual, "service1 admin check arguments")
+			})
+
+			Convey("returns an empty health check for other ports", func() {
+				check, _ := disco.PortHealthCheck(&service1, &service.Port{Name: "metrics"})
+				So(check, ShouldEqual, "")
+
+				check, _ = disco.PortHealthCheck(&service1, &service.Port{})
+				So(check, ShouldEqual, "")
+			})
+		})
+
 		Convey("inspectContainer()", func() {
 			Convey("looks in the cache first", func() {
 				disco.containerCache.Set(&service1, &docker.Container{Path: "cached"})
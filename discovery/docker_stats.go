@@ -0,0 +1,151 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	"github.com/fsouza/go-dockerclient"
+	director "github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultStatsInterval = 30 * time.Second
+	statsTimeout         = 10 * time.Second // Docker takes a second to sample the CPU
+	statsConcurrency     = 4                // How many containers we ask about at once
+)
+
+// A DockerStatsClient can fetch the resource stats for a container. The
+// go-dockerclient Client is one, but not every DockerClient has to be.
+type DockerStatsClient interface {
+	Stats(opts docker.StatsOptions) error
+}
+
+// CollectStats fetches the resource usage of each of the containers on each
+// iteration of the looper, and attaches it to their services
+func (d *DockerDiscovery) CollectStats(looper director.Looper) {
+	looper.Loop(func() error {
+		d.collectStats()
+		return nil
+	})
+}
+
+func (d *DockerDiscovery) collectStats() {
+	client, err := d.ClientProvider()
+	if err != nil {
+		log.Errorf("Error when creating Docker client: %s", err)
+		return
+	}
+
+	statsClient, ok := client.(DockerStatsClient)
+	if !ok {
+		log.Warn("Docker client can't fetch container stats")
+		return
+	}
+
+	d.RLock()
+	containerIDs := make(map[string]string, len(d.services))
+	for _, svc := range d.services {
+		containerIDs[svc.ID] = d.containerIDFor(svc.ID)
+	}
+	d.RUnlock()
+
+	resources := make(map[string]*service.Resources, len(containerIDs))
+	var resourcesLock sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, statsConcurrency)
+
+	for svcID, containerID := range containerIDs {
+		wg.Add(1)
+		go func(svcID string, containerID string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			stats, err := fetchStats(statsClient, containerID)
+			if err != nil {
+				log.Warnf("Unable to fetch stats for container %s: %s", containerID, err)
+				metrics.IncrCounter([]string{"discovery", "docker", "stats", "errors"}, 1)
+				return
+			}
+
+			resourcesLock.Lock()
+			resources[svcID] = resourcesFromStats(stats)
+			resourcesLock.Unlock()
+		}(svcID, containerID)
+	}
+	wg.Wait()
+
+	d.Lock()
+	// Keep the last stats for containers we couldn't reach this time
+	for svcID := range containerIDs {
+		if _, ok := resources[svcID]; !ok && d.resources[svcID] != nil {
+			resources[svcID] = d.resources[svcID]
+		}
+	}
+	d.resources = resources
+	d.Unlock()
+}
+
+// fetchStats asks Docker for one sample of a container's stats
+func fetchStats(client DockerStatsClient, containerID string) (*docker.Stats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), statsTimeout)
+	defer cancel()
+
+	statsChan := make(chan *docker.Stats, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- client.Stats(docker.StatsOptions{
+			ID:      containerID,
+			Stats:   statsChan,
+			Stream:  false,
+			Context: ctx,
+		})
+	}()
+
+	stats, ok := <-statsChan
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+	if !ok || stats == nil {
+		return nil, fmt.Errorf("no stats returned")
+	}
+
+	return stats, nil
+}
+
+// resourcesFromStats works out the usage the same way as `docker stats`
+func resourcesFromStats(stats *docker.Stats) *service.Resources {
+	resources := &service.Resources{
+		MemoryLimit: stats.MemoryStats.Limit,
+		Collected:   stats.Read.UTC(),
+	}
+
+	// The page cache can be reclaimed, so it doesn't count. cgroup v1
+	// reports it as total_inactive_file, and v2 as inactive_file.
+	cache := stats.MemoryStats.Stats.TotalInactiveFile
+	if cache == 0 {
+		cache = stats.MemoryStats.Stats.InactiveFile
+	}
+	if cache < stats.MemoryStats.Usage {
+		resources.MemoryBytes = stats.MemoryStats.Usage - cache
+	}
+
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemCPUUsage) - float64(stats.PreCPUStats.SystemCPUUsage)
+
+	cpus := float64(stats.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+
+	if cpuDelta > 0 && systemDelta > 0 {
+		resources.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+
+	return resources
+}
@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A stubDockerClient that can also fetch container stats
+type statsDockerClient struct {
+	stubDockerClient
+	ContainerStats map[string]*docker.Stats
+}
+
+func (s *statsDockerClient) Stats(opts docker.StatsOptions) error {
+	defer close(opts.Stats)
+
+	stats, ok := s.ContainerStats[opts.ID]
+	if !ok {
+		return errors.New("no such container")
+	}
+	opts.Stats <- stats
+
+	return nil
+}
+
+func cannedStats(cpu uint64, system uint64) *docker.Stats {
+	stats := &docker.Stats{Read: time.Now()}
+	stats.MemoryStats.Usage = 300
+	stats.MemoryStats.Limit = 1000
+	stats.MemoryStats.Stats.TotalInactiveFile = 100
+	stats.PreCPUStats.CPUUsage.TotalUsage = 1000
+	stats.PreCPUStats.SystemCPUUsage = 10000
+	stats.CPUStats.CPUUsage.TotalUsage = 1000 + cpu
+	stats.CPUStats.SystemCPUUsage = 10000 + system
+	stats.CPUStats.OnlineCPUs = 4
+
+	return stats
+}
+
+func Test_resourcesFromStats(t *testing.T) {
+	Convey("resourcesFromStats()", t, func() {
+		Convey("works out the usage like docker stats does", func() {
+			resources := resourcesFromStats(cannedStats(500, 4000))
+			So(resources.CPUPercent, ShouldEqual, 50)
+			So(resources.MemoryBytes, ShouldEqual, 200)
+			So(resources.MemoryLimit, ShouldEqual, 1000)
+		})
+
+		Convey("falls back to the per-CPU usage and the cgroup v2 cache", func() {
+			stats := cannedStats(500, 4000)
+			stats.CPUStats.OnlineCPUs = 0
+			stats.CPUStats.CPUUsage.PercpuUsage = []uint64{1, 2}
+			stats.MemoryStats.Stats.TotalInactiveFile = 0
+			stats.MemoryStats.Stats.InactiveFile = 50
+
+			resources := resourcesFromStats(stats)
+			So(resources.CPUPercent, ShouldEqual, 25)
+			So(resources.MemoryBytes, ShouldEqual, 250)
+		})
+
+		Convey("handles the first sample, which has no previous one", func() {
+			stats := cannedStats(500, 4000)
+			stats.PreCPUStats = docker.CPUStats{}
+			stats.CPUStats.SystemCPUUsage = 0
+
+			So(resourcesFromStats(stats).CPUPercent, ShouldEqual, 0)
+		})
+	})
+}
+
+func Test_CollectStats(t *testing.T) {
+	Convey("Collecting container stats", t, func() {
+		client := &statsDockerClient{ContainerStats: map[string]*docker.Stats{
+			"deadbeef1231": cannedStats(500, 4000),
+		}}
+
+		disco := NewDockerDiscovery("", &RegexpNamer{}, "127.0.0.1")
+		disco.ClientProvider = func() (DockerClient, error) { return client, nil }
+		disco.services = []*service.Service{{ID: "deadbeef1231"}, {ID: "deadbeef1011"}}
+
+		Convey("attaches the stats to the services", func() {
+			disco.CollectStats(director.NewFreeLooper(director.ONCE, nil))
+
+			services := disco.Services()
+			So(services[0].Resources, ShouldNotBeNil)
+			So(services[0].Resources.CPUPercent, ShouldEqual, 50)
+			So(services[1].Resources, ShouldBeNil)
+		})
+
+		Convey("keeps the last stats when a container can't be reached", func() {
+			disco.CollectStats(director.NewFreeLooper(director.ONCE, nil))
+			delete(client.ContainerStats, "deadbeef1231")
+			disco.CollectStats(director.NewFreeLooper(director.ONCE, nil))
+
+			So(disco.Services()[0].Resources, ShouldNotBeNil)
+		})
+
+		Convey("drops the stats of services that have gone away", func() {
+			disco.CollectStats(director.NewFreeLooper(director.ONCE, nil))
+			disco.services = disco.services[1:]
+			disco.CollectStats(director.NewFreeLooper(director.ONCE, nil))
+
+			So(disco.resources, ShouldBeEmpty)
+		})
+	})
+}
@@ -24,6 +24,7 @@ type K8sAPIDiscoverer struct {
 	lock             sync.RWMutex
 	announceAllNodes bool
 	hostname         string
+	lastErr          error
 }
 
 // NewK8sAPIDiscoverer returns a properly configured K8sAPIDiscoverer
@@ -144,20 +145,44 @@ func (k *K8sAPIDiscoverer) Listeners() []ChangeListener {
 // which is injected as a Looper.
 func (k *K8sAPIDiscoverer) Run(looper director.Looper) {
 	looper.Loop(func() error {
-		data, err := k.getServices()
-		if err != nil {
-			log.Errorf("Failed to unmarshal services json: %s, %s", err, string(data))
-		}
-
-		data, err = k.getNodes()
-		if err != nil {
-			log.Errorf("Failed to unmarshal nodes json: %s, %s", err, string(data))
-		}
-
+		k.Refresh()
 		return nil
 	})
 }
 
+// Refresh is part of the Refresher interface. It fetches the services and
+// nodes from the K8s API and returns the error, if there was one.
+func (k *K8sAPIDiscoverer) Refresh() error {
+	data, svcErr := k.getServices()
+	if svcErr != nil {
+		log.Errorf("Failed to unmarshal services json: %s, %s", svcErr, string(data))
+	}
+
+	data, nodeErr := k.getNodes()
+	if nodeErr != nil {
+		log.Errorf("Failed to unmarshal nodes json: %s, %s", nodeErr, string(data))
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.lastErr = svcErr
+	if nodeErr != nil {
+		k.lastErr = nodeErr
+	}
+
+	return k.lastErr
+}
+
+// LastError is part of the StatusReporter interface. It returns the last
+// error we had talking to the K8s API, or nil if the last run succeeded.
+func (k *K8sAPIDiscoverer) LastError() error {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	return k.lastErr
+}
+
 func (k *K8sAPIDiscoverer) getServices() ([]byte, error) {
 	data, err := k.Command.GetServices()
 	if err != nil {
@@ -0,0 +1,135 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// A PortRange is a block of ServicePorts reserved for one namespace (or team)
+type PortRange struct {
+	Namespace string
+	Low       int64
+	High      int64
+}
+
+func (r *PortRange) contains(port int64) bool {
+	return port >= r.Low && port <= r.High
+}
+
+// PortRanges partitions the proxy listen port space between namespaces. A
+// namespace with a range may only use ServicePorts inside it, and nobody
+// else may use ports in a reserved range. Ports outside all the ranges are
+// free for anyone.
+type PortRanges struct {
+	Ranges []PortRange
+}
+
+// ParsePortRanges parses entries of the form "namespace:10000-10999". It
+// is an error for ranges to overlap.
+func ParsePortRanges(entries []string) (*PortRanges, error) {
+	var ranges []PortRange
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid port range %q, expected namespace:low-high", entry)
+		}
+
+		bounds := strings.SplitN(parts[1], "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid port range %q, expected namespace:low-high", entry)
+		}
+
+		low, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port range %q: %s", entry, err)
+		}
+
+		high, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port range %q: %s", entry, err)
+		}
+
+		if low > high {
+			return nil, fmt.Errorf("Invalid port range %q, low port is above high port", entry)
+		}
+
+		ranges = append(ranges, PortRange{Namespace: parts[0], Low: low, High: high})
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Low < ranges[j].Low })
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Low <= ranges[i-1].High {
+			return nil, fmt.Errorf(
+				"Port ranges for %s and %s overlap", ranges[i-1].Namespace, ranges[i].Namespace,
+			)
+		}
+	}
+
+	return &PortRanges{Ranges: ranges}, nil
+}
+
+// Check returns an error if the namespace isn't allowed to use the port
+func (p *PortRanges) Check(namespace string, port int64) error {
+	var own bool
+
+	for _, r := range p.Ranges {
+		if r.Namespace == namespace {
+			own = true
+			if r.contains(port) {
+				return nil
+			}
+			continue
+		}
+
+		if r.contains(port) {
+			return fmt.Errorf("port %d is reserved for namespace %q", port, r.Namespace)
+		}
+	}
+
+	if own {
+		return fmt.Errorf("port %d is outside the range for namespace %q", port, namespace)
+	}
+
+	return nil
+}
+
+// Enforce removes the ServicePort from any port that the service's namespace
+// isn't allowed to use, or that a different service on this host already
+// claimed. The port is still announced, but won't be proxied. The namespaces
+// map is keyed on service ID.
+func (p *PortRanges) Enforce(services []*service.Service, namespaces map[string]string) {
+	claimed := make(map[string]string) // "type/port" -> service name
+
+	for _, svc := range services {
+		namespace := namespaces[svc.ID]
+
+		for i, port := range svc.Ports {
+			if port.ServicePort == 0 {
+				continue
+			}
+
+			err := p.Check(namespace, port.ServicePort)
+
+			key := port.Type + "/" + strconv.FormatInt(port.ServicePort, 10)
+			if owner, ok := claimed[key]; err == nil && ok && owner != svc.Name {
+				err = fmt.Errorf("port %d is already in use by %s", port.ServicePort, owner)
+			}
+
+			if err != nil {
+				log.Errorf("Not proxying %s (%s) on ServicePort %d: %s", svc.Name, svc.ID, port.ServicePort, err)
+				metrics.IncrCounter([]string{"discovery", "port_conflicts"}, 1)
+				svc.Ports[i].ServicePort = 0
+				continue
+			}
+
+			claimed[key] = svc.Name
+		}
+	}
+}
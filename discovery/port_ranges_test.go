@@ -0,0 +1,78 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_PortRanges(t *testing.T) {
+	Convey("PortRanges", t, func() {
+		ranges, err := ParsePortRanges([]string{"teamB:11000-11999", "teamA:10000-10999"})
+		So(err, ShouldBeNil)
+
+		Convey("ParsePortRanges()", func() {
+			Convey("sorts the ranges", func() {
+				So(ranges.Ranges[0], ShouldResemble, PortRange{Namespace: "teamA", Low: 10000, High: 10999})
+			})
+
+			Convey("rejects bad entries", func() {
+				for _, entry := range []string{"teamA", ":1-2", "teamA:1", "teamA:a-2", "teamA:5-1"} {
+					_, err := ParsePortRanges([]string{entry})
+					So(err, ShouldNotBeNil)
+				}
+			})
+
+			Convey("rejects overlapping ranges", func() {
+				_, err := ParsePortRanges([]string{"teamA:10000-10999", "teamB:10500-11999"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "overlap")
+			})
+		})
+
+		Convey("Check()", func() {
+			So(ranges.Check("teamA", 10080), ShouldBeNil)
+			So(ranges.Check("teamA", 11080), ShouldNotBeNil)
+			So(ranges.Check("teamA", 8080), ShouldNotBeNil)
+			So(ranges.Check("", 11080), ShouldNotBeNil)
+			So(ranges.Check("", 8080), ShouldBeNil)
+			So(ranges.Check("teamC", 8080), ShouldBeNil)
+		})
+
+		Convey("Enforce()", func() {
+			svc1 := &service.Service{ID: "deadbeef123", Name: "web", Ports: []service.Port{
+				{Type: "tcp", Port: 32001, ServicePort: 10080},
+				{Type: "tcp", Port: 32002, ServicePort: 11080},
+			}}
+			svc2 := &service.Service{ID: "deadbeef456", Name: "api", Ports: []service.Port{
+				{Type: "tcp", Port: 32003, ServicePort: 10080},
+			}}
+			svc3 := &service.Service{ID: "deadbeef789", Name: "web", Ports: []service.Port{
+				{Type: "tcp", Port: 32004, ServicePort: 10080},
+			}}
+			namespaces := map[string]string{
+				"deadbeef123": "teamA", "deadbeef456": "teamA", "deadbeef789": "teamA",
+			}
+
+			ranges.Enforce([]*service.Service{svc1, svc2, svc3}, namespaces)
+
+			Convey("keeps allowed ports", func() {
+				So(svc1.Ports[0].ServicePort, ShouldEqual, 10080)
+			})
+
+			Convey("drops ports outside the range", func() {
+				So(svc1.Ports[1].ServicePort, ShouldEqual, 0)
+				So(svc1.Ports[1].Port, ShouldEqual, 32002)
+			})
+
+			Convey("drops ports claimed by another service", func() {
+				So(svc2.Ports[0].ServicePort, ShouldEqual, 0)
+			})
+
+			Convey("lets instances of the same service share a port", func() {
+				So(svc3.Ports[0].ServicePort, ShouldEqual, 10080)
+			})
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SelfServiceName is the well-known name Sidecar announces itself under
+	SelfServiceName = "sidecar"
+	// SelfServiceID is the ID of the announcement. There is only ever one
+	// per host, so it doesn't need to be unique across the cluster.
+	SelfServiceID = "sidecar-api"
+)
+
+// A SelfDiscovery announces Sidecar itself as a service, so that tooling
+// can find the API on every host in the cluster from the state, like any
+// other service. The version is carried in the image tag and the role in
+// the service metadata. The API port has no ServicePort so the proxies
+// don't pick it up.
+type SelfDiscovery struct {
+	Hostname string
+	IP       string
+	ApiPort  int64
+	Version  string
+	Role     string
+	created  time.Time
+}
+
+func NewSelfDiscovery(ip string, apiPort int64, version string, role string) *SelfDiscovery {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Errorf("Error getting hostname! %s", err.Error())
+	}
+	return &SelfDiscovery{
+		Hostname: hostname,
+		IP:       ip,
+		ApiPort:  apiPort,
+		Version:  version,
+		Role:     role,
+		created:  time.Now().UTC(),
+	}
+}
+
+// Services returns the announcement for this Sidecar
+func (d *SelfDiscovery) Services() []service.Service {
+	return []service.Service{
+		{
+			ID:        SelfServiceID,
+			Name:      SelfServiceName,
+			Image:     SelfServiceName + ":" + d.Version,
+			Created:   d.created,
+			Hostname:  d.Hostname,
+			Ports:     []service.Port{{Type: "tcp", Port: d.ApiPort, IP: d.IP}},
+			Updated:   time.Now().UTC(),
+			ProxyMode: "http",
+			Metadata:  map[string]string{"role": d.Role},
+		},
+	}
+}
+
+// HealthCheck checks the announcement against the runtime status endpoint
+// of the API
+func (d *SelfDiscovery) HealthCheck(svc *service.Service) (string, string) {
+	if svc.ID != SelfServiceID {
+		return "", ""
+	}
+	return "HttpGet", fmt.Sprintf("http://%s:%d/status/runtime", d.IP, d.ApiPort)
+}
+
+// Listeners returns nothing, Sidecar doesn't subscribe to its own events
+func (d *SelfDiscovery) Listeners() []ChangeListener {
+	return nil
+}
+
+// Run does nothing, the announcement never changes
+func (d *SelfDiscovery) Run(looper director.Looper) {}
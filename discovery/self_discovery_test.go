@@ -0,0 +1,42 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SelfDiscovery(t *testing.T) {
+	Convey("SelfDiscovery", t, func() {
+		disco := NewSelfDiscovery("10.0.0.1", 7777, "1.2.3", "proxy")
+		disco.Hostname = hostname
+
+		Convey("Announces Sidecar as a well-known service", func() {
+			services := disco.Services()
+			So(len(services), ShouldEqual, 1)
+
+			svc := services[0]
+			So(svc.ID, ShouldEqual, SelfServiceID)
+			So(svc.Name, ShouldEqual, "sidecar")
+			So(svc.Version(), ShouldEqual, "1.2.3")
+			So(svc.Hostname, ShouldEqual, hostname)
+			So(svc.Metadata["role"], ShouldEqual, "proxy")
+			So(svc.Ports, ShouldResemble, []service.Port{{Type: "tcp", Port: 7777, IP: "10.0.0.1"}})
+		})
+
+		Convey("Health checks the API", func() {
+			svc := disco.Services()[0]
+			check, args := disco.HealthCheck(&svc)
+			So(check, ShouldEqual, "HttpGet")
+			So(args, ShouldEqual, "http://10.0.0.1:7777/status/runtime")
+
+			check, _ = disco.HealthCheck(&service.Service{ID: "deadbeef123"})
+			So(check, ShouldEqual, "")
+		})
+
+		Convey("Has no listeners", func() {
+			So(disco.Listeners(), ShouldBeEmpty)
+		})
+	})
+}
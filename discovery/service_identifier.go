@@ -0,0 +1,63 @@
+package discovery
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/NinesStack/sidecar/service"
+)
+
+// A ServiceIdentifier decides which ID a discovered service will be announced
+// under. The default is to use the container ID, but that changes every time
+// a container is restarted, which looks like a delete and an add to the rest
+// of the cluster.
+type ServiceIdentifier interface {
+	ServiceID(svc *service.Service) string
+}
+
+// A ServiceIdentifier that keeps the ID the discovery mechanism assigned. For
+// Docker this is the short container ID.
+type ContainerIdentifier struct{}
+
+func (c *ContainerIdentifier) ServiceID(svc *service.Service) string {
+	return svc.ID
+}
+
+// A ServiceIdentifier that derives a stable ID from the hostname, the service
+// name, and the ServicePorts of the service. A container that is restarted
+// with the same configuration will keep its ID, so the existing entry in the
+// state is updated rather than tombstoned and replaced. Note that this means
+// two instances of the same service on the same host, with the same
+// ServicePorts, will collide.
+type HashIdentifier struct{}
+
+func (h *HashIdentifier) ServiceID(svc *service.Service) string {
+	var ports []string
+	for _, port := range svc.Ports {
+		ports = append(ports, fmt.Sprintf("%s/%d", port.Type, port.ServicePort))
+	}
+	sort.Strings(ports)
+
+	hash := sha1.Sum([]byte(
+		svc.Hostname + "|" + svc.Name + "|" + strings.Join(ports, ","),
+	))
+
+	// Same length as the short Docker IDs we use elsewhere
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+// NewServiceIdentifier returns the ServiceIdentifier with the given name,
+// or an error if there isn't one.
+func NewServiceIdentifier(name string) (ServiceIdentifier, error) {
+	switch name {
+	case "", "container":
+		return &ContainerIdentifier{}, nil
+	case "hash":
+		return &HashIdentifier{}, nil
+	default:
+		return nil, fmt.Errorf("unknown service identifier %q", name)
+	}
+}
@@ -0,0 +1,74 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ServiceIdentifiers(t *testing.T) {
+	Convey("ServiceIdentifiers", t, func() {
+		svc := &service.Service{
+			ID:       "deadbeef0001",
+			Name:     "beowulf",
+			Hostname: hostname,
+			Ports: []service.Port{
+				{Type: "tcp", Port: 32768, ServicePort: 10000},
+				{Type: "udp", Port: 32769, ServicePort: 10001},
+			},
+		}
+
+		Convey("ContainerIdentifier keeps the existing ID", func() {
+			So((&ContainerIdentifier{}).ServiceID(svc), ShouldEqual, "deadbeef0001")
+		})
+
+		Convey("HashIdentifier", func() {
+			identifier := &HashIdentifier{}
+			id := identifier.ServiceID(svc)
+
+			Convey("returns a short ID", func() {
+				So(len(id), ShouldEqual, 12)
+				So(id, ShouldNotEqual, svc.ID)
+			})
+
+			Convey("ignores the container ID and the bound ports", func() {
+				restarted := *svc
+				restarted.ID = "cafebabe0002"
+				restarted.Ports = []service.Port{
+					{Type: "udp", Port: 40001, ServicePort: 10001},
+					{Type: "tcp", Port: 40000, ServicePort: 10000},
+				}
+
+				So(identifier.ServiceID(&restarted), ShouldEqual, id)
+			})
+
+			Convey("changes when the service name changes", func() {
+				other := *svc
+				other.Name = "grendel"
+
+				So(identifier.ServiceID(&other), ShouldNotEqual, id)
+			})
+
+			Convey("changes when the hostname changes", func() {
+				other := *svc
+				other.Hostname = "marlowe"
+
+				So(identifier.ServiceID(&other), ShouldNotEqual, id)
+			})
+		})
+
+		Convey("NewServiceIdentifier()", func() {
+			identifier, err := NewServiceIdentifier("hash")
+			So(err, ShouldBeNil)
+			So(identifier, ShouldHaveSameTypeAs, &HashIdentifier{})
+
+			identifier, err = NewServiceIdentifier("")
+			So(err, ShouldBeNil)
+			So(identifier, ShouldHaveSameTypeAs, &ContainerIdentifier{})
+
+			_, err = NewServiceIdentifier("bogus")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
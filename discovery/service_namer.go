@@ -3,11 +3,15 @@ package discovery
 import (
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/fsouza/go-dockerclient"
 	log "github.com/sirupsen/logrus"
 )
 
+// A ServiceNamer decides which name a discovered container will be announced
+// under. All of them fall back to the image when they can't find one.
 type ServiceNamer interface {
 	ServiceName(*docker.APIContainers) string
 }
@@ -83,3 +87,165 @@ func (d *DockerLabelNamer) ServiceName(container *docker.APIContainers) string {
 
 	return container.Image
 }
+
+// A ServiceNamer that uses the last part of the image path, without the
+// registry, the tag or the digest, e.g. "api" for
+// "registry.example.com:5000/team/api:1.2".
+type ImageBasenameNamer struct{}
+
+func (i *ImageBasenameNamer) ServiceName(container *docker.APIContainers) string {
+	if container == nil {
+		log.Warn("ServiceName() called with nil service passed!")
+		return ""
+	}
+
+	return imageBasename(container.Image)
+}
+
+func imageBasename(image string) string {
+	name := image
+	if idx := strings.Index(name, "@"); idx >= 0 {
+		name = name[:idx]
+	}
+	if idx := strings.LastIndex(name, "/"); idx >= 0 {
+		name = name[idx+1:]
+	}
+	if idx := strings.Index(name, ":"); idx >= 0 {
+		name = name[:idx]
+	}
+
+	if name == "" {
+		return image
+	}
+	return name
+}
+
+// The labels Docker Compose puts on the containers it starts
+const (
+	ComposeProjectLabel = "com.docker.compose.project"
+	ComposeServiceLabel = "com.docker.compose.service"
+)
+
+// A ServiceNamer that joins the Compose project and service, e.g. "shop-api",
+// so the same service in two projects doesn't collide. Containers not started
+// by Compose are named after their image.
+type ComposeNamer struct{}
+
+func (c *ComposeNamer) ServiceName(container *docker.APIContainers) string {
+	if container == nil {
+		log.Warn("ServiceName() called with nil service passed!")
+		return ""
+	}
+
+	project := container.Labels[ComposeProjectLabel]
+	svcName := container.Labels[ComposeServiceLabel]
+	if project == "" || svcName == "" {
+		return container.Image
+	}
+
+	return project + "-" + svcName
+}
+
+// A ServiceNamer that picks another one by the image the container runs,
+// e.g. to name the images from one registry differently from the rest. The
+// longest matching prefix wins, and the Default is used when none match.
+type ImagePrefixNamer struct {
+	Default  ServiceNamer
+	prefixes []string
+	namers   map[string]ServiceNamer
+}
+
+// NewImagePrefixNamer returns an ImagePrefixNamer using the namers for the
+// images starting with each prefix, and the default for everything else
+func NewImagePrefixNamer(defaultNamer ServiceNamer, overrides map[string]ServiceNamer) *ImagePrefixNamer {
+	namer := &ImagePrefixNamer{Default: defaultNamer, namers: overrides}
+	for prefix := range overrides {
+		namer.prefixes = append(namer.prefixes, prefix)
+	}
+
+	// Longest first, so the most specific prefix matches
+	sort.Slice(namer.prefixes, func(i, j int) bool {
+		if len(namer.prefixes[i]) != len(namer.prefixes[j]) {
+			return len(namer.prefixes[i]) > len(namer.prefixes[j])
+		}
+		return namer.prefixes[i] < namer.prefixes[j]
+	})
+
+	return namer
+}
+
+func (p *ImagePrefixNamer) ServiceName(container *docker.APIContainers) string {
+	if container == nil {
+		log.Warn("ServiceName() called with nil service passed!")
+		return ""
+	}
+
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(container.Image, prefix) {
+			return p.namers[prefix].ServiceName(container)
+		}
+	}
+
+	return p.Default.ServiceName(container)
+}
+
+// NewServiceNamer returns the ServiceNamer with the given name, or an error
+// if there isn't one. The label is used by docker_label and the expression
+// by regex.
+func NewServiceNamer(name string, label string, expression string) (ServiceNamer, error) {
+	switch name {
+	case "docker_label":
+		return &DockerLabelNamer{Label: label}, nil
+	case "regex":
+		return NewRegexpNamer(expression)
+	case "image_basename":
+		return &ImageBasenameNamer{}, nil
+	case "compose":
+		return &ComposeNamer{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown service namer '%s'", name)
+	}
+}
+
+// ParseNamerOverrides parses entries of the form "image-prefix=namer" into
+// the image prefixes and the namers to use for them. A docker_label or regex
+// namer may be followed by its own label or expression, as in
+// "quay.io/=docker_label:app", otherwise it uses the ones given here.
+func ParseNamerOverrides(entries []string, label string, expression string) (map[string]ServiceNamer, error) {
+	overrides := make(map[string]ServiceNamer, len(entries))
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid namer override %q, expected image-prefix=namer", entry)
+		}
+
+		if _, ok := overrides[parts[0]]; ok {
+			return nil, fmt.Errorf("Duplicate namer override for %q", parts[0])
+		}
+
+		// The namer may bring its own label or expression, e.g. "regex:^/(.+)$"
+		kind, arg := parts[1], ""
+		if idx := strings.Index(kind, ":"); idx >= 0 {
+			kind, arg = kind[:idx], kind[idx+1:]
+		}
+
+		namerLabel, namerExpression := label, expression
+		switch {
+		case arg != "" && kind == "docker_label":
+			namerLabel = arg
+		case arg != "" && kind == "regex":
+			namerExpression = arg
+		case arg != "":
+			return nil, fmt.Errorf("Invalid namer override %q, %s doesn't take an argument", entry, kind)
+		}
+
+		namer, err := NewServiceNamer(kind, namerLabel, namerExpression)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namer override %q: %s", entry, err)
+		}
+		overrides[parts[0]] = namer
+	}
+
+	return overrides, nil
+}
@@ -64,3 +64,113 @@ func Test_DockerLabelNamer(t *testing.T) {
 		})
 	})
 }
+
+func Test_ImageBasenameNamer(t *testing.T) {
+	Convey("ImageBasenameNamer", t, func() {
+		namer := &ImageBasenameNamer{}
+
+		Convey("Strips the registry, the path and the tag", func() {
+			for image, name := range map[string]string{
+				"registry.example.com:5000/team/awesome-svc:0.1.34": "awesome-svc",
+				"gonitro/awesome-svc":                               "awesome-svc",
+				"awesome-svc@sha256:deadbeef":                       "awesome-svc",
+				"quay.io/team/awesome-svc:1.2@sha256:deadbeef":      "awesome-svc",
+			} {
+				So(namer.ServiceName(&docker.APIContainers{Image: image}), ShouldEqual, name)
+			}
+		})
+
+		Convey("Handles error when passed a nil service", func() {
+			So(namer.ServiceName(nil), ShouldEqual, "")
+		})
+	})
+}
+
+func Test_ComposeNamer(t *testing.T) {
+	Convey("ComposeNamer", t, func() {
+		container := &docker.APIContainers{
+			ID:    "deadbeef001",
+			Image: "gonitro/awesome-svc:0.1.34",
+			Names: []string{"/shop_awesome-svc_1"},
+			Labels: map[string]string{
+				ComposeProjectLabel: "shop",
+				ComposeServiceLabel: "awesome-svc",
+			},
+		}
+		namer := &ComposeNamer{}
+
+		Convey("Joins the project and the service", func() {
+			So(namer.ServiceName(container), ShouldEqual, "shop-awesome-svc")
+		})
+
+		Convey("Returns the image when it wasn't started by Compose", func() {
+			container.Labels = map[string]string{}
+			So(namer.ServiceName(container), ShouldEqual, "gonitro/awesome-svc:0.1.34")
+		})
+	})
+}
+
+func Test_ImagePrefixNamer(t *testing.T) {
+	Convey("ImagePrefixNamer", t, func() {
+		container := &docker.APIContainers{
+			ID:     "deadbeef001",
+			Image:  "quay.io/team/awesome-svc:0.1.34",
+			Names:  []string{"/awesome-svc-1231b1b12323"},
+			Labels: map[string]string{"ServiceName": "awesome-svc-1", "app": "awesome"},
+		}
+
+		overrides, err := ParseNamerOverrides(
+			[]string{"quay.io/=image_basename", "quay.io/team/=docker_label:app"},
+			"ServiceName", "",
+		)
+		So(err, ShouldBeNil)
+		namer := NewImagePrefixNamer(&DockerLabelNamer{Label: "ServiceName"}, overrides)
+
+		Convey("Uses the longest matching prefix", func() {
+			So(namer.ServiceName(container), ShouldEqual, "awesome")
+
+			container.Image = "quay.io/other/awesome-svc:0.1.34"
+			So(namer.ServiceName(container), ShouldEqual, "awesome-svc")
+		})
+
+		Convey("Uses the default for other images", func() {
+			container.Image = "gonitro/awesome-svc:0.1.34"
+			So(namer.ServiceName(container), ShouldEqual, "awesome-svc-1")
+		})
+
+		Convey("Rejects invalid overrides", func() {
+			for _, entry := range []string{"quay.io", "=compose", "quay.io/=bogus", "quay.io/=compose:x", "quay.io/=regex:("} {
+				_, err := ParseNamerOverrides([]string{entry}, "ServiceName", "")
+				So(err, ShouldNotBeNil)
+			}
+
+			_, err := ParseNamerOverrides([]string{"quay.io/=compose", "quay.io/=compose"}, "ServiceName", "")
+			So(err.Error(), ShouldContainSubstring, "Duplicate")
+		})
+	})
+}
+
+func Test_NewServiceNamer(t *testing.T) {
+	Convey("NewServiceNamer()", t, func() {
+		Convey("Returns each of the namers", func() {
+			namer, err := NewServiceNamer("docker_label", "ServiceName", "")
+			So(err, ShouldBeNil)
+			So(namer, ShouldResemble, &DockerLabelNamer{Label: "ServiceName"})
+
+			namer, _ = NewServiceNamer("image_basename", "", "")
+			So(namer, ShouldHaveSameTypeAs, &ImageBasenameNamer{})
+
+			namer, _ = NewServiceNamer("compose", "", "")
+			So(namer, ShouldHaveSameTypeAs, &ComposeNamer{})
+
+			namer, err = NewServiceNamer("regex", "", "^/(.+)$")
+			So(err, ShouldBeNil)
+			So(namer, ShouldHaveSameTypeAs, &RegexpNamer{})
+		})
+
+		Convey("Errors on an unknown namer", func() {
+			_, err := NewServiceNamer("bogus", "", "")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
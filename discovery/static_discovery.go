@@ -18,6 +18,7 @@ import (
 type Target struct {
 	Service    service.Service
 	Check      StaticCheck
+	PortChecks map[string]StaticCheck // Checks for the named ports, by name
 	ListenPort int64
 }
 
@@ -32,8 +33,9 @@ type StaticDiscovery struct {
 }
 
 type StaticCheck struct {
-	Type string
-	Args string
+	Type     string
+	Args     string
+	Schedule string
 }
 
 func NewStaticDiscovery(filename string, defaultIP string) *StaticDiscovery {
@@ -57,6 +59,25 @@ func (d *StaticDiscovery) HealthCheck(svc *service.Service) (string, string) {
 	return "", ""
 }
 
+func (d *StaticDiscovery) PortHealthCheck(svc *service.Service, port *service.Port) (string, string) {
+	for _, target := range d.Targets {
+		if svc.ID == target.Service.ID {
+			check := target.PortChecks[port.Name]
+			return check.Type, check.Args
+		}
+	}
+	return "", ""
+}
+
+func (d *StaticDiscovery) CheckSchedule(svc *service.Service) string {
+	for _, target := range d.Targets {
+		if svc.ID == target.Service.ID {
+			return target.Check.Schedule
+		}
+	}
+	return ""
+}
+
 // Returns the list of services derived from the targets that were parsed
 // out of the config file.
 func (d *StaticDiscovery) Services() []service.Service {
@@ -86,17 +107,21 @@ func (d *StaticDiscovery) Listeners() []ChangeListener {
 // Causes the configuration to be parsed and loaded. There is no background
 // processing needed on an ongoing basis.
 func (d *StaticDiscovery) Run(looper director.Looper) {
-	var err error
-
-	d.Targets, err = d.ParseConfig(d.ConfigFile)
-	if err != nil {
+	if err := d.Refresh(); err != nil {
 		log.Errorf("StaticDiscovery cannot parse: %s", err.Error())
 		looper.Done(nil)
 	}
 }
 
+// Refresh is part of the Refresher interface. It parses the config file.
+func (d *StaticDiscovery) Refresh() error {
+	var err error
+	d.Targets, err = d.ParseConfig(d.ConfigFile)
+	return err
+}
+
 // Parses a JSON config file containing an array of Targets. These are
-// then augmented with a random hex ID and stamped with the current
+// then augmented with a random hex ID, unless they have one, and stamped with the current
 // UTC time as the creation time. The same hex ID is applied to the Check
 // and the Service to make sure that they are matched by the healthy
 // package later on.
@@ -115,18 +140,24 @@ func (d *StaticDiscovery) ParseConfig(filename string) ([]*Target, error) {
 
 	// Have to loop with traditional 'for' loop so we can modify entries
 	for _, target := range targets {
-		idBytes, err := RandomHex(6)
-		if err != nil {
-			log.Errorf("ParseConfig(): Unable to get random bytes (%s)", err.Error())
-			return nil, err
+		// An ID given in the file keeps the service the same across runs
+		if target.Service.ID == "" {
+			idBytes, err := RandomHex(6)
+			if err != nil {
+				log.Errorf("ParseConfig(): Unable to get random bytes (%s)", err.Error())
+				return nil, err
+			}
+			target.Service.ID = string(idBytes)
 		}
 
-		target.Service.ID = string(idBytes)
 		target.Service.Created = time.Now().UTC()
 		// We _can_ export services for a 3rd party. If we don't specify
-		// the hostname, then it's for this host.
+		// the hostname, then it's for this host. Otherwise we are only
+		// reporting on it, and other hosts may be too.
 		if target.Service.Hostname == "" {
 			target.Service.Hostname = d.Hostname
+		} else if target.Service.Hostname != d.Hostname {
+			target.Service.Reporter = d.Hostname
 		}
 
 		// Make sure we have an IP address on ports
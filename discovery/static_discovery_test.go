@@ -1,6 +1,8 @@
 package discovery
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
@@ -37,12 +39,14 @@ func Test_ParseConfig(t *testing.T) {
 			So(err, ShouldBeNil)
 			So(len(parsed), ShouldEqual, 1)
 			So(parsed[0].Service.Hostname, ShouldEqual, hostname)
+			So(parsed[0].Service.Reporter, ShouldBeEmpty)
 		})
 
 		Convey("Uses the given hostname when specified", func() {
 			parsed, _ := disco.ParseConfig(STATIC_HOSTNAMED_JSON)
 			So(len(parsed), ShouldEqual, 1)
 			So(parsed[0].Service.Hostname, ShouldEqual, "chaucer")
+			So(parsed[0].Service.Reporter, ShouldEqual, hostname)
 		})
 
 		Convey("Assigns the default IP address when a port doesn't have one", func() {
@@ -50,6 +54,17 @@ func Test_ParseConfig(t *testing.T) {
 			So(len(parsed), ShouldEqual, 1)
 			So(parsed[0].Service.Ports[0].IP, ShouldEqual, ip)
 		})
+
+		Convey("Keeps the ID when one is given", func() {
+			file, _ := ioutil.TempFile("", "static")
+			defer os.Remove(file.Name())
+			file.WriteString(`[{"Service": {"ID": "beowulf01", "Name": "beowulf"}}]`)
+			file.Close()
+
+			parsed, err := disco.ParseConfig(file.Name())
+			So(err, ShouldBeNil)
+			So(parsed[0].Service.ID, ShouldEqual, "beowulf01")
+		})
 	})
 }
 
@@ -16,6 +16,7 @@ import (
 	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	tcpp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
 	cache_types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 	"github.com/gogo/protobuf/proto"
@@ -211,9 +212,38 @@ func EnvoyResourcesFromState(state *catalog.ServicesState, bindIP string,
 	}
 }
 
+// mirrorPoliciesForService returns the policies for mirroring requests to the
+// shadow service, if the Sidecar service has one
+func mirrorPoliciesForService(svc *service.Service, servicePort int64) []*route.RouteAction_RequestMirrorPolicy {
+	mirror, err := svc.Mirror()
+	if err != nil || mirror == nil {
+		return nil
+	}
+
+	port := mirror.Port
+	if port == 0 {
+		port = servicePort
+	}
+	if mirror.Service == svc.Name && port == servicePort {
+		return nil
+	}
+
+	return []*route.RouteAction_RequestMirrorPolicy{{
+		Cluster: SvcName(mirror.Service, port),
+		RuntimeFraction: &core.RuntimeFractionalPercent{
+			DefaultValue: &envoy_type.FractionalPercent{
+				Numerator:   mirror.Percent,
+				Denominator: envoy_type.FractionalPercent_HUNDRED,
+			},
+		},
+	}}
+}
+
 // connectionManagerForService returns a ConnectionManager configured
 // appropriately for the Sidecar service
-func connectionManagerForService(svc *service.Service, envoyServiceName string) (managerName string, manager proto.Message, err error) {
+func connectionManagerForService(svc *service.Service, envoyServiceName string,
+	servicePort int64) (managerName string, manager proto.Message, err error) {
+
 	switch svc.ProxyMode {
 	case "http":
 		managerName = wellknown.HTTPConnectionManager
@@ -240,7 +270,8 @@ func connectionManagerForService(svc *service.Service, envoyServiceName string)
 									ClusterSpecifier: &route.RouteAction_Cluster{
 										Cluster: envoyServiceName,
 									},
-									Timeout: &duration.Duration{},
+									Timeout:               &duration.Duration{},
+									RequestMirrorPolicies: mirrorPoliciesForService(svc, servicePort),
 								},
 							},
 						}},
@@ -320,7 +351,7 @@ func filterChainsForService(svc *service.Service, managerName string, serialized
 func envoyListenerFromService(svc *service.Service, envoyServiceName string,
 	servicePort int64, bindIP string) (cache_types.Resource, error) {
 
-	managerName, manager, err := connectionManagerForService(svc, envoyServiceName)
+	managerName, manager, err := connectionManagerForService(svc, envoyServiceName, servicePort)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create the connection manager: %w", err)
 	}
@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/NinesStack/sidecar/service"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -44,3 +46,44 @@ func Test_isPortCollision(t *testing.T) {
 		})
 	})
 }
+
+func Test_connectionManagerForService(t *testing.T) {
+	Convey("connectionManagerForService()", t, func() {
+		svc := &service.Service{Name: "beowulf", ProxyMode: "http"}
+
+		mirrorPolicies := func() []*route.RouteAction_RequestMirrorPolicy {
+			_, manager, err := connectionManagerForService(svc, "beowulf:10001", 10001)
+			So(err, ShouldBeNil)
+
+			routeConfig := manager.(*hcm.HttpConnectionManager).GetRouteConfig()
+			return routeConfig.VirtualHosts[0].Routes[0].GetRoute().RequestMirrorPolicies
+		}
+
+		Convey("doesn't mirror requests by default", func() {
+			So(mirrorPolicies(), ShouldBeEmpty)
+		})
+
+		Convey("mirrors a percentage of the requests to the shadow cluster", func() {
+			svc.Metadata = map[string]string{"MirrorTo": "hrothgar:10002", "MirrorPercent": "10"}
+
+			policies := mirrorPolicies()
+			So(len(policies), ShouldEqual, 1)
+			So(policies[0].Cluster, ShouldEqual, "hrothgar:10002")
+			So(policies[0].RuntimeFraction.DefaultValue.Numerator, ShouldEqual, 10)
+		})
+
+		Convey("mirrors to the same port by default", func() {
+			svc.Metadata = map[string]string{"MirrorTo": "hrothgar"}
+
+			policies := mirrorPolicies()
+			So(len(policies), ShouldEqual, 1)
+			So(policies[0].Cluster, ShouldEqual, "hrothgar:10001")
+			So(policies[0].RuntimeFraction.DefaultValue.Numerator, ShouldEqual, 100)
+		})
+
+		Convey("doesn't mirror requests back to the same cluster", func() {
+			svc.Metadata = map[string]string{"MirrorTo": "beowulf"}
+			So(mirrorPolicies(), ShouldBeEmpty)
+		})
+	})
+}
@@ -2,6 +2,7 @@ package envoy
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
@@ -14,16 +15,10 @@ import (
 	envoy_discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v2"
 	xds "github.com/envoyproxy/go-control-plane/pkg/server/v2"
-	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
 
-const (
-	// LooperUpdateInterval indicates how often to check if the state has changed
-	LooperUpdateInterval = 1 * time.Second
-)
-
 type xdsCallbacks struct{}
 
 func (*xdsCallbacks) OnStreamOpen(context.Context, int64, string) error  { return nil }
@@ -44,9 +39,9 @@ func (*xdsCallbacks) OnFetchResponse(*api.DiscoveryRequest, *api.DiscoveryRespon
 // the Aggregated Discovery Service (ADS) mechanism.
 type Server struct {
 	config        config.EnvoyConfig
-	state         *catalog.ServicesState
 	snapshotCache cache.SnapshotCache
 	xdsServer     xds.Server
+	eventChannel  chan catalog.ChangeEvent
 }
 
 // newSnapshotVersion returns a unique version for Envoy cache snapshots
@@ -57,58 +52,42 @@ func newSnapshotVersion() string {
 	return strconv.FormatInt(time.Now().UnixNano(), 10)
 }
 
-// Run starts the Envoy update looper and the Envoy gRPC server
-func (s *Server) Run(ctx context.Context, looper director.Looper, grpcListener net.Listener) {
-	// The local hostname needs to match the value passed via `--service-node` to Envoy
-	// See https://github.com/envoyproxy/envoy/issues/144#issuecomment-267401271
-	// This never changes, so we don't need to lock the state here
-	hostname := s.state.Hostname
-
-	// prevStateLastChanged caches the state.LastChanged timestamp when we send an
-	// update to Envoy
-	prevStateLastChanged := time.Unix(0, 0)
-	go looper.Loop(func() error {
-		s.state.RLock()
-		lastChanged := s.state.LastChanged
-
-		// Do nothing if the state hasn't changed
-		if lastChanged == prevStateLastChanged {
-			s.state.RUnlock()
-			return nil
-		}
-		resources := adapter.EnvoyResourcesFromState(s.state, s.config.BindIP, s.config.UseHostnames)
-		s.state.RUnlock()
-
-		prevStateLastChanged = lastChanged
-
-		// Set the computed listeners and clusters in the current snapshot to
-		// send them to Envoy.
-		// See the eventual consistency considerations in the documentation for
-		// details about how Envoy updates these resources:
-		// https://www.envoyproxy.io/docs/envoy/latest/api-docs/xds_protocol#eventual-consistency-considerations
-
-		// Create a new snapshot version and send the listeners and clusters to Envoy
-		snapshotVersion := newSnapshotVersion()
-		err := s.snapshotCache.SetSnapshot(hostname, cache.NewSnapshot(
-			snapshotVersion,
-			resources.Endpoints,
-			resources.Clusters,
-			nil,
-			resources.Listeners,
-			nil,
-		))
-		if err != nil {
-			log.Errorf("Failed to set new Envoy cache snapshot: %s", err)
-			return nil
-		}
+// Watch sends the state to Envoy, and again each time it changes. It's part
+// of the catalog.Proxy interface.
+func (s *Server) Watch(state *catalog.ServicesState) {
+	s.watch(context.Background(), state)
+}
 
-		log.Infof("Sent %d endpoints, %d listeners and %d clusters to Envoy with version %s",
-			len(resources.Endpoints), len(resources.Listeners), len(resources.Clusters), snapshotVersion,
-		)
+// watch does the work of Watch until the context is done
+func (s *Server) watch(ctx context.Context, state *catalog.ServicesState) {
+	state.AddListener(s)
+
+	if err := s.WriteAndReload(state); err != nil {
+		log.Error(err.Error())
+	}
 
-		return nil
-	})
+	for {
+		select {
+		case <-s.eventChannel:
+			// The changes that arrived meanwhile are in this snapshot too
+			for len(s.eventChannel) > 0 {
+				<-s.eventChannel
+			}
+			if err := s.WriteAndReload(state); err != nil {
+				log.Error(err.Error())
+			}
+		case <-ctx.Done():
+			if err := state.RemoveListener(s.Name()); err != nil {
+				log.Warnf("Failed to remove Envoy listener: %s", err)
+			}
+			return
+		}
+	}
+}
 
+// Serve answers Envoy's xDS requests on the listener until the context is
+// done
+func (s *Server) Serve(ctx context.Context, grpcListener net.Listener) {
 	grpcServer := grpc.NewServer()
 	envoy_discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, s.xdsServer)
 
@@ -123,8 +102,61 @@ func (s *Server) Run(ctx context.Context, looper director.Looper, grpcListener n
 	grpcServer.GracefulStop()
 }
 
+// WriteAndReload sets the listeners and clusters for the current state in a
+// new snapshot, to send them to Envoy. Envoy picks them up without a
+// restart. It's part of the catalog.Proxy interface.
+func (s *Server) WriteAndReload(state *catalog.ServicesState) error {
+	// The local hostname needs to match the value passed via `--service-node` to Envoy
+	// See https://github.com/envoyproxy/envoy/issues/144#issuecomment-267401271
+	// This never changes, so we don't need to lock the state here
+	hostname := state.Hostname
+
+	state.RLock()
+	resources := adapter.EnvoyResourcesFromState(state, s.config.BindIP, s.config.UseHostnames)
+	state.RUnlock()
+
+	// See the eventual consistency considerations in the documentation for
+	// details about how Envoy updates these resources:
+	// https://www.envoyproxy.io/docs/envoy/latest/api-docs/xds_protocol#eventual-consistency-considerations
+
+	// Create a new snapshot version and send the listeners and clusters to Envoy
+	snapshotVersion := newSnapshotVersion()
+	err := s.snapshotCache.SetSnapshot(hostname, cache.NewSnapshot(
+		snapshotVersion,
+		resources.Endpoints,
+		resources.Clusters,
+		nil,
+		resources.Listeners,
+		nil,
+	))
+	if err != nil {
+		return fmt.Errorf("Failed to set new Envoy cache snapshot: %s", err)
+	}
+
+	log.Infof("Sent %d endpoints, %d listeners and %d clusters to Envoy with version %s",
+		len(resources.Endpoints), len(resources.Listeners), len(resources.Clusters), snapshotVersion,
+	)
+	return nil
+}
+
+// Name is part of the catalog.Listener and catalog.Proxy interfaces
+func (s *Server) Name() string {
+	return "Envoy"
+}
+
+// Managed is part of the catalog.Listener interface. The Server stays for as
+// long as it runs.
+func (s *Server) Managed() bool {
+	return false
+}
+
+// Chan is part of the catalog.Listener interface
+func (s *Server) Chan() chan catalog.ChangeEvent {
+	return s.eventChannel
+}
+
 // NewServer creates a new Server instance
-func NewServer(ctx context.Context, state *catalog.ServicesState, config config.EnvoyConfig) *Server {
+func NewServer(ctx context.Context, config config.EnvoyConfig) *Server {
 	// Instruct the snapshot cache to use Aggregated Discovery Service (ADS)
 	// The third parameter can contain a logger instance, but I didn't find
 	// those logs particularly useful.
@@ -132,8 +164,8 @@ func NewServer(ctx context.Context, state *catalog.ServicesState, config config.
 
 	return &Server{
 		config:        config,
-		state:         state,
 		snapshotCache: snapshotCache,
 		xdsServer:     xds.NewServer(ctx, snapshotCache, &xdsCallbacks{}),
+		eventChannel:  make(chan catalog.ChangeEvent, catalog.LISTENER_EVENT_BUFFER_SIZE),
 	}
 }
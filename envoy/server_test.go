@@ -29,7 +29,6 @@ import (
 	"github.com/golang/protobuf/ptypes/any"
 	"google.golang.org/grpc"
 
-	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -206,7 +205,7 @@ func NewSnapshotCache() *SnapshotCache {
 }
 
 func Test_PortForServicePort(t *testing.T) {
-	Convey("Run()", t, func() {
+	Convey("Watch() and Serve()", t, func() {
 		config := config.EnvoyConfig{
 			UseGRPCAPI: true,
 			BindIP:     bindIP,
@@ -280,9 +279,9 @@ func Test_PortForServicePort(t *testing.T) {
 		snapshotCache := NewSnapshotCache()
 		server := &Server{
 			config:        config,
-			state:         state,
 			snapshotCache: snapshotCache,
 			xdsServer:     xds.NewServer(ctx, snapshotCache, &xdsCallbacks{}),
+			eventChannel:  make(chan catalog.ChangeEvent, catalog.LISTENER_EVENT_BUFFER_SIZE),
 		}
 
 		// The gRPC listener will be assigned a random port and will be owned
@@ -291,9 +290,9 @@ func Test_PortForServicePort(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(lis.Addr(), ShouldHaveSameTypeAs, &net.TCPAddr{})
 
-		// Using a FreeLooper instead would make it run too often, triggering
-		// spurious locking on the state, which can cause the tests to time out
-		go server.Run(ctx, director.NewTimedLooper(director.FOREVER, 10*time.Millisecond, make(chan error)), lis)
+		go server.watch(ctx, state)
+		go server.Serve(ctx, lis)
+		<-snapshotCache.Waiter
 
 		Convey("sends the Envoy state via gRPC", func() {
 			conn, err := grpc.DialContext(ctx,
@@ -353,6 +352,20 @@ func Test_PortForServicePort(t *testing.T) {
 				})
 			})
 
+			Convey("for the current state when it's reloaded", func() {
+				So(server, ShouldImplement, (*catalog.Proxy)(nil))
+
+				state.AddServiceEntry(httpSvc)
+				<-snapshotCache.Waiter
+
+				result := make(chan error)
+				go func() { result <- server.WriteAndReload(state) }()
+				<-snapshotCache.Waiter
+				So(<-result, ShouldBeNil)
+
+				envoyMock.ValidateResources(stream, httpSvc, state.Hostname)
+			})
+
 			Convey("for a TCP service", func() {
 				state.AddServiceEntry(tcpSvc)
 				<-snapshotCache.Waiter
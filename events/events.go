@@ -0,0 +1,137 @@
+// The events package provides a small in-memory event stream, used to
+// surface notable things (e.g. slow requests or errors on a backend) to
+// the people running services, without them having to dig through logs.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	DefaultBufferSize     = 500     // How many events we keep around
+	DefaultMaxBytes       = 1 << 20 // Roughly how much memory they may take up
+	subscriberChannelSize = 50      // Events buffered per subscriber before dropping
+	eventOverhead         = 128     // Rough size of an Event without its strings
+)
+
+// An Event is something notable that happened
+type Event struct {
+	Time    time.Time
+	Type    string // e.g. "SlowRequest"
+	Source  string // What generated the event, e.g. "haproxy"
+	Subject string // What the event is about, e.g. a backend name
+	Message string
+	Details map[string]string `json:",omitempty"`
+}
+
+// size estimates how much memory the event takes up
+func (evt *Event) size() int {
+	size := eventOverhead + len(evt.Type) + len(evt.Source) + len(evt.Subject) + len(evt.Message)
+	for k, v := range evt.Details {
+		size += len(k) + len(v)
+	}
+
+	return size
+}
+
+// A Bus keeps the most recent events in a fixed size ring buffer and fans
+// them out to subscribers. Slow subscribers miss events rather than holding
+// up the publisher. The oldest events are evicted when the buffer is full,
+// or when the events would take up more than MaxBytes.
+type Bus struct {
+	MaxBytes    int // Zero means no limit beyond the buffer size
+	events      []Event
+	start       int
+	count       int
+	bytes       int
+	subscribers map[chan Event]struct{}
+	sync.RWMutex
+}
+
+// NewBus returns a Bus that retains up to size events, taking up no more
+// than DefaultMaxBytes
+func NewBus(size int) *Bus {
+	if size < 1 {
+		size = DefaultBufferSize
+	}
+
+	return &Bus{
+		MaxBytes:    DefaultMaxBytes,
+		events:      make([]Event, size),
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish records an event and sends it to all the subscribers
+func (b *Bus) Publish(evt Event) {
+	if evt.Time.IsZero() {
+		evt.Time = time.Now().UTC()
+	}
+
+	size := evt.size()
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.count == len(b.events) {
+		b.evict("count")
+	}
+	for b.MaxBytes > 0 && b.count > 0 && b.bytes+size > b.MaxBytes {
+		b.evict("memory")
+	}
+
+	b.events[(b.start+b.count)%len(b.events)] = evt
+	b.count++
+	b.bytes += size
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- evt:
+		default: // Subscriber isn't keeping up
+		}
+	}
+}
+
+// Recent returns the retained events, oldest first
+func (b *Bus) Recent() []Event {
+	b.RLock()
+	defer b.RUnlock()
+
+	recent := make([]Event, 0, b.count)
+	for i := 0; i < b.count; i++ {
+		recent = append(recent, b.events[(b.start+i)%len(b.events)])
+	}
+
+	return recent
+}
+
+// evict drops the oldest event. Must be called while holding the lock.
+func (b *Bus) evict(reason string) {
+	b.bytes -= b.events[b.start].size()
+	b.events[b.start] = Event{}
+	b.start = (b.start + 1) % len(b.events)
+	b.count--
+
+	metrics.IncrCounter([]string{"events", "evicted", reason}, 1)
+}
+
+// Subscribe returns a channel that receives all new events
+func (b *Bus) Subscribe() chan Event {
+	ch := make(chan Event, subscriberChannelSize)
+
+	b.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.Unlock()
+
+	return ch
+}
+
+// Unsubscribe stops sending events to a channel returned from Subscribe
+func (b *Bus) Unsubscribe(ch chan Event) {
+	b.Lock()
+	delete(b.subscribers, ch)
+	b.Unlock()
+}
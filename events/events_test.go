@@ -0,0 +1,73 @@
+package events
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Bus(t *testing.T) {
+	Convey("The event Bus", t, func() {
+		bus := NewBus(3)
+
+		Convey("keeps recent events, oldest first", func() {
+			bus.Publish(Event{Subject: "one"})
+			bus.Publish(Event{Subject: "two"})
+
+			recent := bus.Recent()
+			So(len(recent), ShouldEqual, 2)
+			So(recent[0].Subject, ShouldEqual, "one")
+			So(recent[0].Time.IsZero(), ShouldBeFalse)
+		})
+
+		Convey("drops the oldest events when full", func() {
+			for _, subject := range []string{"one", "two", "three", "four"} {
+				bus.Publish(Event{Subject: subject})
+			}
+
+			recent := bus.Recent()
+			So(len(recent), ShouldEqual, 3)
+			So(recent[0].Subject, ShouldEqual, "two")
+			So(recent[2].Subject, ShouldEqual, "four")
+		})
+
+		Convey("drops the oldest events to stay under MaxBytes", func() {
+			bus.MaxBytes = 2*eventOverhead + 10
+			bus.Publish(Event{Subject: "one"})
+			bus.Publish(Event{Subject: "two"})
+			bus.Publish(Event{Subject: "three"})
+
+			recent := bus.Recent()
+			So(len(recent), ShouldEqual, 2)
+			So(recent[0].Subject, ShouldEqual, "two")
+			So(bus.bytes, ShouldEqual, 2*eventOverhead+8)
+		})
+
+		Convey("keeps an event bigger than MaxBytes on its own", func() {
+			bus.MaxBytes = 1
+			bus.Publish(Event{Subject: "one"})
+			bus.Publish(Event{Subject: "two"})
+
+			So(len(bus.Recent()), ShouldEqual, 1)
+			So(bus.Recent()[0].Subject, ShouldEqual, "two")
+		})
+
+		Convey("sends events to subscribers", func() {
+			ch := bus.Subscribe()
+			bus.Publish(Event{Subject: "one"})
+			So((<-ch).Subject, ShouldEqual, "one")
+
+			bus.Unsubscribe(ch)
+			bus.Publish(Event{Subject: "two"})
+			So(len(ch), ShouldEqual, 0)
+		})
+
+		Convey("doesn't block on slow subscribers", func() {
+			bus.Subscribe()
+			for i := 0; i < subscriberChannelSize+1; i++ {
+				bus.Publish(Event{Subject: "spam"})
+			}
+			So(len(bus.Recent()), ShouldEqual, 3)
+		})
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/config"
+	"github.com/NinesStack/sidecar/handoff"
+	"github.com/NinesStack/sidecar/haproxy"
+	"github.com/NinesStack/sidecar/healthy"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// takeOver asks the Sidecar already running on this host, if there is one,
+// to hand over to us, and loads the state it had. It waits for the old
+// Sidecar to exit, so it must be called before we bind any ports. Returns
+// the Snapshot to restore the rest from, or nil when we start afresh.
+func takeOver(config *config.Config, state *catalog.ServicesState) (*handoff.Snapshot, error) {
+	if config.Sidecar.HandoffSocket == "" {
+		return nil, nil
+	}
+
+	takeover, err := handoff.Request(config.Sidecar.HandoffSocket, config.Sidecar.HandoffTimeout)
+	if err != nil || takeover == nil {
+		return nil, err
+	}
+
+	snapshot := takeover.Snapshot
+	if snapshot.Hostname != state.Hostname {
+		takeover.Abandon()
+		return nil, fmt.Errorf("Can't take over from a Sidecar on %s, we're on %s", snapshot.Hostname, state.Hostname)
+	}
+
+	previous, err := catalog.Decode(snapshot.State)
+	if err != nil {
+		takeover.Abandon()
+		return nil, fmt.Errorf("Error decoding the handed over state: %s", err)
+	}
+
+	if err := takeover.Complete(); err != nil {
+		return nil, err
+	}
+
+	var count int
+	previous.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		state.AddServiceEntry(*svc)
+		count++
+	})
+	log.Infof("Took over from the running Sidecar with %d services", count)
+
+	return snapshot, nil
+}
+
+// serveHandoff hands over to a new Sidecar that asks for it, and then exits
+// without leaving the cluster or running the shutdown hooks, so the new one
+// picks up where we stopped. The monitor and proxy may be nil.
+func serveHandoff(config *config.Config, state *catalog.ServicesState, monitor *healthy.Monitor, proxy *haproxy.HAproxy) {
+	snapshot := func() (*handoff.Snapshot, error) {
+		state.RLock()
+		encoded := state.Encode()
+		state.RUnlock()
+
+		if len(encoded) < 1 {
+			return nil, fmt.Errorf("Unable to encode the state")
+		}
+
+		snapshot := &handoff.Snapshot{Hostname: state.Hostname, State: encoded}
+		if monitor != nil {
+			snapshot.Checks = monitor.SavedStatuses()
+		}
+		if proxy != nil {
+			snapshot.ProxyConfig = proxy.LoadedConfig()
+		}
+		return snapshot, nil
+	}
+
+	// The proxies and IPVS keep running as they are for the new Sidecar
+	server := handoff.NewServer(config.Sidecar.HandoffSocket, snapshot, func() { os.Exit(0) })
+	server.Timeout = config.Sidecar.HandoffTimeout
+
+	if err := server.ListenAndServe(); err != nil {
+		log.Errorf("Stopped listening for Sidecars to hand over to: %s", err)
+	}
+}
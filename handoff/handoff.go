@@ -0,0 +1,275 @@
+// The handoff package lets a new Sidecar take over from the one running on
+// the same host, e.g. during an upgrade. The running Sidecar listens on a
+// unix socket. The new one connects to it before it joins the cluster, and
+// is handed the state, the statuses of the health checks, and the proxy
+// config that was last loaded. Once the new Sidecar has them, the old one
+// exits without leaving the cluster, and the new one carries on from where
+// it stopped. The services keep being announced with the statuses they had,
+// and the proxy isn't reloaded unless its config changed in the meantime.
+package handoff
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/healthy"
+	log "github.com/sirupsen/logrus"
+)
+
+// The version of the protocol. A Sidecar only hands over to one speaking
+// the same version.
+const Version = 1
+
+// The messages the two Sidecars exchange, in the order they are sent
+const (
+	msgRequest  = "request"  // From the new Sidecar, asking for a Snapshot
+	msgSnapshot = "snapshot" // From the old Sidecar, with the Snapshot
+	msgTaken    = "taken"    // From the new Sidecar, once it has loaded it
+	msgError    = "error"    // From the old Sidecar, when it can't hand over
+)
+
+// A Snapshot is everything the new Sidecar needs to carry on from the old
+// one
+type Snapshot struct {
+	Hostname    string
+	State       []byte                // The encoded ServicesState
+	Checks      []healthy.SavedStatus // The statuses of the local health checks
+	ProxyConfig []byte                `json:",omitempty"` // The HAproxy config last loaded, if any
+}
+
+type message struct {
+	Type     string
+	Version  int       `json:",omitempty"`
+	Snapshot *Snapshot `json:",omitempty"`
+	Error    string    `json:",omitempty"`
+}
+
+// A Server hands over to the first new Sidecar that asks for it. Snapshot
+// is called to take the Snapshot, and OnHandoff once the new Sidecar has
+// loaded it. OnHandoff usually exits, which closes the connection and tells
+// the new Sidecar that everything it needs to bind is free.
+type Server struct {
+	Path      string
+	Snapshot  func() (*Snapshot, error)
+	OnHandoff func()
+	Timeout   time.Duration // How long the new Sidecar has to answer
+	listener  net.Listener
+	handing   bool
+	closed    bool
+	sync.Mutex
+}
+
+// NewServer returns a Server listening on the unix socket at path once it
+// is started
+func NewServer(path string, snapshot func() (*Snapshot, error), onHandoff func()) *Server {
+	return &Server{
+		Path:      path,
+		Snapshot:  snapshot,
+		OnHandoff: onHandoff,
+		Timeout:   10 * time.Second,
+	}
+}
+
+// ListenAndServe listens on the socket and hands over to the first new
+// Sidecar that asks. A socket left behind by a Sidecar that exited is
+// removed first.
+func (s *Server) ListenAndServe() error {
+	if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing old handoff socket: %s", err)
+	}
+
+	listener, err := net.Listen("unix", s.Path)
+	if err != nil {
+		return fmt.Errorf("Error listening on handoff socket: %s", err)
+	}
+	if err := os.Chmod(s.Path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("Error securing handoff socket: %s", err)
+	}
+
+	s.Lock()
+	s.listener = listener
+	s.Unlock()
+
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener until it's closed. Returns nil
+// when it was closed by a handoff or Close.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.Lock()
+			defer s.Unlock()
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				log.Warnf("Handoff failed: %s", err)
+			}
+		}()
+	}
+}
+
+// ServeConn hands over to the Sidecar on the other end of conn. Only one
+// handoff happens at a time. The connection is closed after OnHandoff, if it
+// returns.
+func (s *Server) ServeConn(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	var request message
+	if err := decoder.Decode(&request); err != nil {
+		conn.Close()
+		return fmt.Errorf("Error reading handoff request: %s", err)
+	}
+
+	refuse := func(reason string) error {
+		encoder.Encode(message{Type: msgError, Error: reason})
+		conn.Close()
+		return fmt.Errorf("Refused handoff: %s", reason)
+	}
+
+	if request.Type != msgRequest {
+		return refuse(fmt.Sprintf("expected a request, got '%s'", request.Type))
+	}
+	if request.Version != Version {
+		return refuse(fmt.Sprintf("unsupported version %d, expected %d", request.Version, Version))
+	}
+
+	s.Lock()
+	if s.handing {
+		s.Unlock()
+		return refuse("already handing over")
+	}
+	s.handing = true
+	s.Unlock()
+
+	done := func() {
+		s.Lock()
+		s.handing = false
+		s.Unlock()
+	}
+
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		done()
+		return refuse(err.Error())
+	}
+
+	if err := encoder.Encode(message{Type: msgSnapshot, Version: Version, Snapshot: snapshot}); err != nil {
+		done()
+		conn.Close()
+		return fmt.Errorf("Error sending handoff snapshot: %s", err)
+	}
+
+	var reply message
+	if err := decoder.Decode(&reply); err != nil {
+		done()
+		conn.Close()
+		return fmt.Errorf("Error reading handoff reply: %s", err)
+	}
+	if reply.Type != msgTaken {
+		done()
+		conn.Close()
+		return fmt.Errorf("New Sidecar didn't take over, got '%s'", reply.Type)
+	}
+
+	log.Warn("Handed over to the new Sidecar")
+
+	s.Close()
+
+	if s.OnHandoff != nil {
+		s.OnHandoff()
+	}
+	conn.Close()
+	return nil
+}
+
+// Close stops listening for new Sidecars
+func (s *Server) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// A Takeover is a handoff in progress, from the new Sidecar's side
+type Takeover struct {
+	Snapshot *Snapshot
+	conn     net.Conn
+	decoder  *json.Decoder
+}
+
+// Request asks the Sidecar listening on the socket at path to hand over.
+// Returns nil without an error when there's no Sidecar there to ask.
+func Request(path string, timeout time.Duration) (*Takeover, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		log.Infof("No Sidecar to take over from at %s: %s", path, err)
+		return nil, nil
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(message{Type: msgRequest, Version: Version}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error sending handoff request: %s", err)
+	}
+
+	decoder := json.NewDecoder(conn)
+	var reply message
+	if err := decoder.Decode(&reply); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error reading handoff snapshot: %s", err)
+	}
+
+	switch {
+	case reply.Type == msgError:
+		conn.Close()
+		return nil, fmt.Errorf("Error taking over: %s", reply.Error)
+	case reply.Type != msgSnapshot || reply.Snapshot == nil:
+		conn.Close()
+		return nil, fmt.Errorf("Error taking over: expected a snapshot, got '%s'", reply.Type)
+	}
+
+	return &Takeover{Snapshot: reply.Snapshot, conn: conn, decoder: decoder}, nil
+}
+
+// Complete tells the old Sidecar we have loaded the Snapshot, and waits for
+// it to exit, so that the ports it had are free
+func (t *Takeover) Complete() error {
+	defer t.conn.Close()
+
+	if err := json.NewEncoder(t.conn).Encode(message{Type: msgTaken}); err != nil {
+		return fmt.Errorf("Error completing handoff: %s", err)
+	}
+
+	// Nothing more is sent, we're waiting for the connection to close
+	var discard message
+	if err := t.decoder.Decode(&discard); err == nil {
+		return fmt.Errorf("Error completing handoff: unexpected '%s'", discard.Type)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return fmt.Errorf("Timed out waiting for the old Sidecar to exit")
+	}
+
+	return nil
+}
+
+// Abandon gives up on the handoff, leaving the old Sidecar running
+func (t *Takeover) Abandon() {
+	t.conn.Close()
+}
@@ -0,0 +1,89 @@
+package handoff
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/healthy"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Handoff(t *testing.T) {
+	Convey("The handoff", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		dir, _ := ioutil.TempDir("", "handoff")
+		defer os.RemoveAll(dir)
+		socket := path.Join(dir, "handoff.sock")
+
+		snapshot := &Snapshot{
+			Hostname:    "indomitable",
+			State:       []byte(`{"Servers":{}}`),
+			Checks:      []healthy.SavedStatus{{ID: "deadbeef001", Status: healthy.HEALTHY}},
+			ProxyConfig: []byte("global\n"),
+		}
+		handedOver := make(chan struct{})
+		server := NewServer(socket, func() (*Snapshot, error) { return snapshot, nil }, func() { close(handedOver) })
+		server.Timeout = time.Second
+
+		served := make(chan error, 1)
+		go func() { served <- server.ListenAndServe() }()
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(socket); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		Convey("gives the new Sidecar the snapshot", func() {
+			takeover, err := Request(socket, time.Second)
+			So(err, ShouldBeNil)
+			So(takeover.Snapshot, ShouldResemble, snapshot)
+
+			So(takeover.Complete(), ShouldBeNil)
+			<-handedOver
+			So(<-served, ShouldBeNil)
+		})
+
+		Convey("keeps running when the new Sidecar gives up", func() {
+			takeover, err := Request(socket, time.Second)
+			So(err, ShouldBeNil)
+			takeover.Abandon()
+
+			// The old Sidecar notices in its own time
+			for i := 0; i < 100; i++ {
+				if takeover, err = Request(socket, time.Second); err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(err, ShouldBeNil)
+			So(takeover.Snapshot.Hostname, ShouldEqual, "indomitable")
+			takeover.Abandon()
+			server.Close()
+		})
+
+		Convey("passes on the old Sidecar's refusal", func() {
+			server.Snapshot = func() (*Snapshot, error) { return nil, errors.New("not ready") }
+
+			_, err := Request(socket, time.Second)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not ready")
+			server.Close()
+		})
+
+		Convey("starts afresh when there's no Sidecar to take over from", func() {
+			server.Close()
+			<-served
+
+			takeover, err := Request(path.Join(dir, "missing.sock"), time.Second)
+			So(err, ShouldBeNil)
+			So(takeover, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,65 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// isIPv6 tells whether an address is an IPv6 literal, with or without the
+// brackets around it
+func isIPv6(address string) bool {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"))
+	return ip != nil && ip.To4() == nil
+}
+
+// hostPort joins a host and a port the way HAproxy takes them, with the
+// brackets around IPv6 literals. Hostnames and IPv4 addresses are left as
+// they are.
+func hostPort(host string, port interface{}) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if isIPv6(host) {
+		host = "[" + host + "]"
+	}
+	return fmt.Sprintf("%s:%v", host, port)
+}
+
+// splitHostPort splits an address from the config into the host, without
+// any brackets, and the port
+func splitHostPort(address string) (string, string, bool) {
+	i := strings.LastIndex(address, ":")
+	if i < 1 || strings.HasSuffix(address[:i], ":") || (strings.Contains(address[:i], ":") && !strings.HasPrefix(address, "[")) {
+		return "", "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address[:i], "["), "]"), address[i+1:], true
+}
+
+// familyOptions returns the options a bind line needs for the address
+// family of its address. IPv6 addresses take IPv4 connections too with
+// DualStack. Otherwise the IPv6 wildcard only takes IPv6, so it can be bound
+// alongside the IPv4 one.
+func (h *HAproxy) familyOptions(address string) string {
+	if !isIPv6(address) {
+		return ""
+	}
+	if h.DualStack {
+		return "v4v6"
+	}
+	if net.ParseIP(strings.Trim(address, "[]")).IsUnspecified() {
+		return "v6only"
+	}
+	return ""
+}
+
+// meshBinds returns the wildcard addresses the mesh frontend binds to, one
+// for each address family that is configured
+func (h *HAproxy) meshBinds() []string {
+	var addresses []string
+	if h.BindIPv6 == "" || (h.BindIP != "" && !h.DualStack) {
+		addresses = append(addresses, "0.0.0.0")
+	}
+	if h.BindIPv6 != "" {
+		addresses = append(addresses, "[::]")
+	}
+	return addresses
+}
@@ -0,0 +1,86 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_AddressFormats(t *testing.T) {
+	Convey("Formatting addresses", t, func() {
+		Convey("hostPort() brackets only the IPv6 literals", func() {
+			So(hostPort("10.0.0.1", "80"), ShouldEqual, "10.0.0.1:80")
+			So(hostPort("fd00::1", 80), ShouldEqual, "[fd00::1]:80")
+			So(hostPort("[fd00::1]", "80"), ShouldEqual, "[fd00::1]:80")
+			So(hostPort("indomitable", "80"), ShouldEqual, "indomitable:80")
+		})
+
+		Convey("splitHostPort() takes the brackets off", func() {
+			for address, expected := range map[string][]string{
+				"10.0.0.1:80":    {"10.0.0.1", "80"},
+				"[fd00::1]:80":   {"fd00::1", "80"},
+				"indomitable:80": {"indomitable", "80"},
+			} {
+				host, port, ok := splitHostPort(address)
+				So(ok, ShouldBeTrue)
+				So([]string{host, port}, ShouldResemble, expected)
+			}
+
+			for _, address := range []string{"10.0.0.1", "fd00::1", "fd00::1:80", ":80"} {
+				_, _, ok := splitHostPort(address)
+				So(ok, ShouldBeFalse)
+			}
+		})
+
+		Convey("familyOptions() keeps the IPv6 wildcard to IPv6 unless dual stack", func() {
+			proxy := New("tmpConfig", "tmpPid")
+			So(proxy.familyOptions("192.168.168.168"), ShouldEqual, "")
+			So(proxy.familyOptions("[fd00::1]"), ShouldEqual, "")
+			So(proxy.familyOptions("[::]"), ShouldEqual, "v6only")
+
+			proxy.DualStack = true
+			So(proxy.familyOptions("[fd00::1]"), ShouldEqual, "v4v6")
+			So(proxy.familyOptions("0.0.0.0"), ShouldEqual, "")
+		})
+	})
+}
+
+func Test_IPv6Config(t *testing.T) {
+	Convey("Rendering IPv6 addresses", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef001", Name: "web", Hostname: hostname1, Updated: time.Now().UTC(), ProxyMode: "http",
+			Ports: []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "fd00::1"}},
+		})
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = ""
+		proxy.BindIPv6 = "::"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("brackets the server addresses", func() {
+			So(render(), ShouldContainSubstring, "\tserver indomitable-deadbeef001 [fd00::1]:10450 cookie indomitable-10450 \n")
+		})
+
+		Convey("gives the bind lines their family options", func() {
+			So(render(), ShouldContainSubstring, "\tbind [::]:8080 v6only\n")
+
+			proxy.DualStack = true
+			So(render(), ShouldContainSubstring, "\tbind [::]:8080 v4v6\n")
+		})
+	})
+}
@@ -0,0 +1,100 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// The prefix of the backends that the connections from callers a service
+// doesn't allow are sent to, so they show up as such in the request logs
+const deniedBackendPrefix = "denied-"
+
+// templateCallers is what a frontend needs to only take the connections
+// from the instances of the services its service allows
+type templateCallers struct {
+	Services []string
+	Sources  []string // The addresses of their instances. Empty denies everything.
+}
+
+// getAllowedCallers returns the addresses of the instances of the services
+// each service allows to call it, taken from the most recently updated
+// instance, and the warnings for the callers that have no instances
+func getAllowedCallers(state *catalog.ServicesState) (map[string]*templateCallers, []ConfigWarning) {
+	settings := newestMetadata(state, service.AllowedCallersKey)
+	if len(settings) < 1 {
+		return nil, nil
+	}
+
+	sources := make(map[string]map[string]bool)
+	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		if svc.IsTombstone() {
+			return
+		}
+		for _, port := range svc.Ports {
+			if port.IP == "" {
+				continue
+			}
+			if sources[svc.Name] == nil {
+				sources[svc.Name] = make(map[string]bool)
+			}
+			sources[svc.Name][port.IP] = true
+		}
+	})
+
+	svcNames := make([]string, 0, len(settings))
+	for svcName := range settings {
+		svcNames = append(svcNames, svcName)
+	}
+	sort.Strings(svcNames)
+
+	callers := make(map[string]*templateCallers, len(settings))
+	var warnings []ConfigWarning
+	for _, svcName := range svcNames {
+		svc := service.Service{Metadata: settings[svcName]}
+		allowed := svc.AllowedCallers()
+		if len(allowed) < 1 {
+			continue
+		}
+
+		unique := make(map[string]bool)
+		var missing []string
+		for _, caller := range allowed {
+			if len(sources[caller]) < 1 {
+				missing = append(missing, caller)
+			}
+			for ip := range sources[caller] {
+				unique[ip] = true
+			}
+		}
+
+		result := &templateCallers{Services: allowed}
+		for ip := range unique {
+			result.Sources = append(result.Sources, ip)
+		}
+		sort.Strings(result.Sources)
+		callers[svcName] = result
+
+		if len(missing) > 0 {
+			warnings = append(warnings, ConfigWarning{
+				Service: svcName, Kind: WarnAllowedCallers,
+				Message: fmt.Sprintf("No instances of the allowed callers '%s'", strings.Join(missing, "', '")),
+			})
+		}
+	}
+
+	return callers, warnings
+}
+
+// deniedService returns the service and port of a backend that denied
+// callers are sent to, e.g. web-8080 for denied-web-8080, or false when it
+// isn't one
+func deniedService(backend string) (string, bool) {
+	if !strings.HasPrefix(backend, deniedBackendPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(backend, deniedBackendPrefix), true
+}
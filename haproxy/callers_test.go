@@ -0,0 +1,79 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_AllowedCallers(t *testing.T) {
+	Convey("The allowed callers", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		var added int
+		add := func(id string, name string, mode string, ip string, metadata map[string]string, servicePort int64) {
+			added++
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, ProxyMode: mode, Metadata: metadata,
+				Ports:   []service.Port{{Type: "tcp", Port: 10450 + int64(added), ServicePort: servicePort, IP: ip}},
+				Updated: baseTime.Add(time.Duration(added) * time.Second),
+			})
+		}
+		add("deadbeef001", "billing", "http", "10.0.0.1", map[string]string{"AllowedCallers": "web, api"}, 8080)
+		add("deadbeef002", "web", "http", "10.0.0.3", nil, 8081)
+		add("deadbeef003", "api", "http", "10.0.0.2", nil, 8082)
+		add("deadbeef004", "web", "http", "10.0.0.3", nil, 8081)
+		add("deadbeef005", "db", "tcp", "10.0.0.4", map[string]string{"AllowedCallers": "billing"}, 5432)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("send the other callers to a backend that denies them", func() {
+			config := render()
+			So(config, ShouldContainSubstring, "\tacl allowed_caller src 10.0.0.2 10.0.0.3\n"+
+				"\tuse_backend denied-billing-8080 if !allowed_caller\n"+
+				"\tdefault_backend billing-8080\n")
+			So(config, ShouldContainSubstring, "\nbackend denied-billing-8080\n\tmode http\n\thttp-request deny deny_status 403\n")
+			So(config, ShouldContainSubstring, "\nbackend denied-db-5432\n\tmode tcp\n\ttcp-request content reject\n")
+			So(config, ShouldNotContainSubstring, "denied-web")
+			So(proxy.Warnings(), ShouldBeEmpty)
+		})
+
+		Convey("deny everyone while no allowed caller has instances", func() {
+			add("deadbeef001", "billing", "http", "10.0.0.1", map[string]string{"AllowedCallers": "reports"}, 8080)
+
+			config := render()
+			So(config, ShouldContainSubstring, "\tuse_backend denied-billing-8080\n\tdefault_backend billing-8080\n")
+
+			warnings := proxy.Warnings()
+			So(warnings, ShouldHaveLength, 1)
+			So(warnings[0].Service, ShouldEqual, "billing")
+			So(warnings[0].Kind, ShouldEqual, WarnAllowedCallers)
+			So(warnings[0].Message, ShouldEqual, "No instances of the allowed callers 'reports'")
+		})
+
+		Convey("name the services the denied backends are for", func() {
+			svcPort, ok := deniedService("denied-billing-8080")
+			So(ok, ShouldBeTrue)
+			So(svcPort, ShouldEqual, "billing-8080")
+
+			_, ok = deniedService("billing-8080")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
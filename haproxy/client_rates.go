@@ -0,0 +1,266 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-metrics"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+// The stick-tables the frontends track their clients in
+const (
+	clientRateTableSize = "100k"
+	clientRateExpire    = "1m"
+	clientRatePeriod    = "10s"
+)
+
+// A templateClientRates is what the template needs to track the clients of
+// one service in the stick-table of its frontend
+type templateClientRates struct {
+	Type   string // ip, or ipv6 when the frontend binds IPv6 too
+	Size   string
+	Expire string
+	Store  string // The counter, e.g. http_req_rate(10s)
+	Track  string // The rule that tracks the clients, e.g. http-request
+}
+
+// clientRatesFor returns what the template needs to track the clients of a
+// service, or nil when client rates are off
+func (h *HAproxy) clientRatesFor(svcName string, mode string, binds []string) *templateClientRates {
+	if !h.ClientRates {
+		return nil
+	}
+
+	rates := &templateClientRates{
+		Type:   "ip",
+		Size:   clientRateTableSize,
+		Expire: clientRateExpire,
+		Store:  "conn_rate(" + clientRatePeriod + ")",
+		Track:  "tcp-request connection",
+	}
+	if mode == "http" {
+		rates.Store = "http_req_rate(" + clientRatePeriod + ")"
+		rates.Track = "http-request"
+	}
+	for _, address := range binds {
+		if strings.HasPrefix(address, "[") {
+			rates.Type = "ipv6"
+		}
+	}
+
+	return rates
+}
+
+// clientRateTables returns the stick-tables the template gives the
+// frontends, by table name, with the service each is for
+func (h *HAproxy) clientRateTables(ports portmap) map[string]string {
+	if !h.ClientRates {
+		return nil
+	}
+
+	tables := make(map[string]string)
+	for svcName, svcPorts := range ports {
+		for svcPort := range svcPorts {
+			tables[sanitizeName(svcName)+"-"+svcPort] = svcName
+		}
+	}
+	return tables
+}
+
+// ClientRateTables returns the stick-tables in the last config written, by
+// table name, with the service each is for
+func (h *HAproxy) ClientRateTables() map[string]string {
+	h.clientTablesLock.RLock()
+	defer h.clientTablesLock.RUnlock()
+
+	tables := make(map[string]string, len(h.clientTables))
+	for table, svcName := range h.clientTables {
+		tables[table] = svcName
+	}
+	return tables
+}
+
+// A TableEntry is one key in a stick-table, with its counters. The rates
+// are per second.
+type TableEntry struct {
+	Key   string
+	Rates map[string]float64
+}
+
+// ShowTable returns the entries in one of the stick-tables, from
+// "show table"
+func (s *StatsSocket) ShowTable(table string) ([]TableEntry, error) {
+	output, err := s.command("show table " + table)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseTable(output)
+}
+
+// ParseTable parses the output of "show table" for a single table. Only the
+// rate counters are kept, e.g. http_req_rate(10000)=25 is 2.5 a second.
+func ParseTable(output []byte) ([]TableEntry, error) {
+	var entries []TableEntry
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// HAproxy answers with a message when something's wrong
+		if !strings.HasPrefix(line, "0x") {
+			return nil, fmt.Errorf("Error reading HAproxy stick-table: %s", line)
+		}
+
+		entry := TableEntry{Rates: make(map[string]float64)}
+		for _, field := range strings.Fields(line)[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if parts[0] == "key" {
+				entry.Key = parts[1]
+				continue
+			}
+
+			// Rates are name(period in ms)=count
+			open := strings.Index(parts[0], "(")
+			if open < 0 || !strings.HasSuffix(parts[0], ")") || !strings.HasSuffix(parts[0][:open], "_rate") {
+				continue
+			}
+			period, err := strconv.ParseFloat(parts[0][open+1:len(parts[0])-1], 64)
+			if err != nil || period <= 0 {
+				continue
+			}
+			count, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				continue
+			}
+			entry.Rates[parts[0][:open]] = count * 1000 / period
+		}
+
+		if entry.Key != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// A TableSource is where the ClientRateCollector reads the stick-tables
+// from. Usually a StatsSocket.
+type TableSource interface {
+	ShowTable(table string) ([]TableEntry, error)
+}
+
+// A ClientRate is how many requests a second one client makes to a
+// service. TCP services count connections.
+type ClientRate struct {
+	Client string
+	Rate   float64
+}
+
+// A ClientRateCollector reads the stick-tables the frontends track their
+// clients in, and exports the busiest clients of each service as gauges,
+// e.g. haproxy.client_rates.web.10_0_0_1. A service with more than one port
+// has the rates of its frontends added up.
+type ClientRateCollector struct {
+	Source TableSource
+	Tables func() map[string]string // The stick-tables, with their service
+	Top    int                      // How many clients of each service to export
+	sync.Mutex
+}
+
+// NewClientRateCollector returns a ClientRateCollector with the default
+// settings
+func NewClientRateCollector(source TableSource, tables func() map[string]string) *ClientRateCollector {
+	return &ClientRateCollector{
+		Source: source,
+		Tables: tables,
+		Top:    10,
+	}
+}
+
+// Collect reads the stick-tables, exports the busiest clients of each
+// service, and returns them, busiest first
+func (c *ClientRateCollector) Collect() (map[string][]ClientRate, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	tables := c.Tables()
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+
+	rates := make(map[string]map[string]float64)
+	var failed []string
+	for _, table := range names {
+		entries, err := c.Source.ShowTable(table)
+		if err != nil {
+			metrics.IncrCounter([]string{"haproxy", "client_rates", "errors"}, 1)
+			failed = append(failed, fmt.Sprintf("%s: %s", table, err))
+			continue
+		}
+
+		svcName := tables[table]
+		if rates[svcName] == nil {
+			rates[svcName] = make(map[string]float64)
+		}
+		for _, entry := range entries {
+			for _, rate := range entry.Rates {
+				rates[svcName][entry.Key] += rate
+			}
+		}
+	}
+
+	top := make(map[string][]ClientRate, len(rates))
+	for svcName, clients := range rates {
+		sorted := make([]ClientRate, 0, len(clients))
+		for client, rate := range clients {
+			sorted = append(sorted, ClientRate{Client: client, Rate: rate})
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].Rate != sorted[j].Rate {
+				return sorted[i].Rate > sorted[j].Rate
+			}
+			return sorted[i].Client < sorted[j].Client
+		})
+		if len(sorted) > c.Top {
+			sorted = sorted[:c.Top]
+		}
+
+		for _, rate := range sorted {
+			metrics.SetGauge([]string{"haproxy", "client_rates", svcName, metricName(rate.Client)}, float32(rate.Rate))
+		}
+		top[svcName] = sorted
+	}
+
+	if len(failed) > 0 {
+		return top, fmt.Errorf("Error reading stick-tables: %s", strings.Join(failed, ", "))
+	}
+	return top, nil
+}
+
+// Run collects the client rates on each iteration of the looper
+func (c *ClientRateCollector) Run(looper director.Looper) {
+	looper.Loop(func() error {
+		if _, err := c.Collect(); err != nil {
+			log.Warnf("Collecting client rates failed: %s", err)
+		}
+		return nil
+	})
+}
+
+// metricName makes an address usable as part of a metric name, where dots
+// and colons separate the parts
+func metricName(address string) string {
+	return strings.NewReplacer(".", "_", ":", "_").Replace(address)
+}
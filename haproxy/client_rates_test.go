@@ -0,0 +1,116 @@
+package haproxy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A TableSource that serves up canned stick-tables
+type fakeTableSource struct {
+	tables map[string][]TableEntry
+}
+
+func (f *fakeTableSource) ShowTable(table string) ([]TableEntry, error) {
+	entries, ok := f.tables[table]
+	if !ok {
+		return nil, errors.New("No such table")
+	}
+	return entries, nil
+}
+
+func Test_ClientRates(t *testing.T) {
+	Convey("The client rates", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		Convey("are parsed from the stick-tables", func() {
+			output := "# table: web-8080, type: ip, size:102400, used:2\n" +
+				"0x55d0c8a0b2c0: key=10.0.0.1 use=0 exp=59862 http_req_rate(10000)=25\n" +
+				"0x55d0c8a0b3d0: key=10.0.0.2 use=1 exp=41000 server_id=1 conn_rate(1000)=3\n\n"
+
+			entries, err := ParseTable([]byte(output))
+			So(err, ShouldBeNil)
+			So(entries, ShouldResemble, []TableEntry{
+				{Key: "10.0.0.1", Rates: map[string]float64{"http_req_rate": 2.5}},
+				{Key: "10.0.0.2", Rates: map[string]float64{"conn_rate": 3}},
+			})
+
+			_, err = ParseTable([]byte("No such table: web-9999\n"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("are the busiest clients of each service", func() {
+			source := &fakeTableSource{tables: map[string][]TableEntry{
+				"web-8080": {
+					{Key: "10.0.0.1", Rates: map[string]float64{"http_req_rate": 2}},
+					{Key: "10.0.0.2", Rates: map[string]float64{"http_req_rate": 5}},
+					{Key: "10.0.0.3", Rates: map[string]float64{"http_req_rate": 0.5}},
+				},
+				"web-9090": {
+					{Key: "10.0.0.1", Rates: map[string]float64{"http_req_rate": 4}},
+				},
+				"db-5432": {
+					{Key: "10.0.0.4", Rates: map[string]float64{"conn_rate": 1}},
+				},
+			}}
+			tables := map[string]string{"web-8080": "web", "web-9090": "web", "db-5432": "db", "gone-7070": "gone"}
+			collector := NewClientRateCollector(source, func() map[string]string { return tables })
+			collector.Top = 2
+
+			top, err := collector.Collect()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "gone-7070")
+			So(top, ShouldResemble, map[string][]ClientRate{
+				"web": {{Client: "10.0.0.1", Rate: 6}, {Client: "10.0.0.2", Rate: 5}},
+				"db":  {{Client: "10.0.0.4", Rate: 1}},
+			})
+		})
+
+		Convey("are tracked in the frontends when they're on", func() {
+			state := catalog.NewServicesState()
+			add := func(id string, name string, mode string, svcPort int64) {
+				state.AddServiceEntry(service.Service{
+					ID: id, Name: name, Hostname: hostname1, Updated: time.Now().UTC(), ProxyMode: mode,
+					Ports: []service.Port{{Type: "tcp", Port: 10450, ServicePort: svcPort, IP: "127.0.0.1"}},
+				})
+			}
+			add("deadbeef001", "web", "http", 8080)
+			add("deadbeef002", "db", "tcp", 5432)
+
+			proxy := New("tmpConfig", "tmpPid")
+			proxy.BindIP = "192.168.168.168"
+			proxy.Template = "../views/haproxy.cfg"
+
+			render := func() string {
+				buf := bytes.NewBuffer(make([]byte, 0, 4096))
+				So(proxy.WriteConfig(state, buf), ShouldBeNil)
+				return buf.String()
+			}
+
+			So(render(), ShouldNotContainSubstring, "stick-table")
+			So(proxy.ClientRateTables(), ShouldBeEmpty)
+
+			proxy.ClientRates = true
+			config := render()
+			So(config, ShouldContainSubstring, "frontend web-8080\n\tmode http\n\tbind 192.168.168.168:8080\n"+
+				"\tstick-table type ip size 100k expire 1m store http_req_rate(10s)\n"+
+				"\thttp-request track-sc0 src\n")
+			So(config, ShouldContainSubstring, "frontend db-5432\n\tmode tcp\n\tbind 192.168.168.168:5432\n"+
+				"\tstick-table type ip size 100k expire 1m store conn_rate(10s)\n"+
+				"\ttcp-request connection track-sc0 src\n")
+			So(proxy.ClientRateTables(), ShouldResemble, map[string]string{"web-8080": "web", "db-5432": "db"})
+
+			Convey("in IPv6 tables when the frontends bind IPv6", func() {
+				proxy.BindIPv6 = "fd00::1"
+				So(render(), ShouldContainSubstring, "\tstick-table type ipv6 size 100k")
+			})
+		})
+	})
+}
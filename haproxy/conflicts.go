@@ -0,0 +1,57 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A PortConflict is an address that the frontends of more than one service
+// would bind. HAproxy either fails to start with it or, with SO_REUSEPORT,
+// splits the connections between the frontends.
+type PortConflict struct {
+	Address  string // The bind address and ServicePort, e.g. 10.0.0.1:8080
+	Services []string
+}
+
+// A PortConflictError is returned instead of rendering a config with
+// conflicting frontends
+type PortConflictError struct {
+	Conflicts []PortConflict
+}
+
+func (e *PortConflictError) Error() string {
+	conflicts := make([]string, 0, len(e.Conflicts))
+	for _, conflict := range e.Conflicts {
+		conflicts = append(conflicts, fmt.Sprintf("%s is bound by %s", conflict.Address, strings.Join(conflict.Services, " and ")))
+	}
+	return "Error rendering HAproxy config, frontends conflict: " + strings.Join(conflicts, "; ")
+}
+
+// portConflicts finds the addresses that the TCP frontends of more than one
+// service would bind, sorted by address. Services that bind different
+// addresses, e.g. that are restricted to different address families or are
+// on different interfaces, can share a ServicePort.
+func (h *HAproxy) portConflicts(ports portmap, binds map[string][]string) []PortConflict {
+	bound := make(map[string][]string)
+	for svcName, portset := range ports {
+		for svcPort := range portset {
+			for _, address := range binds[svcName] {
+				key := address + ":" + svcPort
+				bound[key] = append(bound[key], svcName)
+			}
+		}
+	}
+
+	var conflicts []PortConflict
+	for address, svcNames := range bound {
+		if len(svcNames) < 2 {
+			continue
+		}
+		sort.Strings(svcNames)
+		conflicts = append(conflicts, PortConflict{Address: address, Services: svcNames})
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Address < conflicts[j].Address })
+
+	return conflicts
+}
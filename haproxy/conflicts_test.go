@@ -0,0 +1,73 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_PortConflicts(t *testing.T) {
+	Convey("The port conflicts", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		add := func(id string, name string, family string, servicePorts ...int64) {
+			var ports []service.Port
+			for i, svcPort := range servicePorts {
+				ports = append(ports, service.Port{Type: "tcp", Port: 10450 + int64(i), ServicePort: svcPort, IP: "127.0.0.1"})
+			}
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, ProxyMode: "http", IPFamily: family, Ports: ports,
+				Updated: baseTime,
+			})
+		}
+		add("deadbeef001", "web", "", 8080, 9090)
+		add("deadbeef002", "web", "", 8080, 9090)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		Convey("don't include the instances of the same service", func() {
+			So(proxy.WriteConfig(state, ioutil.Discard), ShouldBeNil)
+		})
+
+		Convey("stop the config from rendering, naming the services", func() {
+			add("deadbeef003", "api", "", 9090)
+			add("deadbeef004", "admin", "", 9090, 8080)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldNotBeNil)
+			So(buf.Len(), ShouldEqual, 0)
+
+			conflictErr, ok := err.(*PortConflictError)
+			So(ok, ShouldBeTrue)
+			So(conflictErr.Conflicts, ShouldResemble, []PortConflict{
+				{Address: "192.168.168.168:8080", Services: []string{"admin", "web"}},
+				{Address: "192.168.168.168:9090", Services: []string{"admin", "api", "web"}},
+			})
+			So(err.Error(), ShouldContainSubstring, "192.168.168.168:8080 is bound by admin and web")
+		})
+
+		Convey("leave out the services bound to different address families", func() {
+			proxy.BindIPv6 = "fd00::168"
+			add("deadbeef003", "web6", service.IPFamilyV6, 9090)
+			add("deadbeef004", "api", service.IPFamilyV4, 9091)
+			add("deadbeef005", "api6", service.IPFamilyV6, 9091)
+
+			err := proxy.WriteConfig(state, ioutil.Discard)
+			So(err, ShouldNotBeNil)
+			So(err.(*PortConflictError).Conflicts, ShouldResemble, []PortConflict{
+				{Address: "[fd00::168]:9090", Services: []string{"web", "web6"}},
+			})
+		})
+	})
+}
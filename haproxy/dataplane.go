@@ -0,0 +1,269 @@
+package haproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DataPlaneTimeout = 10 * time.Second
+	dataPlanePrefix  = "/v2/services/haproxy"
+)
+
+// A DataPlane pushes the config to HAproxy through the Data Plane API
+// instead of writing the file and running the reload command. Servers
+// coming and going are changed in one transaction, so the running HAproxy
+// gets all of them or none. Anything else that changed replaces the whole
+// config in one request.
+type DataPlane struct {
+	URL      string
+	User     string
+	Password string
+	Client   *http.Client
+}
+
+// A dataPlaneServer is a server as the Data Plane API describes it
+type dataPlaneServer struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	Cookie  string `json:"cookie,omitempty"`
+	MaxConn int    `json:"maxconn,omitempty"`
+	Weight  int    `json:"weight,omitempty"`
+}
+
+type dataPlaneTransaction struct {
+	ID string `json:"id"`
+}
+
+// NewDataPlane returns a DataPlane for the API at baseURL, e.g.
+// http://localhost:5555. The user and password are for basic auth.
+func NewDataPlane(baseURL string, user string, password string) *DataPlane {
+	return &DataPlane{
+		URL:      strings.TrimRight(baseURL, "/"),
+		User:     user,
+		Password: password,
+		Client:   &http.Client{Timeout: DataPlaneTimeout},
+	}
+}
+
+// Push makes the changes from the previous config to the next one. With no
+// previous config, e.g. at startup, the whole config is pushed.
+func (d *DataPlane) Push(previous []byte, next []byte) error {
+	if previous != nil {
+		changes, ok := diffServers(previous, next)
+		if ok && len(changes.Added) == 0 && len(changes.Removed) == 0 {
+			return nil
+		}
+
+		if ok {
+			err := d.pushServers(changes)
+			if err == nil {
+				log.Infof("Updated HAproxy through the Data Plane API: %d servers added, %d removed",
+					len(changes.Added), len(changes.Removed))
+				metrics.IncrCounter([]string{"haproxy", "dataplane", "transactions"}, 1)
+				return nil
+			}
+			log.Warnf("Pushing the whole HAproxy config instead: %s", err)
+		}
+	}
+
+	if err := d.pushRaw(next); err != nil {
+		return err
+	}
+
+	metrics.IncrCounter([]string{"haproxy", "dataplane", "raw_pushes"}, 1)
+	return nil
+}
+
+// pushServers adds and removes the servers in a transaction. It's only
+// committed when every change in it was accepted, and deleted otherwise.
+func (d *DataPlane) pushServers(changes *serverChanges) error {
+	added := make([]dataPlaneServer, 0, len(changes.Added))
+	for _, server := range changes.Added {
+		converted, err := toDataPlaneServer(server)
+		if err != nil {
+			return err
+		}
+		added = append(added, converted)
+	}
+
+	version, err := d.version()
+	if err != nil {
+		return err
+	}
+
+	var transaction dataPlaneTransaction
+	err = d.request(http.MethodPost, "/transactions?version="+strconv.Itoa(version), nil, &transaction)
+	if err != nil {
+		return fmt.Errorf("Error starting a Data Plane transaction: %s", err)
+	}
+
+	for _, server := range changes.Removed {
+		path := "/configuration/servers/" + url.PathEscape(server.Name) + "?" + transactionQuery(server.Backend, transaction.ID)
+		if err = d.request(http.MethodDelete, path, nil, nil); err != nil {
+			d.abort(transaction.ID)
+			return fmt.Errorf("Error deleting server %s: %s", server.key(), err)
+		}
+	}
+
+	for i, server := range changes.Added {
+		path := "/configuration/servers?" + transactionQuery(server.Backend, transaction.ID)
+		if err = d.request(http.MethodPost, path, added[i], nil); err != nil {
+			d.abort(transaction.ID)
+			return fmt.Errorf("Error adding server %s: %s", server.key(), err)
+		}
+	}
+
+	if err = d.request(http.MethodPut, "/transactions/"+transaction.ID, nil, nil); err != nil {
+		d.abort(transaction.ID)
+		return fmt.Errorf("Error committing Data Plane transaction %s: %s", transaction.ID, err)
+	}
+
+	return nil
+}
+
+// abort deletes a transaction, throwing away the changes made in it
+func (d *DataPlane) abort(id string) {
+	if err := d.request(http.MethodDelete, "/transactions/"+id, nil, nil); err != nil {
+		log.Warnf("Error deleting Data Plane transaction %s: %s", id, err)
+	}
+}
+
+// pushRaw replaces the whole config. The Data Plane API checks it and
+// reloads HAproxy, and leaves the running config alone if it's invalid.
+func (d *DataPlane) pushRaw(config []byte) error {
+	version, err := d.version()
+	if err != nil {
+		return err
+	}
+
+	err = d.request(http.MethodPost, "/configuration/raw?version="+strconv.Itoa(version), config, nil)
+	if err != nil {
+		return fmt.Errorf("Error pushing HAproxy config to the Data Plane API: %s", err)
+	}
+
+	return nil
+}
+
+// version returns the version of the config the Data Plane API has now.
+// Changes are made against it, and fail if someone else changed it first.
+func (d *DataPlane) version() (int, error) {
+	var version int
+	if err := d.request(http.MethodGet, "/configuration/version", nil, &version); err != nil {
+		return 0, fmt.Errorf("Error getting the config version from the Data Plane API: %s", err)
+	}
+
+	return version, nil
+}
+
+// request calls the Data Plane API. A []byte body is sent as plain text and
+// anything else as JSON. The response is decoded into result when it's not
+// nil.
+func (d *DataPlane) request(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	contentType := "application/json"
+
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(b)
+		contentType = "text/plain"
+	default:
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, d.URL+dataPlanePrefix+path, reader)
+	if err != nil {
+		return err
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if d.User != "" {
+		req.SetBasicAuth(d.User, d.Password)
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if result != nil {
+		return json.Unmarshal(respBody, result)
+	}
+
+	return nil
+}
+
+func transactionQuery(backend string, id string) string {
+	return url.Values{"backend": {backend}, "transaction_id": {id}}.Encode()
+}
+
+// toDataPlaneServer converts a server line from the config. It returns an
+// error for the options that it doesn't know, so the whole config is pushed
+// instead and none of them are lost.
+func toDataPlaneServer(server configServer) (dataPlaneServer, error) {
+	converted := dataPlaneServer{Name: server.Name}
+
+	host, portValue, ok := splitHostPort(server.Addr)
+	if !ok {
+		return converted, fmt.Errorf("Error parsing address of %s: '%s'", server.key(), server.Addr)
+	}
+
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return converted, fmt.Errorf("Error parsing address of %s: '%s'", server.key(), server.Addr)
+	}
+	converted.Address, converted.Port = host, port
+
+	args := strings.Fields(server.Args)
+	for j := 0; j < len(args); j += 2 {
+		if j+1 >= len(args) {
+			return converted, fmt.Errorf("Error converting %s, no value for '%s'", server.key(), args[j])
+		}
+
+		value := args[j+1]
+		switch args[j] {
+		case "cookie":
+			converted.Cookie = value
+		case "maxconn":
+			converted.MaxConn, err = strconv.Atoi(value)
+		case "weight":
+			converted.Weight, err = strconv.Atoi(value)
+		default:
+			return converted, fmt.Errorf("Error converting %s, unsupported option '%s'", server.key(), args[j])
+		}
+
+		if err != nil {
+			return converted, fmt.Errorf("Error converting %s, invalid %s '%s'", server.key(), args[j], value)
+		}
+	}
+
+	return converted, nil
+}
@@ -0,0 +1,134 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeDataPlane records the requests made to it, and fails the ones whose
+// method and path start with FailOn
+type fakeDataPlane struct {
+	Requests []string
+	Bodies   []string
+	FailOn   string
+	Auth     string
+}
+
+func (f *fakeDataPlane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request := r.Method + " " + strings.TrimPrefix(r.URL.RequestURI(), dataPlanePrefix)
+	body, _ := ioutil.ReadAll(r.Body)
+	f.Requests = append(f.Requests, request)
+	f.Bodies = append(f.Bodies, string(body))
+
+	user, password, _ := r.BasicAuth()
+	f.Auth = user + ":" + password
+
+	if f.FailOn != "" && strings.HasPrefix(request, f.FailOn) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"message": "nope"}`)
+		return
+	}
+
+	switch {
+	case r.URL.Path == dataPlanePrefix+"/configuration/version":
+		fmt.Fprint(w, "7")
+	case r.Method == http.MethodPost && r.URL.Path == dataPlanePrefix+"/transactions":
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": "tx1", "status": "in_progress"}`)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func Test_DataPlane(t *testing.T) {
+	Convey("DataPlane", t, func() {
+		fake := &fakeDataPlane{}
+		server := httptest.NewServer(fake)
+		defer server.Close()
+
+		dataPlane := NewDataPlane(server.URL+"/", "admin", "sekrit")
+
+		before := []byte(fmt.Sprintf(runtimeConfig, "\tserver beta-deadbeef002 10.0.0.2:32768 cookie beta-32768\n"))
+		after := []byte(fmt.Sprintf(runtimeConfig, "\tserver gamma-deadbeef003 10.0.0.3:32768 cookie gamma-32768 maxconn 50\n"))
+
+		Convey("changes the servers in a transaction", func() {
+			So(dataPlane.Push(before, after), ShouldBeNil)
+
+			So(fake.Requests, ShouldResemble, []string{
+				"GET /configuration/version",
+				"POST /transactions?version=7",
+				"DELETE /configuration/servers/beta-deadbeef002?backend=web-8080&transaction_id=tx1",
+				"POST /configuration/servers?backend=web-8080&transaction_id=tx1",
+				"PUT /transactions/tx1",
+			})
+			So(fake.Bodies[3], ShouldEqual,
+				`{"name":"gamma-deadbeef003","address":"10.0.0.3","port":32768,"cookie":"gamma-32768","maxconn":50}`)
+			So(fake.Auth, ShouldEqual, "admin:sekrit")
+		})
+
+		Convey("deletes the transaction when a change fails, and pushes the whole config", func() {
+			fake.FailOn = "POST /configuration/servers"
+
+			So(dataPlane.Push(before, after), ShouldBeNil)
+
+			So(fake.Requests[4:], ShouldResemble, []string{
+				"DELETE /transactions/tx1",
+				"GET /configuration/version",
+				"POST /configuration/raw?version=7",
+			})
+			So(fake.Bodies[6], ShouldEqual, string(after))
+		})
+
+		Convey("pushes the whole config when more than the servers changed", func() {
+			changed := []byte(strings.Replace(string(after), "mode http", "mode tcp", 1))
+
+			So(dataPlane.Push(before, changed), ShouldBeNil)
+			So(fake.Requests, ShouldResemble, []string{
+				"GET /configuration/version",
+				"POST /configuration/raw?version=7",
+			})
+		})
+
+		Convey("pushes the whole config the first time", func() {
+			So(dataPlane.Push(nil, after), ShouldBeNil)
+			So(fake.Requests[1], ShouldEqual, "POST /configuration/raw?version=7")
+		})
+
+		Convey("does nothing when only the comments changed", func() {
+			So(dataPlane.Push(before, []byte(strings.Replace(string(before), "version 1", "version 2", 1))), ShouldBeNil)
+			So(fake.Requests, ShouldBeEmpty)
+		})
+
+		Convey("returns an error when the API rejects the config", func() {
+			fake.FailOn = "POST /configuration/raw"
+
+			err := dataPlane.Push(nil, after)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "nope")
+		})
+	})
+
+	Convey("toDataPlaneServer()", t, func() {
+		Convey("refuses the options it doesn't know", func() {
+			_, err := toDataPlaneServer(configServer{
+				Backend: "web-8080", Name: "alpha", Addr: "10.0.0.1:32768", Args: "check inter 2s",
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("takes the brackets off IPv6 addresses", func() {
+			server, err := toDataPlaneServer(configServer{
+				Backend: "web-8080", Name: "alpha", Addr: "[fd00::1]:32768",
+			})
+			So(err, ShouldBeNil)
+			So(server.Address, ShouldEqual, "fd00::1")
+			So(server.Port, ShouldEqual, 32768)
+		})
+	})
+}
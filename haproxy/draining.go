@@ -0,0 +1,135 @@
+package haproxy
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// A drainingServer is an instance that was tombstoned, kept in its backends
+// without new connections until the DrainPeriod is up
+type drainingServer struct {
+	Service *service.Service // As it was last rendered
+	Until   time.Time
+}
+
+// stoppedServers returns the names of the servers whose instances are
+// tombstoned. The state must be locked.
+func stoppedServers(state *catalog.ServicesState) map[string]bool {
+	stopped := make(map[string]bool)
+	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		if svc.IsTombstone() {
+			stopped[svc.Hostname+"-"+svc.ID] = true
+		}
+	})
+	return stopped
+}
+
+// drainStopped keeps the instances that were rendered last time, and have
+// since been tombstoned, in their backends until the DrainPeriod is up, so
+// their connections can finish. It returns the ones still draining, sorted
+// by server, for the services to render them with a weight of zero.
+func (h *HAproxy) drainStopped(stopped map[string]bool,
+	services map[string][]*service.Service) []*service.Service {
+
+	h.drainingLock.Lock()
+	defer h.drainingLock.Unlock()
+
+	rendered := make(map[string]*service.Service)
+	for _, svcList := range services {
+		for _, svc := range svcList {
+			rendered[svc.Hostname+"-"+svc.ID] = svc
+		}
+	}
+
+	previous := h.rendered
+	h.rendered = rendered
+
+	if h.DrainPeriod <= 0 {
+		h.draining = nil
+		return nil
+	}
+
+	if h.draining == nil {
+		h.draining = make(map[string]*drainingServer)
+	}
+
+	now := clock.OrReal(h.Clock).Now().UTC()
+	for name, svc := range previous {
+		if _, ok := h.draining[name]; ok || rendered[name] != nil || !stopped[name] {
+			continue
+		}
+		log.Infof("Draining %s from the %s backends until %s", name, svc.Name, now.Add(h.DrainPeriod).Format(time.RFC3339))
+		h.draining[name] = &drainingServer{Service: svc, Until: now.Add(h.DrainPeriod)}
+	}
+
+	var draining []*service.Service
+	for name, server := range h.draining {
+		// It's back, or its time is up
+		if rendered[name] != nil || !now.Before(server.Until) {
+			delete(h.draining, name)
+			continue
+		}
+		draining = append(draining, server.Service)
+	}
+
+	sort.Slice(draining, func(i, j int) bool {
+		return draining[i].Hostname+"-"+draining[i].ID < draining[j].Hostname+"-"+draining[j].ID
+	})
+
+	return draining
+}
+
+// drainEnded returns a channel that fires when the first of the draining
+// servers is done, or nil when there are none
+func (h *HAproxy) drainEnded() <-chan time.Time {
+	h.drainingLock.Lock()
+	defer h.drainingLock.Unlock()
+
+	var first time.Time
+	for _, server := range h.draining {
+		if first.IsZero() || server.Until.Before(first) {
+			first = server.Until
+		}
+	}
+
+	if first.IsZero() {
+		return nil
+	}
+
+	clk := clock.OrReal(h.Clock)
+	return clk.After(first.Sub(clk.Now()))
+}
+
+// drainedArgs tells us whether a server line's args differ from the old
+// ones only by a weight of zero, which is how a draining server is rendered
+func drainedArgs(old string, next string) bool {
+	nextFields := strings.Fields(next)
+	var weight string
+	for i, field := range nextFields {
+		if field == "weight" && i+1 < len(nextFields) {
+			weight = nextFields[i+1]
+		}
+	}
+
+	return weight == "0" && withoutWeight(old) == withoutWeight(next)
+}
+
+// withoutWeight returns a server line's args without its weight
+func withoutWeight(args string) string {
+	fields := strings.Fields(args)
+	kept := make([]string, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		if fields[i] == "weight" {
+			i++
+			continue
+		}
+		kept = append(kept, fields[i])
+	}
+	return strings.Join(kept, " ")
+}
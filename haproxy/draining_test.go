@@ -0,0 +1,82 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Draining(t *testing.T) {
+	Convey("Draining stopped instances", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		baseTime := time.Now().UTC()
+		fake := clock.NewFake(baseTime)
+		state := catalog.NewServicesState()
+		svc := service.Service{
+			ID: "deadbeef001", Name: "web", Hostname: hostname1, Updated: baseTime, ProxyMode: "http",
+			Ports: []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "127.0.0.1"}},
+		}
+		state.AddServiceEntry(svc)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.Clock = fake
+		proxy.DrainPeriod = time.Minute
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		server := "\tserver indomitable-deadbeef001 127.0.0.1:10450 cookie indomitable-10450 "
+		stop := func() {
+			stopped := svc
+			stopped.Status = service.TOMBSTONE
+			stopped.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(stopped)
+		}
+
+		So(render(), ShouldContainSubstring, server+"\n")
+
+		Convey("keeps them in their backends with no weight", func() {
+			stop()
+			config := render()
+			So(config, ShouldContainSubstring, "frontend web-8080")
+			So(config, ShouldContainSubstring, server+"weight 0 \n")
+			So(proxy.drainEnded(), ShouldNotBeNil)
+		})
+
+		Convey("removes them when the period is up", func() {
+			stop()
+			render()
+			fake.Advance(time.Minute)
+			So(render(), ShouldNotContainSubstring, server)
+			So(proxy.drainEnded(), ShouldBeNil)
+		})
+
+		Convey("renders them as usual when they come back", func() {
+			stop()
+			render()
+			svc.Updated = baseTime.Add(2 * time.Second)
+			state.AddServiceEntry(svc)
+			So(render(), ShouldContainSubstring, server+"\n")
+			So(proxy.drainEnded(), ShouldBeNil)
+		})
+
+		Convey("removes them right away without a period", func() {
+			proxy.DrainPeriod = 0
+			stop()
+			So(render(), ShouldNotContainSubstring, server)
+		})
+	})
+}
@@ -0,0 +1,225 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// Why an instance of a service was left out of the backends
+const (
+	ExcludedNoPorts      = "NoPorts"      // It doesn't expose any ports
+	ExcludedCheckFailed  = "CheckFailed"  // Its health check is failing
+	ExcludedUnknown      = "Unknown"      // Its health hasn't been established yet
+	ExcludedDraining     = "Draining"     // It's being taken out of service
+	ExcludedPortMismatch = "PortMismatch" // Its ServicePorts differ from the other instances'
+	ExcludedPortFailed   = "PortFailed"   // One of its named ports is failing its own check
+	ExcludedNotInSplit   = "NotInSplit"   // Its version has no share of the traffic split
+)
+
+// An Exclusion is an instance of a service that the last config rendered
+// has no server for, and why
+type Exclusion struct {
+	Service  string
+	Hostname string
+	ID       string
+	Server   string // The name the server has in the backends
+	Port     int64  `json:",omitempty"` // Set when it's only left out of this port's backend
+	Reason   string
+	Detail   string    `json:",omitempty"`
+	Since    time.Time // When it was first left out for this reason
+}
+
+// newExclusion returns the Exclusion of an instance for a reason
+func newExclusion(svc *service.Service, reason string, detail string) Exclusion {
+	return Exclusion{
+		Service:  svc.Name,
+		Hostname: svc.Hostname,
+		ID:       svc.ID,
+		Server:   svc.Hostname + "-" + svc.ID,
+		Reason:   reason,
+		Detail:   detail,
+	}
+}
+
+// statusExclusion returns the Exclusion for an instance that isn't alive.
+// Tombstoned instances are gone, so they return false.
+func statusExclusion(svc *service.Service) (Exclusion, bool) {
+	var reason string
+	switch svc.Status {
+	case service.UNHEALTHY:
+		reason = ExcludedCheckFailed
+	case service.UNKNOWN:
+		reason = ExcludedUnknown
+	case service.DRAINING:
+		reason = ExcludedDraining
+	default:
+		return Exclusion{}, false
+	}
+
+	var detail string
+	switch {
+	case svc.Reporter != "":
+		detail = "merged from the hosts reporting on it"
+	case svc.Status == service.DRAINING && svc.DrainedUntil != nil:
+		detail = "until " + svc.DrainedUntil.UTC().Format(time.RFC3339)
+	}
+
+	return newExclusion(svc, reason, detail), true
+}
+
+// portMismatchExclusion returns the Exclusion for an instance whose
+// ServicePorts differ from those of the instance already in the backends
+func portMismatchExclusion(svc *service.Service, match *service.Service) Exclusion {
+	detail := fmt.Sprintf("ports %s, not %s like %s-%s",
+		strings.Join(getSortedServicePorts(svc), ","),
+		strings.Join(getSortedServicePorts(match), ","),
+		match.Hostname, match.ID,
+	)
+	return newExclusion(svc, ExcludedPortMismatch, detail)
+}
+
+// portExclusions returns an Exclusion for each named port of an instance
+// whose own health check is failing. The instance stays in the backends for
+// its other ports.
+func portExclusions(svc *service.Service) []Exclusion {
+	var exclusions []Exclusion
+	for _, port := range svc.Ports {
+		if port.Status == service.ALIVE {
+			continue
+		}
+
+		exclusion := newExclusion(svc, ExcludedPortFailed, "port "+port.Name)
+		exclusion.Port = port.ServicePort
+		exclusions = append(exclusions, exclusion)
+	}
+
+	return exclusions
+}
+
+// sortExclusions orders the exclusions by service, hostname, ID, and port
+func sortExclusions(exclusions []Exclusion) {
+	sort.Slice(exclusions, func(i, j int) bool {
+		a, b := exclusions[i], exclusions[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Port < b.Port
+	})
+}
+
+// recordExclusions keeps the exclusions from a render, and returns them with
+// the time each one was first seen. A new one, including those there on the
+// first render, is published as a ServerExcluded event.
+func (h *HAproxy) recordExclusions(exclusions []Exclusion) []Exclusion {
+	now := clock.OrReal(h.Clock).Now().UTC()
+
+	h.exclusionsLock.Lock()
+	defer h.exclusionsLock.Unlock()
+
+	since := make(map[string]time.Time, len(h.exclusions))
+	for _, exclusion := range h.exclusions {
+		since[exclusion.key()] = exclusion.Since
+	}
+
+	var added []Exclusion
+	for i := range exclusions {
+		if first, ok := since[exclusions[i].key()]; ok {
+			exclusions[i].Since = first
+			continue
+		}
+		exclusions[i].Since = now
+		added = append(added, exclusions[i])
+	}
+	h.exclusions = exclusions
+
+	for _, exclusion := range added {
+		h.publishExclusion(exclusion)
+	}
+
+	return exclusions
+}
+
+// key identifies an exclusion across renders. One that comes back for
+// another reason is a new one.
+func (e *Exclusion) key() string {
+	return e.Server + "/" + strconv.FormatInt(e.Port, 10) + "/" + e.Reason
+}
+
+// publishExclusion publishes an event about an instance that was left out,
+// when there's a bus
+func (h *HAproxy) publishExclusion(exclusion Exclusion) {
+	if h.Events == nil {
+		return
+	}
+
+	message := fmt.Sprintf("Left %s out of the backends: %s", exclusion.Server, exclusion.Reason)
+	details := map[string]string{
+		"Server":   exclusion.Server,
+		"Hostname": exclusion.Hostname,
+		"ID":       exclusion.ID,
+		"Reason":   exclusion.Reason,
+	}
+	if exclusion.Detail != "" {
+		message += " (" + exclusion.Detail + ")"
+		details["Detail"] = exclusion.Detail
+	}
+	if exclusion.Port != 0 {
+		details["Port"] = strconv.FormatInt(exclusion.Port, 10)
+	}
+
+	h.Events.Publish(events.Event{
+		Time:    exclusion.Since,
+		Type:    "ServerExcluded",
+		Source:  "haproxy",
+		Subject: exclusion.Service,
+		Message: message,
+		Details: details,
+	})
+}
+
+// Exclusions returns the instances the last config rendered left out of the
+// backends, sorted by service, hostname, and ID
+func (h *HAproxy) Exclusions() []Exclusion {
+	h.exclusionsLock.RLock()
+	defer h.exclusionsLock.RUnlock()
+
+	exclusions := make([]Exclusion, len(h.exclusions))
+	copy(exclusions, h.exclusions)
+
+	return exclusions
+}
+
+// exclusionsFor returns the exclusions for one service, for rendering in the
+// template when ShowExclusions is set. When there is a port, the exclusions
+// that only apply to the service's other ports are left out.
+func (h *HAproxy) exclusionsFor(name string, port string, exclusions []Exclusion) []Exclusion {
+	if !h.ShowExclusions {
+		return nil
+	}
+
+	var result []Exclusion
+	for _, exclusion := range exclusions {
+		if exclusion.Service != name {
+			continue
+		}
+		if exclusion.Port != 0 && port != "" && strconv.FormatInt(exclusion.Port, 10) != port {
+			continue
+		}
+		result = append(result, exclusion)
+	}
+
+	return result
+}
@@ -0,0 +1,84 @@
+package haproxy
+
+import (
+	"os"
+	"sort"
+
+	"github.com/NinesStack/sidecar/service"
+)
+
+// The general purpose helpers the templates get, for sites to build their
+// own sections from the services without changing Sidecar
+
+// filterByLabel returns the services with a value in their Metadata
+func filterByLabel(key string, value string, services []*service.Service) []*service.Service {
+	filtered := make([]*service.Service, 0, len(services))
+	for _, svc := range services {
+		if actual, ok := svc.Metadata[key]; ok && actual == value {
+			filtered = append(filtered, svc)
+		}
+	}
+	return filtered
+}
+
+// A templateVersion is the instances of a service running one version
+type templateVersion struct {
+	Version  string
+	Services []*service.Service
+}
+
+// groupByVersion returns the services grouped by the version of their
+// image, sorted by version
+func groupByVersion(services []*service.Service) []templateVersion {
+	byVersion := make(map[string][]*service.Service)
+	for _, svc := range services {
+		byVersion[svc.Version()] = append(byVersion[svc.Version()], svc)
+	}
+
+	groups := make([]templateVersion, 0, len(byVersion))
+	for version, svcList := range byVersion {
+		groups = append(groups, templateVersion{Version: version, Services: svcList})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Version < groups[j].Version })
+
+	return groups
+}
+
+// healthyOnly returns the services that are alive
+func healthyOnly(services []*service.Service) []*service.Service {
+	healthy := make([]*service.Service, 0, len(services))
+	for _, svc := range services {
+		if svc.IsAlive() {
+			healthy = append(healthy, svc)
+		}
+	}
+	return healthy
+}
+
+// metadataFor returns a value from a service's Metadata, or an empty string
+// when it has none
+func metadataFor(svc *service.Service, key string) string {
+	return svc.Metadata[key]
+}
+
+// portNamed returns a service's port with a name, e.g. "admin", or nil when
+// it has none
+func portNamed(svc *service.Service, name string) *service.Port {
+	for i := range svc.Ports {
+		if svc.Ports[i].Name == name {
+			return &svc.Ports[i]
+		}
+	}
+	return nil
+}
+
+// envFor returns an environment variable, or the default when it is unset
+func envFor(name string, defaultValue ...string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	if len(defaultValue) > 0 {
+		return defaultValue[0]
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_TemplateHelpers(t *testing.T) {
+	Convey("The template helpers", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		baseTime := time.Now().UTC()
+		newService := func(id string, image string, metadata map[string]string) *service.Service {
+			return &service.Service{
+				ID: id, Name: "web", Image: image, Hostname: hostname1, Updated: baseTime, ProxyMode: "http",
+				Metadata: metadata,
+				Ports: []service.Port{
+					{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "10.0.0.1"},
+					{Type: "tcp", Port: 10451, ServicePort: 9090, IP: "10.0.0.1", Name: "admin"},
+				},
+			}
+		}
+		v1 := newService("deadbeef001", "web:1.0", map[string]string{"tier": "gold"})
+		v2 := newService("deadbeef002", "web:2.0", map[string]string{"tier": "silver"})
+		v1again := newService("deadbeef003", "web:1.0", nil)
+		services := []*service.Service{v2, v1, v1again}
+
+		Convey("filterByLabel() keeps the services with the value", func() {
+			So(filterByLabel("tier", "gold", services), ShouldResemble, []*service.Service{v1})
+			So(filterByLabel("tier", "bronze", services), ShouldBeEmpty)
+		})
+
+		Convey("groupByVersion() groups the services, sorted by version", func() {
+			So(groupByVersion(services), ShouldResemble, []templateVersion{
+				{Version: "1.0", Services: []*service.Service{v1, v1again}},
+				{Version: "2.0", Services: []*service.Service{v2}},
+			})
+		})
+
+		Convey("healthyOnly() leaves out the services that aren't alive", func() {
+			v2.Status = service.UNHEALTHY
+			So(healthyOnly(services), ShouldResemble, []*service.Service{v1, v1again})
+		})
+
+		Convey("metadata() and portNamed() look up a service's settings", func() {
+			So(metadataFor(v1, "tier"), ShouldEqual, "gold")
+			So(metadataFor(v1again, "tier"), ShouldEqual, "")
+			So(portNamed(v1, "admin").Port, ShouldEqual, 10451)
+			So(portNamed(v1, "metrics"), ShouldBeNil)
+		})
+
+		Convey("env() falls back to the default", func() {
+			os.Setenv("SIDECAR_TEST_TEMPLATE_ENV", "prod")
+			defer os.Unsetenv("SIDECAR_TEST_TEMPLATE_ENV")
+
+			So(envFor("SIDECAR_TEST_TEMPLATE_ENV", "dev"), ShouldEqual, "prod")
+			So(envFor("SIDECAR_TEST_TEMPLATE_UNSET", "dev"), ShouldEqual, "dev")
+			So(envFor("SIDECAR_TEST_TEMPLATE_UNSET"), ShouldEqual, "")
+		})
+
+		Convey("can be used from an overlay", func() {
+			state := catalog.NewServicesState()
+			for _, svc := range services {
+				state.AddServiceEntry(*svc)
+			}
+
+			overlay, _ := ioutil.TempFile("", "haproxy.cfg")
+			defer os.Remove(overlay.Name())
+			overlay.WriteString(`{{ define "extra" }}{{ range $svcName, $services := .Services }}` +
+				`{{ range groupByVersion (healthyOnly $services) }}
+backend {{ sanitizeName $svcName }}-{{ sanitizeName .Version }}-admin
+	mode http{{ range $svc := .Services }}{{ with portNamed $svc "admin" }}
+	server {{ $svc.Hostname }}-{{ $svc.ID }} {{ hostPort .IP .Port }}{{ end }}{{ end }}
+{{ end }}{{ end }}{{ end }}`)
+			overlay.Close()
+
+			proxy := New("tmpConfig", "tmpPid")
+			proxy.Template = "../views/haproxy.cfg"
+			proxy.TemplateOverlay = overlay.Name()
+
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "\nbackend web-1-0-admin\n\tmode http\n"+
+				"\tserver indomitable-deadbeef001 10.0.0.1:10451\n"+
+				"\tserver indomitable-deadbeef003 10.0.0.1:10451\n")
+			So(buf.String(), ShouldContainSubstring, "\nbackend web-2-0-admin\n")
+		})
+	})
+}
@@ -2,8 +2,11 @@ package haproxy
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -11,54 +14,324 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"text/template"
 	"time"
 
+	"github.com/NinesStack/sidecar/affinity"
 	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/certs"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/secrets"
 	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/templating"
+	"github.com/armon/go-metrics"
 	log "github.com/sirupsen/logrus"
 )
 
 type portset map[string]string
 type portmap map[string]portset
 
+// What to do for a service that has no healthy backends
+const (
+	// Stop listening for it, so clients get connection refused
+	NoBackendsRefuse = "refuse"
+	// Keep listening and route to a backend that answers HTTP clients with a
+	// 503 (and the 503 error page) and closes TCP connections
+	NoBackendsMaintenance = "maintenance"
+)
+
+// The defaults for limiting the connections to each server by its memory
+const (
+	// What a connection takes when a service doesn't say
+	DefaultMemoryPerConn = 1 << 20
+	// The fewest connections a server is limited to
+	DefaultMinServerConn = 10
+)
+
+// The status codes HAproxy will serve an errorfile for
+var errorFileCodes = []string{
+	"200", "400", "403", "405", "408", "425", "429", "500", "502", "503", "504",
+}
+
 // Configuration and state for the HAproxy management module
 type HAproxy struct {
-	ReloadCmd      string `toml:"reload_cmd"`
-	VerifyCmd      string `toml:"verify_cmd"`
-	BindIP         string `toml:"bind_ip"`
-	Template       string `toml:"template"`
-	ConfigFile     string `toml:"config_file"`
-	PidFile        string `toml:"pid_file"`
-	User           string `toml:"user"`
-	Group          string `toml:"group"`
-	UseHostnames   bool   `toml:"use_hostnames"`
-	eventChannel   chan catalog.ChangeEvent
-	signalsHandled bool
-	sigLock        sync.Mutex
-	sigStopChan    chan struct{}
+	ReloadCmd     string `toml:"reload_cmd"`
+	VerifyCmd     string `toml:"verify_cmd"`
+	BindIP        string `toml:"bind_ip"`
+	BindIPv6      string `toml:"bind_ipv6"`
+	Template      string `toml:"template"`
+	ConfigFile    string `toml:"config_file"`
+	PidFile       string `toml:"pid_file"`
+	User          string `toml:"user"`
+	Group         string `toml:"group"`
+	Chroot        string `toml:"chroot"`
+	MaxConn       int    `toml:"maxconn"`
+	NbThread      int    `toml:"nbthread"`
+	NbProc        int    `toml:"nbproc"`
+	LogTarget     string `toml:"log_target"`
+	RequestLogs   bool   `toml:"request_logs"`
+	UseHostnames  bool   `toml:"use_hostnames"`
+	ErrorFilesDir string `toml:"error_files_dir"`
+	NoBackends    string `toml:"no_backends"`
+	StatsSocket   string `toml:"stats_socket"`
+	// More addresses HAproxy can bind to, by interface name. Services pick
+	// the ones they're served on with their BindInterfaces, instead of the
+	// BindIP and BindIPv6.
+	BindInterfaces map[string]string `toml:"bind_interfaces"`
+	// An optional site template whose blocks override those in the Template
+	TemplateOverlay string `toml:"template_overlay"`
+	// Per-service NoBackends settings, by service name
+	NoBackendsOverrides map[string]string `toml:"no_backends_overrides"`
+	// Where the certificates named by the services' TLSCert are kept
+	CertDir string `toml:"cert_dir"`
+	// Certificate files to terminate TLS with, by service name, and one for
+	// the HTTP services that have no other. Used when the service has no
+	// certificate in the CertDir.
+	CertFiles       map[string]string `toml:"cert_files"`
+	DefaultCertFile string            `toml:"default_cert_file"`
+	// Redirect the requests to the shared HTTP frontend for services that
+	// terminate TLS to their HTTPS frontend
+	HTTPSRedirect bool `toml:"https_redirect"`
+	// Where to listen for ACME HTTP-01 challenges, and the address of the
+	// responder that answers them. Setting the responder turns on issuing
+	// certificates for the services' PublicHostnames.
+	ACMEBind      string `toml:"acme_bind"`
+	ACMEResponder string `toml:"acme_responder"`
+	// The port of the shared HTTP frontend that routes by the Host header to
+	// the services' VirtualHosts. Zero turns it off.
+	VirtualHostPort int `toml:"vhost_port"`
+	// The port of the shared TCP frontend that routes TLS connections by
+	// their SNI to the services' SNIHosts, without decrypting them. Zero
+	// turns it off.
+	SNIPort int `toml:"sni_port"`
+	// Where the SPOE agent answers, and where its SPOE config is written.
+	// Setting the agent asks it about each request to the services that
+	// want decisions.
+	SPOEAgent      string `toml:"spoe_agent"`
+	SPOEConfigFile string `toml:"spoe_config_file"`
+	// Track each service's clients in a stick-table in its frontend, so the
+	// busiest of them can be read over the StatsSocket
+	ClientRates bool `toml:"client_rates"`
+	// Limit the connections to each server by the memory of its container.
+	// MemoryPerConn is what a connection takes when the service doesn't say,
+	// and limits worked out from the memory are at least MinServerConn.
+	ConnLimits    bool   `toml:"conn_limits"`
+	MemoryPerConn uint64 `toml:"memory_per_conn"`
+	MinServerConn int    `toml:"min_server_conn"`
+	// Render the instances left out of each backend as comments
+	ShowExclusions bool `toml:"show_exclusions"`
+	// The timeouts and retries in the defaults section, and the JSON file
+	// that overrides them for some services. The services' labels override
+	// both.
+	ConnectTimeout time.Duration `toml:"connect_timeout"`
+	ClientTimeout  time.Duration `toml:"client_timeout"`
+	ServerTimeout  time.Duration `toml:"server_timeout"`
+	Retries        int           `toml:"retries"`
+	TimeoutsFile   string        `toml:"timeouts_file"`
+	// Have HAproxy check each server with the HTTP check its Sidecar
+	// announced for the service, instead of trusting every one it's given
+	ActiveChecks bool `toml:"active_checks"`
+	// How long a tombstoned instance stays in its backends, taking no new
+	// connections, so the ones it has can finish. Zero removes it right away.
+	DrainPeriod time.Duration `toml:"drain_period"`
+	// The port of the mesh frontend that terminates mutual TLS from the
+	// other hosts for the instances on this one. Setting it also sends the
+	// traffic to instances on other hosts to their mesh frontends over
+	// mutual TLS, with this host's certificate, verified against the CA.
+	MeshPort     int    `toml:"mesh_port"`
+	MeshCertFile string `toml:"mesh_cert_file"`
+	MeshCAFile   string `toml:"mesh_ca_file"`
+	// The HAproxy binary, run to find out which version is installed
+	Binary string `toml:"binary"`
+	// Global cpu-map entries, e.g. "auto:1/1-4 0-3", pinning the processes
+	// or threads to CPUs
+	CPUMap []string `toml:"cpu_map"`
+	// Turn off SO_REUSEPORT on the listening sockets
+	NoReusePort bool `toml:"no_reuseport"`
+	// Options added to every service's bind lines, e.g. "shards by-thread"
+	BindOptions string `toml:"bind_options"`
+	// Have the IPv6 bind addresses take IPv4 connections too, so binding
+	// only the IPv6 wildcard serves both families
+	DualStack bool `toml:"dual_stack"`
+	// Offer HTTP/2 on the frontends that terminate TLS
+	HTTP2 bool `toml:"http2"`
+	// Clients pinned to particular service instances, if any
+	Pins *affinity.Store `toml:"-"`
+	// Where the templates get credentials from with the secret function
+	Secrets secrets.Provider `toml:"-"`
+	// Tells the time for the now function in the templates
+	Clock clock.Clock `toml:"-"`
+	// Optional bus for the reloads and the failures to reload
+	Events *events.Bus `toml:"-"`
+	// How long to wait after a state change for more of them, so that a
+	// deploy changing many services at once is a single reload
+	ReloadDebounce time.Duration `toml:"reload_debounce"`
+	// How long Watch waits to try again after a failed write and reload,
+	// doubling with each failure in a row up to MaxReloadBackoff. Zero
+	// tries again only on the next state change.
+	ReloadBackoff    time.Duration `toml:"reload_backoff"`
+	MaxReloadBackoff time.Duration `toml:"max_reload_backoff"`
+	// Hold off reloads for up to MaxReloadDelay while more than
+	// ReloadDelaySessions are open on the backends they change, as the
+	// Traffic stats have it. Zero doesn't wait. Backends whose sessions
+	// last LongLivedSession on average count as long-lived.
+	ReloadDelaySessions int           `toml:"reload_delay_sessions"`
+	MaxReloadDelay      time.Duration `toml:"max_reload_delay"`
+	LongLivedSession    time.Duration `toml:"long_lived_session"`
+	// Add and remove servers through the Runtime instead of reloading when
+	// nothing else in the config changed
+	RuntimeUpdates bool          `toml:"runtime_updates"`
+	Runtime        ServerRuntime `toml:"-"`
+	// Push the config through the Data Plane API instead of writing the
+	// ConfigFile and reloading, when it's set
+	DataPlane *DataPlane `toml:"-"`
+	// Optional collector of the traffic to each backend, for the API and
+	// the estimates of what a reload would cut
+	Traffic          *TrafficCollector `toml:"-"`
+	eventChannel     chan catalog.ChangeEvent
+	signalsHandled   bool
+	sigLock          sync.Mutex
+	sigStopChan      chan struct{}
+	configHash       string
+	lastConfig       []byte
+	hashLock         sync.RWMutex
+	exclusions       []Exclusion
+	exclusionsLock   sync.RWMutex
+	clientTables     map[string]string // The client rate stick-tables, with their service
+	clientTablesLock sync.RWMutex
+	warnings         map[string]ConfigWarning // By service/kind
+	warningsLock     sync.RWMutex
+	timeouts         []EffectiveTimeouts
+	timeoutsLock     sync.RWMutex
+	rendered         map[string]*service.Service // The instances last rendered, by server
+	draining         map[string]*drainingServer  // By server
+	drainingLock     sync.Mutex
+	parked           map[string]bool // Removed servers left in maintenance
+	runtimeLock      sync.Mutex
+	version          *Version        // The installed HAproxy, if we know it
+	warned           map[string]bool // The features we warned it's too old for
+	versionLock      sync.RWMutex
+	reloadStatus     ReloadStatus
+	reloadLock       sync.RWMutex
+	writeLock        sync.Mutex // Held while writing and reloading
+}
+
+// The defaults for backing off after failed reloads
+const (
+	DefaultReloadBackoff    = time.Second
+	DefaultMaxReloadBackoff = time.Minute
+)
+
+// A ReloadStatus is how the writes and reloads from Watch are going
+type ReloadStatus struct {
+	Failures    int           // Failures in a row, zero after a success
+	LastError   string        // The error from the most recent failure
+	LastFailure time.Time     // When the most recent failure was
+	Backoff     time.Duration // How long Watch waits before trying again
+	// The estimated impact of the last reload, with the traffic stats
+	Impact *ReloadImpact `json:",omitempty"`
 }
 
 // Constructs a properly configured HAProxy and returns a pointer to it
 func New(configFile string, pidFile string) *HAproxy {
 	reloadCmd := "haproxy -f " + configFile + " -p " + pidFile + " `[[ -f " + pidFile + " ]] && echo \"-sf $(cat " + pidFile + ")\"`"
-	verifyCmd := "haproxy -c -f " + configFile
+	verifyCmd := "haproxy -c -f " + ConfigFilePlaceholder
 
 	proxy := HAproxy{
-		ReloadCmd:  reloadCmd,
-		VerifyCmd:  verifyCmd,
-		Template:   "views/haproxy.cfg",
-		ConfigFile: configFile,
-		PidFile:    pidFile,
+		ReloadCmd:     reloadCmd,
+		VerifyCmd:     verifyCmd,
+		Binary:        "haproxy",
+		Template:      "views/haproxy.cfg",
+		ConfigFile:    configFile,
+		PidFile:       pidFile,
+		MaxConn:       4096,
+		LogTarget:     "127.0.0.1",
+		NoBackends:    NoBackendsMaintenance,
+		StatsSocket:   DefaultStatsSocket,
+		MemoryPerConn: DefaultMemoryPerConn,
+		MinServerConn: DefaultMinServerConn,
+		Clock:         clock.Real{},
+
+		ConnectTimeout: DefaultConnectTimeout,
+		ClientTimeout:  DefaultClientTimeout,
+		ServerTimeout:  DefaultServerTimeout,
+		Retries:        DefaultRetries,
+
+		ReloadBackoff:    DefaultReloadBackoff,
+		MaxReloadBackoff: DefaultMaxReloadBackoff,
 	}
 
 	return &proxy
 }
 
-// Returns a map of ServicePort:Port pairs
-func (h *HAproxy) makePortmap(services map[string][]*service.Service) portmap {
+// ParseNoBackendsOverrides parses entries of the form "service:mode" into a
+// map of service name to NoBackends mode
+func ParseNoBackendsOverrides(entries []string) (map[string]string, error) {
+	overrides := make(map[string]string, len(entries))
+
+	for _, entry := range entries {
+		fields := strings.SplitN(entry, ":", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("Error parsing no backends override '%s': expected service:mode", entry)
+		}
+
+		if !ValidNoBackendsMode(fields[1]) {
+			return nil, fmt.Errorf("Error parsing no backends override '%s': invalid mode '%s'", entry, fields[1])
+		}
+
+		overrides[fields[0]] = fields[1]
+	}
+
+	return overrides, nil
+}
+
+// ConfigFilePlaceholder stands for the config file to check in the
+// VerifyCmd. New configs are verified in a temp file before they replace
+// the ConfigFile, so the command has to say where the file's path goes.
+const ConfigFilePlaceholder = "{{.ConfigFile}}"
+
+// ValidVerifyCmd tells us whether the command has the placeholder for the
+// config file it should check
+func ValidVerifyCmd(command string) bool {
+	return strings.Contains(command, ConfigFilePlaceholder)
+}
+
+// ValidNoBackendsMode tells us whether mode is one we know how to render
+func ValidNoBackendsMode(mode string) bool {
+	return mode == NoBackendsRefuse || mode == NoBackendsMaintenance
+}
+
+// noBackendsFor returns the NoBackends mode for the named service
+func (h *HAproxy) noBackendsFor(svcName string) string {
+	if mode, ok := h.NoBackendsOverrides[svcName]; ok {
+		return mode
+	}
+
+	return h.NoBackends
+}
+
+// errorFilesIn returns the errorfiles present in dir, by status code. They
+// must be named after the status code, e.g. 503.http.
+func errorFilesIn(dir string) map[string]string {
+	files := make(map[string]string)
+
+	for _, code := range errorFileCodes {
+		file := path.Join(dir, code+".http")
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+			files[code] = file
+		}
+	}
+
+	return files
+}
+
+// Returns a map of ServicePort:Port pairs for the ports of a protocol, "tcp"
+// or "udp"
+func (h *HAproxy) makePortmap(services map[string][]*service.Service, protocol string) portmap {
 	ports := make(portmap)
 
 	for svcName, svcList := range services {
@@ -68,9 +341,9 @@ func (h *HAproxy) makePortmap(services map[string][]*service.Service) portmap {
 
 		for _, service := range svcList {
 			for _, port := range service.Ports {
-				// Currently only handle TCP, and we skip ports that aren't exported.
-				// That's the effect of not specifying a ServicePort.
-				if port.Type == "tcp" && port.ServicePort != 0 {
+				// We skip ports that aren't exported. That's the effect of
+				// not specifying a ServicePort.
+				if port.Type == protocol && port.ServicePort != 0 {
 					svcPort := strconv.FormatInt(port.ServicePort, 10)
 					internalPort := strconv.FormatInt(port.Port, 10)
 					ports[svcName][svcPort] = internalPort
@@ -88,26 +361,25 @@ func sanitizeName(image string) string {
 	return replace.ReplaceAllString(image, "-")
 }
 
-// Find a matching Port when given a ServicePort
-func findPortForService(svcPort string, svc *service.Service) string {
+// Find a matching Port when given a ServicePort, and optionally the
+// protocol. Without one, TCP ports are preferred.
+func findPortForService(svcPort string, svc *service.Service, protocol ...string) string {
 	matchPort, err := strconv.ParseInt(svcPort, 10, 64)
 	if err != nil {
 		log.Errorf("Invalid value from template ('%s') can't parse as int64: %s", svcPort, err.Error())
 		return "-1"
 	}
 
-	for _, port := range svc.Ports {
-		if port.ServicePort == matchPort {
-			internalPort := strconv.FormatInt(port.Port, 10)
-			return internalPort
-		}
+	if port := matchServicePort(matchPort, svc, protocol); port != nil {
+		return strconv.FormatInt(port.Port, 10)
 	}
 
 	return "-1"
 }
 
-// Find the matching IP address when given a ServicePort
-func (h *HAproxy) findIpForService(svcPort string, svc *service.Service) string {
+// Find the matching IP address when given a ServicePort, and optionally the
+// protocol
+func (h *HAproxy) findIpForService(svcPort string, svc *service.Service, protocol ...string) string {
 	// We can turn off using IP addresses in the config, which is sometimes
 	// necessary (e.g. w/Docker for Mac).
 	if h.UseHostnames {
@@ -120,10 +392,8 @@ func (h *HAproxy) findIpForService(svcPort string, svc *service.Service) string
 		return "-1"
 	}
 
-	for _, port := range svc.Ports {
-		if port.ServicePort == matchPort {
-			return port.IP
-		}
+	if port := matchServicePort(matchPort, svc, protocol); port != nil {
+		return port.IP
 	}
 
 	// This defaults to the previous behavior of templating the hostname
@@ -133,6 +403,84 @@ func (h *HAproxy) findIpForService(svcPort string, svc *service.Service) string
 	return svc.Hostname
 }
 
+// matchServicePort finds the port with a ServicePort. When the protocol is
+// given, it has to match. Otherwise a TCP port is preferred, so a UDP port
+// on the same number doesn't end up in a TCP backend.
+func matchServicePort(servicePort int64, svc *service.Service, protocol []string) *service.Port {
+	var fallback *service.Port
+	for i := range svc.Ports {
+		port := &svc.Ports[i]
+		if port.ServicePort != servicePort {
+			continue
+		}
+
+		switch {
+		case len(protocol) > 0:
+			if port.Type == protocol[0] {
+				return port
+			}
+		case port.Type == "tcp":
+			return port
+		case fallback == nil:
+			fallback = port
+		}
+	}
+
+	return fallback
+}
+
+// TemplateFuncs is the contract for the functions available to the HAproxy
+// template and overlays. Add new functions with the next minor version.
+var TemplateFuncs = &templating.Contract{
+	Version: templating.Version{Major: 1, Minor: 24},
+	Funcs: map[string]templating.Func{
+		"now":             {Since: templating.Version{Major: 1, Minor: 0}},
+		"getMode":         {Since: templating.Version{Major: 1, Minor: 0}},
+		"getPorts":        {Since: templating.Version{Major: 1, Minor: 0}},
+		"portFor":         {Since: templating.Version{Major: 1, Minor: 0}},
+		"ipFor":           {Since: templating.Version{Major: 1, Minor: 0}},
+		"bindIP":          {Since: templating.Version{Major: 1, Minor: 0}, Deprecated: "use bindsFor, which handles IPv6"},
+		"sanitizeName":    {Since: templating.Version{Major: 1, Minor: 0}},
+		"errorFilesFor":   {Since: templating.Version{Major: 1, Minor: 0}},
+		"serviceFor":      {Since: templating.Version{Major: 1, Minor: 0}},
+		"bindsFor":        {Since: templating.Version{Major: 1, Minor: 1}},
+		"secret":          {Since: templating.Version{Major: 1, Minor: 1}},
+		"certFor":         {Since: templating.Version{Major: 1, Minor: 2}},
+		"acmeChallenge":   {Since: templating.Version{Major: 1, Minor: 2}},
+		"pinsFor":         {Since: templating.Version{Major: 1, Minor: 3}},
+		"sourceRoutesFor": {Since: templating.Version{Major: 1, Minor: 4}},
+		"maxConnFor":      {Since: templating.Version{Major: 1, Minor: 5}},
+		"exclusionsFor":   {Since: templating.Version{Major: 1, Minor: 6}},
+		"haproxyVersion":  {Since: templating.Version{Major: 1, Minor: 7}},
+		"haproxyAtLeast":  {Since: templating.Version{Major: 1, Minor: 7}},
+		"getUDPPorts":     {Since: templating.Version{Major: 1, Minor: 8}},
+		"spoeAgent":       {Since: templating.Version{Major: 1, Minor: 9}},
+		"spoeFor":         {Since: templating.Version{Major: 1, Minor: 9}},
+		"virtualHosts":    {Since: templating.Version{Major: 1, Minor: 10}},
+		"pathPrefixesFor": {Since: templating.Version{Major: 1, Minor: 11}},
+		"clientRatesFor":  {Since: templating.Version{Major: 1, Minor: 12}},
+		"sniRoutes":       {Since: templating.Version{Major: 1, Minor: 13}},
+		"weightFor":       {Since: templating.Version{Major: 1, Minor: 14}},
+		"stickinessFor":   {Since: templating.Version{Major: 1, Minor: 15}},
+		"healthCheckFor":  {Since: templating.Version{Major: 1, Minor: 16}},
+		"timeoutsFor":     {Since: templating.Version{Major: 1, Minor: 17}},
+		"drainingFor":     {Since: templating.Version{Major: 1, Minor: 18}},
+		"meshIn":          {Since: templating.Version{Major: 1, Minor: 19}},
+		"meshFor":         {Since: templating.Version{Major: 1, Minor: 19}},
+		"hostPort":        {Since: templating.Version{Major: 1, Minor: 21}},
+		"isIPv6":          {Since: templating.Version{Major: 1, Minor: 21}},
+		"familyOptions":   {Since: templating.Version{Major: 1, Minor: 21}},
+		"callersFor":      {Since: templating.Version{Major: 1, Minor: 22}},
+		"filterByLabel":   {Since: templating.Version{Major: 1, Minor: 23}},
+		"groupByVersion":  {Since: templating.Version{Major: 1, Minor: 23}},
+		"healthyOnly":     {Since: templating.Version{Major: 1, Minor: 23}},
+		"metadata":        {Since: templating.Version{Major: 1, Minor: 23}},
+		"portNamed":       {Since: templating.Version{Major: 1, Minor: 23}},
+		"env":             {Since: templating.Version{Major: 1, Minor: 23}},
+		"mirrorFor":       {Since: templating.Version{Major: 1, Minor: 24}},
+	},
+}
+
 // Create an HAproxy config from the supplied ServicesState. Write it out to the
 // supplied io.Writer interface. This gets a list from servicesWithPorts() and
 // builds a list of unique ports for all services, then passes these to the
@@ -140,38 +488,269 @@ func (h *HAproxy) findIpForService(svcPort string, svc *service.Service) string
 func (h *HAproxy) WriteConfig(state *catalog.ServicesState, output io.Writer) error {
 
 	state.RLock()
-	services := servicesWithPorts(state)
-	ports := h.makePortmap(services)
+	splits := getTrafficSplits(state)
+	services, exclusions := servicesWithPorts(state, splits)
+	maintenance := h.servicesInMaintenance(state, services)
 	modes := getModes(state)
+	families := getFamilies(state)
+	interfaces := getBindInterfaces(state)
+	callers, callerWarnings := getAllowedCallers(state)
+	tlsCerts := getTLSCerts(state, h.ACMEResponder != "")
+	challenge := h.acmeChallenge(state)
+	sourceRoutes := getSourceRoutes(state)
+	decisions := getDecisions(state)
+	mirrorSettings, mirrorWarnings := getMirrors(state)
+	hosts := getVirtualHosts(state)
+	sniHosts := getSNIHosts(state)
+	stickiness := getStickiness(state)
+	healthChecks := getHealthChecks(state)
+	labelTimeouts, labelWarnings := getTimeouts(state)
+	stopped := stoppedServers(state)
+	hostname := state.Hostname
+	version := state.Version()
 	state.RUnlock()
 
+	// Services in maintenance get their ports from an unhealthy instance,
+	// but are rendered without any servers
+	portSources := make(map[string][]*service.Service, len(services)+len(maintenance))
+	for svcName, svcList := range services {
+		portSources[svcName] = svcList
+	}
+	for svcName, svcList := range maintenance {
+		portSources[svcName] = svcList
+		services[svcName] = []*service.Service{}
+	}
+
+	// Stopped instances drain in their backends for the DrainPeriod
+	draining := make(map[string]bool)
+	for _, svc := range h.drainStopped(stopped, services) {
+		if _, ok := portSources[svc.Name]; !ok {
+			portSources[svc.Name] = []*service.Service{svc}
+		}
+		services[svc.Name] = append(services[svc.Name], svc)
+		draining[svc.Hostname+"-"+svc.ID] = true
+	}
+	ports := h.makePortmap(portSources, "tcp")
+	udpPorts := h.makePortmap(portSources, "udp")
+
+	// Refuse to render frontends that HAproxy can't bind, or would send
+	// another service's connections to
+	binds, bindWarnings := h.serviceBinds(ports, families, interfaces)
+	if conflicts := h.portConflicts(ports, binds); len(conflicts) > 0 {
+		return &PortConflictError{Conflicts: conflicts}
+	}
+	mesh, err := h.meshIn(hostname, services, ports)
+	if err != nil {
+		return err
+	}
+
+	exclusions = h.recordExclusions(exclusions)
+	certPaths := make(map[string]string, len(ports))
+	for svcName := range ports {
+		if path := h.certPathFor(svcName, tlsCerts[svcName], modes[svcName]); path != "" {
+			certPaths[svcName] = path
+		}
+	}
+
+	h.clientTablesLock.Lock()
+	h.clientTables = h.clientRateTables(ports)
+	h.clientTablesLock.Unlock()
+	vhosts, vhostWarnings := h.virtualHosts(hosts, ports, modes, decisions, certPaths)
+	sni, sniWarnings := h.sniRoutes(sniHosts, ports, modes, certPaths)
+	weights, splitWarnings := splitWeights(services, splits)
+	sticky, stickyWarnings := h.stickiness(stickiness, ports, modes, binds)
+	mirrors, mirrorsForWarnings := h.mirrorsFor(mirrorSettings, ports, modes, binds, families, decisions)
+	warnings := append(configWarnings(services, ports, udpPorts, exclusions), vhostWarnings...)
+	warnings = append(warnings, sniWarnings...)
+	warnings = append(warnings, splitWarnings...)
+	warnings = append(warnings, stickyWarnings...)
+	warnings = append(warnings, bindWarnings...)
+	warnings = append(warnings, callerWarnings...)
+	warnings = append(warnings, mirrorWarnings...)
+	warnings = append(warnings, mirrorsForWarnings...)
+
+	fileTimeouts, fileWarnings := h.readTimeoutsFile()
+	svcNames := make([]string, 0, len(services))
+	for svcName := range services {
+		svcNames = append(svcNames, svcName)
+	}
+	effectiveTimeouts := h.resolveTimeouts(svcNames, labelTimeouts, fileTimeouts)
+	h.recordTimeouts(effectiveTimeouts)
+	serviceTimeouts := make(map[string]*templateTimeouts, len(effectiveTimeouts))
+	for _, effective := range effectiveTimeouts {
+		serviceTimeouts[effective.Service] = templateTimeoutsFor(effective)
+	}
+	warnings = append(warnings, labelWarnings...)
+	h.recordWarnings(append(warnings, fileWarnings...))
+
+	var errorFiles map[string]string
+	serviceErrorFiles := make(map[string]map[string]string)
+	if h.ErrorFilesDir != "" {
+		errorFiles = errorFilesIn(h.ErrorFilesDir)
+		for svcName := range services {
+			serviceErrorFiles[svcName] = errorFilesIn(path.Join(h.ErrorFilesDir, svcName))
+		}
+	}
+
 	data := struct {
-		Services map[string][]*service.Service
-		User     string
-		Group    string
+		Services    map[string][]*service.Service
+		User        string
+		Group       string
+		Chroot      string
+		MaxConn     int
+		NbThread    int
+		NbProc      int
+		CPUMap      []string
+		NoReusePort bool
+		LogTarget   string
+		RequestLogs bool
+		ErrorFiles  map[string]string
+		StatsSocket string
+		Timeouts    templateTimeouts
+		Version     uint64
 	}{
-		Services: services,
-		User:     h.User,
-		Group:    h.Group,
+		Services:    services,
+		User:        h.User,
+		Group:       h.Group,
+		Chroot:      h.Chroot,
+		MaxConn:     h.MaxConn,
+		NbThread:    h.NbThread,
+		NbProc:      h.NbProc,
+		CPUMap:      h.CPUMap,
+		NoReusePort: h.NoReusePort,
+		LogTarget:   h.LogTarget,
+		RequestLogs: h.RequestLogs,
+		ErrorFiles:  errorFiles,
+		StatsSocket: h.StatsSocket,
+		Timeouts:    h.defaultsSection(),
+		Version:     version,
 	}
 
+	http2 := h.HTTP2 && h.supports("HTTP/2", 1, 8)
+	agent := h.spoe()
+
 	funcMap := template.FuncMap{
-		"now": time.Now().UTC,
+		"now": func() time.Time { return clock.OrReal(h.Clock).Now().UTC() },
+		"haproxyVersion": func() string {
+			if version, ok := h.InstalledVersion(); ok {
+				return version.String()
+			}
+			return ""
+		},
+		"haproxyAtLeast": h.atLeast,
 		"getMode": func(k string) string {
 			return modes[k]
 		},
 		"getPorts": func(k string) map[string]string {
 			return ports[k]
 		},
-		"portFor":      findPortForService,
-		"ipFor":        h.findIpForService,
-		"bindIP":       func() string { return h.BindIP },
-		"sanitizeName": sanitizeName,
+		"getUDPPorts": func(k string) map[string]string {
+			return udpPorts[k]
+		},
+		"portFor": findPortForService,
+		"ipFor":   h.findIpForService,
+		"bindIP": func(name ...string) string {
+			if len(name) > 0 {
+				return h.BindInterfaces[strings.ToLower(name[0])]
+			}
+			return h.BindIP
+		},
+		"hostPort":      hostPort,
+		"isIPv6":        isIPv6,
+		"familyOptions": h.familyOptions,
+		"bindsFor": func(k string) []string {
+			if addresses, ok := binds[k]; ok {
+				return addresses
+			}
+			return h.bindAddresses(families[k])
+		},
+		"certFor": func(k string) string {
+			return certPaths[k]
+		},
+		"acmeChallenge": func() *acmeChallenge { return challenge },
+		"pinsFor": func(k string, services []*service.Service) []templatePin {
+			return h.pinsFor(k, modes[k], services)
+		},
+		"sourceRoutesFor": func(k string, svcPort string) []templateRoute {
+			return sourceRoutesFor(k, svcPort, sourceRoutes[k], ports, modes)
+		},
+		"maxConnFor": h.maxConnFor,
+		"weightFor": func(svc *service.Service) int {
+			if weight, ok := weights[svc.Hostname+"-"+svc.ID]; ok {
+				return weight
+			}
+			return weightFor(svc)
+		},
+		"drainingFor": func(svc *service.Service) bool {
+			return draining[svc.Hostname+"-"+svc.ID]
+		},
+		"meshIn": func() *templateMesh { return mesh },
+		"meshFor": func(svc *service.Service, svcPort string) *templateMeshServer {
+			return h.meshFor(hostname, svc, svcPort)
+		},
+		"spoeAgent": func() *templateSPOE { return agent },
+		"virtualHosts": func() *templateVirtualHosts {
+			return vhosts
+		},
+		"sniRoutes": func() *templateSNI {
+			return sni
+		},
+		"stickinessFor": func(k string) *templateStickiness {
+			return sticky[k]
+		},
+		"callersFor": func(k string) *templateCallers {
+			return callers[k]
+		},
+		"mirrorFor": func(k string, svcPort string) *templateMirror {
+			return mirrors[k][svcPort]
+		},
+		"timeoutsFor": func(k string) *templateTimeouts {
+			return serviceTimeouts[k]
+		},
+		"healthCheckFor": func(k string, svcPort string) *templateHealthCheck {
+			return h.healthCheckFor(healthChecks[k], svcPort)
+		},
+		"pathPrefixesFor": func(k string) []string {
+			return hosts[k].PathPrefixes
+		},
+		"clientRatesFor": func(k string) *templateClientRates {
+			return h.clientRatesFor(k, modes[k], binds[k])
+		},
+		"spoeFor": func(k string) *templateSPOE {
+			if !decisions[k] || modes[k] != "http" {
+				return nil
+			}
+			return agent
+		},
+		"exclusionsFor": func(k string, svcPort ...string) []Exclusion {
+			var port string
+			if len(svcPort) > 0 {
+				port = svcPort[0]
+			}
+			return h.exclusionsFor(k, port, exclusions)
+		},
+		"sanitizeName":   sanitizeName,
+		"secret":         secrets.TemplateFunc(h.Secrets),
+		"filterByLabel":  filterByLabel,
+		"groupByVersion": groupByVersion,
+		"healthyOnly":    healthyOnly,
+		"metadata":       metadataFor,
+		"portNamed":      portNamed,
+		"env":            envFor,
+		"errorFilesFor": func(k string) map[string]string {
+			return serviceErrorFiles[k]
+		},
+		"serviceFor": func(svcName string, svcPort string, services []*service.Service) *templateService {
+			templateSvc := serviceForPort(svcName, svcPort, services, h.RequestLogs)
+			templateSvc.BindOptions = h.BindOptions
+			templateSvc.HTTP2 = http2
+			return templateSvc
+		},
 	}
 
-	t, err := template.New("haproxy").Funcs(funcMap).ParseFiles(h.Template)
+	t, err := templating.ParseWithOverlay(h.Template, h.TemplateOverlay, TemplateFuncs, funcMap)
 	if err != nil {
-		return fmt.Errorf("Error Parsing template '%s': %s", h.Template, err.Error())
+		return err
 	}
 
 	// We write into a buffer so disk IO doesn't hold up the whole state lock
@@ -192,6 +771,50 @@ func (h *HAproxy) WriteConfig(state *catalog.ServicesState, output io.Writer) er
 	return nil
 }
 
+// A templateService is passed to the per-service blocks in the template
+type templateService struct {
+	Name        string
+	Port        string
+	PortName    string
+	Services    []*service.Service
+	RequestLogs bool
+	BindOptions string
+	HTTP2       bool
+}
+
+// serviceForPort returns the templateService for one port of a service. The
+// instances whose own check on that port is failing are left out of it.
+func serviceForPort(svcName string, svcPort string, services []*service.Service,
+	requestLogs bool) *templateService {
+
+	templateSvc := &templateService{
+		Name:        svcName,
+		Port:        svcPort,
+		Services:    services,
+		RequestLogs: requestLogs,
+	}
+
+	matchPort, err := strconv.ParseInt(svcPort, 10, 64)
+	if err != nil {
+		return templateSvc
+	}
+
+	alive := make([]*service.Service, 0, len(services))
+	for _, svc := range services {
+		for _, port := range svc.Ports {
+			if port.ServicePort == matchPort && port.Name != "" && templateSvc.PortName == "" {
+				templateSvc.PortName = port.Name
+			}
+		}
+		if svc.PortAlive(matchPort) {
+			alive = append(alive, svc)
+		}
+	}
+	templateSvc.Services = alive
+
+	return templateSvc
+}
+
 // notifySignals swallows a bunch of signals that get sent to us when running into
 // an error from HAproxy. If we didn't swallow these, the process would potentially
 // stop when the signals are propagated by the sub-shell.
@@ -270,22 +893,103 @@ func (h *HAproxy) Reload() error {
 // the current config. Used to gate a Reload() so we don't load a bad
 // config and tear everything down.
 func (h *HAproxy) Verify() error {
-	return h.run(h.VerifyCmd)
+	return h.VerifyFile(h.ConfigFile)
+}
+
+// VerifyFile runs the verify command against a config file, with its path
+// in place of the ConfigFilePlaceholder. A command without the placeholder
+// would check some other file, so it's an error.
+func (h *HAproxy) VerifyFile(path string) error {
+	if !ValidVerifyCmd(h.VerifyCmd) {
+		return fmt.Errorf("The verify command '%s' has no %s for the config file", h.VerifyCmd, ConfigFilePlaceholder)
+	}
+	return h.run(strings.Replace(h.VerifyCmd, ConfigFilePlaceholder, path, -1))
+}
+
+// A VerifyError is returned by InstallConfig when the new config fails
+// verification, and the old one was left in place
+type VerifyError struct {
+	Err error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("Failed to verify HAproxy config! (%s)", e.Err)
+}
+
+// InstallConfig replaces the ConfigFile with a rendered config. It's
+// written to a temp file next to it first, verified there when verify is
+// set, and then renamed into place, so HAproxy never sees a partial or
+// broken config.
+func (h *HAproxy) InstallConfig(config []byte, verify bool) error {
+	if h.ConfigFile == "" {
+		return fmt.Errorf("Trying to write HAproxy config, but no filename specified!")
+	}
+
+	tmpfile, err := ioutil.TempFile(path.Dir(h.ConfigFile), "."+path.Base(h.ConfigFile)+".")
+	if err != nil {
+		return fmt.Errorf("Unable to write to %s! (%s)", h.ConfigFile, err.Error())
+	}
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.Write(config)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpfile.Name(), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write to %s! (%s)", tmpfile.Name(), err.Error())
+	}
+
+	if verify {
+		if err := h.VerifyFile(tmpfile.Name()); err != nil {
+			return &VerifyError{Err: err}
+		}
+	}
+
+	if err := os.Rename(tmpfile.Name(), h.ConfigFile); err != nil {
+		return fmt.Errorf("Unable to write to %s! (%s)", h.ConfigFile, err.Error())
+	}
+
+	return nil
 }
 
 // Watch the state of a ServicesState struct and generate a new proxy
 // config file (haproxy.ConfigFile) when the state changes. Also notifies
 // the service that it needs to reload once the new file has been written
-// and verified.
+// and verified. With a ReloadDebounce, the changes that follow one within
+// it are written with the same reload. When the write and reload fails, it
+// backs off before trying again, taking the changes that arrive meanwhile.
 func (h *HAproxy) Watch(state *catalog.ServicesState) {
 	h.eventChannel = make(chan catalog.ChangeEvent, 2)
 	state.AddListener(h)
 
-	for event := range h.eventChannel {
-		log.Println("State change event from " + event.Service.Hostname)
-		err := h.WriteAndReload(state)
-		if err != nil {
-			log.Error(err.Error())
+Watching:
+	for {
+		select {
+		case event, ok := <-h.eventChannel:
+			if !ok {
+				break Watching
+			}
+			log.Printf("State change event from %s (version %d)", event.Service.Hostname, event.Version)
+		case <-h.drainEnded():
+			log.Info("Removing the servers that are done draining")
+		}
+
+		if h.ReloadDebounce > 0 {
+			if coalesced := h.debounce(); coalesced > 0 {
+				log.Infof("Writing %d more state changes with the same HAproxy reload", coalesced)
+				metrics.IncrCounter([]string{"haproxy", "coalesced_changes"}, float32(coalesced))
+			}
+		}
+
+		if !h.waitForSessions(state) {
+			break Watching
+		}
+
+		if !h.writeWithBackoff(state) {
+			break Watching
 		}
 	}
 
@@ -295,29 +999,268 @@ func (h *HAproxy) Watch(state *catalog.ServicesState) {
 	}
 }
 
-// Write out the the HAproxy config and reload the service.
-func (h *HAproxy) WriteAndReload(state *catalog.ServicesState) error {
-	if h.ConfigFile == "" {
-		return fmt.Errorf("Trying to write HAproxy config, but no filename specified!")
+// writeWithBackoff writes and reloads until it works, waiting longer after
+// each failure. It returns false if the channel was closed while waiting.
+func (h *HAproxy) writeWithBackoff(state *catalog.ServicesState) bool {
+	for {
+		err := h.WriteAndReload(state)
+		backoff := h.recordReload(err)
+		if err == nil {
+			return true
+		}
+
+		log.Error(err.Error())
+		if backoff <= 0 {
+			return true
+		}
+
+		log.Warnf("Trying the HAproxy reload again in %s", backoff)
+		skipped, open := h.drain(backoff)
+		if !open {
+			return false
+		}
+		if skipped > 0 {
+			log.Infof("Writing %d state changes from the backoff with the next HAproxy reload", skipped)
+		}
 	}
+}
+
+// debounce takes the events that arrive within the ReloadDebounce, so they
+// don't each cause a reload, and returns how many there were. It stops
+// early if the channel is closed.
+func (h *HAproxy) debounce() int {
+	count, _ := h.drain(h.ReloadDebounce)
+	return count
+}
+
+// drain takes the events that arrive within a duration, and returns how
+// many there were. It returns false early if the channel is closed.
+func (h *HAproxy) drain(duration time.Duration) (int, bool) {
+	window := clock.OrReal(h.Clock).After(duration)
+
+	var count int
+	for {
+		select {
+		case event, ok := <-h.eventChannel:
+			if !ok {
+				return count, false
+			}
+			log.Debugf("State change event from %s (version %d)", event.Service.Hostname, event.Version)
+			count++
+		case <-window:
+			return count, true
+		}
+	}
+}
+
+// recordReload keeps the outcome of a write and reload in the ReloadStatus,
+// and returns how long to back off for before the next one
+func (h *HAproxy) recordReload(err error) time.Duration {
+	h.reloadLock.Lock()
+	defer h.reloadLock.Unlock()
+
+	if err == nil {
+		h.reloadStatus.Failures = 0
+		h.reloadStatus.Backoff = 0
+		metrics.SetGauge([]string{"haproxy", "reload_failures_in_a_row"}, 0)
+		return 0
+	}
+
+	h.reloadStatus.Failures++
+	h.reloadStatus.LastError = err.Error()
+	h.reloadStatus.LastFailure = clock.OrReal(h.Clock).Now().UTC()
+	h.reloadStatus.Backoff = h.backoffFor(h.reloadStatus.Failures)
+
+	metrics.IncrCounter([]string{"haproxy", "reload_failures"}, 1)
+	metrics.SetGauge([]string{"haproxy", "reload_failures_in_a_row"}, float32(h.reloadStatus.Failures))
+	h.publishReload("ReloadFailed", fmt.Sprintf("Failed to write and reload the HAproxy config %d times in a row: %s",
+		h.reloadStatus.Failures, err))
+
+	return h.reloadStatus.Backoff
+}
 
-	outfile, err := os.Create(h.ConfigFile)
+// backoffFor returns the ReloadBackoff doubled for each failure in a row
+// after the first, up to the MaxReloadBackoff
+func (h *HAproxy) backoffFor(failures int) time.Duration {
+	backoff := h.ReloadBackoff
+	if backoff <= 0 {
+		return 0
+	}
+
+	for i := 1; i < failures; i++ {
+		backoff *= 2
+		if h.MaxReloadBackoff > 0 && backoff >= h.MaxReloadBackoff {
+			return h.MaxReloadBackoff
+		}
+	}
+
+	if h.MaxReloadBackoff > 0 && backoff > h.MaxReloadBackoff {
+		return h.MaxReloadBackoff
+	}
+
+	return backoff
+}
+
+// publishReload publishes an event about a reload, when there's a bus
+func (h *HAproxy) publishReload(eventType string, message string) {
+	if h.Events == nil {
+		return
+	}
+
+	h.Events.Publish(events.Event{
+		Time:    clock.OrReal(h.Clock).Now().UTC(),
+		Type:    eventType,
+		Source:  "haproxy",
+		Subject: h.ConfigFile,
+		Message: message,
+	})
+}
+
+// ReloadStatus returns how the writes and reloads from Watch are going
+func (h *HAproxy) ReloadStatus() ReloadStatus {
+	h.reloadLock.RLock()
+	defer h.reloadLock.RUnlock()
+
+	return h.reloadStatus
+}
+
+// RenderConfig renders the HAproxy config for the state, and tells us
+// whether it differs from the one HAproxy last loaded
+func (h *HAproxy) RenderConfig(state *catalog.ServicesState) ([]byte, bool, error) {
+	var rendered bytes.Buffer
+	if err := h.WriteConfig(state, &rendered); err != nil {
+		return nil, false, err
+	}
+
+	return rendered.Bytes(), HashConfig(rendered.Bytes()) != h.ConfigHash(), nil
+}
+
+// Write out the the HAproxy config and reload the service. Nothing is
+// written when the rendered config is the same as the one already loaded,
+// e.g. when only metadata the template doesn't use changed.
+func (h *HAproxy) WriteAndReload(state *catalog.ServicesState) error {
+	return h.writeAndReload(state, false)
+}
+
+// ForceWriteAndReload writes out the config and reloads HAproxy even when
+// the config didn't change. Used when something outside of it did, like the
+// certificates or the HAproxy binary.
+func (h *HAproxy) ForceWriteAndReload(state *catalog.ServicesState) error {
+	return h.writeAndReload(state, true)
+}
+
+// writeAndReload does the work of both. Watch, the startup, the pins, the
+// certificates, and the version check all call it, so it takes one at a
+// time, and they don't write over each other's temp file or reload.
+func (h *HAproxy) writeAndReload(state *catalog.ServicesState, force bool) error {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	rendered, changed, err := h.RenderConfig(state)
 	if err != nil {
-		return fmt.Errorf("Unable to write to %s! (%s)", h.ConfigFile, err.Error())
+		return err
+	}
+
+	if !changed && !force {
+		log.Debug("HAproxy config is unchanged, skipping the reload")
+		metrics.IncrCounter([]string{"haproxy", "skipped_reloads"}, 1)
+		return nil
+	}
+
+	if h.DataPlane != nil {
+		return h.pushToDataPlane(rendered)
+	}
+
+	if err := verifyCerts(rendered); err != nil {
+		return err
 	}
 
-	if err := h.WriteConfig(state, outfile); err != nil {
+	if err := h.InstallConfig(rendered, true); err != nil {
 		return err
 	}
 
-	if err = h.Verify(); err != nil {
-		return fmt.Errorf("Failed to verify HAproxy config! (%s)", err.Error())
+	if !h.RuntimeUpdates || !h.applyAtRuntime(rendered) {
+		if err := h.Reload(); err != nil {
+			return err
+		}
+		metrics.IncrCounter([]string{"haproxy", "reloads"}, 1)
+		h.publishReload("Reloaded", "Reloaded HAproxy with a new config")
+
+		h.runtimeLock.Lock()
+		h.parked = nil
+		h.runtimeLock.Unlock()
 	}
 
-	return h.Reload()
+	h.hashLock.Lock()
+	h.configHash = HashConfig(rendered)
+	h.lastConfig = rendered
+	h.hashLock.Unlock()
+
+	return nil
 }
 
-// Name is part of the catalog.Listener interface. Returns the listener name.
+// pushToDataPlane hands the rendered config to the DataPlane, which makes
+// the changes from the last one it was given
+func (h *HAproxy) pushToDataPlane(rendered []byte) error {
+	h.hashLock.RLock()
+	previous := h.lastConfig
+	h.hashLock.RUnlock()
+
+	if err := h.DataPlane.Push(previous, rendered); err != nil {
+		return err
+	}
+
+	h.hashLock.Lock()
+	h.configHash = HashConfig(rendered)
+	h.lastConfig = rendered
+	h.hashLock.Unlock()
+
+	return nil
+}
+
+// ConfigHash returns a hash of the config HAproxy last loaded, or an empty
+// string if it hasn't loaded one yet
+func (h *HAproxy) ConfigHash() string {
+	h.hashLock.RLock()
+	defer h.hashLock.RUnlock()
+
+	return h.configHash
+}
+
+// LoadedConfig returns the config HAproxy last loaded, or nil if it hasn't
+// loaded one yet
+func (h *HAproxy) LoadedConfig() []byte {
+	h.hashLock.RLock()
+	defer h.hashLock.RUnlock()
+
+	return h.lastConfig
+}
+
+// AdoptConfig takes the config another Sidecar had HAproxy load as the one
+// it last loaded, so it isn't reloaded until the config changes
+func (h *HAproxy) AdoptConfig(config []byte) {
+	h.hashLock.Lock()
+	defer h.hashLock.Unlock()
+
+	h.configHash = HashConfig(config)
+	h.lastConfig = config
+}
+
+// HashConfig hashes a rendered config, leaving out the comments. They carry
+// the state version, which is different on every host.
+func HashConfig(config []byte) string {
+	hash := sha1.New()
+	for _, line := range bytes.SplitAfter(config, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			continue
+		}
+		hash.Write(line)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Name is part of the catalog.Listener and catalog.Proxy interfaces. Returns the listener name.
 func (h *HAproxy) Name() string {
 	return "HAproxy"
 }
@@ -348,51 +1291,350 @@ func getModes(state *catalog.ServicesState) map[string]string {
 	return modeMap
 }
 
+// getFamilies returns the address family each service is restricted to, if
+// any, taken from the most recently updated instance
+func getFamilies(state *catalog.ServicesState) map[string]string {
+	return newestSetting(state, func(svc *service.Service) string { return svc.IPFamily })
+}
+
+func getTLSCerts(state *catalog.ServicesState, issueForHostnames bool) map[string]string {
+	return newestSetting(state, func(svc *service.Service) string {
+		return certs.NameFor(svc, issueForHostnames)
+	})
+}
+
+// getSourceRoutes returns the source routes each service declares, taken
+// from the most recently updated instance
+func getSourceRoutes(state *catalog.ServicesState) map[string][]service.SourceRoute {
+	routes := make(map[string][]service.SourceRoute)
+	for svcName, value := range newestSetting(state, func(svc *service.Service) string {
+		return svc.Metadata[service.SourceRoutesKey]
+	}) {
+		routes[svcName], _ = service.ParseSourceRoutes(value)
+	}
+	return routes
+}
+
+// A templateRoute sends the clients from some networks to another backend
+type templateRoute struct {
+	ACL     string
+	Sources []string
+	Backend string
+}
+
+// sourceRoutesFor returns the source routes for the frontend of a service
+// on a port, grouped by the backend they go to. Routes to services that
+// don't have that backend, or that are in a different mode, are left out so
+// the clients go to the default backend.
+func sourceRoutesFor(name string, svcPort string, routes []service.SourceRoute,
+	ports portmap, modes map[string]string) []templateRoute {
+
+	var result []templateRoute
+	byBackend := make(map[string]int)
+	for _, route := range routes {
+		port := svcPort
+		if route.Port != 0 {
+			port = strconv.FormatInt(route.Port, 10)
+		}
+		if route.Service == name && port == svcPort {
+			continue
+		}
+		if _, ok := ports[route.Service][port]; !ok || modes[route.Service] != modes[name] {
+			continue
+		}
+
+		backend := sanitizeName(route.Service) + "-" + port
+		i, ok := byBackend[backend]
+		if !ok {
+			result = append(result, templateRoute{ACL: "src_" + backend, Backend: backend})
+			i = len(result) - 1
+			byBackend[backend] = i
+		}
+		result[i].Sources = append(result[i].Sources, route.Source)
+	}
+
+	return result
+}
+
+// A templatePin is an affinity pin as the backend template renders it
+type templatePin struct {
+	ID        string
+	Criterion string // What the ACL matches the client on
+	Server    string
+}
+
+// pinsFor returns the pins for the backend of a service. Pins to instances
+// that aren't in the backend are left out, and so are cookie pins unless
+// the backend is in HTTP mode.
+func (h *HAproxy) pinsFor(name string, mode string, services []*service.Service) []templatePin {
+	if h.Pins == nil {
+		return nil
+	}
+
+	servers := make(map[string]string, len(services))
+	for _, svc := range services {
+		servers[svc.ID] = svc.Hostname + "-" + svc.ID
+	}
+
+	var pins []templatePin
+	for _, pin := range h.Pins.ForService(name) {
+		server, ok := servers[pin.ServerID]
+		if !ok {
+			continue
+		}
+
+		var criterion string
+		switch {
+		case pin.Source != "":
+			criterion = "src " + pin.Source
+		case mode == "http":
+			criterion = "req.cook(" + affinity.CookieName + ") -m str " + pin.Cookie
+		default:
+			continue
+		}
+
+		pins = append(pins, templatePin{ID: pin.ID, Criterion: criterion, Server: server})
+	}
+
+	return pins
+}
+
+// The ACME challenge frontend, when certificates are being issued
+type acmeChallenge struct {
+	Bind      string
+	Responder string
+	Hostnames []string
+}
+
+// acmeChallenge returns what the template needs to route the HTTP-01
+// challenges for the public hostnames of the alive services to the ACME
+// responder. Returns nil when there is nothing to route.
+func (h *HAproxy) acmeChallenge(state *catalog.ServicesState) *acmeChallenge {
+	if h.ACMEResponder == "" || h.ACMEBind == "" {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var hostnames []string
+	state.EachServiceMerged(func(hostname *string, serviceId *string, svc *service.Service) {
+		if !svc.IsAlive() {
+			return
+		}
+		for _, publicName := range svc.PublicHostnames {
+			if !seen[publicName] {
+				seen[publicName] = true
+				hostnames = append(hostnames, publicName)
+			}
+		}
+	})
+
+	if len(hostnames) < 1 {
+		return nil
+	}
+	sort.Strings(hostnames)
+
+	return &acmeChallenge{Bind: h.ACMEBind, Responder: h.ACMEResponder, Hostnames: hostnames}
+}
+
+// newestSetting returns a setting for each service name, taken from its most
+// recently updated instance
+func newestSetting(state *catalog.ServicesState, setting func(*service.Service) string) map[string]string {
+	settingMap := make(map[string]string)
+	updated := make(map[string]time.Time)
+	state.EachService(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			if svc.Updated.Before(updated[svc.Name]) {
+				return
+			}
+			settingMap[svc.Name] = setting(svc)
+			updated[svc.Name] = svc.Updated
+		},
+	)
+	return settingMap
+}
+
+// newestMetadata returns the values of the Metadata keys for each service,
+// taken from the most recently updated instance
+func newestMetadata(state *catalog.ServicesState, keys ...string) map[string]map[string]string {
+	settings := make(map[string]map[string]string)
+	for _, key := range keys {
+		key := key
+		for svcName, value := range newestSetting(state, func(svc *service.Service) string {
+			return svc.Metadata[key]
+		}) {
+			if settings[svcName] == nil {
+				settings[svcName] = make(map[string]string)
+			}
+			settings[svcName][key] = value
+		}
+	}
+	return settings
+}
+
+// certFor returns the path of the certificate a frontend terminates TLS
+// with, or an empty string when it doesn't. The certificate has to be in
+// the CertDir already, so a frontend is never rendered with a missing one.
+func (h *HAproxy) certFor(name string) string {
+	if h.CertDir == "" || name == "" {
+		return ""
+	}
+
+	path := certs.Path(h.CertDir, name)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+
+	return path
+}
+
+// maxConnFor returns the maxconn for a server, or 0 to leave it unlimited.
+// It's never over the global MaxConn, which a container without a memory
+// limit would otherwise reach, since it reports all of the host's memory.
+func (h *HAproxy) maxConnFor(svc *service.Service) int {
+	if !h.ConnLimits {
+		return 0
+	}
+
+	limit, _ := svc.ConnectionLimit(h.MemoryPerConn, h.MinServerConn)
+	if h.MaxConn > 0 && limit > h.MaxConn {
+		limit = h.MaxConn
+	}
+
+	return limit
+}
+
+// weightFor returns the weight of a server, or 0 to leave it at HAproxy's
+// default. Weights out of range, e.g. from a peer that didn't check them,
+// are left out.
+func weightFor(svc *service.Service) int {
+	if svc.Weight < 1 || svc.Weight > service.MaxWeight {
+		return 0
+	}
+
+	return svc.Weight
+}
+
+// bindAddresses returns the addresses a frontend binds to, one for each
+// address family that is configured. When both are, a service may be
+// restricted to just one of them.
+func (h *HAproxy) bindAddresses(family string) []string {
+	var addresses []string
+
+	if h.BindIP != "" && (family != service.IPFamilyV6 || h.BindIPv6 == "") {
+		addresses = append(addresses, h.BindIP)
+	}
+
+	if h.BindIPv6 != "" && (family != service.IPFamilyV4 || h.BindIP == "") {
+		addresses = append(addresses, "["+h.BindIPv6+"]")
+	}
+
+	return addresses
+}
+
 // Like state.ByService() but only stores information for services which
 // actually have public ports. Only matches services that have the same name
-// and the same ports. Otherwise log an error.
-func servicesWithPorts(state *catalog.ServicesState) map[string][]*service.Service {
-	serviceMap := make(map[string][]*service.Service)
+// and the same ports. Otherwise log an error. A service with a traffic split
+// only gets the instances of the versions that have a share of it. The
+// instances that are left out are returned as Exclusions.
+func servicesWithPorts(state *catalog.ServicesState,
+	splits map[string][]service.VersionShare) (map[string][]*service.Service, []Exclusion) {
 
-	state.EachService(
+	candidates := make(map[string][]*service.Service)
+	var exclusions []Exclusion
+
+	state.EachServiceMerged(
 		func(hostname *string, serviceId *string, svc *service.Service) {
-			if len(svc.Ports) < 1 {
+			if svc.IsTombstone() {
 				return
 			}
 
-			// We only want things that are alive and healthy!
-			if !svc.IsAlive() {
+			if len(svc.Ports) < 1 {
+				exclusions = append(exclusions, newExclusion(svc, ExcludedNoPorts, ""))
 				return
 			}
 
-			// If this is the first one, just set it
-			if _, ok := serviceMap[svc.Name]; !ok {
-				serviceMap[svc.Name] = []*service.Service{svc}
+			// We only want things that are alive and healthy!
+			if exclusion, ok := statusExclusion(svc); ok {
+				exclusions = append(exclusions, exclusion)
 				return
 			}
 
-			// Otherwise we need to make sure the ServicePorts match
-			match := serviceMap[svc.Name][0] // Get the first entry for comparison
+			candidates[svc.Name] = append(candidates[svc.Name], svc)
+		},
+	)
+
+	serviceMap := make(map[string][]*service.Service, len(candidates))
+	for svcName, instances := range candidates {
+		instances, excluded := splitInstances(instances, splits[svcName])
+		exclusions = append(exclusions, excluded...)
 
-			// Build up a sorted list of ServicePorts from the existing service
-			portsToMatch := getSortedServicePorts(match)
+		// The first instance sets the ServicePorts, which for a split service
+		// is one of the version with the largest share. Ports failing their
+		// own checks are left out when the backends are rendered, but the
+		// instance stays for the others.
+		match := instances[0]
+		portsToMatch := getSortedServicePorts(match)
 
-			// Get the list of our ports
+	next:
+		for _, svc := range instances {
 			portsWeHave := getSortedServicePorts(svc)
 
 			// Compare the two sorted lists
 			for i, port := range portsToMatch {
-				if portsWeHave[i] != port {
+				if i >= len(portsWeHave) || portsWeHave[i] != port {
 					// TODO should we just add another service with this port added
 					// to the name? We have to find out which port.
-					log.Warnf("%s service from %s not added: non-matching ports! (%v vs %v)",
-						svc.Name, svc.Hostname, port, portsWeHave[i])
-					return
+					log.Debugf("%s service from %s not added: non-matching ports! (%v vs %v)",
+						svc.Name, svc.Hostname, portsToMatch, portsWeHave)
+					exclusions = append(exclusions, portMismatchExclusion(svc, match))
+					continue next
 				}
 			}
 
 			// It was a match! Append to the list.
-			serviceMap[svc.Name] = append(serviceMap[svc.Name], svc)
+			serviceMap[svcName] = append(serviceMap[svcName], svc)
+			exclusions = append(exclusions, portExclusions(svc)...)
+		}
+	}
+
+	sortExclusions(exclusions)
+
+	// The same state has to render the same config, or every write
+	// would look like a change
+	for _, instances := range serviceMap {
+		sort.Slice(instances, func(i, j int) bool {
+			if instances[i].Hostname != instances[j].Hostname {
+				return instances[i].Hostname < instances[j].Hostname
+			}
+			return instances[i].ID < instances[j].ID
+		})
+	}
+
+	return serviceMap, exclusions
+}
+
+// servicesInMaintenance finds the services in maintenance mode that have no
+// healthy instances, and returns the most recently updated instance of each,
+// so that we know which ports to keep listening on.
+func (h *HAproxy) servicesInMaintenance(state *catalog.ServicesState,
+	healthy map[string][]*service.Service) map[string][]*service.Service {
+
+	serviceMap := make(map[string][]*service.Service)
+
+	state.EachServiceMerged(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			if len(svc.Ports) < 1 || len(healthy[svc.Name]) > 0 {
+				return
+			}
+
+			if h.noBackendsFor(svc.Name) != NoBackendsMaintenance {
+				return
+			}
+
+			existing, ok := serviceMap[svc.Name]
+			if !ok || svc.Updated.After(existing[0].Updated) {
+				serviceMap[svc.Name] = []*service.Service{svc}
+			}
 		},
 	)
 
@@ -2,14 +2,23 @@ package haproxy
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/NinesStack/sidecar/affinity"
 	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/certs"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/secrets"
 	"github.com/NinesStack/sidecar/service"
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
@@ -44,6 +53,9 @@ func Test_HAproxy(t *testing.T) {
 			{Type: "tcp", Port: 32763, ServicePort: 8080, IP: ip3},
 			{Type: "tcp", Port: 10020, ServicePort: 9000, IP: ip3},
 		}
+		ports4 := []service.Port{
+			{Type: "tcp", Port: 32764, ServicePort: 8081, IP: ip3},
+		}
 
 		services := []service.Service{
 			{
@@ -89,7 +101,7 @@ func Test_HAproxy(t *testing.T) {
 				Hostname:  hostname2,
 				Updated:   baseTime.Add(5 * time.Second),
 				ProxyMode: "ws",
-				Ports:     ports3,
+				Ports:     ports4,
 			},
 		}
 
@@ -106,12 +118,13 @@ func Test_HAproxy(t *testing.T) {
 		Convey("New() returns a properly configured struct", func() {
 			p := New("tmpConfig", "tmpPid")
 			So([]byte(p.ReloadCmd), ShouldMatch, "^haproxy .*")
-			So([]byte(p.VerifyCmd), ShouldMatch, "^haproxy .*")
+			So(p.VerifyCmd, ShouldEqual, "haproxy -c -f "+ConfigFilePlaceholder)
 			So([]byte(p.Template), ShouldMatch, "views/haproxy.cfg")
+			So(p, ShouldImplement, (*catalog.Proxy)(nil))
 		})
 
 		Convey("makePortmap() generates a properly formatted list", func() {
-			result := proxy.makePortmap(state.ByService())
+			result := proxy.makePortmap(state.ByService(), "tcp")
 
 			So(len(result), ShouldEqual, 3)
 			So(len(result[services[0].Image]), ShouldEqual, 2)
@@ -143,6 +156,42 @@ func Test_HAproxy(t *testing.T) {
 			So(result, ShouldEqual, "127.0.0.1")
 		})
 
+		Convey("makePortmap() and the port functions handle UDP ports", func() {
+			dns := service.Service{
+				ID:       "deadbeef053",
+				Name:     "dns",
+				Hostname: hostname1,
+				Updated:  baseTime.Add(5 * time.Second),
+				Ports: []service.Port{
+					{Type: "udp", Port: 10053, ServicePort: 53, IP: ip},
+					{Type: "tcp", Port: 20053, ServicePort: 53, IP: ip3},
+				},
+			}
+			state.AddServiceEntry(dns)
+
+			So(proxy.makePortmap(state.ByService(), "udp")["dns"], ShouldResemble, portset{"53": "10053"})
+			So(proxy.makePortmap(state.ByService(), "tcp")["dns"], ShouldResemble, portset{"53": "20053"})
+
+			So(findPortForService("53", &dns), ShouldEqual, "20053")
+			So(findPortForService("53", &dns, "udp"), ShouldEqual, "10053")
+			So(proxy.findIpForService("53", &dns), ShouldEqual, ip3)
+			So(proxy.findIpForService("53", &dns, "udp"), ShouldEqual, ip)
+
+			Convey("and getUDPPorts gives them to the template", func() {
+				tmpDir, _ := ioutil.TempDir("", "sidecar-test")
+				defer os.RemoveAll(tmpDir)
+				proxy.Template = tmpDir + "/udp.cfg"
+				ioutil.WriteFile(proxy.Template, []byte(`{{ range $svcName, $services := .Services }}`+
+					`{{ range $svcPort, $port := getUDPPorts $svcName }}{{ range $services }}`+
+					`udp {{ $svcName }} {{ ipFor $svcPort . "udp" }}:{{ portFor $svcPort . "udp" }}
+{{ end }}{{ end }}{{ end }}`), 0644)
+
+				buf := bytes.NewBuffer(make([]byte, 0, 2048))
+				So(proxy.WriteConfig(state, buf), ShouldBeNil)
+				So(buf.String(), ShouldEqual, "udp dns 127.0.0.1:10053\n")
+			})
+		})
+
 		Convey("servicesWithPorts() groups services by name and port", func() {
 			badSvc := service.Service{
 				ID:       "0000bad00000",
@@ -156,14 +205,116 @@ func Test_HAproxy(t *testing.T) {
 			}
 
 			// It had 1 before
-			svcList := servicesWithPorts(state)
+			svcList, _ := servicesWithPorts(state, nil)
 			So(len(svcList[badSvc.Name]), ShouldEqual, 1)
 
 			// We add an entry with mismatching ports and should get no more added
 			state.AddServiceEntry(badSvc)
 
-			svcList = servicesWithPorts(state)
+			svcList, exclusions := servicesWithPorts(state, nil)
 			So(len(svcList[badSvc.Name]), ShouldEqual, 1)
+
+			// Whichever came second is left out
+			var mismatched []Exclusion
+			for _, exclusion := range exclusions {
+				if exclusion.Reason == ExcludedPortMismatch {
+					mismatched = append(mismatched, exclusion)
+				}
+			}
+			So(len(mismatched), ShouldEqual, 1)
+			So(mismatched[0].Service, ShouldEqual, "some-svc")
+			So(mismatched[0].Detail, ShouldContainSubstring, "6666")
+		})
+
+		Convey("WriteConfig() records the instances it leaves out, and why", func() {
+			sick := services[1]
+			sick.Updated = baseTime.Add(10 * time.Second)
+			sick.Status = service.UNHEALTHY
+			state.AddServiceEntry(sick)
+
+			firstSeen := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+			fakeClock := clock.NewFake(firstSeen)
+			proxy.Clock = fakeClock
+			proxy.Events = events.NewBus(10)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(proxy.Exclusions(), ShouldResemble, []Exclusion{
+				{Service: "awesome-svc", Hostname: hostname2, ID: svcId2, Server: "indefatigable-deadbeef101", Reason: ExcludedCheckFailed, Since: firstSeen},
+				{Service: "some-svc", Hostname: hostname2, ID: svcId4, Server: "indefatigable-deadbeef999", Reason: ExcludedNoPorts, Since: firstSeen},
+			})
+			So(buf.String(), ShouldNotContainSubstring, "# excluded")
+
+			published := proxy.Events.Recent()
+			So(published, ShouldHaveLength, 2)
+			So(published[0].Type, ShouldEqual, "ServerExcluded")
+			So(published[0].Subject, ShouldEqual, "awesome-svc")
+			So(published[0].Details["Reason"], ShouldEqual, ExcludedCheckFailed)
+			So(published[0].Details["Server"], ShouldEqual, "indefatigable-deadbeef101")
+
+			Convey("and keeps when each one was first seen", func() {
+				fakeClock.Advance(time.Minute)
+				proxy.ShowExclusions = true
+				buf.Reset()
+				So(proxy.WriteConfig(state, buf), ShouldBeNil)
+				So(buf.String(), ShouldContainSubstring, "\tmode http \n\tserver indomitable-deadbeef123 127.0.0.1:10450 cookie indomitable-10450 \n"+
+					"\t# excluded indefatigable-deadbeef101: CheckFailed since 2020-02-03T04:05:06Z\n")
+				So(proxy.Exclusions()[0].Since, ShouldResemble, firstSeen)
+				So(proxy.Events.Recent(), ShouldHaveLength, 2)
+			})
+
+			Convey("and starts over when one comes back for another reason", func() {
+				fakeClock.Advance(time.Minute)
+				draining := sick
+				draining.Updated = baseTime.Add(11 * time.Second)
+				draining.Status = service.DRAINING
+				until := baseTime.Add(time.Hour)
+				draining.DrainedUntil = &until
+				state.AddServiceEntry(draining)
+
+				So(proxy.WriteConfig(state, buf), ShouldBeNil)
+				exclusion := proxy.Exclusions()[0]
+				So(exclusion.Reason, ShouldEqual, ExcludedDraining)
+				So(exclusion.Detail, ShouldEqual, "until "+until.Format(time.RFC3339))
+				So(exclusion.Since, ShouldResemble, firstSeen.Add(time.Minute))
+
+				published := proxy.Events.Recent()
+				So(published, ShouldHaveLength, 3)
+				So(published[2].Details["Reason"], ShouldEqual, ExcludedDraining)
+				So(published[2].Message, ShouldContainSubstring, "(until ")
+			})
+		})
+
+		Convey("WriteConfig() leaves a failing named port out of only its own backend", func() {
+			sick := services[1]
+			sick.Updated = baseTime.Add(10 * time.Second)
+			sick.Ports = []service.Port{
+				{Type: "tcp", Port: 32763, ServicePort: 8080, IP: ip3, Name: "web"},
+				{Type: "tcp", Port: 10020, ServicePort: 9000, IP: ip3, Name: "admin", Status: service.UNHEALTHY},
+			}
+			state.AddServiceEntry(sick)
+
+			proxy.ShowExclusions = true
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			var portFailed []Exclusion
+			for _, exclusion := range proxy.Exclusions() {
+				if exclusion.Reason == ExcludedPortFailed {
+					exclusion.Since = time.Time{}
+					portFailed = append(portFailed, exclusion)
+				}
+			}
+			So(portFailed, ShouldResemble, []Exclusion{{
+				Service: "awesome-svc", Hostname: hostname2, ID: svcId2, Server: "indefatigable-deadbeef101",
+				Port: 9000, Reason: ExcludedPortFailed, Detail: "port admin",
+			}})
+
+			output := buf.String()
+			So(output, ShouldContainSubstring, "# ----------- awesome-svc port 9000 (admin) --------------")
+			So(output, ShouldContainSubstring, "\tserver indefatigable-deadbeef101 127.0.0.3:32763")
+			So(output, ShouldNotContainSubstring, "\tserver indefatigable-deadbeef101 127.0.0.3:10020")
+			So(output, ShouldContainSubstring, "\t# excluded indefatigable-deadbeef101: PortFailed (port admin) since ")
+			So(strings.Count(output, "# excluded indefatigable-deadbeef101"), ShouldEqual, 1)
 		})
 
 		Convey("WriteConfig() writes a template from a file", func() {
@@ -182,6 +333,273 @@ func Test_HAproxy(t *testing.T) {
 			So(output, ShouldMatch, "frontend some-svc-8090")
 			So(output, ShouldMatch, "backend some-svc-8090")
 			So(output, ShouldMatch, "server indefatigable-deadbeef105 127.0.0.3:9999 cookie indefatigable-9999")
+			So(string(output), ShouldContainSubstring, fmt.Sprintf("# State version %d", state.Version()))
+		})
+
+		Convey("WriteConfig() stamps the config with the time from the clock", func() {
+			proxy.Clock = clock.NewFake(time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC))
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "Auto-generated by Sidecar at 2020-02-03 04:05:06 +0000 UTC")
+		})
+
+		Convey("WriteConfig() renders the global section settings", func() {
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "maxconn 4096")
+			So(buf.String(), ShouldContainSubstring, "log     127.0.0.1 local0")
+			So(buf.String(), ShouldNotContainSubstring, "chroot")
+			So(buf.String(), ShouldNotContainSubstring, "nbthread")
+
+			proxy.Chroot = "/var/lib/haproxy"
+			proxy.MaxConn = 20000
+			proxy.NbThread = 4
+			proxy.LogTarget = "/dev/log"
+			buf.Reset()
+			err = proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "chroot /var/lib/haproxy")
+			So(buf.String(), ShouldContainSubstring, "nbthread 4")
+			So(buf.String(), ShouldContainSubstring, "maxconn 20000")
+			So(buf.String(), ShouldContainSubstring, "log     /dev/log local1 notice")
+		})
+
+		Convey("WriteConfig() renders the process and socket tuning", func() {
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+			So(buf.String(), ShouldNotContainSubstring, "nbproc")
+			So(buf.String(), ShouldNotContainSubstring, "cpu-map")
+			So(buf.String(), ShouldNotContainSubstring, "noreuseport")
+
+			proxy.NbProc = 2
+			proxy.CPUMap = []string{"1 0", "2 1"}
+			proxy.NoReusePort = true
+			proxy.BindOptions = "process all"
+			buf.Reset()
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "nbproc 2")
+			So(buf.String(), ShouldContainSubstring, "\tcpu-map 1 0\n\tcpu-map 2 1\n")
+			So(buf.String(), ShouldContainSubstring, "\tnoreuseport\n")
+			So(buf.String(), ShouldContainSubstring, "bind 192.168.168.168:8080 process all")
+		})
+
+		Convey("WriteConfig() turns on request logs when asked", func() {
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+			So(buf.String(), ShouldNotContainSubstring, "option httplog")
+
+			proxy.RequestLogs = true
+			buf.Reset()
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "option httplog")
+		})
+
+		Convey("WriteConfig() binds to both address families when configured", func() {
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			proxy.WriteConfig(state, buf)
+			So(buf.String(), ShouldNotContainSubstring, "bind [")
+
+			proxy.BindIPv6 = "fd00::168"
+			state.AddServiceEntry(service.Service{
+				ID:        "deadbeef777",
+				Name:      "v4-only-svc",
+				Image:     "v4-only-svc",
+				Hostname:  hostname2,
+				Updated:   baseTime.Add(5 * time.Second),
+				ProxyMode: "http",
+				IPFamily:  service.IPFamilyV4,
+				Ports:     []service.Port{{Type: "tcp", Port: 9998, ServicePort: 8070, IP: ip3}},
+			})
+
+			buf.Reset()
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "bind 192.168.168.168:8080\n\tbind [fd00::168]:8080")
+			So(buf.String(), ShouldContainSubstring, "bind 192.168.168.168:8070")
+			So(buf.String(), ShouldNotContainSubstring, "bind [fd00::168]:8070")
+		})
+
+		Convey("WriteConfig() terminates TLS once the certificate is in the CertDir", func() {
+			dir, _ := ioutil.TempDir("", "certs")
+			defer os.RemoveAll(dir)
+			proxy.CertDir = dir
+
+			state.AddServiceEntry(service.Service{
+				ID:        "deadbeef888",
+				Name:      "secure-svc",
+				Image:     "secure-svc",
+				Hostname:  hostname2,
+				Updated:   baseTime.Add(5 * time.Second),
+				ProxyMode: "http",
+				TLSCert:   "secure",
+				Ports:     []service.Port{{Type: "tcp", Port: 9997, ServicePort: 8443, IP: ip3}},
+			})
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "bind 192.168.168.168:8443\n")
+			So(buf.String(), ShouldNotContainSubstring, "ssl crt")
+
+			ioutil.WriteFile(certs.Path(dir, "secure"), []byte("pem"), 0600)
+
+			buf.Reset()
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "bind 192.168.168.168:8443 ssl crt "+certs.Path(dir, "secure")+"\n")
+			So(buf.String(), ShouldNotContainSubstring, "bind 192.168.168.168:8080 ssl")
+
+			Convey("and offers HTTP/2 when the installed HAproxy supports it", func() {
+				proxy.HTTP2 = true
+				buf.Reset()
+				So(proxy.WriteConfig(state, buf), ShouldBeNil)
+				So(buf.String(), ShouldContainSubstring, "ssl crt "+certs.Path(dir, "secure")+" alpn h2,http/1.1\n")
+
+				proxy.version = &Version{Major: 1, Minor: 7}
+				buf.Reset()
+				So(proxy.WriteConfig(state, buf), ShouldBeNil)
+				So(buf.String(), ShouldNotContainSubstring, "alpn")
+			})
+		})
+
+		Convey("WriteConfig() routes ACME challenges for the public hostnames", func() {
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldNotContainSubstring, "acme_challenge")
+
+			dir, _ := ioutil.TempDir("", "certs")
+			defer os.RemoveAll(dir)
+			proxy.CertDir = dir
+			proxy.ACMEBind = "0.0.0.0:80"
+			proxy.ACMEResponder = "127.0.0.1:7779"
+
+			state.AddServiceEntry(service.Service{
+				ID:              "deadbeef444",
+				Name:            "public-svc",
+				Image:           "public-svc",
+				Hostname:        hostname2,
+				Updated:         baseTime.Add(5 * time.Second),
+				ProxyMode:       "http",
+				PublicHostnames: []string{"www.example.com", "example.com"},
+				Ports:           []service.Port{{Type: "tcp", Port: 9996, ServicePort: 443, IP: ip3}},
+			})
+			ioutil.WriteFile(certs.Path(dir, "www.example.com"), []byte("pem"), 0600)
+
+			buf.Reset()
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "frontend acme_challenge\n\tmode http\n\tbind 0.0.0.0:80\n")
+			So(buf.String(), ShouldContainSubstring, "acl acme_host hdr(host),field(1,:) -i example.com www.example.com\n")
+			So(buf.String(), ShouldContainSubstring, "server sidecar 127.0.0.1:7779")
+			So(buf.String(), ShouldContainSubstring, "bind 192.168.168.168:443 ssl crt "+certs.Path(dir, "www.example.com"))
+		})
+
+		Convey("WriteConfig() routes pinned clients to their instance", func() {
+			proxy.Pins = affinity.NewStore()
+			proxy.Pins.Add(affinity.Pin{Service: "awesome-svc", ServerID: svcId2, Source: "10.0.0.9", Author: "jane"})
+			proxy.Pins.Add(affinity.Pin{Service: "awesome-svc", ServerID: svcId1, Cookie: "tester", Author: "jane"})
+			proxy.Pins.Add(affinity.Pin{Service: "some-svc", ServerID: svcId3, Cookie: "tester", Author: "jane"})
+			proxy.Pins.Add(affinity.Pin{Service: "awesome-svc", ServerID: "abba", Source: "10.0.0.8", Author: "jane"})
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring,
+				"\tacl pin_1 src 10.0.0.9/32\n\tuse-server "+hostname2+"-"+svcId2+" if pin_1\n")
+			So(buf.String(), ShouldContainSubstring,
+				"\tacl pin_2 req.cook(SidecarPin) -m str tester\n\tuse-server "+hostname1+"-"+svcId1+" if pin_2\n")
+			// Cookies can't be matched in TCP mode, and unknown servers are skipped
+			So(buf.String(), ShouldNotContainSubstring, "pin_3")
+			So(buf.String(), ShouldNotContainSubstring, "pin_4")
+		})
+
+		Convey("WriteConfig() routes clients by source to other services", func() {
+			routed := services[0]
+			routed.Updated = baseTime.Add(10 * time.Second)
+			routed.Metadata = map[string]string{
+				"SourceRoutes": "10.1.0.0/16=staging-svc:9080, 10.2.0.9=staging-svc:9080, 10.3.0.0/16=some-svc:8090, 10.4.0.0/16=missing-svc",
+			}
+			state.AddServiceEntry(routed)
+			state.AddServiceEntry(service.Service{
+				ID:        "deadbeef333",
+				Name:      "staging-svc",
+				Image:     "staging-svc",
+				Hostname:  hostname2,
+				Updated:   baseTime.Add(5 * time.Second),
+				ProxyMode: "http",
+				Ports:     []service.Port{{Type: "tcp", Port: 9995, ServicePort: 9080, IP: ip3}},
+			})
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "frontend awesome-svc-8080\n\tmode http\n\tbind 192.168.168.168:8080\n"+
+				"\tacl src_staging-svc-9080 src 10.1.0.0/16 10.2.0.9/32\n"+
+				"\tuse_backend staging-svc-9080 if src_staging-svc-9080\n"+
+				"\tdefault_backend awesome-svc-8080\n")
+			// Only routes to backends that exist and are in the same mode
+			So(buf.String(), ShouldNotContainSubstring, "10.3.0.0/16")
+			So(buf.String(), ShouldNotContainSubstring, "10.4.0.0/16")
+		})
+
+		Convey("WriteConfig() limits the connections to each server by its memory", func() {
+			limited := services[0]
+			limited.Updated = baseTime.Add(10 * time.Second)
+			limited.Resources = &service.Resources{MemoryLimit: 64 << 20}
+			state.AddServiceEntry(limited)
+
+			hinted := services[1]
+			hinted.Updated = baseTime.Add(10 * time.Second)
+			hinted.Metadata = map[string]string{"MaxConn": "5"}
+			state.AddServiceEntry(hinted)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldNotContainSubstring, "maxconn 64")
+
+			proxy.ConnLimits = true
+			buf.Reset()
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "server indomitable-deadbeef123 127.0.0.1:10450 cookie indomitable-10450 maxconn 64 \n")
+			So(buf.String(), ShouldContainSubstring, "server indefatigable-deadbeef101 127.0.0.3:32763 cookie indefatigable-32763 maxconn 5 \n")
+			// Nothing to go on for the rest
+			So(buf.String(), ShouldContainSubstring, "server indefatigable-deadbeef105 127.0.0.3:9999 cookie indefatigable-9999 \n")
+		})
+
+		Convey("maxConnFor() keeps the limits under the global maxconn", func() {
+			proxy.ConnLimits = true
+			svc := &service.Service{Resources: &service.Resources{MemoryLimit: 64 << 30}}
+			So(proxy.maxConnFor(svc), ShouldEqual, 4096)
+
+			svc.Resources.MemoryLimit = 1 << 20
+			So(proxy.maxConnFor(svc), ShouldEqual, DefaultMinServerConn)
+		})
+
+		Convey("WriteConfig() gives the servers their weights", func() {
+			weighted := services[1]
+			weighted.Updated = baseTime.Add(10 * time.Second)
+			weighted.Weight = 10
+			state.AddServiceEntry(weighted)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "server indefatigable-deadbeef101 127.0.0.3:32763 cookie indefatigable-32763 weight 10 \n")
+			So(buf.String(), ShouldContainSubstring, "server indomitable-deadbeef123 127.0.0.1:10450 cookie indomitable-10450 \n")
+		})
+
+		Convey("weightFor() leaves out weights HAproxy won't take", func() {
+			So(weightFor(&service.Service{Weight: 256}), ShouldEqual, 256)
+			So(weightFor(&service.Service{Weight: 257}), ShouldEqual, 0)
+			So(weightFor(&service.Service{Weight: -1}), ShouldEqual, 0)
+		})
+
+		Convey("bindAddresses() only honors the family when both are configured", func() {
+			So(proxy.bindAddresses(service.IPFamilyV6), ShouldResemble, []string{"192.168.168.168"})
+
+			proxy.BindIPv6 = "::1"
+			So(proxy.bindAddresses(""), ShouldResemble, []string{"192.168.168.168", "[::1]"})
+			So(proxy.bindAddresses(service.IPFamilyV6), ShouldResemble, []string{"[::1]"})
+
+			proxy.BindIP = ""
+			So(proxy.bindAddresses(service.IPFamilyV4), ShouldResemble, []string{"[::1]"})
 		})
 
 		Convey("WriteConfig() bubbles up templater errors", func() {
@@ -192,6 +610,65 @@ func Test_HAproxy(t *testing.T) {
 			So(err, ShouldNotBeNil)
 		})
 
+		Convey("WriteConfig() applies the blocks from a template overlay", func() {
+			overlay, _ := ioutil.TempFile("", "haproxy.cfg")
+			defer os.Remove(overlay.Name())
+			overlay.WriteString(`{{ define "defaults" }}defaults
+	timeout  client  5m
+{{ end }}{{ define "extra" }}# Site additions for {{ len .Services }} services
+{{ end }}`)
+			overlay.Close()
+
+			proxy.TemplateOverlay = overlay.Name()
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+
+			output := buf.String()
+			So(output, ShouldContainSubstring, "timeout  client  5m")
+			So(output, ShouldNotContainSubstring, "timeout  client  1m")
+			So(output, ShouldContainSubstring, "# Site additions for 3 services")
+			// Everything else still comes from the base
+			So(output, ShouldContainSubstring, "frontend awesome-svc-8080")
+			So(output, ShouldContainSubstring, "global")
+		})
+
+		Convey("WriteConfig() returns an error for a missing overlay", func() {
+			proxy.TemplateOverlay = "/does/not/exist"
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldNotBeNil)
+		})
+
+		Convey("WriteConfig() rejects an overlay needing newer template functions", func() {
+			overlay, _ := ioutil.TempFile("", "haproxy.cfg")
+			defer os.Remove(overlay.Name())
+			overlay.WriteString(`{{/* funcmap: 1.99 */}}{{ define "extra" }}{{ end }}`)
+			overlay.Close()
+			proxy.TemplateOverlay = overlay.Name()
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "requires template functions version 1.99")
+		})
+
+		Convey("WriteConfig() fills in secrets from the provider", func() {
+			overlay, _ := ioutil.TempFile("", "haproxy.cfg")
+			defer os.Remove(overlay.Name())
+			overlay.WriteString(`{{ define "extra" }}	stats auth admin:{{ secret "stats_password" }}
+{{ end }}`)
+			overlay.Close()
+			proxy.TemplateOverlay = overlay.Name()
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteConfig(state, buf), ShouldNotBeNil) // No provider
+
+			proxy.Secrets = secrets.NewCommandProvider("echo s3cret-for")
+			buf.Reset()
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "stats auth admin:s3cret-for stats_password")
+		})
+
 		Convey("WriteConfig() only writes out healthy services", func() {
 			badSvc := service.Service{
 				ID:       "0000bad00000",
@@ -228,6 +705,85 @@ func Test_HAproxy(t *testing.T) {
 			So(output, ShouldNotMatch, "0000bad00001")
 		})
 
+		Convey("WriteConfig() keeps services in maintenance mode listening", func() {
+			sickSvc := service.Service{
+				ID:        "0000sick0000",
+				Name:      "maintained-svc",
+				Hostname:  "titanic",
+				Status:    service.UNHEALTHY,
+				ProxyMode: "http",
+				Updated:   baseTime.Add(5 * time.Second),
+				Ports: []service.Port{
+					{Type: "tcp", Port: 777, ServicePort: 7777, IP: "127.0.0.1"},
+				},
+			}
+			state.AddServiceEntry(sickSvc)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "frontend maintained-svc-7777")
+			So(buf.String(), ShouldContainSubstring, "backend maintained-svc-7777")
+			So(buf.String(), ShouldNotContainSubstring, "0000sick0000")
+			So(buf.String(), ShouldContainSubstring, "http-request deny deny_status 503")
+			So(buf.String(), ShouldNotContainSubstring, "tcp-request content reject")
+
+			proxy.NoBackendsOverrides = map[string]string{"maintained-svc": NoBackendsRefuse}
+			buf.Reset()
+			err = proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldNotContainSubstring, "maintained-svc")
+			So(buf.String(), ShouldNotContainSubstring, "deny_status 503")
+		})
+
+		Convey("WriteConfig() closes TCP connections for services with no backends", func() {
+			sickSvc := service.Service{
+				ID:        "0000sick0001",
+				Name:      "maintained-tcp-svc",
+				Hostname:  "titanic",
+				Status:    service.TOMBSTONE,
+				ProxyMode: "tcp",
+				Updated:   baseTime.Add(5 * time.Second),
+				Ports: []service.Port{
+					{Type: "tcp", Port: 778, ServicePort: 7778, IP: "127.0.0.1"},
+				},
+			}
+			state.AddServiceEntry(sickSvc)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "bind 192.168.168.168:7778")
+			So(buf.String(), ShouldContainSubstring, "tcp-request content reject")
+		})
+
+		Convey("WriteConfig() renders the error files that exist", func() {
+			dir, _ := ioutil.TempDir("", "errorfiles")
+			defer os.RemoveAll(dir)
+			os.Mkdir(dir+"/awesome-svc", 0755)
+			ioutil.WriteFile(dir+"/503.http", []byte("HTTP/1.0 503"), 0644)
+			ioutil.WriteFile(dir+"/awesome-svc/502.http", []byte("HTTP/1.0 502"), 0644)
+
+			proxy.ErrorFilesDir = dir
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteConfig(state, buf)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "errorfile 503 "+dir+"/503.http")
+			So(buf.String(), ShouldContainSubstring, "errorfile 502 "+dir+"/awesome-svc/502.http")
+			So(buf.String(), ShouldNotContainSubstring, "errorfile 504")
+		})
+
+		Convey("ParseNoBackendsOverrides() parses and validates entries", func() {
+			overrides, err := ParseNoBackendsOverrides([]string{"web:maintenance", "db:refuse"})
+			So(err, ShouldBeNil)
+			So(overrides, ShouldResemble, map[string]string{"web": "maintenance", "db": "refuse"})
+
+			_, err = ParseNoBackendsOverrides([]string{"web:sometimes"})
+			So(err, ShouldNotBeNil)
+			_, err = ParseNoBackendsOverrides([]string{"web"})
+			So(err, ShouldNotBeNil)
+		})
+
 		Convey("Reload() doesn't return an error when it works", func() {
 			proxy.ReloadCmd = "sh -c 'exit 0'"
 			err := proxy.Reload()
@@ -253,7 +809,174 @@ func Test_HAproxy(t *testing.T) {
 			os.Remove(tmpfile.Name())
 
 			So(err, ShouldNotBeNil)
+			So(proxy.ConfigHash(), ShouldBeEmpty)
+		})
 
+		Convey("WriteAndReload() records a hash of the config it loaded", func() {
+			proxy.ReloadCmd = "sh -c 'exit 0'"
+			proxy.VerifyCmd = "sh -c 'exit 0' " + ConfigFilePlaceholder
+			tmpfile, _ := ioutil.TempFile("", "WriteAndReload")
+			proxy.ConfigFile = tmpfile.Name()
+			defer os.Remove(tmpfile.Name())
+
+			So(proxy.WriteAndReload(state), ShouldBeNil)
+
+			written, _ := ioutil.ReadFile(tmpfile.Name())
+			So(proxy.ConfigHash(), ShouldEqual, HashConfig(written))
+			So(proxy.ConfigHash(), ShouldNotEqual, fmt.Sprintf("%x", sha1.Sum(nil)))
+		})
+
+		Convey("AdoptConfig() takes over the config another Sidecar loaded", func() {
+			proxy.ReloadCmd = "/usr/bin/false"
+			proxy.VerifyCmd = "sh -c 'exit 0' " + ConfigFilePlaceholder
+			tmpfile, _ := ioutil.TempFile("", "AdoptConfig")
+			proxy.ConfigFile = tmpfile.Name()
+			defer os.Remove(tmpfile.Name())
+
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			proxy.AdoptConfig(buf.Bytes())
+
+			So(proxy.LoadedConfig(), ShouldResemble, buf.Bytes())
+			So(proxy.ConfigHash(), ShouldEqual, HashConfig(buf.Bytes()))
+			// The reload would fail if it were run
+			So(proxy.WriteAndReload(state), ShouldBeNil)
+		})
+
+		Convey("WriteAndReload() skips the reload when the config is unchanged", func() {
+			tmpDir, _ := ioutil.TempDir("", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+			reloads := tmpDir + "/reloads"
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.VerifyCmd = "sh -c 'exit 0' " + ConfigFilePlaceholder
+			proxy.ReloadCmd = "sh -c 'echo >> " + reloads + "'"
+
+			countReloads := func() int {
+				written, _ := ioutil.ReadFile(reloads)
+				return len(written)
+			}
+
+			So(proxy.WriteAndReload(state), ShouldBeNil)
+			So(countReloads(), ShouldEqual, 1)
+
+			relabeled := services[0]
+			relabeled.Updated = baseTime.Add(10 * time.Second)
+			relabeled.Metadata = map[string]string{"team": "core"}
+			state.AddServiceEntry(relabeled)
+
+			So(proxy.WriteAndReload(state), ShouldBeNil)
+			So(countReloads(), ShouldEqual, 1)
+
+			Convey("unless it's forced", func() {
+				So(proxy.ForceWriteAndReload(state), ShouldBeNil)
+				So(countReloads(), ShouldEqual, 2)
+			})
+
+			Convey("and reloads once it changes", func() {
+				added := services[0]
+				added.ID = "deadbeef777"
+				added.Updated = baseTime.Add(10 * time.Second)
+				added.Ports = []service.Port{
+					{Type: "tcp", Port: 10451, ServicePort: 8080, IP: ip},
+					{Type: "tcp", Port: 10021, ServicePort: 9000, IP: ip},
+				}
+				state.AddServiceEntry(added)
+
+				So(proxy.WriteAndReload(state), ShouldBeNil)
+				So(countReloads(), ShouldEqual, 2)
+			})
+		})
+
+		Convey("WriteAndReload() writes and reloads one at a time", func() {
+			tmpDir, _ := ioutil.TempDir("", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			steps := tmpDir + "/steps"
+			proxy.VerifyCmd = "sh -c 'echo verify >> " + steps + "; sleep 0.02' " + ConfigFilePlaceholder
+			proxy.ReloadCmd = "sh -c 'echo reload >> " + steps + "'"
+
+			results := make(chan error, 3)
+			for i := 0; i < 3; i++ {
+				go func() { results <- proxy.ForceWriteAndReload(state) }()
+			}
+			for i := 0; i < 3; i++ {
+				So(<-results, ShouldBeNil)
+			}
+
+			written, _ := ioutil.ReadFile(steps)
+			So(string(written), ShouldEqual, strings.Repeat("verify\nreload\n", 3))
+		})
+
+		Convey("WriteAndReload() leaves the old config alone when the new one fails", func() {
+			tmpDir, _ := ioutil.TempDir("", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.ReloadCmd = "sh -c 'exit 0'"
+			ioutil.WriteFile(proxy.ConfigFile, []byte("old config\n"), 0644)
+
+			Convey("to render", func() {
+				proxy.Template = tmpDir + "/broken.cfg"
+				ioutil.WriteFile(proxy.Template, []byte("{{ .NoSuchField }}"), 0644)
+
+				So(proxy.WriteAndReload(state), ShouldNotBeNil)
+			})
+
+			Convey("to verify, and verifies the new file in its place", func() {
+				proxy.VerifyCmd = "grep -q not-in-the-config " + ConfigFilePlaceholder
+
+				err := proxy.WriteAndReload(state)
+				So(err, ShouldHaveSameTypeAs, &VerifyError{})
+				So(err.Error(), ShouldContainSubstring, tmpDir+"/.haproxy.cfg.")
+			})
+
+			Convey("to verify in the temp file, even when the old one passes", func() {
+				proxy.VerifyCmd = "grep -q 'old config' " + ConfigFilePlaceholder
+				So(proxy.Verify(), ShouldBeNil)
+
+				So(proxy.WriteAndReload(state), ShouldHaveSameTypeAs, &VerifyError{})
+			})
+
+			Convey("because the verify command has no placeholder", func() {
+				proxy.VerifyCmd = "sh -c 'exit 0'"
+
+				err := proxy.WriteAndReload(state)
+				So(err, ShouldHaveSameTypeAs, &VerifyError{})
+				So(err.Error(), ShouldContainSubstring, ConfigFilePlaceholder)
+			})
+
+			written, _ := ioutil.ReadFile(proxy.ConfigFile)
+			So(string(written), ShouldEqual, "old config\n")
+
+			files, _ := ioutil.ReadDir(tmpDir)
+			for _, file := range files {
+				So(file.Name(), ShouldNotStartWith, ".haproxy.cfg.")
+			}
+		})
+
+		Convey("WriteAndReload() pushes to the DataPlane instead of the file when there is one", func() {
+			var pushed string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == dataPlanePrefix+"/configuration/raw" {
+					body, _ := ioutil.ReadAll(r.Body)
+					pushed = string(body)
+				}
+				fmt.Fprint(w, "1")
+			}))
+			defer server.Close()
+
+			proxy.ConfigFile = ""
+			proxy.ReloadCmd = "/usr/bin/false"
+			proxy.DataPlane = NewDataPlane(server.URL, "", "")
+
+			So(proxy.WriteAndReload(state), ShouldBeNil)
+			So(pushed, ShouldContainSubstring, "frontend")
+			So(proxy.ConfigHash(), ShouldEqual, HashConfig([]byte(pushed)))
+		})
+
+		Convey("HashConfig() leaves out the comments", func() {
+			So(HashConfig([]byte("# State version 12\nglobal\n  # local\n")), ShouldEqual,
+				HashConfig([]byte("# State version 34\nglobal\n")))
+			So(HashConfig([]byte("global\n")), ShouldNotEqual, HashConfig([]byte("defaults\n")))
 		})
 
 		Convey("sanitizeName() fixes crazy image names", func() {
@@ -261,11 +984,116 @@ func Test_HAproxy(t *testing.T) {
 			So(sanitizeName(image), ShouldEqual, "public-something-longish-latest")
 		})
 
+		Convey("debounce() takes the changes that arrive within the window", func() {
+			fakeClock := clock.NewFake(time.Now())
+			proxy.Clock = fakeClock
+			proxy.ReloadDebounce = 2 * time.Second
+			proxy.eventChannel = make(chan catalog.ChangeEvent, 5)
+
+			result := make(chan int)
+			go func() { result <- proxy.debounce() }()
+
+			proxy.eventChannel <- catalog.ChangeEvent{}
+			proxy.eventChannel <- catalog.ChangeEvent{}
+			for fakeClock.Waiters() < 1 || len(proxy.eventChannel) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			fakeClock.Advance(2 * time.Second)
+			So(<-result, ShouldEqual, 2)
+
+			Convey("and stops when the channel is closed", func() {
+				go func() { result <- proxy.debounce() }()
+				close(proxy.eventChannel)
+				So(<-result, ShouldEqual, 0)
+			})
+		})
+
+		Convey("backoffFor() doubles the backoff up to the maximum", func() {
+			proxy.ReloadBackoff = time.Second
+			proxy.MaxReloadBackoff = 5 * time.Second
+
+			So(proxy.backoffFor(1), ShouldEqual, time.Second)
+			So(proxy.backoffFor(3), ShouldEqual, 4*time.Second)
+			So(proxy.backoffFor(4), ShouldEqual, 5*time.Second)
+			So(proxy.backoffFor(100), ShouldEqual, 5*time.Second)
+
+			proxy.ReloadBackoff = 0
+			So(proxy.backoffFor(3), ShouldEqual, 0)
+		})
+
+		Convey("writeWithBackoff() tries again, backing off, until the reload works", func() {
+			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
+			defer os.RemoveAll(tmpDir)
+			marker := tmpDir + "/reloaded"
+
+			fakeClock := clock.NewFake(time.Now())
+			proxy.Clock = fakeClock
+			proxy.ConfigFile = tmpDir + "/haproxy.cfg"
+			proxy.VerifyCmd = "sh -c 'exit 0' " + ConfigFilePlaceholder
+			proxy.ReloadCmd = "test -f " + marker
+			proxy.ReloadBackoff = time.Second
+			proxy.Events = events.NewBus(10)
+			proxy.eventChannel = make(chan catalog.ChangeEvent, 5)
+
+			result := make(chan bool)
+			go func() { result <- proxy.writeWithBackoff(state) }()
+
+			waitForBackoff := func(failures int) {
+				for proxy.ReloadStatus().Failures < failures || fakeClock.Waiters() < 1 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			waitForBackoff(1)
+			status := proxy.ReloadStatus()
+			So(status.Backoff, ShouldEqual, time.Second)
+			So(status.LastError, ShouldContainSubstring, "test -f")
+			So(status.LastFailure.IsZero(), ShouldBeFalse)
+
+			proxy.eventChannel <- catalog.ChangeEvent{}
+			fakeClock.Advance(time.Second)
+			waitForBackoff(2)
+			So(proxy.ReloadStatus().Backoff, ShouldEqual, 2*time.Second)
+
+			So(ioutil.WriteFile(marker, nil, 0644), ShouldBeNil)
+			fakeClock.Advance(2 * time.Second)
+			So(<-result, ShouldBeTrue)
+
+			status = proxy.ReloadStatus()
+			So(status.Failures, ShouldEqual, 0)
+			So(status.Backoff, ShouldEqual, 0)
+			So(status.LastError, ShouldContainSubstring, "test -f")
+
+			var published []string
+			for _, evt := range proxy.Events.Recent() {
+				published = append(published, evt.Type)
+			}
+			So(published, ShouldResemble, []string{"ServerExcluded", "ReloadFailed", "ReloadFailed", "Reloaded"})
+
+			Convey("and gives up when the channel is closed", func() {
+				So(os.Remove(marker), ShouldBeNil)
+				added := services[0]
+				added.ID = "deadbeef777"
+				added.Ports = []service.Port{
+					{Type: "tcp", Port: 10451, ServicePort: 8080, IP: ip},
+					{Type: "tcp", Port: 10021, ServicePort: 9000, IP: ip},
+				}
+				state.AddServiceEntry(added)
+
+				go func() { result <- proxy.writeWithBackoff(state) }()
+				waitForBackoff(1)
+				close(proxy.eventChannel)
+				So(<-result, ShouldBeFalse)
+			})
+		})
+
 		Convey("Watch() writes out a config when the state changes", func() {
 			tmpDir, _ := ioutil.TempDir("/tmp", "sidecar-test")
 			config := fmt.Sprintf("%s/haproxy.cfg", tmpDir)
 			proxy.ConfigFile = config
 			proxy.ReloadCmd = "/usr/bin/false"
+			proxy.VerifyCmd = "sh -c 'exit 0' " + ConfigFilePlaceholder
 
 			go proxy.Watch(state)
 			newTime := time.Now().UTC()
@@ -277,7 +1105,7 @@ func Test_HAproxy(t *testing.T) {
 				Hostname: hostname2,
 				Updated:  newTime,
 				Ports: []service.Port{
-					{Type: "tcp", Port: 1337, ServicePort: 8090, IP: "127.0.0.1"},
+					{Type: "tcp", Port: 1337, ServicePort: 8091, IP: "127.0.0.1"},
 				},
 			}
 		OUTER:
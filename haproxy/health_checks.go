@@ -0,0 +1,43 @@
+package haproxy
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// A templateHealthCheck is what the template needs for HAproxy to check
+// each server of a backend the way Sidecar checks the service
+type templateHealthCheck struct {
+	Path  string // What to GET
+	Inter string // How often, e.g. 3000ms
+}
+
+// getHealthChecks returns the check each service's health monitor announced,
+// taken from the most recently updated instance. Services without a valid
+// one are left out.
+func getHealthChecks(state *catalog.ServicesState) map[string]*service.ProxyCheck {
+	checks := make(map[string]*service.ProxyCheck)
+	for svcName, metadata := range newestMetadata(state, service.ProxyCheckKeys...) {
+		svc := service.Service{Metadata: metadata}
+		if check, err := svc.ProxyCheck(); err == nil && check != nil {
+			checks[svcName] = check
+		}
+	}
+	return checks
+}
+
+// healthCheckFor returns the check for the backend of a service's port, or
+// nil when active checks are off or the check is for another port
+func (h *HAproxy) healthCheckFor(check *service.ProxyCheck, svcPort string) *templateHealthCheck {
+	if !h.ActiveChecks || check == nil || strconv.FormatInt(check.ServicePort, 10) != svcPort {
+		return nil
+	}
+
+	return &templateHealthCheck{
+		Path:  check.Path,
+		Inter: fmt.Sprintf("%dms", check.Interval.Milliseconds()),
+	}
+}
@@ -0,0 +1,62 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_HealthChecks(t *testing.T) {
+	Convey("The active health checks", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef001", Name: "web", Hostname: hostname1, Updated: baseTime, ProxyMode: "http",
+			Metadata: map[string]string{
+				"ProxyCheckPath": "/status/check?full=true", "ProxyCheckPort": "8080", "ProxyCheckInterval": "1.5s",
+			},
+			Ports: []service.Port{
+				{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "127.0.0.1"},
+				{Type: "tcp", Port: 10451, ServicePort: 9000, IP: "127.0.0.1"},
+			},
+		})
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("are off by default", func() {
+			config := render()
+			So(config, ShouldNotContainSubstring, "httpchk")
+			So(config, ShouldNotContainSubstring, " check ")
+		})
+
+		Convey("check the servers of the backend for the checked port", func() {
+			proxy.ActiveChecks = true
+			So(render(), ShouldContainSubstring, "backend web-8080\n"+
+				"\toption httpchk GET /status/check?full=true\n"+
+				"\tmode http \n"+
+				"\tserver indomitable-deadbeef001 127.0.0.1:10450 cookie indomitable-10450 check inter 1500ms \n")
+		})
+
+		Convey("leave the other backends alone", func() {
+			proxy.ActiveChecks = true
+			So(render(), ShouldContainSubstring, "backend web-9000\n\tmode http \n"+
+				"\tserver indomitable-deadbeef001 127.0.0.1:10451 cookie indomitable-10451 \n")
+		})
+	})
+}
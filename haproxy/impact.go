@@ -0,0 +1,205 @@
+package haproxy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often Watch looks at the sessions again while it holds off a reload
+const reloadImpactRecheck = 5 * time.Second
+
+// BackendImpact is what a reload would do to one backend
+type BackendImpact struct {
+	Backend   string
+	Removed   bool // Gone from the next config, rather than changed
+	Sessions  int64
+	LongLived bool // Its sessions last at least the LongLivedSession on average
+}
+
+// A ReloadImpact estimates the sessions a reload would cut, from the ones
+// open on the backends it changes. The long-lived ones are the likeliest to
+// outlast the old HAproxy process.
+type ReloadImpact struct {
+	Estimated time.Time
+	Backends  []BackendImpact
+	Sessions  int64
+	LongLived int64
+	Delayed   time.Duration // How long the reload was held off for
+}
+
+// changedBackends returns the backends that are different in the next
+// config, or gone from it, and whether each one is gone
+func changedBackends(previous []byte, next []byte) map[string]bool {
+	before := backendSections(previous)
+	after := backendSections(next)
+
+	changed := make(map[string]bool)
+	for name, section := range before {
+		if nextSection, ok := after[name]; !ok {
+			changed[name] = true
+		} else if nextSection != section {
+			changed[name] = false
+		}
+	}
+	return changed
+}
+
+// backendSections returns the lines of each backend in a config, without
+// the comments or the indentation
+func backendSections(config []byte) map[string]string {
+	sections := make(map[string]string)
+	var backend string
+
+	for _, line := range bytes.Split(config, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// Sections start at the beginning of the line, their settings are
+		// indented
+		if line[0] != ' ' && line[0] != '\t' {
+			backend = ""
+			if fields[0] == "backend" && len(fields) > 1 {
+				backend = fields[1]
+			}
+			continue
+		}
+
+		if backend != "" {
+			sections[backend] += strings.Join(fields, " ") + "\n"
+		}
+	}
+
+	return sections
+}
+
+// estimateImpact adds up the sessions open on the changed backends
+func estimateImpact(traffic []BackendTraffic, changed map[string]bool, longLived time.Duration,
+	now time.Time) *ReloadImpact {
+
+	impact := &ReloadImpact{Estimated: now}
+	for _, backend := range traffic {
+		removed, ok := changed[backend.Backend]
+		if !ok {
+			continue
+		}
+
+		backendImpact := BackendImpact{
+			Backend:   backend.Backend,
+			Removed:   removed,
+			Sessions:  backend.Sessions,
+			LongLived: longLived > 0 && backend.AvgSessionTime >= longLived,
+		}
+		impact.Backends = append(impact.Backends, backendImpact)
+		impact.Sessions += backend.Sessions
+		if backendImpact.LongLived {
+			impact.LongLived += backend.Sessions
+		}
+	}
+	sort.Slice(impact.Backends, func(i, j int) bool { return impact.Backends[i].Backend < impact.Backends[j].Backend })
+
+	return impact
+}
+
+// reloadImpact estimates what loading the rendered config would do to the
+// open sessions. It's nil when it wouldn't reload HAproxy, e.g. when the
+// servers can be changed at runtime, or there are no traffic stats to go on.
+func (h *HAproxy) reloadImpact(rendered []byte) (*ReloadImpact, error) {
+	previous := h.LoadedConfig()
+	if h.Traffic == nil || h.DataPlane != nil || previous == nil {
+		return nil, nil
+	}
+
+	if h.RuntimeUpdates {
+		if _, ok := diffServers(previous, rendered); ok {
+			return nil, nil
+		}
+	}
+
+	traffic, err := h.Traffic.Source.Traffic()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the traffic stats: %s", err)
+	}
+
+	now := clock.OrReal(h.Clock).Now().UTC()
+	return estimateImpact(traffic, changedBackends(previous, rendered), h.LongLivedSession, now), nil
+}
+
+// waitForSessions estimates the impact of the next reload and, while it
+// would cut more than ReloadDelaySessions, holds it off for up to the
+// MaxReloadDelay. State changes that arrive meanwhile go out with the same
+// reload. It returns false if the channel was closed while waiting.
+func (h *HAproxy) waitForSessions(state *catalog.ServicesState) bool {
+	if h.Traffic == nil {
+		return true
+	}
+
+	start := clock.OrReal(h.Clock).Now()
+	for {
+		rendered, changed, err := h.RenderConfig(state)
+		if err != nil || !changed {
+			// Writing the config reports the error
+			return true
+		}
+
+		impact, err := h.reloadImpact(rendered)
+		if err != nil {
+			log.Warnf("Can't estimate the impact of the HAproxy reload: %s", err)
+			return true
+		}
+		if impact == nil {
+			return true
+		}
+
+		waited := clock.OrReal(h.Clock).Now().Sub(start)
+		remaining := h.MaxReloadDelay - waited
+		if h.ReloadDelaySessions < 1 || impact.Sessions <= int64(h.ReloadDelaySessions) || remaining <= 0 {
+			impact.Delayed = waited
+			h.recordImpact(impact)
+			return true
+		}
+
+		log.Infof("Holding off the HAproxy reload while %d sessions are open on the backends it changes", impact.Sessions)
+		metrics.IncrCounter([]string{"haproxy", "reload_impact", "delays"}, 1)
+
+		recheck := reloadImpactRecheck
+		if remaining < recheck {
+			recheck = remaining
+		}
+		if _, open := h.drain(recheck); !open {
+			return false
+		}
+	}
+}
+
+// recordImpact keeps the impact of the coming reload in the ReloadStatus,
+// and reports it
+func (h *HAproxy) recordImpact(impact *ReloadImpact) {
+	h.reloadLock.Lock()
+	h.reloadStatus.Impact = impact
+	h.reloadLock.Unlock()
+
+	metrics.SetGauge([]string{"haproxy", "reload_impact", "sessions"}, float32(impact.Sessions))
+	metrics.SetGauge([]string{"haproxy", "reload_impact", "long_lived"}, float32(impact.LongLived))
+
+	if impact.Sessions < 1 {
+		return
+	}
+
+	message := fmt.Sprintf("Reloading HAproxy with %d sessions open on %d changed backends, %d of them long-lived",
+		impact.Sessions, len(impact.Backends), impact.LongLived)
+	if impact.Delayed > 0 {
+		message += fmt.Sprintf(", after holding off for %s", impact.Delayed)
+	}
+	log.Info(message)
+	h.publishReload("ReloadImpact", message)
+}
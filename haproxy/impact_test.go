@@ -0,0 +1,140 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const impactStat = `# pxname,svname,qcur,scur,stot,status,type,ttime
+web-8080,BACKEND,0,12,400,UP,1,90000
+api-9000,BACKEND,0,3,40,UP,1,200
+`
+
+func Test_ReloadImpact(t *testing.T) {
+	Convey("The reload impact", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		Convey("changedBackends() finds the backends that changed or went away", func() {
+			previous := []byte("frontend web-8080\n\tbind :8080\n" +
+				"backend web-8080\n\tmode http\n\tserver alpha 10.0.0.1:10450\n" +
+				"backend api-9000\n\tmode http\n\tserver beta 10.0.0.2:10451\n" +
+				"backend db-5432\n\tmode tcp\n")
+			next := []byte("# A comment\nfrontend web-8080\n\tbind :8081\n" +
+				"backend web-8080\n\tmode http\n\tserver alpha 10.0.0.1:10450\n\tserver gamma 10.0.0.3:10452\n" +
+				"backend api-9000\n    mode http\n    server beta 10.0.0.2:10451\n")
+
+			So(changedBackends(previous, next), ShouldResemble, map[string]bool{"web-8080": false, "db-5432": true})
+		})
+
+		Convey("estimateImpact() counts the sessions on the changed backends", func() {
+			traffic, err := ParseTraffic([]byte(impactStat))
+			So(err, ShouldBeNil)
+			So(traffic[0].AvgSessionTime, ShouldEqual, 90*time.Second)
+
+			now := time.Now().UTC()
+			impact := estimateImpact(traffic, map[string]bool{"web-8080": false, "api-9000": true}, time.Minute, now)
+			So(impact, ShouldResemble, &ReloadImpact{
+				Estimated: now,
+				Backends: []BackendImpact{
+					{Backend: "api-9000", Removed: true, Sessions: 3},
+					{Backend: "web-8080", Sessions: 12, LongLived: true},
+				},
+				Sessions:  15,
+				LongLived: 12,
+			})
+		})
+
+		Convey("waitForSessions()", func() {
+			state := catalog.NewServicesState()
+			baseTime := time.Now().UTC()
+			var added int
+			add := func(id string, ip string) {
+				added++
+				state.AddServiceEntry(service.Service{
+					ID: id, Name: "web", Image: "web:1.0", Hostname: hostname1, ProxyMode: "http",
+					Ports:   []service.Port{{Type: "tcp", Port: 10450 + int64(added), ServicePort: 8080, IP: ip}},
+					Updated: baseTime.Add(time.Duration(added) * time.Second),
+				})
+			}
+			add("deadbeef001", "10.0.0.1")
+
+			fakeClock := clock.NewFake(baseTime)
+			source := &fakeTrafficSource{output: []byte(impactStat)}
+
+			proxy := New("tmpConfig", "tmpPid")
+			proxy.Template = "../views/haproxy.cfg"
+			proxy.Clock = fakeClock
+			proxy.Traffic = NewTrafficCollector(source)
+			proxy.LongLivedSession = time.Minute
+			proxy.MaxReloadDelay = time.Minute
+			proxy.eventChannel = make(chan catalog.ChangeEvent, 5)
+
+			rendered, _, err := proxy.RenderConfig(state)
+			So(err, ShouldBeNil)
+			proxy.AdoptConfig(rendered)
+			add("deadbeef002", "10.0.0.2")
+
+			Convey("records the impact without waiting by default", func() {
+				So(proxy.waitForSessions(state), ShouldBeTrue)
+
+				impact := proxy.ReloadStatus().Impact
+				So(impact, ShouldNotBeNil)
+				So(impact.Backends, ShouldResemble, []BackendImpact{{Backend: "web-8080", Sessions: 12, LongLived: true}})
+				So(impact.Delayed, ShouldEqual, 0)
+			})
+
+			Convey("holds off the reload while there are too many sessions", func() {
+				proxy.ReloadDelaySessions = 5
+
+				result := make(chan bool)
+				go func() { result <- proxy.waitForSessions(state) }()
+
+				for fakeClock.Waiters() < 1 {
+					time.Sleep(time.Millisecond)
+				}
+				source.output = []byte("# pxname,svname,qcur,scur,stot,status,type,ttime\nweb-8080,BACKEND,0,2,410,UP,1,90000\n")
+				fakeClock.Advance(reloadImpactRecheck)
+
+				So(<-result, ShouldBeTrue)
+				impact := proxy.ReloadStatus().Impact
+				So(impact.Sessions, ShouldEqual, 2)
+				So(impact.Delayed, ShouldEqual, reloadImpactRecheck)
+			})
+
+			Convey("holds off the reload no longer than the maximum", func() {
+				proxy.ReloadDelaySessions = 5
+				proxy.MaxReloadDelay = 3 * time.Second
+
+				result := make(chan bool)
+				go func() { result <- proxy.waitForSessions(state) }()
+
+				for fakeClock.Waiters() < 1 {
+					time.Sleep(time.Millisecond)
+				}
+				fakeClock.Advance(3 * time.Second)
+
+				So(<-result, ShouldBeTrue)
+				So(proxy.ReloadStatus().Impact.Sessions, ShouldEqual, 12)
+			})
+
+			Convey("stops when the channel is closed", func() {
+				proxy.ReloadDelaySessions = 5
+				close(proxy.eventChannel)
+				So(proxy.waitForSessions(state), ShouldBeFalse)
+			})
+
+			Convey("doesn't estimate changes that don't reload", func() {
+				proxy.RuntimeUpdates = true
+				So(proxy.waitForSessions(state), ShouldBeTrue)
+				So(proxy.ReloadStatus().Impact, ShouldBeNil)
+			})
+		})
+	})
+}
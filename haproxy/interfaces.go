@@ -0,0 +1,110 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// ParseBindInterfaces parses the named interfaces HAproxy can bind to, in the
+// form name=ip, e.g. dmz=203.0.113.5
+func ParseBindInterfaces(entries []string) (map[string]string, error) {
+	interfaces := make(map[string]string, len(entries))
+
+	for _, entry := range entries {
+		fields := strings.SplitN(entry, "=", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) == "" || net.ParseIP(strings.TrimSpace(fields[1])) == nil {
+			return nil, fmt.Errorf("Error parsing bind interface '%s': expected name=ip", entry)
+		}
+
+		interfaces[strings.ToLower(strings.TrimSpace(fields[0]))] = strings.TrimSpace(fields[1])
+	}
+
+	return interfaces, nil
+}
+
+// getBindInterfaces returns the interfaces each service asked to be served
+// on, taken from the most recently updated instance
+func getBindInterfaces(state *catalog.ServicesState) map[string][]string {
+	interfaces := make(map[string][]string)
+	for svcName, metadata := range newestMetadata(state, service.BindInterfacesKey) {
+		svc := service.Service{Metadata: metadata}
+		if names := svc.BindInterfaces(); len(names) > 0 {
+			interfaces[svcName] = names
+		}
+	}
+	return interfaces
+}
+
+// serviceBinds returns the addresses the frontends of each service bind to,
+// and the warnings for the interfaces they asked for that aren't configured.
+// Services that didn't ask for any, or only for unknown ones, get the
+// default addresses.
+func (h *HAproxy) serviceBinds(ports portmap, families map[string]string,
+	interfaces map[string][]string) (map[string][]string, []ConfigWarning) {
+
+	binds := make(map[string][]string, len(ports))
+	var warnings []ConfigWarning
+
+	svcNames := make([]string, 0, len(ports))
+	for svcName := range ports {
+		svcNames = append(svcNames, svcName)
+	}
+	sort.Strings(svcNames)
+
+	for _, svcName := range svcNames {
+		var addresses []string
+		var unknown []string
+		for _, name := range interfaces[svcName] {
+			ip, ok := h.BindInterfaces[name]
+			if !ok {
+				unknown = append(unknown, name)
+				continue
+			}
+			addresses = append(addresses, ip)
+		}
+
+		if len(unknown) > 0 {
+			message := fmt.Sprintf("Not bound to the unknown interfaces '%s'", strings.Join(unknown, "', '"))
+			if len(addresses) < 1 {
+				message += ", using the default ones"
+			}
+			warnings = append(warnings, ConfigWarning{Service: svcName, Kind: WarnBindInterfaces, Message: message})
+		}
+
+		if len(addresses) < 1 {
+			binds[svcName] = h.bindAddresses(families[svcName])
+			continue
+		}
+		binds[svcName] = interfaceAddresses(addresses, families[svcName])
+	}
+
+	return binds, warnings
+}
+
+// interfaceAddresses returns the addresses of the interfaces in the form a
+// bind line takes them. A service restricted to an address family only gets
+// those of that family, unless none of them are.
+func interfaceAddresses(ips []string, family string) []string {
+	var all, matching []string
+	for _, ip := range ips {
+		address := ip
+		v4 := net.ParseIP(ip).To4() != nil
+		if !v4 {
+			address = "[" + ip + "]"
+		}
+		all = append(all, address)
+		if family == "" || (family == service.IPFamilyV4) == v4 {
+			matching = append(matching, address)
+		}
+	}
+
+	if len(matching) < 1 {
+		return all
+	}
+	return matching
+}
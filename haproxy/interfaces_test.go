@@ -0,0 +1,111 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseBindInterfaces(t *testing.T) {
+	Convey("ParseBindInterfaces()", t, func() {
+		Convey("parses the named addresses", func() {
+			interfaces, err := ParseBindInterfaces([]string{"internal=10.0.0.5", " DMZ = fd00::5"})
+			So(err, ShouldBeNil)
+			So(interfaces, ShouldResemble, map[string]string{"internal": "10.0.0.5", "dmz": "fd00::5"})
+		})
+
+		Convey("rejects entries without a name or a valid IP", func() {
+			for _, entry := range []string{"10.0.0.5", "=10.0.0.5", "dmz=", "dmz=example.com"} {
+				_, err := ParseBindInterfaces([]string{entry})
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func Test_BindInterfaces(t *testing.T) {
+	Convey("Binding services to interfaces", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		var added int
+		add := func(id string, name string, metadata map[string]string, family string) {
+			added++
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, ProxyMode: "http", Metadata: metadata, IPFamily: family,
+				Ports:   []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "127.0.0.1"}},
+				Updated: baseTime.Add(time.Duration(added) * time.Second),
+			})
+		}
+		add("deadbeef001", "web", map[string]string{"BindInterfaces": "dmz"}, "")
+		add("deadbeef002", "admin", nil, "")
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.BindInterfaces = map[string]string{"dmz": "203.0.113.5", "internal": "10.0.0.5", "dmz6": "fd00::5"}
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("binds them to the ones they ask for, sharing the ServicePort", func() {
+			config := render()
+			So(config, ShouldContainSubstring, "frontend web-8080\n\tmode http\n\tbind 203.0.113.5:8080\n")
+			So(config, ShouldContainSubstring, "frontend admin-8080\n\tmode http\n\tbind 192.168.168.168:8080\n")
+			So(proxy.Warnings(), ShouldBeEmpty)
+		})
+
+		Convey("binds them to several, in the order they're asked for", func() {
+			add("deadbeef001", "web", map[string]string{"BindInterfaces": "internal,dmz6"}, "")
+			So(render(), ShouldContainSubstring, "\tbind 10.0.0.5:8080\n\tbind [fd00::5]:8080\n")
+		})
+
+		Convey("honors the service's address family", func() {
+			add("deadbeef001", "web", map[string]string{"BindInterfaces": "internal,dmz6"}, service.IPFamilyV6)
+			config := render()
+			So(config, ShouldContainSubstring, "frontend web-8080\n\tmode http\n\tbind [fd00::5]:8080\n")
+			So(config, ShouldNotContainSubstring, "10.0.0.5")
+		})
+
+		Convey("warns about the ones that aren't configured", func() {
+			add("deadbeef001", "web", map[string]string{"BindInterfaces": "public,dmz"}, "")
+			So(render(), ShouldContainSubstring, "frontend web-8080\n\tmode http\n\tbind 203.0.113.5:8080\n")
+
+			warnings := proxy.Warnings()
+			So(warnings, ShouldHaveLength, 1)
+			So(warnings[0].Service, ShouldEqual, "web")
+			So(warnings[0].Kind, ShouldEqual, WarnBindInterfaces)
+			So(warnings[0].Message, ShouldEqual, "Not bound to the unknown interfaces 'public'")
+		})
+
+		Convey("uses the default addresses when none are configured", func() {
+			binds, warnings := proxy.serviceBinds(
+				portmap{"web": {"8080": "8080"}}, nil, map[string][]string{"web": {"public"}},
+			)
+			So(binds["web"], ShouldResemble, []string{"192.168.168.168"})
+			So(warnings, ShouldHaveLength, 1)
+			So(warnings[0].Message, ShouldEndWith, ", using the default ones")
+		})
+
+		Convey("gives the interfaces to the bindIP function", func() {
+			overlay, _ := ioutil.TempFile("", "haproxy.cfg")
+			defer os.Remove(overlay.Name())
+			overlay.WriteString(`{{ define "extra" }}# dmz {{ bindIP "DMZ" }} default {{ bindIP }}{{ end }}`)
+			overlay.Close()
+
+			proxy.TemplateOverlay = overlay.Name()
+			So(render(), ShouldContainSubstring, "# dmz 203.0.113.5 default 192.168.168.168")
+		})
+	})
+}
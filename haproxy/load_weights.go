@@ -0,0 +1,193 @@
+package haproxy
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+// A LoadWeigher spreads the load in each backend by the CPU use of its
+// servers, from the Resources that Sidecars collect for their containers.
+// The least busy server in a backend keeps its full weight, and the others
+// get less the busier they are compared to it. Servers are matched to their
+// services by the <hostname>-<ID> names the template gives them, and the
+// backends are whatever HAproxy reports them in.
+type LoadWeigher struct {
+	Source    StatsSource
+	Headroom  float64                     // CPU percentage points added to each server before comparing them
+	MinWeight int                         // The lowest percentage weight a server gets
+	Smoothing float64                     // How much each new CPU sample counts, from 0 to 1
+	MaxAge    time.Duration               // Resources collected longer ago than this are ignored
+	Exclude   func() map[string]time.Time // Servers whose weight is set by someone else, as backend/server
+	cpu       map[string]float64          // The smoothed CPU use, by server name
+	collected map[string]time.Time        // When the last sample we smoothed in was collected
+	weights   map[string]int              // The weights we have set, as backend/server
+	sync.Mutex
+}
+
+// NewLoadWeigher returns a LoadWeigher with the default settings
+func NewLoadWeigher(source StatsSource) *LoadWeigher {
+	return &LoadWeigher{
+		Source:    source,
+		Headroom:  10,
+		MinWeight: 20,
+		Smoothing: 0.5,
+		MaxAge:    3 * time.Minute,
+		cpu:       make(map[string]float64),
+		collected: make(map[string]time.Time),
+		weights:   make(map[string]int),
+	}
+}
+
+// Adjust works out the weights of the servers from the latest Resources in
+// the state, and sets them in HAproxy. They are set on every run, because a
+// reload puts them all back to the configured weight.
+func (w *LoadWeigher) Adjust(state *catalog.ServicesState, now time.Time) error {
+	stats, err := w.Source.ServerStats()
+	if err != nil {
+		metrics.IncrCounter([]string{"haproxy", "load_weights", "errors"}, 1)
+		return err
+	}
+
+	resources := make(map[string]*service.Resources)
+	state.RLock()
+	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		if svc.IsAlive() && svc.Resources != nil {
+			resources[svc.Hostname+"-"+svc.ID] = svc.Resources
+		}
+	})
+	state.RUnlock()
+
+	var exclude map[string]time.Time
+	if w.Exclude != nil {
+		exclude = w.Exclude()
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	// Smooth in the samples we haven't seen yet, and forget the servers
+	// that have gone away
+	cpu := make(map[string]float64, len(resources))
+	collected := make(map[string]time.Time, len(resources))
+	for server, res := range resources {
+		if now.Sub(res.Collected) > w.MaxAge {
+			continue
+		}
+
+		last, ok := w.cpu[server]
+		switch {
+		case !ok:
+			cpu[server] = res.CPUPercent
+		case res.Collected.After(w.collected[server]):
+			cpu[server] = w.Smoothing*res.CPUPercent + (1-w.Smoothing)*last
+		default:
+			cpu[server] = last
+		}
+		collected[server] = res.Collected
+	}
+	w.cpu = cpu
+	w.collected = collected
+
+	backends := make(map[string][]string)
+	for _, stat := range stats {
+		backends[stat.Backend] = append(backends[stat.Backend], stat.Server)
+	}
+
+	weights := make(map[string]int)
+	for backend, servers := range backends {
+		for server, weight := range w.weightsFor(servers) {
+			key := backend + "/" + server
+			if _, ok := exclude[key]; ok {
+				continue
+			}
+
+			// Only touch servers we are weighting now, or did before
+			if weight == 100 && w.weights[key] == 0 {
+				continue
+			}
+
+			if err := w.Source.SetWeight(backend, server, weight); err != nil {
+				log.Warnf("Unable to set the weight of %s: %s", key, err)
+				continue
+			}
+
+			if weight != 100 {
+				weights[key] = weight
+			}
+			if weight != w.weights[key] {
+				log.Debugf("Set the weight of %s to %d%%", key, weight)
+			}
+		}
+	}
+	w.weights = weights
+
+	metrics.SetGauge([]string{"haproxy", "load_weights", "lowered"}, float32(len(weights)))
+
+	return nil
+}
+
+// weightsFor works out the weights for the servers in one backend. A server
+// without recent Resources gets its full weight, and so does everything when
+// fewer than two servers have them.
+func (w *LoadWeigher) weightsFor(servers []string) map[string]int {
+	weights := make(map[string]int, len(servers))
+
+	least := math.Inf(1)
+	var known int
+	for _, server := range servers {
+		weights[server] = 100
+		if cpu, ok := w.cpu[server]; ok {
+			least = math.Min(least, cpu)
+			known++
+		}
+	}
+
+	if known < 2 {
+		return weights
+	}
+
+	for _, server := range servers {
+		cpu, ok := w.cpu[server]
+		if !ok {
+			continue
+		}
+
+		weight := int(math.Round(100 * (least + w.Headroom) / (cpu + w.Headroom)))
+		if weight < w.MinWeight {
+			weight = w.MinWeight
+		}
+		weights[server] = weight
+	}
+
+	return weights
+}
+
+// Weights returns the weights that are currently lowered, as backend/server
+func (w *LoadWeigher) Weights() map[string]int {
+	w.Lock()
+	defer w.Unlock()
+
+	weights := make(map[string]int, len(w.weights))
+	for key, weight := range w.weights {
+		weights[key] = weight
+	}
+
+	return weights
+}
+
+// Run adjusts the weights on each iteration of the looper
+func (w *LoadWeigher) Run(state *catalog.ServicesState, looper director.Looper) {
+	looper.Loop(func() error {
+		if err := w.Adjust(state, time.Now().UTC()); err != nil {
+			log.Warnf("Load weighting failed: %s", err)
+		}
+		return nil
+	})
+}
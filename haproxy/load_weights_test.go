@@ -0,0 +1,93 @@
+package haproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_LoadWeigher(t *testing.T) {
+	Convey("The LoadWeigher", t, func() {
+		now := time.Now().UTC()
+
+		source := &fakeStatsSource{weights: make(map[string]int), stats: []ServerStats{
+			{Backend: "web-8080", Server: "alpha-deadbeef0001"},
+			{Backend: "web-8080", Server: "beta-deadbeef0002"},
+			{Backend: "web-8080", Server: "gamma-deadbeef0003"},
+			{Backend: "db-5432", Server: "alpha-deadbeef0004"},
+		}}
+		weigher := NewLoadWeigher(source)
+
+		state := catalog.NewServicesState()
+		for _, svc := range []service.Service{
+			{ID: "deadbeef0001", Hostname: "alpha", Name: "web", Updated: now},
+			{ID: "deadbeef0002", Hostname: "beta", Name: "web", Updated: now},
+			{ID: "deadbeef0003", Hostname: "gamma", Name: "web", Updated: now},
+			{ID: "deadbeef0004", Hostname: "alpha", Name: "db", Updated: now},
+		} {
+			state.AddServiceEntry(svc)
+		}
+
+		// Sets the CPU use of a service, collected at the given time
+		cpu := func(hostname, id string, percent float64, collected time.Time) {
+			state.Servers[hostname].Services[id].Resources = &service.Resources{
+				CPUPercent: percent,
+				Collected:  collected,
+			}
+		}
+
+		Convey("lowers the weight of the busier servers in a backend", func() {
+			cpu("alpha", "deadbeef0001", 10, now)
+			cpu("beta", "deadbeef0002", 30, now)
+			cpu("gamma", "deadbeef0003", 390, now)
+			cpu("alpha", "deadbeef0004", 90, now)
+
+			So(weigher.Adjust(state, now), ShouldBeNil)
+
+			So(source.weights, ShouldResemble, map[string]int{
+				"web-8080/beta-deadbeef0002":  50,
+				"web-8080/gamma-deadbeef0003": 20,
+			})
+			So(weigher.Weights(), ShouldResemble, source.weights)
+		})
+
+		Convey("smooths the CPU use over the samples", func() {
+			cpu("alpha", "deadbeef0001", 10, now)
+			cpu("beta", "deadbeef0002", 30, now)
+			So(weigher.Adjust(state, now), ShouldBeNil)
+
+			cpu("beta", "deadbeef0002", 10, now.Add(30*time.Second))
+			So(weigher.Adjust(state, now.Add(30*time.Second)), ShouldBeNil)
+			So(source.weights["web-8080/beta-deadbeef0002"], ShouldEqual, 67)
+
+			// The same sample again doesn't count twice
+			So(weigher.Adjust(state, now.Add(time.Minute)), ShouldBeNil)
+			So(source.weights["web-8080/beta-deadbeef0002"], ShouldEqual, 67)
+		})
+
+		Convey("puts the weight back when the stats go stale", func() {
+			cpu("alpha", "deadbeef0001", 10, now)
+			cpu("beta", "deadbeef0002", 30, now)
+			So(weigher.Adjust(state, now), ShouldBeNil)
+			So(source.weights["web-8080/beta-deadbeef0002"], ShouldEqual, 50)
+
+			So(weigher.Adjust(state, now.Add(5*time.Minute)), ShouldBeNil)
+			So(source.weights["web-8080/beta-deadbeef0002"], ShouldEqual, 100)
+			So(weigher.Weights(), ShouldBeEmpty)
+		})
+
+		Convey("leaves the servers lowered by outlier detection alone", func() {
+			weigher.Exclude = func() map[string]time.Time {
+				return map[string]time.Time{"web-8080/beta-deadbeef0002": now}
+			}
+			cpu("alpha", "deadbeef0001", 10, now)
+			cpu("beta", "deadbeef0002", 30, now)
+
+			So(weigher.Adjust(state, now), ShouldBeNil)
+			So(source.weights, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,243 @@
+package haproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/events"
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Matches the parts of the HAproxy HTTP and TCP log formats that we care
+// about. The HTTP format has five timers and a status code, the TCP format
+// three timers and no status code. e.g.:
+//
+//	10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 ...
+//	10.0.1.2:33313 [06/Feb/2009:12:12:51.443] fnt bck/srv1 0/0/5007 212 --
+var requestLogMatch = regexp.MustCompile(
+	`(\S+):\d+ \[[^\]]+\] (\S+) ([^/\s]+)/(\S+) ((?:-?\d+/){2,4}-?\d+) (?:(\d{3}) )?(\d+)`,
+)
+
+// A RequestLog is the interesting bits of one HAproxy request log line
+type RequestLog struct {
+	Client    string // The address the request came from
+	Frontend  string
+	Backend   string
+	Server    string
+	Status    int // Zero for TCP logs
+	TotalTime int // Milliseconds
+	Bytes     int64
+}
+
+// ParseRequestLog parses an HAproxy request log line, which may still be
+// wrapped in its syslog header.
+func ParseRequestLog(line string) (*RequestLog, error) {
+	matches := requestLogMatch.FindStringSubmatch(line)
+	if matches == nil {
+		return nil, errors.New("not an HAproxy request log")
+	}
+
+	timers := strings.Split(matches[5], "/")
+	totalTime, _ := strconv.Atoi(timers[len(timers)-1])
+	status, _ := strconv.Atoi(matches[6])
+	bytes, _ := strconv.ParseInt(matches[7], 10, 64)
+
+	return &RequestLog{
+		Client:    strings.Trim(matches[1], "[]"),
+		Frontend:  matches[2],
+		Backend:   matches[3],
+		Server:    matches[4],
+		Status:    status,
+		TotalTime: totalTime,
+		Bytes:     bytes,
+	}, nil
+}
+
+// A LogReceiver is a minimal UDP syslog listener for HAproxy's logs. It
+// parses the request logs and re-exports per-backend request, error, and
+// latency metrics, so we get RED metrics without running another agent.
+// When it has an event Bus, slow requests, 5xx responses, and the
+// connections denied for coming from callers a service doesn't allow are
+// published as events, along with a sample of all the other requests.
+type LogReceiver struct {
+	Addr          string
+	Events        *events.Bus
+	SlowThreshold time.Duration // Zero turns off slow request events
+	SampleRate    float64       // Fraction of other requests published as events
+	sampleFn      func() float64
+	conn          net.PacketConn
+	connLock      sync.Mutex
+}
+
+// NewLogReceiver returns a LogReceiver that will listen on the address
+func NewLogReceiver(addr string) *LogReceiver {
+	return &LogReceiver{Addr: addr, sampleFn: rand.Float64}
+}
+
+// ListenAndServe receives logs until the receiver is closed
+func (r *LogReceiver) ListenAndServe() error {
+	if err := r.Listen(); err != nil {
+		return err
+	}
+
+	return r.Serve()
+}
+
+// Listen opens the socket on the Addr, so that HAproxy can send to it
+// before Serve is running
+func (r *LogReceiver) Listen() error {
+	conn, err := net.ListenPacket("udp", r.Addr)
+	if err != nil {
+		return err
+	}
+
+	r.connLock.Lock()
+	r.conn = conn
+	r.connLock.Unlock()
+
+	return nil
+}
+
+// LocalAddr returns the address the receiver is listening on, or nil when
+// it isn't listening
+func (r *LogReceiver) LocalAddr() net.Addr {
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.LocalAddr()
+}
+
+// Serve receives logs on the socket from Listen until the receiver is closed
+func (r *LogReceiver) Serve() error {
+	r.connLock.Lock()
+	conn := r.conn
+	r.connLock.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("Error serving HAproxy logs: not listening")
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		entry, err := ParseRequestLog(string(buf[:n]))
+		if err != nil {
+			log.Debugf("Skipping HAproxy log line: %s", err)
+			continue
+		}
+
+		r.record(entry)
+	}
+}
+
+// Close stops the receiver
+func (r *LogReceiver) Close() error {
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+
+	if r.conn == nil {
+		return nil
+	}
+
+	return r.conn.Close()
+}
+
+func (r *LogReceiver) record(entry *RequestLog) {
+	if svcPort, ok := deniedService(entry.Backend); ok {
+		r.recordDenied(svcPort, entry)
+		return
+	}
+
+	prefix := []string{"haproxy", "backend", entry.Backend}
+
+	metrics.IncrCounter(append(prefix, "requests"), 1)
+	metrics.AddSample(append(prefix, "latency"), float32(entry.TotalTime))
+
+	if entry.Status > 0 {
+		metrics.IncrCounter(append(prefix, "status", strconv.Itoa(entry.Status/100)+"xx"), 1)
+	}
+
+	// <NOSRV> means HAproxy had nowhere to send the request
+	if entry.Status >= 500 || entry.Server == "<NOSRV>" {
+		metrics.IncrCounter(append(prefix, "errors"), 1)
+	}
+
+	r.publish(entry)
+}
+
+// recordDenied counts a connection from a caller the service doesn't allow,
+// and publishes it as an event
+func (r *LogReceiver) recordDenied(svcPort string, entry *RequestLog) {
+	metrics.IncrCounter([]string{"haproxy", "backend", svcPort, "denied"}, 1)
+	log.Infof("Denied %s from %s, which isn't an allowed caller", svcPort, entry.Client)
+
+	if r.Events == nil {
+		return
+	}
+
+	r.Events.Publish(events.Event{
+		Type:    "CallerDenied",
+		Source:  "haproxy",
+		Subject: svcPort,
+		Message: fmt.Sprintf("%s denied %s, which isn't an allowed caller", svcPort, entry.Client),
+		Details: map[string]string{
+			"Frontend": entry.Frontend,
+			"Client":   entry.Client,
+			"Status":   strconv.Itoa(entry.Status),
+		},
+	})
+}
+
+// publish sends the request to the event Bus if it's interesting, or if it
+// was picked for the sample.
+func (r *LogReceiver) publish(entry *RequestLog) {
+	if r.Events == nil {
+		return
+	}
+
+	latency := time.Duration(entry.TotalTime) * time.Millisecond
+
+	var evtType, message string
+	switch {
+	case entry.Status >= 500:
+		evtType = "ServerError"
+		message = fmt.Sprintf("%s returned %d from %s", entry.Backend, entry.Status, entry.Server)
+	case r.SlowThreshold > 0 && latency >= r.SlowThreshold:
+		evtType = "SlowRequest"
+		message = fmt.Sprintf("%s took %s on %s", entry.Backend, latency, entry.Server)
+	case r.SampleRate > 0 && r.sampleFn() < r.SampleRate:
+		evtType = "Request"
+		message = fmt.Sprintf("%s served in %s by %s", entry.Backend, latency, entry.Server)
+	default:
+		return
+	}
+
+	r.Events.Publish(events.Event{
+		Type:    evtType,
+		Source:  "haproxy",
+		Subject: entry.Backend,
+		Message: message,
+		Details: map[string]string{
+			"Frontend": entry.Frontend,
+			"Server":   entry.Server,
+			"Status":   strconv.Itoa(entry.Status),
+			"Latency":  latency.String(),
+			"Bytes":    strconv.FormatInt(entry.Bytes, 10),
+		},
+	})
+}
@@ -0,0 +1,164 @@
+package haproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/events"
+	"github.com/armon/go-metrics"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseRequestLog(t *testing.T) {
+	Convey("ParseRequestLog()", t, func() {
+		Convey("parses HTTP logs inside a syslog header", func() {
+			line := "<134>Feb  6 12:14:14 haproxy[14389]: 10.0.1.2:33317 [06/Feb/2009:12:14:14.655] " +
+				"awesome-svc-8080 awesome-svc-8080/indefatigable-deadbeef123 10/0/30/69/109 503 2750 - - ---- " +
+				`1/1/1/1/0 0/0 "GET /index.html HTTP/1.1"`
+
+			entry, err := ParseRequestLog(line)
+			So(err, ShouldBeNil)
+			So(entry, ShouldResemble, &RequestLog{
+				Client:    "10.0.1.2",
+				Frontend:  "awesome-svc-8080",
+				Backend:   "awesome-svc-8080",
+				Server:    "indefatigable-deadbeef123",
+				Status:    503,
+				TotalTime: 109,
+				Bytes:     2750,
+			})
+		})
+
+		Convey("parses TCP logs", func() {
+			line := "haproxy[14387]: 10.0.1.2:33313 [06/Feb/2009:12:12:51.443] fnt bck/srv1 0/0/5007 212 -- 0/0/0/0/3 0/0"
+
+			entry, err := ParseRequestLog(line)
+			So(err, ShouldBeNil)
+			So(entry.Backend, ShouldEqual, "bck")
+			So(entry.Status, ShouldEqual, 0)
+			So(entry.TotalTime, ShouldEqual, 5007)
+			So(entry.Bytes, ShouldEqual, 212)
+		})
+
+		Convey("takes the brackets off IPv6 clients", func() {
+			line := "haproxy[14387]: [fd00::2]:33313 [06/Feb/2009:12:12:51.443] fnt bck/srv1 0/0/5007 212 -- 0/0/0/0/3 0/0"
+
+			entry, err := ParseRequestLog(line)
+			So(err, ShouldBeNil)
+			So(entry.Client, ShouldEqual, "fd00::2")
+		})
+
+		Convey("rejects other log lines", func() {
+			_, err := ParseRequestLog("haproxy[14387]: Proxy awesome-svc-8080 started.")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_LogReceiver(t *testing.T) {
+	Convey("The LogReceiver", t, func() {
+		sink := metrics.NewInmemSink(time.Minute, time.Minute)
+		metricsConfig := metrics.DefaultConfig("sidecar")
+		metricsConfig.EnableHostname = false
+		metricsConfig.EnableRuntimeMetrics = false
+		metrics.NewGlobal(metricsConfig, sink)
+		defer metrics.NewGlobal(metricsConfig, &metrics.BlackholeSink{})
+
+		Convey("records per-backend metrics from the logs", func() {
+			receiver := NewLogReceiver("127.0.0.1:0")
+			So(receiver.Listen(), ShouldBeNil)
+			go receiver.Serve()
+			defer receiver.Close()
+
+			conn, err := net.Dial("udp", receiver.LocalAddr().String())
+			So(err, ShouldBeNil)
+			conn.Write([]byte("haproxy[1]: 10.0.1.2:33317 [06/Feb/2009:12:14:14.655] web web/<NOSRV> 0/-1/-1/-1/3 503 212"))
+			conn.Close()
+
+			var counters map[string]metrics.SampledValue
+			for i := 0; i < 100; i++ {
+				// Other tests' goroutines may record metrics too, so wait
+				// for ours
+				counters = sink.Data()[0].Counters
+				if _, ok := counters["sidecar.haproxy.backend.web.errors"]; ok {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			So(counters["sidecar.haproxy.backend.web.requests"].Count, ShouldEqual, 1)
+			So(counters["sidecar.haproxy.backend.web.status.5xx"].Count, ShouldEqual, 1)
+			So(counters["sidecar.haproxy.backend.web.errors"].Count, ShouldEqual, 1)
+		})
+
+		Convey("won't serve before it listens", func() {
+			receiver := NewLogReceiver("127.0.0.1:0")
+			So(receiver.LocalAddr(), ShouldBeNil)
+			So(receiver.Serve(), ShouldNotBeNil)
+			So(receiver.Close(), ShouldBeNil)
+		})
+	})
+}
+
+func Test_LogReceiverEvents(t *testing.T) {
+	Convey("Publishing request events", t, func() {
+		bus := events.NewBus(10)
+		receiver := NewLogReceiver("127.0.0.1:0")
+		receiver.Events = bus
+		receiver.SlowThreshold = time.Second
+		receiver.sampleFn = func() float64 { return 0.5 }
+
+		entry := &RequestLog{Frontend: "web", Backend: "web", Server: "srv1", Status: 200, TotalTime: 20}
+
+		Convey("publishes 5xx responses", func() {
+			entry.Status = 502
+			receiver.publish(entry)
+
+			recent := bus.Recent()
+			So(len(recent), ShouldEqual, 1)
+			So(recent[0].Type, ShouldEqual, "ServerError")
+			So(recent[0].Subject, ShouldEqual, "web")
+			So(recent[0].Details["Status"], ShouldEqual, "502")
+		})
+
+		Convey("publishes slow requests", func() {
+			entry.TotalTime = 1500
+			receiver.publish(entry)
+
+			recent := bus.Recent()
+			So(len(recent), ShouldEqual, 1)
+			So(recent[0].Type, ShouldEqual, "SlowRequest")
+			So(recent[0].Details["Latency"], ShouldEqual, "1.5s")
+		})
+
+		Convey("skips normal requests unless sampled", func() {
+			receiver.publish(entry)
+			So(len(bus.Recent()), ShouldEqual, 0)
+
+			receiver.SampleRate = 0.75
+			receiver.publish(entry)
+			So(len(bus.Recent()), ShouldEqual, 1)
+			So(bus.Recent()[0].Type, ShouldEqual, "Request")
+		})
+
+		Convey("publishes the denied callers instead of the request", func() {
+			receiver.record(&RequestLog{
+				Client: "10.0.1.2", Frontend: "web-8080", Backend: "denied-web-8080", Server: "<NOSRV>", Status: 403,
+			})
+
+			recent := bus.Recent()
+			So(len(recent), ShouldEqual, 1)
+			So(recent[0].Type, ShouldEqual, "CallerDenied")
+			So(recent[0].Subject, ShouldEqual, "web-8080")
+			So(recent[0].Details["Client"], ShouldEqual, "10.0.1.2")
+		})
+
+		Convey("does nothing without a Bus", func() {
+			receiver.Events = nil
+			entry.Status = 500
+			receiver.publish(entry)
+			So(len(bus.Recent()), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NinesStack/sidecar/service"
+)
+
+// A templateMesh is what the template needs for the mesh frontend, which
+// takes the mutual TLS connections from the other hosts' HAproxies and hands
+// them to the instances on this host, by the SNI they asked for
+type templateMesh struct {
+	Port        int
+	Binds       []string
+	Cert        string
+	CA          string
+	RequestLogs bool
+	Routes      []templateMeshRoute
+}
+
+// A templateMeshRoute is one port of a local instance in the mesh frontend
+type templateMeshRoute struct {
+	SNI     string
+	Backend string
+	Addr    string // The instance's own address and port
+}
+
+// A templateMeshServer is what a server line needs to reach an instance on
+// another host through that host's mesh frontend
+type templateMeshServer struct {
+	Port       int
+	Cert       string
+	CA         string
+	SNI        string
+	VerifyHost string // The name the other host's certificate has to have
+}
+
+// meshSNI names a port of an instance, for the mesh frontend on its host to
+// route by
+func meshSNI(svc *service.Service, svcPort string) string {
+	return sanitizeName(strings.ToLower(svc.Hostname+"-"+svc.ID)) + "-" + svcPort
+}
+
+// meshIn returns the routes of the mesh frontend to each port of the
+// instances rendered for this host, or nil when the mesh is off. It fails
+// when another frontend would bind the MeshPort.
+func (h *HAproxy) meshIn(hostname string, services map[string][]*service.Service, ports portmap) (*templateMesh, error) {
+	if h.MeshPort < 1 {
+		return nil, nil
+	}
+
+	meshPort := strconv.Itoa(h.MeshPort)
+	if h.MeshPort == h.VirtualHostPort || h.MeshPort == h.SNIPort {
+		return nil, fmt.Errorf("Error rendering the mesh: port %s is also the virtual host or SNI port", meshPort)
+	}
+	for svcName, svcPorts := range ports {
+		if _, ok := svcPorts[meshPort]; ok {
+			return nil, fmt.Errorf("Error rendering the mesh: port %s is a ServicePort of %s", meshPort, svcName)
+		}
+	}
+
+	mesh := &templateMesh{
+		Port:        h.MeshPort,
+		Binds:       h.meshBinds(),
+		Cert:        h.MeshCertFile,
+		CA:          h.MeshCAFile,
+		RequestLogs: h.RequestLogs,
+	}
+
+	for svcName, svcList := range services {
+		for _, svc := range svcList {
+			if svc.Hostname != hostname {
+				continue
+			}
+			for svcPort := range ports[svcName] {
+				port := findPortForService(svcPort, svc)
+				if port == "" {
+					continue
+				}
+				sni := meshSNI(svc, svcPort)
+				mesh.Routes = append(mesh.Routes, templateMeshRoute{
+					SNI:     sni,
+					Backend: "mesh-" + sni,
+					Addr:    hostPort(h.findIpForService(svcPort, svc), port),
+				})
+			}
+		}
+	}
+
+	sort.Slice(mesh.Routes, func(i, j int) bool { return mesh.Routes[i].SNI < mesh.Routes[j].SNI })
+
+	return mesh, nil
+}
+
+// meshFor returns how a server line reaches an instance through the mesh,
+// or nil when the mesh is off or the instance is on this host
+func (h *HAproxy) meshFor(hostname string, svc *service.Service, svcPort string) *templateMeshServer {
+	if h.MeshPort < 1 || svc.Hostname == hostname {
+		return nil
+	}
+
+	return &templateMeshServer{
+		Port:       h.MeshPort,
+		Cert:       h.MeshCertFile,
+		CA:         h.MeshCAFile,
+		SNI:        meshSNI(svc, svcPort),
+		VerifyHost: svc.Hostname,
+	}
+}
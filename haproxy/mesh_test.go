@@ -0,0 +1,80 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Mesh(t *testing.T) {
+	Convey("The mesh", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		baseTime := time.Now().UTC()
+		state := catalog.NewServicesState()
+		state.Hostname = hostname1
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef001", Name: "web", Hostname: hostname1, Updated: baseTime, ProxyMode: "http",
+			Ports: []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "10.0.0.1"}},
+		})
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef002", Name: "web", Hostname: "Beta", Updated: baseTime, ProxyMode: "http",
+			Ports: []service.Port{{Type: "tcp", Port: 10451, ServicePort: 8080, IP: "10.0.0.2"}},
+		})
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("isn't rendered when it's off", func() {
+			config := render()
+			So(config, ShouldNotContainSubstring, "mesh")
+			So(config, ShouldContainSubstring, "\tserver Beta-deadbeef002 10.0.0.2:10451 cookie Beta-10451 \n")
+		})
+
+		Convey("when it's on", func() {
+			proxy.MeshPort = 15443
+			proxy.MeshCertFile = "/etc/sidecar/mesh.pem"
+			proxy.MeshCAFile = "/etc/sidecar/ca.pem"
+
+			Convey("terminates mutual TLS for the local instances", func() {
+				So(render(), ShouldContainSubstring, "frontend mesh-in\n\tmode tcp\n"+
+					"\tbind 0.0.0.0:15443 ssl crt /etc/sidecar/mesh.pem ca-file /etc/sidecar/ca.pem verify required\n"+
+					"\tuse_backend mesh-indomitable-deadbeef001-8080 if { ssl_fc_sni -i indomitable-deadbeef001-8080 }\n"+
+					"\nbackend mesh-indomitable-deadbeef001-8080\n\tmode tcp\n\tserver local 10.0.0.1:10450\n")
+			})
+
+			Convey("sends the traffic to other hosts over mutual TLS", func() {
+				config := render()
+				So(config, ShouldContainSubstring, "\tserver Beta-deadbeef002 10.0.0.2:15443 cookie Beta-10451 "+
+					"ssl crt /etc/sidecar/mesh.pem ca-file /etc/sidecar/ca.pem verify required "+
+					"sni str(beta-deadbeef002-8080) verifyhost Beta \n")
+				So(config, ShouldContainSubstring, "\tserver indomitable-deadbeef001 10.0.0.1:10450 cookie indomitable-10450 \n")
+				So(config, ShouldNotContainSubstring, "mesh-beta")
+			})
+
+			Convey("won't share its port", func() {
+				buf := bytes.NewBuffer(make([]byte, 0, 4096))
+
+				proxy.MeshPort = 8080
+				So(proxy.WriteConfig(state, buf), ShouldNotBeNil)
+
+				proxy.MeshPort = 443
+				proxy.SNIPort = 443
+				So(proxy.WriteConfig(state, buf), ShouldNotBeNil)
+			})
+		})
+	})
+}
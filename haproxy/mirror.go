@@ -0,0 +1,151 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// A templateMirror is what a frontend needs to have the SPOE agent send a
+// copy of a percentage of its requests to the frontend of a shadow service
+type templateMirror struct {
+	*templateSPOE
+	Backend string // The shadow's backend, e.g. web-next-9080
+	Addr    string // Where the shadow's frontend listens, for the agent
+	Percent uint32
+	Filter  bool // Whether the frontend needs the SPOE filter for it
+}
+
+// getMirrors returns where each service mirrors its requests to, taken
+// from its most recently updated instance, and the warnings for the
+// settings that can't be parsed
+func getMirrors(state *catalog.ServicesState) (map[string]*service.Mirror, []ConfigWarning) {
+	settings := newestMetadata(state, service.MirrorToKey, service.MirrorPercentKey)
+
+	svcNames := make([]string, 0, len(settings))
+	for svcName := range settings {
+		svcNames = append(svcNames, svcName)
+	}
+	sort.Strings(svcNames)
+
+	mirrors := make(map[string]*service.Mirror)
+	var warnings []ConfigWarning
+	for _, svcName := range svcNames {
+		svc := service.Service{Metadata: settings[svcName]}
+		mirror, err := svc.Mirror()
+		if err != nil {
+			warnings = append(warnings, ConfigWarning{Service: svcName, Kind: WarnMirror, Message: err.Error()})
+			continue
+		}
+		if mirror != nil {
+			mirrors[svcName] = mirror
+		}
+	}
+
+	return mirrors, warnings
+}
+
+// mirrorsFor works out the mirroring for each of the services' frontends,
+// by service and port. The requests can only be mirrored by the SPOE agent,
+// between HTTP services, to a shadow with a frontend on the port. The rest
+// are left out with a warning.
+func (h *HAproxy) mirrorsFor(mirrors map[string]*service.Mirror, ports portmap, modes map[string]string,
+	binds map[string][]string, families map[string]string,
+	decisions map[string]bool) (map[string]map[string]*templateMirror, []ConfigWarning) {
+
+	agent := h.spoe()
+	result := make(map[string]map[string]*templateMirror)
+	var warnings []ConfigWarning
+
+	svcNames := make([]string, 0, len(mirrors))
+	for svcName := range mirrors {
+		svcNames = append(svcNames, svcName)
+	}
+	sort.Strings(svcNames)
+
+	for _, svcName := range svcNames {
+		mirror := mirrors[svcName]
+		if _, ok := ports[svcName]; !ok {
+			continue
+		}
+
+		warn := func(message string) {
+			warnings = append(warnings, ConfigWarning{Service: svcName, Kind: WarnMirror, Message: message})
+		}
+
+		if agent == nil {
+			warn("Mirroring requests with HAproxy needs the SPOE agent, set HAPROXY_SPOE_AGENT_ADDR")
+			continue
+		}
+		if modes[svcName] != "http" || modes[mirror.Service] != "http" {
+			warn(fmt.Sprintf("Only HTTP requests can be mirrored, and '%s' or '%s' isn't in http mode",
+				svcName, mirror.Service))
+			continue
+		}
+
+		var missing []string
+		for _, svcPort := range sortedPorts(ports[svcName]) {
+			port := svcPort
+			if mirror.Port != 0 {
+				port = strconv.FormatInt(mirror.Port, 10)
+			}
+			if mirror.Service == svcName && port == svcPort {
+				continue
+			}
+			if _, ok := ports[mirror.Service][port]; !ok {
+				missing = append(missing, port)
+				continue
+			}
+
+			addresses, ok := binds[mirror.Service]
+			if !ok {
+				addresses = h.bindAddresses(families[mirror.Service])
+			}
+			if len(addresses) < 1 {
+				continue
+			}
+
+			if result[svcName] == nil {
+				result[svcName] = make(map[string]*templateMirror)
+			}
+			result[svcName][svcPort] = &templateMirror{
+				templateSPOE: agent,
+				Backend:      sanitizeName(mirror.Service) + "-" + port,
+				Addr:         localAddress(addresses[0]) + ":" + port,
+				Percent:      mirror.Percent,
+				Filter:       !decisions[svcName],
+			}
+		}
+
+		if len(missing) > 0 {
+			warn(fmt.Sprintf("The mirror '%s' has no frontend on port %v", mirror.Service, missing))
+		}
+	}
+
+	return result, warnings
+}
+
+// localAddress returns an address the agent can reach a frontend bound to
+// the address at, using the loopback address for the wildcards
+func localAddress(address string) string {
+	switch address {
+	case "", "*", "0.0.0.0":
+		return "127.0.0.1"
+	case "[::]":
+		return "[::1]"
+	}
+	return address
+}
+
+// sortedPorts returns the ServicePorts in a portset in order
+func sortedPorts(ports portset) []string {
+	sorted := make([]string, 0, len(ports))
+	for svcPort := range ports {
+		sorted = append(sorted, svcPort)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
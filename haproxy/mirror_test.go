@@ -0,0 +1,99 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Mirrors(t *testing.T) {
+	Convey("Mirroring requests", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		var added int
+		add := func(id string, name string, mode string, metadata map[string]string, svcPort int64) {
+			added++
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, ProxyMode: mode, Metadata: metadata,
+				Ports:   []service.Port{{Type: "tcp", Port: 10450 + int64(added), ServicePort: svcPort, IP: "127.0.0.1"}},
+				Updated: baseTime.Add(time.Duration(added) * time.Second),
+			})
+		}
+		add("deadbeef001", "web", "http", map[string]string{"MirrorTo": "web-next:9080", "MirrorPercent": "10"}, 8080)
+		add("deadbeef002", "web-next", "http", nil, 9080)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("warns that it needs the SPOE agent", func() {
+			So(render(), ShouldNotContainSubstring, "mirror")
+
+			warnings := proxy.Warnings()
+			So(warnings, ShouldHaveLength, 1)
+			So(warnings[0].Service, ShouldEqual, "web")
+			So(warnings[0].Kind, ShouldEqual, WarnMirror)
+			So(warnings[0].Message, ShouldContainSubstring, "HAPROXY_SPOE_AGENT_ADDR")
+		})
+
+		Convey("with the SPOE agent", func() {
+			proxy.SPOEAgent = "127.0.0.1:7780"
+			proxy.SPOEConfigFile = "/etc/haproxy-spoe.conf"
+
+			Convey("has it send a sample of the requests to the shadow's frontend", func() {
+				So(render(), ShouldContainSubstring, "frontend web-8080\n\tmode http\n\tbind 192.168.168.168:8080\n"+
+					"\tfilter spoe engine sidecar config /etc/haproxy-spoe.conf\n"+
+					"\toption http-buffer-request\n"+
+					"\thttp-request set-var(txn.sidecar_mirror) str(192.168.168.168:9080) if { rand(100) lt 10 }\n"+
+					"\thttp-request send-spoe-group sidecar mirror if { var(txn.sidecar_mirror) -m found }\n"+
+					"\tdefault_backend web-8080\n")
+				So(proxy.Warnings(), ShouldBeEmpty)
+			})
+
+			Convey("shares the filter with the decisions", func() {
+				add("deadbeef001", "web", "http", map[string]string{"MirrorTo": "web-next:9080", "RateLimit": "100/s"}, 8080)
+
+				config := render()
+				So(bytes.Count([]byte(config), []byte("filter spoe")), ShouldEqual, 1)
+				So(config, ShouldContainSubstring, "\thttp-request set-var(txn.sidecar_mirror) str(192.168.168.168:9080)\n")
+			})
+
+			Convey("sends them to the loopback address when binding the wildcard", func() {
+				proxy.BindIP = "0.0.0.0"
+				So(render(), ShouldContainSubstring, "set-var(txn.sidecar_mirror) str(127.0.0.1:9080)")
+			})
+
+			Convey("warns about shadows without a frontend on the port", func() {
+				add("deadbeef001", "web", "http", map[string]string{"MirrorTo": "web-next:9999"}, 8080)
+
+				So(render(), ShouldNotContainSubstring, "txn.sidecar_mirror")
+				warnings := proxy.Warnings()
+				So(warnings, ShouldHaveLength, 1)
+				So(warnings[0].Message, ShouldEqual, "The mirror 'web-next' has no frontend on port [9999]")
+			})
+
+			Convey("warns about services that aren't HTTP", func() {
+				add("deadbeef002", "web-next", "tcp", nil, 9080)
+
+				So(render(), ShouldNotContainSubstring, "txn.sidecar_mirror")
+				warnings := proxy.Warnings()
+				So(warnings, ShouldHaveLength, 1)
+				So(warnings[0].Kind, ShouldEqual, WarnMirror)
+			})
+		})
+	})
+}
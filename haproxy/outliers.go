@@ -0,0 +1,359 @@
+package haproxy
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/events"
+	"github.com/armon/go-metrics"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The default path of HAproxy's admin socket
+	DefaultStatsSocket = "/var/run/haproxy_stats.sock"
+	// How long we wait on the admin socket
+	statsSocketTimeout = 2 * time.Second
+	// The type field of server rows in the stats
+	statsTypeServer = "2"
+)
+
+// ServerStats are the counters HAproxy keeps for one server in a backend.
+// They count up from when HAproxy was last started.
+type ServerStats struct {
+	Backend  string
+	Server   string
+	Requests int64 // Responses for HTTP backends, sessions for TCP ones
+	Errors   int64 // 5xx responses, plus connection and response errors
+}
+
+// A StatsSocket talks to HAproxy over its admin socket
+type StatsSocket struct {
+	Path string
+}
+
+// ServerStats returns the counters for all of the servers in all of the
+// backends, from "show stat"
+func (s *StatsSocket) ServerStats() ([]ServerStats, error) {
+	output, err := s.command("show stat")
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseServerStats(output)
+}
+
+// SetWeight sets the weight of a server as a percentage of the weight it
+// was configured with
+func (s *StatsSocket) SetWeight(backend string, server string, percent int) error {
+	output, err := s.command(fmt.Sprintf("set weight %s/%s %d%%", backend, server, percent))
+	if err != nil {
+		return err
+	}
+
+	// HAproxy says nothing when the command works
+	if msg := strings.TrimSpace(string(output)); msg != "" {
+		return fmt.Errorf("Error setting weight of %s/%s: %s", backend, server, msg)
+	}
+
+	return nil
+}
+
+func (s *StatsSocket) command(cmd string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", s.Path, statsSocketTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to HAproxy stats socket: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(statsSocketTimeout))
+
+	if _, err := io.WriteString(conn, cmd+"\n"); err != nil {
+		return nil, fmt.Errorf("Error sending '%s' to HAproxy: %s", cmd, err)
+	}
+
+	output, err := ioutil.ReadAll(bufio.NewReader(conn))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response to '%s' from HAproxy: %s", cmd, err)
+	}
+
+	return output, nil
+}
+
+// ParseServerStats parses the CSV output of "show stat", keeping only the
+// server rows
+func ParseServerStats(output []byte) ([]ServerStats, error) {
+	rows, err := parseStats(output, "stot")
+	if err != nil || len(rows) < 1 {
+		return nil, err
+	}
+
+	var stats []ServerStats
+	for _, row := range rows {
+		if row["type"] != statsTypeServer {
+			continue
+		}
+
+		var responses int64
+		for _, name := range []string{"hrsp_1xx", "hrsp_2xx", "hrsp_3xx", "hrsp_4xx", "hrsp_5xx", "hrsp_other"} {
+			responses += row.Int(name)
+		}
+
+		requests := row.Int("stot")
+		if responses > 0 {
+			requests = responses + row.Int("eresp")
+		}
+
+		stats = append(stats, ServerStats{
+			Backend:  row["pxname"],
+			Server:   row["svname"],
+			Requests: requests,
+			Errors:   row.errors(),
+		})
+	}
+
+	return stats, nil
+}
+
+// A statsRow is one row of the output of "show stat", by column
+type statsRow map[string]string
+
+// Int returns a counter from the row, or 0 when it has none
+func (r statsRow) Int(name string) int64 {
+	value, _ := strconv.ParseInt(r[name], 10, 64)
+	return value
+}
+
+// errors adds up the 5xx responses and the connection and response errors
+func (r statsRow) errors() int64 {
+	return r.Int("hrsp_5xx") + r.Int("econ") + r.Int("eresp")
+}
+
+// parseStats parses the CSV output of "show stat" into its rows, making
+// sure it has the naming columns and the required ones
+func parseStats(output []byte, required ...string) ([]statsRow, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(output), "# ")))
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing HAproxy stats: %s", err)
+	}
+	if len(records) < 1 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int, len(records[0]))
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, name := range append([]string{"pxname", "svname", "type"}, required...) {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("Error parsing HAproxy stats: no %s column", name)
+		}
+	}
+
+	rows := make([]statsRow, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(statsRow, len(columns))
+		for name, i := range columns {
+			if i < len(record) {
+				row[name] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// A StatsSource is where the OutlierDetector gets server stats from, and
+// where it sets their weights. Usually a StatsSocket.
+type StatsSource interface {
+	ServerStats() ([]ServerStats, error)
+	SetWeight(backend string, server string, percent int) error
+}
+
+// An OutlierDetector watches the error rates of the servers in each backend
+// and lowers the weight of any that are failing much more than the rest of
+// their backend, even while their health checks pass. Their weight is put
+// back after the Cooldown, and lowered again if they are still failing.
+type OutlierDetector struct {
+	Source      StatsSource
+	Events      *events.Bus
+	ErrorRate   float64       // The error rate that makes a server an outlier
+	MinRequests int64         // Fewer requests than this in an interval are ignored
+	Weight      int           // The percentage weight outliers are lowered to
+	Cooldown    time.Duration // How long outliers stay lowered
+	previous    map[string]ServerStats
+	lowered     map[string]time.Time
+	sync.Mutex
+}
+
+// NewOutlierDetector returns an OutlierDetector with the default settings
+func NewOutlierDetector(source StatsSource) *OutlierDetector {
+	return &OutlierDetector{
+		Source:      source,
+		ErrorRate:   0.5,
+		MinRequests: 20,
+		Weight:      10,
+		Cooldown:    time.Minute,
+		previous:    make(map[string]ServerStats),
+		lowered:     make(map[string]time.Time),
+	}
+}
+
+// A server's requests and errors over one interval
+type serverInterval struct {
+	ServerStats
+	rate float64
+}
+
+// Detect compares the stats with the ones from the last run, lowers the
+// weight of new outliers, and restores the weight of the ones that have
+// cooled down
+func (d *OutlierDetector) Detect(now time.Time) error {
+	stats, err := d.Source.ServerStats()
+	if err != nil {
+		metrics.IncrCounter([]string{"haproxy", "outliers", "errors"}, 1)
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	backends := make(map[string][]serverInterval)
+	current := make(map[string]ServerStats, len(stats))
+	for _, stat := range stats {
+		key := stat.Backend + "/" + stat.Server
+		current[key] = stat
+
+		interval := stat
+		if last, ok := d.previous[key]; ok && last.Requests <= stat.Requests && last.Errors <= stat.Errors {
+			interval.Requests -= last.Requests
+			interval.Errors -= last.Errors
+		} // Otherwise HAproxy was restarted and the counters started over
+
+		if interval.Requests < d.MinRequests {
+			continue
+		}
+		backends[stat.Backend] = append(backends[stat.Backend], serverInterval{
+			ServerStats: interval,
+			rate:        float64(interval.Errors) / float64(interval.Requests),
+		})
+	}
+	d.previous = current
+
+	for key, since := range d.lowered {
+		if now.Sub(since) < d.Cooldown {
+			continue
+		}
+		// A server that has gone away is dropped either way
+		if stat, ok := current[key]; ok {
+			if err := d.Source.SetWeight(stat.Backend, stat.Server, 100); err != nil {
+				log.Warnf("Unable to restore the weight of outlier %s: %s", key, err)
+				continue
+			}
+			log.Infof("Restored the weight of outlier %s", key)
+		}
+		delete(d.lowered, key)
+	}
+
+	for _, servers := range backends {
+		for _, outlier := range d.outliers(servers) {
+			d.lower(outlier, now)
+		}
+	}
+
+	return nil
+}
+
+// outliers returns the servers in a backend whose error rate is over the
+// threshold while the rest of the backend's is under it. At most half of
+// the servers are outliers, so a backend that is failing as a whole keeps
+// its weights.
+func (d *OutlierDetector) outliers(servers []serverInterval) []serverInterval {
+	var outliers []serverInterval
+	var requests, errors int64
+	for _, server := range servers {
+		if server.rate >= d.ErrorRate {
+			outliers = append(outliers, server)
+			continue
+		}
+		requests += server.Requests
+		errors += server.Errors
+	}
+
+	if requests == 0 || float64(errors)/float64(requests) >= d.ErrorRate || len(outliers)*2 > len(servers) {
+		return nil
+	}
+
+	return outliers
+}
+
+func (d *OutlierDetector) lower(outlier serverInterval, now time.Time) {
+	key := outlier.Backend + "/" + outlier.Server
+	if _, ok := d.lowered[key]; ok {
+		return
+	}
+
+	if err := d.Source.SetWeight(outlier.Backend, outlier.Server, d.Weight); err != nil {
+		log.Warnf("Unable to lower the weight of outlier %s: %s", key, err)
+		return
+	}
+	d.lowered[key] = now
+
+	log.Warnf("Lowered the weight of %s to %d%%, %d of %d requests failed",
+		key, d.Weight, outlier.Errors, outlier.Requests)
+	metrics.IncrCounter([]string{"haproxy", "outliers", "lowered"}, 1)
+
+	if d.Events == nil {
+		return
+	}
+	d.Events.Publish(events.Event{
+		Time:    now,
+		Type:    "OutlierLowered",
+		Source:  "haproxy",
+		Subject: outlier.Backend,
+		Message: fmt.Sprintf("Lowered the weight of %s, %d of %d requests failed", key, outlier.Errors, outlier.Requests),
+		Details: map[string]string{
+			"Backend":  outlier.Backend,
+			"Server":   outlier.Server,
+			"Errors":   strconv.FormatInt(outlier.Errors, 10),
+			"Requests": strconv.FormatInt(outlier.Requests, 10),
+		},
+	})
+}
+
+// Lowered returns the servers whose weight is currently lowered, as
+// backend/server, with when they were lowered
+func (d *OutlierDetector) Lowered() map[string]time.Time {
+	d.Lock()
+	defer d.Unlock()
+
+	lowered := make(map[string]time.Time, len(d.lowered))
+	for key, since := range d.lowered {
+		lowered[key] = since
+	}
+
+	return lowered
+}
+
+// Run looks for outliers on each iteration of the looper
+func (d *OutlierDetector) Run(looper director.Looper) {
+	looper.Loop(func() error {
+		if err := d.Detect(time.Now().UTC()); err != nil {
+			log.Warnf("Outlier detection failed: %s", err)
+		}
+		return nil
+	})
+}
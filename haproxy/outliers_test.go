@@ -0,0 +1,156 @@
+package haproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/events"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const showStat = `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,weight,act,bck,chkfail,chkdown,lastchg,downtime,qlimit,pid,iid,sid,throttle,lbtot,tracked,type,rate,rate_lim,rate_max,check_status,check_code,check_duration,hrsp_1xx,hrsp_2xx,hrsp_3xx,hrsp_4xx,hrsp_5xx,hrsp_other
+web-8080,FRONTEND,,,0,3,4096,120,0,0,0,0,0,,,,,OPEN,,,,,,,,,1,2,0,,,,0,0,0,2,,,,0,100,0,0,20,0
+web-8080,alpha-deadbeef0001,0,0,0,1,,60,0,0,,0,,0,0,0,0,UP,1,1,0,0,0,10,0,,1,3,1,,60,,2,0,,1,L4OK,,0,0,59,0,0,1,0
+web-8080,beta-deadbeef0002,0,0,0,1,,60,0,0,,0,,1,2,0,0,UP,1,1,0,0,0,10,0,,1,3,2,,60,,2,0,,1,L4OK,,0,0,41,0,0,19,0
+web-8080,BACKEND,0,0,0,3,410,120,0,0,0,0,,1,2,0,0,UP,2,2,0,,0,10,0,,1,3,0,,120,,1,0,,2,,,,0,100,0,0,20,0
+db-5432,gamma-deadbeef0003,0,0,0,1,,30,0,0,,0,,0,0,0,0,UP,1,1,0,0,0,10,0,,1,4,1,,30,,2,0,,1,L4OK,,0,0,0,0,0,0,0
+`
+
+// A StatsSource that serves up canned stats and records the weights set
+type fakeStatsSource struct {
+	stats   []ServerStats
+	weights map[string]int
+}
+
+func (f *fakeStatsSource) ServerStats() ([]ServerStats, error) {
+	return f.stats, nil
+}
+
+func (f *fakeStatsSource) SetWeight(backend string, server string, percent int) error {
+	f.weights[backend+"/"+server] = percent
+	return nil
+}
+
+func Test_ParseServerStats(t *testing.T) {
+	Convey("ParseServerStats()", t, func() {
+		Convey("returns the counters for the servers", func() {
+			stats, err := ParseServerStats([]byte(showStat))
+			So(err, ShouldBeNil)
+			So(stats, ShouldResemble, []ServerStats{
+				{Backend: "web-8080", Server: "alpha-deadbeef0001", Requests: 60, Errors: 1},
+				{Backend: "web-8080", Server: "beta-deadbeef0002", Requests: 62, Errors: 22},
+				{Backend: "db-5432", Server: "gamma-deadbeef0003", Requests: 30, Errors: 0},
+			})
+		})
+
+		Convey("returns an error for output that isn't stats", func() {
+			_, err := ParseServerStats([]byte("Unknown command.\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_StatsSocket(t *testing.T) {
+	Convey("StatsSocket", t, func() {
+		dir, _ := ioutil.TempDir("", "stats")
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "haproxy.sock")
+		listener, err := net.Listen("unix", path)
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		commands := make(chan string, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			cmd, _ := bufio.NewReader(conn).ReadString('\n')
+			commands <- cmd
+			if cmd == "show stat\n" {
+				conn.Write([]byte(showStat))
+			}
+		}()
+
+		socket := &StatsSocket{Path: path}
+
+		Convey("fetches the server stats", func() {
+			stats, err := socket.ServerStats()
+			So(err, ShouldBeNil)
+			So(len(stats), ShouldEqual, 3)
+		})
+
+		Convey("sets the weight of a server", func() {
+			So(socket.SetWeight("web-8080", "beta-deadbeef0002", 10), ShouldBeNil)
+			So(<-commands, ShouldEqual, "set weight web-8080/beta-deadbeef0002 10%\n")
+		})
+	})
+}
+
+func Test_OutlierDetector(t *testing.T) {
+	Convey("OutlierDetector", t, func() {
+		source := &fakeStatsSource{weights: make(map[string]int)}
+		detector := NewOutlierDetector(source)
+		bus := events.NewBus(10)
+		detector.Events = bus
+
+		now := time.Now().UTC()
+		stats := func(alpha, beta, gamma ServerStats) {
+			alpha.Backend, alpha.Server = "web-8080", "alpha"
+			beta.Backend, beta.Server = "web-8080", "beta"
+			gamma.Backend, gamma.Server = "web-8080", "gamma"
+			source.stats = []ServerStats{alpha, beta, gamma}
+		}
+
+		// A baseline, so the next run looks at the difference
+		stats(ServerStats{Requests: 100}, ServerStats{Requests: 100}, ServerStats{Requests: 100})
+		So(detector.Detect(now), ShouldBeNil)
+
+		Convey("lowers the weight of a server failing more than the rest", func() {
+			stats(ServerStats{Requests: 200, Errors: 2}, ServerStats{Requests: 200, Errors: 60}, ServerStats{Requests: 200})
+			So(detector.Detect(now.Add(10*time.Second)), ShouldBeNil)
+
+			So(source.weights, ShouldResemble, map[string]int{"web-8080/beta": 10})
+			So(detector.Lowered(), ShouldContainKey, "web-8080/beta")
+			So(len(bus.Recent()), ShouldEqual, 1)
+			So(bus.Recent()[0].Type, ShouldEqual, "OutlierLowered")
+
+			Convey("and restores it after the cooldown", func() {
+				stats(ServerStats{Requests: 300, Errors: 2}, ServerStats{Requests: 205, Errors: 62}, ServerStats{Requests: 300})
+				So(detector.Detect(now.Add(20*time.Second)), ShouldBeNil)
+				So(source.weights["web-8080/beta"], ShouldEqual, 10)
+
+				stats(ServerStats{Requests: 400, Errors: 2}, ServerStats{Requests: 210, Errors: 62}, ServerStats{Requests: 400})
+				So(detector.Detect(now.Add(80*time.Second)), ShouldBeNil)
+				So(source.weights["web-8080/beta"], ShouldEqual, 100)
+				So(detector.Lowered(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("leaves a backend alone when it is failing as a whole", func() {
+			stats(ServerStats{Requests: 200, Errors: 90}, ServerStats{Requests: 200, Errors: 90}, ServerStats{Requests: 200, Errors: 10})
+			So(detector.Detect(now.Add(10*time.Second)), ShouldBeNil)
+			So(source.weights, ShouldBeEmpty)
+		})
+
+		Convey("ignores servers with too few requests", func() {
+			stats(ServerStats{Requests: 200}, ServerStats{Requests: 110, Errors: 10}, ServerStats{Requests: 200})
+			So(detector.Detect(now.Add(10*time.Second)), ShouldBeNil)
+			So(source.weights, ShouldBeEmpty)
+		})
+
+		Convey("starts over when HAproxy's counters are reset", func() {
+			stats(ServerStats{Requests: 50}, ServerStats{Requests: 50, Errors: 40}, ServerStats{Requests: 50})
+			So(detector.Detect(now.Add(10*time.Second)), ShouldBeNil)
+			So(source.weights, ShouldResemble, map[string]int{"web-8080/beta": 10})
+		})
+	})
+}
@@ -0,0 +1,274 @@
+package haproxy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// A ServerRuntime changes the servers of the running HAproxy without a
+// reload. Usually a StatsSocket.
+type ServerRuntime interface {
+	AddServer(backend string, server string, args string) error
+	DelServer(backend string, server string) error
+	SetServerState(backend string, server string, state string) error
+	SetServerAddr(backend string, server string, addr string) error
+	EnableHealth(backend string, server string) error
+}
+
+// AddServer adds a server to a backend. The args are what follows the
+// address on its line in the config. It starts out in maintenance.
+func (s *StatsSocket) AddServer(backend string, server string, args string) error {
+	return s.expect(fmt.Sprintf("add server %s/%s %s", backend, server, args), "New server registered")
+}
+
+// DelServer deletes a server from a backend. It has to be in maintenance
+// and have no connections left.
+func (s *StatsSocket) DelServer(backend string, server string) error {
+	return s.expect(fmt.Sprintf("del server %s/%s", backend, server), "Server deleted")
+}
+
+// SetServerState sets a server to ready, drain, or maint
+func (s *StatsSocket) SetServerState(backend string, server string, state string) error {
+	return s.expect(fmt.Sprintf("set server %s/%s state %s", backend, server, state), "")
+}
+
+// EnableHealth starts the health checks of a server, which those added at
+// runtime don't run until told to
+func (s *StatsSocket) EnableHealth(backend string, server string) error {
+	return s.expect(fmt.Sprintf("enable health %s/%s", backend, server), "")
+}
+
+// SetServerAddr points a server at another address, given as ip:port
+func (s *StatsSocket) SetServerAddr(backend string, server string, addr string) error {
+	ip, port, ok := splitHostPort(addr)
+	if !ok {
+		ip, port = strings.Trim(addr, "[]"), ""
+	}
+
+	cmd := fmt.Sprintf("set server %s/%s addr %s", backend, server, ip)
+	if port != "" {
+		cmd += " port " + port
+	}
+
+	output, err := s.command(cmd)
+	if err != nil {
+		return err
+	}
+
+	msg := strings.TrimSpace(string(output))
+	if !strings.Contains(msg, "changed") && !strings.Contains(msg, "no need to change") {
+		return fmt.Errorf("Error setting address of %s/%s: %s", backend, server, msg)
+	}
+
+	return nil
+}
+
+// expect sends a command and returns an error unless HAproxy's response
+// contains what it says when the command works. Some commands say nothing.
+func (s *StatsSocket) expect(cmd string, success string) error {
+	output, err := s.command(cmd)
+	if err != nil {
+		return err
+	}
+
+	msg := strings.TrimSpace(string(output))
+	if (success == "" && msg != "") || !strings.Contains(msg, success) {
+		return fmt.Errorf("Error running '%s' on HAproxy: %s", cmd, msg)
+	}
+
+	return nil
+}
+
+// A configServer is a server line in a rendered config
+type configServer struct {
+	Backend string
+	Name    string
+	Addr    string
+	Args    string // Everything after the address
+}
+
+// checked tells us whether HAproxy health checks the server
+func (s configServer) checked() bool {
+	for _, arg := range strings.Fields(s.Args) {
+		if arg == "check" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s configServer) key() string {
+	return s.Backend + "/" + s.Name
+}
+
+// serverChanges are the servers that came and went between two configs,
+// and those that started draining
+type serverChanges struct {
+	Added   []configServer
+	Removed []configServer
+	Drained []configServer
+}
+
+// parseServers splits a rendered config into the server lines and the rest,
+// leaving out the comments
+func parseServers(config []byte) (map[string]configServer, string) {
+	servers := make(map[string]configServer)
+	var structure strings.Builder
+	var backend string
+
+	for _, line := range bytes.Split(config, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch {
+		case fields[0] == "backend" && len(fields) > 1:
+			backend = fields[1]
+		case fields[0] == "frontend", fields[0] == "listen", fields[0] == "global", fields[0] == "defaults":
+			backend = ""
+		case fields[0] == "server" && len(fields) > 2 && backend != "":
+			server := configServer{Backend: backend, Name: fields[1], Addr: fields[2], Args: strings.Join(fields[3:], " ")}
+			servers[server.key()] = server
+			continue
+		}
+
+		structure.WriteString(strings.Join(fields, " ") + "\n")
+	}
+
+	return servers, structure.String()
+}
+
+// diffServers returns the servers added, removed, and drained from one
+// config to the next. It returns false when anything else changed,
+// including other settings of a server that is in both, because that needs
+// a reload.
+func diffServers(previous []byte, next []byte) (*serverChanges, bool) {
+	oldServers, oldStructure := parseServers(previous)
+	newServers, newStructure := parseServers(next)
+
+	if oldStructure != newStructure {
+		return nil, false
+	}
+
+	changes := &serverChanges{}
+	for key, server := range newServers {
+		old, ok := oldServers[key]
+		if !ok {
+			changes.Added = append(changes.Added, server)
+			continue
+		}
+		if old != server {
+			if old.Addr != server.Addr || !drainedArgs(old.Args, server.Args) {
+				return nil, false
+			}
+			changes.Drained = append(changes.Drained, server)
+		}
+	}
+
+	for key, server := range oldServers {
+		if _, ok := newServers[key]; !ok {
+			changes.Removed = append(changes.Removed, server)
+		}
+	}
+
+	sortServers(changes.Added)
+	sortServers(changes.Removed)
+	sortServers(changes.Drained)
+
+	return changes, true
+}
+
+func sortServers(servers []configServer) {
+	sort.Slice(servers, func(i, j int) bool { return servers[i].key() < servers[j].key() })
+}
+
+// applyAtRuntime makes the changes from the last config HAproxy loaded to
+// the next one through the runtime API, if servers coming, going, and
+// draining is all that changed. It returns false when HAproxy needs a
+// reload instead.
+// Removed servers that still have connections can't be deleted, so they
+// are parked in maintenance, and brought back if they return.
+func (h *HAproxy) applyAtRuntime(next []byte) bool {
+	h.runtimeLock.Lock()
+	defer h.runtimeLock.Unlock()
+
+	h.hashLock.RLock()
+	previous := h.lastConfig
+	h.hashLock.RUnlock()
+
+	if previous == nil || h.Runtime == nil || !h.supports("runtime updates", 2, 5) {
+		return false
+	}
+
+	changes, ok := diffServers(previous, next)
+	if !ok {
+		return false
+	}
+
+	if len(changes.Added) == 0 && len(changes.Removed) == 0 && len(changes.Drained) == 0 {
+		return true
+	}
+
+	if h.parked == nil {
+		h.parked = make(map[string]bool)
+	}
+
+	for _, server := range changes.Drained {
+		if err := h.Runtime.SetServerState(server.Backend, server.Name, "drain"); err != nil {
+			log.Warnf("Reloading HAproxy, can't drain %s at runtime: %s", server.key(), err)
+			return false
+		}
+	}
+
+	for _, server := range changes.Removed {
+		if err := h.Runtime.SetServerState(server.Backend, server.Name, "maint"); err != nil {
+			log.Warnf("Reloading HAproxy, can't take out %s at runtime: %s", server.key(), err)
+			return false
+		}
+
+		if err := h.Runtime.DelServer(server.Backend, server.Name); err != nil {
+			log.Debugf("Leaving %s in maintenance: %s", server.key(), err)
+			h.parked[server.key()] = true
+			continue
+		}
+		delete(h.parked, server.key())
+	}
+
+	for _, server := range changes.Added {
+		if h.parked[server.key()] {
+			if err := h.Runtime.SetServerAddr(server.Backend, server.Name, server.Addr); err != nil {
+				log.Warnf("Reloading HAproxy, can't bring back %s at runtime: %s", server.key(), err)
+				return false
+			}
+		} else {
+			if err := h.Runtime.AddServer(server.Backend, server.Name, server.Addr+" "+server.Args); err != nil {
+				log.Warnf("Reloading HAproxy, can't add %s at runtime: %s", server.key(), err)
+				return false
+			}
+			if server.checked() {
+				if err := h.Runtime.EnableHealth(server.Backend, server.Name); err != nil {
+					log.Warnf("Reloading HAproxy, can't check %s at runtime: %s", server.key(), err)
+					return false
+				}
+			}
+		}
+
+		if err := h.Runtime.SetServerState(server.Backend, server.Name, "ready"); err != nil {
+			log.Warnf("Reloading HAproxy, can't enable %s at runtime: %s", server.key(), err)
+			return false
+		}
+		delete(h.parked, server.key())
+	}
+
+	log.Infof("Updated HAproxy at runtime: %d servers added, %d removed, %d drained",
+		len(changes.Added), len(changes.Removed), len(changes.Drained))
+	metrics.IncrCounter([]string{"haproxy", "runtime_updates"}, 1)
+
+	return true
+}
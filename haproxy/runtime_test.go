@@ -0,0 +1,168 @@
+package haproxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type mockRuntime struct {
+	Commands []string
+	DelErr   error
+	AddErr   error
+}
+
+func (m *mockRuntime) AddServer(backend string, server string, args string) error {
+	m.Commands = append(m.Commands, fmt.Sprintf("add %s/%s %s", backend, server, args))
+	return m.AddErr
+}
+
+func (m *mockRuntime) DelServer(backend string, server string) error {
+	m.Commands = append(m.Commands, fmt.Sprintf("del %s/%s", backend, server))
+	return m.DelErr
+}
+
+func (m *mockRuntime) SetServerState(backend string, server string, state string) error {
+	m.Commands = append(m.Commands, fmt.Sprintf("state %s/%s %s", backend, server, state))
+	return nil
+}
+
+func (m *mockRuntime) SetServerAddr(backend string, server string, addr string) error {
+	m.Commands = append(m.Commands, fmt.Sprintf("addr %s/%s %s", backend, server, addr))
+	return nil
+}
+
+func (m *mockRuntime) EnableHealth(backend string, server string) error {
+	m.Commands = append(m.Commands, fmt.Sprintf("health %s/%s", backend, server))
+	return nil
+}
+
+const runtimeConfig = `# State version 1
+frontend web-8080
+	bind 192.168.168.168:8080
+	default_backend web-8080
+
+backend web-8080
+	mode http
+	server alpha-deadbeef001 10.0.0.1:32768 cookie alpha-32768
+%s`
+
+func Test_diffServers(t *testing.T) {
+	Convey("diffServers()", t, func() {
+		before := []byte(fmt.Sprintf(runtimeConfig, ""))
+
+		Convey("finds the servers that came and went", func() {
+			after := []byte(fmt.Sprintf(runtimeConfig, "\tserver beta-deadbeef002 10.0.0.2:32768 cookie beta-32768\n"))
+
+			changes, ok := diffServers(before, after)
+			So(ok, ShouldBeTrue)
+			So(changes.Added, ShouldResemble, []configServer{
+				{Backend: "web-8080", Name: "beta-deadbeef002", Addr: "10.0.0.2:32768", Args: "cookie beta-32768"},
+			})
+			So(changes.Removed, ShouldBeEmpty)
+
+			changes, ok = diffServers(after, before)
+			So(ok, ShouldBeTrue)
+			So(changes.Removed[0].Name, ShouldEqual, "beta-deadbeef002")
+		})
+
+		Convey("ignores the comments", func() {
+			after := []byte("# State version 2\n" + string(before))
+
+			changes, ok := diffServers(before, after)
+			So(ok, ShouldBeTrue)
+			So(changes.Added, ShouldBeEmpty)
+		})
+
+		Convey("says when anything else changed", func() {
+			_, ok := diffServers(before, []byte(fmt.Sprintf(runtimeConfig, "\tbalance leastconn\n")))
+			So(ok, ShouldBeFalse)
+
+			changed := []byte(fmt.Sprintf(runtimeConfig, ""))
+			changed = []byte(string(changed[:len(changed)-1]) + " maxconn 10\n")
+			_, ok = diffServers(before, changed)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func Test_applyAtRuntime(t *testing.T) {
+	Convey("applyAtRuntime()", t, func() {
+		runtime := &mockRuntime{}
+		proxy := New("/tmp/haproxy.cfg", "/tmp/haproxy.pid")
+		proxy.RuntimeUpdates = true
+		proxy.Runtime = runtime
+
+		before := []byte(fmt.Sprintf(runtimeConfig, ""))
+		after := []byte(fmt.Sprintf(runtimeConfig, "\tserver beta-deadbeef002 10.0.0.2:32768 cookie beta-32768\n"))
+
+		Convey("needs a reload without a config to start from", func() {
+			So(proxy.applyAtRuntime(after), ShouldBeFalse)
+		})
+
+		Convey("adds and enables new servers", func() {
+			proxy.lastConfig = before
+
+			So(proxy.applyAtRuntime(after), ShouldBeTrue)
+			So(runtime.Commands, ShouldResemble, []string{
+				"add web-8080/beta-deadbeef002 10.0.0.2:32768 cookie beta-32768",
+				"state web-8080/beta-deadbeef002 ready",
+			})
+		})
+
+		Convey("turns on the checks of new servers that have them", func() {
+			proxy.lastConfig = before
+			checked := []byte(fmt.Sprintf(runtimeConfig, "\tserver beta-deadbeef002 10.0.0.2:32768 cookie beta-32768 check inter 3000ms\n"))
+
+			So(proxy.applyAtRuntime(checked), ShouldBeTrue)
+			So(runtime.Commands, ShouldResemble, []string{
+				"add web-8080/beta-deadbeef002 10.0.0.2:32768 cookie beta-32768 check inter 3000ms",
+				"health web-8080/beta-deadbeef002",
+				"state web-8080/beta-deadbeef002 ready",
+			})
+		})
+
+		Convey("drains the servers that are rendered with no weight", func() {
+			proxy.lastConfig = before
+			drained := []byte(strings.Replace(string(before), "cookie alpha-32768", "cookie alpha-32768 weight 0", 1))
+
+			So(proxy.applyAtRuntime(drained), ShouldBeTrue)
+			So(runtime.Commands, ShouldResemble, []string{"state web-8080/alpha-deadbeef001 drain"})
+		})
+
+		Convey("parks the servers it can't delete, and brings them back", func() {
+			runtime.DelErr = errors.New("Server still has connections attached to it, cannot remove it.")
+			proxy.lastConfig = after
+
+			So(proxy.applyAtRuntime(before), ShouldBeTrue)
+			So(proxy.parked["web-8080/beta-deadbeef002"], ShouldBeTrue)
+
+			runtime.Commands = nil
+			proxy.lastConfig = before
+			So(proxy.applyAtRuntime(after), ShouldBeTrue)
+			So(runtime.Commands, ShouldResemble, []string{
+				"addr web-8080/beta-deadbeef002 10.0.0.2:32768",
+				"state web-8080/beta-deadbeef002 ready",
+			})
+			So(proxy.parked, ShouldBeEmpty)
+		})
+
+		Convey("needs a reload when the installed HAproxy is too old", func() {
+			proxy.lastConfig = before
+			proxy.version = &Version{Major: 2, Minor: 4}
+
+			So(proxy.applyAtRuntime(after), ShouldBeFalse)
+			So(runtime.Commands, ShouldBeEmpty)
+		})
+
+		Convey("needs a reload when a command fails", func() {
+			runtime.AddErr = errors.New("Unknown command")
+			proxy.lastConfig = before
+
+			So(proxy.applyAtRuntime(after), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,182 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// The SNI hosts a service declares
+type sniHost struct {
+	Hostnames []string
+	Port      int64 // The ServicePort they go to, 0 for the lowest one
+}
+
+// A templateSNI is what the template needs for the shared TLS passthrough
+// frontend, which routes connections by the SNI in their TLS ClientHello
+// without decrypting them. The Rules are in the order HAproxy has to try
+// them: the exact hostnames, then the wildcards, longest first.
+type templateSNI struct {
+	Port        int
+	Binds       []string
+	RequestLogs bool
+	ACLs        []templateACL
+	Rules       []templateRule
+}
+
+// getSNIHosts returns the SNI hosts each service declares, taken from the
+// most recently updated instance
+func getSNIHosts(state *catalog.ServicesState) map[string]sniHost {
+	settings := newestMetadata(state, service.SNIHostsKey, service.SNIPortKey)
+
+	hosts := make(map[string]sniHost)
+	for svcName, metadata := range settings {
+		svc := service.Service{Metadata: metadata}
+		hostnames, port, _ := svc.SNIHosts()
+		if len(hostnames) > 0 {
+			hosts[svcName] = sniHost{Hostnames: hostnames, Port: port}
+		}
+	}
+	return hosts
+}
+
+// sniRoutes returns the routes for the shared TLS passthrough frontend, and
+// the warnings for the SNI hosts that had to be left out. Only TCP services
+// that Sidecar doesn't terminate TLS for can be routed to. A hostname claimed
+// by more than one service goes to the first of them by name. Returns nil
+// when the frontend is off, or has nothing to route.
+func (h *HAproxy) sniRoutes(hosts map[string]sniHost, ports portmap, modes map[string]string,
+	certPaths map[string]string) (*templateSNI, []ConfigWarning) {
+
+	if h.SNIPort < 1 || len(hosts) < 1 {
+		return nil, nil
+	}
+
+	var warnings []ConfigWarning
+	warn := func(svcName string, format string, args ...interface{}) {
+		warnings = append(warnings, ConfigWarning{
+			Service: svcName, Kind: WarnSNIHosts, Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	svcNames := make([]string, 0, len(hosts))
+	for svcName := range hosts {
+		svcNames = append(svcNames, svcName)
+	}
+	sort.Strings(svcNames)
+
+	// The port can't be bound twice
+	sniPort := strconv.Itoa(h.SNIPort)
+	if h.SNIPort == h.VirtualHostPort {
+		for _, svcName := range svcNames {
+			warn(svcName, "Left out because the SNI port %s is also the virtual host port", sniPort)
+		}
+		return nil, warnings
+	}
+	portNames := make([]string, 0, len(ports))
+	for svcName := range ports {
+		portNames = append(portNames, svcName)
+	}
+	sort.Strings(portNames)
+	for _, svcName := range portNames {
+		if _, ok := ports[svcName][sniPort]; ok {
+			for _, name := range svcNames {
+				warn(name, "Left out because %s has the SNI port %s as a ServicePort", svcName, sniPort)
+			}
+			return nil, warnings
+		}
+	}
+
+	result := &templateSNI{
+		Port:        h.SNIPort,
+		Binds:       h.bindAddresses(""),
+		RequestLogs: h.RequestLogs,
+	}
+
+	type wildcardRule struct {
+		Suffix string
+		templateRule
+	}
+	var wildcardRules []wildcardRule
+	var exactRules []templateRule
+	claimed := make(map[string]string)
+
+	for _, svcName := range svcNames {
+		host := hosts[svcName]
+
+		if modes[svcName] != "tcp" {
+			warn(svcName, "Left out because only TCP services can have SNI hosts")
+			continue
+		}
+		if certPaths[svcName] != "" {
+			warn(svcName, "Left out because HAproxy terminates TLS for it")
+			continue
+		}
+
+		port := lowestPort(ports[svcName])
+		if host.Port != 0 {
+			port = strconv.FormatInt(host.Port, 10)
+			if _, ok := ports[svcName][port]; !ok {
+				warn(svcName, "Left out because it has no ServicePort %s", port)
+				continue
+			}
+		}
+		if port == "" {
+			continue
+		}
+
+		backend := sanitizeName(svcName) + "-" + port
+		var exact, wildcards, taken []string
+		for _, hostname := range host.Hostnames {
+			if owner, ok := claimed[hostname]; ok && owner != svcName {
+				taken = append(taken, hostname+" (to "+owner+")")
+				continue
+			}
+			claimed[hostname] = svcName
+
+			if strings.HasPrefix(hostname, "*.") {
+				wildcards = append(wildcards, strings.TrimPrefix(hostname, "*"))
+			} else {
+				exact = append(exact, hostname)
+			}
+		}
+
+		if len(exact) > 0 {
+			acl := "sni_" + backend
+			result.ACLs = append(result.ACLs, templateACL{Name: acl, Criterion: "req_ssl_sni -i " + strings.Join(exact, " ")})
+			exactRules = append(exactRules, templateRule{Condition: acl, Service: svcName, Backend: backend})
+		}
+		for i, suffix := range wildcards {
+			acl := fmt.Sprintf("sni_wildcard_%s_%d", backend, i+1)
+			result.ACLs = append(result.ACLs, templateACL{Name: acl, Criterion: "req_ssl_sni -i -m end " + suffix})
+			wildcardRules = append(wildcardRules, wildcardRule{
+				Suffix:       suffix,
+				templateRule: templateRule{Condition: acl, Service: svcName, Backend: backend},
+			})
+		}
+
+		if len(taken) > 0 {
+			warn(svcName, "Left out what goes to other services: %s", strings.Join(taken, ", "))
+		}
+	}
+
+	// A wildcard mustn't win over another service's hostname under it, or
+	// over a longer wildcard
+	sort.SliceStable(wildcardRules, func(i, j int) bool {
+		return len(wildcardRules[i].Suffix) > len(wildcardRules[j].Suffix)
+	})
+	result.Rules = exactRules
+	for _, rule := range wildcardRules {
+		result.Rules = append(result.Rules, rule.templateRule)
+	}
+
+	if len(result.Rules) < 1 {
+		return nil, warnings
+	}
+
+	return result, warnings
+}
@@ -0,0 +1,95 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SNIRoutes(t *testing.T) {
+	Convey("The SNI passthrough routes", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		var added int
+		add := func(id string, name string, mode string, metadata map[string]string, servicePorts ...int64) {
+			var ports []service.Port
+			for i, svcPort := range servicePorts {
+				ports = append(ports, service.Port{Type: "tcp", Port: 10450 + int64(i), ServicePort: svcPort, IP: "127.0.0.1"})
+			}
+			added++
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, ProxyMode: mode, Metadata: metadata, Ports: ports,
+				Updated: baseTime.Add(time.Duration(added) * time.Second),
+			})
+		}
+		add("deadbeef001", "db", "tcp", map[string]string{"SNIHosts": "db.example.com,*.db.example.com"}, 5432, 5433)
+		add("deadbeef002", "mq", "tcp", map[string]string{"SNIHosts": "*.example.com", "SNIPort": "5671"}, 5672, 5671)
+		add("deadbeef003", "web", "http", nil, 8080)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("have no frontend when it's off", func() {
+			So(render(), ShouldNotContainSubstring, "frontend sni-")
+		})
+
+		Convey("route by the SNI on the shared port", func() {
+			proxy.SNIPort = 443
+
+			So(render(), ShouldContainSubstring, "frontend sni-443\n\tmode tcp\n\tbind 192.168.168.168:443\n"+
+				"\ttcp-request inspect-delay 5s\n"+
+				"\ttcp-request content accept if { req_ssl_hello_type 1 }\n"+
+				"\tacl sni_db-5432 req_ssl_sni -i db.example.com\n"+
+				"\tacl sni_wildcard_db-5432_1 req_ssl_sni -i -m end .db.example.com\n"+
+				"\tacl sni_wildcard_mq-5671_1 req_ssl_sni -i -m end .example.com\n"+
+				"\tuse_backend db-5432 if sni_db-5432\n"+
+				"\tuse_backend db-5432 if sni_wildcard_db-5432_1\n"+
+				"\tuse_backend mq-5671 if sni_wildcard_mq-5671_1\n")
+			So(proxy.Warnings(), ShouldBeEmpty)
+		})
+
+		Convey("leave out the services they can't route to", func() {
+			proxy.SNIPort = 443
+			add("deadbeef004", "web", "http", map[string]string{"SNIHosts": "www.example.com"}, 8080)
+			add("deadbeef005", "search", "tcp", map[string]string{"SNIHosts": "db.example.com"}, 6379)
+			proxy.CertFiles = map[string]string{"ldap": "/etc/ssl/ldap.pem"}
+			add("deadbeef006", "ldap", "tcp", map[string]string{"SNIHosts": "ldap.example.com"}, 636)
+
+			config := render()
+			So(config, ShouldNotContainSubstring, "www.example.com")
+			So(config, ShouldNotContainSubstring, "sni_search")
+			So(config, ShouldNotContainSubstring, "sni_ldap")
+
+			warnings := proxy.Warnings()
+			So(warnings, ShouldHaveLength, 3)
+			So(warnings[0].Service, ShouldEqual, "ldap")
+			So(warnings[0].Message, ShouldContainSubstring, "terminates TLS")
+			So(warnings[1].Service, ShouldEqual, "search")
+			So(warnings[1].Message, ShouldContainSubstring, "db.example.com (to db)")
+			So(warnings[2].Service, ShouldEqual, "web")
+			So(warnings[2].Kind, ShouldEqual, WarnSNIHosts)
+		})
+
+		Convey("are left out when a service has the SNI port", func() {
+			proxy.SNIPort = 5432
+
+			So(render(), ShouldNotContainSubstring, "frontend sni-")
+			So(proxy.Warnings(), ShouldHaveLength, 2)
+		})
+	})
+}
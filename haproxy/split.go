@@ -0,0 +1,146 @@
+package haproxy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// getTrafficSplits returns how each service splits its traffic between its
+// versions, taken from the most recently updated instance. Services without a
+// valid split are left out.
+func getTrafficSplits(state *catalog.ServicesState) map[string][]service.VersionShare {
+	splits := make(map[string][]service.VersionShare)
+	for svcName, value := range newestSetting(state, func(svc *service.Service) string {
+		return svc.Metadata[service.TrafficSplitKey]
+	}) {
+		shares, err := service.ParseTrafficSplit(value)
+		if err == nil && len(shares) > 0 {
+			splits[svcName] = shares
+		}
+	}
+	return splits
+}
+
+// splitInstances leaves out the instances of a service whose version has no
+// share of its traffic split, and puts those of the version with the largest
+// share first. When none of the instances have a share, the split can't be
+// honored, and they are all kept.
+func splitInstances(instances []*service.Service, shares []service.VersionShare) ([]*service.Service, []Exclusion) {
+	if len(shares) < 1 {
+		return instances, nil
+	}
+
+	rank := make(map[string]int, len(shares))
+	for i, share := range shares {
+		if share.Percent > 0 {
+			rank[share.Version] = i
+		}
+	}
+
+	var kept []*service.Service
+	var exclusions []Exclusion
+	for _, svc := range instances {
+		if _, ok := rank[svc.Version()]; !ok {
+			exclusions = append(exclusions, newExclusion(svc, ExcludedNotInSplit, "version "+svc.Version()))
+			continue
+		}
+		kept = append(kept, svc)
+	}
+
+	if len(kept) < 1 {
+		return instances, nil
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool {
+		return rank[kept[i].Version()] < rank[kept[j].Version()]
+	})
+
+	return kept, exclusions
+}
+
+// splitWeights works out the server weights that split the traffic to each
+// service between its versions, by server name, and the warnings for the
+// shares that can't be honored. A version's share is divided between its
+// instances by their own weights. The heaviest server gets the MaxWeight,
+// so the rest keep as much precision as HAproxy allows.
+func splitWeights(services map[string][]*service.Service,
+	splits map[string][]service.VersionShare) (map[string]int, []ConfigWarning) {
+
+	weights := make(map[string]int)
+	var warnings []ConfigWarning
+
+	svcNames := make([]string, 0, len(splits))
+	for svcName := range splits {
+		svcNames = append(svcNames, svcName)
+	}
+	sort.Strings(svcNames)
+
+	for _, svcName := range svcNames {
+		instances := services[svcName]
+		if len(instances) < 1 {
+			continue
+		}
+
+		percents := make(map[string]int)
+		for _, share := range splits[svcName] {
+			percents[share.Version] = share.Percent
+		}
+
+		totals := make(map[string]int)
+		for _, svc := range instances {
+			if percents[svc.Version()] > 0 {
+				totals[svc.Version()] += instanceWeight(svc)
+			}
+		}
+
+		if len(totals) < 1 {
+			warnings = append(warnings, ConfigWarning{
+				Service: svcName, Kind: WarnTrafficSplit,
+				Message: "None of the versions in the traffic split have instances, so it isn't split",
+			})
+			continue
+		}
+
+		for _, share := range splits[svcName] {
+			if share.Percent > 0 && totals[share.Version] == 0 {
+				warnings = append(warnings, ConfigWarning{
+					Service: svcName, Kind: WarnTrafficSplit,
+					Message: fmt.Sprintf("No instances of version %s, so its %d%% goes to the other versions",
+						share.Version, share.Percent),
+				})
+			}
+		}
+
+		shares := make(map[string]float64, len(instances))
+		var heaviest float64
+		for _, svc := range instances {
+			version := svc.Version()
+			share := float64(percents[version]) * float64(instanceWeight(svc)) / float64(totals[version])
+			shares[svc.Hostname+"-"+svc.ID] = share
+			heaviest = math.Max(heaviest, share)
+		}
+
+		for server, share := range shares {
+			weight := int(math.Round(share * service.MaxWeight / heaviest))
+			if weight < 1 {
+				weight = 1
+			}
+			weights[server] = weight
+		}
+	}
+
+	return weights, warnings
+}
+
+// instanceWeight returns the weight of an instance, which is HAproxy's
+// default of 1 when it has none
+func instanceWeight(svc *service.Service) int {
+	if weight := weightFor(svc); weight > 0 {
+		return weight
+	}
+	return 1
+}
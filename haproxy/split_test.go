@@ -0,0 +1,103 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_TrafficSplits(t *testing.T) {
+	Convey("The traffic splits", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		var added int
+		add := func(id string, version string, weight int, metadata map[string]string, servicePorts ...int64) {
+			var ports []service.Port
+			added++
+			for i, svcPort := range servicePorts {
+				ports = append(ports, service.Port{Type: "tcp", Port: 10450 + int64(added*10+i), ServicePort: svcPort, IP: "127.0.0.1"})
+			}
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: "web", Image: "web:" + version, Hostname: hostname1, ProxyMode: "http",
+				Weight: weight, Metadata: metadata, Ports: ports,
+				Updated: baseTime.Add(time.Duration(added) * time.Second),
+			})
+		}
+		split := map[string]string{"TrafficSplit": "v1=95,v2=5,v0=0"}
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+		server := func(id string, port int, args string) string {
+			return "server " + hostname1 + "-" + id + " 127.0.0.1:" + strconv.Itoa(port) + " cookie " + hostname1 + "-" + strconv.Itoa(port) + " " + args + "\n"
+		}
+
+		Convey("weight the servers by the share of their version", func() {
+			add("deadbeef001", "v1", 0, nil, 8080)
+			add("deadbeef002", "v1", 3, nil, 8080)
+			add("deadbeef003", "v2", 0, split, 8080)
+
+			config := render()
+			// v1 has 95% split 1:3, and v2 has 5%
+			So(config, ShouldContainSubstring, server("deadbeef001", 10460, "weight 85 "))
+			So(config, ShouldContainSubstring, server("deadbeef002", 10470, "weight 256 "))
+			So(config, ShouldContainSubstring, server("deadbeef003", 10480, "weight 18 "))
+			So(proxy.Warnings(), ShouldBeEmpty)
+		})
+
+		Convey("leave out the versions without a share", func() {
+			add("deadbeef001", "v1", 0, nil, 8080)
+			add("deadbeef002", "v0", 0, nil, 8080)
+			add("deadbeef003", "v3", 0, split, 8080)
+
+			config := render()
+			So(config, ShouldContainSubstring, server("deadbeef001", 10460, "weight 256 "))
+			So(config, ShouldNotContainSubstring, "deadbeef002 ")
+			So(config, ShouldNotContainSubstring, "deadbeef003 ")
+
+			exclusions := proxy.Exclusions()
+			So(exclusions, ShouldHaveLength, 2)
+			So(exclusions[0].Reason, ShouldEqual, ExcludedNotInSplit)
+			So(exclusions[1].Detail, ShouldEqual, "version v3")
+
+			warnings := proxy.Warnings()
+			So(warnings, ShouldHaveLength, 1)
+			So(warnings[0].Kind, ShouldEqual, WarnTrafficSplit)
+			So(warnings[0].Message, ShouldContainSubstring, "version v2")
+		})
+
+		Convey("match the ports of the version with the largest share", func() {
+			add("deadbeef001", "v1", 0, nil, 8080)
+			add("deadbeef002", "v2", 0, split, 9090)
+
+			So(render(), ShouldContainSubstring, server("deadbeef001", 10460, "weight 256 "))
+			exclusions := proxy.Exclusions()
+			So(exclusions, ShouldHaveLength, 1)
+			So(exclusions[0].ID, ShouldEqual, "deadbeef002")
+			So(exclusions[0].Reason, ShouldEqual, ExcludedPortMismatch)
+		})
+
+		Convey("aren't honored when no version in them has instances", func() {
+			add("deadbeef001", "v3", 0, split, 8080)
+
+			So(render(), ShouldContainSubstring, server("deadbeef001", 10460, ""))
+			So(proxy.Exclusions(), ShouldBeEmpty)
+			So(proxy.Warnings()[0].Message, ShouldContainSubstring, "isn't split")
+		})
+	})
+}
@@ -0,0 +1,125 @@
+package haproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/spoe"
+)
+
+// The names the HAproxy config and the SPOE config refer to each other by
+const (
+	SPOEBackend     = "sidecar_spoe"
+	spoeEngine      = "sidecar" // Also the prefix of the variables the agent sets
+	spoeGroup       = "check-request"
+	spoeMirrorGroup = "mirror"
+)
+
+// How long HAproxy waits for the agent, before letting the request through
+// without a decision
+const spoeProcessingTimeout = "100ms"
+
+// Where the frontends set the service the request is for, and where the
+// shared HTTP frontend sets the service it routes the request to
+const (
+	spoeServiceVar = "txn." + spoeEngine + "_service"
+	spoeRouteVar   = "txn." + spoeEngine + "_route"
+	spoeMirrorVar  = "txn." + spoeEngine + "_mirror" // Where to mirror the request to
+)
+
+// A templateSPOE is what the template needs to ask the SPOE agent about
+// the requests to a service
+type templateSPOE struct {
+	Agent       string
+	Backend     string
+	ConfigFile  string
+	Engine      string
+	Group       string
+	MirrorGroup string
+	MirrorVar   string // Where the frontend sets the address to mirror to
+	ServiceVar  string // Where the frontend sets the service it's for
+	RouteVar    string // Where the shared frontend sets the service it routes to
+	Var         string // Where the decision is, e.g. txn.sidecar.decision
+}
+
+// spoe returns what the template needs for the SPOE agent, or nil when
+// there isn't one
+func (h *HAproxy) spoe() *templateSPOE {
+	if h.SPOEAgent == "" || h.SPOEConfigFile == "" || !h.supports("SPOE", 1, 9) {
+		return nil
+	}
+
+	return &templateSPOE{
+		Agent:       h.SPOEAgent,
+		Backend:     SPOEBackend,
+		ConfigFile:  h.SPOEConfigFile,
+		Engine:      spoeEngine,
+		Group:       spoeGroup,
+		MirrorGroup: spoeMirrorGroup,
+		MirrorVar:   spoeMirrorVar,
+		ServiceVar:  spoeServiceVar,
+		RouteVar:    spoeRouteVar,
+		Var:         "txn." + spoeEngine + "." + spoe.DecisionVar,
+	}
+}
+
+// getDecisions returns the names of the services whose newest instance
+// wants decisions from the SPOE agent
+func getDecisions(state *catalog.ServicesState) map[string]bool {
+	decisions := make(map[string]bool)
+	for svcName, value := range newestSetting(state, func(svc *service.Service) string {
+		if svc.WantsDecisions() {
+			return "true"
+		}
+		return ""
+	}) {
+		decisions[svcName] = value != ""
+	}
+	return decisions
+}
+
+// SPOEConfig renders the SPOE config that the template's filters point
+// at. The frontends send the messages with the send-spoe-group rules, once
+// they've set the service it's for, or the address to mirror to.
+func SPOEConfig() []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "# DO NOT EDIT THIS FILE\n# Auto-generated by Sidecar\n\n")
+	fmt.Fprintf(&buf, "[%s]\n", spoeEngine)
+	fmt.Fprintf(&buf, "spoe-agent %s-agent\n", spoeEngine)
+	fmt.Fprintf(&buf, "\tgroups %s %s\n", spoeGroup, spoeMirrorGroup)
+	fmt.Fprintf(&buf, "\toption var-prefix %s\n", spoeEngine)
+	fmt.Fprintf(&buf, "\ttimeout hello 2s\n")
+	fmt.Fprintf(&buf, "\ttimeout idle 2m\n")
+	fmt.Fprintf(&buf, "\ttimeout processing %s\n", spoeProcessingTimeout)
+	fmt.Fprintf(&buf, "\tuse-backend %s\n\n", SPOEBackend)
+	fmt.Fprintf(&buf, "spoe-message %s\n", spoe.MessageName)
+	fmt.Fprintf(&buf, "\targs service=var(%s) src=src\n\n", spoeServiceVar)
+	fmt.Fprintf(&buf, "spoe-message %s\n", spoe.MirrorMessageName)
+	fmt.Fprintf(&buf, "\targs addr=var(%s) method=method path=url ver=req.ver hdrs=req.hdrs_bin body=req.body\n\n",
+		spoeMirrorVar)
+	fmt.Fprintf(&buf, "spoe-group %s\n", spoeGroup)
+	fmt.Fprintf(&buf, "\tmessages %s\n\n", spoe.MessageName)
+	fmt.Fprintf(&buf, "spoe-group %s\n", spoeMirrorGroup)
+	fmt.Fprintf(&buf, "\tmessages %s\n", spoe.MirrorMessageName)
+
+	return buf.Bytes()
+}
+
+// WriteSPOEConfig writes the SPOE config to the SPOEConfigFile, when the
+// agent is on
+func (h *HAproxy) WriteSPOEConfig() error {
+	if h.SPOEAgent == "" {
+		return nil
+	}
+
+	err := ioutil.WriteFile(h.SPOEConfigFile, SPOEConfig(), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing SPOE config '%s': %s", h.SPOEConfigFile, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SPOE(t *testing.T) {
+	Convey("The SPOE agent", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		add := func(id string, name string, mode string, metadata map[string]string, svcPort int64) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, Updated: baseTime, ProxyMode: mode, Metadata: metadata,
+				Ports: []service.Port{{Type: "tcp", Port: 10450, ServicePort: svcPort, IP: "127.0.0.1"}},
+			})
+		}
+		add("deadbeef001", "web", "http", map[string]string{"RateLimit": "100/s"}, 8080)
+		add("deadbeef002", "api", "http", nil, 8081)
+		add("deadbeef003", "db", "tcp", map[string]string{"AllowedSources": "10.0.0.0/8"}, 5432)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("is left out of the config when it's off", func() {
+			So(render(), ShouldNotContainSubstring, "spoe")
+		})
+
+		Convey("is asked about the requests to the HTTP services that want decisions", func() {
+			proxy.SPOEAgent = "127.0.0.1:7780"
+			proxy.SPOEConfigFile = "/etc/haproxy-spoe.conf"
+
+			config := render()
+			So(config, ShouldContainSubstring, "backend sidecar_spoe\n\tmode tcp\n\tserver agent 127.0.0.1:7780\n")
+			So(config, ShouldContainSubstring, "frontend web-8080\n\tmode http\n\tbind 192.168.168.168:8080\n"+
+				"\thttp-request set-var(txn.sidecar_service) str(web)\n"+
+				"\tfilter spoe engine sidecar config /etc/haproxy-spoe.conf\n"+
+				"\thttp-request send-spoe-group sidecar check-request\n"+
+				"\thttp-request deny deny_status 403 if { var(txn.sidecar.decision) -m str deny }\n"+
+				"\thttp-request deny deny_status 429 if { var(txn.sidecar.decision) -m str rate-limit }\n")
+			So(config, ShouldContainSubstring, "frontend api-8081\n\tmode http\n\tbind 192.168.168.168:8081\n\tdefault_backend")
+			So(config, ShouldContainSubstring, "frontend db-5432\n\tmode tcp\n\tbind 192.168.168.168:5432\n\tdefault_backend")
+
+			Convey("unless HAproxy is too old for it", func() {
+				proxy.version = &Version{Major: 1, Minor: 8}
+				So(render(), ShouldNotContainSubstring, "spoe")
+			})
+		})
+
+		Convey("has its SPOE config written", func() {
+			dir, _ := ioutil.TempDir("", "spoe")
+			defer os.RemoveAll(dir)
+
+			proxy.SPOEConfigFile = path.Join(dir, "spoe.conf")
+			So(proxy.WriteSPOEConfig(), ShouldBeNil)
+			_, err := os.Stat(proxy.SPOEConfigFile)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			proxy.SPOEAgent = "127.0.0.1:7780"
+			So(proxy.WriteSPOEConfig(), ShouldBeNil)
+
+			written, err := ioutil.ReadFile(proxy.SPOEConfigFile)
+			So(err, ShouldBeNil)
+			So(string(written), ShouldContainSubstring, "[sidecar]\nspoe-agent sidecar-agent\n\tgroups check-request mirror\n")
+			So(string(written), ShouldContainSubstring, "\tuse-backend sidecar_spoe\n")
+			So(string(written), ShouldContainSubstring,
+				"spoe-message check-request\n\targs service=var(txn.sidecar_service) src=src\n")
+			So(string(written), ShouldContainSubstring, "spoe-group check-request\n\tmessages check-request\n")
+			So(string(written), ShouldContainSubstring, "spoe-message mirror-request\n\targs addr=var(txn.sidecar_mirror) "+
+				"method=method path=url ver=req.ver hdrs=req.hdrs_bin body=req.body\n")
+			So(string(written), ShouldContainSubstring, "spoe-group mirror\n\tmessages mirror-request\n")
+		})
+	})
+}
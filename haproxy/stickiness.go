@@ -0,0 +1,92 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// The size of the stick-tables that keep clients on a server by their
+// source address
+const stickyTableSize = "100k"
+
+// A templateStickiness is what the template needs to keep the clients of a
+// service on the same server. Exactly one of Cookie and Table is set.
+type templateStickiness struct {
+	Cookie string // The name of the cookie HAproxy sets
+	Table  *templateStickTable
+}
+
+// A templateStickTable is the stick-table of a backend that remembers the
+// server each client address went to
+type templateStickTable struct {
+	Type   string // ip, or ipv6 when the frontend binds IPv6 too
+	Size   string
+	Expire string
+}
+
+// getStickiness returns how each service keeps its clients on the same
+// instance, taken from the most recently updated instance. Services without
+// valid stickiness are left out.
+func getStickiness(state *catalog.ServicesState) map[string]*service.Stickiness {
+	stickiness := make(map[string]*service.Stickiness)
+	for svcName, metadata := range newestMetadata(state, service.StickinessKeys...) {
+		svc := service.Service{Metadata: metadata}
+		if sticky, err := svc.Stickiness(); err == nil && sticky != nil {
+			stickiness[svcName] = sticky
+		}
+	}
+	return stickiness
+}
+
+// stickiness returns what the template needs for the stickiness of each
+// service that has frontends, and the warnings for the services that asked
+// for stickiness their mode can't have. Cookies only work for HTTP.
+func (h *HAproxy) stickiness(settings map[string]*service.Stickiness, ports portmap, modes map[string]string,
+	binds map[string][]string) (map[string]*templateStickiness, []ConfigWarning) {
+
+	result := make(map[string]*templateStickiness, len(settings))
+	var warnings []ConfigWarning
+
+	svcNames := make([]string, 0, len(settings))
+	for svcName := range settings {
+		if len(ports[svcName]) > 0 {
+			svcNames = append(svcNames, svcName)
+		}
+	}
+	sort.Strings(svcNames)
+
+	for _, svcName := range svcNames {
+		sticky := settings[svcName]
+
+		switch sticky.Mode {
+		case service.StickyCookie:
+			if modes[svcName] != "http" {
+				warnings = append(warnings, ConfigWarning{
+					Service: svcName, Kind: WarnStickiness,
+					Message: "Not sticky, since only HTTP services can be kept on a server by cookie",
+				})
+				continue
+			}
+			result[svcName] = &templateStickiness{Cookie: sticky.Cookie}
+
+		case service.StickySource:
+			table := &templateStickTable{
+				Type:   "ip",
+				Size:   stickyTableSize,
+				Expire: fmt.Sprintf("%ds", int64(sticky.Expire.Seconds())),
+			}
+			for _, address := range binds[svcName] {
+				if strings.HasPrefix(address, "[") {
+					table.Type = "ipv6"
+				}
+			}
+			result[svcName] = &templateStickiness{Table: table}
+		}
+	}
+
+	return result, warnings
+}
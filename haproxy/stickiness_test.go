@@ -0,0 +1,76 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Stickiness(t *testing.T) {
+	Convey("The stickiness", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		add := func(id string, name string, mode string, metadata map[string]string, svcPort int64) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, Updated: baseTime, ProxyMode: mode, Metadata: metadata,
+				Ports: []service.Port{{Type: "tcp", Port: 10450, ServicePort: svcPort, IP: "127.0.0.1"}},
+			})
+		}
+		add("deadbeef001", "web", "http", map[string]string{"Stickiness": "cookie", "StickyCookie": "WEB"}, 8080)
+		add("deadbeef002", "db", "tcp", map[string]string{"Stickiness": "source", "StickyExpire": "1h"}, 5432)
+		add("deadbeef003", "api", "http", nil, 8081)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("keeps clients on a server by cookie", func() {
+			So(render(), ShouldContainSubstring, "cookie indomitable-10450 \n"+
+				"\tcookie WEB insert indirect nocache\n")
+		})
+
+		Convey("keeps clients on a server by source address", func() {
+			So(render(), ShouldContainSubstring, "cookie indomitable-10450 \n"+
+				"\tstick-table type ip size 100k expire 3600s\n"+
+				"\tstick on src\n")
+		})
+
+		Convey("uses IPv6 tables when the frontend binds IPv6", func() {
+			proxy.BindIPv6 = "fd00::168"
+			So(render(), ShouldContainSubstring, "\tstick-table type ipv6 size 100k expire 3600s\n")
+		})
+
+		Convey("leaves the other services alone", func() {
+			So(render(), ShouldContainSubstring, "backend api-8081\n\tmode http \n"+
+				"\tserver indomitable-deadbeef003 127.0.0.1:10450 cookie indomitable-10450 \n\n")
+		})
+
+		Convey("warns about cookies for TCP services", func() {
+			state.AddServiceEntry(service.Service{
+				ID: "deadbeef002", Name: "db", Hostname: hostname1, Updated: baseTime.Add(time.Second), ProxyMode: "tcp",
+				Metadata: map[string]string{"Stickiness": "cookie"},
+				Ports:    []service.Port{{Type: "tcp", Port: 10450, ServicePort: 5432, IP: "127.0.0.1"}},
+			})
+
+			So(render(), ShouldNotContainSubstring, "stick")
+			warnings := proxy.Warnings()
+			So(warnings, ShouldHaveLength, 1)
+			So(warnings[0].Service, ShouldEqual, "db")
+			So(warnings[0].Kind, ShouldEqual, WarnStickiness)
+		})
+	})
+}
@@ -0,0 +1,237 @@
+package haproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// The timeouts and retries in the defaults section, when HAproxy isn't told
+// otherwise
+const (
+	DefaultConnectTimeout = 5 * time.Second
+	DefaultClientTimeout  = time.Minute
+	DefaultServerTimeout  = time.Minute
+	DefaultRetries        = 3
+)
+
+// Where a service's timeout or retries came from, from the weakest to the
+// strongest
+const (
+	TimeoutFromDefault = "default" // The defaults section
+	TimeoutFromFile    = "file"    // The TimeoutsFile
+	TimeoutFromLabel   = "label"   // The service's Metadata, usually from its labels
+)
+
+// EffectiveTimeouts are the timeouts and retries a service was last rendered
+// with. Sources says where each of them came from, by its Metadata key.
+type EffectiveTimeouts struct {
+	Service string
+	Connect string // As HAproxy reads them, e.g. 5s
+	Client  string
+	Server  string
+	Retries int
+	Sources map[string]string
+}
+
+// A templateTimeouts is what the template needs for the settings a service
+// overrides. The rest are empty, and left to the defaults section.
+type templateTimeouts struct {
+	Connect string
+	Client  string
+	Server  string
+	Retries string
+}
+
+// getTimeouts returns the timeouts and retries each service's Metadata sets,
+// taken from the most recently updated instance, and the warnings for those
+// that are invalid
+func getTimeouts(state *catalog.ServicesState) (map[string]service.Timeouts, []ConfigWarning) {
+	timeouts := make(map[string]service.Timeouts)
+	var warnings []ConfigWarning
+	for svcName, metadata := range newestMetadata(state, service.TimeoutKeys...) {
+		svc := service.Service{Metadata: metadata}
+		parsed, err := svc.Timeouts()
+		if err != nil {
+			warnings = append(warnings, ConfigWarning{
+				Service: svcName, Kind: WarnTimeouts, Message: "Ignoring some of its labels: " + err.Error(),
+			})
+		}
+		timeouts[svcName] = parsed
+	}
+	return timeouts, warnings
+}
+
+// readTimeoutsFile returns the timeouts and retries the TimeoutsFile sets for
+// each service, and the warnings for those that are invalid. The file has
+// the same keys as the labels, by service name, e.g.
+// {"awesome-svc": {"ServerTimeout": "5m", "Retries": "1"}}. It is read on
+// each render, so changes to it apply with the next one.
+func (h *HAproxy) readTimeoutsFile() (map[string]service.Timeouts, []ConfigWarning) {
+	if h.TimeoutsFile == "" {
+		return nil, nil
+	}
+
+	var settings map[string]map[string]string
+	data, err := ioutil.ReadFile(h.TimeoutsFile)
+	if err == nil {
+		err = json.Unmarshal(data, &settings)
+	}
+	if err != nil {
+		return nil, []ConfigWarning{{
+			Kind: WarnTimeouts, Message: fmt.Sprintf("Ignoring the timeouts file %s: %s", h.TimeoutsFile, err),
+		}}
+	}
+
+	timeouts := make(map[string]service.Timeouts, len(settings))
+	var warnings []ConfigWarning
+	for svcName, metadata := range settings {
+		svc := service.Service{Metadata: metadata}
+		parsed, err := svc.Timeouts()
+		if err != nil {
+			warnings = append(warnings, ConfigWarning{
+				Service: svcName, Kind: WarnTimeouts, Message: "Ignoring some of the timeouts file: " + err.Error(),
+			})
+		}
+		timeouts[svcName] = parsed
+	}
+	return timeouts, warnings
+}
+
+// defaultTimeouts returns what the defaults section renders, filling in the
+// settings that aren't set
+func (h *HAproxy) defaultTimeouts() service.Timeouts {
+	timeouts := service.Timeouts{
+		Connect: h.ConnectTimeout, Client: h.ClientTimeout, Server: h.ServerTimeout, Retries: h.Retries,
+	}
+	if timeouts.Connect <= 0 {
+		timeouts.Connect = DefaultConnectTimeout
+	}
+	if timeouts.Client <= 0 {
+		timeouts.Client = DefaultClientTimeout
+	}
+	if timeouts.Server <= 0 {
+		timeouts.Server = DefaultServerTimeout
+	}
+	if timeouts.Retries < 0 {
+		timeouts.Retries = DefaultRetries
+	}
+	return timeouts
+}
+
+// defaultsSection returns the timeouts and retries for the template's
+// defaults section
+func (h *HAproxy) defaultsSection() templateTimeouts {
+	defaults := h.defaultTimeouts()
+	return templateTimeouts{
+		Connect: haproxyDuration(defaults.Connect),
+		Client:  haproxyDuration(defaults.Client),
+		Server:  haproxyDuration(defaults.Server),
+		Retries: strconv.Itoa(defaults.Retries),
+	}
+}
+
+// resolveTimeouts works out the timeouts and retries of each service, taking
+// each setting from its labels, then the TimeoutsFile, then the defaults
+func (h *HAproxy) resolveTimeouts(svcNames []string, labels map[string]service.Timeouts,
+	file map[string]service.Timeouts) []EffectiveTimeouts {
+
+	defaults := h.defaultTimeouts()
+	sort.Strings(svcNames)
+
+	effective := make([]EffectiveTimeouts, 0, len(svcNames))
+	for _, svcName := range svcNames {
+		result := EffectiveTimeouts{Service: svcName, Sources: make(map[string]string, len(service.TimeoutKeys))}
+
+		duration := func(key string, pick func(service.Timeouts) time.Duration) string {
+			if value, ok := labels[svcName]; ok && pick(value) > 0 {
+				result.Sources[key] = TimeoutFromLabel
+				return haproxyDuration(pick(value))
+			}
+			if value, ok := file[svcName]; ok && pick(value) > 0 {
+				result.Sources[key] = TimeoutFromFile
+				return haproxyDuration(pick(value))
+			}
+			result.Sources[key] = TimeoutFromDefault
+			return haproxyDuration(pick(defaults))
+		}
+		result.Connect = duration(service.ConnectTimeoutKey, func(t service.Timeouts) time.Duration { return t.Connect })
+		result.Client = duration(service.ClientTimeoutKey, func(t service.Timeouts) time.Duration { return t.Client })
+		result.Server = duration(service.ServerTimeoutKey, func(t service.Timeouts) time.Duration { return t.Server })
+
+		result.Sources[service.RetriesKey] = TimeoutFromDefault
+		result.Retries = defaults.Retries
+		if value, ok := labels[svcName]; ok && value.Retries >= 0 {
+			result.Sources[service.RetriesKey] = TimeoutFromLabel
+			result.Retries = value.Retries
+		} else if value, ok := file[svcName]; ok && value.Retries >= 0 {
+			result.Sources[service.RetriesKey] = TimeoutFromFile
+			result.Retries = value.Retries
+		}
+
+		effective = append(effective, result)
+	}
+
+	return effective
+}
+
+// templateTimeoutsFor returns what the template needs for the settings a
+// service overrides, or nil when it takes them all from the defaults
+func templateTimeoutsFor(effective EffectiveTimeouts) *templateTimeouts {
+	result := &templateTimeouts{}
+	overridden := func(key string) bool { return effective.Sources[key] != TimeoutFromDefault }
+
+	if overridden(service.ConnectTimeoutKey) {
+		result.Connect = effective.Connect
+	}
+	if overridden(service.ClientTimeoutKey) {
+		result.Client = effective.Client
+	}
+	if overridden(service.ServerTimeoutKey) {
+		result.Server = effective.Server
+	}
+	if overridden(service.RetriesKey) {
+		result.Retries = strconv.Itoa(effective.Retries)
+	}
+
+	if *result == (templateTimeouts{}) {
+		return nil
+	}
+	return result
+}
+
+// haproxyDuration formats a duration the way HAproxy reads them, in the
+// largest unit that keeps it exact
+func haproxyDuration(d time.Duration) string {
+	switch {
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	default:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+}
+
+// recordTimeouts keeps the timeouts a render resolved, for Timeouts
+func (h *HAproxy) recordTimeouts(effective []EffectiveTimeouts) {
+	h.timeoutsLock.Lock()
+	defer h.timeoutsLock.Unlock()
+
+	h.timeouts = effective
+}
+
+// Timeouts returns the timeouts and retries each service was last rendered
+// with, and where each of them came from, sorted by service
+func (h *HAproxy) Timeouts() []EffectiveTimeouts {
+	h.timeoutsLock.RLock()
+	defer h.timeoutsLock.RUnlock()
+
+	return append([]EffectiveTimeouts{}, h.timeouts...)
+}
@@ -0,0 +1,125 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Timeouts(t *testing.T) {
+	Convey("The timeouts and retries", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		add := func(id string, name string, metadata map[string]string, svcPort int64) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, Updated: baseTime, ProxyMode: "http", Metadata: metadata,
+				Ports: []service.Port{{Type: "tcp", Port: 10450, ServicePort: svcPort, IP: "127.0.0.1"}},
+			})
+		}
+		add("deadbeef001", "web", map[string]string{"ServerTimeout": "5m", "ClientTimeout": "1500ms"}, 8080)
+		add("deadbeef002", "api", nil, 8081)
+
+		tmpDir, err := ioutil.TempDir("", "timeouts")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(tmpDir) })
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.TimeoutsFile = tmpDir + "/timeouts.json"
+
+		writeFile := func(contents string) {
+			So(ioutil.WriteFile(proxy.TimeoutsFile, []byte(contents), 0644), ShouldBeNil)
+		}
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("are set in the defaults section", func() {
+			proxy.ServerTimeout = 90 * time.Second
+			writeFile(`{}`)
+
+			So(render(), ShouldContainSubstring, "\tretries  3\n"+
+				"\ttimeout  connect 5s\n"+
+				"\ttimeout  client  1m\n"+
+				"\ttimeout  server  90s\n")
+		})
+
+		Convey("take the labels over the file, and the file over the defaults", func() {
+			writeFile(`{"web": {"ServerTimeout": "2m", "Retries": "1"}, "api": {"ConnectTimeout": "2s"}}`)
+
+			config := render()
+			So(config, ShouldContainSubstring, "default_backend web-8080")
+			So(config, ShouldContainSubstring, "\ttimeout client 1500ms\n")
+			So(config, ShouldContainSubstring, "backend web-8080\n"+
+				"\ttimeout server 5m\n"+
+				"\tretries 1\n"+
+				"\tmode http \n")
+			So(config, ShouldContainSubstring, "backend api-8081\n"+
+				"\ttimeout connect 2s\n"+
+				"\tmode http \n")
+
+			So(proxy.Timeouts(), ShouldResemble, []EffectiveTimeouts{
+				{
+					Service: "api", Connect: "2s", Client: "1m", Server: "1m", Retries: 3,
+					Sources: map[string]string{
+						"ConnectTimeout": TimeoutFromFile, "ClientTimeout": TimeoutFromDefault,
+						"ServerTimeout": TimeoutFromDefault, "Retries": TimeoutFromDefault,
+					},
+				},
+				{
+					Service: "web", Connect: "5s", Client: "1500ms", Server: "5m", Retries: 1,
+					Sources: map[string]string{
+						"ConnectTimeout": TimeoutFromDefault, "ClientTimeout": TimeoutFromLabel,
+						"ServerTimeout": TimeoutFromLabel, "Retries": TimeoutFromFile,
+					},
+				},
+			})
+			So(proxy.Warnings(), ShouldBeEmpty)
+		})
+
+		Convey("leave the services that don't override them alone", func() {
+			So(render(), ShouldContainSubstring, "backend api-8081\n\tmode http \n")
+		})
+
+		Convey("warn about invalid settings and ignore them", func() {
+			writeFile(`{"api": {"ServerTimeout": "later"}}`)
+			state.AddServiceEntry(service.Service{
+				ID: "deadbeef001", Name: "web", Hostname: hostname1, Updated: baseTime.Add(time.Second), ProxyMode: "http",
+				Metadata: map[string]string{"Retries": "many"},
+				Ports:    []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "127.0.0.1"}},
+			})
+
+			So(render(), ShouldContainSubstring, "backend api-8081\n\tmode http \n")
+			warnings := proxy.Warnings()
+			So(warnings, ShouldHaveLength, 2)
+			So(warnings[0].Service, ShouldEqual, "api")
+			So(warnings[0].Kind, ShouldEqual, WarnTimeouts)
+			So(warnings[0].Message, ShouldContainSubstring, "ServerTimeout 'later'")
+			So(warnings[1].Service, ShouldEqual, "web")
+			So(warnings[1].Message, ShouldContainSubstring, "Retries 'many'")
+		})
+
+		Convey("warn about a file that can't be read", func() {
+			writeFile(`{"api":`)
+
+			render()
+			warnings := proxy.Warnings()
+			So(warnings, ShouldHaveLength, 1)
+			So(warnings[0].Service, ShouldEqual, "")
+			So(warnings[0].Message, ShouldContainSubstring, "Ignoring the timeouts file")
+		})
+	})
+}
@@ -0,0 +1,99 @@
+package haproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// certPathFor returns the certificate a service's frontends terminate TLS
+// with, or "" when they don't. A certificate fetched for the service's
+// TLSCert comes first, then the file configured for the service, and then
+// the DefaultCertFile, which only the HTTP services get.
+func (h *HAproxy) certPathFor(svcName string, certName string, mode string) string {
+	if path := h.certFor(certName); path != "" {
+		return path
+	}
+	if path := h.CertFiles[svcName]; path != "" {
+		return path
+	}
+	if mode == "http" {
+		return h.DefaultCertFile
+	}
+	return ""
+}
+
+// ParseCertFiles parses the per-service certificate files, given in the
+// form service:path
+func ParseCertFiles(entries []string) (map[string]string, error) {
+	certFiles := make(map[string]string, len(entries))
+
+	for _, entry := range entries {
+		fields := strings.SplitN(entry, ":", 2)
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("Error parsing cert file '%s': expected service:path", entry)
+		}
+
+		certFiles[fields[0]] = fields[1]
+	}
+
+	return certFiles, nil
+}
+
+// A templateRedirect sends the plain HTTP requests for a service that
+// terminates TLS to its HTTPS frontend
+type templateRedirect struct {
+	Service  string
+	Location string
+}
+
+// httpsRedirect returns the redirect to a service's HTTPS frontend on a
+// port, keeping the hostname and the path
+func httpsRedirect(svcName string, port string) templateRedirect {
+	location := "https://%[hdr(host),field(1,:)]"
+	if port != "443" {
+		location += ":" + port
+	}
+	return templateRedirect{Service: svcName, Location: location + "%[capture.req.uri]"}
+}
+
+// verifyCerts checks that every certificate a config binds with is a file
+// HAproxy can load, so a missing one fails before the reload instead of
+// taking HAproxy down
+func verifyCerts(config []byte) error {
+	var missing []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 1 || fields[0] != "bind" {
+			continue
+		}
+
+		for i := 1; i < len(fields)-1; i++ {
+			if fields[i] != "crt" || seen[fields[i+1]] {
+				continue
+			}
+			path := fields[i+1]
+			seen[path] = true
+
+			info, err := os.Stat(path)
+			switch {
+			case err != nil:
+				missing = append(missing, fmt.Sprintf("%s (%s)", path, err))
+			case !info.Mode().IsRegular():
+				missing = append(missing, path+" (not a file)")
+			case info.Size() == 0:
+				missing = append(missing, path+" (empty)")
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Error verifying certificates: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
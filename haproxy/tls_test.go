@@ -0,0 +1,93 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/certs"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_TLS(t *testing.T) {
+	Convey("TLS termination", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		dir, _ := ioutil.TempDir("", "certs")
+		defer os.RemoveAll(dir)
+
+		state := catalog.NewServicesState()
+		add := func(id string, name string, mode string, tlsCert string, svcPort int64) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, Updated: time.Now().UTC(), ProxyMode: mode, TLSCert: tlsCert,
+				Ports: []service.Port{{Type: "tcp", Port: 10450, ServicePort: svcPort, IP: "127.0.0.1"}},
+			})
+		}
+		add("deadbeef001", "web", "http", "", 8080)
+		add("deadbeef002", "api", "http", "api", 9090)
+		add("deadbeef003", "db", "tcp", "", 5432)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.CertDir = dir
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("uses the service's file, then the default for HTTP services", func() {
+			proxy.CertFiles = map[string]string{"db": "/etc/ssl/db.pem", "api": "/etc/ssl/api.pem"}
+			proxy.DefaultCertFile = "/etc/ssl/default.pem"
+
+			config := render()
+			So(config, ShouldContainSubstring, "bind 192.168.168.168:8080 ssl crt /etc/ssl/default.pem\n")
+			So(config, ShouldContainSubstring, "bind 192.168.168.168:9090 ssl crt /etc/ssl/api.pem\n")
+			So(config, ShouldContainSubstring, "bind 192.168.168.168:5432 ssl crt /etc/ssl/db.pem\n")
+
+			Convey("after the one fetched for its TLSCert", func() {
+				ioutil.WriteFile(certs.Path(dir, "api"), []byte("pem"), 0600)
+				So(render(), ShouldContainSubstring, "bind 192.168.168.168:9090 ssl crt "+certs.Path(dir, "api")+"\n")
+			})
+		})
+
+		Convey("leaves TCP services alone without a file of their own", func() {
+			proxy.DefaultCertFile = "/etc/ssl/default.pem"
+			So(render(), ShouldContainSubstring, "bind 192.168.168.168:5432\n")
+		})
+
+		Convey("checks the certificates exist before reloading", func() {
+			good := path.Join(dir, "good.pem")
+			empty := path.Join(dir, "empty.pem")
+			ioutil.WriteFile(good, []byte("pem"), 0600)
+			ioutil.WriteFile(empty, nil, 0600)
+
+			So(verifyCerts([]byte("frontend web-8080\n\tbind 10.0.0.1:8080 ssl crt "+good+" alpn h2\n")), ShouldBeNil)
+
+			err := verifyCerts([]byte("\tbind 10.0.0.1:8080 ssl crt " + empty + "\n" +
+				"\tbind 10.0.0.1:9090 ssl crt " + path.Join(dir, "missing.pem") + "\n"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "empty.pem (empty)")
+			So(err.Error(), ShouldContainSubstring, "missing.pem")
+		})
+
+		Convey("parses the per-service files", func() {
+			certFiles, err := ParseCertFiles([]string{"web:/etc/ssl/web.pem", "api:/etc/ssl/api.pem"})
+			So(err, ShouldBeNil)
+			So(certFiles, ShouldResemble, map[string]string{"web": "/etc/ssl/web.pem", "api": "/etc/ssl/api.pem"})
+
+			_, err = ParseCertFiles([]string{"web"})
+			So(err, ShouldNotBeNil)
+			_, err = ParseCertFiles([]string{":/etc/ssl/web.pem"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,169 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// TraefikEntryPointPrefix is prepended to the ServicePort to name the Traefik
+// entry point each router listens on. Entry points are part of Traefik's
+// static configuration, so they have to be defined there, e.g. "port-8080"
+// with the address ":8080".
+const TraefikEntryPointPrefix = "port-"
+
+// A TraefikConfig is the dynamic configuration for Traefik's HTTP provider.
+// It routes the same services, on the same ServicePorts, to the same
+// instances as the HAproxy config does.
+type TraefikConfig struct {
+	HTTP *TraefikProtocol `json:"http,omitempty"`
+	TCP  *TraefikProtocol `json:"tcp,omitempty"`
+}
+
+// A TraefikProtocol holds the routers and services for either HTTP or TCP
+type TraefikProtocol struct {
+	Routers  map[string]*TraefikRouter  `json:"routers"`
+	Services map[string]*TraefikService `json:"services"`
+}
+
+// A TraefikRouter sends the requests on an entry point to a service
+type TraefikRouter struct {
+	EntryPoints []string `json:"entryPoints"`
+	Rule        string   `json:"rule"`
+	Service     string   `json:"service"`
+}
+
+// A TraefikService balances the load over the instances of a service
+type TraefikService struct {
+	LoadBalancer TraefikLoadBalancer `json:"loadBalancer"`
+}
+
+// A TraefikLoadBalancer has a server for each instance. HTTP servers have a
+// URL, and TCP servers an address.
+type TraefikLoadBalancer struct {
+	Servers []TraefikServer `json:"servers"`
+}
+
+// A TraefikServer is one instance of a service
+type TraefikServer struct {
+	URL     string `json:"url,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+func newTraefikProtocol() *TraefikProtocol {
+	return &TraefikProtocol{
+		Routers:  make(map[string]*TraefikRouter),
+		Services: make(map[string]*TraefikService),
+	}
+}
+
+// Traefik builds the Traefik dynamic configuration from the state. Services
+// in "tcp" ProxyMode are routed as TCP, and the rest as HTTP. HTTP routers
+// match the PublicHostnames of the service when it has any, and everything
+// on the entry point otherwise.
+func Traefik(state *catalog.ServicesState) *TraefikConfig {
+	state.RLock()
+	services, _ := servicesWithPorts(state, nil)
+	modes := getModes(state)
+	hostnames := newestSetting(state, func(svc *service.Service) string {
+		return strings.Join(svc.PublicHostnames, ",")
+	})
+	state.RUnlock()
+
+	config := &TraefikConfig{HTTP: newTraefikProtocol(), TCP: newTraefikProtocol()}
+
+	for svcName, instances := range services {
+		for _, svcPort := range getSortedServicePorts(instances[0]) {
+			matchPort, err := strconv.ParseInt(svcPort, 10, 64)
+			if err != nil || matchPort == 0 {
+				continue
+			}
+
+			name := sanitizeName(svcName) + "-" + svcPort
+			router := &TraefikRouter{
+				EntryPoints: []string{TraefikEntryPointPrefix + svcPort},
+				Service:     name,
+			}
+
+			protocol := config.HTTP
+			if modes[svcName] == "tcp" {
+				protocol = config.TCP
+				router.Rule = "HostSNI(`*`)"
+			} else {
+				router.Rule = traefikHostRule(hostnames[svcName])
+			}
+
+			servers := traefikServers(matchPort, instances, protocol == config.TCP)
+			if len(servers) < 1 {
+				continue
+			}
+
+			protocol.Routers[name] = router
+			protocol.Services[name] = &TraefikService{LoadBalancer: TraefikLoadBalancer{Servers: servers}}
+		}
+	}
+
+	if len(config.HTTP.Routers) < 1 {
+		config.HTTP = nil
+	}
+	if len(config.TCP.Routers) < 1 {
+		config.TCP = nil
+	}
+
+	return config
+}
+
+// traefikHostRule matches a comma separated list of hostnames, or any host
+// when there are none
+func traefikHostRule(hostnames string) string {
+	if hostnames == "" {
+		return "PathPrefix(`/`)"
+	}
+
+	var rules []string
+	for _, hostname := range strings.Split(hostnames, ",") {
+		rules = append(rules, fmt.Sprintf("Host(`%s`)", hostname))
+	}
+
+	return strings.Join(rules, " || ")
+}
+
+// traefikServers returns the servers for one ServicePort of a service,
+// sorted. Instances whose own check on that port is failing are left out,
+// like they are from the HAproxy backends.
+func traefikServers(servicePort int64, instances []*service.Service, tcp bool) []TraefikServer {
+	var servers []TraefikServer
+	for _, svc := range instances {
+		if !svc.PortAlive(servicePort) {
+			continue
+		}
+
+		for _, port := range svc.Ports {
+			if port.Type != "tcp" || port.ServicePort != servicePort {
+				continue
+			}
+
+			host := port.IP
+			if host == "" {
+				host = svc.Hostname
+			}
+			address := fmt.Sprintf("%s:%d", host, port.Port)
+
+			if tcp {
+				servers = append(servers, TraefikServer{Address: address})
+			} else {
+				servers = append(servers, TraefikServer{URL: "http://" + address})
+			}
+		}
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].URL+servers[i].Address < servers[j].URL+servers[j].Address
+	})
+
+	return servers
+}
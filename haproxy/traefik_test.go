@@ -0,0 +1,76 @@
+package haproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Traefik(t *testing.T) {
+	Convey("Traefik()", t, func() {
+		state := catalog.NewServicesState()
+		add := func(svc service.Service) {
+			svc.Updated = time.Now().UTC()
+			state.AddServiceEntry(svc)
+		}
+
+		add(service.Service{
+			ID: "deadbeef001", Name: "awesome-svc", Hostname: hostname1, ProxyMode: "http",
+			PublicHostnames: []string{"awesome.example.com", "www.awesome.example.com"},
+			Ports:           []service.Port{{Type: "tcp", Port: 32768, ServicePort: 8080, IP: "10.0.0.2"}},
+		})
+		add(service.Service{
+			ID: "deadbeef002", Name: "awesome-svc", Hostname: hostname2, ProxyMode: "http",
+			PublicHostnames: []string{"awesome.example.com", "www.awesome.example.com"},
+			Ports:           []service.Port{{Type: "tcp", Port: 32769, ServicePort: 8080, IP: "10.0.0.1"}},
+		})
+		add(service.Service{
+			ID: "deadbeef003", Name: "database", Hostname: hostname1, ProxyMode: "tcp",
+			Ports: []service.Port{{Type: "tcp", Port: 32770, ServicePort: 5432, IP: "10.0.0.2"}},
+		})
+
+		Convey("routes the HTTP services by their PublicHostnames", func() {
+			config := Traefik(state)
+
+			So(config.HTTP.Routers["awesome-svc-8080"], ShouldResemble, &TraefikRouter{
+				EntryPoints: []string{"port-8080"},
+				Rule:        "Host(`awesome.example.com`) || Host(`www.awesome.example.com`)",
+				Service:     "awesome-svc-8080",
+			})
+			So(config.HTTP.Services["awesome-svc-8080"].LoadBalancer.Servers, ShouldResemble, []TraefikServer{
+				{URL: "http://10.0.0.1:32769"}, {URL: "http://10.0.0.2:32768"},
+			})
+		})
+
+		Convey("routes the TCP services by their addresses", func() {
+			config := Traefik(state)
+
+			So(config.TCP.Routers["database-5432"].Rule, ShouldEqual, "HostSNI(`*`)")
+			So(config.TCP.Services["database-5432"].LoadBalancer.Servers, ShouldResemble, []TraefikServer{
+				{Address: "10.0.0.2:32770"},
+			})
+		})
+
+		Convey("leaves out the instances HAproxy does", func() {
+			add(service.Service{
+				ID: "deadbeef004", Name: "database", Hostname: hostname2, ProxyMode: "tcp",
+				Status: service.UNHEALTHY,
+				Ports:  []service.Port{{Type: "tcp", Port: 32771, ServicePort: 5432, IP: "10.0.0.1"}},
+			})
+
+			config := Traefik(state)
+
+			So(len(config.TCP.Services["database-5432"].LoadBalancer.Servers), ShouldEqual, 1)
+		})
+
+		Convey("leaves out the protocols without any routers", func() {
+			config := Traefik(catalog.NewServicesState())
+
+			So(config.HTTP, ShouldBeNil)
+			So(config.TCP, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,231 @@
+package haproxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+// The type field of backend rows in the stats
+const statsTypeBackend = "1"
+
+// TrafficCounters are what HAproxy's stats say about a backend, or one of
+// its servers. The totals count up from when HAproxy was last started.
+type TrafficCounters struct {
+	Status        string // As HAproxy has it, e.g. UP, DOWN, MAINT, or DRAIN
+	Sessions      int64  // Open right now
+	Queued        int64  // Waiting for a connection slot
+	TotalSessions int64
+	Errors        int64 // 5xx responses, plus connection and response errors
+	// How long the last sessions lasted on average, when HAproxy says
+	AvgSessionTime time.Duration
+}
+
+// ServerTraffic is the traffic to one server, with the instance of the
+// service it is, when the catalog knows it
+type ServerTraffic struct {
+	Server   string
+	Hostname string `json:",omitempty"`
+	ID       string `json:",omitempty"`
+	TrafficCounters
+}
+
+// BackendTraffic is the traffic to a backend and each of its servers, with
+// the service it is for, when the catalog knows it
+type BackendTraffic struct {
+	Backend string
+	Service string `json:",omitempty"`
+	TrafficCounters
+	Servers []ServerTraffic
+}
+
+// Traffic returns the traffic to each backend, from "show stat"
+func (s *StatsSocket) Traffic() ([]BackendTraffic, error) {
+	output, err := s.command("show stat")
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseTraffic(output)
+}
+
+// ParseTraffic parses the CSV output of "show stat" into the traffic to
+// each backend, leaving out the frontends
+func ParseTraffic(output []byte) ([]BackendTraffic, error) {
+	rows, err := parseStats(output, "scur", "qcur", "stot", "status")
+	if err != nil || len(rows) < 1 {
+		return nil, err
+	}
+
+	var names []string
+	backends := make(map[string]*BackendTraffic)
+	backend := func(name string) *BackendTraffic {
+		if backends[name] == nil {
+			backends[name] = &BackendTraffic{Backend: name}
+			names = append(names, name)
+		}
+		return backends[name]
+	}
+
+	for _, row := range rows {
+		counters := TrafficCounters{
+			Status:        row["status"],
+			Sessions:      row.Int("scur"),
+			Queued:        row.Int("qcur"),
+			TotalSessions: row.Int("stot"),
+			Errors:        row.errors(),
+			// ttime is in milliseconds
+			AvgSessionTime: time.Duration(row.Int("ttime")) * time.Millisecond,
+		}
+
+		switch row["type"] {
+		case statsTypeBackend:
+			backend(row["pxname"]).TrafficCounters = counters
+		case statsTypeServer:
+			traffic := backend(row["pxname"])
+			traffic.Servers = append(traffic.Servers, ServerTraffic{Server: row["svname"], TrafficCounters: counters})
+		}
+	}
+
+	traffic := make([]BackendTraffic, 0, len(names))
+	for _, name := range names {
+		traffic = append(traffic, *backends[name])
+	}
+
+	return traffic, nil
+}
+
+// A TrafficSource is where the TrafficCollector reads the stats from.
+// Usually a StatsSocket.
+type TrafficSource interface {
+	Traffic() ([]BackendTraffic, error)
+}
+
+// A TrafficCollector reads HAproxy's stats for each backend and server,
+// ties them to the services and instances in the catalog, and exports them
+// as metrics, e.g. haproxy.traffic.web-8080.sessions. The errors are
+// counted as they happen, rather than as HAproxy's running totals.
+type TrafficCollector struct {
+	Source    TrafficSource
+	latest    []BackendTraffic
+	collected time.Time
+	errors    map[string]int64 // The running totals, by backend
+	sync.Mutex
+}
+
+// NewTrafficCollector returns a TrafficCollector reading from a source
+func NewTrafficCollector(source TrafficSource) *TrafficCollector {
+	return &TrafficCollector{
+		Source: source,
+		errors: make(map[string]int64),
+	}
+}
+
+// Collect reads the stats, exports them, and returns them, sorted by
+// backend and server
+func (c *TrafficCollector) Collect(state *catalog.ServicesState, now time.Time) ([]BackendTraffic, error) {
+	traffic, err := c.Source.Traffic()
+	if err != nil {
+		metrics.IncrCounter([]string{"haproxy", "traffic", "errors"}, 1)
+		return nil, err
+	}
+
+	backendServices, instances := trafficNames(state)
+
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].Backend < traffic[j].Backend })
+	for i := range traffic {
+		backend := &traffic[i]
+		backend.Service = backendServices[backend.Backend]
+
+		sort.Slice(backend.Servers, func(i, j int) bool { return backend.Servers[i].Server < backend.Servers[j].Server })
+		for j := range backend.Servers {
+			if svc, ok := instances[backend.Servers[j].Server]; ok {
+				backend.Servers[j].Hostname = svc.Hostname
+				backend.Servers[j].ID = svc.ID
+			}
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	errors := make(map[string]int64, len(traffic))
+	for _, backend := range traffic {
+		var up float32
+		for _, server := range backend.Servers {
+			if strings.HasPrefix(server.Status, "UP") {
+				up++
+			}
+		}
+
+		metrics.SetGauge([]string{"haproxy", "traffic", backend.Backend, "sessions"}, float32(backend.Sessions))
+		metrics.SetGauge([]string{"haproxy", "traffic", backend.Backend, "queued"}, float32(backend.Queued))
+		metrics.SetGauge([]string{"haproxy", "traffic", backend.Backend, "servers_up"}, up)
+
+		if previous, ok := c.errors[backend.Backend]; ok {
+			increase := backend.Errors - previous
+			// The totals start again when HAproxy does
+			if increase < 0 {
+				increase = backend.Errors
+			}
+			if increase > 0 {
+				metrics.IncrCounter([]string{"haproxy", "traffic", backend.Backend, "errors"}, float32(increase))
+			}
+		}
+		errors[backend.Backend] = backend.Errors
+	}
+
+	c.errors = errors
+	c.latest = traffic
+	c.collected = now
+
+	return traffic, nil
+}
+
+// trafficNames returns the services each backend is for, and the instances
+// of the services by their server name
+func trafficNames(state *catalog.ServicesState) (map[string]string, map[string]*service.Service) {
+	backends := make(map[string]string)
+	instances := make(map[string]*service.Service)
+
+	state.RLock()
+	defer state.RUnlock()
+
+	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		instances[svc.Hostname+"-"+svc.ID] = svc
+		for _, port := range svc.Ports {
+			if port.ServicePort != 0 {
+				backends[sanitizeName(svc.Name)+"-"+strconv.FormatInt(port.ServicePort, 10)] = svc.Name
+			}
+		}
+	})
+
+	return backends, instances
+}
+
+// Latest returns the stats from the last collection, and when that was.
+// The time is zero before the first.
+func (c *TrafficCollector) Latest() ([]BackendTraffic, time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]BackendTraffic{}, c.latest...), c.collected
+}
+
+// Run collects the stats on each iteration of the looper
+func (c *TrafficCollector) Run(state *catalog.ServicesState, looper director.Looper) {
+	looper.Loop(func() error {
+		if _, err := c.Collect(state, time.Now().UTC()); err != nil {
+			log.Warnf("Collecting HAproxy traffic stats failed: %s", err)
+		}
+		return nil
+	})
+}
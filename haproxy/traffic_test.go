@@ -0,0 +1,99 @@
+package haproxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A TrafficSource that serves up canned stats
+type fakeTrafficSource struct {
+	output []byte
+	err    error
+}
+
+func (f *fakeTrafficSource) Traffic() ([]BackendTraffic, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return ParseTraffic(f.output)
+}
+
+func Test_ParseTraffic(t *testing.T) {
+	Convey("ParseTraffic()", t, func() {
+		Convey("returns the backends with their servers", func() {
+			traffic, err := ParseTraffic([]byte(showStat))
+			So(err, ShouldBeNil)
+			So(traffic, ShouldHaveLength, 2)
+
+			web := traffic[0]
+			So(web.Backend, ShouldEqual, "web-8080")
+			So(web.TrafficCounters, ShouldResemble, TrafficCounters{Status: "UP", TotalSessions: 120, Errors: 23})
+			So(web.Servers, ShouldResemble, []ServerTraffic{
+				{Server: "alpha-deadbeef0001", TrafficCounters: TrafficCounters{Status: "UP", TotalSessions: 60, Errors: 1}},
+				{Server: "beta-deadbeef0002", TrafficCounters: TrafficCounters{Status: "UP", TotalSessions: 60, Errors: 22}},
+			})
+
+			So(traffic[1].Backend, ShouldEqual, "db-5432")
+			So(traffic[1].Servers, ShouldHaveLength, 1)
+		})
+
+		Convey("returns an error for output that isn't stats", func() {
+			_, err := ParseTraffic([]byte("Unknown command.\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_TrafficCollector(t *testing.T) {
+	Convey("TrafficCollector", t, func() {
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef0001", Name: "web", Hostname: "alpha", Updated: time.Now().UTC(),
+			Ports: []service.Port{{Type: "tcp", Port: 32768, ServicePort: 8080}},
+		})
+
+		source := &fakeTrafficSource{output: []byte(showStat)}
+		collector := NewTrafficCollector(source)
+		now := time.Now().UTC()
+
+		Convey("ties the backends and servers to the catalog", func() {
+			traffic, err := collector.Collect(state, now)
+			So(err, ShouldBeNil)
+			So(traffic[0].Backend, ShouldEqual, "db-5432")
+			So(traffic[0].Service, ShouldBeEmpty)
+
+			web := traffic[1]
+			So(web.Service, ShouldEqual, "web")
+			So(web.Servers[0].Hostname, ShouldEqual, "alpha")
+			So(web.Servers[0].ID, ShouldEqual, "deadbeef0001")
+			So(web.Servers[1].Hostname, ShouldBeEmpty)
+		})
+
+		Convey("keeps the last stats it read", func() {
+			latest, collected := collector.Latest()
+			So(latest, ShouldBeEmpty)
+			So(collected.IsZero(), ShouldBeTrue)
+
+			collector.Collect(state, now)
+			latest, collected = collector.Latest()
+			So(latest, ShouldHaveLength, 2)
+			So(collected, ShouldEqual, now)
+		})
+
+		Convey("keeps the last stats when they can't be read", func() {
+			collector.Collect(state, now)
+			source.err = errors.New("Error connecting to HAproxy stats socket")
+
+			_, err := collector.Collect(state, now.Add(time.Minute))
+			So(err, ShouldNotBeNil)
+			latest, collected := collector.Latest()
+			So(latest, ShouldHaveLength, 2)
+			So(collected, ShouldEqual, now)
+		})
+	})
+}
@@ -0,0 +1,198 @@
+package haproxy
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+var versionPattern = regexp.MustCompile(`HA-?Proxy version (\d+)\.(\d+)(?:\.(\d+))?`)
+
+// A Version is the release of an HAproxy binary, e.g. 2.4.22
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast returns whether this is the major.minor release or a later one
+func (v Version) AtLeast(major int, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// ParseVersion parses the output of "haproxy -v". Both the old "HA-Proxy"
+// and the newer "HAProxy" spellings are understood.
+func ParseVersion(output string) (Version, error) {
+	matches := versionPattern.FindStringSubmatch(output)
+	if matches == nil {
+		return Version{}, fmt.Errorf("Error parsing HAproxy version from '%s'", strings.TrimSpace(output))
+	}
+
+	var version Version
+	version.Major, _ = strconv.Atoi(matches[1])
+	version.Minor, _ = strconv.Atoi(matches[2])
+	if matches[3] != "" {
+		version.Patch, _ = strconv.Atoi(matches[3])
+	}
+
+	return version, nil
+}
+
+// DetectVersion runs the HAproxy binary with -v and returns its version
+func DetectVersion(binary string) (Version, error) {
+	output, err := exec.Command(binary, "-v").CombinedOutput()
+	if err != nil {
+		return Version{}, fmt.Errorf("Error running '%s -v': %s", binary, err)
+	}
+
+	return ParseVersion(string(output))
+}
+
+// ParseVersionString parses a version given as major.minor or
+// major.minor.patch, e.g. in a template
+func ParseVersionString(value string) (Version, error) {
+	return ParseVersion("HAProxy version " + value)
+}
+
+// DetectInstalledVersion runs the HAproxy Binary to find out which version
+// is installed, and keeps it for gating the features that need a newer one
+func (h *HAproxy) DetectInstalledVersion() (Version, error) {
+	version, err := DetectVersion(h.Binary)
+	if err != nil {
+		return Version{}, err
+	}
+
+	h.versionLock.Lock()
+	previous := h.version
+	h.version = &version
+	h.warned = nil
+	h.versionLock.Unlock()
+
+	if previous == nil {
+		log.Infof("Found HAproxy version %s", version)
+	} else if *previous != version {
+		log.Infof("HAproxy version changed from %s to %s", previous, version)
+	}
+
+	return version, nil
+}
+
+// InstalledVersion returns the version of HAproxy we found last, and false
+// if we haven't found one
+func (h *HAproxy) InstalledVersion() (Version, bool) {
+	h.versionLock.RLock()
+	defer h.versionLock.RUnlock()
+
+	if h.version == nil {
+		return Version{}, false
+	}
+
+	return *h.version, true
+}
+
+// supports returns whether the installed HAproxy is new enough for a
+// feature, and warns the first time it isn't. When we don't know the
+// version, we assume it is, and leave it to the config check.
+func (h *HAproxy) supports(feature string, major int, minor int) bool {
+	h.versionLock.Lock()
+	defer h.versionLock.Unlock()
+
+	if h.version == nil || h.version.AtLeast(major, minor) {
+		return true
+	}
+
+	if !h.warned[feature] {
+		log.Warnf("Not using %s, it needs HAproxy %d.%d or later and %s is installed",
+			feature, major, minor, h.version)
+		if h.warned == nil {
+			h.warned = make(map[string]bool)
+		}
+		h.warned[feature] = true
+	}
+
+	return false
+}
+
+// atLeast is the haproxyAtLeast template function. It takes the version as a
+// string, e.g. "2.2", and is true when we don't know the installed version.
+func (h *HAproxy) atLeast(value string) (bool, error) {
+	wanted, err := ParseVersionString(value)
+	if err != nil {
+		return false, err
+	}
+
+	installed, ok := h.InstalledVersion()
+	return !ok || installed.AtLeast(wanted.Major, wanted.Minor), nil
+}
+
+// RunVersionCheck looks for a different version of HAproxy on each run of
+// the looper, e.g. after a package upgrade, and writes the config and
+// reloads when there is one, so the new binary and the features gated on it
+// are picked up.
+func (h *HAproxy) RunVersionCheck(state *catalog.ServicesState, looper director.Looper) {
+	looper.Loop(func() error {
+		previous, known := h.InstalledVersion()
+
+		version, err := h.DetectInstalledVersion()
+		if err != nil {
+			log.Warnf("Can't check the HAproxy version: %s", err)
+			return nil
+		}
+
+		if known && version != previous {
+			if err := h.ForceWriteAndReload(state); err != nil {
+				log.Errorf("Error writing the HAproxy config for version %s: %s", version, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// ValidateTuning checks that the process, thread, and socket settings work
+// together and are supported by the version of HAproxy that is installed
+func (h *HAproxy) ValidateTuning(version Version) error {
+	var problems []string
+
+	if h.NbProc > 1 && h.NbThread > 1 {
+		problems = append(problems, "nbproc and nbthread can't both be more than 1")
+	}
+
+	if h.NbProc > 0 && version.AtLeast(2, 5) {
+		problems = append(problems, "nbproc was removed in HAproxy 2.5, use nbthread")
+	}
+
+	if h.NbThread > 0 && !version.AtLeast(1, 8) {
+		problems = append(problems, "nbthread needs HAproxy 1.8 or later")
+	}
+
+	if len(h.CPUMap) > 0 && !version.AtLeast(1, 5) {
+		problems = append(problems, "cpu-map needs HAproxy 1.5 or later")
+	}
+
+	if h.NoReusePort && !version.AtLeast(1, 6) {
+		problems = append(problems, "noreuseport needs HAproxy 1.6 or later")
+	}
+
+	for _, option := range strings.Fields(h.BindOptions) {
+		if option == "shards" && !version.AtLeast(2, 7) {
+			problems = append(problems, "the shards bind option needs HAproxy 2.7 or later")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid HAproxy tuning for version %s: %s", version, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
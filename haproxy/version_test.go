@@ -0,0 +1,117 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseVersion(t *testing.T) {
+	Convey("ParseVersion()", t, func() {
+		Convey("parses the newer version output", func() {
+			version, err := ParseVersion("HAProxy version 2.4.22-0ubuntu0.22.04.3 2023/12/04 - https://haproxy.org/\n")
+			So(err, ShouldBeNil)
+			So(version, ShouldResemble, Version{Major: 2, Minor: 4, Patch: 22})
+		})
+
+		Convey("parses the older version output", func() {
+			version, err := ParseVersion("HA-Proxy version 1.8.8-1ubuntu0.13 2020/12/02\nCopyright 2000-2018 Willy Tarreau")
+			So(err, ShouldBeNil)
+			So(version.String(), ShouldEqual, "1.8.8")
+		})
+
+		Convey("returns an error for anything else", func() {
+			_, err := ParseVersion("bash: haproxy: command not found")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_ValidateTuning(t *testing.T) {
+	Convey("ValidateTuning()", t, func() {
+		proxy := New("/tmp/haproxy.cfg", "/tmp/haproxy.pid")
+
+		Convey("accepts the defaults on any version", func() {
+			So(proxy.ValidateTuning(Version{Major: 1, Minor: 4}), ShouldBeNil)
+		})
+
+		Convey("rejects nbproc on versions that removed it", func() {
+			proxy.NbProc = 4
+			So(proxy.ValidateTuning(Version{Major: 2, Minor: 4}), ShouldBeNil)
+
+			err := proxy.ValidateTuning(Version{Major: 2, Minor: 6})
+			So(err.Error(), ShouldContainSubstring, "nbproc was removed in HAproxy 2.5")
+		})
+
+		Convey("rejects nbthread on versions without threads", func() {
+			proxy.NbThread = 4
+			err := proxy.ValidateTuning(Version{Major: 1, Minor: 7})
+			So(err.Error(), ShouldContainSubstring, "nbthread needs HAproxy 1.8")
+		})
+
+		Convey("rejects running several processes with several threads", func() {
+			proxy.NbProc = 2
+			proxy.NbThread = 2
+			err := proxy.ValidateTuning(Version{Major: 1, Minor: 8})
+			So(err.Error(), ShouldContainSubstring, "can't both be more than 1")
+		})
+
+		Convey("rejects shards on versions without them", func() {
+			proxy.BindOptions = "shards by-thread"
+			So(proxy.ValidateTuning(Version{Major: 2, Minor: 8}), ShouldBeNil)
+
+			err := proxy.ValidateTuning(Version{Major: 2, Minor: 6})
+			So(err.Error(), ShouldContainSubstring, "shards bind option needs HAproxy 2.7")
+		})
+	})
+}
+
+func Test_InstalledVersion(t *testing.T) {
+	Convey("Tracking the installed version", t, func() {
+		dir, _ := ioutil.TempDir("", "haproxy")
+		defer os.RemoveAll(dir)
+
+		binary := filepath.Join(dir, "haproxy")
+		ioutil.WriteFile(binary, []byte("#!/bin/sh\necho 'HAProxy version 2.4.22 2023/12/04'\n"), 0755)
+
+		proxy := New("/tmp/haproxy.cfg", "/tmp/haproxy.pid")
+		proxy.Binary = binary
+
+		Convey("assumes features are supported until it knows the version", func() {
+			_, ok := proxy.InstalledVersion()
+			So(ok, ShouldBeFalse)
+			So(proxy.supports("runtime updates", 2, 5), ShouldBeTrue)
+
+			atLeast, err := proxy.atLeast("3.0")
+			So(err, ShouldBeNil)
+			So(atLeast, ShouldBeTrue)
+		})
+
+		Convey("detects the version and gates features on it", func() {
+			version, err := proxy.DetectInstalledVersion()
+			So(err, ShouldBeNil)
+			So(version, ShouldResemble, Version{Major: 2, Minor: 4, Patch: 22})
+
+			installed, ok := proxy.InstalledVersion()
+			So(ok, ShouldBeTrue)
+			So(installed, ShouldResemble, version)
+
+			So(proxy.supports("HTTP/2", 1, 8), ShouldBeTrue)
+			So(proxy.supports("runtime updates", 2, 5), ShouldBeFalse)
+			So(proxy.warned["runtime updates"], ShouldBeTrue)
+
+			atLeast, _ := proxy.atLeast("2.2")
+			So(atLeast, ShouldBeTrue)
+			atLeast, _ = proxy.atLeast("2.6")
+			So(atLeast, ShouldBeFalse)
+		})
+
+		Convey("returns an error for a bad version in a template", func() {
+			_, err := proxy.atLeast("two")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,297 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// The virtual hosts and path prefixes a service declares
+type virtualHost struct {
+	Hostnames    []string
+	PathPrefixes []string
+	Port         int64 // The ServicePort they go to, 0 for the lowest one
+}
+
+// A templateVirtualHosts is what the template needs for the shared HTTP
+// frontend that routes by the Host header and the path. The Rules are in
+// the order HAproxy has to try them.
+type templateVirtualHosts struct {
+	Port        int
+	Binds       []string
+	RequestLogs bool
+	ACLs        []templateACL
+	Rules       []templateRule
+	Decisions   []string           // The services routed to that want SPOE decisions
+	Redirects   []templateRedirect // The services routed to that terminate TLS
+	RouteVar    string             // Where the service a request is routed to is set, if needed
+}
+
+// A templateACL is one line of an ACL. The lines with the same name match
+// when any of them does.
+type templateACL struct {
+	Name      string
+	Criterion string
+}
+
+// A templateRule sends the requests that match its ACLs to a backend
+type templateRule struct {
+	Condition string
+	Service   string
+	Backend   string
+}
+
+// A pathClaim is a path prefix one service has on some hostnames, or on all
+// of them when Hostnames is nil
+type pathClaim struct {
+	Service   string
+	Hostnames map[string]bool
+}
+
+// overlaps says whether the claim is on any of the hostnames
+func (c *pathClaim) overlaps(hostnames map[string]bool) bool {
+	if c.Hostnames == nil || hostnames == nil {
+		return true
+	}
+	for hostname := range hostnames {
+		if c.Hostnames[hostname] {
+			return true
+		}
+	}
+	return false
+}
+
+// getVirtualHosts returns the virtual hosts each service declares, taken
+// from the most recently updated instance
+func getVirtualHosts(state *catalog.ServicesState) map[string]virtualHost {
+	settings := newestMetadata(state, service.VirtualHostsKey, service.VirtualHostPortKey, service.PathPrefixesKey)
+
+	hosts := make(map[string]virtualHost)
+	for svcName, metadata := range settings {
+		svc := service.Service{Metadata: metadata}
+		hostnames, port, _ := svc.VirtualHosts()
+		prefixes := svc.PathPrefixes()
+		if len(hostnames) > 0 || len(prefixes) > 0 {
+			hosts[svcName] = virtualHost{Hostnames: hostnames, PathPrefixes: prefixes, Port: port}
+		}
+	}
+	return hosts
+}
+
+// virtualHosts returns the routes for the shared HTTP frontend, and the
+// warnings for the virtual hosts that had to be left out. A hostname, or a
+// path prefix on a hostname, claimed by more than one service goes to the
+// first of them by name. The longest path prefixes are tried first, then
+// the hostnames without one. With HTTPSRedirect, the requests for services
+// that have a certificate are redirected to them instead. Returns nil when
+// the frontend is off, or has nothing to route.
+func (h *HAproxy) virtualHosts(hosts map[string]virtualHost, ports portmap, modes map[string]string,
+	decisions map[string]bool, certPaths map[string]string) (*templateVirtualHosts, []ConfigWarning) {
+
+	if h.VirtualHostPort < 1 || len(hosts) < 1 {
+		return nil, nil
+	}
+
+	var warnings []ConfigWarning
+	warn := func(svcName string, format string, args ...interface{}) {
+		warnings = append(warnings, ConfigWarning{
+			Service: svcName, Kind: WarnVirtualHosts, Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	svcNames := make([]string, 0, len(hosts))
+	for svcName := range hosts {
+		svcNames = append(svcNames, svcName)
+	}
+	sort.Strings(svcNames)
+
+	// Binding the port for a service too would split its clients between them
+	vhostPort := strconv.Itoa(h.VirtualHostPort)
+	portNames := make([]string, 0, len(ports))
+	for svcName := range ports {
+		portNames = append(portNames, svcName)
+	}
+	sort.Strings(portNames)
+	for _, svcName := range portNames {
+		if _, ok := ports[svcName][vhostPort]; ok {
+			for _, name := range svcNames {
+				warn(name, "Left out because %s has the virtual host port %s as a ServicePort", svcName, vhostPort)
+			}
+			return nil, warnings
+		}
+	}
+
+	result := &templateVirtualHosts{
+		Port:        h.VirtualHostPort,
+		Binds:       h.bindAddresses(""),
+		RequestLogs: h.RequestLogs,
+	}
+
+	type pathRule struct {
+		Prefix string
+		templateRule
+	}
+	var pathRules []pathRule
+	var hostRules []templateRule
+	claimed := make(map[string]string)
+	pathClaims := make(map[string][]pathClaim)
+	decided := make(map[string]bool)
+
+	for _, svcName := range svcNames {
+		host := hosts[svcName]
+
+		if modes[svcName] != "http" {
+			warn(svcName, "Left out because only HTTP services can have virtual hosts")
+			continue
+		}
+
+		port := lowestPort(ports[svcName])
+		if host.Port != 0 {
+			port = strconv.FormatInt(host.Port, 10)
+			if _, ok := ports[svcName][port]; !ok {
+				warn(svcName, "Left out because it has no ServicePort %s", port)
+				continue
+			}
+		}
+		if port == "" {
+			continue
+		}
+
+		backend := sanitizeName(svcName) + "-" + port
+		hostACL := "host_" + backend
+		var taken []string
+		var routed bool
+
+		if len(host.PathPrefixes) > 0 {
+			var hostnames map[string]bool
+			if len(host.Hostnames) > 0 {
+				hostnames = make(map[string]bool, len(host.Hostnames))
+				for _, hostname := range host.Hostnames {
+					hostnames[hostname] = true
+				}
+			}
+
+			for i, prefix := range host.PathPrefixes {
+				if owner := claimedBy(pathClaims[prefix], svcName, hostnames); owner != "" {
+					taken = append(taken, prefix+" (to "+owner+")")
+					continue
+				}
+				pathClaims[prefix] = append(pathClaims[prefix], pathClaim{Service: svcName, Hostnames: hostnames})
+
+				pathACL := fmt.Sprintf("path_%s_%d", backend, i+1)
+				if prefix == "/" {
+					result.ACLs = append(result.ACLs, templateACL{Name: pathACL, Criterion: "path_beg /"})
+				} else {
+					result.ACLs = append(result.ACLs,
+						templateACL{Name: pathACL, Criterion: "path " + prefix},
+						templateACL{Name: pathACL, Criterion: "path_beg " + prefix + "/"},
+					)
+				}
+
+				condition := pathACL
+				if hostnames != nil {
+					condition = hostACL + " " + pathACL
+				}
+				pathRules = append(pathRules, pathRule{
+					Prefix:       prefix,
+					templateRule: templateRule{Condition: condition, Service: svcName, Backend: backend},
+				})
+				routed = true
+			}
+
+			if routed && hostnames != nil {
+				result.ACLs = append(result.ACLs, hostnamesACL(hostACL, host.Hostnames))
+			}
+		} else {
+			var kept []string
+			for _, hostname := range host.Hostnames {
+				if owner, ok := claimed[hostname]; ok && owner != svcName {
+					taken = append(taken, hostname+" (to "+owner+")")
+					continue
+				}
+				claimed[hostname] = svcName
+				kept = append(kept, hostname)
+			}
+
+			if len(kept) > 0 {
+				result.ACLs = append(result.ACLs, hostnamesACL(hostACL, kept))
+				hostRules = append(hostRules, templateRule{Condition: hostACL, Service: svcName, Backend: backend})
+				routed = true
+			}
+		}
+
+		if len(taken) > 0 {
+			warn(svcName, "Left out what goes to other services: %s", strings.Join(taken, ", "))
+		}
+		if routed && decisions[svcName] {
+			decided[svcName] = true
+		}
+		if routed && h.HTTPSRedirect && certPaths[svcName] != "" {
+			result.Redirects = append(result.Redirects, httpsRedirect(svcName, port))
+		}
+	}
+
+	// The longest prefixes go first, so they win over the ones they're under
+	sort.SliceStable(pathRules, func(i, j int) bool {
+		return len(pathRules[i].Prefix) > len(pathRules[j].Prefix)
+	})
+	for _, rule := range pathRules {
+		result.Rules = append(result.Rules, rule.templateRule)
+	}
+	result.Rules = append(result.Rules, hostRules...)
+
+	if len(result.Rules) < 1 {
+		return nil, warnings
+	}
+
+	for _, svcName := range svcNames {
+		if decided[svcName] {
+			result.Decisions = append(result.Decisions, svcName)
+		}
+	}
+
+	// Only the first rule that matches a request may act on it
+	if len(result.Redirects) > 0 || (len(result.Decisions) > 0 && h.spoe() != nil) {
+		result.RouteVar = spoeRouteVar
+	}
+
+	return result, warnings
+}
+
+// claimedBy returns the other service that has a claim on a path prefix on
+// any of the hostnames, or "" if none does
+func claimedBy(claims []pathClaim, svcName string, hostnames map[string]bool) string {
+	for i := range claims {
+		if claims[i].Service != svcName && claims[i].overlaps(hostnames) {
+			return claims[i].Service
+		}
+	}
+	return ""
+}
+
+// hostnamesACL returns the ACL line that matches the Host header, without a
+// port, against some hostnames
+func hostnamesACL(name string, hostnames []string) templateACL {
+	return templateACL{Name: name, Criterion: "hdr(host),field(1,:) -i " + strings.Join(hostnames, " ")}
+}
+
+// lowestPort returns the lowest of the ServicePorts, or "" when there are
+// none
+func lowestPort(ports portset) string {
+	var lowest int
+	for svcPort := range ports {
+		port, err := strconv.Atoi(svcPort)
+		if err == nil && (lowest == 0 || port < lowest) {
+			lowest = port
+		}
+	}
+
+	if lowest == 0 {
+		return ""
+	}
+	return strconv.Itoa(lowest)
+}
@@ -0,0 +1,188 @@
+package haproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_VirtualHosts(t *testing.T) {
+	Convey("The virtual hosts", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		var added int
+		add := func(id string, name string, mode string, metadata map[string]string, servicePorts ...int64) {
+			var ports []service.Port
+			for i, svcPort := range servicePorts {
+				ports = append(ports, service.Port{Type: "tcp", Port: 10450 + int64(i), ServicePort: svcPort, IP: "127.0.0.1"})
+			}
+			// The later instances are newer, so their settings win
+			added++
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, ProxyMode: mode, Metadata: metadata, Ports: ports,
+				Updated: baseTime.Add(time.Duration(added) * time.Second),
+			})
+		}
+		add("deadbeef001", "web", "http", map[string]string{"VirtualHosts": "www.example.com,example.com"}, 9090, 8080)
+		add("deadbeef002", "api", "http", map[string]string{"VirtualHosts": "api.example.com", "VirtualHostPort": "9091"}, 9091, 9092)
+		add("deadbeef003", "db", "tcp", nil, 5432)
+
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.BindIP = "192.168.168.168"
+		proxy.Template = "../views/haproxy.cfg"
+
+		render := func() string {
+			buf := bytes.NewBuffer(make([]byte, 0, 4096))
+			So(proxy.WriteConfig(state, buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("have no frontend when it's off", func() {
+			So(render(), ShouldNotContainSubstring, "vhosts")
+		})
+
+		Convey("are routed to by the Host header on the shared port", func() {
+			proxy.VirtualHostPort = 80
+
+			config := render()
+			So(config, ShouldContainSubstring, "frontend vhosts-80\n\tmode http\n\tbind 192.168.168.168:80\n"+
+				"\tacl host_api-9091 hdr(host),field(1,:) -i api.example.com\n"+
+				"\tacl host_web-8080 hdr(host),field(1,:) -i www.example.com example.com\n"+
+				"\tuse_backend api-9091 if host_api-9091\n"+
+				"\tuse_backend web-8080 if host_web-8080\n")
+			So(config, ShouldContainSubstring, "frontend web-8080\n")
+			So(proxy.Warnings(), ShouldBeEmpty)
+
+			Convey("and ask the SPOE agent about the services that want decisions", func() {
+				proxy.SPOEAgent = "127.0.0.1:7780"
+				proxy.SPOEConfigFile = "/etc/haproxy-spoe.conf"
+				add("deadbeef004", "api", "http", map[string]string{
+					"VirtualHosts": "api.example.com", "VirtualHostPort": "9091", "RateLimit": "10/s",
+				}, 9091, 9092)
+
+				So(render(), ShouldContainSubstring, "\tacl host_web-8080 hdr(host),field(1,:) -i www.example.com example.com\n"+
+					"\tfilter spoe engine sidecar config /etc/haproxy-spoe.conf\n"+
+					"\thttp-request set-var(txn.sidecar_route) str(api) if host_api-9091 !{ var(txn.sidecar_route) -m found }\n"+
+					"\thttp-request set-var(txn.sidecar_route) str(web) if host_web-8080 !{ var(txn.sidecar_route) -m found }\n"+
+					"\thttp-request set-var(txn.sidecar_service) var(txn.sidecar_route) if { var(txn.sidecar_route) -m str api }\n"+
+					"\thttp-request send-spoe-group sidecar check-request if { var(txn.sidecar_service) -m found }\n")
+			})
+		})
+
+		Convey("route by path prefix, longest first", func() {
+			proxy.VirtualHostPort = 80
+			add("deadbeef004", "api", "http", map[string]string{
+				"VirtualHosts": "example.com", "PathPrefixes": "/api,/static/", "VirtualHostPort": "9091",
+			}, 9091, 9092)
+			add("deadbeef005", "api-v2", "http", map[string]string{"PathPrefixes": "/api/v2"}, 7070)
+
+			config := render()
+			So(config, ShouldContainSubstring, "\tacl path_api-9091_1 path /api\n"+
+				"\tacl path_api-9091_1 path_beg /api/\n"+
+				"\tacl path_api-9091_2 path /static\n"+
+				"\tacl path_api-9091_2 path_beg /static/\n"+
+				"\tacl host_api-9091 hdr(host),field(1,:) -i example.com\n"+
+				"\tacl path_api-v2-7070_1 path /api/v2\n"+
+				"\tacl path_api-v2-7070_1 path_beg /api/v2/\n"+
+				"\tacl host_web-8080 hdr(host),field(1,:) -i www.example.com example.com\n")
+			So(config, ShouldContainSubstring, "\tuse_backend api-9091 if host_api-9091 path_api-9091_2\n"+
+				"\tuse_backend api-v2-7070 if path_api-v2-7070_1\n"+
+				"\tuse_backend api-9091 if host_api-9091 path_api-9091_1\n"+
+				"\tuse_backend web-8080 if host_web-8080\n")
+			So(proxy.Warnings(), ShouldBeEmpty)
+
+			Convey("and leave out the prefixes another service has on the same hosts", func() {
+				add("deadbeef006", "www", "http", map[string]string{
+					"VirtualHosts": "example.com,www.example.com", "PathPrefixes": "/static,/",
+				}, 6060)
+
+				config := render()
+				So(config, ShouldContainSubstring, "\tacl path_www-6060_2 path_beg /\n")
+				So(config, ShouldNotContainSubstring, "path_www-6060_1")
+
+				warnings := proxy.Warnings()
+				So(len(warnings), ShouldEqual, 1)
+				So(warnings[0].Service, ShouldEqual, "www")
+				So(warnings[0].Message, ShouldContainSubstring, "/static (to api)")
+			})
+
+			Convey("which the templates can look up", func() {
+				overlay, _ := ioutil.TempFile("", "haproxy.cfg")
+				defer os.Remove(overlay.Name())
+				overlay.WriteString(`{{ define "extra" }}# {{ pathPrefixesFor "api" }}{{ end }}`)
+				overlay.Close()
+				proxy.TemplateOverlay = overlay.Name()
+
+				So(render(), ShouldContainSubstring, "# [/api /static]")
+			})
+		})
+
+		Convey("redirect to the services that terminate TLS", func() {
+			proxy.VirtualHostPort = 80
+			proxy.HTTPSRedirect = true
+			proxy.CertFiles = map[string]string{"api": "/etc/ssl/api.pem"}
+
+			config := render()
+			So(config, ShouldContainSubstring, "\tacl host_web-8080 hdr(host),field(1,:) -i www.example.com example.com\n"+
+				"\thttp-request set-var(txn.sidecar_route) str(api) if host_api-9091 !{ var(txn.sidecar_route) -m found }\n"+
+				"\thttp-request set-var(txn.sidecar_route) str(web) if host_web-8080 !{ var(txn.sidecar_route) -m found }\n"+
+				"\thttp-request redirect location https://%[hdr(host),field(1,:)]:9091%[capture.req.uri] code 301"+
+				" if { var(txn.sidecar_route) -m str api }\n"+
+				"\tuse_backend api-9091 if host_api-9091\n")
+			So(config, ShouldContainSubstring, "bind 192.168.168.168:9091 ssl crt /etc/ssl/api.pem\n")
+
+			Convey("leaving out the port when it's 443", func() {
+				proxy.CertFiles["secure"] = "/etc/ssl/secure.pem"
+				add("deadbeef004", "secure", "http", map[string]string{"VirtualHosts": "secure.example.com"}, 443)
+				So(render(), ShouldContainSubstring, "redirect location https://%[hdr(host),field(1,:)]%[capture.req.uri] code 301")
+			})
+		})
+
+		Convey("don't ask the SPOE agent when no service routed to wants decisions", func() {
+			proxy.VirtualHostPort = 80
+			proxy.SPOEAgent = "127.0.0.1:7780"
+			proxy.SPOEConfigFile = "/etc/haproxy-spoe.conf"
+
+			So(render(), ShouldNotContainSubstring, "sidecar_route")
+		})
+
+		Convey("that can't be routed are left out with a warning", func() {
+			proxy.VirtualHostPort = 80
+			add("deadbeef004", "db", "tcp", map[string]string{"VirtualHosts": "db.example.com"}, 5432)
+			add("deadbeef005", "www", "http", map[string]string{"VirtualHosts": "www.example.com,www2.example.com"}, 7070)
+			add("deadbeef006", "api", "http", map[string]string{"VirtualHosts": "api.example.com", "VirtualHostPort": "9999"}, 9091, 9092)
+
+			config := render()
+			So(config, ShouldNotContainSubstring, "host_api")
+			So(config, ShouldContainSubstring, "\tacl host_www-7070 hdr(host),field(1,:) -i www2.example.com\n")
+
+			warnings := proxy.Warnings()
+			So(len(warnings), ShouldEqual, 3)
+			So(warnings[0].Service, ShouldEqual, "api")
+			So(warnings[0].Message, ShouldContainSubstring, "no ServicePort 9999")
+			So(warnings[1].Service, ShouldEqual, "db")
+			So(warnings[1].Message, ShouldContainSubstring, "only HTTP services")
+			So(warnings[2].Service, ShouldEqual, "www")
+			So(warnings[2].Message, ShouldContainSubstring, "www.example.com (to web)")
+		})
+
+		Convey("have no frontend when a service has its port", func() {
+			proxy.VirtualHostPort = 5432
+
+			So(render(), ShouldNotContainSubstring, "vhosts")
+			warnings := proxy.Warnings()
+			So(len(warnings), ShouldEqual, 2)
+			So(warnings[0].Kind, ShouldEqual, WarnVirtualHosts)
+			So(warnings[0].Message, ShouldContainSubstring, "db has the virtual host port 5432")
+		})
+	})
+}
@@ -0,0 +1,154 @@
+package haproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// The problems with a service that rendering the config runs into
+const (
+	WarnPortMismatch   = "PortMismatch"   // Some instances are left out for having other ServicePorts
+	WarnNoServicePorts = "NoServicePorts" // No TCP or UDP port has a ServicePort, so it has no frontends
+	WarnNameCollision  = "NameCollision"  // Its name sanitizes to the same as another service's
+	WarnVirtualHosts   = "VirtualHosts"   // Some of its virtual hosts are left out
+	WarnSNIHosts       = "SNIHosts"       // Some of its SNI hosts are left out
+	WarnTrafficSplit   = "TrafficSplit"   // Some versions in its traffic split have no instances
+	WarnStickiness     = "Stickiness"     // It asked for stickiness its mode can't have
+	WarnTimeouts       = "Timeouts"       // Some of its timeouts or retries are invalid
+	WarnBindInterfaces = "BindInterfaces" // Some of its interfaces aren't configured
+	WarnAllowedCallers = "AllowedCallers" // Some of its allowed callers have no instances
+	WarnMirror         = "Mirror"         // Its requests can't be mirrored as it asked
+)
+
+// A ConfigWarning is a problem with a service that the config rendered with.
+// It stays for as long as the renders keep running into it, and Count says
+// how many of them in a row did.
+type ConfigWarning struct {
+	Service   string
+	Kind      string
+	Message   string
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// configWarnings finds the problems with the services in a render
+func configWarnings(services map[string][]*service.Service, ports portmap, udpPorts portmap,
+	exclusions []Exclusion) []ConfigWarning {
+
+	var warnings []ConfigWarning
+
+	mismatched := make(map[string][]string)
+	for _, exclusion := range exclusions {
+		if exclusion.Reason == ExcludedPortMismatch {
+			mismatched[exclusion.Service] = append(mismatched[exclusion.Service], exclusion.Server)
+		}
+	}
+	for svcName, servers := range mismatched {
+		warnings = append(warnings, ConfigWarning{
+			Service: svcName,
+			Kind:    WarnPortMismatch,
+			Message: "Left out for ServicePorts that differ from the other instances': " + strings.Join(servers, ", "),
+		})
+	}
+
+	sanitized := make(map[string][]string)
+	for svcName, svcList := range services {
+		// Services in maintenance have no instances, and no frontends either way
+		if len(svcList) > 0 && len(ports[svcName]) == 0 && len(udpPorts[svcName]) == 0 {
+			warnings = append(warnings, ConfigWarning{
+				Service: svcName,
+				Kind:    WarnNoServicePorts,
+				Message: "None of its TCP or UDP ports has a ServicePort, so it has no frontends",
+			})
+		}
+
+		name := sanitizeName(svcName)
+		sanitized[name] = append(sanitized[name], svcName)
+	}
+	for name, svcNames := range sanitized {
+		if len(svcNames) < 2 {
+			continue
+		}
+
+		sort.Strings(svcNames)
+		for _, svcName := range svcNames {
+			warnings = append(warnings, ConfigWarning{
+				Service: svcName,
+				Kind:    WarnNameCollision,
+				Message: fmt.Sprintf("Its frontends and backends are named %s-*, like those of %s",
+					name, strings.Join(without(svcNames, svcName), ", ")),
+			})
+		}
+	}
+
+	return warnings
+}
+
+// recordWarnings counts the warnings from a render. The ones that it didn't
+// run into are dropped, and the new ones are logged.
+func (h *HAproxy) recordWarnings(warnings []ConfigWarning) {
+	now := clock.OrReal(h.Clock).Now().UTC()
+
+	h.warningsLock.Lock()
+	defer h.warningsLock.Unlock()
+
+	current := make(map[string]ConfigWarning, len(warnings))
+	for _, warning := range warnings {
+		key := warning.Service + "/" + warning.Kind
+		if previous, ok := h.warnings[key]; ok {
+			warning.Count = previous.Count
+			warning.FirstSeen = previous.FirstSeen
+		} else {
+			warning.FirstSeen = now
+			log.Warnf("HAproxy config warning for %s (%s): %s", warning.Service, warning.Kind, warning.Message)
+		}
+		warning.Count++
+		warning.LastSeen = now
+
+		current[key] = warning
+	}
+	h.warnings = current
+
+	metrics.SetGauge([]string{"haproxy", "config_warnings"}, float32(len(current)))
+}
+
+// Warnings returns the problems the last config rendered ran into, sorted
+// by service and kind
+func (h *HAproxy) Warnings() []ConfigWarning {
+	h.warningsLock.RLock()
+	defer h.warningsLock.RUnlock()
+
+	warnings := make([]ConfigWarning, 0, len(h.warnings))
+	for _, warning := range h.warnings {
+		warnings = append(warnings, warning)
+	}
+
+	sort.Slice(warnings, func(i, j int) bool {
+		if warnings[i].Service != warnings[j].Service {
+			return warnings[i].Service < warnings[j].Service
+		}
+		return warnings[i].Kind < warnings[j].Kind
+	})
+
+	return warnings
+}
+
+// without returns the strings other than one
+func without(values []string, value string) []string {
+	var result []string
+	for _, other := range values {
+		if other != value {
+			result = append(result, other)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,87 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ConfigWarnings(t *testing.T) {
+	Convey("Config warnings", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := catalog.NewServicesState()
+		baseTime := time.Now().UTC()
+		ports := []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "127.0.0.1"}}
+
+		add := func(id string, name string, ports []service.Port) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: hostname1, Updated: baseTime, Ports: ports,
+			})
+		}
+
+		fakeClock := clock.NewFake(baseTime)
+		proxy := New("tmpConfig", "tmpPid")
+		proxy.Template = "../views/haproxy.cfg"
+		proxy.Clock = fakeClock
+
+		render := func() {
+			So(proxy.WriteConfig(state, ioutil.Discard), ShouldBeNil)
+		}
+
+		Convey("are counted over the renders that run into them", func() {
+			add("deadbeef001", "web", ports)
+			add("deadbeef002", "web", []service.Port{{Type: "tcp", Port: 10451, ServicePort: 9090, IP: "127.0.0.1"}})
+
+			render()
+			fakeClock.Advance(time.Minute)
+			render()
+
+			warnings := proxy.Warnings()
+			So(len(warnings), ShouldEqual, 1)
+			So(warnings[0].Kind, ShouldEqual, WarnPortMismatch)
+			So(warnings[0].Count, ShouldEqual, 2)
+			So(warnings[0].FirstSeen, ShouldEqual, baseTime)
+			So(warnings[0].LastSeen, ShouldEqual, baseTime.Add(time.Minute))
+			So(warnings[0].Message, ShouldContainSubstring, hostname1+"-deadbeef00")
+
+			Convey("and dropped once they don't", func() {
+				state.AddServiceEntry(service.Service{
+					ID: "deadbeef002", Name: "web", Hostname: hostname1, Updated: baseTime.Add(time.Second),
+					Ports: ports, Status: service.TOMBSTONE,
+				})
+				render()
+
+				So(proxy.Warnings(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("include the services without ServicePorts", func() {
+			add("deadbeef001", "web", []service.Port{{Type: "tcp", Port: 10450, IP: "127.0.0.1"}})
+			render()
+
+			warnings := proxy.Warnings()
+			So(len(warnings), ShouldEqual, 1)
+			So(warnings[0].Kind, ShouldEqual, WarnNoServicePorts)
+		})
+
+		Convey("include the services whose names collide once sanitized", func() {
+			add("deadbeef001", "web.app", ports)
+			add("deadbeef002", "web_app", []service.Port{{Type: "tcp", Port: 10451, ServicePort: 8081, IP: "127.0.0.1"}})
+			render()
+
+			warnings := proxy.Warnings()
+			So(len(warnings), ShouldEqual, 2)
+			So(warnings[0].Service, ShouldEqual, "web.app")
+			So(warnings[0].Kind, ShouldEqual, WarnNameCollision)
+			So(warnings[0].Message, ShouldContainSubstring, "like those of web_app")
+			So(warnings[1].Service, ShouldEqual, "web_app")
+		})
+	})
+}
@@ -0,0 +1,229 @@
+package healthy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/NinesStack/sidecar/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// An Annotation is a note that an operator attaches to a check, e.g. a link
+// to the incident that explains why it is failing. A silencing annotation
+// also stops the check from raising events while it is in effect. The check
+// keeps running either way.
+type Annotation struct {
+	CheckID string
+	Note    string
+	Author  string
+	Silence bool
+	Created time.Time
+	Expires time.Time // The zero time means it never expires
+}
+
+// Expired tells us whether the annotation has run out at this time
+func (a *Annotation) Expired(t time.Time) bool {
+	return !a.Expires.IsZero() && !t.Before(a.Expires)
+}
+
+// Annotate attaches an annotation to a check, replacing any previous one.
+// The check must exist. If an AnnotationsFile is configured, the annotations
+// are saved to it.
+func (m *Monitor) Annotate(annotation Annotation) error {
+	if annotation.Author == "" {
+		return fmt.Errorf("Error annotating check %s: an author is required", annotation.CheckID)
+	}
+
+	now := m.now()
+	if annotation.Expired(now) {
+		return fmt.Errorf("Error annotating check %s: already expired at %s", annotation.CheckID, annotation.Expires)
+	}
+	if annotation.Created.IsZero() {
+		annotation.Created = now
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.Checks[annotation.CheckID]; !ok {
+		return fmt.Errorf("Error annotating check %s: no such check", annotation.CheckID)
+	}
+
+	if m.annotations == nil {
+		m.annotations = make(map[string]*Annotation)
+	}
+	m.annotations[annotation.CheckID] = &annotation
+
+	log.Infof("Check %s annotated by %s (silenced: %t): %s",
+		annotation.CheckID, annotation.Author, annotation.Silence, annotation.Note)
+
+	return m.saveAnnotations()
+}
+
+// RemoveAnnotation removes the annotation from a check, lifting any silence
+func (m *Monitor) RemoveAnnotation(checkID string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.annotations[checkID]; !ok {
+		return fmt.Errorf("Error removing annotation: check %s has none", checkID)
+	}
+	delete(m.annotations, checkID)
+
+	return m.saveAnnotations()
+}
+
+// Annotations returns the annotations that are still in effect, sorted by
+// check ID
+func (m *Monitor) Annotations() []Annotation {
+	m.RLock()
+	defer m.RUnlock()
+
+	now := m.now()
+	var result []Annotation
+	for _, annotation := range m.annotations {
+		if !annotation.Expired(now) {
+			result = append(result, *annotation)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].CheckID < result[j].CheckID })
+
+	return result
+}
+
+// annotationFor returns the annotation in effect for a check, if any. Must
+// be called while holding the lock.
+func (m *Monitor) annotationFor(checkID string, t time.Time) *Annotation {
+	annotation, ok := m.annotations[checkID]
+	if !ok || annotation.Expired(t) {
+		return nil
+	}
+
+	return annotation
+}
+
+// silenced tells us whether a check's events are currently silenced
+func (m *Monitor) silenced(checkID string, t time.Time) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	annotation := m.annotationFor(checkID, t)
+	return annotation != nil && annotation.Silence
+}
+
+// LoadAnnotations reads back the annotations saved in the AnnotationsFile,
+// dropping any that have expired. A missing file is not an error.
+func (m *Monitor) LoadAnnotations() error {
+	if m.AnnotationsFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(m.AnnotationsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading check annotations: %s", err)
+	}
+
+	var annotations []Annotation
+	if err := json.Unmarshal(data, &annotations); err != nil {
+		return fmt.Errorf("Error decoding check annotations from %s: %s", m.AnnotationsFile, err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+	m.annotations = make(map[string]*Annotation, len(annotations))
+	for i, annotation := range annotations {
+		if annotation.Expired(now) {
+			continue
+		}
+		m.annotations[annotation.CheckID] = &annotations[i]
+	}
+
+	return nil
+}
+
+// saveAnnotations writes the annotations that are still in effect to the
+// AnnotationsFile, if there is one. The file is replaced atomically. Must be
+// called while holding the lock.
+func (m *Monitor) saveAnnotations() error {
+	if m.AnnotationsFile == "" {
+		return nil
+	}
+
+	now := m.now()
+	annotations := make([]Annotation, 0, len(m.annotations))
+	for id, annotation := range m.annotations {
+		if annotation.Expired(now) {
+			delete(m.annotations, id)
+			continue
+		}
+		annotations = append(annotations, *annotation)
+	}
+
+	data, err := json.MarshalIndent(annotations, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding check annotations: %s", err)
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(m.AnnotationsFile), ".annotations")
+	if err != nil {
+		return fmt.Errorf("Error saving check annotations: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("Error saving check annotations: %s", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("Error saving check annotations: %s", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), m.AnnotationsFile); err != nil {
+		return fmt.Errorf("Error saving check annotations: %s", err)
+	}
+
+	return nil
+}
+
+// publishStatusChange raises an event when a check changes status, unless
+// the check is silenced
+func (m *Monitor) publishStatusChange(check *Check, previous int, t time.Time) {
+	if m.Events == nil || check.Status == previous {
+		return
+	}
+
+	if m.silenced(check.ID, t) {
+		log.Debugf("Check %s is silenced, not raising status change event", check.ID)
+		return
+	}
+
+	subject := check.ServiceName
+	if subject == "" {
+		subject = check.ID
+	}
+
+	m.Events.Publish(events.Event{
+		Time:    t,
+		Type:    "CheckStatusChanged",
+		Source:  "healthy",
+		Subject: subject,
+		Message: fmt.Sprintf("Check %s went from %s to %s", check.ID, StatusString(previous), StatusString(check.Status)),
+		Details: map[string]string{
+			"CheckID":  check.ID,
+			"Hostname": check.Hostname,
+			"Previous": StatusString(previous),
+			"Status":   StatusString(check.Status),
+		},
+	})
+}
@@ -0,0 +1,105 @@
+package healthy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Annotations(t *testing.T) {
+	Convey("Annotating checks", t, func() {
+		monitor := NewMonitor(hostname, "/")
+		cmd := &mockCommand{DesiredResult: HEALTHY}
+		monitor.AddCheck(&Check{ID: "abc", Type: "mock", Command: cmd, ServiceName: "web"})
+
+		Convey("Attaches an annotation that shows up in the statuses", func() {
+			err := monitor.Annotate(Annotation{CheckID: "abc", Note: "Looking into it", Author: "jane"})
+			So(err, ShouldBeNil)
+
+			statuses := monitor.CheckStatuses()
+			So(statuses[0].Annotation, ShouldNotBeNil)
+			So(statuses[0].Annotation.Note, ShouldEqual, "Looking into it")
+			So(statuses[0].Annotation.Created.IsZero(), ShouldBeFalse)
+		})
+
+		Convey("Requires an author and an existing check", func() {
+			So(monitor.Annotate(Annotation{CheckID: "abc", Note: "Anonymous"}), ShouldNotBeNil)
+			So(monitor.Annotate(Annotation{CheckID: "zzz", Author: "jane"}), ShouldNotBeNil)
+		})
+
+		Convey("Drops annotations once they expire", func() {
+			So(monitor.Annotate(Annotation{
+				CheckID: "abc", Author: "jane", Expires: time.Now().UTC().Add(-1 * time.Second),
+			}), ShouldNotBeNil)
+
+			monitor.annotations = map[string]*Annotation{
+				"abc": {CheckID: "abc", Author: "jane", Expires: time.Now().UTC().Add(-1 * time.Second)},
+			}
+			So(monitor.CheckStatuses()[0].Annotation, ShouldBeNil)
+			So(monitor.Annotations(), ShouldBeEmpty)
+		})
+
+		Convey("Expires annotations by the monitor's clock", func() {
+			fake := clock.NewFake(time.Now().UTC())
+			monitor.Clock = fake
+
+			So(monitor.Annotate(Annotation{
+				CheckID: "abc", Author: "jane", Expires: fake.Now().Add(time.Hour),
+			}), ShouldBeNil)
+			So(monitor.Annotations(), ShouldHaveLength, 1)
+
+			fake.Advance(time.Hour)
+			So(monitor.Annotations(), ShouldBeEmpty)
+		})
+
+		Convey("Removes annotations", func() {
+			So(monitor.Annotate(Annotation{CheckID: "abc", Author: "jane"}), ShouldBeNil)
+			So(monitor.RemoveAnnotation("abc"), ShouldBeNil)
+			So(monitor.RemoveAnnotation("abc"), ShouldNotBeNil)
+			So(monitor.Annotations(), ShouldBeEmpty)
+		})
+
+		Convey("Raises events on status changes unless silenced", func() {
+			bus := events.NewBus(10)
+			monitor.Events = bus
+
+			monitor.Run(director.NewFreeLooper(director.ONCE, nil))
+			So(bus.Recent(), ShouldBeEmpty) // The first run doesn't count
+
+			cmd.DesiredResult = FAILED
+			monitor.Run(director.NewFreeLooper(director.ONCE, nil))
+			So(len(bus.Recent()), ShouldEqual, 1)
+			So(bus.Recent()[0].Type, ShouldEqual, "CheckStatusChanged")
+			So(bus.Recent()[0].Subject, ShouldEqual, "web")
+
+			So(monitor.Annotate(Annotation{CheckID: "abc", Author: "jane", Silence: true}), ShouldBeNil)
+			cmd.DesiredResult = HEALTHY
+			monitor.Run(director.NewFreeLooper(director.ONCE, nil))
+			So(len(bus.Recent()), ShouldEqual, 1)
+			So(monitor.CheckStatuses()[0].Status, ShouldEqual, "Healthy")
+		})
+
+		Convey("Saves and loads annotations from a file", func() {
+			dir, err := ioutil.TempDir("", "annotations")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			monitor.AnnotationsFile = filepath.Join(dir, "annotations.json")
+			So(monitor.LoadAnnotations(), ShouldBeNil) // Missing file is fine
+			So(monitor.Annotate(Annotation{CheckID: "abc", Author: "jane", Silence: true}), ShouldBeNil)
+
+			restarted := NewMonitor(hostname, "/")
+			restarted.AnnotationsFile = monitor.AnnotationsFile
+			So(restarted.LoadAnnotations(), ShouldBeNil)
+			So(len(restarted.Annotations()), ShouldEqual, 1)
+			So(restarted.silenced("abc", time.Now().UTC()), ShouldBeTrue)
+		})
+	})
+}
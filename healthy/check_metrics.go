@@ -0,0 +1,126 @@
+package healthy
+
+import (
+	"sort"
+	"time"
+)
+
+// The upper bounds, in seconds, of the buckets check durations are counted
+// in. There is one more bucket for everything over the last one.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// An Exemplar is one run of a check that a bucket of its durations has
+// counted, with the ID of the trace it was part of
+type Exemplar struct {
+	TraceID  string
+	Duration float64 // In seconds
+	Time     time.Time
+}
+
+// A Transition counts the times a check went from one status to another
+type Transition struct {
+	From  string
+	To    string
+	Count uint64
+}
+
+// CheckMetrics are the durations and status transitions of one check since
+// it was added. Buckets has a count for each of the DurationBuckets, and
+// then the one for the rest. They aren't cumulative. Exemplars has the
+// latest traced run for each bucket, or nil for those without one.
+type CheckMetrics struct {
+	ID          string
+	ServiceName string
+	Buckets     []uint64
+	Exemplars   []*Exemplar
+	Count       uint64
+	Sum         float64 // In seconds
+	Transitions []Transition
+}
+
+// observe counts a run that took this long
+func (c *CheckMetrics) observe(duration time.Duration, traceID string, t time.Time) {
+	seconds := duration.Seconds()
+
+	bucket := sort.SearchFloat64s(DurationBuckets, seconds)
+	c.Buckets[bucket]++
+	c.Count++
+	c.Sum += seconds
+
+	if traceID != "" {
+		c.Exemplars[bucket] = &Exemplar{TraceID: traceID, Duration: seconds, Time: t}
+	}
+}
+
+// transition counts a change of status
+func (c *CheckMetrics) transition(from int, to int) {
+	fromName, toName := StatusString(from), StatusString(to)
+	for i := range c.Transitions {
+		if c.Transitions[i].From == fromName && c.Transitions[i].To == toName {
+			c.Transitions[i].Count++
+			return
+		}
+	}
+
+	c.Transitions = append(c.Transitions, Transition{From: fromName, To: toName, Count: 1})
+	sort.Slice(c.Transitions, func(i, j int) bool {
+		if c.Transitions[i].From != c.Transitions[j].From {
+			return c.Transitions[i].From < c.Transitions[j].From
+		}
+		return c.Transitions[i].To < c.Transitions[j].To
+	})
+}
+
+// recordMetrics counts the latest run of a check, and its change of status
+// from previous. The first run only establishes where the check stands, so
+// it isn't counted as a change.
+func (m *Monitor) recordMetrics(check *Check, previous int, t time.Time) {
+	m.metricsLock.Lock()
+	defer m.metricsLock.Unlock()
+
+	if m.checkMetrics == nil {
+		m.checkMetrics = make(map[string]*CheckMetrics)
+	}
+
+	metrics, ok := m.checkMetrics[check.ID]
+	if !ok {
+		metrics = &CheckMetrics{
+			ID:          check.ID,
+			ServiceName: check.ServiceName,
+			Buckets:     make([]uint64, len(DurationBuckets)+1),
+			Exemplars:   make([]*Exemplar, len(DurationBuckets)+1),
+		}
+		m.checkMetrics[check.ID] = metrics
+	}
+
+	metrics.observe(check.LastResult.Latency, check.LastResult.TraceID, t)
+	if !check.LastRun.IsZero() && check.Status != previous {
+		metrics.transition(previous, check.Status)
+	}
+}
+
+// CheckMetrics returns a copy of the metrics for each check, sorted by ID
+func (m *Monitor) CheckMetrics() []CheckMetrics {
+	m.metricsLock.Lock()
+	defer m.metricsLock.Unlock()
+
+	all := make([]CheckMetrics, 0, len(m.checkMetrics))
+	for _, metrics := range m.checkMetrics {
+		copied := *metrics
+		copied.Buckets = append([]uint64{}, metrics.Buckets...)
+		copied.Exemplars = append([]*Exemplar{}, metrics.Exemplars...)
+		copied.Transitions = append([]Transition{}, metrics.Transitions...)
+		all = append(all, copied)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+
+	return all
+}
+
+// forgetMetrics drops the metrics for a check that was removed
+func (m *Monitor) forgetMetrics(checkID string) {
+	m.metricsLock.Lock()
+	defer m.metricsLock.Unlock()
+
+	delete(m.checkMetrics, checkID)
+}
@@ -0,0 +1,100 @@
+package healthy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_CheckMetrics(t *testing.T) {
+	Convey("The check metrics", t, func() {
+		status := http.StatusOK
+		var traceParent string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceParent = r.Header.Get("traceparent")
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		monitor := NewMonitor(hostname, "/")
+		monitor.TraceChecks = true
+		monitor.AddCheck(&Check{
+			ID: "deadbeef001", ServiceName: "web", Type: "HttpGet", Args: server.URL,
+			Command: monitor.GetCommandNamed("HttpGet"), MaxCount: 3,
+		})
+		looper := director.NewFreeLooper(director.ONCE, nil)
+
+		Convey("count the durations of each run", func() {
+			monitor.Run(looper)
+			monitor.Run(looper)
+
+			metrics := monitor.CheckMetrics()
+			So(metrics, ShouldHaveLength, 1)
+			So(metrics[0].ServiceName, ShouldEqual, "web")
+			So(metrics[0].Count, ShouldEqual, 2)
+			So(metrics[0].Buckets, ShouldHaveLength, len(DurationBuckets)+1)
+
+			var total uint64
+			for _, count := range metrics[0].Buckets {
+				total += count
+			}
+			So(total, ShouldEqual, 2)
+		})
+
+		Convey("link the runs to their traces", func() {
+			monitor.Run(looper)
+
+			So(traceParent, ShouldStartWith, "00-")
+			traceID := strings.Split(traceParent, "-")[1]
+			So(monitor.Checks["deadbeef001"].LastResult.TraceID, ShouldEqual, traceID)
+
+			var exemplars []*Exemplar
+			for _, exemplar := range monitor.CheckMetrics()[0].Exemplars {
+				if exemplar != nil {
+					exemplars = append(exemplars, exemplar)
+				}
+			}
+			So(exemplars, ShouldHaveLength, 1)
+			So(exemplars[0].TraceID, ShouldEqual, traceID)
+		})
+
+		Convey("count the changes of status, but not the first run", func() {
+			monitor.Run(looper)
+			status = http.StatusServiceUnavailable
+			monitor.Run(looper)
+			monitor.Run(looper)
+
+			So(monitor.CheckMetrics()[0].Transitions, ShouldResemble, []Transition{
+				{From: "Healthy", To: "Sickly", Count: 1},
+			})
+		})
+
+		Convey("put a run in the bucket for its duration", func() {
+			metrics := &CheckMetrics{
+				Buckets:   make([]uint64, len(DurationBuckets)+1),
+				Exemplars: make([]*Exemplar, len(DurationBuckets)+1),
+			}
+			metrics.observe(100*time.Millisecond, "", time.Now())
+			metrics.observe(time.Minute, "abc", time.Now())
+
+			So(metrics.Buckets[4], ShouldEqual, 1)
+			So(metrics.Buckets[len(DurationBuckets)], ShouldEqual, 1)
+			So(metrics.Exemplars[4], ShouldBeNil)
+			So(metrics.Exemplars[len(DurationBuckets)].TraceID, ShouldEqual, "abc")
+			So(metrics.Sum, ShouldAlmostEqual, 60.1)
+		})
+
+		Convey("send no trace when tracing is off", func() {
+			monitor.Checks["deadbeef001"].Command = &HttpGetCmd{}
+			monitor.Run(looper)
+
+			So(traceParent, ShouldBeEmpty)
+			So(monitor.Checks["deadbeef001"].LastResult.TraceID, ShouldBeEmpty)
+		})
+	})
+}
@@ -4,6 +4,9 @@
 package healthy
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"net/http"
 	"os/exec"
@@ -12,24 +15,67 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// How much of a check's output we hold on to
+const maxOutputSize = 1024
+
 // A Checker that makes an HTTP get call and expects to get
 // a 200-299 back as success. Anything else is considered
 // a failure. The URL to hit is passed as the args to the
-// Run method.
-type HttpGetCmd struct{}
+// Run method. If a Resolver is set, hostnames are resolved
+// through its cache. The output is the HTTP status line. With
+// Trace, each request starts a W3C trace the service can join,
+// and the result carries its ID.
+type HttpGetCmd struct {
+	Resolver *Resolver
+	Trace    bool
+}
+
+func (h *HttpGetCmd) Run(ctx context.Context, args CheckArgs) (Result, error) {
+	client := http.DefaultClient
+	if h.Resolver != nil {
+		client = h.Resolver.Client()
+	}
+
+	req, err := http.NewRequest("GET", args.Args, nil)
+	if err != nil {
+		return Result{Status: UNKNOWN}, err
+	}
+
+	var traceID string
+	if h.Trace {
+		var traceParent string
+		if traceID, traceParent = newTraceParent(); traceID != "" {
+			req.Header.Set("traceparent", traceParent)
+		}
+	}
 
-func (h *HttpGetCmd) Run(args string) (int, error) {
-	resp, err := http.Get(args)
+	resp, err := client.Do(req.WithContext(ctx))
 	if resp == nil {
-		return UNKNOWN, errors.New("No body from HTTP response!")
+		if err == nil {
+			err = errors.New("No body from HTTP response!")
+		}
+		return Result{Status: UNKNOWN, TraceID: traceID}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return HEALTHY, nil
+		return Result{Status: HEALTHY, Output: resp.Status, TraceID: traceID}, nil
 	}
 
-	return SICKLY, err
+	return Result{Status: SICKLY, Output: resp.Status, TraceID: traceID}, err
+}
+
+// newTraceParent returns a new trace ID, and a W3C traceparent header that
+// starts a sampled trace with it
+func newTraceParent() (string, string) {
+	ids := make([]byte, 24)
+	if _, err := rand.Read(ids); err != nil {
+		return "", ""
+	}
+
+	traceID := hex.EncodeToString(ids[:16])
+	spanID := hex.EncodeToString(ids[16:])
+	return traceID, "00-" + traceID + "-" + spanID + "-01"
 }
 
 // A Checker that works with Nagios checks or other simple
@@ -38,20 +84,25 @@ func (h *HttpGetCmd) Run(args string) (int, error) {
 // The command is passed as the args to the Run method. The
 // command will be executed without a shell wrapper to keep
 // the call as lean as possible in the majority case. If you
-// need a shell you must invoke it yourself.
+// need a shell you must invoke it yourself. The command is
+// killed if the check times out.
 type ExternalCmd struct{}
 
-func (e *ExternalCmd) Run(args string) (int, error) {
-	cliArgs := strings.Split(args, " ")
-	cmd := exec.Command(cliArgs[0], cliArgs[1:]...)
+func (e *ExternalCmd) Run(ctx context.Context, args CheckArgs) (Result, error) {
+	cliArgs := strings.Split(args.Args, " ")
+	cmd := exec.CommandContext(ctx, cliArgs[0], cliArgs[1:]...)
 
 	output, err := cmd.CombinedOutput()
+	if len(output) > maxOutputSize {
+		output = output[:maxOutputSize]
+	}
+
 	if err == nil {
-		return HEALTHY, nil
+		return Result{Status: HEALTHY, Output: string(output)}, nil
 	}
 
 	log.Errorf("Error running command: %s (%s)\n", err.Error(), output)
-	return SICKLY, err
+	return Result{Status: SICKLY, Output: string(output)}, err
 }
 
 // A Checker that always returns success. Usually used in
@@ -59,6 +110,6 @@ func (e *ExternalCmd) Run(args string) (int, error) {
 // some reason.
 type AlwaysSuccessfulCmd struct{}
 
-func (a *AlwaysSuccessfulCmd) Run(args string) (int, error) {
-	return HEALTHY, nil
+func (a *AlwaysSuccessfulCmd) Run(ctx context.Context, args CheckArgs) (Result, error) {
+	return Result{Status: HEALTHY}, nil
 }
@@ -0,0 +1,64 @@
+package healthy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_HttpGetCmd(t *testing.T) {
+	Convey("HttpGetCmd", t, func() {
+		status := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		cmd := &HttpGetCmd{}
+
+		Convey("is healthy on a 2xx and reports the status line", func() {
+			result, err := cmd.Run(context.Background(), CheckArgs{Args: server.URL})
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, HEALTHY)
+			So(result.Output, ShouldEqual, "200 OK")
+		})
+
+		Convey("is sickly on anything else", func() {
+			status = http.StatusServiceUnavailable
+			result, _ := cmd.Run(context.Background(), CheckArgs{Args: server.URL})
+			So(result.Status, ShouldEqual, SICKLY)
+			So(result.Output, ShouldEqual, "503 Service Unavailable")
+		})
+
+		Convey("gives up when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			result, err := cmd.Run(ctx, CheckArgs{Args: server.URL})
+			So(err, ShouldNotBeNil)
+			So(result.Status, ShouldEqual, UNKNOWN)
+		})
+	})
+}
+
+func Test_ExternalCmd(t *testing.T) {
+	Convey("ExternalCmd", t, func() {
+		cmd := &ExternalCmd{}
+
+		Convey("is healthy when the command succeeds and keeps its output", func() {
+			result, err := cmd.Run(context.Background(), CheckArgs{Args: "echo hello"})
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, HEALTHY)
+			So(result.Output, ShouldEqual, "hello\n")
+		})
+
+		Convey("is sickly when the command fails", func() {
+			result, err := cmd.Run(context.Background(), CheckArgs{Args: "false"})
+			So(err, ShouldNotBeNil)
+			So(result.Status, ShouldEqual, SICKLY)
+		})
+	})
+}
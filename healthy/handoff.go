@@ -0,0 +1,73 @@
+package healthy
+
+import (
+	"sort"
+
+	"github.com/NinesStack/sidecar/service"
+)
+
+// A SavedStatus is where a check had got to, for a Sidecar taking over from
+// this one to carry on from
+type SavedStatus struct {
+	ID     string
+	Status int
+	Count  int
+}
+
+// SavedStatuses returns where each check has got to, sorted by ID
+func (m *Monitor) SavedStatuses() []SavedStatus {
+	m.RLock()
+	defer m.RUnlock()
+
+	saved := make([]SavedStatus, 0, len(m.Checks))
+	for _, check := range m.Checks {
+		saved = append(saved, SavedStatus{ID: check.ID, Status: check.Status, Count: check.Count})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+
+	return saved
+}
+
+// RestoreStatuses has the checks that haven't been added yet start from
+// the saved statuses, rather than Unknown, so their services don't drop out
+// while the checks get going. Until their checks are added, the services
+// are marked with them too.
+func (m *Monitor) RestoreStatuses(saved []SavedStatus) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.restored = make(map[string]SavedStatus, len(saved))
+	for _, status := range saved {
+		m.restored[status.ID] = status
+	}
+}
+
+// restoreStatus starts a new check from its saved status, if it has one.
+// Each saved status is only used once.
+func (m *Monitor) restoreStatus(check *Check) {
+	m.Lock()
+	defer m.Unlock()
+
+	saved, ok := m.restored[check.ID]
+	if !ok {
+		return
+	}
+	delete(m.restored, check.ID)
+
+	if check.ConfigError == nil {
+		check.Status = saved.Status
+		check.Count = saved.Count
+	}
+}
+
+// restoredServiceStatus returns the service status for a check that hasn't
+// been added yet, from its saved status. The monitor must be locked.
+func (m *Monitor) restoredServiceStatus(checkID string) int {
+	saved, ok := m.restored[checkID]
+	if !ok {
+		return service.UNKNOWN
+	}
+
+	check := Check{Status: saved.Status}
+	return check.ServiceStatus()
+}
@@ -0,0 +1,53 @@
+package healthy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SavedStatuses(t *testing.T) {
+	Convey("The statuses handed over to another Sidecar", t, func() {
+		old := NewMonitor(hostname, "/")
+		old.AddCheck(&Check{ID: "web", Status: HEALTHY})
+		old.AddCheck(&Check{ID: "api", Status: SICKLY, Count: 1})
+		old.AddCheck(&Check{ID: "api:admin", Status: FAILED, Count: 3})
+
+		saved := old.SavedStatuses()
+		So(saved, ShouldResemble, []SavedStatus{
+			{ID: "api", Status: SICKLY, Count: 1},
+			{ID: "api:admin", Status: FAILED, Count: 3},
+			{ID: "web", Status: HEALTHY},
+		})
+
+		ports := []service.Port{
+			{Type: "tcp", Port: 1234, ServicePort: 8081, IP: "127.0.0.1"},
+			{Type: "tcp", Port: 1235, ServicePort: 9000, IP: "127.0.0.1", Name: "admin"},
+		}
+		svcList := []service.Service{{ID: "api", Name: "hasCheck", Ports: ports, Created: time.Now().UTC()}}
+		disco := &mockPortChecker{mockDiscoverer{listFn: func() []service.Service { return svcList }}}
+
+		monitor := NewMonitor(hostname, "/")
+		monitor.DiscoveryFn = disco.Services
+		monitor.RestoreStatuses(saved)
+
+		Convey("mark the services before their checks are added", func() {
+			marked := monitor.Services()
+			So(marked[0].Status, ShouldEqual, service.ALIVE)
+			So(marked[0].PortAlive(9000), ShouldBeFalse)
+		})
+
+		Convey("are where the new checks start from", func() {
+			monitor.Watch(disco, director.NewFreeLooper(director.ONCE, nil))
+
+			So(monitor.Checks["api"].Status, ShouldEqual, SICKLY)
+			So(monitor.Checks["api"].Count, ShouldEqual, 1)
+			So(monitor.Checks["api:admin"].Status, ShouldEqual, FAILED)
+			So(monitor.restored, ShouldContainKey, "web")
+			So(monitor.restored, ShouldNotContainKey, "api")
+		})
+	})
+}
@@ -6,11 +6,17 @@
 package healthy
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/recovery"
 	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
 	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 )
@@ -38,6 +44,25 @@ type Monitor struct {
 	DefaultCheckHost     string
 	DiscoveryFn          func() []service.Service
 	DefaultCheckEndpoint string
+	CheckViaProxy        bool        // Whether checks go through the proxy unless the service says
+	ProxyCheckHost       string      // Where the proxy listens, required for checks through it
+	Resolver             *Resolver   // Optional DNS cache for HttpGet checks
+	Events               *events.Bus // Optional bus for check status changes
+	AnnotationsFile      string      // Optional file to save annotations to
+	HistorySize          int         // Results kept per check, zero for none
+	HistoryMaxBytes      int         // Ceiling on the size of all the history, zero for none
+	Clock                clock.Clock // Tells the time for scheduling checks and annotations
+	TraceChecks          bool        // Whether HttpGet checks start a trace the service can join
+	annotations          map[string]*Annotation
+	restored             map[string]SavedStatus // Statuses handed over by another Sidecar, by check ID
+	history              map[string][]CheckResult
+	historyBytes         int
+	historyLock          sync.Mutex
+	checkMetrics         map[string]*CheckMetrics
+	metricsLock          sync.Mutex
+	hooks                hooks
+	hooksLock            sync.RWMutex
+	runLock              sync.Mutex
 	sync.RWMutex
 }
 
@@ -51,6 +76,14 @@ type Check struct {
 	// The ID of this check
 	ID string
 
+	// The name of the service being checked, and the host it runs on
+	ServiceName string
+	Hostname    string
+
+	// The named port of the service this check is for, when it's not for
+	// the whole service
+	PortName string
+
 	// The most recent status of this check
 	Status int
 
@@ -66,17 +99,81 @@ type Check struct {
 	// The arguments to pass to the Checker
 	Args string
 
+	// The arguments for checking the service through the proxy instead, if
+	// the check goes through it
+	ProxyArgs string
+
 	// The Checker to run to validate this
 	Command Checker
 
 	// The last recorded error on this check
 	LastError error
+
+	// The full result of the last run, with its latency and output
+	LastResult Result
+
+	// When the check last ran, and when the monitor expects to run it next
+	LastRun time.Time
+	NextRun time.Time
+
+	// Optionally restricts when the check may run
+	Schedule Schedule
+
+	// The Args parsed into the options struct for the Type of check, e.g.
+	// HttpGetOptions. When they can't be parsed, ConfigError says why and
+	// the check doesn't run.
+	Options     interface{}
+	ConfigError error
+
+	// When the service we are checking was created. Used to spot a service
+	// that was replaced while keeping the same ID.
+	serviceCreated time.Time
 }
 
+// A Checker runs a health check. It should give up when the context is
+// done. The Result carries the status along with whatever else the Checker
+// learned along the way.
 type Checker interface {
+	Run(ctx context.Context, args CheckArgs) (Result, error)
+}
+
+// CheckArgs are what a Checker is passed on each run
+type CheckArgs struct {
+	ID   string // The ID of the check
+	Args string // The arguments from the check definition, e.g. a URL
+}
+
+// A Result is the outcome of running a Checker. If the Latency is left
+// empty, the Monitor fills in how long the run took.
+type Result struct {
+	Status  int
+	Latency time.Duration
+	Output  string             `json:",omitempty"`
+	Metrics map[string]float64 `json:",omitempty"`
+	TraceID string             `json:",omitempty"` // The trace the run was part of, if it was traced
+}
+
+// A LegacyChecker is the original, simpler Checker interface. Wrap one with
+// AdaptLegacy to use it as a Checker.
+type LegacyChecker interface {
 	Run(args string) (int, error)
 }
 
+// AdaptLegacy turns a LegacyChecker into a Checker. The LegacyChecker can't
+// be cancelled, but the Monitor still times it out.
+func AdaptLegacy(checker LegacyChecker) Checker {
+	return &legacyAdapter{checker: checker}
+}
+
+type legacyAdapter struct {
+	checker LegacyChecker
+}
+
+func (l *legacyAdapter) Run(ctx context.Context, args CheckArgs) (Result, error) {
+	status, err := l.checker.Run(args.Args)
+	return Result{Status: status}, err
+}
+
 // NewCheck returns a properly configured default Check
 func NewCheck(id string) *Check {
 	check := Check{
@@ -113,6 +210,57 @@ func (check *Check) UpdateStatus(status int, err error) {
 	}
 }
 
+// A CheckStatus is a point-in-time snapshot of a Check, suitable for
+// reporting over the API.
+type CheckStatus struct {
+	ID          string
+	Service     string `json:",omitempty"`
+	Hostname    string `json:",omitempty"`
+	Port        string `json:",omitempty"`
+	Type        string
+	Args        string
+	ProxyArgs   string `json:",omitempty"`
+	Status      string
+	Count       int
+	MaxCount    int
+	LastError   string      `json:",omitempty"`
+	Options     interface{} `json:",omitempty"`
+	ConfigError string      `json:",omitempty"`
+	Latency     time.Duration
+	Output      string             `json:",omitempty"`
+	Metrics     map[string]float64 `json:",omitempty"`
+	LastRun     time.Time
+	NextRun     time.Time
+	Schedule    string      `json:",omitempty"`
+	Annotation  *Annotation `json:",omitempty"`
+}
+
+// StatusString returns a human readable version of a check status
+func StatusString(status int) string {
+	switch status {
+	case HEALTHY:
+		return "Healthy"
+	case SICKLY:
+		return "Sickly"
+	case FAILED:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+// runArgs returns the arguments for the next run. A check through the proxy
+// only goes through it while the service is alive, because the proxy only
+// sends requests to alive services. Otherwise it checks the service directly,
+// so the service can come back.
+func (check *Check) runArgs() string {
+	if check.ProxyArgs != "" && check.ServiceStatus() == service.ALIVE {
+		return check.ProxyArgs
+	}
+
+	return check.Args
+}
+
 func (check *Check) ServiceStatus() int {
 	switch check.Status {
 	case HEALTHY:
@@ -133,6 +281,9 @@ func NewMonitor(defaultCheckHost string, defaultCheckEndpoint string) *Monitor {
 		CheckInterval:        HEALTH_INTERVAL,
 		DefaultCheckHost:     defaultCheckHost,
 		DefaultCheckEndpoint: defaultCheckEndpoint,
+		HistorySize:          DefaultHistorySize,
+		HistoryMaxBytes:      DefaultHistoryMaxBytes,
+		Clock:                clock.Real{},
 	}
 	return &monitor
 }
@@ -140,9 +291,15 @@ func NewMonitor(defaultCheckHost string, defaultCheckEndpoint string) *Monitor {
 // Add a Check to the list. Handles synchronization.
 func (m *Monitor) AddCheck(check *Check) {
 	m.Lock()
-	defer m.Unlock()
 	log.Printf("Adding health check: %s (ID: %s), Args: %s", check.Type, check.ID, check.Args)
+	replaced := m.Checks[check.ID]
 	m.Checks[check.ID] = check
+	m.Unlock()
+
+	if replaced != nil && replaced != check {
+		m.checkRemoved(replaced)
+	}
+	m.checkAdded(check)
 }
 
 // MarkService takes a service and mark its Status appropriately based on the
@@ -157,62 +314,321 @@ func (m *Monitor) MarkService(svc *service.Service) {
 	if _, ok := m.Checks[svc.ID]; ok {
 		svc.Status = m.Checks[svc.ID].ServiceStatus()
 	} else {
-		svc.Status = service.UNKNOWN
+		svc.Status = m.restoredServiceStatus(svc.ID)
+	}
+
+	// Named ports with checks of their own take the status of their check.
+	// The ports are copied first so the discoverer's copy isn't changed.
+	var ports []service.Port
+	for i, port := range svc.Ports {
+		if port.Name == "" {
+			continue
+		}
+		checkID := portCheckID(svc.ID, port.Name)
+		check, ok := m.Checks[checkID]
+		_, restored := m.restored[checkID]
+		if !ok && !restored {
+			continue
+		}
+		if ports == nil {
+			ports = append([]service.Port{}, svc.Ports...)
+		}
+		if ok {
+			ports[i].Status = check.ServiceStatus()
+		} else {
+			ports[i].Status = m.restoredServiceStatus(checkID)
+		}
+	}
+	if ports != nil {
+		svc.Ports = ports
+	}
+
+	// Announce the check, so the proxies can run it too. The Metadata is
+	// copied like the ports.
+	if announced := m.proxyCheckMetadata(m.Checks[svc.ID], svc); announced != nil {
+		metadata := make(map[string]string, len(svc.Metadata)+len(announced))
+		for key, value := range svc.Metadata {
+			metadata[key] = value
+		}
+		for key, value := range announced {
+			metadata[key] = value
+		}
+		svc.Metadata = metadata
 	}
 	m.RUnlock()
 }
 
+// CheckStatuses returns a snapshot of all the current checks, sorted by ID
+func (m *Monitor) CheckStatuses() []CheckStatus {
+	m.RLock()
+	defer m.RUnlock()
+
+	now := m.now()
+	statuses := make([]CheckStatus, 0, len(m.Checks))
+	for _, check := range m.Checks {
+		status := CheckStatus{
+			ID:        check.ID,
+			Service:   check.ServiceName,
+			Hostname:  check.Hostname,
+			Port:      check.PortName,
+			Type:      check.Type,
+			Args:      check.Args,
+			ProxyArgs: check.ProxyArgs,
+			Status:    StatusString(check.Status),
+			Count:     check.Count,
+			MaxCount:  check.MaxCount,
+			Latency:   check.LastResult.Latency,
+			Output:    check.LastResult.Output,
+			Metrics:   check.LastResult.Metrics,
+			Options:   check.Options,
+			LastRun:   check.LastRun,
+			NextRun:   check.NextRun,
+		}
+
+		if check.LastError != nil {
+			status.LastError = check.LastError.Error()
+		}
+
+		if check.ConfigError != nil {
+			status.ConfigError = check.ConfigError.Error()
+		}
+
+		if check.Schedule != nil {
+			status.Schedule = check.Schedule.String()
+		}
+
+		if annotation := m.annotationFor(check.ID, now); annotation != nil {
+			copied := *annotation
+			status.Annotation = &copied
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+
+	return statuses
+}
+
+// A CheckGroup is the set of checks for one service or one host, along with
+// how many of them are in each status.
+type CheckGroup struct {
+	Name    string
+	Total   int
+	Healthy int
+	Sickly  int
+	Failed  int
+	Unknown int
+	Checks  []CheckStatus
+}
+
+// ChecksByService returns a snapshot of the current checks grouped by
+// service name, sorted by name
+func (m *Monitor) ChecksByService() []CheckGroup {
+	return groupChecks(m.CheckStatuses(), func(status *CheckStatus) string {
+		return status.Service
+	})
+}
+
+// ChecksByHost returns a snapshot of the current checks grouped by the host
+// the service runs on, sorted by name
+func (m *Monitor) ChecksByHost() []CheckGroup {
+	return groupChecks(m.CheckStatuses(), func(status *CheckStatus) string {
+		return status.Hostname
+	})
+}
+
+// groupChecks groups the statuses by the key and counts up the statuses in
+// each group. The statuses within a group keep their order.
+func groupChecks(statuses []CheckStatus, keyFn func(*CheckStatus) string) []CheckGroup {
+	groups := make(map[string]*CheckGroup)
+
+	for i := range statuses {
+		status := &statuses[i]
+		key := keyFn(status)
+
+		group, ok := groups[key]
+		if !ok {
+			group = &CheckGroup{Name: key}
+			groups[key] = group
+		}
+
+		group.Total++
+		switch status.Status {
+		case StatusString(HEALTHY):
+			group.Healthy++
+		case StatusString(SICKLY):
+			group.Sickly++
+		case StatusString(FAILED):
+			group.Failed++
+		default:
+			group.Unknown++
+		}
+		group.Checks = append(group.Checks, *status)
+	}
+
+	result := make([]CheckGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, *group)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result
+}
+
 // Run runs the main monitoring loop. The looper controls the actual run behavior.
 func (m *Monitor) Run(looper director.Looper) {
 	looper.Loop(func() error {
-		log.Debugf("Running checks")
-
-		var wg sync.WaitGroup
-
-		// Make immutable copy of m.Checks (checks are still mutable)
-		m.RLock()
-		checks := make(map[string]*Check, len(m.Checks))
-		for k, v := range m.Checks {
-			checks[k] = v
-		}
-		m.RUnlock()
-
-		wg.Add(len(checks))
-		for _, check := range checks {
-			// Run all checks in parallel in goroutines
-			resultChan := make(chan checkResult, 1)
-
-			go func(check *Check, resultChan chan checkResult) {
-				result, err := check.Command.Run(check.Args)
-				resultChan <- checkResult{result, err}
-			}(check, resultChan) // copy check pointer for the goroutine
-
-			go func(check *Check, resultChan chan checkResult) {
-				defer wg.Done()
-
-				// We make the call but we time out if it gets too close to the
-				// m.CheckInterval.
-				select {
-				case result := <-resultChan:
-					check.UpdateStatus(result.status, result.err)
-				case <-time.After(m.CheckInterval - 1*time.Millisecond):
-					log.Errorf("Error, check %s timed out! (%v)", check.ID, check.Args)
-					check.UpdateStatus(UNKNOWN, errors.New("Timed out!"))
+		m.RunChecks()
+		return nil
+	})
+}
+
+// RunChecks runs all of the checks once, in parallel, and waits for them to
+// complete or time out. Only one run happens at a time.
+func (m *Monitor) RunChecks() {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+
+	log.Debugf("Running checks")
+
+	var wg sync.WaitGroup
+	started := m.now()
+	began := time.Now() // Latency is always on the system clock
+
+	// Make immutable copy of m.Checks (checks are still mutable), leaving
+	// out the ones that aren't scheduled to run right now, and the ones that
+	// are configured wrong
+	m.RLock()
+	checks := make(map[string]*Check, len(m.Checks))
+	for k, v := range m.Checks {
+		if !v.scheduledAt(started) || v.ConfigError != nil {
+			continue
+		}
+		checks[k] = v
+	}
+	m.RUnlock()
+
+	wg.Add(len(checks))
+	for _, check := range checks {
+		// Run all checks in parallel in goroutines. We time them out if
+		// they get too close to the m.CheckInterval.
+		resultChan := make(chan checkResult, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), m.CheckInterval-1*time.Millisecond)
+
+		go func(check *Check, args string, resultChan chan checkResult) {
+			start := time.Now()
+
+			// A Checker that panics is treated like one that errored
+			var result Result
+			err := recovery.Run("check", func() error {
+				var err error
+				result, err = check.Command.Run(ctx, CheckArgs{ID: check.ID, Args: args})
+				return err
+			})
+			if _, ok := err.(*recovery.PanicError); ok {
+				result = Result{Status: UNKNOWN}
+			}
+			if result.Latency == 0 {
+				result.Latency = time.Since(start)
+			}
+			resultChan <- checkResult{result, err}
+		}(check, check.runArgs(), resultChan) // copy check pointer for the goroutine
+
+		go func(check *Check, resultChan chan checkResult) {
+			defer wg.Done()
+			defer cancel()
+
+			previous := check.Status
+
+			// Checkers that ignore the context still time out here
+			var err error
+			select {
+			case outcome := <-resultChan:
+				err = outcome.err
+				check.LastResult = outcome.result
+				check.UpdateStatus(outcome.result.Status, outcome.err)
+			case <-ctx.Done():
+				log.Errorf("Error, check %s timed out! (%v)", check.ID, check.Args)
+				err = errors.New("Timed out!")
+				check.LastResult = Result{Status: UNKNOWN, Latency: time.Since(began)}
+				check.UpdateStatus(UNKNOWN, err)
+			}
+
+			metrics.AddSample(
+				[]string{"healthy", "check", "latency"},
+				float32(check.LastResult.Latency)/float32(time.Millisecond),
+			)
+
+			// The first run only establishes where the check stands
+			if !check.LastRun.IsZero() {
+				m.publishStatusChange(check, previous, started)
+				if check.Status != previous {
+					m.statusChanged(check, previous)
 				}
-			}(check, resultChan) // copy check pointer for the goroutine
+			}
+			m.recordResult(check, err, started)
+			m.recordMetrics(check, previous, started)
+
+			check.LastRun = started
+			check.NextRun = m.nextRun(check, started)
+		}(check, resultChan) // copy check pointer for the goroutine
+	}
+
+	// Let's make sure we don't continue to spool up
+	// huge quantities of goroutines. Wait on all of them
+	// to complete before moving on. This could slow down
+	// our check loop if something doesn't time out properly.
+	wg.Wait()
+}
+
+// nextRun works out when the check will run again after a run at started.
+// The runner comes around every CheckInterval and skips the check when its
+// Schedule doesn't allow it, so this is the first of those times that the
+// Schedule allows. Returns the zero time if there is none within a year.
+func (m *Monitor) nextRun(check *Check, started time.Time) time.Time {
+	next := started.Add(m.CheckInterval)
+	if check.Schedule == nil || m.CheckInterval <= 0 {
+		return next
+	}
+
+	limit := started.AddDate(1, 0, 0)
+	for next.Before(limit) {
+		if check.Schedule.Allows(next.Local()) {
+			return next
 		}
 
-		// Let's make sure we don't continue to spool up
-		// huge quantities of goroutines. Wait on all of them
-		// to complete before moving on. This could slow down
-		// our check loop if something doesn't time out properly.
-		wg.Wait()
+		// Schedules only change on the minute, so look for the next minute
+		// that is allowed, then the first run at or after it
+		minute := next.Truncate(time.Minute).Add(time.Minute)
+		for minute.Before(limit) && !check.Schedule.Allows(minute.Local()) {
+			minute = minute.Add(time.Minute)
+		}
 
-		return nil
-	})
+		runs := (minute.Sub(started) + m.CheckInterval - 1) / m.CheckInterval
+		next = started.Add(runs * m.CheckInterval)
+	}
+
+	return time.Time{}
+}
+
+// now returns the current time in UTC from the Monitor's Clock
+func (m *Monitor) now() time.Time {
+	return clock.OrReal(m.Clock).Now().UTC()
+}
+
+// scheduledAt tells us whether the check may run at this time. Checks that
+// have never run always run once, so that they have a status to hold on to.
+func (check *Check) scheduledAt(t time.Time) bool {
+	if check.Schedule == nil || check.LastRun.IsZero() {
+		return true
+	}
+
+	return check.Schedule.Allows(t.Local())
 }
 
 type checkResult struct {
-	status int
+	result Result
 	err    error
 }
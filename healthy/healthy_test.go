@@ -1,10 +1,12 @@
 package healthy
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
 
+	"github.com/NinesStack/sidecar/clock"
 	"github.com/NinesStack/sidecar/service"
 	"github.com/relistan/go-director"
 	. "github.com/smartystreets/goconvey/convey"
@@ -46,15 +48,24 @@ type mockCommand struct {
 	CallCount     int
 	LastArgs      string
 	DesiredResult int
+	Output        string
 	Error         error
 }
 
-func (m *mockCommand) Run(args string) (int, error) {
+func (m *mockCommand) Run(ctx context.Context, args CheckArgs) (Result, error) {
 	m.CallCount = m.CallCount + 1
-	m.LastArgs = args
-	return m.DesiredResult, m.Error
+	m.LastArgs = args.Args
+	return Result{Status: m.DesiredResult, Output: m.Output}, m.Error
 }
 
+// panickyCommand panics instead of running
+type panickyCommand struct{}
+
+func (p *panickyCommand) Run(ctx context.Context, args CheckArgs) (Result, error) {
+	panic("oh no")
+}
+
+// slowCommand is a LegacyChecker, which can't be cancelled
 type slowCommand struct{}
 
 func (s *slowCommand) Run(args string) (int, error) {
@@ -62,6 +73,17 @@ func (s *slowCommand) Run(args string) (int, error) {
 	return HEALTHY, nil
 }
 
+// patientCommand waits until it is cancelled
+type patientCommand struct {
+	cancelled chan struct{}
+}
+
+func (p *patientCommand) Run(ctx context.Context, args CheckArgs) (Result, error) {
+	<-ctx.Done()
+	close(p.cancelled)
+	return Result{Status: UNKNOWN}, ctx.Err()
+}
+
 func Test_RunningChecks(t *testing.T) {
 	Convey("Working with health checks", t, func() {
 		monitor := NewMonitor(hostname, "/")
@@ -157,7 +179,7 @@ func Test_RunningChecks(t *testing.T) {
 				Type:     "mock",
 				Status:   FAILED,
 				Args:     "testing123",
-				Command:  &slowCommand{},
+				Command:  AdaptLegacy(&slowCommand{}),
 				MaxCount: 3,
 			}
 			monitor.AddCheck(check)
@@ -168,9 +190,68 @@ func Test_RunningChecks(t *testing.T) {
 			So(check.LastError.Error(), ShouldEqual, "Timed out!")
 		})
 
+		Convey("Checks that take too long are cancelled", func() {
+			cmd := &patientCommand{cancelled: make(chan struct{})}
+			monitor.AddCheck(&Check{ID: "test", Type: "mock", Command: cmd, MaxCount: 3})
+			monitor.CheckInterval = 2 * time.Millisecond
+			monitor.Run(looper)
+
+			So(monitor.Checks["test"].Status, ShouldEqual, UNKNOWN)
+			cancelled := false
+			select {
+			case <-cmd.cancelled:
+				cancelled = true
+			case <-time.After(time.Second):
+			}
+			So(cancelled, ShouldBeTrue)
+		})
+
+		Convey("Keeps the output and latency of the last run", func() {
+			cmd.Output = "All good"
+			monitor.RunChecks()
+
+			So(check.LastResult.Output, ShouldEqual, "All good")
+			So(check.LastResult.Latency, ShouldBeGreaterThan, 0)
+			So(monitor.CheckStatuses()[0].Output, ShouldEqual, "All good")
+		})
+
+		Convey("Checks that panic become UNKNOWN without taking the monitor down", func() {
+			monitor.AddCheck(&Check{ID: "test", Type: "mock", Command: &panickyCommand{}, MaxCount: 3})
+			monitor.RunChecks()
+
+			So(monitor.Checks["test"].Status, ShouldEqual, UNKNOWN)
+			So(monitor.Checks["test"].LastError.Error(), ShouldContainSubstring, "oh no")
+		})
+
+		Convey("LegacyCheckers work through the adapter", func() {
+			result, err := AdaptLegacy(&slowCommand{}).Run(context.Background(), CheckArgs{Args: "testing"})
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("RunChecks() runs every check once", func() {
+			monitor.RunChecks()
+			So(cmd.CallCount, ShouldEqual, 1)
+			So(check.Status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("Checks outside their schedule hold their last status", func() {
+			never, _ := ParseSchedule("0 0 31 2 *") // February 31st
+			check.Schedule = never
+
+			monitor.RunChecks()
+			So(cmd.CallCount, ShouldEqual, 1) // Never ran, so runs once anyway
+			So(check.Status, ShouldEqual, HEALTHY)
+
+			cmd.DesiredResult = SICKLY
+			monitor.RunChecks()
+			So(cmd.CallCount, ShouldEqual, 1)
+			So(check.Status, ShouldEqual, HEALTHY)
+		})
+
 		Convey("Checks that had an error become UNKNOWN on first pass", func() {
 			check := NewCheck("test")
-			check.Command = &slowCommand{}
+			check.Command = AdaptLegacy(&slowCommand{})
 			check.MaxCount = 3
 			check.UpdateStatus(1, errors.New("Borked!"))
 
@@ -258,3 +339,93 @@ func Test_MarkingServices(t *testing.T) {
 		})
 	})
 }
+
+func Test_CheckStatuses(t *testing.T) {
+	Convey("Reporting on checks", t, func() {
+		monitor := NewMonitor(hostname, "/")
+		monitor.AddCheck(&Check{ID: "zzz", Type: "mock", Command: &mockCommand{DesiredResult: HEALTHY}})
+		monitor.AddCheck(&Check{
+			ID: "aaa", Type: "mock", MaxCount: 3,
+			Command: &mockCommand{Error: errors.New("Uh oh!")},
+		})
+
+		Convey("Returns all the checks sorted by ID", func() {
+			statuses := monitor.CheckStatuses()
+			So(len(statuses), ShouldEqual, 2)
+			So(statuses[0].ID, ShouldEqual, "aaa")
+			So(statuses[1].ID, ShouldEqual, "zzz")
+		})
+
+		Convey("Records the last and next run times", func() {
+			before := time.Now().UTC()
+			monitor.Run(director.NewFreeLooper(director.ONCE, nil))
+
+			statuses := monitor.CheckStatuses()
+			So(statuses[1].Status, ShouldEqual, "Healthy")
+			So(statuses[1].LastRun, ShouldHappenOnOrAfter, before)
+			So(statuses[1].NextRun, ShouldEqual, statuses[1].LastRun.Add(monitor.CheckInterval))
+		})
+
+		Convey("Takes the run times from the monitor's clock", func() {
+			fake := clock.NewFake(time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC))
+			monitor.Clock = fake
+			monitor.Run(director.NewFreeLooper(director.ONCE, nil))
+
+			statuses := monitor.CheckStatuses()
+			So(statuses[1].LastRun, ShouldEqual, fake.Now())
+			So(statuses[1].NextRun, ShouldEqual, fake.Now().Add(monitor.CheckInterval))
+		})
+
+		Convey("Skips ahead to the next run the schedule allows", func() {
+			fake := clock.NewFake(time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC))
+			monitor.Clock = fake
+			monitor.Checks["zzz"].Schedule, _ = ParseSchedule("30 * * * *")
+			monitor.Run(director.NewFreeLooper(director.ONCE, nil))
+
+			statuses := monitor.CheckStatuses()
+			So(statuses[1].LastRun, ShouldEqual, fake.Now())
+			So(statuses[1].NextRun, ShouldEqual, time.Date(2020, 2, 3, 4, 30, 0, 0, time.UTC))
+		})
+
+		Convey("Has no next run when the schedule never allows one", func() {
+			monitor.Checks["zzz"].Schedule, _ = ParseSchedule("0 0 31 2 *") // February 31st
+			monitor.Run(director.NewFreeLooper(director.ONCE, nil))
+
+			statuses := monitor.CheckStatuses()
+			So(statuses[1].LastRun.IsZero(), ShouldBeFalse)
+			So(statuses[1].NextRun.IsZero(), ShouldBeTrue)
+		})
+
+		Convey("Includes the last error", func() {
+			monitor.Run(director.NewFreeLooper(director.ONCE, nil))
+
+			statuses := monitor.CheckStatuses()
+			So(statuses[0].Status, ShouldEqual, "Unknown")
+			So(statuses[0].LastError, ShouldEqual, "Uh oh!")
+		})
+
+		Convey("Groups the checks by service and by host", func() {
+			monitor.AddCheck(&Check{ID: "bbb", ServiceName: "web", Hostname: "alpha", Status: FAILED})
+			monitor.AddCheck(&Check{ID: "ccc", ServiceName: "web", Hostname: "beta", Status: HEALTHY})
+			monitor.AddCheck(&Check{ID: "ddd", ServiceName: "api", Hostname: "alpha", Status: SICKLY})
+
+			byService := monitor.ChecksByService()
+			So(len(byService), ShouldEqual, 3)
+			So(byService[0].Name, ShouldEqual, "") // The checks without a service
+			So(byService[1].Name, ShouldEqual, "api")
+			So(byService[1].Sickly, ShouldEqual, 1)
+			So(byService[2].Name, ShouldEqual, "web")
+			So(byService[2].Total, ShouldEqual, 2)
+			So(byService[2].Healthy, ShouldEqual, 1)
+			So(byService[2].Failed, ShouldEqual, 1)
+			So(byService[2].Checks[0].ID, ShouldEqual, "bbb")
+
+			byHost := monitor.ChecksByHost()
+			So(len(byHost), ShouldEqual, 3)
+			So(byHost[1].Name, ShouldEqual, "alpha")
+			So(byHost[1].Total, ShouldEqual, 2)
+			So(byHost[2].Name, ShouldEqual, "beta")
+			So(byHost[2].Checks[0].Service, ShouldEqual, "web")
+		})
+	})
+}
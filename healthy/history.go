@@ -0,0 +1,127 @@
+package healthy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	DefaultHistorySize     = 20      // Results kept per check
+	DefaultHistoryMaxBytes = 1 << 20 // Roughly how much memory all of them may take up
+	resultOverhead         = 64      // Rough size of a CheckResult without its strings
+)
+
+// A CheckResult records the outcome of one run of a check
+type CheckResult struct {
+	Time    time.Time
+	Status  string
+	Latency time.Duration
+	Error   string `json:",omitempty"`
+}
+
+// size estimates how much memory the result takes up
+func (r *CheckResult) size() int {
+	return resultOverhead + len(r.Status) + len(r.Error)
+}
+
+// recordResult adds the latest outcome of a check, and the error from
+// running it if there was one, to its history. The oldest results are
+// evicted once the check has HistorySize of them, and the oldest across all
+// checks once they would take up more than HistoryMaxBytes.
+func (m *Monitor) recordResult(check *Check, err error, t time.Time) {
+	if m.HistorySize < 1 {
+		return
+	}
+
+	result := CheckResult{Time: t, Status: StatusString(check.Status), Latency: check.LastResult.Latency}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	size := result.size()
+
+	m.historyLock.Lock()
+	defer m.historyLock.Unlock()
+
+	if m.history == nil {
+		m.history = make(map[string][]CheckResult)
+	}
+
+	if len(m.history[check.ID]) >= m.HistorySize {
+		m.evictResult(check.ID, "count")
+	}
+	for m.HistoryMaxBytes > 0 && m.historyBytes+size > m.HistoryMaxBytes {
+		oldest := m.oldestResult()
+		if oldest == "" {
+			break
+		}
+		m.evictResult(oldest, "memory")
+	}
+
+	m.history[check.ID] = append(m.history[check.ID], result)
+	m.historyBytes += size
+}
+
+// History returns the recent results for a check, oldest first
+func (m *Monitor) History(checkID string) ([]CheckResult, error) {
+	m.RLock()
+	_, ok := m.Checks[checkID]
+	m.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Error fetching history: no such check %s", checkID)
+	}
+
+	m.historyLock.Lock()
+	defer m.historyLock.Unlock()
+
+	return append([]CheckResult{}, m.history[checkID]...), nil
+}
+
+// forgetHistory drops the history of a check that was removed
+func (m *Monitor) forgetHistory(checkID string) {
+	m.historyLock.Lock()
+	defer m.historyLock.Unlock()
+
+	for _, result := range m.history[checkID] {
+		m.historyBytes -= result.size()
+	}
+	delete(m.history, checkID)
+}
+
+// oldestResult returns the ID of the check holding the oldest result. Must
+// be called while holding the historyLock.
+func (m *Monitor) oldestResult() string {
+	var oldestID string
+	var oldest time.Time
+	for id, results := range m.history {
+		if len(results) < 1 {
+			continue
+		}
+		if oldestID == "" || results[0].Time.Before(oldest) {
+			oldestID = id
+			oldest = results[0].Time
+		}
+	}
+
+	return oldestID
+}
+
+// evictResult drops the oldest result for a check. Must be called while
+// holding the historyLock.
+func (m *Monitor) evictResult(checkID string, reason string) {
+	results := m.history[checkID]
+	if len(results) < 1 {
+		return
+	}
+
+	m.historyBytes -= results[0].size()
+	if len(results) == 1 {
+		delete(m.history, checkID)
+	} else {
+		m.history[checkID] = results[1:]
+	}
+
+	metrics.IncrCounter([]string{"healthy", "history", "evicted", reason}, 1)
+}
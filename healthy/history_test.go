@@ -0,0 +1,77 @@
+package healthy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_History(t *testing.T) {
+	Convey("Check history", t, func() {
+		monitor := NewMonitor(hostname, "/")
+		monitor.HistorySize = 3
+		cmd := &mockCommand{DesiredResult: HEALTHY}
+		monitor.AddCheck(&Check{ID: "abc", Type: "mock", Command: cmd, MaxCount: 1})
+
+		run := func() { monitor.Run(director.NewFreeLooper(director.ONCE, nil)) }
+
+		Convey("Records the results of each run, oldest first", func() {
+			run()
+			cmd.DesiredResult = SICKLY
+			run()
+			cmd.Error = errors.New("Uh oh")
+			run()
+
+			history, err := monitor.History("abc")
+			So(err, ShouldBeNil)
+			So(len(history), ShouldEqual, 3)
+			So(history[0].Status, ShouldEqual, "Healthy")
+			So(history[1].Status, ShouldEqual, "Failed")
+			So(history[2].Status, ShouldEqual, "Failed")
+			So(history[2].Error, ShouldEqual, "Uh oh")
+		})
+
+		Convey("Keeps only HistorySize results per check", func() {
+			for i := 0; i < 5; i++ {
+				run()
+			}
+
+			history, _ := monitor.History("abc")
+			So(len(history), ShouldEqual, 3)
+		})
+
+		Convey("Evicts the oldest results across checks to stay under HistoryMaxBytes", func() {
+			monitor.AddCheck(&Check{ID: "def", Type: "mock", Command: &mockCommand{DesiredResult: HEALTHY}})
+			monitor.HistoryMaxBytes = 3 * (resultOverhead + len("Healthy"))
+
+			run()
+			run()
+
+			abc, _ := monitor.History("abc")
+			def, _ := monitor.History("def")
+			So(len(abc)+len(def), ShouldEqual, 3)
+			So(monitor.historyBytes, ShouldEqual, monitor.HistoryMaxBytes)
+		})
+
+		Convey("Records nothing when turned off", func() {
+			monitor.HistorySize = 0
+			run()
+
+			history, _ := monitor.History("abc")
+			So(history, ShouldBeEmpty)
+		})
+
+		Convey("Returns an error for an unknown check", func() {
+			_, err := monitor.History("zzz")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Forgets the history of removed checks", func() {
+			run()
+			monitor.forgetHistory("abc")
+			So(monitor.historyBytes, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package healthy
+
+import (
+	"github.com/NinesStack/sidecar/recovery"
+)
+
+// A CheckHook is called with a check that was added to or removed from the
+// Monitor
+type CheckHook func(check *Check)
+
+// A StatusChangeHook is called with a check that changed status, and the
+// status it had before
+type StatusChangeHook func(check *Check, previous int)
+
+// The hooks registered on a Monitor, in the order they were registered
+type hooks struct {
+	add          []CheckHook
+	remove       []CheckHook
+	statusChange []StatusChangeHook
+}
+
+// OnAdd registers a hook that is called whenever a check is added. A check
+// that replaces another with the same ID is added after the other one is
+// removed.
+func (m *Monitor) OnAdd(hook CheckHook) {
+	m.hooksLock.Lock()
+	defer m.hooksLock.Unlock()
+
+	m.hooks.add = append(m.hooks.add, hook)
+}
+
+// OnRemove registers a hook that is called whenever a check is removed,
+// e.g. because its service went away
+func (m *Monitor) OnRemove(hook CheckHook) {
+	m.hooksLock.Lock()
+	defer m.hooksLock.Unlock()
+
+	m.hooks.remove = append(m.hooks.remove, hook)
+}
+
+// OnStatusChange registers a hook that is called whenever a check that has
+// already run changes status. Unlike the CheckStatusChanged events, it is
+// called for silenced checks too.
+func (m *Monitor) OnStatusChange(hook StatusChangeHook) {
+	m.hooksLock.Lock()
+	defer m.hooksLock.Unlock()
+
+	m.hooks.statusChange = append(m.hooks.statusChange, hook)
+}
+
+// The hooks are called without the Monitor locked, so they can call back
+// into it. A hook that panics doesn't stop the others.
+
+func (m *Monitor) checkAdded(check *Check) {
+	m.hooksLock.RLock()
+	registered := m.hooks.add
+	m.hooksLock.RUnlock()
+
+	for _, hook := range registered {
+		recovery.Run("check_hook", func() error { hook(check); return nil })
+	}
+}
+
+func (m *Monitor) checkRemoved(check *Check) {
+	m.hooksLock.RLock()
+	registered := m.hooks.remove
+	m.hooksLock.RUnlock()
+
+	for _, hook := range registered {
+		recovery.Run("check_hook", func() error { hook(check); return nil })
+	}
+}
+
+func (m *Monitor) statusChanged(check *Check, previous int) {
+	m.hooksLock.RLock()
+	registered := m.hooks.statusChange
+	m.hooksLock.RUnlock()
+
+	for _, hook := range registered {
+		recovery.Run("check_hook", func() error { hook(check, previous); return nil })
+	}
+}
@@ -0,0 +1,68 @@
+package healthy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Hooks(t *testing.T) {
+	Convey("The check lifecycle hooks", t, func() {
+		monitor := NewMonitor(hostname, "/")
+
+		var added, removed []string
+		var changes []string
+		monitor.OnAdd(func(check *Check) { added = append(added, check.ID) })
+		monitor.OnRemove(func(check *Check) { removed = append(removed, check.ID) })
+		monitor.OnStatusChange(func(check *Check, previous int) {
+			changes = append(changes, check.ID+": "+StatusString(previous)+" -> "+StatusString(check.Status))
+		})
+
+		Convey("are called as the services come and go", func() {
+			svcList := []service.Service{{ID: "deadbeef001", Name: "hasCheck", Created: time.Now().UTC()}}
+			disco := &mockDiscoverer{listFn: func() []service.Service { return svcList }}
+			looper := director.NewFreeLooper(director.ONCE, nil)
+
+			monitor.Watch(disco, looper)
+			So(added, ShouldResemble, []string{"deadbeef001"})
+			So(removed, ShouldBeEmpty)
+
+			svcList = nil
+			monitor.Watch(disco, looper)
+			So(removed, ShouldResemble, []string{"deadbeef001"})
+		})
+
+		Convey("see a replaced check removed before the new one is added", func() {
+			monitor.AddCheck(&Check{ID: "deadbeef001"})
+			monitor.AddCheck(&Check{ID: "deadbeef001"})
+
+			So(added, ShouldResemble, []string{"deadbeef001", "deadbeef001"})
+			So(removed, ShouldResemble, []string{"deadbeef001"})
+		})
+
+		Convey("are called when a check changes status, after its first run", func() {
+			cmd := &mockCommand{DesiredResult: HEALTHY}
+			monitor.AddCheck(&Check{ID: "deadbeef001", Status: FAILED, Command: cmd, MaxCount: 3})
+			looper := director.NewFreeLooper(director.ONCE, nil)
+
+			monitor.Run(looper)
+			So(changes, ShouldBeEmpty)
+
+			cmd.DesiredResult = SICKLY
+			monitor.Run(looper)
+			monitor.Run(looper)
+			So(changes, ShouldResemble, []string{"deadbeef001: Healthy -> Sickly"})
+		})
+
+		Convey("keep going when one of them panics", func() {
+			monitor.OnAdd(func(check *Check) { panic("oh no") })
+			monitor.OnAdd(func(check *Check) { added = append(added, "again") })
+
+			monitor.AddCheck(&Check{ID: "deadbeef001"})
+			So(added, ShouldResemble, []string{"deadbeef001", "again"})
+		})
+	})
+}
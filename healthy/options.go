@@ -0,0 +1,75 @@
+package healthy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The Args of a check are a plain string, which makes it easy to get them
+// wrong in a label without anyone noticing until the check fails. Each type
+// of check has an options struct that its Args are parsed into when the check
+// is created, so that mistakes are reported then, with what's wrong with them.
+
+// HttpGetOptions are the parsed Args of an HttpGet check
+type HttpGetOptions struct {
+	URL string
+}
+
+// ExternalOptions are the parsed Args of an External check
+type ExternalOptions struct {
+	Command string
+	Args    []string `json:",omitempty"`
+}
+
+// ParseCheckOptions parses and validates the Args for a type of check,
+// returning the options struct for that type. AlwaysSuccessful checks have
+// no options, so they return nil.
+func ParseCheckOptions(checkType string, args string) (interface{}, error) {
+	switch checkType {
+	case "HttpGet":
+		return parseHttpGetOptions(args)
+	case "External":
+		return parseExternalOptions(args)
+	case "AlwaysSuccessful":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf(
+			"Error parsing check: unknown check type '%s', expected HttpGet, External, or AlwaysSuccessful",
+			checkType,
+		)
+	}
+}
+
+func parseHttpGetOptions(args string) (*HttpGetOptions, error) {
+	if strings.Contains(args, "{{") {
+		return nil, fmt.Errorf("Error parsing HttpGet check URL '%s': the template didn't render", args)
+	}
+
+	// The tcp and udp template functions return -1 when there's no such port
+	if strings.Contains(args, ":-1") {
+		return nil, fmt.Errorf(
+			"Error parsing HttpGet check URL '%s': port not found, is the ServicePort in the template right?", args,
+		)
+	}
+
+	parsed, err := url.Parse(args)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing HttpGet check URL '%s': %s", args, err)
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("Error parsing HttpGet check URL '%s': scheme must be http or https", args)
+	}
+
+	return &HttpGetOptions{URL: args}, nil
+}
+
+func parseExternalOptions(args string) (*ExternalOptions, error) {
+	fields := strings.Fields(args)
+	if len(fields) < 1 {
+		return nil, fmt.Errorf("Error parsing External check: no command to run")
+	}
+
+	return &ExternalOptions{Command: fields[0], Args: fields[1:]}, nil
+}
@@ -0,0 +1,51 @@
+package healthy
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseCheckOptions(t *testing.T) {
+	Convey("ParseCheckOptions", t, func() {
+		Convey("parses HttpGet URLs", func() {
+			options, err := ParseCheckOptions("HttpGet", "http://indefatigable:1234/status")
+			So(err, ShouldBeNil)
+			So(options, ShouldResemble, &HttpGetOptions{URL: "http://indefatigable:1234/status"})
+
+			_, err = ParseCheckOptions("HttpGet", "http://:9090/status")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("says what's wrong with an HttpGet URL", func() {
+			_, err := ParseCheckOptions("HttpGet", "indefatigable:1234/status")
+			So(err.Error(), ShouldContainSubstring, "scheme must be http or https")
+
+			_, err = ParseCheckOptions("HttpGet", "http://indefatigable:-1/status")
+			So(err.Error(), ShouldContainSubstring, "port not found")
+
+			_, err = ParseCheckOptions("HttpGet", "http://{{ host }:1234/status")
+			So(err.Error(), ShouldContainSubstring, "the template didn't render")
+		})
+
+		Convey("splits External commands", func() {
+			options, err := ParseCheckOptions("External", "/bin/check_disk -w 10% ")
+			So(err, ShouldBeNil)
+			So(options, ShouldResemble, &ExternalOptions{Command: "/bin/check_disk", Args: []string{"-w", "10%"}})
+
+			_, err = ParseCheckOptions("External", " ")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("has no options for AlwaysSuccessful", func() {
+			options, err := ParseCheckOptions("AlwaysSuccessful", "")
+			So(err, ShouldBeNil)
+			So(options, ShouldBeNil)
+		})
+
+		Convey("rejects unknown check types", func() {
+			_, err := ParseCheckOptions("HtpGet", "http://indefatigable:1234/")
+			So(err.Error(), ShouldContainSubstring, "unknown check type 'HtpGet'")
+		})
+	})
+}
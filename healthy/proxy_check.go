@@ -0,0 +1,49 @@
+package healthy
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/NinesStack/sidecar/service"
+)
+
+// proxyCheckMetadata returns the Metadata that announces a service's check
+// to the proxies, or nil when they can't run it. Only plain HTTP checks on
+// one of the service's own TCP ports can be, since the proxies run them
+// against each instance on that port. Scheduled checks aren't, because the
+// proxies would run them all the time.
+func (m *Monitor) proxyCheckMetadata(check *Check, svc *service.Service) map[string]string {
+	if check == nil || check.Type != "HttpGet" || check.ConfigError != nil ||
+		check.Schedule != nil || m.CheckInterval <= 0 {
+		return nil
+	}
+
+	options, ok := check.Options.(*HttpGetOptions)
+	if !ok {
+		return nil
+	}
+
+	parsed, err := url.Parse(options.URL)
+	if err != nil || parsed.Scheme != "http" {
+		return nil
+	}
+
+	port, err := strconv.ParseInt(parsed.Port(), 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	for _, svcPort := range svc.Ports {
+		if svcPort.Type != "tcp" || svcPort.Port != port || svcPort.ServicePort < 1 {
+			continue
+		}
+
+		return map[string]string{
+			service.ProxyCheckPathKey:     parsed.RequestURI(),
+			service.ProxyCheckPortKey:     strconv.FormatInt(svcPort.ServicePort, 10),
+			service.ProxyCheckIntervalKey: m.CheckInterval.String(),
+		}
+	}
+
+	return nil
+}
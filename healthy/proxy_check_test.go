@@ -0,0 +1,46 @@
+package healthy
+
+import (
+	"testing"
+
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ProxyCheckMetadata(t *testing.T) {
+	Convey("The services the monitor marks", t, func() {
+		svc := service.Service{
+			ID: "deadbeef123", Name: "hasCheck", Hostname: hostname,
+			Metadata: map[string]string{"VirtualHosts": "web.example.com"},
+			Ports:    []service.Port{{Type: "tcp", Port: 32768, ServicePort: 8081}},
+		}
+
+		monitor := NewMonitor(hostname, "/")
+		monitor.DiscoveryFn = func() []service.Service { return []service.Service{svc} }
+		check := monitor.CheckForService(&svc, &mockDiscoverer{})
+		monitor.AddCheck(check)
+
+		Convey("announce their HttpGet check to the proxies", func() {
+			marked := monitor.Services()
+			So(marked, ShouldHaveLength, 1)
+			So(marked[0].Metadata, ShouldResemble, map[string]string{
+				"VirtualHosts":       "web.example.com",
+				"ProxyCheckPath":     "/status/check",
+				"ProxyCheckPort":     "8081",
+				"ProxyCheckInterval": "3s",
+			})
+			So(svc.Metadata, ShouldHaveLength, 1)
+		})
+
+		Convey("don't announce a check on a port they don't have", func() {
+			check.Options = &HttpGetOptions{URL: "http://" + hostname + ":9999/status/check"}
+			So(monitor.Services()[0].Metadata, ShouldResemble, svc.Metadata)
+		})
+
+		Convey("don't announce checks the proxies can't run", func() {
+			check.Type = "External"
+			check.Options = &ExternalOptions{Command: "/bin/true"}
+			So(monitor.Services()[0].Metadata, ShouldResemble, svc.Metadata)
+		})
+	})
+}
@@ -0,0 +1,117 @@
+package healthy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Resolver caches DNS lookups for check targets so that checks don't
+// re-resolve the same hostname on every run. Entries live for the TTL and
+// are then looked up again on the next use.
+type Resolver struct {
+	TTL      time.Duration
+	LookupFn func(ctx context.Context, host string) ([]string, error)
+	entries  map[string]resolverEntry
+	client   *http.Client
+	sync.Mutex
+}
+
+type resolverEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// NewResolver returns a Resolver that caches results for the TTL
+func NewResolver(ttl time.Duration) *Resolver {
+	return &Resolver{
+		TTL:      ttl,
+		LookupFn: net.DefaultResolver.LookupHost,
+		entries:  make(map[string]resolverEntry),
+	}
+}
+
+// LookupHost returns the addresses for a host, from the cache if we have a
+// current entry. IP addresses are returned as-is.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	r.Lock()
+	entry, ok := r.entries[host]
+	r.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		metrics.IncrCounter([]string{"healthy", "resolver", "hits"}, 1)
+		return entry.addrs, nil
+	}
+
+	metrics.IncrCounter([]string{"healthy", "resolver", "misses"}, 1)
+
+	start := time.Now()
+	addrs, err := r.LookupFn(ctx, host)
+	metrics.MeasureSince([]string{"healthy", "resolver", "lookup"}, start)
+
+	if err != nil {
+		metrics.IncrCounter([]string{"healthy", "resolver", "failures"}, 1)
+		return nil, err
+	}
+
+	r.Lock()
+	r.entries[host] = resolverEntry{addrs: addrs, expires: time.Now().Add(r.TTL)}
+	r.Unlock()
+
+	return addrs, nil
+}
+
+// DialContext dials the address using the cached resolution of the host.
+// Each of the addresses is tried in turn until one connects.
+func (r *Resolver) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	var conn net.Conn
+	for _, addr := range addrs {
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("Failed to connect to %s (%s): %s", addr, host, err)
+	}
+
+	return nil, err
+}
+
+// Client returns an HTTP client that resolves hostnames through the cache
+func (r *Resolver) Client() *http.Client {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.client == nil {
+		r.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         r.DialContext,
+				MaxIdleConns:        100,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		}
+	}
+
+	return r.client
+}
@@ -0,0 +1,75 @@
+package healthy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Resolver(t *testing.T) {
+	Convey("The Resolver", t, func() {
+		lookups := 0
+		var lookupErr error
+
+		resolver := NewResolver(time.Minute)
+		resolver.LookupFn = func(ctx context.Context, host string) ([]string, error) {
+			lookups++
+			if lookupErr != nil {
+				return nil, lookupErr
+			}
+			return []string{"127.0.0.1"}, nil
+		}
+
+		Convey("caches lookups within the TTL", func() {
+			addrs, err := resolver.LookupHost(context.Background(), "chaucer")
+			So(err, ShouldBeNil)
+			So(addrs, ShouldResemble, []string{"127.0.0.1"})
+
+			resolver.LookupHost(context.Background(), "chaucer")
+			So(lookups, ShouldEqual, 1)
+		})
+
+		Convey("looks up again once the entry expires", func() {
+			resolver.TTL = 0
+			resolver.LookupHost(context.Background(), "chaucer")
+			resolver.LookupHost(context.Background(), "chaucer")
+			So(lookups, ShouldEqual, 2)
+		})
+
+		Convey("doesn't cache failures", func() {
+			lookupErr = errors.New("no such host")
+			_, err := resolver.LookupHost(context.Background(), "chaucer")
+			So(err, ShouldNotBeNil)
+
+			lookupErr = nil
+			_, err = resolver.LookupHost(context.Background(), "chaucer")
+			So(err, ShouldBeNil)
+			So(lookups, ShouldEqual, 2)
+		})
+
+		Convey("passes IP addresses straight through", func() {
+			addrs, _ := resolver.LookupHost(context.Background(), "10.0.0.1")
+			So(addrs, ShouldResemble, []string{"10.0.0.1"})
+			So(lookups, ShouldEqual, 0)
+		})
+
+		Convey("is used by HttpGet checks", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+
+			_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			cmd := &HttpGetCmd{Resolver: resolver}
+
+			result, err := cmd.Run(context.Background(), CheckArgs{Args: "http://chaucer.example:" + port + "/"})
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, HEALTHY)
+			So(lookups, ShouldEqual, 1)
+		})
+	})
+}
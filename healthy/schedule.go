@@ -0,0 +1,271 @@
+package healthy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule restricts when a check is allowed to run. Outside of the
+// schedule, the check holds on to its last status.
+type Schedule interface {
+	Allows(t time.Time) bool
+	String() string
+}
+
+// ParseSchedule parses either a standard 5-field cron expression, e.g.
+// "* 0-7,19-23 * * *", which allows the check to run in any minute it
+// matches, or a comma-separated list of time windows, e.g.
+// "Mon-Fri 19:00-07:00, Sat-Sun 00:00-24:00". Windows may wrap past
+// midnight, in which case the days apply to the start of the window. Both
+// are evaluated in the host's local time.
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, fmt.Errorf("Error parsing schedule: empty schedule")
+	}
+
+	if strings.Contains(spec, ":") {
+		return parseWindows(spec)
+	}
+
+	return parseCron(spec)
+}
+
+// A CronSchedule allows a check to run in any minute matched by a cron
+// expression
+type CronSchedule struct {
+	spec    string
+	minutes []bool
+	hours   []bool
+	days    []bool
+	months  []bool
+	weekday []bool
+}
+
+func (c *CronSchedule) Allows(t time.Time) bool {
+	return c.minutes[t.Minute()] && c.hours[t.Hour()] && c.days[t.Day()] &&
+		c.months[int(t.Month())] && c.weekday[int(t.Weekday())]
+}
+
+func (c *CronSchedule) String() string {
+	return c.spec
+}
+
+func parseCron(spec string) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Error parsing schedule '%s': expected 5 cron fields, got %d", spec, len(fields))
+	}
+
+	schedule := &CronSchedule{spec: spec}
+	ranges := []struct {
+		target   *[]bool
+		min, max int
+	}{
+		{&schedule.minutes, 0, 59},
+		{&schedule.hours, 0, 23},
+		{&schedule.days, 1, 31},
+		{&schedule.months, 1, 12},
+		{&schedule.weekday, 0, 6},
+	}
+
+	for i, field := range fields {
+		matches, err := parseCronField(field, ranges[i].min, ranges[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing schedule '%s': %s", spec, err)
+		}
+		*ranges[i].target = matches
+	}
+
+	return schedule, nil
+}
+
+// parseCronField handles "*", single values, ranges, lists, and steps,
+// e.g. "*/15" or "1-5,10".
+func parseCronField(field string, min, max int) ([]bool, error) {
+	matches := make([]bool, max+1)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:idx]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid value '%s'", part)
+				}
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+
+		for i := low; i <= high; i += step {
+			matches[i] = true
+		}
+	}
+
+	return matches, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+type window struct {
+	days  [7]bool
+	start int // Minutes since midnight
+	end   int
+}
+
+// A WindowSchedule allows a check to run inside any of a list of time windows
+type WindowSchedule struct {
+	spec    string
+	windows []window
+}
+
+func (w *WindowSchedule) Allows(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, win := range w.windows {
+		if win.start <= win.end {
+			if win.days[today] && minute >= win.start && minute < win.end {
+				return true
+			}
+			continue
+		}
+
+		// The window wraps past midnight
+		if win.days[today] && minute >= win.start {
+			return true
+		}
+		if win.days[yesterday] && minute < win.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *WindowSchedule) String() string {
+	return w.spec
+}
+
+func parseWindows(spec string) (*WindowSchedule, error) {
+	schedule := &WindowSchedule{spec: spec}
+
+	for _, entry := range strings.Split(spec, ",") {
+		win, err := parseWindow(strings.Fields(entry))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing schedule '%s': %s", spec, err)
+		}
+		schedule.windows = append(schedule.windows, *win)
+	}
+
+	return schedule, nil
+}
+
+func parseWindow(fields []string) (*window, error) {
+	win := &window{}
+
+	switch len(fields) {
+	case 1:
+		for i := range win.days {
+			win.days[i] = true
+		}
+	case 2:
+		if err := parseDays(fields[0], &win.days); err != nil {
+			return nil, err
+		}
+		fields = fields[1:]
+	default:
+		return nil, fmt.Errorf("expected '[days] HH:MM-HH:MM', got '%s'", strings.Join(fields, " "))
+	}
+
+	times := strings.SplitN(fields[0], "-", 2)
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid time range '%s'", fields[0])
+	}
+
+	var err error
+	if win.start, err = parseClock(times[0]); err != nil {
+		return nil, err
+	}
+	if win.end, err = parseClock(times[1]); err != nil {
+		return nil, err
+	}
+
+	return win, nil
+}
+
+// parseDays handles a single day or a range of days, e.g. "Mon-Fri"
+func parseDays(spec string, days *[7]bool) error {
+	bounds := strings.SplitN(strings.ToLower(spec), "-", 2)
+
+	first, ok := weekdays[bounds[0]]
+	if !ok {
+		return fmt.Errorf("invalid day '%s'", bounds[0])
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, ok = weekdays[bounds[1]]; !ok {
+			return fmt.Errorf("invalid day '%s'", bounds[1])
+		}
+	}
+
+	for day := first; ; day = (day + 1) % 7 {
+		days[day] = true
+		if day == last {
+			break
+		}
+	}
+
+	return nil
+}
+
+// parseClock parses HH:MM into minutes since midnight. 24:00 is allowed as
+// the end of the day.
+func parseClock(clock string) (int, error) {
+	parts := strings.SplitN(clock, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time '%s'", clock)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s'", clock)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s'", clock)
+	}
+
+	total := hours*60 + minutes
+	if hours < 0 || minutes < 0 || minutes > 59 || total > 24*60 {
+		return 0, fmt.Errorf("invalid time '%s'", clock)
+	}
+
+	return total, nil
+}
@@ -0,0 +1,51 @@
+package healthy
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseSchedule(t *testing.T) {
+	Convey("Parsing check schedules", t, func() {
+		// A Wednesday
+		at := func(hour, minute int) time.Time {
+			return time.Date(2020, 4, 1, hour, minute, 0, 0, time.Local)
+		}
+
+		Convey("handles cron expressions", func() {
+			schedule, err := ParseSchedule("*/15 0-7,19-23 * * 1-5")
+			So(err, ShouldBeNil)
+			So(schedule.Allows(at(20, 30)), ShouldBeTrue)
+			So(schedule.Allows(at(20, 31)), ShouldBeFalse)
+			So(schedule.Allows(at(12, 0)), ShouldBeFalse)
+			So(schedule.Allows(at(12, 0).AddDate(0, 0, 3).Add(-4*time.Hour)), ShouldBeFalse)
+			So(schedule.String(), ShouldEqual, "*/15 0-7,19-23 * * 1-5")
+		})
+
+		Convey("handles time windows", func() {
+			schedule, err := ParseSchedule("Mon-Fri 19:00-07:00, Sat-Sun 00:00-24:00")
+			So(err, ShouldBeNil)
+			So(schedule.Allows(at(19, 0)), ShouldBeTrue)
+			So(schedule.Allows(at(6, 59)), ShouldBeTrue) // Tuesday's window
+			So(schedule.Allows(at(7, 0)), ShouldBeFalse)
+			So(schedule.Allows(at(12, 0)), ShouldBeFalse)
+			So(schedule.Allows(at(12, 0).AddDate(0, 0, 3)), ShouldBeTrue) // Saturday
+		})
+
+		Convey("handles windows without days", func() {
+			schedule, err := ParseSchedule("01:30-02:00")
+			So(err, ShouldBeNil)
+			So(schedule.Allows(at(1, 45)), ShouldBeTrue)
+			So(schedule.Allows(at(2, 0)), ShouldBeFalse)
+		})
+
+		Convey("rejects invalid schedules", func() {
+			for _, spec := range []string{"", "* * *", "60 * * * *", "Funday 01:00-02:00", "25:00-26:00", "*/0 * * * *"} {
+				_, err := ParseSchedule(spec)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
@@ -3,10 +3,12 @@ package healthy
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"text/template"
 
 	"github.com/NinesStack/sidecar/discovery"
 	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
 	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 )
@@ -53,26 +55,29 @@ func (m *Monitor) defaultCheckForService(svc *service.Service) *Check {
 		return &Check{ID: svc.ID, Command: &AlwaysSuccessfulCmd{}}
 	}
 
+	return &Check{
+		ID:      svc.ID,
+		Type:    "HttpGet",
+		Args:    m.defaultCheckURL(m.DefaultCheckHost, port.Port),
+		Status:  FAILED,
+		Command: &HttpGetCmd{Resolver: m.Resolver, Trace: m.TraceChecks},
+	}
+}
+
+func (m *Monitor) defaultCheckURL(host string, port int64) string {
 	// Use the const default unless we've been provided something else
 	defaultCheckEndpoint := DEFAULT_STATUS_ENDPOINT
 	if len(m.DefaultCheckEndpoint) != 0 {
 		defaultCheckEndpoint = m.DefaultCheckEndpoint
 	}
 
-	url := fmt.Sprintf("http://%v:%v%v", m.DefaultCheckHost, port.Port, defaultCheckEndpoint)
-	return &Check{
-		ID:      svc.ID,
-		Type:    "HttpGet",
-		Args:    url,
-		Status:  FAILED,
-		Command: &HttpGetCmd{},
-	}
+	return fmt.Sprintf("http://%v:%v%v", host, port, defaultCheckEndpoint)
 }
 
 func (m *Monitor) GetCommandNamed(name string) Checker {
 	switch name {
 	case "HttpGet":
-		return &HttpGetCmd{}
+		return &HttpGetCmd{Resolver: m.Resolver, Trace: m.TraceChecks}
 	case "External":
 		return &ExternalCmd{}
 	case "AlwaysSuccessful":
@@ -110,6 +115,67 @@ func (m *Monitor) templateCheckArgs(check *Check, svc *service.Service) string {
 		"container": func() string { return svc.Hostname },
 	}
 
+	return m.executeCheckArgs(check, svc, funcMap)
+}
+
+// proxyCheckArgs templates the check args so they point at the proxy's
+// frontend for the service, rather than the service itself. Default checks
+// use the ServicePort of the port they check. Returns an empty string when
+// the check can't go through the proxy.
+func (m *Monitor) proxyCheckArgs(check *Check, svc *service.Service, isDefault bool) string {
+	if check.Type == "" || check.Type == "AlwaysSuccessful" {
+		return ""
+	}
+
+	if isDefault {
+		port := findFirstTCPPort(svc)
+		if port == nil || port.ServicePort == 0 {
+			return ""
+		}
+		return m.defaultCheckURL(m.ProxyCheckHost, port.ServicePort)
+	}
+
+	funcMap := template.FuncMap{
+		"tcp":       func(p int64) int64 { return p },
+		"udp":       func(p int64) int64 { return p },
+		"host":      func() string { return m.ProxyCheckHost },
+		"container": func() string { return svc.Hostname },
+	}
+
+	proxyArgs := m.executeCheckArgs(check, svc, funcMap)
+	if proxyArgs == m.templateCheckArgs(check, svc) {
+		log.Warnf("Check for service %s (id: %s) doesn't use the port or host, so can't go through the proxy",
+			svc.Name, svc.ID)
+		return ""
+	}
+
+	return proxyArgs
+}
+
+// checkViaProxy tells us whether a service's check should go through the
+// proxy. The Discoverer can override the Monitor's default.
+func (m *Monitor) checkViaProxy(svc *service.Service, disco discovery.Discoverer) bool {
+	if m.ProxyCheckHost == "" {
+		return false
+	}
+
+	viaProxy := m.CheckViaProxy
+	if proxier, ok := disco.(discovery.CheckProxier); ok {
+		if value := proxier.CheckViaProxy(svc); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				log.Errorf("Ignoring invalid HealthCheckViaProxy '%s' for service %s (id: %s)", value, svc.Name, svc.ID)
+			} else {
+				viaProxy = parsed
+			}
+		}
+	}
+
+	return viaProxy
+}
+
+// executeCheckArgs runs the check args as a template with these functions
+func (m *Monitor) executeCheckArgs(check *Check, svc *service.Service, funcMap template.FuncMap) string {
 	t, err := template.New("check").Funcs(funcMap).Parse(check.Args)
 	if err != nil {
 		log.Errorf("Unable to parse check Args: '%s'", check.Args)
@@ -126,20 +192,117 @@ func (m *Monitor) templateCheckArgs(check *Check, svc *service.Service) string {
 	return output.String()
 }
 
+// scheduleForService looks up the schedule for a service's check, if the
+// Discoverer supports them and one is configured
+func (m *Monitor) scheduleForService(svc *service.Service, disco discovery.Discoverer) Schedule {
+	scheduler, ok := disco.(discovery.CheckScheduler)
+	if !ok {
+		return nil
+	}
+
+	spec := scheduler.CheckSchedule(svc)
+	if spec == "" {
+		return nil
+	}
+
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		log.Errorf("Ignoring check schedule for service %s (id: %s): %s", svc.Name, svc.ID, err)
+		return nil
+	}
+
+	return schedule
+}
+
+// replacedBy tells us whether the service is a different instance from the
+// one this check was created for, even though it has the same ID.
+func (check *Check) replacedBy(svc *service.Service) bool {
+	return !check.serviceCreated.IsZero() && !svc.Created.Equal(check.serviceCreated)
+}
+
 // CheckForService returns a Check that has been properly configured for this
 // particular service.
 func (m *Monitor) CheckForService(svc *service.Service, disco discovery.Discoverer) *Check {
 	check := m.fetchCheckForService(svc, disco)
-	if check == nil { // We got nothing
+	isDefault := check == nil
+	if isDefault { // We got nothing
 		log.Warnf("Using default check for service %s (id: %s).", svc.Name, svc.ID)
 		check = m.defaultCheckForService(svc)
 	}
 
+	if m.checkViaProxy(svc, disco) {
+		check.ProxyArgs = m.proxyCheckArgs(check, svc, isDefault)
+	}
 	check.Args = m.templateCheckArgs(check, svc)
+	check.ServiceName = svc.Name
+	check.Hostname = svc.Hostname
+	check.serviceCreated = svc.Created
+	check.Schedule = m.scheduleForService(svc, disco)
+	check.parseOptions()
 
 	return check
 }
 
+// parseOptions parses the templated Args of a check into its Options. Our
+// own default checks have no Type, and nothing to parse.
+func (check *Check) parseOptions() {
+	if check.Type == "" {
+		return
+	}
+
+	check.Options, check.ConfigError = ParseCheckOptions(check.Type, check.Args)
+	if check.ConfigError != nil {
+		log.Errorf("Check %s for service %s won't run: %s", check.ID, check.ServiceName, check.ConfigError)
+		metrics.IncrCounter([]string{"healthy", "check", "invalid"}, 1)
+	}
+}
+
+// portCheckID returns the ID of the check for a named port of a service
+func portCheckID(serviceID string, portName string) string {
+	return serviceID + ":" + portName
+}
+
+// PortChecksForService returns the checks for the named ports of this
+// service that the Discoverer has checks for. Each has the ID of the service
+// and the name of the port, e.g. "deadbeef0123:admin".
+func (m *Monitor) PortChecksForService(svc *service.Service, disco discovery.Discoverer) []*Check {
+	checker, ok := disco.(discovery.PortChecker)
+	if !ok {
+		return nil
+	}
+
+	var checks []*Check
+	for i := range svc.Ports {
+		port := &svc.Ports[i]
+		if port.Name == "" {
+			continue
+		}
+
+		checkType, args := checker.PortHealthCheck(svc, port)
+		if checkType == "" {
+			continue
+		}
+
+		check := &Check{
+			ID:             portCheckID(svc.ID, port.Name),
+			ServiceName:    svc.Name,
+			Hostname:       svc.Hostname,
+			PortName:       port.Name,
+			Type:           checkType,
+			Args:           args,
+			Command:        m.GetCommandNamed(checkType),
+			Status:         FAILED,
+			Schedule:       m.scheduleForService(svc, disco),
+			serviceCreated: svc.Created,
+		}
+		check.Args = m.templateCheckArgs(check, svc)
+		check.parseOptions()
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
 // Watch loops over a list of services and adds checks for services we don't already
 // know about. It then removes any checks for services which have gone away. All
 // services are expected to be local to this node.
@@ -151,35 +314,85 @@ func (m *Monitor) Watch(disco discovery.Discoverer, looper director.Looper) {
 
 		// Add checks when new services are found
 		for _, svc := range services {
-			if m.Checks[svc.ID] == nil {
-				check := m.CheckForService(&svc, disco)
-				if check.Command == nil {
-					log.Errorf(
-						"Attempted to add %s (id: %s) but no check configured!",
-						svc.Name, svc.ID,
-					)
-				} else {
-					m.AddCheck(check)
+			m.RLock()
+			existing := m.Checks[svc.ID]
+			m.RUnlock()
+
+			if existing != nil && !existing.replacedBy(&svc) {
+				continue
+			}
+
+			check := m.CheckForService(&svc, disco)
+			if check.Command == nil {
+				log.Errorf(
+					"Attempted to add %s (id: %s) but no check configured!",
+					svc.Name, svc.ID,
+				)
+				continue
+			}
+
+			// A service that kept its ID across a restart keeps its status
+			// so that it doesn't flap while the new check gets going. A
+			// check that's configured wrong won't run to change it, though.
+			if existing != nil && check.ConfigError == nil {
+				check.Status = existing.Status
+				check.Count = existing.Count
+			} else if existing == nil {
+				m.restoreStatus(check)
+			}
+
+			m.AddCheck(check)
+
+			// The same goes for the checks on its named ports
+			for _, portCheck := range m.PortChecksForService(&svc, disco) {
+				m.RLock()
+				existingPort := m.Checks[portCheck.ID]
+				m.RUnlock()
+
+				if existingPort != nil && portCheck.ConfigError == nil {
+					portCheck.Status = existingPort.Status
+					portCheck.Count = existingPort.Count
+				} else if existingPort == nil {
+					m.restoreStatus(portCheck)
+				}
+
+				m.AddCheck(portCheck)
+			}
+		}
+
+		// The checks we want are the ones for the running services, and for
+		// their named ports
+		wanted := make(map[string]struct{}, len(services))
+		for _, svc := range services {
+			wanted[svc.ID] = struct{}{}
+			for _, port := range svc.Ports {
+				if port.Name != "" {
+					wanted[portCheckID(svc.ID, port.Name)] = struct{}{}
 				}
 			}
 		}
 
 		m.Lock()
-		defer m.Unlock()
-	OUTER:
+
 		// We remove checks when encountering a missing service. This
 		// prevents us from storing up checks forever. This is the only
 		// way we'll find out about a service going away.
+		var removed []*Check
 		for _, check := range m.Checks {
-			for _, svc := range services {
-				// Continue if we have a matching service/check pair
-				if svc.ID == check.ID {
-					continue OUTER
-				}
+			if _, ok := wanted[check.ID]; ok {
+				continue
 			}
 
 			// Remove checks for services that are no longer running
 			delete(m.Checks, check.ID)
+			m.forgetHistory(check.ID)
+			m.forgetMetrics(check.ID)
+			removed = append(removed, check)
+		}
+		m.Unlock()
+
+		for _, check := range removed {
+			m.checkRemoved(check)
 		}
 
 		return nil
@@ -38,6 +38,29 @@ func (m *mockDiscoverer) HealthCheck(svc *service.Service) (string, string) {
 
 func (m *mockDiscoverer) Run(director.Looper) {}
 
+// A Discoverer whose services set whether their checks go through the proxy
+type mockProxier struct {
+	mockDiscoverer
+	viaProxy string
+}
+
+func (m *mockProxier) CheckViaProxy(svc *service.Service) string {
+	return m.viaProxy
+}
+
+// A Discoverer with checks on the named ports of its services
+type mockPortChecker struct {
+	mockDiscoverer
+}
+
+func (m *mockPortChecker) PortHealthCheck(svc *service.Service, port *service.Port) (string, string) {
+	if port.Name == "admin" {
+		return "HttpGet", "http://{{ host }}:{{ tcp 9000 }}/health"
+	}
+
+	return "", ""
+}
+
 func Test_ServicesBridge(t *testing.T) {
 	Convey("The services bridge", t, func() {
 		svcId1 := "deadbeef123"
@@ -148,11 +171,14 @@ func Test_ServicesBridge(t *testing.T) {
 
 			cmd := HttpGetCmd{}
 			check := &Check{
-				ID:      svc.ID,
-				Command: &cmd,
-				Type:    "HttpGet",
-				Args:    "http://" + hostname + ":1234/",
-				Status:  FAILED,
+				ID:          svc.ID,
+				ServiceName: svc.Name,
+				Hostname:    svc.Hostname,
+				Command:     &cmd,
+				Type:        "HttpGet",
+				Args:        "http://" + hostname + ":1234/",
+				Options:     &HttpGetOptions{URL: "http://" + hostname + ":1234/"},
+				Status:      FAILED,
 			}
 			looper := director.NewTimedLooper(5, 5*time.Nanosecond, nil)
 
@@ -161,6 +187,62 @@ func Test_ServicesBridge(t *testing.T) {
 			So(len(monitor.Checks), ShouldEqual, 1)
 			So(monitor.Checks[svc.ID], ShouldResemble, check)
 		})
+
+		Convey("Replaces the check when the service is replaced under the same ID", func() {
+			ports := []service.Port{{Type: "tcp", Port: 1234, ServicePort: 8081, IP: "127.0.0.1"}}
+			svc := service.Service{ID: "babbacabba", Name: "hasCheck", Ports: ports, Created: baseTime}
+			svcList := []service.Service{svc}
+			disco := &mockDiscoverer{listFn: func() []service.Service { return svcList }}
+
+			monitor.Watch(disco, director.NewFreeLooper(director.ONCE, nil))
+			monitor.Checks[svc.ID].Status = HEALTHY
+			So(monitor.Checks[svc.ID].Args, ShouldEqual, "http://indefatigable:1234/status/check")
+
+			svcList[0].Created = baseTime.Add(time.Second)
+			svcList[0].Ports[0].Port = 4321
+			monitor.Watch(disco, director.NewFreeLooper(director.ONCE, nil))
+
+			So(monitor.Checks[svc.ID].Args, ShouldEqual, "http://indefatigable:4321/status/check")
+			So(monitor.Checks[svc.ID].Status, ShouldEqual, HEALTHY)
+		})
+
+		Convey("Checks the named ports of a service on their own", func() {
+			ports := []service.Port{
+				{Type: "tcp", Port: 1234, ServicePort: 8081, IP: "127.0.0.1", Name: "web"},
+				{Type: "tcp", Port: 1235, ServicePort: 9000, IP: "127.0.0.1", Name: "admin"},
+			}
+			svc := service.Service{ID: "babbacabba", Name: "hasCheck", Ports: ports, Created: baseTime}
+			svcList := []service.Service{svc}
+			disco := &mockPortChecker{mockDiscoverer{listFn: func() []service.Service { return svcList }}}
+			monitor.DiscoveryFn = disco.Services
+
+			monitor.Watch(disco, director.NewFreeLooper(director.ONCE, nil))
+
+			So(len(monitor.Checks), ShouldEqual, 2)
+			portCheck := monitor.Checks["babbacabba:admin"]
+			So(portCheck, ShouldNotBeNil)
+			So(portCheck.PortName, ShouldEqual, "admin")
+			So(portCheck.Args, ShouldEqual, "http://indefatigable:1235/health")
+
+			Convey("and marks the ports with the status of their checks", func() {
+				monitor.Checks[svc.ID].Status = HEALTHY
+				portCheck.Status = FAILED
+
+				marked := monitor.Services()
+				So(marked[0].Status, ShouldEqual, service.ALIVE)
+				So(marked[0].PortAlive(8081), ShouldBeTrue)
+				So(marked[0].PortAlive(9000), ShouldBeFalse)
+				So(svcList[0].Ports[1].Status, ShouldEqual, service.ALIVE)
+			})
+
+			Convey("and removes the check when the port goes away", func() {
+				svcList[0].Ports = ports[:1]
+				monitor.Watch(disco, director.NewFreeLooper(director.ONCE, nil))
+
+				So(len(monitor.Checks), ShouldEqual, 1)
+				So(monitor.Checks["babbacabba:admin"], ShouldBeNil)
+			})
+		})
 	})
 }
 
@@ -205,6 +287,90 @@ func Test_CheckForService(t *testing.T) {
 			check := monitor.CheckForService(&service1, &mockDiscoverer{})
 			So(check.Args, ShouldEqual, "http://indefatigable:1234/something/else")
 		})
+
+		Convey("Catches a check that's configured wrong, and doesn't run it", func() {
+			monitor := NewMonitor(hostname, "/")
+			service1.Name = "hasCheck"
+			service1.Ports = ports[:1] // No tcp 8081 for the template
+			check := monitor.CheckForService(&service1, &mockDiscoverer{})
+			So(check.ConfigError, ShouldNotBeNil)
+			So(check.ConfigError.Error(), ShouldContainSubstring, "port not found")
+
+			monitor.AddCheck(check)
+			monitor.RunChecks()
+			So(check.LastRun.IsZero(), ShouldBeTrue)
+			So(check.Status, ShouldEqual, FAILED)
+			So(monitor.CheckStatuses()[0].ConfigError, ShouldContainSubstring, "port not found")
+		})
+	})
+}
+
+func Test_CheckViaProxy(t *testing.T) {
+	Convey("When checking through the proxy", t, func() {
+		ports := []service.Port{
+			{Type: "tcp", Port: 1234, ServicePort: 8081, IP: "127.0.0.1"},
+		}
+		svc := service.Service{ID: "deadbeef123", Hostname: hostname, Ports: ports}
+
+		monitor := NewMonitor(hostname, "/")
+		monitor.CheckViaProxy = true
+		monitor.ProxyCheckHost = "192.168.168.168"
+
+		Convey("Points the default check at the ServicePort on the proxy", func() {
+			check := monitor.CheckForService(&svc, &mockDiscoverer{})
+			So(check.Args, ShouldEqual, "http://indefatigable:1234/")
+			So(check.ProxyArgs, ShouldEqual, "http://192.168.168.168:8081/")
+		})
+
+		Convey("Templates the proxy into the check arguments", func() {
+			svc.Name = "hasCheck"
+			check := monitor.CheckForService(&svc, &mockDiscoverer{})
+			So(check.Args, ShouldEqual, "http://indefatigable:1234/status/check")
+			So(check.ProxyArgs, ShouldEqual, "http://192.168.168.168:8081/status/check")
+		})
+
+		Convey("Can't go through the proxy when the check is on the container", func() {
+			svc.Name = "containerCheck"
+			check := monitor.CheckForService(&svc, &mockDiscoverer{})
+			So(check.ProxyArgs, ShouldNotEqual, "")
+
+			svc.Ports[0].ServicePort = 0
+			svc.Name = ""
+			check = monitor.CheckForService(&svc, &mockDiscoverer{})
+			So(check.ProxyArgs, ShouldEqual, "")
+		})
+
+		Convey("Lets the service override the default", func() {
+			check := monitor.CheckForService(&svc, &mockProxier{viaProxy: "false"})
+			So(check.ProxyArgs, ShouldEqual, "")
+
+			monitor.CheckViaProxy = false
+			check = monitor.CheckForService(&svc, &mockProxier{viaProxy: "true"})
+			So(check.ProxyArgs, ShouldEqual, "http://192.168.168.168:8081/")
+
+			check = monitor.CheckForService(&svc, &mockProxier{viaProxy: "bogus"})
+			So(check.ProxyArgs, ShouldEqual, "")
+		})
+
+		Convey("Does nothing without a proxy", func() {
+			monitor.ProxyCheckHost = ""
+			check := monitor.CheckForService(&svc, &mockProxier{viaProxy: "true"})
+			So(check.ProxyArgs, ShouldEqual, "")
+		})
+
+		Convey("Only goes through the proxy while the service is alive", func() {
+			check := monitor.CheckForService(&svc, &mockDiscoverer{})
+			So(check.runArgs(), ShouldEqual, check.Args)
+
+			check.Status = HEALTHY
+			So(check.runArgs(), ShouldEqual, check.ProxyArgs)
+
+			check.Status = SICKLY
+			So(check.runArgs(), ShouldEqual, check.ProxyArgs)
+
+			check.Status = FAILED
+			So(check.runArgs(), ShouldEqual, check.Args)
+		})
 	})
 }
 
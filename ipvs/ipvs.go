@@ -0,0 +1,356 @@
+package ipvs
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// A VirtualService is an IPVS virtual service that we route to one or more
+// RealServers.
+type VirtualService struct {
+	Protocol string
+	Address  string
+	Port     int64
+}
+
+func (v VirtualService) String() string {
+	return v.Address + ":" + strconv.FormatInt(v.Port, 10)
+}
+
+// flag returns the ipvsadm flag for the protocol of the VirtualService
+func (v VirtualService) flag() string {
+	if v.Protocol == "udp" {
+		return "-u"
+	}
+	return "-t"
+}
+
+// A RealServer is one backend for a VirtualService
+type RealServer struct {
+	Address string
+	Port    int64
+}
+
+func (r RealServer) String() string {
+	return r.Address + ":" + strconv.FormatInt(r.Port, 10)
+}
+
+type routingTable map[VirtualService]map[RealServer]bool
+
+// IPVS programs the kernel IPVS tables directly from the services state as a
+// lightweight alternative to HAproxy for pure L4 routing. It only ever touches
+// virtual services on the BindIP, and treats all of them as its own, so it is
+// safe to run on hosts with other IPVS configuration as long as the BindIP is
+// dedicated to Sidecar.
+type IPVS struct {
+	BindIP       string
+	Scheduler    string
+	Command      string
+	Runner       func(command string, args ...string) error
+	Lister       func(command string, args ...string) ([]byte, error)
+	applied      routingTable
+	eventChannel chan catalog.ChangeEvent
+	sync.Mutex
+}
+
+// Constructs a properly configured IPVS and returns a pointer to it
+func New(bindIP string) *IPVS {
+	return &IPVS{
+		BindIP:    bindIP,
+		Scheduler: "rr",
+		Command:   "ipvsadm",
+		Runner:    runCommand,
+		Lister:    listCommand,
+		applied:   make(routingTable),
+	}
+}
+
+// Execute a command and bubble up the error along with its output
+func runCommand(command string, args ...string) error {
+	output, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error running '%s %v': %s (%s)", command, args, err, output)
+	}
+
+	return nil
+}
+
+// Execute a command and return its output, or the error along with the output
+func listCommand(command string, args ...string) ([]byte, error) {
+	output, err := exec.Command(command, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error running '%s %v': %s (%s)", command, args, err, output)
+	}
+
+	return output, nil
+}
+
+// desiredTable builds the routing table we want from the alive services
+// in the state. Only ports with a ServicePort are exported.
+// Note: not synchronized!
+func (i *IPVS) desiredTable(state *catalog.ServicesState) routingTable {
+	table := make(routingTable)
+
+	state.EachServiceMerged(func(hostname *string, serviceId *string, svc *service.Service) {
+		if !svc.IsAlive() {
+			return
+		}
+
+		for _, port := range svc.Ports {
+			if port.ServicePort == 0 || (port.Type != "tcp" && port.Type != "udp") {
+				continue
+			}
+
+			address := port.IP
+			if address == "" {
+				address = svc.Hostname
+			}
+
+			vs := VirtualService{Protocol: port.Type, Address: i.BindIP, Port: port.ServicePort}
+			if _, ok := table[vs]; !ok {
+				table[vs] = make(map[RealServer]bool)
+			}
+			table[vs][RealServer{Address: address, Port: port.Port}] = true
+		}
+	})
+
+	return table
+}
+
+// Sync brings the IPVS tables in line with the current state, adding and
+// removing only what changed since the last run.
+func (i *IPVS) Sync(state *catalog.ServicesState) error {
+	state.RLock()
+	desired := i.desiredTable(state)
+	state.RUnlock()
+
+	i.Lock()
+	defer i.Unlock()
+
+	var errs []error
+	run := func(args ...string) bool {
+		err := i.Runner(i.Command, args...)
+		if err != nil {
+			errs = append(errs, err)
+			return false
+		}
+		return true
+	}
+
+	// Remove virtual services and real servers that went away
+	for _, vs := range sortedVirtualServices(i.applied) {
+		servers := i.applied[vs]
+		if _, ok := desired[vs]; !ok {
+			if run("-D", vs.flag(), vs.String()) {
+				delete(i.applied, vs)
+			}
+			continue
+		}
+
+		for rs := range servers {
+			if !desired[vs][rs] {
+				if run("-d", vs.flag(), vs.String(), "-r", rs.String()) {
+					delete(servers, rs)
+				}
+			}
+		}
+	}
+
+	// Add the new ones
+	for _, vs := range sortedVirtualServices(desired) {
+		if _, ok := i.applied[vs]; !ok {
+			if !run("-A", vs.flag(), vs.String(), "-s", i.Scheduler) {
+				continue
+			}
+			i.applied[vs] = make(map[RealServer]bool)
+		}
+
+		for rs := range desired[vs] {
+			if i.applied[vs][rs] {
+				continue
+			}
+			if run("-a", vs.flag(), vs.String(), "-r", rs.String(), "-m") {
+				i.applied[vs][rs] = true
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to apply %d IPVS changes, first error: %s", len(errs), errs[0])
+	}
+
+	return nil
+}
+
+// FullSync reads what is in the kernel IPVS tables for the BindIP, then syncs
+// them with the current state. That removes anything left behind by an
+// earlier run, or added by hand, that we wouldn't otherwise know about.
+func (i *IPVS) FullSync(state *catalog.ServicesState) error {
+	output, err := i.Lister(i.Command, "-S", "-n")
+	if err != nil {
+		return fmt.Errorf("Error listing IPVS services: %s", err)
+	}
+
+	i.Lock()
+	i.applied = i.parseTable(output)
+	i.Unlock()
+
+	return i.Sync(state)
+}
+
+// parseTable builds a routing table from the output of 'ipvsadm -S -n',
+// keeping only the virtual services on the BindIP. The lines look like:
+//
+//	-A -t 192.168.168.169:80 -s rr
+//	-a -t 192.168.168.169:80 -r 10.0.0.1:32080 -m -w 1
+func (i *IPVS) parseTable(output []byte) routingTable {
+	table := make(routingTable)
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || (fields[1] != "-t" && fields[1] != "-u") {
+			continue
+		}
+
+		vs, ok := i.parseVirtualService(fields[1], fields[2])
+		if !ok {
+			continue
+		}
+
+		switch fields[0] {
+		case "-A":
+			if _, ok := table[vs]; !ok {
+				table[vs] = make(map[RealServer]bool)
+			}
+		case "-a":
+			if len(fields) < 5 || fields[3] != "-r" {
+				continue
+			}
+			host, port, err := splitAddress(fields[4])
+			if err != nil {
+				continue
+			}
+			if _, ok := table[vs]; !ok {
+				table[vs] = make(map[RealServer]bool)
+			}
+			table[vs][RealServer{Address: host, Port: port}] = true
+		}
+	}
+
+	return table
+}
+
+// parseVirtualService returns the VirtualService for an ipvsadm protocol
+// flag and address, and whether it is one of ours
+func (i *IPVS) parseVirtualService(flag string, address string) (VirtualService, bool) {
+	host, port, err := splitAddress(address)
+	if err != nil || host != i.BindIP {
+		return VirtualService{}, false
+	}
+
+	protocol := "tcp"
+	if flag == "-u" {
+		protocol = "udp"
+	}
+
+	return VirtualService{Protocol: protocol, Address: host, Port: port}, true
+}
+
+// splitAddress splits an ipvsadm host:port into its parts
+func splitAddress(address string) (string, int64, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.ParseInt(portStr, 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, port, nil
+}
+
+// Cleanup removes every virtual service we created. Intended to be called on
+// shutdown so we don't leave stale routes behind.
+func (i *IPVS) Cleanup() {
+	i.Lock()
+	defer i.Unlock()
+
+	for _, vs := range sortedVirtualServices(i.applied) {
+		err := i.Runner(i.Command, "-D", vs.flag(), vs.String())
+		if err != nil {
+			log.Errorf("Failed to remove IPVS virtual service %s: %s", vs, err)
+			continue
+		}
+		delete(i.applied, vs)
+	}
+}
+
+// Watch the state of a ServicesState struct and sync the IPVS tables every
+// time the state changes. It starts with a FullSync so the tables match the
+// state before the first change comes in.
+func (i *IPVS) Watch(state *catalog.ServicesState) {
+	i.eventChannel = make(chan catalog.ChangeEvent, 2)
+	state.AddListener(i)
+
+	err := i.FullSync(state)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	for event := range i.eventChannel {
+		log.Println("State change event from " + event.Service.Hostname)
+		err := i.Sync(state)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	err = state.RemoveListener(i.Name())
+	if err != nil {
+		log.Warnf("Failed to remove IPVS listener: %s", err)
+	}
+}
+
+// Name is part of the catalog.Listener interface. Returns the listener name.
+func (i *IPVS) Name() string {
+	return "IPVS"
+}
+
+// Managed is part of the catalog.Listener interface. We never want IPVS to
+// be auto-added or removed.
+func (i *IPVS) Managed() bool {
+	return false
+}
+
+// Chan is part of the catalog.Listener interface. Returns the channel we listen on.
+func (i *IPVS) Chan() chan catalog.ChangeEvent {
+	return i.eventChannel
+}
+
+// sortedVirtualServices keeps the order of commands stable
+func sortedVirtualServices(table routingTable) []VirtualService {
+	list := make([]VirtualService, 0, len(table))
+	for vs := range table {
+		list = append(list, vs)
+	}
+
+	sort.Slice(list, func(a, b int) bool {
+		if list[a].Port == list[b].Port {
+			return list[a].Protocol < list[b].Protocol
+		}
+		return list[a].Port < list[b].Port
+	})
+
+	return list
+}
@@ -0,0 +1,198 @@
+package ipvs
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type mockRunner struct {
+	commands []string
+	failOn   string
+	table    string
+	listErr  error
+	sync.Mutex
+}
+
+func (m *mockRunner) run(command string, args ...string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	cmd := command + " " + strings.Join(args, " ")
+	if m.failOn != "" && strings.Contains(cmd, m.failOn) {
+		return errors.New("intentional failure")
+	}
+	m.commands = append(m.commands, cmd)
+	return nil
+}
+
+func (m *mockRunner) list(command string, args ...string) ([]byte, error) {
+	return []byte(m.table), m.listErr
+}
+
+func (m *mockRunner) ran(cmd string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, c := range m.commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_IPVS(t *testing.T) {
+	Convey("IPVS", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = "indomitable"
+		baseTime := time.Now().UTC().Round(time.Second)
+
+		svc1 := service.Service{
+			ID: "deadbeef123", Name: "web", Hostname: "indomitable", Updated: baseTime,
+			Ports: []service.Port{
+				{Type: "tcp", Port: 32080, ServicePort: 80, IP: "10.0.0.1"},
+				{Type: "udp", Port: 32053, ServicePort: 53, IP: "10.0.0.1"},
+				{Type: "tcp", Port: 32999, IP: "10.0.0.1"},
+			},
+		}
+		svc2 := service.Service{
+			ID: "deadbeef456", Name: "web", Hostname: "indefatigable", Updated: baseTime,
+			Ports: []service.Port{{Type: "tcp", Port: 31080, ServicePort: 80, IP: "10.0.0.2"}},
+		}
+		state.AddServiceEntry(svc1)
+		state.AddServiceEntry(svc2)
+
+		runner := &mockRunner{}
+		dataplane := New("192.168.168.169")
+		dataplane.Runner = runner.run
+		dataplane.Lister = runner.list
+
+		Convey("New() configures sane defaults", func() {
+			So(dataplane.Scheduler, ShouldEqual, "rr")
+			So(dataplane.Command, ShouldEqual, "ipvsadm")
+		})
+
+		Convey("Sync() programs the virtual and real servers", func() {
+			err := dataplane.Sync(state)
+
+			So(err, ShouldBeNil)
+			So(runner.commands, ShouldContain, "ipvsadm -A -u 192.168.168.169:53 -s rr")
+			So(runner.commands, ShouldContain, "ipvsadm -A -t 192.168.168.169:80 -s rr")
+			So(runner.commands, ShouldContain, "ipvsadm -a -u 192.168.168.169:53 -r 10.0.0.1:32053 -m")
+			So(runner.commands, ShouldContain, "ipvsadm -a -t 192.168.168.169:80 -r 10.0.0.1:32080 -m")
+			So(runner.commands, ShouldContain, "ipvsadm -a -t 192.168.168.169:80 -r 10.0.0.2:31080 -m")
+			So(len(runner.commands), ShouldEqual, 5)
+		})
+
+		Convey("Sync() only applies what changed", func() {
+			dataplane.Sync(state)
+			runner.commands = nil
+
+			svc2.Status = service.TOMBSTONE
+			svc2.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc2)
+			dataplane.Sync(state)
+
+			So(runner.commands, ShouldResemble, []string{
+				"ipvsadm -d -t 192.168.168.169:80 -r 10.0.0.2:31080",
+			})
+		})
+
+		Convey("Sync() removes virtual services with no backends", func() {
+			dataplane.Sync(state)
+			runner.commands = nil
+
+			svc1.Status = service.UNHEALTHY
+			svc1.Updated = baseTime.Add(time.Second)
+			state.AddServiceEntry(svc1)
+			dataplane.Sync(state)
+
+			So(runner.commands, ShouldResemble, []string{
+				"ipvsadm -D -u 192.168.168.169:53",
+				"ipvsadm -d -t 192.168.168.169:80 -r 10.0.0.1:32080",
+			})
+		})
+
+		Convey("Sync() reports failures and retries them next time", func() {
+			runner.failOn = "-u"
+			err := dataplane.Sync(state)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "intentional failure")
+
+			runner.failOn = ""
+			runner.commands = nil
+			err = dataplane.Sync(state)
+			So(err, ShouldBeNil)
+			So(runner.commands, ShouldResemble, []string{
+				"ipvsadm -A -u 192.168.168.169:53 -s rr",
+				"ipvsadm -a -u 192.168.168.169:53 -r 10.0.0.1:32053 -m",
+			})
+		})
+
+		Convey("FullSync() replaces everything else on the BindIP", func() {
+			runner.table = strings.Join([]string{
+				"-A -t 192.168.168.169:80 -s rr",
+				"-a -t 192.168.168.169:80 -r 10.0.0.1:32080 -m -w 1",
+				"-a -t 192.168.168.169:80 -r 10.0.0.9:30000 -m -w 1",
+				"-A -t 192.168.168.169:8080 -s rr",
+				"-a -t 192.168.168.169:8080 -r 10.0.0.9:30001 -m -w 1",
+				"-A -t 10.1.1.1:80 -s wlc",
+				"-a -t 10.1.1.1:80 -r 10.0.0.9:30002 -m -w 1",
+				"-A -f 5 -s rr",
+			}, "\n") + "\n"
+
+			err := dataplane.FullSync(state)
+
+			So(err, ShouldBeNil)
+			So(runner.commands, ShouldResemble, []string{
+				"ipvsadm -d -t 192.168.168.169:80 -r 10.0.0.9:30000",
+				"ipvsadm -D -t 192.168.168.169:8080",
+				"ipvsadm -A -u 192.168.168.169:53 -s rr",
+				"ipvsadm -a -u 192.168.168.169:53 -r 10.0.0.1:32053 -m",
+				"ipvsadm -a -t 192.168.168.169:80 -r 10.0.0.2:31080 -m",
+			})
+		})
+
+		Convey("FullSync() reports when it can't list the tables", func() {
+			runner.listErr = errors.New("intentional failure")
+
+			err := dataplane.FullSync(state)
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "intentional failure")
+			So(runner.commands, ShouldBeEmpty)
+		})
+
+		Convey("Watch() does a full sync when it starts", func() {
+			runner.table = "-A -t 192.168.168.169:8080 -s rr\n"
+
+			go dataplane.Watch(state)
+
+			for i := 0; i < 1000 && !runner.ran("ipvsadm -D -t 192.168.168.169:8080"); i++ {
+				time.Sleep(1 * time.Millisecond)
+			}
+			So(runner.ran("ipvsadm -D -t 192.168.168.169:8080"), ShouldBeTrue)
+			So(runner.ran("ipvsadm -A -t 192.168.168.169:80 -s rr"), ShouldBeTrue)
+		})
+
+		Convey("Cleanup() removes only what we created", func() {
+			dataplane.Sync(state)
+			runner.commands = nil
+
+			dataplane.Cleanup()
+
+			So(runner.commands, ShouldResemble, []string{
+				"ipvsadm -D -u 192.168.168.169:53",
+				"ipvsadm -D -t 192.168.168.169:80",
+			})
+			So(len(dataplane.applied), ShouldEqual, 0)
+		})
+	})
+}
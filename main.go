@@ -2,27 +2,54 @@ package main // import "github.com/NinesStack/sidecar"
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"net/http"
 	"os"
-	"os/signal"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/NinesStack/memberlist"
+	"github.com/NinesStack/sidecar/affinity"
 	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/certs"
 	"github.com/NinesStack/sidecar/config"
+	"github.com/NinesStack/sidecar/consistency"
 	"github.com/NinesStack/sidecar/discovery"
 	"github.com/NinesStack/sidecar/envoy"
+	"github.com/NinesStack/sidecar/events"
 	"github.com/NinesStack/sidecar/haproxy"
 	"github.com/NinesStack/sidecar/healthy"
+	"github.com/NinesStack/sidecar/ipvs"
+	"github.com/NinesStack/sidecar/nginx"
+	"github.com/NinesStack/sidecar/recovery"
+	"github.com/NinesStack/sidecar/secrets"
 	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/sidecargrpc"
 	"github.com/NinesStack/sidecar/sidecarhttp"
+	"github.com/NinesStack/sidecar/spoe"
+	"github.com/NinesStack/sidecar/timeline"
+	"github.com/NinesStack/sidecar/wire"
 	"github.com/armon/go-metrics"
 	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/relistan/rubberneck.v1"
 )
 
+// Version is announced with Sidecar's own service entry. Set it at build
+// time with: go build -ldflags "-X main.Version=1.2.3"
+var Version = "dev"
+
+// The modules we check for, named here because the config variable hides the
+// config package where we check
+const (
+	moduleAPI     = config.ModuleAPI
+	moduleHealthy = config.ModuleHealthy
+	moduleMetrics = config.ModuleMetrics
+)
+
 func announceMembers(list *memberlist.Memberlist, state *catalog.ServicesState) {
 	for {
 		// Ask for members of the cluster
@@ -59,24 +86,42 @@ func configureOverrides(config *config.Config, opts *CliOpts) {
 	}
 }
 
-func configureHAproxy(config *config.Config) *haproxy.HAproxy {
+func configureHAproxy(config *config.Config) (*haproxy.HAproxy, error) {
 	proxy := haproxy.New(config.HAproxy.ConfigFile, config.HAproxy.PidFile)
 
 	if len(config.HAproxy.BindIP) > 0 {
 		proxy.BindIP = config.HAproxy.BindIP
 	}
 
+	if len(config.HAproxy.BindIPv6) > 0 {
+		proxy.BindIPv6 = config.HAproxy.BindIPv6
+	}
+
+	interfaces, err := haproxy.ParseBindInterfaces(config.HAproxy.BindInterfaces)
+	if err != nil {
+		return nil, err
+	}
+	proxy.BindInterfaces = interfaces
+	proxy.DualStack = config.HAproxy.DualStack
+
 	if len(config.HAproxy.ReloadCmd) > 0 {
 		proxy.ReloadCmd = config.HAproxy.ReloadCmd
 	}
 
 	if len(config.HAproxy.VerifyCmd) > 0 {
+		if !haproxy.ValidVerifyCmd(config.HAproxy.VerifyCmd) {
+			return nil, fmt.Errorf(
+				"Invalid verify command '%s', it needs %s where the config file goes",
+				config.HAproxy.VerifyCmd, haproxy.ConfigFilePlaceholder,
+			)
+		}
 		proxy.VerifyCmd = config.HAproxy.VerifyCmd
 	}
 
 	if len(config.HAproxy.TemplateFile) > 0 {
 		proxy.Template = config.HAproxy.TemplateFile
 	}
+	proxy.TemplateOverlay = config.HAproxy.TemplateOverlayFile
 
 	if len(config.HAproxy.User) > 0 {
 		proxy.User = config.HAproxy.User
@@ -86,12 +131,265 @@ func configureHAproxy(config *config.Config) *haproxy.HAproxy {
 		proxy.Group = config.HAproxy.Group
 	}
 
+	if config.HAproxy.MaxConn > 0 {
+		proxy.MaxConn = config.HAproxy.MaxConn
+	}
+
+	proxy.Chroot = config.HAproxy.Chroot
+	proxy.NbThread = config.HAproxy.NbThread
+	proxy.NbProc = config.HAproxy.NbProc
+	proxy.CPUMap = config.HAproxy.CPUMap
+	proxy.NoReusePort = config.HAproxy.NoReusePort
+	proxy.BindOptions = config.HAproxy.BindOptions
+	proxy.HTTP2 = config.HAproxy.HTTP2
+
+	if len(config.HAproxy.Binary) > 0 {
+		proxy.Binary = config.HAproxy.Binary
+	}
+	proxy.LogTarget = config.HAproxy.LogTarget
+
+	// Send the logs to our own receiver if we're turning them into metrics
+	if config.HAproxy.SyslogAddr != "" {
+		proxy.LogTarget = config.HAproxy.SyslogAddr
+		proxy.RequestLogs = true
+	}
+
 	proxy.UseHostnames = config.HAproxy.UseHostnames
+	proxy.ShowExclusions = config.HAproxy.ShowExclusions
+	proxy.ActiveChecks = config.HAproxy.ActiveChecks
+	proxy.ConnectTimeout = config.HAproxy.ConnectTimeout
+	proxy.ClientTimeout = config.HAproxy.ClientTimeout
+	proxy.ServerTimeout = config.HAproxy.ServerTimeout
+	proxy.Retries = config.HAproxy.Retries
+	proxy.TimeoutsFile = config.HAproxy.TimeoutsFile
+	proxy.DrainPeriod = config.HAproxy.DrainPeriod
+	proxy.StatsSocket = config.HAproxy.StatsSocket
+	proxy.ReloadDebounce = config.HAproxy.ReloadDebounce
+	proxy.ReloadBackoff = config.HAproxy.ReloadBackoff
+	proxy.MaxReloadBackoff = config.HAproxy.MaxReloadBackoff
+	proxy.ReloadDelaySessions = config.HAproxy.ReloadDelaySessions
+	proxy.MaxReloadDelay = config.HAproxy.MaxReloadDelay
+	proxy.LongLivedSession = config.HAproxy.LongLivedSession
+
+	if proxy.ReloadDelaySessions > 0 && !config.HAproxy.TrafficStats {
+		return nil, fmt.Errorf("Delaying reloads requires HAPROXY_TRAFFIC_STATS")
+	}
+
+	if config.HAproxy.RuntimeUpdates {
+		if proxy.StatsSocket == "" {
+			return nil, fmt.Errorf("Runtime updates require HAPROXY_STATS_SOCKET")
+		}
+		proxy.RuntimeUpdates = true
+		proxy.Runtime = &haproxy.StatsSocket{Path: proxy.StatsSocket}
+	}
+
+	if config.HAproxy.DataPlaneURL != "" {
+		if config.HAproxy.RuntimeUpdates {
+			return nil, fmt.Errorf("Runtime updates can't be used with HAPROXY_DATAPLANE_URL")
+		}
+		proxy.DataPlane = haproxy.NewDataPlane(
+			config.HAproxy.DataPlaneURL, config.HAproxy.DataPlaneUser, config.HAproxy.DataPlanePassword,
+		)
+	}
+	proxy.ErrorFilesDir = config.HAproxy.ErrorFilesDir
+
+	if !haproxy.ValidNoBackendsMode(config.HAproxy.NoBackends) {
+		return nil, fmt.Errorf("Invalid no backends mode '%s'", config.HAproxy.NoBackends)
+	}
+	proxy.NoBackends = config.HAproxy.NoBackends
+
+	overrides, err := haproxy.ParseNoBackendsOverrides(config.HAproxy.NoBackendsOverrides)
+	if err != nil {
+		return nil, err
+	}
+	proxy.NoBackendsOverrides = overrides
+
+	proxy.Secrets, err = configureSecrets(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.HAproxy.ConnLimits {
+		memoryPerConn, err := service.ParseBytes(config.HAproxy.MemoryPerConn)
+		if err != nil || memoryPerConn == 0 {
+			return nil, fmt.Errorf("Invalid memory per connection '%s'", config.HAproxy.MemoryPerConn)
+		}
+		if config.HAproxy.MinServerConn < 1 {
+			return nil, fmt.Errorf("Invalid min server connections %d, must be at least 1", config.HAproxy.MinServerConn)
+		}
+		proxy.ConnLimits = true
+		proxy.MemoryPerConn = memoryPerConn
+		proxy.MinServerConn = config.HAproxy.MinServerConn
+	}
+
+	proxy.VirtualHostPort = config.HAproxy.VirtualHostPort
+	proxy.SNIPort = config.HAproxy.SNIPort
+	proxy.ClientRates = config.HAproxy.ClientRates
+
+	if config.HAproxy.MeshPort > 0 {
+		if config.HAproxy.MeshCertFile == "" || config.HAproxy.MeshCAFile == "" {
+			return nil, fmt.Errorf("HAPROXY_MESH_PORT requires HAPROXY_MESH_CERT_FILE and HAPROXY_MESH_CA_FILE")
+		}
+		proxy.MeshPort = config.HAproxy.MeshPort
+		proxy.MeshCertFile = config.HAproxy.MeshCertFile
+		proxy.MeshCAFile = config.HAproxy.MeshCAFile
+	}
+
+	if config.HAproxy.SPOEAgentAddr != "" {
+		if proxy.DataPlane != nil {
+			return nil, fmt.Errorf("The SPOE agent can't be used with HAPROXY_DATAPLANE_URL")
+		}
+		proxy.SPOEAgent = config.HAproxy.SPOEAgentAddr
+		proxy.SPOEConfigFile = config.HAproxy.SPOEConfigFile
+	}
+
+	proxy.CertDir = config.HAproxy.CertDir
+
+	certFiles, err := haproxy.ParseCertFiles(config.HAproxy.CertFiles)
+	if err != nil {
+		return nil, err
+	}
+	proxy.CertFiles = certFiles
+	proxy.DefaultCertFile = config.HAproxy.DefaultCertFile
+	proxy.HTTPSRedirect = config.HAproxy.HTTPSRedirect
+
+	if config.ACME.Enable {
+		if proxy.CertDir == "" {
+			return nil, fmt.Errorf("ACME_ENABLE requires HAPROXY_CERT_DIR")
+		}
+		proxy.ACMEBind = config.ACME.HTTPBind
+		proxy.ACMEResponder = config.ACME.ResponderAddr
+	}
 
-	return proxy
+	return proxy, nil
 }
 
-func configureDiscovery(config *config.Config, publishedIP string, localNode *memberlist.Node) discovery.Discoverer {
+// validateHAproxyTuning checks the tuning options against the installed
+// HAproxy. When we can't tell which version that is, we let HAproxy's own
+// config check catch any problems.
+func validateHAproxyTuning(proxy *haproxy.HAproxy) error {
+	version, err := proxy.DetectInstalledVersion()
+	if err != nil {
+		log.Warnf("Not validating the HAproxy tuning options: %s", err)
+		return nil
+	}
+
+	return proxy.ValidateTuning(version)
+}
+
+// configureCerts sets up the manager that keeps the certificates in the
+// HAproxy CertDir up to date. They are issued by ACME when it's enabled, and
+// otherwise fetched from Vault when it's configured or from the secrets
+// provider.
+func configureCerts(config *config.Config, proxy *haproxy.HAproxy, state *catalog.ServicesState) (*certs.Manager, error) {
+	var source certs.Source
+
+	switch {
+	case config.ACME.Enable:
+		acmeSource := certs.NewACMESource(config.ACME.DirectoryURL, config.ACME.AccountKeyFile)
+		acmeSource.Email = config.ACME.Email
+		acmeSource.RenewBefore = config.ACME.RenewBefore
+		source = acmeSource
+	case config.Vault.Addr != "":
+		vault := certs.NewVaultSource(config.Vault.Addr, config.Vault.Token)
+		vault.Mount = config.Vault.CertMount
+		vault.Prefix = config.Vault.CertPath
+		source = vault
+	case proxy.Secrets != nil:
+		source = certs.NewSecretsSource(proxy.Secrets)
+	default:
+		return nil, fmt.Errorf("HAPROXY_CERT_DIR requires VAULT_ADDR or a secrets provider")
+	}
+
+	manager := certs.NewManager(proxy.CertDir, source)
+	manager.RenewInterval = config.HAproxy.CertRenewInterval
+	manager.IssueForHostnames = config.ACME.Enable
+	manager.OnRotate = func() error { return proxy.ForceWriteAndReload(state) }
+
+	return manager, nil
+}
+
+// configureSecrets returns the provider the proxy templates get their
+// credentials from, or nil if none is configured.
+func configureSecrets(config *config.Config) (secrets.Provider, error) {
+	switch {
+	case config.Sidecar.SecretsFile != "" && config.Sidecar.SecretsCommand != "":
+		return nil, fmt.Errorf("Only one of SIDECAR_SECRETS_FILE and SIDECAR_SECRETS_COMMAND can be set")
+	case config.Sidecar.SecretsFile != "":
+		if config.Sidecar.SecretsKeyFile == "" {
+			return nil, fmt.Errorf("SIDECAR_SECRETS_FILE requires SIDECAR_SECRETS_KEY_FILE")
+		}
+		return secrets.NewFileProvider(config.Sidecar.SecretsFile, config.Sidecar.SecretsKeyFile), nil
+	case config.Sidecar.SecretsCommand != "":
+		return secrets.NewCommandProvider(config.Sidecar.SecretsCommand), nil
+	}
+
+	return nil, nil
+}
+
+func configureNginx(config *config.Config) (*nginx.Nginx, error) {
+	proxy := nginx.New(config.Nginx.StreamConfigFile)
+	proxy.BindIP = config.Nginx.BindIP
+	proxy.StreamTemplate = config.Nginx.StreamTemplate
+	proxy.StreamTemplateOverlay = config.Nginx.StreamTemplateOverlay
+	proxy.UseHostnames = config.Nginx.UseHostnames
+	proxy.Proxy = config.Nginx.ProxyEnable
+	proxy.ProxyTemplate = config.Nginx.ProxyTemplate
+	proxy.ProxyTemplateOverlay = config.Nginx.ProxyTemplateOverlay
+	proxy.ProxyConfigFile = config.Nginx.ProxyConfigFile
+
+	if len(config.Nginx.ReloadCmd) > 0 {
+		proxy.ReloadCmd = config.Nginx.ReloadCmd
+	}
+
+	if len(config.Nginx.VerifyCmd) > 0 {
+		proxy.VerifyCmd = config.Nginx.VerifyCmd
+	}
+
+	var err error
+	proxy.Secrets, err = configureSecrets(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy, nil
+}
+
+func configureIPVS(config *config.Config) *ipvs.IPVS {
+	dataplane := ipvs.New(config.IPVS.BindIP)
+	dataplane.Scheduler = config.IPVS.Scheduler
+	dataplane.Command = config.IPVS.Command
+
+	return dataplane
+}
+
+// configureServiceNamer returns the ServiceNamer that names Docker services,
+// picking a different one for the images with an override
+func configureServiceNamer(config *config.Config) (discovery.ServiceNamer, error) {
+	svcNamer, err := discovery.NewServiceNamer(
+		config.Services.ServiceNamer, config.Services.NameLabel, config.Services.NameMatch,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Services.NamerOverrides) < 1 {
+		return svcNamer, nil
+	}
+
+	overrides, err := discovery.ParseNamerOverrides(
+		config.Services.NamerOverrides, config.Services.NameLabel, config.Services.NameMatch,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return discovery.NewImagePrefixNamer(svcNamer, overrides), nil
+}
+
+func configureDiscovery(config *config.Config, publishedIP string, localNode *memberlist.Node,
+	eventBus *events.Bus) *discovery.MultiDiscovery {
+
 	disco := new(discovery.MultiDiscovery)
 
 	var svcNamer discovery.ServiceNamer
@@ -108,105 +406,274 @@ func configureDiscovery(config *config.Config, publishedIP string, localNode *me
 		}
 	}
 
-	switch config.Services.ServiceNamer {
-	case "docker_label":
-		svcNamer = &discovery.DockerLabelNamer{
-			Label: config.Services.NameLabel,
-		}
-	case "regex":
-		svcNamer, err = discovery.NewRegexpNamer(config.Services.NameMatch)
+	svcNamer, err = configureServiceNamer(config)
+	if err != nil && usingDocker {
+		log.Fatalf("Unable to configure service namer: %s", err)
+	}
+
+	svcIdentifier, err := discovery.NewServiceIdentifier(config.Services.Identity)
+	if err != nil {
+		log.Fatalf("Unable to configure service identity: %s", err)
+	}
+
+	var portRanges *discovery.PortRanges
+	if len(config.Services.PortRanges) > 0 {
+		portRanges, err = discovery.ParsePortRanges(config.Services.PortRanges)
 		if err != nil {
-			log.Fatalf("Unable to use RegexpNamer: %s", err)
-		}
-	default:
-		if usingDocker {
-			log.Fatalf("Unable to configure service namer! Not a valid entry.")
+			log.Fatalf("Unable to configure service port ranges: %s", err)
 		}
 	}
 
 	for _, method := range config.Sidecar.Discovery {
+		var source discovery.Discoverer
+
 		switch method {
 		case "docker":
-			disco.Discoverers = append(
-				disco.Discoverers,
-				discovery.NewDockerDiscovery(config.DockerDiscovery.DockerURL, svcNamer, publishedIP),
-			)
+			dockerDisco := discovery.NewDockerDiscovery(config.DockerDiscovery.DockerURL, svcNamer, publishedIP)
+			dockerDisco.Identifier = svcIdentifier
+			dockerDisco.PortRanges = portRanges
+			dockerDisco.NamespaceLabel = config.Services.NamespaceLabel
+			if config.DockerDiscovery.CollectStats {
+				dockerDisco.StatsInterval = config.DockerDiscovery.StatsInterval
+			}
+			err := waitFor("Docker", config.Sidecar.StartupTimeout, dockerDisco.Ping)
+			exitWithError(err, "Docker is not available")
+			source = dockerDisco
 		case "static":
-			disco.Discoverers = append(
-				disco.Discoverers,
-				discovery.NewStaticDiscovery(config.StaticDiscovery.ConfigFile, publishedIP),
-			)
+			source = discovery.NewStaticDiscovery(config.StaticDiscovery.ConfigFile, publishedIP)
 		case "kubernetes_api":
-			disco.Discoverers = append(
-				disco.Discoverers,
-				discovery.NewK8sAPIDiscoverer(
-					config.K8sAPIDiscovery.KubeAPIIP, config.K8sAPIDiscovery.KubeAPIPort,
-					config.K8sAPIDiscovery.Namespace, config.K8sAPIDiscovery.KubeTimeout,
-					config.K8sAPIDiscovery.CredsPath, config.K8sAPIDiscovery.AnnounceAllNodes,
-					localNode.Name,
-				),
+			source = discovery.NewK8sAPIDiscoverer(
+				config.K8sAPIDiscovery.KubeAPIIP, config.K8sAPIDiscovery.KubeAPIPort,
+				config.K8sAPIDiscovery.Namespace, config.K8sAPIDiscovery.KubeTimeout,
+				config.K8sAPIDiscovery.CredsPath, config.K8sAPIDiscovery.AnnounceAllNodes,
+				localNode.Name,
 			)
+		case "sidecar":
+			if !config.ModuleEnabled(moduleAPI) {
+				log.Warn("Not announcing Sidecar itself, the API module is disabled")
+				continue
+			}
+			source = discovery.NewSelfDiscovery(publishedIP, sidecarhttp.ApiPort, Version, config.Sidecar.Role)
 		default:
+			continue
+		}
+
+		// Don't let a misbehaving source take all of its services down with it
+		if config.Sidecar.DiscoveryGracePeriod > 0 {
+			breaker := discovery.NewCircuitBreaker(method, source, config.Sidecar.DiscoveryGracePeriod)
+			breaker.Events = eventBus
+			source = breaker
 		}
+
+		disco.Discoverers = append(disco.Discoverers, source)
 	}
 
 	return disco
 }
 
-// configureMetrics sets up remote performance metrics if we're asked to send them (statsd)
-func configureMetrics(config *config.Config) {
+// configureMetrics sets up in-memory metrics for the API, and remote
+// performance metrics if we're asked to send them (statsd)
+func configureMetrics(config *config.Config) *metrics.InmemSink {
+	inmem := metrics.NewInmemSink(10*time.Second, time.Minute)
+	sinks := metrics.FanoutSink{inmem}
+
 	if config.Sidecar.StatsAddr != "" {
 		sink, err := metrics.NewStatsdSink(config.Sidecar.StatsAddr)
 		exitWithError(err, "Can't configure Statsd")
+		sinks = append(sinks, sink)
+	}
+
+	metricsConfig := metrics.DefaultConfig("sidecar")
+	_, err := metrics.NewGlobal(metricsConfig, sinks)
+	exitWithError(err, "Can't start metrics")
+
+	return inmem
+}
+
+// configureLogReceiver starts the HAproxy syslog listener if we're asked to
+// turn HAproxy request logs into metrics
+func configureLogReceiver(config *config.Config, eventBus *events.Bus) {
+	if config.HAproxy.SyslogAddr == "" {
+		return
+	}
+
+	receiver := haproxy.NewLogReceiver(config.HAproxy.SyslogAddr)
+	receiver.Events = eventBus
+	receiver.SlowThreshold = config.HAproxy.SlowRequestThreshold
+	receiver.SampleRate = config.HAproxy.RequestSampleRate
+	go func() {
+		err := receiver.ListenAndServe()
+		log.Errorf("HAproxy log receiver stopped: %s", err)
+	}()
+}
+
+// configureOutliers returns the detector that lowers the weight of HAproxy
+// servers with elevated error rates, or nil if it isn't turned on
+func configureOutliers(config *config.Config, eventBus *events.Bus) (*haproxy.OutlierDetector, error) {
+	if !config.HAproxy.OutlierDetection {
+		return nil, nil
+	}
 
-		metricsConfig := metrics.DefaultConfig("sidecar")
-		_, err = metrics.NewGlobal(metricsConfig, sink)
-		exitWithError(err, "Can't start metrics")
+	if config.HAproxy.StatsSocket == "" {
+		return nil, fmt.Errorf("Outlier detection requires HAPROXY_STATS_SOCKET")
+	}
+	if config.HAproxy.OutlierErrorRate <= 0 || config.HAproxy.OutlierErrorRate > 1 {
+		return nil, fmt.Errorf("Invalid outlier error rate %f, must be over 0 and at most 1", config.HAproxy.OutlierErrorRate)
 	}
+	if config.HAproxy.OutlierWeight < 0 || config.HAproxy.OutlierWeight > 100 {
+		return nil, fmt.Errorf("Invalid outlier weight %d, must be from 0 to 100", config.HAproxy.OutlierWeight)
+	}
+
+	detector := haproxy.NewOutlierDetector(&haproxy.StatsSocket{Path: config.HAproxy.StatsSocket})
+	detector.Events = eventBus
+	detector.ErrorRate = config.HAproxy.OutlierErrorRate
+	detector.MinRequests = config.HAproxy.OutlierMinRequests
+	detector.Weight = config.HAproxy.OutlierWeight
+	detector.Cooldown = config.HAproxy.OutlierCooldown
+
+	return detector, nil
+}
+
+// configureLoadWeigher returns the weigher that spreads the load in each
+// HAproxy backend by the CPU use of its servers, or nil if it isn't turned
+// on. Servers the outlier detector has lowered are left to it.
+func configureLoadWeigher(config *config.Config, outliers *haproxy.OutlierDetector) (*haproxy.LoadWeigher, error) {
+	if !config.HAproxy.LoadWeighting {
+		return nil, nil
+	}
+
+	if config.HAproxy.StatsSocket == "" {
+		return nil, fmt.Errorf("Load weighting requires HAPROXY_STATS_SOCKET")
+	}
+	if config.HAproxy.LoadMinWeight < 1 || config.HAproxy.LoadMinWeight > 100 {
+		return nil, fmt.Errorf("Invalid load min weight %d, must be from 1 to 100", config.HAproxy.LoadMinWeight)
+	}
+	if config.HAproxy.LoadHeadroom < 0 {
+		return nil, fmt.Errorf("Invalid load headroom %f, must not be negative", config.HAproxy.LoadHeadroom)
+	}
+	if config.HAproxy.LoadWeightInterval <= 0 {
+		return nil, fmt.Errorf("Invalid load weight interval %s, must be over 0", config.HAproxy.LoadWeightInterval)
+	}
+
+	weigher := haproxy.NewLoadWeigher(&haproxy.StatsSocket{Path: config.HAproxy.StatsSocket})
+	weigher.MinWeight = config.HAproxy.LoadMinWeight
+	weigher.Headroom = config.HAproxy.LoadHeadroom
+	if outliers != nil {
+		weigher.Exclude = outliers.Lowered
+	}
+
+	return weigher, nil
+}
+
+// configureClientRates returns the collector that exports the busiest
+// clients of each service from HAproxy's stick-tables, or nil if it isn't
+// turned on
+func configureClientRates(config *config.Config, proxy *haproxy.HAproxy) (*haproxy.ClientRateCollector, error) {
+	if !config.HAproxy.ClientRates {
+		return nil, nil
+	}
+
+	if config.HAproxy.StatsSocket == "" {
+		return nil, fmt.Errorf("Client rates require HAPROXY_STATS_SOCKET")
+	}
+	if config.HAproxy.ClientRatesTop < 1 {
+		return nil, fmt.Errorf("Invalid client rates top %d, must be at least 1", config.HAproxy.ClientRatesTop)
+	}
+	if config.HAproxy.ClientRatesInterval <= 0 {
+		return nil, fmt.Errorf("Invalid client rates interval %s, must be over 0", config.HAproxy.ClientRatesInterval)
+	}
+
+	collector := haproxy.NewClientRateCollector(
+		&haproxy.StatsSocket{Path: config.HAproxy.StatsSocket}, proxy.ClientRateTables,
+	)
+	collector.Top = config.HAproxy.ClientRatesTop
+
+	return collector, nil
+}
+
+// configureTraffic returns the collector that exports the traffic to each
+// backend from HAproxy's stats, or nil if it isn't turned on
+func configureTraffic(config *config.Config) (*haproxy.TrafficCollector, error) {
+	if !config.HAproxy.TrafficStats {
+		return nil, nil
+	}
+
+	if config.HAproxy.StatsSocket == "" {
+		return nil, fmt.Errorf("Traffic stats require HAPROXY_STATS_SOCKET")
+	}
+	if config.HAproxy.TrafficInterval <= 0 {
+		return nil, fmt.Errorf("Invalid traffic stats interval %s, must be over 0", config.HAproxy.TrafficInterval)
+	}
+
+	return haproxy.NewTrafficCollector(&haproxy.StatsSocket{Path: config.HAproxy.StatsSocket}), nil
+}
+
+// configureConsistency returns the checker that compares our state and proxy
+// config with the rest of the cluster's. The proxy may be nil.
+func configureConsistency(config *config.Config, list *memberlist.Memberlist,
+	proxy *haproxy.HAproxy, eventBus *events.Bus) (*consistency.Checker, error) {
+
+	if config.Sidecar.ConsistencyThreshold < 1 {
+		return nil, fmt.Errorf("Invalid consistency threshold %d, must be at least 1", config.Sidecar.ConsistencyThreshold)
+	}
+
+	checker := consistency.NewChecker(func() []consistency.Member {
+		var members []consistency.Member
+		for _, node := range list.Members() {
+			members = append(members, consistency.Member{
+				Name: node.Name,
+				URL:  "http://" + net.JoinHostPort(node.Addr.String(), strconv.Itoa(sidecarhttp.ApiPort)),
+			})
+		}
+		return members
+	})
+	checker.Events = eventBus
+	checker.Threshold = config.Sidecar.ConsistencyThreshold
+
+	if proxy != nil {
+		checker.ConfigHash = proxy.ConfigHash
+	}
+
+	return checker, nil
 }
 
 // configureDelegate sets up the Memberlist delegate we'll use
-func configureDelegate(state *catalog.ServicesState, config *config.Config) *servicesDelegate {
+func configureDelegate(state *catalog.ServicesState, config *config.Config, eventBus *events.Bus) *servicesDelegate {
 	delegate := NewServicesDelegate(state)
 	delegate.Metadata = NodeMetadata{
 		ClusterName: config.Sidecar.ClusterName,
 		State:       "Running",
+		Formats:     wire.Formats,
 	}
+	delegate.Events = eventBus
+
+	encoder, err := wire.ForName(config.Sidecar.WireFormat)
+	exitWithError(err, "Can't configure the wire format")
+	delegate.WireEncoder = encoder
 
 	delegate.Start()
 
 	return delegate
 }
 
-// configureCpuProfiler sets of the CPU profiler and a signal handler to
-// stop it if we have been told to run the CPU profiler.
+// configureCpuProfiler starts the CPU profiler and registers a shutdown hook
+// to stop it if we have been told to run the CPU profiler.
 func configureCpuProfiler(opts *CliOpts) {
 	if !*opts.CpuProfile {
 		return
 	}
 
-	var profilerFile os.File
-
-	// Capture CTRL-C and stop the CPU profiler
-	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, os.Interrupt)
-	go func() {
-		for sig := range sigChannel {
-			log.Printf("Captured %v, stopping profiler and exiting..", sig)
-			pprof.StopCPUProfile()
-			profilerFile.Close()
-			os.Exit(0)
-		}
-	}()
+	profilerFile, err := os.Create("sidecar.cpu.prof")
+	exitWithError(err, "Can't write profiling file")
+	err = pprof.StartCPUProfile(profilerFile)
+	exitWithError(err, "Can't start the CPU profiler")
+	log.Debug("Profiling!")
 
-	// Enable CPU profiling support if requested
-	if *opts.CpuProfile {
-		profilerFile, err := os.Create("sidecar.cpu.prof")
-		exitWithError(err, "Can't write profiling file")
-		err = pprof.StartCPUProfile(profilerFile)
-		exitWithError(err, "Can't start the CPU profiler")
-		log.Debug("Profiling!")
-	}
+	// Stop the CPU profiler when we're asked to exit
+	onShutdown(func() {
+		pprof.StopCPUProfile()
+		profilerFile.Close()
+	})
 }
 
 func configureLoggingLevel(config *config.Config) {
@@ -236,8 +703,8 @@ func configureLoggingFormat(config *config.Config) {
 	}
 }
 
-func configureMemberlist(config *config.Config, state *catalog.ServicesState) *memberlist.Config {
-	delegate := configureDelegate(state, config)
+func configureMemberlist(config *config.Config, state *catalog.ServicesState, eventBus *events.Bus) *memberlist.Config {
+	delegate := configureDelegate(state, config, eventBus)
 
 	// Use a LAN config but add our delegate
 	mlConfig := memberlist.DefaultLANConfig()
@@ -282,25 +749,62 @@ func configureListeners(config *config.Config, state *catalog.ServicesState) {
 }
 
 func main() {
-	config := config.ParseConfig()
 	opts := parseCommandLine()
+	if opts.Command != "run" || *opts.Once {
+		os.Exit(runCommand(opts, os.Stdout))
+	}
+
+	config := config.ParseConfig()
 	configureOverrides(config, opts)
+	go handleShutdownSignals()
 	configureCpuProfiler(opts)
 	configureLoggingLevel(config)
 	configureLoggingFormat(config)
-	configureMetrics(config)
+
+	log.Infof("Running with role '%s' and modules: %s",
+		config.Sidecar.Role, strings.Join(config.Sidecar.Modules, ", "))
+
+	var metricsSink *metrics.InmemSink
+	if config.ModuleEnabled(moduleMetrics) {
+		metricsSink = configureMetrics(config)
+	}
 
 	// Create a new state instance and fire up the processor. We need
 	// this to happen early in the startup.
 	state := catalog.NewServicesState()
+	if config.Sidecar.ChangeLogSize > 0 {
+		state.ChangeLog = catalog.NewChangeLog(config.Sidecar.ChangeLogSize)
+		state.ChangeLog.SpillFile = config.Sidecar.ChangeLogSpillFile
+		state.ChangeLog.SpillMaxBytes = config.Sidecar.ChangeLogSpillMaxBytes
+	}
+	if config.Sidecar.UptimeWindow > 0 {
+		state.Uptime = catalog.NewUptimeTracker(config.Sidecar.UptimeWindow, config.Sidecar.UptimeTarget)
+	}
 	svcMsgLooper := director.NewFreeLooper(
 		director.FOREVER, make(chan error),
 	)
 	go state.ProcessServiceMsgs(svcMsgLooper)
 
+	// A Sidecar being upgraded hands over to us before we bind its ports
+	snapshot, err := takeOver(config, state)
+	exitWithError(err, "Can't take over from the running Sidecar")
+
 	configureListeners(config, state)
 
-	mlConfig := configureMemberlist(config, state)
+	// Notable events are collected here and made available over the API
+	eventBus := events.NewBus(config.Sidecar.EventsSize)
+	eventBus.MaxBytes = config.Sidecar.EventsMaxBytes
+
+	// The timeline picks the notable changes out of the events and the state
+	var changes *timeline.Timeline
+	if config.Sidecar.TimelineRetention > 0 {
+		changes = timeline.NewTimeline()
+		changes.Retention = config.Sidecar.TimelineRetention
+		changes.MassFailures = config.Sidecar.TimelineMassFailures
+		go changes.Watch(state, eventBus)
+	}
+
+	mlConfig := configureMemberlist(config, state, eventBus)
 
 	printer := rubberneck.NewPrinter(log.Infof, rubberneck.NoAddLineFeed)
 	printer.PrintWithLabel("Sidecar", config)
@@ -308,47 +812,78 @@ func main() {
 	list, err := memberlist.Create(mlConfig)
 	exitWithError(err, "Failed to create memberlist")
 
+	// Don't act on a state that only has part of the cluster in it yet
+	state.Bootstrap(config.Sidecar.BootstrapExpect, config.Sidecar.BootstrapTimeout, func() int {
+		return list.NumMembers() - 1
+	})
+
 	// Join an existing cluster by specifying at least one known member.
 	nodeCount, err := list.Join(config.Sidecar.Seeds)
 	exitWithError(err, "Failed to join cluster")
 	log.Infof("Joined cluster with %d nodes contacted", nodeCount)
 
 	// Set up a bunch of go-director Loopers to run our
-	// background goroutines
-	servicesLooper := director.NewTimedLooper(
+	// background goroutines. A panic in one of them is recovered
+	// from, and the loop starts over, rather than killing Sidecar.
+	servicesLooper := recovery.NewLooper("broadcast_services", director.NewTimedLooper(
 		director.FOREVER, catalog.ALIVE_SLEEP_INTERVAL, nil,
-	)
-	tombstoneLooper := director.NewTimedLooper(
+	))
+	tombstoneLooper := recovery.NewLooper("broadcast_tombstones", director.NewTimedLooper(
 		director.FOREVER, catalog.TOMBSTONE_SLEEP_INTERVAL, nil,
-	)
-	trackingLooper := director.NewTimedLooper(
+	))
+	trackingLooper := recovery.NewLooper("track_services", director.NewTimedLooper(
 		director.FOREVER, catalog.ALIVE_SLEEP_INTERVAL, nil,
-	)
+	))
 	discoLooper := director.NewTimedLooper(
 		director.FOREVER, config.Sidecar.DiscoverySleepInterval, make(chan error),
 	)
-	listenLooper := director.NewTimedLooper(
+	listenLooper := recovery.NewLooper("track_listeners", director.NewTimedLooper(
 		director.FOREVER, discovery.DefaultSleepInterval, make(chan error),
-	)
-	healthWatchLooper := director.NewTimedLooper(
+	))
+	healthWatchLooper := recovery.NewLooper("health_watch", director.NewTimedLooper(
 		director.FOREVER, healthy.WATCH_INTERVAL, make(chan error),
-	)
-	healthLooper := director.NewTimedLooper(
+	))
+	healthLooper := recovery.NewLooper("health_run", director.NewTimedLooper(
 		director.FOREVER, healthy.HEALTH_INTERVAL, make(chan error),
-	)
+	))
 
 	// Register the cluster name with the state object
 	state.ClusterName = config.Sidecar.ClusterName
 
-	disco := configureDiscovery(config, mlConfig.AdvertiseAddr, list.LocalNode())
+	disco := configureDiscovery(config, mlConfig.AdvertiseAddr, list.LocalNode(), eventBus)
 	go disco.Run(discoLooper)
 
 	// Configure the monitor and use the public address as the default
-	// check address.
-	monitor := healthy.NewMonitor(mlConfig.AdvertiseAddr, config.Sidecar.DefaultCheckEndpoint)
+	// check address. Without it, we trust whatever discovery tells us.
+	var monitor *healthy.Monitor
+	serviceFunc := disco.Services
+
+	if config.ModuleEnabled(moduleHealthy) {
+		monitor = healthy.NewMonitor(mlConfig.AdvertiseAddr, config.Sidecar.DefaultCheckEndpoint)
+		if config.Sidecar.CheckDNSCacheTTL > 0 {
+			monitor.Resolver = healthy.NewResolver(config.Sidecar.CheckDNSCacheTTL)
+		}
+		monitor.Events = eventBus
+		monitor.AnnotationsFile = config.Sidecar.CheckAnnotationsFile
+		monitor.HistorySize = config.Sidecar.CheckHistorySize
+		monitor.HistoryMaxBytes = config.Sidecar.CheckHistoryMaxBytes
+		monitor.TraceChecks = config.Sidecar.CheckTracing
+
+		// Checks can only go through the proxy if we run one
+		monitor.CheckViaProxy = config.Sidecar.CheckViaProxy
+		if !config.HAproxy.Disable {
+			monitor.ProxyCheckHost = config.HAproxy.BindIP
+		} else if config.Envoy.UseGRPCAPI {
+			monitor.ProxyCheckHost = config.Envoy.BindIP
+		}
+		exitWithError(monitor.LoadAnnotations(), "Can't load check annotations")
+		if snapshot != nil {
+			monitor.RestoreStatuses(snapshot.Checks)
+		}
 
-	// Wrap the monitor Services function as a simple func without the receiver
-	serviceFunc := func() []service.Service { return monitor.Services() }
+		// Wrap the monitor Services function as a simple func without the receiver
+		serviceFunc = func() []service.Service { return monitor.Services() }
+	}
 
 	// Wrap the discovery Listeners output in something the state can handle
 	listenFunc := func() []catalog.Listener {
@@ -366,9 +901,143 @@ func main() {
 	// discovered services, and then won't write them out.
 	var proxy *haproxy.HAproxy
 
+	// The proxies that follow the state. SIDECAR_PROXY picks one of them.
+	var proxies []catalog.Proxy
+
+	// Affinity pins are added through the API and only apply on this host
+	pins := affinity.NewStore()
+	go pins.Run(director.NewTimedLooper(director.FOREVER, affinity.ExpireInterval, nil))
+
 	if !config.HAproxy.Disable {
-		proxy = configureHAproxy(config)
-		go proxy.Watch(state)
+		proxy, err = configureHAproxy(config)
+		exitWithError(err, "Can't configure HAproxy")
+		if snapshot != nil && snapshot.ProxyConfig != nil {
+			proxy.AdoptConfig(snapshot.ProxyConfig)
+		}
+
+		proxy.Pins = pins
+		proxy.Events = eventBus
+		pins.OnChange = func() {
+			if err := proxy.WriteAndReload(state); err != nil {
+				log.Errorf("Error reloading HAproxy after a pin change: %s", err)
+			}
+		}
+
+		configureLogReceiver(config, eventBus)
+
+		outliers, err := configureOutliers(config, eventBus)
+		exitWithError(err, "Can't configure outlier detection")
+		weigher, err := configureLoadWeigher(config, outliers)
+		exitWithError(err, "Can't configure load weighting")
+		clientRates, err := configureClientRates(config, proxy)
+		exitWithError(err, "Can't configure client rates")
+		proxy.Traffic, err = configureTraffic(config)
+		exitWithError(err, "Can't configure traffic stats")
+
+		// With the Data Plane API, HAproxy and its config may be elsewhere
+		if proxy.DataPlane == nil {
+			err = waitFor("HAproxy binary", config.Sidecar.StartupTimeout, commandAvailable(proxy.VerifyCmd))
+			exitWithError(err, "HAproxy is not available")
+			exitWithError(validateHAproxyTuning(proxy), "Can't use the HAproxy tuning options")
+			err = waitFor("HAproxy config dir", config.Sidecar.StartupTimeout, dirAvailable(proxy.ConfigFile))
+			exitWithError(err, "HAproxy config dir is not available")
+		}
+
+		// The SPOE agent decides the requests HAproxy asks it about
+		if proxy.SPOEAgent != "" {
+			exitWithError(proxy.WriteSPOEConfig(), "Can't write the SPOE config")
+
+			agent := spoe.NewAgent()
+			go agent.Watch(state)
+			go func() {
+				err := agent.ListenAndServe(proxy.SPOEAgent)
+				exitWithError(err, "Can't start the SPOE agent")
+			}()
+		}
+
+		proxies = append(proxies, proxy)
+
+		if config.HAproxy.VersionCheckInterval > 0 && proxy.DataPlane == nil {
+			go proxy.RunVersionCheck(state, director.NewTimedLooper(
+				director.FOREVER, config.HAproxy.VersionCheckInterval, nil,
+			))
+		}
+
+		if outliers != nil {
+			go outliers.Run(director.NewTimedLooper(director.FOREVER, config.HAproxy.OutlierInterval, nil))
+		}
+
+		if weigher != nil {
+			go weigher.Run(state, director.NewTimedLooper(director.FOREVER, config.HAproxy.LoadWeightInterval, nil))
+		}
+
+		if clientRates != nil {
+			go clientRates.Run(director.NewTimedLooper(director.FOREVER, config.HAproxy.ClientRatesInterval, nil))
+		}
+
+		if proxy.Traffic != nil {
+			go proxy.Traffic.Run(state, director.NewTimedLooper(director.FOREVER, config.HAproxy.TrafficInterval, nil))
+		}
+
+		if proxy.CertDir != "" {
+			manager, err := configureCerts(config, proxy, state)
+			exitWithError(err, "Can't configure certificates")
+
+			// The ACME source answers the challenges HAproxy routes to it
+			if acmeSource, ok := manager.Source.(*certs.ACMESource); ok {
+				go func() {
+					err := http.ListenAndServe(config.ACME.ResponderAddr, acmeSource)
+					exitWithError(err, "Can't start the ACME challenge responder")
+				}()
+			}
+
+			certsLooper := director.NewTimedLooper(director.FOREVER, certs.SyncInterval, nil)
+			go manager.Watch(state)
+			go manager.Run(state, certsLooper)
+		}
+	}
+
+	// HAproxy can't route UDP, so nginx handles those services when enabled.
+	// It can also stand in for HAproxy and route the rest.
+	var nginxProxy *nginx.Nginx
+
+	if config.Nginx.UDPEnable || config.Nginx.ProxyEnable {
+		nginxProxy, err = configureNginx(config)
+		exitWithError(err, "Can't configure nginx")
+		proxies = append(proxies, nginxProxy)
+	}
+
+	// Envoy gets the state over gRPC, so it needs no config file or reload
+	if config.Envoy.UseGRPCAPI {
+		ctx := context.Background()
+		envoyServer := envoy.NewServer(ctx, config.Envoy)
+
+		// This listener will be owned and managed by the gRPC server
+		grpcListener, err := net.Listen("tcp", ":"+config.Envoy.GRPCPort)
+		if err != nil {
+			log.Fatalf("Failed to listen on port %q: %s", config.Envoy.GRPCPort, err)
+		}
+
+		go envoyServer.Serve(ctx, grpcListener)
+		proxies = append(proxies, envoyServer)
+	}
+
+	for _, watcher := range proxies {
+		go func(watcher catalog.Proxy) {
+			state.WaitForBootstrap()
+			watcher.Watch(state)
+		}(watcher)
+	}
+
+	// IPVS routes L4 traffic in the kernel, without a userspace proxy. We
+	// remove everything we programmed on the way out.
+	if config.IPVS.Enable {
+		dataplane := configureIPVS(config)
+		onShutdown(dataplane.Cleanup)
+		go func() {
+			state.WaitForBootstrap()
+			dataplane.Watch(state)
+		}()
 	}
 
 	// This is kind of expensive because it looks at the state and formats text
@@ -381,33 +1050,67 @@ func main() {
 	go state.BroadcastTombstones(serviceFunc, tombstoneLooper)
 	go state.TrackNewServices(serviceFunc, trackingLooper)
 	go state.TrackLocalListeners(listenFunc, listenLooper)
-	go monitor.Watch(disco, healthWatchLooper)
-	go monitor.Run(healthLooper)
-
-	go sidecarhttp.ServeHttp(list, state, &sidecarhttp.HttpConfig{
-		BindIP:       config.HAproxy.BindIP,
-		UseHostnames: config.HAproxy.UseHostnames,
+	go state.RunScheduledDrains(director.NewTimedLooper(director.FOREVER, catalog.DrainCheckInterval, nil))
+	if monitor != nil {
+		go monitor.Watch(disco, healthWatchLooper)
+		go monitor.Run(healthLooper)
+	}
+	go handleReannounceSignals(func() {
+		if monitor != nil {
+			monitor.RunChecks()
+		}
+		state.AnnounceServices(serviceFunc)
 	})
 
-	if !config.HAproxy.Disable {
-		err := proxy.WriteAndReload(state)
-		exitWithError(err, "Failed to reload HAProxy config")
+	// Compare our view of the cluster with everyone else's
+	checker, err := configureConsistency(config, list, proxy, eventBus)
+	exitWithError(err, "Can't configure the consistency checker")
+	if config.Sidecar.ConsistencyInterval > 0 {
+		go checker.Run(director.NewTimedLooper(director.FOREVER, config.Sidecar.ConsistencyInterval, nil))
 	}
 
-	if config.Envoy.UseGRPCAPI {
-		ctx := context.Background()
-		envoyServer := envoy.NewServer(ctx, state, config.Envoy)
-		envoyServerLooper := director.NewTimedLooper(
-			director.FOREVER, envoy.LooperUpdateInterval, make(chan error),
-		)
+	if config.ModuleEnabled(moduleAPI) {
+		deps := &sidecarhttp.ApiDeps{
+			Monitor:   monitor,
+			Metrics:   metricsSink,
+			Events:    eventBus,
+			Timeline:  changes,
+			Pins:      pins,
+			Checker:   checker,
+			Proxy:     proxy,
+			Discovery: disco,
+		}
+		go sidecarhttp.ServeHttp(list, state, deps, &sidecarhttp.HttpConfig{
+			BindIP:       config.HAproxy.BindIP,
+			UseHostnames: config.HAproxy.UseHostnames,
+		})
+
+		if config.Sidecar.GRPCPort > 0 {
+			grpcListener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Sidecar.GRPCPort))
+			exitWithError(err, "Can't listen for the gRPC API")
+
+			go func() {
+				err := sidecargrpc.NewServer(state, list, monitor, eventBus).Serve(grpcListener)
+				exitWithError(err, "Can't serve the gRPC API")
+			}()
+		}
+	}
 
-		// This listener will be owned and managed by the gRPC server
-		grpcListener, err := net.Listen("tcp", ":"+config.Envoy.GRPCPort)
-		if err != nil {
-			log.Fatalf("Failed to listen on port %q: %s", config.Envoy.GRPCPort, err)
+	// The proxies keep the config they have until we've seen our peers
+	state.WaitForBootstrap()
+
+	for _, watcher := range proxies {
+		err := watcher.WriteAndReload(state)
+		if _, ok := watcher.(*envoy.Server); ok && err != nil {
+			// Envoy keeps the snapshot it has, and gets another on the next change
+			log.Error(err.Error())
+			continue
 		}
+		exitWithError(err, fmt.Sprintf("Failed to reload the %s config", watcher.Name()))
+	}
 
-		go envoyServer.Run(ctx, envoyServerLooper, grpcListener)
+	if config.Sidecar.HandoffSocket != "" {
+		go serveHandoff(config, state, monitor, proxy)
 	}
 
 	select {}
@@ -0,0 +1,223 @@
+package nginx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/secrets"
+	log "github.com/sirupsen/logrus"
+)
+
+// Configuration and state for the nginx management module. HAproxy can't
+// proxy UDP, so this is used to route UDP services through an nginx stream
+// block instead. With Proxy set, it routes the TCP and HTTP services too, on
+// hosts that run nginx in place of HAproxy.
+type Nginx struct {
+	ReloadCmd        string `toml:"reload_cmd"`
+	VerifyCmd        string `toml:"verify_cmd"`
+	BindIP           string `toml:"bind_ip"`
+	StreamTemplate   string `toml:"stream_template"`
+	StreamConfigFile string `toml:"stream_config_file"`
+	UseHostnames     bool   `toml:"use_hostnames"`
+	// An optional site template whose blocks override those in the StreamTemplate
+	StreamTemplateOverlay string `toml:"stream_template_overlay"`
+	// Route the TCP services through the stream config, and the HTTP services
+	// through the ProxyConfigFile, which goes inside the http {} block
+	Proxy                bool   `toml:"proxy"`
+	ProxyTemplate        string `toml:"proxy_template"`
+	ProxyTemplateOverlay string `toml:"proxy_template_overlay"`
+	ProxyConfigFile      string `toml:"proxy_config_file"`
+	// Where the templates get credentials from with the secret function
+	Secrets      secrets.Provider `toml:"-"`
+	eventChannel chan catalog.ChangeEvent
+}
+
+// Constructs a properly configured Nginx and returns a pointer to it
+func New(streamConfigFile string) *Nginx {
+	return &Nginx{
+		ReloadCmd:        "nginx -s reload",
+		VerifyCmd:        "nginx -t",
+		StreamTemplate:   "views/nginx-stream.conf",
+		StreamConfigFile: streamConfigFile,
+		ProxyTemplate:    "views/nginx-proxy.conf",
+	}
+}
+
+// Execute a command and bubble up the error
+func (n *Nginx) run(command string) error {
+	cmd := exec.Command("/bin/bash", "-c", command)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("Error running '%s': %s\n%s\n%s", command, err, stdout, stderr)
+	}
+
+	return err
+}
+
+// Run the nginx reload command to load the new config
+func (n *Nginx) Reload() error {
+	return n.run(n.ReloadCmd)
+}
+
+// Run nginx with the verify command to check the validity of the current
+// config. Used to gate a Reload() so we don't load a bad config.
+func (n *Nginx) Verify() error {
+	return n.run(n.VerifyCmd)
+}
+
+// Watch the state of a ServicesState struct and generate a new config
+// when the state changes, then verify it and reload nginx.
+func (n *Nginx) Watch(state *catalog.ServicesState) {
+	n.eventChannel = make(chan catalog.ChangeEvent, 2)
+	state.AddListener(n)
+
+	for event := range n.eventChannel {
+		log.Printf("State change event from %s (version %d)", event.Service.Hostname, event.Version)
+		err := n.WriteAndReload(state)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	err := state.RemoveListener(n.Name())
+	if err != nil {
+		log.Warnf("Failed to remove nginx listener: %s", err)
+	}
+}
+
+// Write out the nginx config and reload the service. The configs are all
+// rendered before any file is replaced, and nginx only verifies its whole
+// config, so when that fails the previous files are put back. Either way a
+// render error or a bad config never stays in place for nginx to load.
+func (n *Nginx) WriteAndReload(state *catalog.ServicesState) error {
+	configs := []renderedConfig{{filename: n.StreamConfigFile}}
+	if n.Proxy {
+		configs = append(configs, renderedConfig{filename: n.ProxyConfigFile})
+	}
+
+	writers := []func(*catalog.ServicesState, io.Writer) error{n.WriteStreamConfig, n.WriteProxyConfig}
+	for i := range configs {
+		if err := configs[i].render(state, writers[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := range configs {
+		if err := configs[i].install(); err != nil {
+			restoreConfigs(configs[:i])
+			return err
+		}
+	}
+
+	if err := n.Verify(); err != nil {
+		restoreConfigs(configs)
+		return fmt.Errorf("Failed to verify nginx config! (%s)", err.Error())
+	}
+
+	return n.Reload()
+}
+
+// A renderedConfig is one of the config files, with the new config for it
+// and the one it replaced
+type renderedConfig struct {
+	filename string
+	config   []byte
+	previous []byte // Nil when there was no file
+}
+
+// render renders the config into memory
+func (c *renderedConfig) render(state *catalog.ServicesState,
+	write func(*catalog.ServicesState, io.Writer) error) error {
+
+	if c.filename == "" {
+		return fmt.Errorf("Trying to write nginx config, but no filename specified!")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 4096))
+	if err := write(state, buf); err != nil {
+		return err
+	}
+	c.config = buf.Bytes()
+
+	return nil
+}
+
+// install keeps the current file, and replaces it with the rendered config
+func (c *renderedConfig) install() error {
+	previous, err := ioutil.ReadFile(c.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to read %s! (%s)", c.filename, err.Error())
+	}
+	c.previous = previous
+
+	return replaceFile(c.filename, c.config)
+}
+
+// restoreConfigs puts back the files the configs replaced
+func restoreConfigs(configs []renderedConfig) {
+	for _, c := range configs {
+		var err error
+		if c.previous == nil {
+			err = os.Remove(c.filename)
+		} else {
+			err = replaceFile(c.filename, c.previous)
+		}
+		if err != nil {
+			log.Errorf("Unable to restore the previous nginx config %s: %s", c.filename, err)
+		}
+	}
+}
+
+// replaceFile writes a temp file next to the file and renames it into
+// place, so nginx never sees a partial config
+func replaceFile(filename string, contents []byte) error {
+	tmpfile, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename)+".")
+	if err != nil {
+		return fmt.Errorf("Unable to write to %s! (%s)", filename, err.Error())
+	}
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.Write(contents)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpfile.Name(), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write to %s! (%s)", tmpfile.Name(), err.Error())
+	}
+
+	if err := os.Rename(tmpfile.Name(), filename); err != nil {
+		return fmt.Errorf("Unable to write to %s! (%s)", filename, err.Error())
+	}
+
+	return nil
+}
+
+// Name is part of the catalog.Listener and catalog.Proxy interfaces. Returns the listener name.
+func (n *Nginx) Name() string {
+	return "nginx"
+}
+
+// Managed is part of the catalog.Listener interface. We never want nginx
+// to be auto-added or removed.
+func (n *Nginx) Managed() bool {
+	return false
+}
+
+// Chan is part of the catalog.Listener interface. Returns the channel we listen on.
+func (n *Nginx) Chan() chan catalog.ChangeEvent {
+	return n.eventChannel
+}
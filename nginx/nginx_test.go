@@ -0,0 +1,91 @@
+package nginx
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/NinesStack/sidecar/catalog"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Nginx(t *testing.T) {
+	Convey("Managing nginx", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := makeState()
+		proxy := New("tmpConfig")
+		proxy.StreamTemplate = "../views/nginx-stream.conf"
+
+		Convey("New() returns a properly configured struct", func() {
+			So(proxy.ReloadCmd, ShouldEqual, "nginx -s reload")
+			So(proxy.VerifyCmd, ShouldEqual, "nginx -t")
+			So(proxy.StreamConfigFile, ShouldEqual, "tmpConfig")
+			So(proxy, ShouldImplement, (*catalog.Proxy)(nil))
+		})
+
+		Convey("Reload() returns an error when it fails", func() {
+			proxy.ReloadCmd = "sh -c 'exit 1'"
+			So(proxy.Reload().Error(), ShouldContainSubstring, "exit status 1")
+
+			proxy.ReloadCmd = "sh -c 'exit 0'"
+			So(proxy.Reload(), ShouldBeNil)
+		})
+
+		Convey("WriteAndReload()", func() {
+			tmpfile, _ := ioutil.TempFile("", "WriteAndReload")
+			proxy.StreamConfigFile = tmpfile.Name()
+			defer os.Remove(tmpfile.Name())
+
+			Convey("writes the config, verifies, and reloads", func() {
+				proxy.VerifyCmd = "true"
+				proxy.ReloadCmd = "true"
+
+				So(proxy.WriteAndReload(state), ShouldBeNil)
+
+				result, _ := ioutil.ReadFile(tmpfile.Name())
+				So(string(result), ShouldContainSubstring, "upstream dns-svc-53-udp")
+			})
+
+			Convey("doesn't reload when verification fails", func() {
+				proxy.VerifyCmd = "false"
+				proxy.ReloadCmd = "touch " + tmpfile.Name() + ".reloaded"
+				defer os.Remove(tmpfile.Name() + ".reloaded")
+
+				ioutil.WriteFile(tmpfile.Name(), []byte("# previous config\n"), 0644)
+
+				So(proxy.WriteAndReload(state), ShouldNotBeNil)
+
+				_, err := os.Stat(tmpfile.Name() + ".reloaded")
+				So(os.IsNotExist(err), ShouldBeTrue)
+
+				Convey("and puts the previous config back", func() {
+					result, _ := ioutil.ReadFile(tmpfile.Name())
+					So(string(result), ShouldEqual, "# previous config\n")
+				})
+			})
+
+			Convey("leaves the config alone when it can't be rendered", func() {
+				proxy.VerifyCmd = "true"
+				proxy.ReloadCmd = "true"
+				proxy.Proxy = true
+				proxy.ProxyConfigFile = tmpfile.Name() + ".proxy"
+				proxy.ProxyTemplate = "../views/does-not-exist.conf"
+				ioutil.WriteFile(tmpfile.Name(), []byte("# previous config\n"), 0644)
+
+				So(proxy.WriteAndReload(state), ShouldNotBeNil)
+
+				result, _ := ioutil.ReadFile(tmpfile.Name())
+				So(string(result), ShouldEqual, "# previous config\n")
+				_, err := os.Stat(proxy.ProxyConfigFile)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("WriteAndReload() requires a config file", func() {
+			proxy.StreamConfigFile = ""
+			So(proxy.WriteAndReload(state), ShouldNotBeNil)
+		})
+	})
+}
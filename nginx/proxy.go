@@ -0,0 +1,90 @@
+package nginx
+
+import (
+	"io"
+	"text/template"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/secrets"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/templating"
+)
+
+// ProxyTemplateFuncs is the contract for the functions available to the
+// proxy template and overlays. Add new functions with the next minor version.
+var ProxyTemplateFuncs = &templating.Contract{
+	Version: templating.Version{Major: 1, Minor: 0},
+	Funcs: map[string]templating.Func{
+		"now":          {Since: templating.Version{Major: 1, Minor: 0}},
+		"bindIP":       {Since: templating.Version{Major: 1, Minor: 0}},
+		"sanitizeName": {Since: templating.Version{Major: 1, Minor: 0}},
+		"serviceFor":   {Since: templating.Version{Major: 1, Minor: 0}},
+		"secret":       {Since: templating.Version{Major: 1, Minor: 0}},
+	},
+}
+
+// tcpBackends returns the backends of the services in tcp mode, which are
+// proxied by the stream config
+func (n *Nginx) tcpBackends(state *catalog.ServicesState) map[string]map[string][]Backend {
+	return n.backends(state, func(svc *service.Service, port *service.Port) bool {
+		return port.Type == "tcp" && svc.ProxyMode == "tcp"
+	})
+}
+
+// httpBackends returns the backends of the services in http and ws mode,
+// which are proxied by the proxy config
+func (n *Nginx) httpBackends(state *catalog.ServicesState) map[string]map[string][]Backend {
+	return n.backends(state, func(svc *service.Service, port *service.Port) bool {
+		return port.Type == "tcp" && svc.ProxyMode != "tcp"
+	})
+}
+
+// getModes returns the ProxyMode of each service, taken from the most
+// recently updated instance
+func getModes(state *catalog.ServicesState) map[string]string {
+	modes := make(map[string]string)
+	updated := make(map[string]time.Time)
+	state.EachService(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			if svc.Updated.Before(updated[svc.Name]) {
+				return
+			}
+			modes[svc.Name] = svc.ProxyMode
+			updated[svc.Name] = svc.Updated
+		},
+	)
+	return modes
+}
+
+// WriteProxyConfig renders the nginx config for the HTTP services in the
+// supplied ServicesState and writes it to the output. Websocket services get
+// the headers to upgrade the connection. The result is meant to be included
+// inside the http {} block of the main nginx config.
+func (n *Nginx) WriteProxyConfig(state *catalog.ServicesState, output io.Writer) error {
+	state.RLock()
+	services := n.httpBackends(state)
+	modes := getModes(state)
+	version := state.Version()
+	state.RUnlock()
+
+	data := struct {
+		Services map[string]map[string][]Backend
+		Version  uint64
+	}{
+		Services: services,
+		Version:  version,
+	}
+
+	funcMap := template.FuncMap{
+		"now":          time.Now().UTC,
+		"bindIP":       func() string { return n.BindIP },
+		"sanitizeName": sanitizeName,
+		"secret":       secrets.TemplateFunc(n.Secrets),
+		"serviceFor": func(svcName string, svcPort string, backends []Backend) *templateService {
+			return &templateService{Name: svcName, Port: svcPort, Mode: modes[svcName], Backends: backends}
+		},
+	}
+
+	return renderTemplate(n.ProxyTemplate, n.ProxyTemplateOverlay, ProxyTemplateFuncs, funcMap, data, output)
+}
@@ -0,0 +1,115 @@
+package nginx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ProxyConfig(t *testing.T) {
+	Convey("Generating nginx proxy config", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := makeState()
+		baseTime := time.Now().UTC().Round(time.Second)
+		state.AddServiceEntry(service.Service{
+			ID:        "deadbeef321",
+			Name:      "db-svc",
+			Hostname:  hostname1,
+			Updated:   baseTime,
+			ProxyMode: "tcp",
+			Ports: []service.Port{
+				{Type: "tcp", Port: 35432, ServicePort: 5432, IP: "127.0.0.1"},
+			},
+		})
+		state.AddServiceEntry(service.Service{
+			ID:        "deadbeef654",
+			Name:      "chat-svc",
+			Hostname:  hostname1,
+			Updated:   baseTime,
+			ProxyMode: "ws",
+			Ports: []service.Port{
+				{Type: "tcp", Port: 38000, ServicePort: 8000, IP: "127.0.0.1"},
+				{Type: "tcp", Port: 38001, ServicePort: 8001, IP: "127.0.0.1", Name: "admin", Status: service.UNHEALTHY},
+			},
+		})
+
+		proxy := New("tmpConfig")
+		proxy.BindIP = "192.168.168.168"
+		proxy.StreamTemplate = "../views/nginx-stream.conf"
+		proxy.ProxyTemplate = "../views/nginx-proxy.conf"
+		proxy.Proxy = true
+
+		Convey("tcpBackends() only returns the services in tcp mode", func() {
+			result := proxy.tcpBackends(state)
+
+			So(len(result), ShouldEqual, 1)
+			So(result["db-svc"]["5432"][0].Port, ShouldEqual, 35432)
+		})
+
+		Convey("httpBackends() returns the rest, leaving out failing ports", func() {
+			result := proxy.httpBackends(state)
+
+			So(len(result), ShouldEqual, 3)
+			So(result["web-svc"]["80"][0].Port, ShouldEqual, 31080)
+			So(result["chat-svc"]["8000"][0].Port, ShouldEqual, 38000)
+			So(result["chat-svc"]["8001"], ShouldBeEmpty)
+		})
+
+		Convey("WriteProxyConfig() renders upstreams and servers", func() {
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteProxyConfig(state, buf), ShouldBeNil)
+
+			output := buf.String()
+			So(output, ShouldContainSubstring, "upstream web-svc-80 {\n\tserver 127.0.0.2:31080; # indefatigable-deadbeef789\n}")
+			So(output, ShouldContainSubstring, "listen 192.168.168.168:80;")
+			So(output, ShouldContainSubstring, "proxy_pass http://web-svc-80;")
+			So(output, ShouldContainSubstring, "proxy_pass http://chat-svc-8000;")
+			So(output, ShouldContainSubstring, "proxy_set_header Upgrade $http_upgrade;")
+			So(output, ShouldNotContainSubstring, "38001")
+			So(output, ShouldNotContainSubstring, "db-svc")
+			So(output, ShouldNotContainSubstring, "dns-svc-53")
+		})
+
+		Convey("WriteStreamConfig() adds the tcp services", func() {
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteStreamConfig(state, buf), ShouldBeNil)
+
+			output := buf.String()
+			So(output, ShouldContainSubstring, "upstream db-svc-5432-tcp {")
+			So(output, ShouldContainSubstring, "listen 192.168.168.168:5432;")
+			So(output, ShouldContainSubstring, "upstream dns-svc-53-udp {")
+			So(output, ShouldNotContainSubstring, "web-svc")
+
+			proxy.Proxy = false
+			buf.Reset()
+			So(proxy.WriteStreamConfig(state, buf), ShouldBeNil)
+			So(buf.String(), ShouldNotContainSubstring, "db-svc")
+		})
+
+		Convey("WriteAndReload() writes both configs", func() {
+			streamFile, _ := ioutil.TempFile("", "nginx-stream")
+			proxyFile, _ := ioutil.TempFile("", "nginx-proxy")
+			defer os.Remove(streamFile.Name())
+			defer os.Remove(proxyFile.Name())
+
+			proxy.StreamConfigFile = streamFile.Name()
+			proxy.ProxyConfigFile = proxyFile.Name()
+			proxy.VerifyCmd = "true"
+			proxy.ReloadCmd = "true"
+
+			So(proxy.WriteAndReload(state), ShouldBeNil)
+
+			streamConfig, _ := ioutil.ReadFile(streamFile.Name())
+			proxyConfig, _ := ioutil.ReadFile(proxyFile.Name())
+			So(string(streamConfig), ShouldContainSubstring, "upstream db-svc-5432-tcp")
+			So(string(proxyConfig), ShouldContainSubstring, "upstream web-svc-80")
+		})
+	})
+}
@@ -0,0 +1,171 @@
+package nginx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/secrets"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/templating"
+)
+
+// A Backend is one server entry in an nginx upstream block
+type Backend struct {
+	ID       string
+	Hostname string
+	Address  string
+	Port     int64
+}
+
+// A templateService is passed to the per-service blocks in the template
+type templateService struct {
+	Name     string
+	Port     string
+	Mode     string // The ProxyMode, for the services in the proxy template
+	Backends []Backend
+}
+
+// StreamTemplateFuncs is the contract for the functions available to the
+// stream template and overlays. Add new functions with the next minor version.
+var StreamTemplateFuncs = &templating.Contract{
+	Version: templating.Version{Major: 1, Minor: 1},
+	Funcs: map[string]templating.Func{
+		"now":          {Since: templating.Version{Major: 1, Minor: 0}},
+		"bindIP":       {Since: templating.Version{Major: 1, Minor: 0}},
+		"sanitizeName": {Since: templating.Version{Major: 1, Minor: 0}},
+		"serviceFor":   {Since: templating.Version{Major: 1, Minor: 0}},
+		"secret":       {Since: templating.Version{Major: 1, Minor: 1}},
+	},
+}
+
+// renderTemplate renders a template, and its overlay, to the output
+func renderTemplate(file string, overlayFile string, contract *templating.Contract,
+	funcMap template.FuncMap, data interface{}, output io.Writer) error {
+
+	t, err := templating.ParseWithOverlay(file, overlayFile, contract, funcMap)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 16384))
+	err = t.ExecuteTemplate(buf, path.Base(file), data)
+	if err != nil {
+		return fmt.Errorf("Error executing template '%s': %s", file, err.Error())
+	}
+
+	_, err = io.Copy(output, buf)
+	if err != nil {
+		return fmt.Errorf("Error writing template '%s': %s", file, err.Error())
+	}
+
+	return nil
+}
+
+// Clean up service names for use as nginx upstream names
+func sanitizeName(image string) string {
+	replace := regexp.MustCompile("[^a-z0-9-]")
+	return replace.ReplaceAllString(image, "-")
+}
+
+// udpBackends returns a map of service name -> ServicePort -> backends for all
+// the alive services that export UDP ports.
+func (n *Nginx) udpBackends(state *catalog.ServicesState) map[string]map[string][]Backend {
+	return n.backends(state, func(svc *service.Service, port *service.Port) bool {
+		return port.Type == "udp"
+	})
+}
+
+// backends returns a map of service name -> ServicePort -> backends for the
+// ports of the alive services that match. Ports without a ServicePort aren't
+// exported, and the ones failing their own health check are left out.
+func (n *Nginx) backends(state *catalog.ServicesState,
+	match func(*service.Service, *service.Port) bool) map[string]map[string][]Backend {
+
+	result := make(map[string]map[string][]Backend)
+
+	state.EachServiceSorted(
+		func(hostname *string, serviceId *string, svc *service.Service) {
+			if !svc.IsAlive() {
+				return
+			}
+
+			for i := range svc.Ports {
+				port := &svc.Ports[i]
+				if port.ServicePort == 0 || !match(svc, port) || !svc.PortAlive(port.ServicePort) {
+					continue
+				}
+
+				address := port.IP
+				if n.UseHostnames || address == "" {
+					address = svc.Hostname
+				}
+
+				if _, ok := result[svc.Name]; !ok {
+					result[svc.Name] = make(map[string][]Backend)
+				}
+
+				svcPort := strconv.FormatInt(port.ServicePort, 10)
+				result[svc.Name][svcPort] = append(result[svc.Name][svcPort], Backend{
+					ID:       svc.ID,
+					Hostname: svc.Hostname,
+					Address:  address,
+					Port:     port.Port,
+				})
+			}
+		},
+	)
+
+	// Keep the output stable between runs
+	for _, ports := range result {
+		for _, backends := range ports {
+			sort.Slice(backends, func(i, j int) bool { return backends[i].ID < backends[j].ID })
+		}
+	}
+
+	return result
+}
+
+// WriteStreamConfig renders the nginx stream config for all UDP services in
+// the supplied ServicesState and writes it to the output. When nginx is the
+// Proxy, the TCP services are in it too. The result is meant to be included
+// inside the stream {} block of the main nginx config.
+func (n *Nginx) WriteStreamConfig(state *catalog.ServicesState, output io.Writer) error {
+	state.RLock()
+	services := n.udpBackends(state)
+	var tcpServices map[string]map[string][]Backend
+	if n.Proxy {
+		tcpServices = n.tcpBackends(state)
+	}
+	version := state.Version()
+	state.RUnlock()
+
+	data := struct {
+		Services    map[string]map[string][]Backend
+		TCPServices map[string]map[string][]Backend
+		Version     uint64
+	}{
+		Services:    services,
+		TCPServices: tcpServices,
+		Version:     version,
+	}
+
+	funcMap := template.FuncMap{
+		"now":          time.Now().UTC,
+		"bindIP":       func() string { return n.BindIP },
+		"sanitizeName": sanitizeName,
+		"secret":       secrets.TemplateFunc(n.Secrets),
+		"serviceFor": func(svcName string, svcPort string, backends []Backend) *templateService {
+			return &templateService{Name: svcName, Port: svcPort, Backends: backends}
+		},
+	}
+
+	return renderTemplate(n.StreamTemplate, n.StreamTemplateOverlay, StreamTemplateFuncs, funcMap, data, output)
+}
@@ -0,0 +1,139 @@
+package nginx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var hostname1 = "indomitable"
+var hostname2 = "indefatigable"
+
+func makeState() *catalog.ServicesState {
+	state := catalog.NewServicesState()
+	state.Hostname = hostname1
+	baseTime := time.Now().UTC().Round(time.Second)
+
+	services := []service.Service{
+		{
+			ID:       "deadbeef123",
+			Name:     "dns-svc",
+			Hostname: hostname1,
+			Updated:  baseTime,
+			Ports: []service.Port{
+				{Type: "udp", Port: 32053, ServicePort: 53, IP: "127.0.0.1"},
+				{Type: "tcp", Port: 32054, ServicePort: 8053, IP: "127.0.0.1"},
+			},
+		},
+		{
+			ID:       "deadbeef456",
+			Name:     "dns-svc",
+			Hostname: hostname2,
+			Updated:  baseTime,
+			Ports: []service.Port{
+				{Type: "udp", Port: 31053, ServicePort: 53, IP: "127.0.0.2"},
+			},
+		},
+		{
+			ID:       "deadbeef789",
+			Name:     "web-svc",
+			Hostname: hostname2,
+			Updated:  baseTime,
+			Ports: []service.Port{
+				{Type: "tcp", Port: 31080, ServicePort: 80, IP: "127.0.0.2"},
+			},
+		},
+		{
+			ID:       "deadbeef000",
+			Name:     "dns-svc",
+			Hostname: "titanic",
+			Updated:  baseTime,
+			Status:   service.UNHEALTHY,
+			Ports: []service.Port{
+				{Type: "udp", Port: 30053, ServicePort: 53, IP: "127.0.0.3"},
+			},
+		},
+	}
+
+	for _, svc := range services {
+		state.AddServiceEntry(svc)
+	}
+
+	return state
+}
+
+func Test_StreamConfig(t *testing.T) {
+	Convey("Generating nginx stream config", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		state := makeState()
+		proxy := New("tmpConfig")
+		proxy.BindIP = "192.168.168.168"
+		proxy.StreamTemplate = "../views/nginx-stream.conf"
+
+		Convey("udpBackends() only returns alive UDP services", func() {
+			result := proxy.udpBackends(state)
+
+			So(len(result), ShouldEqual, 1)
+			So(len(result["dns-svc"]), ShouldEqual, 1)
+			So(len(result["dns-svc"]["53"]), ShouldEqual, 2)
+			So(result["dns-svc"]["53"][0].Address, ShouldEqual, "127.0.0.1")
+			So(result["dns-svc"]["53"][0].Port, ShouldEqual, 32053)
+		})
+
+		Convey("udpBackends() uses hostnames when configured", func() {
+			proxy.UseHostnames = true
+			result := proxy.udpBackends(state)
+
+			So(result["dns-svc"]["53"][0].Address, ShouldEqual, hostname1)
+		})
+
+		Convey("WriteStreamConfig() renders upstreams and servers", func() {
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			err := proxy.WriteStreamConfig(state, buf)
+			output := buf.String()
+
+			So(err, ShouldBeNil)
+			So(output, ShouldContainSubstring, "upstream dns-svc-53-udp {")
+			So(output, ShouldContainSubstring, "server 127.0.0.1:32053;")
+			So(output, ShouldContainSubstring, "server 127.0.0.2:31053;")
+			So(output, ShouldContainSubstring, "listen 192.168.168.168:53 udp;")
+			So(output, ShouldNotContainSubstring, "127.0.0.3")
+			So(output, ShouldNotContainSubstring, "web-svc")
+		})
+
+		Convey("WriteStreamConfig() applies the blocks from a template overlay", func() {
+			overlay, _ := ioutil.TempFile("", "nginx-stream.conf")
+			defer os.Remove(overlay.Name())
+			overlay.WriteString(`{{ define "server" }}server {
+	listen {{ bindIP }}:{{ .Port }} udp reuseport;
+	proxy_pass {{ sanitizeName .Name }}-{{ .Port }}-udp;
+}
+{{ end }}`)
+			overlay.Close()
+
+			proxy.StreamTemplateOverlay = overlay.Name()
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+			So(proxy.WriteStreamConfig(state, buf), ShouldBeNil)
+
+			output := buf.String()
+			So(output, ShouldContainSubstring, "listen 192.168.168.168:53 udp reuseport;")
+			So(output, ShouldNotContainSubstring, "proxy_timeout")
+			So(output, ShouldContainSubstring, "server 127.0.0.2:31053;")
+		})
+
+		Convey("WriteStreamConfig() bubbles up template errors", func() {
+			proxy.StreamTemplate = "/"
+			buf := bytes.NewBuffer(make([]byte, 0, 2048))
+
+			So(proxy.WriteStreamConfig(state, buf), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleReannounceSignals calls reannounce every time we get a SIGUSR1. This
+// lets an operator force an immediate re-check and re-announce of all the
+// local services, e.g. after fixing a network issue.
+func handleReannounceSignals(reannounce func()) {
+	sigChannel := make(chan os.Signal, 1)
+	signal.Notify(sigChannel, syscall.SIGUSR1)
+
+	for sig := range sigChannel {
+		log.Infof("Captured %v, re-running checks and re-announcing services", sig)
+		reannounce()
+	}
+}
@@ -0,0 +1,101 @@
+// Package recovery keeps a panic in one of Sidecar's background goroutines
+// from taking the whole process down with it. The panic is logged with its
+// stack trace and counted in the metrics, and the loop it happened in starts
+// over after a backoff.
+package recovery
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/armon/go-metrics"
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMinBackoff = 1 * time.Second // How long a loop waits after its first panic
+	DefaultMaxBackoff = 1 * time.Minute // The longest it waits after panicking again and again
+)
+
+// A PanicError is what Run returns when the function it ran panicked
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Recovered from panic: %v", e.Value)
+}
+
+// Run calls fn, recovering from any panic in it. The panic is logged and
+// counted under the name passed in, and returned as a *PanicError.
+func Run(name string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			log.Errorf("Recovered from panic in %s: %v\n%s", name, r, stack)
+			metrics.IncrCounter([]string{"recovery", name, "panics"}, 1)
+			err = &PanicError{Value: r, Stack: stack}
+		}
+	}()
+
+	return fn()
+}
+
+// A Looper wraps a director.Looper, recovering from panics in the function
+// it loops on. After a panic the loop waits, then carries on with the next
+// iteration. The wait starts at MinBackoff and doubles each time the loop
+// panics in a row, up to MaxBackoff.
+type Looper struct {
+	director.Looper
+	Name       string
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Clock      clock.Clock
+}
+
+// NewLooper returns a Looper that recovers from panics in the loop it wraps
+func NewLooper(name string, looper director.Looper) *Looper {
+	return &Looper{
+		Looper:     looper,
+		Name:       name,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		Clock:      clock.Real{},
+	}
+}
+
+// Loop runs fn on the wrapped Looper, recovering from panics
+func (l *Looper) Loop(fn func() error) {
+	var backoff time.Duration
+
+	l.Looper.Loop(func() error {
+		err := Run(l.Name, fn)
+		if _, ok := err.(*PanicError); !ok {
+			backoff = 0
+			return err
+		}
+
+		backoff = l.nextBackoff(backoff)
+		log.Warnf("Restarting the %s loop in %s", l.Name, backoff)
+		<-clock.OrReal(l.Clock).After(backoff)
+
+		return nil
+	})
+}
+
+// nextBackoff doubles the backoff, keeping it between the min and the max
+func (l *Looper) nextBackoff(backoff time.Duration) time.Duration {
+	backoff = backoff * 2
+	if backoff < l.MinBackoff {
+		backoff = l.MinBackoff
+	}
+	if l.MaxBackoff > 0 && backoff > l.MaxBackoff {
+		backoff = l.MaxBackoff
+	}
+
+	return backoff
+}
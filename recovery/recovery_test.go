@@ -0,0 +1,73 @@
+package recovery
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/relistan/go-director"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Run(t *testing.T) {
+	Convey("Run()", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		Convey("returns what the function returns", func() {
+			So(Run("testing", func() error { return nil }), ShouldBeNil)
+			So(Run("testing", func() error { return errors.New("oh no") }).Error(), ShouldEqual, "oh no")
+		})
+
+		Convey("turns a panic into a PanicError", func() {
+			err := Run("testing", func() error { panic("oh no") })
+
+			panicErr, ok := err.(*PanicError)
+			So(ok, ShouldBeTrue)
+			So(panicErr.Value, ShouldEqual, "oh no")
+			So(string(panicErr.Stack), ShouldContainSubstring, "recovery_test.go")
+		})
+	})
+}
+
+func Test_Looper(t *testing.T) {
+	Convey("The Looper", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		looper := NewLooper("testing", director.NewFreeLooper(4, make(chan error)))
+		looper.MinBackoff = time.Millisecond
+		looper.MaxBackoff = 2 * time.Millisecond
+
+		Convey("carries on looping after a panic", func() {
+			runs := 0
+			go looper.Loop(func() error {
+				runs++
+				if runs < 3 {
+					panic("oh no")
+				}
+				return nil
+			})
+
+			So(looper.Wait(), ShouldBeNil)
+			So(runs, ShouldEqual, 4)
+		})
+
+		Convey("still stops on an error", func() {
+			runs := 0
+			go looper.Loop(func() error {
+				runs++
+				return errors.New("oh no")
+			})
+
+			So(looper.Wait(), ShouldNotBeNil)
+			So(runs, ShouldEqual, 1)
+		})
+
+		Convey("doubles the backoff up to the max", func() {
+			So(looper.nextBackoff(0), ShouldEqual, time.Millisecond)
+			So(looper.nextBackoff(time.Millisecond), ShouldEqual, 2*time.Millisecond)
+			So(looper.nextBackoff(2*time.Millisecond), ShouldEqual, 2*time.Millisecond)
+		})
+	})
+}
@@ -0,0 +1,206 @@
+// The secrets package supplies credentials to the proxy templates when they
+// are rendered, so they don't have to sit in plaintext in Sidecar's config.
+// They come either from a file encrypted with a key that is kept elsewhere,
+// or from an external command, e.g. one that talks to a secret store.
+package secrets
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Provider looks up a secret by name
+type Provider interface {
+	Secret(name string) (string, error)
+}
+
+// A FileProvider reads secrets from a JSON object of names to values that
+// was encrypted with Encrypt. The file is decrypted again whenever it
+// changes.
+type FileProvider struct {
+	File    string
+	KeyFile string
+
+	secrets map[string]string
+	modTime time.Time
+	sync.Mutex
+}
+
+func NewFileProvider(file string, keyFile string) *FileProvider {
+	return &FileProvider{File: file, KeyFile: keyFile}
+}
+
+// Secret returns the named secret from the file
+func (f *FileProvider) Secret(name string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.load(); err != nil {
+		return "", err
+	}
+
+	value, ok := f.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("Error looking up secret '%s': not found in %s", name, f.File)
+	}
+
+	return value, nil
+}
+
+// load decrypts the file if it has changed since we last read it. Must be
+// called while holding the lock.
+func (f *FileProvider) load() error {
+	info, err := os.Stat(f.File)
+	if err != nil {
+		return fmt.Errorf("Error reading secrets file: %s", err)
+	}
+
+	if f.secrets != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	key, err := ReadKey(f.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := ioutil.ReadFile(f.File)
+	if err != nil {
+		return fmt.Errorf("Error reading secrets file: %s", err)
+	}
+
+	plaintext, err := Decrypt(ciphertext, key)
+	if err != nil {
+		return fmt.Errorf("Error decrypting %s: %s", f.File, err)
+	}
+
+	var secrets map[string]string
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return fmt.Errorf("Error decoding secrets from %s: %s", f.File, err)
+	}
+
+	f.secrets = secrets
+	f.modTime = info.ModTime()
+
+	return nil
+}
+
+// A CommandProvider runs an external command with the name of the secret
+// as its last argument, and uses whatever it prints as the value. Trailing
+// newlines are dropped.
+type CommandProvider struct {
+	Command string
+	Timeout time.Duration
+}
+
+func NewCommandProvider(command string) *CommandProvider {
+	return &CommandProvider{Command: command, Timeout: 10 * time.Second}
+}
+
+// Secret runs the command to fetch the named secret
+func (c *CommandProvider) Secret(name string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("/bin/bash", "-c", c.Command+` "$0"`, name)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("Error running secrets command: %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", fmt.Errorf("Error fetching secret '%s': %s (%s)",
+				name, err, strings.TrimSpace(stderr.String()))
+		}
+	case <-time.After(c.Timeout):
+		cmd.Process.Kill()
+		return "", fmt.Errorf("Error fetching secret '%s': timed out after %s", name, c.Timeout)
+	}
+
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+// ReadKey reads a 256-bit key, written as hex, from a file
+func ReadKey(keyFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading secrets key: %s", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Error reading secrets key from %s: expected 64 hex characters", keyFile)
+	}
+
+	return key, nil
+}
+
+// Encrypt seals the plaintext with AES-256-GCM. The random nonce is stored
+// in front of the ciphertext.
+func Encrypt(plaintext []byte, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Error generating nonce: %s", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens ciphertext sealed with Encrypt
+func Decrypt(ciphertext []byte, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating cipher: %s", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// TemplateFunc returns a function for looking up secrets from templates.
+// It fails the render if there is no provider, rather than leaving a blank
+// where the credential should be.
+func TemplateFunc(provider Provider) func(name string) (string, error) {
+	return func(name string) (string, error) {
+		if provider == nil {
+			return "", fmt.Errorf("Error looking up secret '%s': no secrets provider is configured", name)
+		}
+		return provider.Secret(name)
+	}
+}
@@ -0,0 +1,110 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func Test_FileProvider(t *testing.T) {
+	Convey("FileProvider", t, func() {
+		dir, err := ioutil.TempDir("", "secrets")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		keyFile := filepath.Join(dir, "key")
+		So(ioutil.WriteFile(keyFile, []byte(testKey+"\n"), 0600), ShouldBeNil)
+		key, err := ReadKey(keyFile)
+		So(err, ShouldBeNil)
+
+		writeSecrets := func(plaintext string) {
+			ciphertext, err := Encrypt([]byte(plaintext), key)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, "secrets"), ciphertext, 0600), ShouldBeNil)
+		}
+
+		provider := NewFileProvider(filepath.Join(dir, "secrets"), keyFile)
+
+		Convey("looks up secrets from the encrypted file", func() {
+			writeSecrets(`{"stats_password": "hunter2"}`)
+
+			value, err := provider.Secret("stats_password")
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "hunter2")
+
+			_, err = provider.Secret("missing")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("picks up changes to the file", func() {
+			writeSecrets(`{"stats_password": "hunter2"}`)
+			provider.Secret("stats_password")
+
+			writeSecrets(`{"stats_password": "correct horse"}`)
+			later := time.Now().Add(time.Minute)
+			os.Chtimes(provider.File, later, later)
+
+			value, err := provider.Secret("stats_password")
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "correct horse")
+		})
+
+		Convey("fails with the wrong key", func() {
+			writeSecrets(`{"stats_password": "hunter2"}`)
+			So(ioutil.WriteFile(keyFile, []byte(testKey[2:]+"20"), 0600), ShouldBeNil)
+
+			_, err := provider.Secret("stats_password")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("fails with a bad key file", func() {
+			So(ioutil.WriteFile(keyFile, []byte("not hex"), 0600), ShouldBeNil)
+
+			_, err := ReadKey(keyFile)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_CommandProvider(t *testing.T) {
+	Convey("CommandProvider", t, func() {
+		Convey("uses the output of the command", func() {
+			value, err := NewCommandProvider("echo value-of").Secret("stats_password")
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "value-of stats_password")
+		})
+
+		Convey("passes the name as a single argument", func() {
+			value, err := NewCommandProvider("printf '%s'").Secret("has spaces; true")
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "has spaces; true")
+		})
+
+		Convey("returns an error when the command fails", func() {
+			_, err := NewCommandProvider("false").Secret("stats_password")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("times out slow commands", func() {
+			provider := NewCommandProvider("sleep 5; echo")
+			provider.Timeout = 10 * time.Millisecond
+
+			_, err := provider.Secret("stats_password")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "timed out")
+		})
+	})
+}
+
+func Test_TemplateFunc(t *testing.T) {
+	Convey("TemplateFunc fails without a provider", t, func() {
+		_, err := TemplateFunc(nil)("stats_password")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Metadata keys, and Docker labels, that ask for decisions on each
+// request to a service from the SPOE agent
+const (
+	RateLimitKey      = "RateLimit"
+	AllowedSourcesKey = "AllowedSources"
+)
+
+// DecisionKeys are all of the Metadata keys above
+var DecisionKeys = []string{RateLimitKey, AllowedSourcesKey}
+
+// A RateLimit is how many requests each client can make in a period
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// WantsDecisions says whether the service's Metadata asks for decisions on
+// its requests
+func (svc *Service) WantsDecisions() bool {
+	for _, key := range DecisionKeys {
+		if strings.TrimSpace(svc.Metadata[key]) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit returns the rate limit in the service's Metadata, or nil when
+// it has none
+func (svc *Service) RateLimit() (*RateLimit, error) {
+	value := strings.TrimSpace(svc.Metadata[RateLimitKey])
+	if value == "" {
+		return nil, nil
+	}
+	return ParseRateLimit(value)
+}
+
+// ParseRateLimit parses a rate limit in the format "<requests>[/<period>]",
+// where the period is "s", "m", "h", or a duration like "10s". The period
+// defaults to a second.
+func ParseRateLimit(value string) (*RateLimit, error) {
+	fields := strings.SplitN(strings.TrimSpace(value), "/", 2)
+
+	requests, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil || requests < 1 {
+		return nil, fmt.Errorf("Error parsing rate limit '%s': invalid number of requests", value)
+	}
+
+	limit := &RateLimit{Requests: requests, Per: time.Second}
+	if len(fields) < 2 {
+		return limit, nil
+	}
+
+	switch period := strings.TrimSpace(fields[1]); period {
+	case "s":
+	case "m":
+		limit.Per = time.Minute
+	case "h":
+		limit.Per = time.Hour
+	default:
+		limit.Per, err = time.ParseDuration(period)
+		if err != nil || limit.Per <= 0 {
+			return nil, fmt.Errorf("Error parsing rate limit '%s': invalid period", value)
+		}
+	}
+
+	return limit, nil
+}
+
+// AllowedSources returns the valid networks in the service's Metadata that
+// clients are allowed from. None means clients are allowed from anywhere.
+func (svc *Service) AllowedSources() []*net.IPNet {
+	sources, _ := ParseAllowedSources(svc.Metadata[AllowedSourcesKey])
+	return sources
+}
+
+// ParseAllowedSources parses a comma separated list of CIDRs. A plain IP
+// address is taken to mean just that host. Invalid entries are left out and
+// reported in the error.
+func ParseAllowedSources(value string) ([]*net.IPNet, error) {
+	var sources []*net.IPNet
+	var invalid []string
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		cidr, err := normalizeCIDR(entry)
+		if err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+
+		_, network, _ := net.ParseCIDR(cidr)
+		sources = append(sources, network)
+	}
+
+	if len(invalid) > 0 {
+		return sources, fmt.Errorf("Error parsing allowed sources: invalid entries '%s'", strings.Join(invalid, "', '"))
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The Metadata keys, and Docker labels, that hint at how many connections
+// each instance of a service can take
+const (
+	MaxConnKey       = "MaxConn"
+	MemoryPerConnKey = "MemoryPerConn"
+)
+
+// LimitKeys are all of the Metadata keys above
+var LimitKeys = []string{MaxConnKey, MemoryPerConnKey}
+
+// ConnectionLimit works out how many connections at once the proxy should
+// send to this instance. A MaxConn hint is used as it is. Otherwise it's the
+// container's memory limit divided by the memory each connection takes, from
+// the MemoryPerConn hint or the memoryPerConn passed in, and no less than
+// minConn. It returns 0 when there is nothing to work it out from. Invalid
+// hints are left out of the limit and reported in the error.
+func (svc *Service) ConnectionLimit(memoryPerConn uint64, minConn int) (int, error) {
+	var invalid []string
+
+	if value := strings.TrimSpace(svc.Metadata[MaxConnKey]); value != "" {
+		maxConn, err := strconv.Atoi(value)
+		if err == nil && maxConn > 0 {
+			return maxConn, nil
+		}
+		invalid = append(invalid, fmt.Sprintf("%s '%s'", MaxConnKey, value))
+	}
+
+	if value := strings.TrimSpace(svc.Metadata[MemoryPerConnKey]); value != "" {
+		perConn, err := ParseBytes(value)
+		if err == nil && perConn > 0 {
+			memoryPerConn = perConn
+		} else {
+			invalid = append(invalid, fmt.Sprintf("%s '%s'", MemoryPerConnKey, value))
+		}
+	}
+
+	var err error
+	if len(invalid) > 0 {
+		err = fmt.Errorf("Error parsing connection limit hints: %s", strings.Join(invalid, ", "))
+	}
+
+	if svc.Resources == nil || svc.Resources.MemoryLimit == 0 || memoryPerConn == 0 {
+		return 0, err
+	}
+
+	limit := int(svc.Resources.MemoryLimit / memoryPerConn)
+	if limit < minConn {
+		limit = minConn
+	}
+	if limit < 1 {
+		limit = 1
+	}
+
+	return limit, err
+}
+
+// ParseBytes parses a size in bytes, with an optional K, M, or G suffix for
+// KiB, MiB, or GiB, e.g. "512K"
+func ParseBytes(original string) (uint64, error) {
+	value := strings.ToUpper(strings.TrimSpace(original))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	size, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing size '%s': %s", original, err)
+	}
+
+	return size * multiplier, nil
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Metadata keys the health monitor announces a service's HttpGet check
+// under, so the proxies on other hosts can run the same check
+const (
+	ProxyCheckPathKey     = "ProxyCheckPath"
+	ProxyCheckPortKey     = "ProxyCheckPort"
+	ProxyCheckIntervalKey = "ProxyCheckInterval"
+)
+
+// ProxyCheckKeys are all of the Metadata keys above
+var ProxyCheckKeys = []string{ProxyCheckPathKey, ProxyCheckPortKey, ProxyCheckIntervalKey}
+
+// A ProxyCheck is the HTTP check the proxies run against each instance of a
+// service, on the port with this ServicePort
+type ProxyCheck struct {
+	Path        string
+	ServicePort int64
+	Interval    time.Duration
+}
+
+// ProxyCheck returns the check the service's Metadata announces, or nil when
+// it has none
+func (svc *Service) ProxyCheck() (*ProxyCheck, error) {
+	path := strings.TrimSpace(svc.Metadata[ProxyCheckPathKey])
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t\r\n") {
+		return nil, fmt.Errorf("Error parsing proxy check path '%s'", path)
+	}
+
+	port, err := strconv.ParseInt(strings.TrimSpace(svc.Metadata[ProxyCheckPortKey]), 10, 64)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("Error parsing proxy check port '%s'", svc.Metadata[ProxyCheckPortKey])
+	}
+
+	interval, err := time.ParseDuration(strings.TrimSpace(svc.Metadata[ProxyCheckIntervalKey]))
+	if err != nil || interval < time.Millisecond {
+		return nil, fmt.Errorf("Error parsing proxy check interval '%s'", svc.Metadata[ProxyCheckIntervalKey])
+	}
+
+	return &ProxyCheck{Path: path, ServicePort: port, Interval: interval}, nil
+}
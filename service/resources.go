@@ -0,0 +1,14 @@
+package service
+
+import (
+	"time"
+)
+
+// Resources are what a service instance was using of its host when they
+// were last collected from the container runtime
+type Resources struct {
+	CPUPercent  float64 // Of one core, so can be over 100 on a multi-core host
+	MemoryBytes uint64  // Not counting the page cache
+	MemoryLimit uint64  // The container's limit, or the host's memory without one
+	Collected   time.Time
+}
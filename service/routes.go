@@ -0,0 +1,329 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The Metadata keys, and Docker labels, that a service declares its routing
+// with
+const (
+	SourceRoutesKey    = "SourceRoutes"
+	MirrorToKey        = "MirrorTo"
+	MirrorPercentKey   = "MirrorPercent"
+	VirtualHostsKey    = "VirtualHosts"
+	VirtualHostPortKey = "VirtualHostPort"
+	PathPrefixesKey    = "PathPrefixes"
+	SNIHostsKey        = "SNIHosts"
+	SNIPortKey         = "SNIPort"
+	TrafficSplitKey    = "TrafficSplit"
+	BindInterfacesKey  = "BindInterfaces"
+	AllowedCallersKey  = "AllowedCallers"
+)
+
+// RoutingKeys are all of the Metadata keys above
+var RoutingKeys = []string{
+	SourceRoutesKey, MirrorToKey, MirrorPercentKey, VirtualHostsKey, VirtualHostPortKey, PathPrefixesKey,
+	SNIHostsKey, SNIPortKey, TrafficSplitKey, BindInterfacesKey, AllowedCallersKey,
+}
+
+// BindInterfaces returns the names of the proxy's interfaces the service
+// asked to be served on. None means the proxy's default ones.
+func (svc *Service) BindInterfaces() []string {
+	return parseHostnames(svc.Metadata[BindInterfacesKey])
+}
+
+// AllowedCallers returns the names of the services the service only takes
+// connections from. None means it takes them from anywhere.
+func (svc *Service) AllowedCallers() []string {
+	var callers []string
+	for _, name := range strings.Split(svc.Metadata[AllowedCallersKey], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			callers = append(callers, name)
+		}
+	}
+	return callers
+}
+
+// A SourceRoute sends the clients coming from a network to another service,
+// e.g. the office ranges to the staging version of it
+type SourceRoute struct {
+	Source  string // A CIDR
+	Service string
+	Port    int64 // The ServicePort of the other service. 0 means the same port.
+}
+
+// SourceRoutes returns the valid source routes in the service's Metadata
+func (svc *Service) SourceRoutes() []SourceRoute {
+	routes, _ := ParseSourceRoutes(svc.Metadata[SourceRoutesKey])
+	return routes
+}
+
+// ParseSourceRoutes parses a comma separated list of routes in the format
+// "<CIDR>=<service>[:<port>]". A plain IP address is taken to mean just that
+// host. Invalid entries are left out of the routes and reported in the error.
+func ParseSourceRoutes(value string) ([]SourceRoute, error) {
+	var routes []SourceRoute
+	var invalid []string
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fields := strings.SplitN(entry, "=", 2)
+		if len(fields) != 2 {
+			invalid = append(invalid, entry)
+			continue
+		}
+
+		source, err := normalizeCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+
+		name, port, err := parseServicePort(fields[1])
+		if err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+
+		routes = append(routes, SourceRoute{Source: source, Service: name, Port: port})
+	}
+
+	if len(invalid) > 0 {
+		return routes, fmt.Errorf("Error parsing source routes: invalid entries '%s'", strings.Join(invalid, "', '"))
+	}
+
+	return routes, nil
+}
+
+// A Mirror sends a copy of a percentage of the requests to a service on to
+// a shadow service. The responses from the shadow are thrown away.
+type Mirror struct {
+	Service string
+	Port    int64 // The ServicePort of the shadow. 0 means the same port.
+	Percent uint32
+}
+
+// Mirror returns where the service's Metadata says to mirror requests to,
+// or nil if they aren't mirrored. The percentage defaults to 100.
+func (svc *Service) Mirror() (*Mirror, error) {
+	target := svc.Metadata[MirrorToKey]
+	if target == "" {
+		return nil, nil
+	}
+
+	name, port, err := parseServicePort(target)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing mirror target: %s", err)
+	}
+
+	mirror := &Mirror{Service: name, Port: port, Percent: 100}
+
+	if value := strings.TrimSpace(svc.Metadata[MirrorPercentKey]); value != "" {
+		percent, err := strconv.ParseUint(strings.TrimSuffix(value, "%"), 10, 32)
+		if err != nil || percent < 1 || percent > 100 {
+			return nil, fmt.Errorf("Error parsing mirror percentage '%s': must be from 1 to 100", value)
+		}
+		mirror.Percent = uint32(percent)
+	}
+
+	return mirror, nil
+}
+
+// VirtualHosts returns the hostnames in the service's Metadata that the
+// shared HTTP frontend routes to it by, and the ServicePort of the backend
+// they go to. The port is 0 when it isn't given.
+func (svc *Service) VirtualHosts() ([]string, int64, error) {
+	hostnames := parseHostnames(svc.Metadata[VirtualHostsKey])
+
+	value := strings.TrimSpace(svc.Metadata[VirtualHostPortKey])
+	if value == "" {
+		return hostnames, 0, nil
+	}
+
+	port, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || port < 1 || port > 65535 {
+		return hostnames, 0, fmt.Errorf("Error parsing virtual host port '%s'", value)
+	}
+
+	return hostnames, port, nil
+}
+
+// PathPrefixes returns the valid URL path prefixes in the service's Metadata
+// that the shared HTTP frontend routes to it by
+func (svc *Service) PathPrefixes() []string {
+	prefixes, _ := ParsePathPrefixes(svc.Metadata[PathPrefixesKey])
+	return prefixes
+}
+
+// ParsePathPrefixes parses a comma separated list of URL path prefixes, e.g.
+// "/api/v2,/api/v3". Each one matches the path itself and the paths under
+// it, so a trailing slash is dropped. Invalid entries are left out and
+// reported in the error.
+func ParsePathPrefixes(value string) ([]string, error) {
+	var prefixes []string
+	var invalid []string
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(entry, "/") || strings.ContainsAny(entry, " \t\"'{}#?") {
+			invalid = append(invalid, entry)
+			continue
+		}
+
+		if prefix := strings.TrimRight(entry, "/"); prefix != "" {
+			entry = prefix
+		} else {
+			entry = "/"
+		}
+		prefixes = append(prefixes, entry)
+	}
+
+	if len(invalid) > 0 {
+		return prefixes, fmt.Errorf("Error parsing path prefixes: invalid entries '%s'", strings.Join(invalid, "', '"))
+	}
+
+	return prefixes, nil
+}
+
+// SNIHosts returns the hostnames in the service's Metadata that the shared
+// TLS passthrough frontend routes to it by the SNI of, and the ServicePort of
+// the backend they go to. The port is 0 when it isn't given. A hostname may
+// start with "*." to match everything under it. Invalid hostnames are left
+// out and reported in the error.
+func (svc *Service) SNIHosts() ([]string, int64, error) {
+	var hostnames []string
+	var invalid []string
+
+	for _, hostname := range parseHostnames(svc.Metadata[SNIHostsKey]) {
+		name := strings.TrimPrefix(hostname, "*.")
+		if name == "" || strings.ContainsAny(name, " \t\"'{}#*") {
+			invalid = append(invalid, hostname)
+			continue
+		}
+		hostnames = append(hostnames, hostname)
+	}
+
+	var port int64
+	if value := strings.TrimSpace(svc.Metadata[SNIPortKey]); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 || parsed > 65535 {
+			return hostnames, 0, fmt.Errorf("Error parsing SNI port '%s'", value)
+		}
+		port = parsed
+	}
+
+	if len(invalid) > 0 {
+		return hostnames, port, fmt.Errorf("Error parsing SNI hosts: invalid entries '%s'", strings.Join(invalid, "', '"))
+	}
+
+	return hostnames, port, nil
+}
+
+// A VersionShare is the percentage of a service's traffic that goes to the
+// instances of one version of it. The version is the tag of their image.
+type VersionShare struct {
+	Version string
+	Percent int
+}
+
+// TrafficSplit returns how the service's Metadata splits its traffic between
+// its versions, or nil when it isn't split
+func (svc *Service) TrafficSplit() ([]VersionShare, error) {
+	return ParseTrafficSplit(svc.Metadata[TrafficSplitKey])
+}
+
+// ParseTrafficSplit parses a comma separated list of shares in the format
+// "<version>=<percent>", e.g. "v1=95,v2=5". The percentages have to add up
+// to 100. The shares are returned largest first. Since a split with a share
+// left out wouldn't add up, an invalid one is returned as nil.
+func ParseTrafficSplit(value string) ([]VersionShare, error) {
+	var shares []VersionShare
+	var invalid []string
+	seen := make(map[string]bool)
+	total := 0
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fields := strings.SplitN(entry, "=", 2)
+		if len(fields) != 2 {
+			invalid = append(invalid, entry)
+			continue
+		}
+
+		version := strings.TrimSpace(fields[0])
+		percent, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(fields[1]), "%"))
+		if version == "" || seen[version] || err != nil || percent < 0 || percent > 100 {
+			invalid = append(invalid, entry)
+			continue
+		}
+
+		seen[version] = true
+		total += percent
+		shares = append(shares, VersionShare{Version: version, Percent: percent})
+	}
+
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("Error parsing traffic split: invalid entries '%s'", strings.Join(invalid, "', '"))
+	}
+	if len(shares) > 0 && total != 100 {
+		return nil, fmt.Errorf("Error parsing traffic split '%s': the percentages add up to %d, not 100", value, total)
+	}
+
+	sort.SliceStable(shares, func(i, j int) bool { return shares[i].Percent > shares[j].Percent })
+
+	return shares, nil
+}
+
+// parseServicePort parses a "<service>[:<port>]" reference to another
+// service. The port is 0 when it isn't given.
+func parseServicePort(value string) (string, int64, error) {
+	fields := strings.SplitN(strings.TrimSpace(value), ":", 2)
+	name := strings.TrimSpace(fields[0])
+	if name == "" {
+		return "", 0, fmt.Errorf("missing service name in '%s'", value)
+	}
+
+	if len(fields) < 2 {
+		return name, 0, nil
+	}
+
+	port, err := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in '%s'", value)
+	}
+
+	return name, port, nil
+}
+
+// normalizeCIDR turns an IP address or CIDR into a CIDR
+func normalizeCIDR(source string) (string, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+
+	_, network, err := net.ParseCIDR(source)
+	if err != nil {
+		return "", err
+	}
+
+	return network.String(), nil
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/NinesStack/sidecar/output"
+	"github.com/NinesStack/sidecar/wire"
 	docker "github.com/fsouza/go-dockerclient"
 	log "github.com/sirupsen/logrus"
 )
@@ -22,29 +23,54 @@ const (
 	DRAINING  = iota
 )
 
+// The address families a service can restrict its proxy frontends to. Empty
+// means both.
+const (
+	IPFamilyV4 = "ipv4"
+	IPFamilyV6 = "ipv6"
+)
+
+// The highest Weight an instance can have, which is the highest HAproxy takes
+const MaxWeight = 256
+
 type Port struct {
 	Type        string
 	Port        int64
 	ServicePort int64
 	IP          string
+	Name        string `json:",omitempty" codec:",omitempty"` // What the port is for, e.g. "admin"
+	Status      int    `json:",omitempty" codec:",omitempty"` // From the port's own health check, if it has one
 }
 
 type Service struct {
-	ID        string
-	Name      string
-	Image     string
-	Created   time.Time
-	Hostname  string
-	Ports     []Port
-	Updated   time.Time
-	ProxyMode string
-	Status    int
+	ID              string
+	Name            string
+	Image           string
+	Created         time.Time
+	Hostname        string
+	Ports           []Port
+	Updated         time.Time
+	ProxyMode       string
+	IPFamily        string            `json:",omitempty" codec:",omitempty"`
+	TLSCert         string            `json:",omitempty" codec:",omitempty"` // Certificate the proxy terminates TLS with
+	PublicHostnames []string          `json:",omitempty" codec:",omitempty"` // Names the service is reached by from outside
+	Metadata        map[string]string `json:",omitempty" codec:",omitempty"`
+	Reporter        string            `json:",omitempty" codec:",omitempty"` // Set when announced on behalf of another host
+	Resources       *Resources        `json:",omitempty" codec:",omitempty"` // Optional usage stats from the container runtime
+	DrainedUntil    *time.Time        `json:",omitempty" codec:",omitempty"` // When a scheduled drain ends, if it's one
+	Weight          int               `json:",omitempty" codec:",omitempty"` // Its share of the traffic to its backend, 0 for the proxy's default
+	Status          int
 }
 
 func (svc *Service) Encode() ([]byte, error) {
 	return svc.MarshalJSON()
 }
 
+// EncodeWith encodes the service for the wire in the Encoder's format
+func (svc *Service) EncodeWith(encoder wire.Encoder) ([]byte, error) {
+	return encoder.Marshal(svc)
+}
+
 func (svc *Service) StatusString() string {
 	return StatusString(svc.Status)
 }
@@ -61,12 +87,23 @@ func (svc *Service) IsDraining() bool {
 	return svc.Status == DRAINING
 }
 
+// DrainEnded tells us whether the service is in a scheduled drain that has
+// run out at this time. Other drains never end.
+func (svc *Service) DrainEnded(t time.Time) bool {
+	return svc.DrainedUntil != nil && !t.Before(*svc.DrainedUntil)
+}
+
 func (svc *Service) Invalidates(otherSvc *Service) bool {
 	return otherSvc != nil && svc.Updated.After(otherSvc.Updated)
 }
 
 func (svc *Service) IsStale(lifespan time.Duration) bool {
-	oldestAllowed := time.Now().UTC().Add(0 - lifespan)
+	return svc.IsStaleAt(lifespan, time.Now().UTC())
+}
+
+// IsStaleAt is IsStale with the current time passed in
+func (svc *Service) IsStaleAt(lifespan time.Duration, now time.Time) bool {
+	oldestAllowed := now.Add(0 - lifespan)
 	// We add a fudge factor for clock drift
 	return svc.Updated.Before(oldestAllowed.Add(0 - 1*time.Minute))
 }
@@ -105,6 +142,18 @@ func (svc *Service) PortForServicePort(findPort int64, pType string) int64 {
 	return -1
 }
 
+// PortAlive tells us whether the port with this ServicePort is passing its
+// own health check. Ports without one take the status of the service.
+func (svc *Service) PortAlive(servicePort int64) bool {
+	for _, port := range svc.Ports {
+		if port.ServicePort == servicePort && port.Status != ALIVE {
+			return false
+		}
+	}
+
+	return true
+}
+
 // ListenerName returns the string name this service should be identified
 // by as a listener to Sidecar state
 func (svc *Service) ListenerName() string {
@@ -122,13 +171,14 @@ func (svc *Service) Version() string {
 	return parts[0]
 }
 
-// Decode decodes the input data JSON into a *Service. If it fails, it returns
-// a non-nil error
+// Decode decodes the input data, in any of the wire formats, into a
+// *Service. If it fails, it returns a non-nil error
 func Decode(data []byte) (*Service, error) {
 	var svc Service
-	err := svc.UnmarshalJSON(data)
+	encoder := wire.Detect(data)
+	err := encoder.Unmarshal(data, &svc)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode service JSON: %s", err)
+		return nil, fmt.Errorf("failed to decode service %s: %s", encoder.Name(), err)
 	}
 
 	return &svc, nil
@@ -154,6 +204,69 @@ func ToService(container *docker.APIContainers, ip string) Service {
 		svc.ProxyMode = "http"
 	}
 
+	switch family := container.Labels["IPFamily"]; family {
+	case "", IPFamilyV4, IPFamilyV6:
+		svc.IPFamily = family
+	default:
+		log.Warnf("Ignoring invalid IPFamily label '%s' on %s", family, svc.ID)
+	}
+
+	svc.TLSCert = container.Labels["TLSCert"]
+	svc.PublicHostnames = parseHostnames(container.Labels["PublicHostnames"])
+
+	if value, ok := container.Labels["Weight"]; ok {
+		weight, err := ParseWeight(value)
+		if err != nil {
+			log.Warnf("Ignoring the Weight label on %s: %s", svc.ID, err)
+		}
+		svc.Weight = weight
+	}
+
+	for _, keys := range [][]string{RoutingKeys, LimitKeys, DecisionKeys, StickinessKeys, TimeoutKeys} {
+		for _, key := range keys {
+			if value, ok := container.Labels[key]; ok {
+				if svc.Metadata == nil {
+					svc.Metadata = make(map[string]string)
+				}
+				svc.Metadata[key] = value
+			}
+		}
+	}
+
+	if _, err := ParseSourceRoutes(svc.Metadata[SourceRoutesKey]); err != nil {
+		log.Warnf("Ignoring some of the source routes on %s: %s", svc.ID, err)
+	}
+	if _, _, err := svc.VirtualHosts(); err != nil {
+		log.Warnf("Using the default port for the virtual hosts of %s: %s", svc.ID, err)
+	}
+	if _, err := ParsePathPrefixes(svc.Metadata[PathPrefixesKey]); err != nil {
+		log.Warnf("Ignoring some of the path prefixes on %s: %s", svc.ID, err)
+	}
+	if _, _, err := svc.SNIHosts(); err != nil {
+		log.Warnf("Ignoring some of the SNI hosts on %s: %s", svc.ID, err)
+	}
+	if _, err := svc.TrafficSplit(); err != nil {
+		log.Warnf("Not splitting the traffic to %s: %s", svc.ID, err)
+	}
+	if _, err := svc.Mirror(); err != nil {
+		log.Warnf("Not mirroring requests to %s: %s", svc.ID, err)
+	}
+	if _, err := svc.Stickiness(); err != nil {
+		log.Warnf("Not keeping the clients of %s on the same instance: %s", svc.ID, err)
+	}
+	if _, err := svc.Timeouts(); err != nil {
+		log.Warnf("Ignoring some of the timeouts on %s: %s", svc.ID, err)
+	}
+	if _, err := svc.ConnectionLimit(0, 0); err != nil {
+		log.Warnf("Ignoring some of the connection limit hints on %s: %s", svc.ID, err)
+	}
+	if _, err := svc.RateLimit(); err != nil {
+		log.Warnf("Not rate limiting requests to %s: %s", svc.ID, err)
+	}
+	if _, err := ParseAllowedSources(svc.Metadata[AllowedSourcesKey]); err != nil {
+		log.Warnf("Ignoring some of the allowed sources on %s: %s", svc.ID, err)
+	}
+
 	svc.Ports = make([]Port, 0)
 
 	for _, port := range container.Ports {
@@ -184,6 +297,8 @@ func StatusString(status int) string {
 func buildPortFor(port *docker.APIPort, container *docker.APIContainers, ip string) Port {
 	// We look up service port labels by convention in the format "ServicePort_80=8080"
 	svcPortLabel := fmt.Sprintf("ServicePort_%d", port.PrivatePort)
+	// ...and port names in the format "PortName_80=admin"
+	portNameLabel := fmt.Sprintf("PortName_%d", port.PrivatePort)
 
 	// You can override the default IP by binding your container on a specific IP
 	if port.IP != "0.0.0.0" && port.IP != "" {
@@ -191,6 +306,7 @@ func buildPortFor(port *docker.APIPort, container *docker.APIContainers, ip stri
 	}
 
 	returnPort := Port{Port: port.PublicPort, Type: port.Type, IP: ip}
+	returnPort.Name = strings.TrimSpace(container.Labels[portNameLabel])
 
 	if svcPort, ok := container.Labels[svcPortLabel]; ok {
 		svcPortInt, err := strconv.Atoi(svcPort)
@@ -208,3 +324,28 @@ func buildPortFor(port *docker.APIPort, container *docker.APIContainers, ip stri
 
 	return returnPort
 }
+
+// ParseWeight parses the weight of an instance, which goes from 1 to
+// MaxWeight. It returns 0 when the value is invalid.
+func ParseWeight(value string) (int, error) {
+	weight, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || weight < 1 || weight > MaxWeight {
+		return 0, fmt.Errorf("Error parsing weight '%s', must be from 1 to %d", value, MaxWeight)
+	}
+
+	return weight, nil
+}
+
+// Parse a comma separated list of hostnames from a label. Hostnames aren't
+// case sensitive, so they are lowercased.
+func parseHostnames(label string) []string {
+	var hostnames []string
+	for _, hostname := range strings.Split(label, ",") {
+		hostname = strings.ToLower(strings.TrimSpace(hostname))
+		if hostname != "" {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	return hostnames
+}
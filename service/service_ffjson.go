@@ -1,30 +1,33 @@
-// DO NOT EDIT!
-// Code generated by ffjson <https://github.com/pquerna/ffjson>
+// Code generated by ffjson <https://github.com/pquerna/ffjson>. DO NOT EDIT.
 // source: service.go
-// DO NOT EDIT!
 
 package service
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	fflib "github.com/pquerna/ffjson/fflib/v1"
+	"time"
 )
 
-func (mj *Port) MarshalJSON() ([]byte, error) {
+// MarshalJSON marshal bytes to json - template
+func (j *Port) MarshalJSON() ([]byte, error) {
 	var buf fflib.Buffer
-	if mj == nil {
+	if j == nil {
 		buf.WriteString("null")
 		return buf.Bytes(), nil
 	}
-	err := mj.MarshalJSONBuf(&buf)
+	err := j.MarshalJSONBuf(&buf)
 	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
-func (mj *Port) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
-	if mj == nil {
+
+// MarshalJSONBuf marshal buff to json - template
+func (j *Port) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
+	if j == nil {
 		buf.WriteString("null")
 		return nil
 	}
@@ -32,47 +35,69 @@ func (mj *Port) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
 	var obj []byte
 	_ = obj
 	_ = err
-	buf.WriteString(`{"Type":`)
-	fflib.WriteJsonString(buf, string(mj.Type))
+	buf.WriteString(`{ "Type":`)
+	fflib.WriteJsonString(buf, string(j.Type))
 	buf.WriteString(`,"Port":`)
-	fflib.FormatBits2(buf, uint64(mj.Port), 10, mj.Port < 0)
+	fflib.FormatBits2(buf, uint64(j.Port), 10, j.Port < 0)
 	buf.WriteString(`,"ServicePort":`)
-	fflib.FormatBits2(buf, uint64(mj.ServicePort), 10, mj.ServicePort < 0)
+	fflib.FormatBits2(buf, uint64(j.ServicePort), 10, j.ServicePort < 0)
 	buf.WriteString(`,"IP":`)
-	fflib.WriteJsonString(buf, string(mj.IP))
+	fflib.WriteJsonString(buf, string(j.IP))
+	buf.WriteByte(',')
+	if len(j.Name) != 0 {
+		buf.WriteString(`"Name":`)
+		fflib.WriteJsonString(buf, string(j.Name))
+		buf.WriteByte(',')
+	}
+	if j.Status != 0 {
+		buf.WriteString(`"Status":`)
+		fflib.FormatBits2(buf, uint64(j.Status), 10, j.Status < 0)
+		buf.WriteByte(',')
+	}
+	buf.Rewind(1)
 	buf.WriteByte('}')
 	return nil
 }
 
 const (
-	ffj_t_Portbase = iota
-	ffj_t_Portno_such_key
+	ffjtPortbase = iota
+	ffjtPortnosuchkey
+
+	ffjtPortType
 
-	ffj_t_Port_Type
+	ffjtPortPort
 
-	ffj_t_Port_Port
+	ffjtPortServicePort
 
-	ffj_t_Port_ServicePort
+	ffjtPortIP
 
-	ffj_t_Port_IP
+	ffjtPortName
+
+	ffjtPortStatus
 )
 
-var ffj_key_Port_Type = []byte("Type")
+var ffjKeyPortType = []byte("Type")
+
+var ffjKeyPortPort = []byte("Port")
 
-var ffj_key_Port_Port = []byte("Port")
+var ffjKeyPortServicePort = []byte("ServicePort")
 
-var ffj_key_Port_ServicePort = []byte("ServicePort")
+var ffjKeyPortIP = []byte("IP")
 
-var ffj_key_Port_IP = []byte("IP")
+var ffjKeyPortName = []byte("Name")
 
-func (uj *Port) UnmarshalJSON(input []byte) error {
+var ffjKeyPortStatus = []byte("Status")
+
+// UnmarshalJSON umarshall json - template of ffjson
+func (j *Port) UnmarshalJSON(input []byte) error {
 	fs := fflib.NewFFLexer(input)
-	return uj.UnmarshalJSONFFLexer(fs, fflib.FFParse_map_start)
+	return j.UnmarshalJSONFFLexer(fs, fflib.FFParse_map_start)
 }
 
-func (uj *Port) UnmarshalJSONFFLexer(fs *fflib.FFLexer, state fflib.FFParseState) error {
-	var err error = nil
-	currentKey := ffj_t_Portbase
+// UnmarshalJSONFFLexer fast json unmarshall - template ffjson
+func (j *Port) UnmarshalJSONFFLexer(fs *fflib.FFLexer, state fflib.FFParseState) error {
+	var err error
+	currentKey := ffjtPortbase
 	_ = currentKey
 	tok := fflib.FFTok_init
 	wantedTok := fflib.FFTok_init
@@ -118,7 +143,7 @@ mainparse:
 			kn := fs.Output.Bytes()
 			if len(kn) <= 0 {
 				// "" case. hrm.
-				currentKey = ffj_t_Portno_such_key
+				currentKey = ffjtPortnosuchkey
 				state = fflib.FFParse_want_colon
 				goto mainparse
 			} else {
@@ -126,63 +151,88 @@ mainparse:
 
 				case 'I':
 
-					if bytes.Equal(ffj_key_Port_IP, kn) {
-						currentKey = ffj_t_Port_IP
+					if bytes.Equal(ffjKeyPortIP, kn) {
+						currentKey = ffjtPortIP
+						state = fflib.FFParse_want_colon
+						goto mainparse
+					}
+
+				case 'N':
+
+					if bytes.Equal(ffjKeyPortName, kn) {
+						currentKey = ffjtPortName
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				case 'P':
 
-					if bytes.Equal(ffj_key_Port_Port, kn) {
-						currentKey = ffj_t_Port_Port
+					if bytes.Equal(ffjKeyPortPort, kn) {
+						currentKey = ffjtPortPort
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				case 'S':
 
-					if bytes.Equal(ffj_key_Port_ServicePort, kn) {
-						currentKey = ffj_t_Port_ServicePort
+					if bytes.Equal(ffjKeyPortServicePort, kn) {
+						currentKey = ffjtPortServicePort
+						state = fflib.FFParse_want_colon
+						goto mainparse
+
+					} else if bytes.Equal(ffjKeyPortStatus, kn) {
+						currentKey = ffjtPortStatus
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				case 'T':
 
-					if bytes.Equal(ffj_key_Port_Type, kn) {
-						currentKey = ffj_t_Port_Type
+					if bytes.Equal(ffjKeyPortType, kn) {
+						currentKey = ffjtPortType
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				}
 
-				if fflib.SimpleLetterEqualFold(ffj_key_Port_IP, kn) {
-					currentKey = ffj_t_Port_IP
+				if fflib.EqualFoldRight(ffjKeyPortStatus, kn) {
+					currentKey = ffjtPortStatus
+					state = fflib.FFParse_want_colon
+					goto mainparse
+				}
+
+				if fflib.SimpleLetterEqualFold(ffjKeyPortName, kn) {
+					currentKey = ffjtPortName
+					state = fflib.FFParse_want_colon
+					goto mainparse
+				}
+
+				if fflib.SimpleLetterEqualFold(ffjKeyPortIP, kn) {
+					currentKey = ffjtPortIP
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.EqualFoldRight(ffj_key_Port_ServicePort, kn) {
-					currentKey = ffj_t_Port_ServicePort
+				if fflib.EqualFoldRight(ffjKeyPortServicePort, kn) {
+					currentKey = ffjtPortServicePort
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.SimpleLetterEqualFold(ffj_key_Port_Port, kn) {
-					currentKey = ffj_t_Port_Port
+				if fflib.SimpleLetterEqualFold(ffjKeyPortPort, kn) {
+					currentKey = ffjtPortPort
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.SimpleLetterEqualFold(ffj_key_Port_Type, kn) {
-					currentKey = ffj_t_Port_Type
+				if fflib.SimpleLetterEqualFold(ffjKeyPortType, kn) {
+					currentKey = ffjtPortType
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				currentKey = ffj_t_Portno_such_key
+				currentKey = ffjtPortnosuchkey
 				state = fflib.FFParse_want_colon
 				goto mainparse
 			}
@@ -199,19 +249,25 @@ mainparse:
 			if tok == fflib.FFTok_left_brace || tok == fflib.FFTok_left_bracket || tok == fflib.FFTok_integer || tok == fflib.FFTok_double || tok == fflib.FFTok_string || tok == fflib.FFTok_bool || tok == fflib.FFTok_null {
 				switch currentKey {
 
-				case ffj_t_Port_Type:
+				case ffjtPortType:
 					goto handle_Type
 
-				case ffj_t_Port_Port:
+				case ffjtPortPort:
 					goto handle_Port
 
-				case ffj_t_Port_ServicePort:
+				case ffjtPortServicePort:
 					goto handle_ServicePort
 
-				case ffj_t_Port_IP:
+				case ffjtPortIP:
 					goto handle_IP
 
-				case ffj_t_Portno_such_key:
+				case ffjtPortName:
+					goto handle_Name
+
+				case ffjtPortStatus:
+					goto handle_Status
+
+				case ffjtPortnosuchkey:
 					err = fs.SkipField(tok)
 					if err != nil {
 						return fs.WrapErr(err)
@@ -227,7 +283,7 @@ mainparse:
 
 handle_Type:
 
-	/* handler: uj.Type type=string kind=string quoted=false*/
+	/* handler: j.Type type=string kind=string quoted=false*/
 
 	{
 
@@ -243,7 +299,7 @@ handle_Type:
 
 			outBuf := fs.Output.Bytes()
 
-			uj.Type = string(string(outBuf))
+			j.Type = string(string(outBuf))
 
 		}
 	}
@@ -253,7 +309,7 @@ handle_Type:
 
 handle_Port:
 
-	/* handler: uj.Port type=int64 kind=int64 quoted=false*/
+	/* handler: j.Port type=int64 kind=int64 quoted=false*/
 
 	{
 		if tok != fflib.FFTok_integer && tok != fflib.FFTok_null {
@@ -273,7 +329,7 @@ handle_Port:
 				return fs.WrapErr(err)
 			}
 
-			uj.Port = int64(tval)
+			j.Port = int64(tval)
 
 		}
 	}
@@ -283,7 +339,7 @@ handle_Port:
 
 handle_ServicePort:
 
-	/* handler: uj.ServicePort type=int64 kind=int64 quoted=false*/
+	/* handler: j.ServicePort type=int64 kind=int64 quoted=false*/
 
 	{
 		if tok != fflib.FFTok_integer && tok != fflib.FFTok_null {
@@ -303,7 +359,7 @@ handle_ServicePort:
 				return fs.WrapErr(err)
 			}
 
-			uj.ServicePort = int64(tval)
+			j.ServicePort = int64(tval)
 
 		}
 	}
@@ -313,7 +369,7 @@ handle_ServicePort:
 
 handle_IP:
 
-	/* handler: uj.IP type=string kind=string quoted=false*/
+	/* handler: j.IP type=string kind=string quoted=false*/
 
 	{
 
@@ -329,7 +385,63 @@ handle_IP:
 
 			outBuf := fs.Output.Bytes()
 
-			uj.IP = string(string(outBuf))
+			j.IP = string(string(outBuf))
+
+		}
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_Name:
+
+	/* handler: j.Name type=string kind=string quoted=false*/
+
+	{
+
+		{
+			if tok != fflib.FFTok_string && tok != fflib.FFTok_null {
+				return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for string", tok))
+			}
+		}
+
+		if tok == fflib.FFTok_null {
+
+		} else {
+
+			outBuf := fs.Output.Bytes()
+
+			j.Name = string(string(outBuf))
+
+		}
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_Status:
+
+	/* handler: j.Status type=int kind=int quoted=false*/
+
+	{
+		if tok != fflib.FFTok_integer && tok != fflib.FFTok_null {
+			return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for int", tok))
+		}
+	}
+
+	{
+
+		if tok == fflib.FFTok_null {
+
+		} else {
+
+			tval, err := fflib.ParseInt(fs.Output.Bytes(), 10, 64)
+
+			if err != nil {
+				return fs.WrapErr(err)
+			}
+
+			j.Status = int(tval)
 
 		}
 	}
@@ -355,20 +467,23 @@ done:
 	return nil
 }
 
-func (mj *Service) MarshalJSON() ([]byte, error) {
+// MarshalJSON marshal bytes to json - template
+func (j *Service) MarshalJSON() ([]byte, error) {
 	var buf fflib.Buffer
-	if mj == nil {
+	if j == nil {
 		buf.WriteString("null")
 		return buf.Bytes(), nil
 	}
-	err := mj.MarshalJSONBuf(&buf)
+	err := j.MarshalJSONBuf(&buf)
 	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
-func (mj *Service) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
-	if mj == nil {
+
+// MarshalJSONBuf marshal buff to json - template
+func (j *Service) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
+	if j == nil {
 		buf.WriteString("null")
 		return nil
 	}
@@ -377,16 +492,16 @@ func (mj *Service) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
 	_ = obj
 	_ = err
 	buf.WriteString(`{"ID":`)
-	fflib.WriteJsonString(buf, string(mj.ID))
+	fflib.WriteJsonString(buf, string(j.ID))
 	buf.WriteString(`,"Name":`)
-	fflib.WriteJsonString(buf, string(mj.Name))
+	fflib.WriteJsonString(buf, string(j.Name))
 	buf.WriteString(`,"Image":`)
-	fflib.WriteJsonString(buf, string(mj.Image))
+	fflib.WriteJsonString(buf, string(j.Image))
 	buf.WriteString(`,"Created":`)
 
 	{
 
-		obj, err = mj.Created.MarshalJSON()
+		obj, err = j.Created.MarshalJSON()
 		if err != nil {
 			return err
 		}
@@ -394,11 +509,11 @@ func (mj *Service) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
 
 	}
 	buf.WriteString(`,"Hostname":`)
-	fflib.WriteJsonString(buf, string(mj.Hostname))
+	fflib.WriteJsonString(buf, string(j.Hostname))
 	buf.WriteString(`,"Ports":`)
-	if mj.Ports != nil {
+	if j.Ports != nil {
 		buf.WriteString(`[`)
-		for i, v := range mj.Ports {
+		for i, v := range j.Ports {
 			if i != 0 {
 				buf.WriteString(`,`)
 			}
@@ -420,7 +535,7 @@ func (mj *Service) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
 
 	{
 
-		obj, err = mj.Updated.MarshalJSON()
+		obj, err = j.Updated.MarshalJSON()
 		if err != nil {
 			return err
 		}
@@ -428,62 +543,176 @@ func (mj *Service) MarshalJSONBuf(buf fflib.EncodingBuffer) error {
 
 	}
 	buf.WriteString(`,"ProxyMode":`)
-	fflib.WriteJsonString(buf, string(mj.ProxyMode))
-	buf.WriteString(`,"Status":`)
-	fflib.FormatBits2(buf, uint64(mj.Status), 10, mj.Status < 0)
+	fflib.WriteJsonString(buf, string(j.ProxyMode))
+	buf.WriteByte(',')
+	if len(j.IPFamily) != 0 {
+		buf.WriteString(`"IPFamily":`)
+		fflib.WriteJsonString(buf, string(j.IPFamily))
+		buf.WriteByte(',')
+	}
+	if len(j.TLSCert) != 0 {
+		buf.WriteString(`"TLSCert":`)
+		fflib.WriteJsonString(buf, string(j.TLSCert))
+		buf.WriteByte(',')
+	}
+	if len(j.PublicHostnames) != 0 {
+		buf.WriteString(`"PublicHostnames":`)
+		if j.PublicHostnames != nil {
+			buf.WriteString(`[`)
+			for i, v := range j.PublicHostnames {
+				if i != 0 {
+					buf.WriteString(`,`)
+				}
+				fflib.WriteJsonString(buf, string(v))
+			}
+			buf.WriteString(`]`)
+		} else {
+			buf.WriteString(`null`)
+		}
+		buf.WriteByte(',')
+	}
+	if len(j.Metadata) != 0 {
+		if j.Metadata == nil {
+			buf.WriteString(`"Metadata":null`)
+		} else {
+			buf.WriteString(`"Metadata":{ `)
+			for key, value := range j.Metadata {
+				fflib.WriteJsonString(buf, key)
+				buf.WriteString(`:`)
+				fflib.WriteJsonString(buf, string(value))
+				buf.WriteByte(',')
+			}
+			buf.Rewind(1)
+			buf.WriteByte('}')
+		}
+		buf.WriteByte(',')
+	}
+	if len(j.Reporter) != 0 {
+		buf.WriteString(`"Reporter":`)
+		fflib.WriteJsonString(buf, string(j.Reporter))
+		buf.WriteByte(',')
+	}
+	if j.Resources != nil {
+		if true {
+			/* Struct fall back. type=service.Resources kind=struct */
+			buf.WriteString(`"Resources":`)
+			err = buf.Encode(j.Resources)
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(',')
+		}
+	}
+	if j.DrainedUntil != nil {
+		if true {
+			buf.WriteString(`"DrainedUntil":`)
+
+			{
+
+				obj, err = j.DrainedUntil.MarshalJSON()
+				if err != nil {
+					return err
+				}
+				buf.Write(obj)
+
+			}
+			buf.WriteByte(',')
+		}
+	}
+	if j.Weight != 0 {
+		buf.WriteString(`"Weight":`)
+		fflib.FormatBits2(buf, uint64(j.Weight), 10, j.Weight < 0)
+		buf.WriteByte(',')
+	}
+	buf.WriteString(`"Status":`)
+	fflib.FormatBits2(buf, uint64(j.Status), 10, j.Status < 0)
 	buf.WriteByte('}')
 	return nil
 }
 
 const (
-	ffj_t_Servicebase = iota
-	ffj_t_Serviceno_such_key
+	ffjtServicebase = iota
+	ffjtServicenosuchkey
+
+	ffjtServiceID
+
+	ffjtServiceName
 
-	ffj_t_Service_ID
+	ffjtServiceImage
 
-	ffj_t_Service_Name
+	ffjtServiceCreated
 
-	ffj_t_Service_Image
+	ffjtServiceHostname
 
-	ffj_t_Service_Created
+	ffjtServicePorts
 
-	ffj_t_Service_Hostname
+	ffjtServiceUpdated
 
-	ffj_t_Service_Ports
+	ffjtServiceProxyMode
 
-	ffj_t_Service_Updated
+	ffjtServiceIPFamily
 
-	ffj_t_Service_ProxyMode
+	ffjtServiceTLSCert
 
-	ffj_t_Service_Status
+	ffjtServicePublicHostnames
+
+	ffjtServiceMetadata
+
+	ffjtServiceReporter
+
+	ffjtServiceResources
+
+	ffjtServiceDrainedUntil
+
+	ffjtServiceWeight
+
+	ffjtServiceStatus
 )
 
-var ffj_key_Service_ID = []byte("ID")
+var ffjKeyServiceID = []byte("ID")
+
+var ffjKeyServiceName = []byte("Name")
+
+var ffjKeyServiceImage = []byte("Image")
 
-var ffj_key_Service_Name = []byte("Name")
+var ffjKeyServiceCreated = []byte("Created")
 
-var ffj_key_Service_Image = []byte("Image")
+var ffjKeyServiceHostname = []byte("Hostname")
 
-var ffj_key_Service_Created = []byte("Created")
+var ffjKeyServicePorts = []byte("Ports")
 
-var ffj_key_Service_Hostname = []byte("Hostname")
+var ffjKeyServiceUpdated = []byte("Updated")
 
-var ffj_key_Service_Ports = []byte("Ports")
+var ffjKeyServiceProxyMode = []byte("ProxyMode")
 
-var ffj_key_Service_Updated = []byte("Updated")
+var ffjKeyServiceIPFamily = []byte("IPFamily")
 
-var ffj_key_Service_ProxyMode = []byte("ProxyMode")
+var ffjKeyServiceTLSCert = []byte("TLSCert")
 
-var ffj_key_Service_Status = []byte("Status")
+var ffjKeyServicePublicHostnames = []byte("PublicHostnames")
 
-func (uj *Service) UnmarshalJSON(input []byte) error {
+var ffjKeyServiceMetadata = []byte("Metadata")
+
+var ffjKeyServiceReporter = []byte("Reporter")
+
+var ffjKeyServiceResources = []byte("Resources")
+
+var ffjKeyServiceDrainedUntil = []byte("DrainedUntil")
+
+var ffjKeyServiceWeight = []byte("Weight")
+
+var ffjKeyServiceStatus = []byte("Status")
+
+// UnmarshalJSON umarshall json - template of ffjson
+func (j *Service) UnmarshalJSON(input []byte) error {
 	fs := fflib.NewFFLexer(input)
-	return uj.UnmarshalJSONFFLexer(fs, fflib.FFParse_map_start)
+	return j.UnmarshalJSONFFLexer(fs, fflib.FFParse_map_start)
 }
 
-func (uj *Service) UnmarshalJSONFFLexer(fs *fflib.FFLexer, state fflib.FFParseState) error {
-	var err error = nil
-	currentKey := ffj_t_Servicebase
+// UnmarshalJSONFFLexer fast json unmarshall - template ffjson
+func (j *Service) UnmarshalJSONFFLexer(fs *fflib.FFLexer, state fflib.FFParseState) error {
+	var err error
+	currentKey := ffjtServicebase
 	_ = currentKey
 	tok := fflib.FFTok_init
 	wantedTok := fflib.FFTok_init
@@ -529,7 +758,7 @@ mainparse:
 			kn := fs.Output.Bytes()
 			if len(kn) <= 0 {
 				// "" case. hrm.
-				currentKey = ffj_t_Serviceno_such_key
+				currentKey = ffjtServicenosuchkey
 				state = fflib.FFParse_want_colon
 				goto mainparse
 			} else {
@@ -537,127 +766,230 @@ mainparse:
 
 				case 'C':
 
-					if bytes.Equal(ffj_key_Service_Created, kn) {
-						currentKey = ffj_t_Service_Created
+					if bytes.Equal(ffjKeyServiceCreated, kn) {
+						currentKey = ffjtServiceCreated
+						state = fflib.FFParse_want_colon
+						goto mainparse
+					}
+
+				case 'D':
+
+					if bytes.Equal(ffjKeyServiceDrainedUntil, kn) {
+						currentKey = ffjtServiceDrainedUntil
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				case 'H':
 
-					if bytes.Equal(ffj_key_Service_Hostname, kn) {
-						currentKey = ffj_t_Service_Hostname
+					if bytes.Equal(ffjKeyServiceHostname, kn) {
+						currentKey = ffjtServiceHostname
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				case 'I':
 
-					if bytes.Equal(ffj_key_Service_ID, kn) {
-						currentKey = ffj_t_Service_ID
+					if bytes.Equal(ffjKeyServiceID, kn) {
+						currentKey = ffjtServiceID
+						state = fflib.FFParse_want_colon
+						goto mainparse
+
+					} else if bytes.Equal(ffjKeyServiceImage, kn) {
+						currentKey = ffjtServiceImage
 						state = fflib.FFParse_want_colon
 						goto mainparse
 
-					} else if bytes.Equal(ffj_key_Service_Image, kn) {
-						currentKey = ffj_t_Service_Image
+					} else if bytes.Equal(ffjKeyServiceIPFamily, kn) {
+						currentKey = ffjtServiceIPFamily
+						state = fflib.FFParse_want_colon
+						goto mainparse
+					}
+
+				case 'M':
+
+					if bytes.Equal(ffjKeyServiceMetadata, kn) {
+						currentKey = ffjtServiceMetadata
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				case 'N':
 
-					if bytes.Equal(ffj_key_Service_Name, kn) {
-						currentKey = ffj_t_Service_Name
+					if bytes.Equal(ffjKeyServiceName, kn) {
+						currentKey = ffjtServiceName
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				case 'P':
 
-					if bytes.Equal(ffj_key_Service_Ports, kn) {
-						currentKey = ffj_t_Service_Ports
+					if bytes.Equal(ffjKeyServicePorts, kn) {
+						currentKey = ffjtServicePorts
+						state = fflib.FFParse_want_colon
+						goto mainparse
+
+					} else if bytes.Equal(ffjKeyServiceProxyMode, kn) {
+						currentKey = ffjtServiceProxyMode
 						state = fflib.FFParse_want_colon
 						goto mainparse
 
-					} else if bytes.Equal(ffj_key_Service_ProxyMode, kn) {
-						currentKey = ffj_t_Service_ProxyMode
+					} else if bytes.Equal(ffjKeyServicePublicHostnames, kn) {
+						currentKey = ffjtServicePublicHostnames
+						state = fflib.FFParse_want_colon
+						goto mainparse
+					}
+
+				case 'R':
+
+					if bytes.Equal(ffjKeyServiceReporter, kn) {
+						currentKey = ffjtServiceReporter
+						state = fflib.FFParse_want_colon
+						goto mainparse
+
+					} else if bytes.Equal(ffjKeyServiceResources, kn) {
+						currentKey = ffjtServiceResources
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				case 'S':
 
-					if bytes.Equal(ffj_key_Service_Status, kn) {
-						currentKey = ffj_t_Service_Status
+					if bytes.Equal(ffjKeyServiceStatus, kn) {
+						currentKey = ffjtServiceStatus
+						state = fflib.FFParse_want_colon
+						goto mainparse
+					}
+
+				case 'T':
+
+					if bytes.Equal(ffjKeyServiceTLSCert, kn) {
+						currentKey = ffjtServiceTLSCert
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
 				case 'U':
 
-					if bytes.Equal(ffj_key_Service_Updated, kn) {
-						currentKey = ffj_t_Service_Updated
+					if bytes.Equal(ffjKeyServiceUpdated, kn) {
+						currentKey = ffjtServiceUpdated
 						state = fflib.FFParse_want_colon
 						goto mainparse
 					}
 
+				case 'W':
+
+					if bytes.Equal(ffjKeyServiceWeight, kn) {
+						currentKey = ffjtServiceWeight
+						state = fflib.FFParse_want_colon
+						goto mainparse
+					}
+
+				}
+
+				if fflib.EqualFoldRight(ffjKeyServiceStatus, kn) {
+					currentKey = ffjtServiceStatus
+					state = fflib.FFParse_want_colon
+					goto mainparse
+				}
+
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceWeight, kn) {
+					currentKey = ffjtServiceWeight
+					state = fflib.FFParse_want_colon
+					goto mainparse
+				}
+
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceDrainedUntil, kn) {
+					currentKey = ffjtServiceDrainedUntil
+					state = fflib.FFParse_want_colon
+					goto mainparse
+				}
+
+				if fflib.EqualFoldRight(ffjKeyServiceResources, kn) {
+					currentKey = ffjtServiceResources
+					state = fflib.FFParse_want_colon
+					goto mainparse
+				}
+
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceReporter, kn) {
+					currentKey = ffjtServiceReporter
+					state = fflib.FFParse_want_colon
+					goto mainparse
+				}
+
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceMetadata, kn) {
+					currentKey = ffjtServiceMetadata
+					state = fflib.FFParse_want_colon
+					goto mainparse
+				}
+
+				if fflib.EqualFoldRight(ffjKeyServicePublicHostnames, kn) {
+					currentKey = ffjtServicePublicHostnames
+					state = fflib.FFParse_want_colon
+					goto mainparse
+				}
+
+				if fflib.EqualFoldRight(ffjKeyServiceTLSCert, kn) {
+					currentKey = ffjtServiceTLSCert
+					state = fflib.FFParse_want_colon
+					goto mainparse
 				}
 
-				if fflib.EqualFoldRight(ffj_key_Service_Status, kn) {
-					currentKey = ffj_t_Service_Status
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceIPFamily, kn) {
+					currentKey = ffjtServiceIPFamily
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.SimpleLetterEqualFold(ffj_key_Service_ProxyMode, kn) {
-					currentKey = ffj_t_Service_ProxyMode
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceProxyMode, kn) {
+					currentKey = ffjtServiceProxyMode
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.SimpleLetterEqualFold(ffj_key_Service_Updated, kn) {
-					currentKey = ffj_t_Service_Updated
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceUpdated, kn) {
+					currentKey = ffjtServiceUpdated
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.EqualFoldRight(ffj_key_Service_Ports, kn) {
-					currentKey = ffj_t_Service_Ports
+				if fflib.EqualFoldRight(ffjKeyServicePorts, kn) {
+					currentKey = ffjtServicePorts
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.EqualFoldRight(ffj_key_Service_Hostname, kn) {
-					currentKey = ffj_t_Service_Hostname
+				if fflib.EqualFoldRight(ffjKeyServiceHostname, kn) {
+					currentKey = ffjtServiceHostname
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.SimpleLetterEqualFold(ffj_key_Service_Created, kn) {
-					currentKey = ffj_t_Service_Created
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceCreated, kn) {
+					currentKey = ffjtServiceCreated
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.SimpleLetterEqualFold(ffj_key_Service_Image, kn) {
-					currentKey = ffj_t_Service_Image
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceImage, kn) {
+					currentKey = ffjtServiceImage
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.SimpleLetterEqualFold(ffj_key_Service_Name, kn) {
-					currentKey = ffj_t_Service_Name
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceName, kn) {
+					currentKey = ffjtServiceName
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				if fflib.SimpleLetterEqualFold(ffj_key_Service_ID, kn) {
-					currentKey = ffj_t_Service_ID
+				if fflib.SimpleLetterEqualFold(ffjKeyServiceID, kn) {
+					currentKey = ffjtServiceID
 					state = fflib.FFParse_want_colon
 					goto mainparse
 				}
 
-				currentKey = ffj_t_Serviceno_such_key
+				currentKey = ffjtServicenosuchkey
 				state = fflib.FFParse_want_colon
 				goto mainparse
 			}
@@ -674,34 +1006,58 @@ mainparse:
 			if tok == fflib.FFTok_left_brace || tok == fflib.FFTok_left_bracket || tok == fflib.FFTok_integer || tok == fflib.FFTok_double || tok == fflib.FFTok_string || tok == fflib.FFTok_bool || tok == fflib.FFTok_null {
 				switch currentKey {
 
-				case ffj_t_Service_ID:
+				case ffjtServiceID:
 					goto handle_ID
 
-				case ffj_t_Service_Name:
+				case ffjtServiceName:
 					goto handle_Name
 
-				case ffj_t_Service_Image:
+				case ffjtServiceImage:
 					goto handle_Image
 
-				case ffj_t_Service_Created:
+				case ffjtServiceCreated:
 					goto handle_Created
 
-				case ffj_t_Service_Hostname:
+				case ffjtServiceHostname:
 					goto handle_Hostname
 
-				case ffj_t_Service_Ports:
+				case ffjtServicePorts:
 					goto handle_Ports
 
-				case ffj_t_Service_Updated:
+				case ffjtServiceUpdated:
 					goto handle_Updated
 
-				case ffj_t_Service_ProxyMode:
+				case ffjtServiceProxyMode:
 					goto handle_ProxyMode
 
-				case ffj_t_Service_Status:
+				case ffjtServiceIPFamily:
+					goto handle_IPFamily
+
+				case ffjtServiceTLSCert:
+					goto handle_TLSCert
+
+				case ffjtServicePublicHostnames:
+					goto handle_PublicHostnames
+
+				case ffjtServiceMetadata:
+					goto handle_Metadata
+
+				case ffjtServiceReporter:
+					goto handle_Reporter
+
+				case ffjtServiceResources:
+					goto handle_Resources
+
+				case ffjtServiceDrainedUntil:
+					goto handle_DrainedUntil
+
+				case ffjtServiceWeight:
+					goto handle_Weight
+
+				case ffjtServiceStatus:
 					goto handle_Status
 
-				case ffj_t_Serviceno_such_key:
+				case ffjtServicenosuchkey:
 					err = fs.SkipField(tok)
 					if err != nil {
 						return fs.WrapErr(err)
@@ -717,7 +1073,7 @@ mainparse:
 
 handle_ID:
 
-	/* handler: uj.ID type=string kind=string quoted=false*/
+	/* handler: j.ID type=string kind=string quoted=false*/
 
 	{
 
@@ -733,7 +1089,7 @@ handle_ID:
 
 			outBuf := fs.Output.Bytes()
 
-			uj.ID = string(string(outBuf))
+			j.ID = string(string(outBuf))
 
 		}
 	}
@@ -743,7 +1099,7 @@ handle_ID:
 
 handle_Name:
 
-	/* handler: uj.Name type=string kind=string quoted=false*/
+	/* handler: j.Name type=string kind=string quoted=false*/
 
 	{
 
@@ -759,7 +1115,7 @@ handle_Name:
 
 			outBuf := fs.Output.Bytes()
 
-			uj.Name = string(string(outBuf))
+			j.Name = string(string(outBuf))
 
 		}
 	}
@@ -769,7 +1125,7 @@ handle_Name:
 
 handle_Image:
 
-	/* handler: uj.Image type=string kind=string quoted=false*/
+	/* handler: j.Image type=string kind=string quoted=false*/
 
 	{
 
@@ -785,7 +1141,7 @@ handle_Image:
 
 			outBuf := fs.Output.Bytes()
 
-			uj.Image = string(string(outBuf))
+			j.Image = string(string(outBuf))
 
 		}
 	}
@@ -795,23 +1151,22 @@ handle_Image:
 
 handle_Created:
 
-	/* handler: uj.Created type=time.Time kind=struct quoted=false*/
+	/* handler: j.Created type=time.Time kind=struct quoted=false*/
 
 	{
 		if tok == fflib.FFTok_null {
 
-			state = fflib.FFParse_after_value
-			goto mainparse
-		}
+		} else {
 
-		tbuf, err := fs.CaptureField(tok)
-		if err != nil {
-			return fs.WrapErr(err)
-		}
+			tbuf, err := fs.CaptureField(tok)
+			if err != nil {
+				return fs.WrapErr(err)
+			}
 
-		err = uj.Created.UnmarshalJSON(tbuf)
-		if err != nil {
-			return fs.WrapErr(err)
+			err = j.Created.UnmarshalJSON(tbuf)
+			if err != nil {
+				return fs.WrapErr(err)
+			}
 		}
 		state = fflib.FFParse_after_value
 	}
@@ -821,7 +1176,7 @@ handle_Created:
 
 handle_Hostname:
 
-	/* handler: uj.Hostname type=string kind=string quoted=false*/
+	/* handler: j.Hostname type=string kind=string quoted=false*/
 
 	{
 
@@ -837,7 +1192,7 @@ handle_Hostname:
 
 			outBuf := fs.Output.Bytes()
 
-			uj.Hostname = string(string(outBuf))
+			j.Hostname = string(string(outBuf))
 
 		}
 	}
@@ -847,7 +1202,7 @@ handle_Hostname:
 
 handle_Ports:
 
-	/* handler: uj.Ports type=[]service.Port kind=slice quoted=false*/
+	/* handler: j.Ports type=[]service.Port kind=slice quoted=false*/
 
 	{
 
@@ -858,16 +1213,16 @@ handle_Ports:
 		}
 
 		if tok == fflib.FFTok_null {
-			uj.Ports = nil
+			j.Ports = nil
 		} else {
 
-			uj.Ports = []Port{}
+			j.Ports = []Port{}
 
 			wantVal := true
 
 			for {
 
-				var tmp_uj__Ports Port
+				var tmpJPorts Port
 
 				tok = fs.Scan()
 				if tok == fflib.FFTok_error {
@@ -888,23 +1243,22 @@ handle_Ports:
 					wantVal = true
 				}
 
-				/* handler: tmp_uj__Ports type=service.Port kind=struct quoted=false*/
+				/* handler: tmpJPorts type=service.Port kind=struct quoted=false*/
 
 				{
 					if tok == fflib.FFTok_null {
 
-						state = fflib.FFParse_after_value
-						goto mainparse
-					}
+					} else {
 
-					err = tmp_uj__Ports.UnmarshalJSONFFLexer(fs, fflib.FFParse_want_key)
-					if err != nil {
-						return err
+						err = tmpJPorts.UnmarshalJSONFFLexer(fs, fflib.FFParse_want_key)
+						if err != nil {
+							return err
+						}
 					}
 					state = fflib.FFParse_after_value
 				}
 
-				uj.Ports = append(uj.Ports, tmp_uj__Ports)
+				j.Ports = append(j.Ports, tmpJPorts)
 
 				wantVal = false
 			}
@@ -916,49 +1270,386 @@ handle_Ports:
 
 handle_Updated:
 
-	/* handler: uj.Updated type=time.Time kind=struct quoted=false*/
+	/* handler: j.Updated type=time.Time kind=struct quoted=false*/
 
 	{
 		if tok == fflib.FFTok_null {
 
-			state = fflib.FFParse_after_value
-			goto mainparse
+		} else {
+
+			tbuf, err := fs.CaptureField(tok)
+			if err != nil {
+				return fs.WrapErr(err)
+			}
+
+			err = j.Updated.UnmarshalJSON(tbuf)
+			if err != nil {
+				return fs.WrapErr(err)
+			}
 		}
+		state = fflib.FFParse_after_value
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_ProxyMode:
+
+	/* handler: j.ProxyMode type=string kind=string quoted=false*/
+
+	{
 
+		{
+			if tok != fflib.FFTok_string && tok != fflib.FFTok_null {
+				return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for string", tok))
+			}
+		}
+
+		if tok == fflib.FFTok_null {
+
+		} else {
+
+			outBuf := fs.Output.Bytes()
+
+			j.ProxyMode = string(string(outBuf))
+
+		}
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_IPFamily:
+
+	/* handler: j.IPFamily type=string kind=string quoted=false*/
+
+	{
+
+		{
+			if tok != fflib.FFTok_string && tok != fflib.FFTok_null {
+				return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for string", tok))
+			}
+		}
+
+		if tok == fflib.FFTok_null {
+
+		} else {
+
+			outBuf := fs.Output.Bytes()
+
+			j.IPFamily = string(string(outBuf))
+
+		}
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_TLSCert:
+
+	/* handler: j.TLSCert type=string kind=string quoted=false*/
+
+	{
+
+		{
+			if tok != fflib.FFTok_string && tok != fflib.FFTok_null {
+				return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for string", tok))
+			}
+		}
+
+		if tok == fflib.FFTok_null {
+
+		} else {
+
+			outBuf := fs.Output.Bytes()
+
+			j.TLSCert = string(string(outBuf))
+
+		}
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_PublicHostnames:
+
+	/* handler: j.PublicHostnames type=[]string kind=slice quoted=false*/
+
+	{
+
+		{
+			if tok != fflib.FFTok_left_brace && tok != fflib.FFTok_null {
+				return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for ", tok))
+			}
+		}
+
+		if tok == fflib.FFTok_null {
+			j.PublicHostnames = nil
+		} else {
+
+			j.PublicHostnames = []string{}
+
+			wantVal := true
+
+			for {
+
+				var tmpJPublicHostnames string
+
+				tok = fs.Scan()
+				if tok == fflib.FFTok_error {
+					goto tokerror
+				}
+				if tok == fflib.FFTok_right_brace {
+					break
+				}
+
+				if tok == fflib.FFTok_comma {
+					if wantVal == true {
+						// TODO(pquerna): this isn't an ideal error message, this handles
+						// things like [,,,] as an array value.
+						return fs.WrapErr(fmt.Errorf("wanted value token, but got token: %v", tok))
+					}
+					continue
+				} else {
+					wantVal = true
+				}
+
+				/* handler: tmpJPublicHostnames type=string kind=string quoted=false*/
+
+				{
+
+					{
+						if tok != fflib.FFTok_string && tok != fflib.FFTok_null {
+							return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for string", tok))
+						}
+					}
+
+					if tok == fflib.FFTok_null {
+
+					} else {
+
+						outBuf := fs.Output.Bytes()
+
+						tmpJPublicHostnames = string(string(outBuf))
+
+					}
+				}
+
+				j.PublicHostnames = append(j.PublicHostnames, tmpJPublicHostnames)
+
+				wantVal = false
+			}
+		}
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_Metadata:
+
+	/* handler: j.Metadata type=map[string]string kind=map quoted=false*/
+
+	{
+
+		{
+			if tok != fflib.FFTok_left_bracket && tok != fflib.FFTok_null {
+				return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for ", tok))
+			}
+		}
+
+		if tok == fflib.FFTok_null {
+			j.Metadata = nil
+		} else {
+
+			j.Metadata = make(map[string]string, 0)
+
+			wantVal := true
+
+			for {
+
+				var k string
+
+				var tmpJMetadata string
+
+				tok = fs.Scan()
+				if tok == fflib.FFTok_error {
+					goto tokerror
+				}
+				if tok == fflib.FFTok_right_bracket {
+					break
+				}
+
+				if tok == fflib.FFTok_comma {
+					if wantVal == true {
+						// TODO(pquerna): this isn't an ideal error message, this handles
+						// things like [,,,] as an array value.
+						return fs.WrapErr(fmt.Errorf("wanted value token, but got token: %v", tok))
+					}
+					continue
+				} else {
+					wantVal = true
+				}
+
+				/* handler: k type=string kind=string quoted=false*/
+
+				{
+
+					{
+						if tok != fflib.FFTok_string && tok != fflib.FFTok_null {
+							return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for string", tok))
+						}
+					}
+
+					if tok == fflib.FFTok_null {
+
+					} else {
+
+						outBuf := fs.Output.Bytes()
+
+						k = string(string(outBuf))
+
+					}
+				}
+
+				// Expect ':' after key
+				tok = fs.Scan()
+				if tok != fflib.FFTok_colon {
+					return fs.WrapErr(fmt.Errorf("wanted colon token, but got token: %v", tok))
+				}
+
+				tok = fs.Scan()
+				/* handler: tmpJMetadata type=string kind=string quoted=false*/
+
+				{
+
+					{
+						if tok != fflib.FFTok_string && tok != fflib.FFTok_null {
+							return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for string", tok))
+						}
+					}
+
+					if tok == fflib.FFTok_null {
+
+					} else {
+
+						outBuf := fs.Output.Bytes()
+
+						tmpJMetadata = string(string(outBuf))
+
+					}
+				}
+
+				j.Metadata[k] = tmpJMetadata
+
+				wantVal = false
+			}
+
+		}
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_Reporter:
+
+	/* handler: j.Reporter type=string kind=string quoted=false*/
+
+	{
+
+		{
+			if tok != fflib.FFTok_string && tok != fflib.FFTok_null {
+				return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for string", tok))
+			}
+		}
+
+		if tok == fflib.FFTok_null {
+
+		} else {
+
+			outBuf := fs.Output.Bytes()
+
+			j.Reporter = string(string(outBuf))
+
+		}
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_Resources:
+
+	/* handler: j.Resources type=service.Resources kind=struct quoted=false*/
+
+	{
+		/* Falling back. type=service.Resources kind=struct */
 		tbuf, err := fs.CaptureField(tok)
 		if err != nil {
 			return fs.WrapErr(err)
 		}
 
-		err = uj.Updated.UnmarshalJSON(tbuf)
+		err = json.Unmarshal(tbuf, &j.Resources)
 		if err != nil {
 			return fs.WrapErr(err)
 		}
-		state = fflib.FFParse_after_value
 	}
 
 	state = fflib.FFParse_after_value
 	goto mainparse
 
-handle_ProxyMode:
+handle_DrainedUntil:
 
-	/* handler: uj.ProxyMode type=string kind=string quoted=false*/
+	/* handler: j.DrainedUntil type=time.Time kind=struct quoted=false*/
 
 	{
+		if tok == fflib.FFTok_null {
 
-		{
-			if tok != fflib.FFTok_string && tok != fflib.FFTok_null {
-				return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for string", tok))
+			j.DrainedUntil = nil
+
+		} else {
+
+			tbuf, err := fs.CaptureField(tok)
+			if err != nil {
+				return fs.WrapErr(err)
+			}
+
+			if j.DrainedUntil == nil {
+				j.DrainedUntil = new(time.Time)
+			}
+
+			err = j.DrainedUntil.UnmarshalJSON(tbuf)
+			if err != nil {
+				return fs.WrapErr(err)
 			}
 		}
+		state = fflib.FFParse_after_value
+	}
+
+	state = fflib.FFParse_after_value
+	goto mainparse
+
+handle_Weight:
+
+	/* handler: j.Weight type=int kind=int quoted=false*/
+
+	{
+		if tok != fflib.FFTok_integer && tok != fflib.FFTok_null {
+			return fs.WrapErr(fmt.Errorf("cannot unmarshal %s into Go value for int", tok))
+		}
+	}
+
+	{
 
 		if tok == fflib.FFTok_null {
 
 		} else {
 
-			outBuf := fs.Output.Bytes()
+			tval, err := fflib.ParseInt(fs.Output.Bytes(), 10, 64)
+
+			if err != nil {
+				return fs.WrapErr(err)
+			}
 
-			uj.ProxyMode = string(string(outBuf))
+			j.Weight = int(tval)
 
 		}
 	}
@@ -968,7 +1659,7 @@ handle_ProxyMode:
 
 handle_Status:
 
-	/* handler: uj.Status type=int kind=int quoted=false*/
+	/* handler: j.Status type=int kind=int quoted=false*/
 
 	{
 		if tok != fflib.FFTok_integer && tok != fflib.FFTok_null {
@@ -988,7 +1679,7 @@ handle_Status:
 				return fs.WrapErr(err)
 			}
 
-			uj.Status = int(tval)
+			j.Status = int(tval)
 
 		}
 	}
@@ -14,8 +14,8 @@ func Test_PortForServicePort(t *testing.T) {
 		svc := &Service{
 			ID: "deadbeef001",
 			Ports: []Port{
-				{"tcp", 8173, 8080, "127.0.0.1"},
-				{"udp", 8172, 8080, "127.0.0.1"},
+				{Type: "tcp", Port: 8173, ServicePort: 8080, IP: "127.0.0.1"},
+				{Type: "udp", Port: 8172, ServicePort: 8080, IP: "127.0.0.1"},
 			},
 		}
 
@@ -26,6 +26,14 @@ func Test_PortForServicePort(t *testing.T) {
 		Convey("Returns -1 when there is no match", func() {
 			So(svc.PortForServicePort(8090, "tcp"), ShouldEqual, -1)
 		})
+
+		Convey("PortAlive() follows the port's own status", func() {
+			So(svc.PortAlive(8080), ShouldBeTrue)
+
+			svc.Ports[1].Status = UNHEALTHY
+			So(svc.PortAlive(8080), ShouldBeFalse)
+			So(svc.PortAlive(9090), ShouldBeTrue)
+		})
 	})
 }
 
@@ -60,6 +68,13 @@ func Test_buildPortFor(t *testing.T) {
 			So(port.IP, ShouldEqual, ip)
 		})
 
+		Convey("Takes the port name from the label", func() {
+			container.Labels["PortName_80"] = "admin"
+			port := buildPortFor(&dPort, container, ip)
+
+			So(port.Name, ShouldEqual, "admin")
+		})
+
 		Convey("Skips the service port when there is none", func() {
 			delete(container.Labels, "ServicePort_80")
 			port := buildPortFor(&dPort, container, ip)
@@ -135,6 +150,178 @@ func Test_ToService(t *testing.T) {
 			So(service.Updated, ShouldNotBeNil)
 			So(service.ProxyMode, ShouldEqual, "tcp")
 			So(service.Status, ShouldEqual, 0)
+			So(service.IPFamily, ShouldEqual, "")
+		})
+
+		Convey("Restricts the service to an address family from the label", func() {
+			sampleAPIContainer.Labels["IPFamily"] = "ipv6"
+			defer delete(sampleAPIContainer.Labels, "IPFamily")
+
+			So(ToService(sampleAPIContainer, "127.0.0.1").IPFamily, ShouldEqual, IPFamilyV6)
+		})
+
+		Convey("Ignores an invalid address family label", func() {
+			sampleAPIContainer.Labels["IPFamily"] = "ipx"
+			defer delete(sampleAPIContainer.Labels, "IPFamily")
+
+			So(ToService(sampleAPIContainer, "127.0.0.1").IPFamily, ShouldEqual, "")
+		})
+
+		Convey("Takes the TLS certificate from the label", func() {
+			sampleAPIContainer.Labels["TLSCert"] = "www.example.com"
+			defer delete(sampleAPIContainer.Labels, "TLSCert")
+
+			So(ToService(sampleAPIContainer, "127.0.0.1").TLSCert, ShouldEqual, "www.example.com")
+		})
+
+		Convey("Takes the public hostnames from the label", func() {
+			sampleAPIContainer.Labels["PublicHostnames"] = "WWW.example.com, example.com,"
+			defer delete(sampleAPIContainer.Labels, "PublicHostnames")
+
+			So(ToService(sampleAPIContainer, "127.0.0.1").PublicHostnames, ShouldResemble,
+				[]string{"www.example.com", "example.com"})
+		})
+
+		Convey("Takes the source routes from the label", func() {
+			sampleAPIContainer.Labels["SourceRoutes"] = "10.1.0.0/16=web-staging"
+			defer delete(sampleAPIContainer.Labels, "SourceRoutes")
+
+			svc := ToService(sampleAPIContainer, "127.0.0.1")
+			So(svc.Metadata["SourceRoutes"], ShouldEqual, "10.1.0.0/16=web-staging")
+			So(svc.SourceRoutes(), ShouldResemble, []SourceRoute{{Source: "10.1.0.0/16", Service: "web-staging"}})
+		})
+
+		Convey("Takes the mirror settings from the labels", func() {
+			sampleAPIContainer.Labels["MirrorTo"] = "web-next"
+			sampleAPIContainer.Labels["MirrorPercent"] = "10"
+			defer delete(sampleAPIContainer.Labels, "MirrorTo")
+			defer delete(sampleAPIContainer.Labels, "MirrorPercent")
+
+			svc := ToService(sampleAPIContainer, "127.0.0.1")
+			mirror, err := svc.Mirror()
+			So(err, ShouldBeNil)
+			So(mirror, ShouldResemble, &Mirror{Service: "web-next", Percent: 10})
+		})
+
+		Convey("Takes the connection limit hints from the labels", func() {
+			sampleAPIContainer.Labels["MaxConn"] = "50"
+			defer delete(sampleAPIContainer.Labels, "MaxConn")
+
+			svc := ToService(sampleAPIContainer, "127.0.0.1")
+			So(svc.Metadata["MaxConn"], ShouldEqual, "50")
+		})
+
+		Convey("Takes the weight from the label", func() {
+			sampleAPIContainer.Labels["Weight"] = " 10"
+			defer delete(sampleAPIContainer.Labels, "Weight")
+
+			svc := ToService(sampleAPIContainer, "127.0.0.1")
+			So(svc.Weight, ShouldEqual, 10)
+		})
+
+		Convey("Ignores an invalid weight label", func() {
+			sampleAPIContainer.Labels["Weight"] = "257"
+			defer delete(sampleAPIContainer.Labels, "Weight")
+
+			svc := ToService(sampleAPIContainer, "127.0.0.1")
+			So(svc.Weight, ShouldEqual, 0)
+		})
+
+		Convey("Takes the virtual hosts from the labels", func() {
+			sampleAPIContainer.Labels["VirtualHosts"] = "API.example.com, api"
+			sampleAPIContainer.Labels["VirtualHostPort"] = "8080"
+			defer delete(sampleAPIContainer.Labels, "VirtualHosts")
+			defer delete(sampleAPIContainer.Labels, "VirtualHostPort")
+
+			svc := ToService(sampleAPIContainer, "127.0.0.1")
+			hostnames, port, err := svc.VirtualHosts()
+			So(err, ShouldBeNil)
+			So(hostnames, ShouldResemble, []string{"api.example.com", "api"})
+			So(port, ShouldEqual, 8080)
+		})
+
+		Convey("Takes the path prefixes from the label", func() {
+			sampleAPIContainer.Labels["PathPrefixes"] = "/api/v2"
+			defer delete(sampleAPIContainer.Labels, "PathPrefixes")
+
+			svc := ToService(sampleAPIContainer, "127.0.0.1")
+			So(svc.PathPrefixes(), ShouldResemble, []string{"/api/v2"})
+		})
+
+		Convey("Takes the decision settings from the labels", func() {
+			sampleAPIContainer.Labels["RateLimit"] = "100/m"
+			sampleAPIContainer.Labels["AllowedSources"] = "10.1.0.0/16"
+			defer delete(sampleAPIContainer.Labels, "RateLimit")
+			defer delete(sampleAPIContainer.Labels, "AllowedSources")
+
+			svc := ToService(sampleAPIContainer, "127.0.0.1")
+			So(svc.WantsDecisions(), ShouldBeTrue)
+			limit, err := svc.RateLimit()
+			So(err, ShouldBeNil)
+			So(limit, ShouldResemble, &RateLimit{Requests: 100, Per: time.Minute})
+			So(len(svc.AllowedSources()), ShouldEqual, 1)
+			So(svc.AllowedSources()[0].String(), ShouldEqual, "10.1.0.0/16")
+		})
+	})
+}
+
+func Test_SourceRoutes(t *testing.T) {
+	Convey("ParseSourceRoutes()", t, func() {
+		Convey("parses the routes and normalizes the sources", func() {
+			routes, err := ParseSourceRoutes("10.1.2.3/16=web-staging, 192.168.0.9 = web-canary:9080,fd00::/8=web-staging,")
+			So(err, ShouldBeNil)
+			So(routes, ShouldResemble, []SourceRoute{
+				{Source: "10.1.0.0/16", Service: "web-staging"},
+				{Source: "192.168.0.9/32", Service: "web-canary", Port: 9080},
+				{Source: "fd00::/8", Service: "web-staging"},
+			})
+		})
+
+		Convey("leaves out and reports invalid entries", func() {
+			routes, err := ParseSourceRoutes("10.1.0.0/16=web-staging,10.2.0.0/33=web-staging,10.3.0.0/16=,web,10.5.0.0/16=web:http")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "10.2.0.0/33=web-staging")
+			So(err.Error(), ShouldContainSubstring, "'web'")
+			So(err.Error(), ShouldContainSubstring, "web:http")
+			So(len(routes), ShouldEqual, 1)
+		})
+
+		Convey("returns nothing for a service without routes", func() {
+			svc := &Service{Name: "web"}
+			So(svc.SourceRoutes(), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Mirror()", t, func() {
+		svc := &Service{Name: "web", Metadata: map[string]string{"MirrorTo": "web-next:9080"}}
+
+		Convey("mirrors all of the requests by default", func() {
+			mirror, err := svc.Mirror()
+			So(err, ShouldBeNil)
+			So(mirror, ShouldResemble, &Mirror{Service: "web-next", Port: 9080, Percent: 100})
+		})
+
+		Convey("mirrors a percentage of the requests", func() {
+			svc.Metadata["MirrorPercent"] = "5%"
+			mirror, err := svc.Mirror()
+			So(err, ShouldBeNil)
+			So(mirror.Percent, ShouldEqual, 5)
+		})
+
+		Convey("rejects invalid percentages and targets", func() {
+			svc.Metadata["MirrorPercent"] = "150"
+			_, err := svc.Mirror()
+			So(err, ShouldNotBeNil)
+
+			svc.Metadata = map[string]string{"MirrorTo": ":9080"}
+			_, err = svc.Mirror()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("returns nil when the requests aren't mirrored", func() {
+			mirror, err := (&Service{Name: "web"}).Mirror()
+			So(err, ShouldBeNil)
+			So(mirror, ShouldBeNil)
 		})
 	})
 }
@@ -158,3 +345,356 @@ func Test_IsStale(t *testing.T) {
 		})
 	})
 }
+
+func Test_Resources(t *testing.T) {
+	Convey("Resources", t, func() {
+		Convey("survive encoding and decoding", func() {
+			collected := time.Now().UTC().Round(time.Second)
+			svc := &Service{
+				ID:        "deadbeef123",
+				Name:      "hrunting",
+				Resources: &Resources{CPUPercent: 12.5, MemoryBytes: 2048, MemoryLimit: 4096, Collected: collected},
+			}
+
+			encoded, err := svc.Encode()
+			So(err, ShouldBeNil)
+
+			var decoded Service
+			So(decoded.UnmarshalJSON(encoded), ShouldBeNil)
+			So(decoded.Resources, ShouldResemble, svc.Resources)
+		})
+
+		Convey("are left out when there are none", func() {
+			encoded, _ := (&Service{ID: "deadbeef123"}).Encode()
+			So(string(encoded), ShouldNotContainSubstring, "Resources")
+		})
+	})
+}
+
+func Test_Weight(t *testing.T) {
+	Convey("Weight", t, func() {
+		Convey("survives encoding and decoding", func() {
+			encoded, err := (&Service{ID: "deadbeef123", Weight: 25}).Encode()
+			So(err, ShouldBeNil)
+
+			var decoded Service
+			So(decoded.UnmarshalJSON(encoded), ShouldBeNil)
+			So(decoded.Weight, ShouldEqual, 25)
+		})
+
+		Convey("is left out when there is none", func() {
+			encoded, _ := (&Service{ID: "deadbeef123"}).Encode()
+			So(string(encoded), ShouldNotContainSubstring, "Weight")
+		})
+
+		Convey("ParseWeight() only takes weights from 1 to 256", func() {
+			weight, err := ParseWeight("256")
+			So(err, ShouldBeNil)
+			So(weight, ShouldEqual, 256)
+
+			for _, value := range []string{"0", "-1", "257", "heavy", ""} {
+				weight, err = ParseWeight(value)
+				So(err, ShouldNotBeNil)
+				So(weight, ShouldEqual, 0)
+			}
+		})
+	})
+}
+
+func Test_ConnectionLimit(t *testing.T) {
+	Convey("ConnectionLimit()", t, func() {
+		svc := &Service{
+			Name:      "hrunting",
+			Metadata:  map[string]string{},
+			Resources: &Resources{MemoryLimit: 256 << 20},
+		}
+
+		Convey("divides the memory limit by the memory for each connection", func() {
+			limit, err := svc.ConnectionLimit(1 << 20, 0)
+			So(err, ShouldBeNil)
+			So(limit, ShouldEqual, 256)
+
+			svc.Metadata["MemoryPerConn"] = "4MiB"
+			limit, err = svc.ConnectionLimit(1 << 20, 0)
+			So(err, ShouldBeNil)
+			So(limit, ShouldEqual, 64)
+		})
+
+		Convey("doesn't go below the minimum", func() {
+			limit, _ := svc.ConnectionLimit(1<<20, 500)
+			So(limit, ShouldEqual, 500)
+
+			svc.Metadata["MaxConn"] = "30"
+			limit, _ = svc.ConnectionLimit(1<<20, 500)
+			So(limit, ShouldEqual, 30)
+		})
+
+		Convey("uses the MaxConn hint as it is", func() {
+			svc.Metadata["MaxConn"] = "30"
+			limit, _ := svc.ConnectionLimit(1 << 20, 0)
+			So(limit, ShouldEqual, 30)
+		})
+
+		Convey("ignores and reports invalid hints", func() {
+			svc.Metadata["MaxConn"] = "lots"
+			svc.Metadata["MemoryPerConn"] = "2X"
+			limit, err := svc.ConnectionLimit(1 << 20, 0)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "MaxConn 'lots'")
+			So(err.Error(), ShouldContainSubstring, "MemoryPerConn '2X'")
+			So(limit, ShouldEqual, 256)
+		})
+
+		Convey("returns 0 without a memory limit", func() {
+			svc.Resources = nil
+			limit, err := svc.ConnectionLimit(1 << 20, 0)
+			So(err, ShouldBeNil)
+			So(limit, ShouldEqual, 0)
+		})
+	})
+
+	Convey("ParseBytes()", t, func() {
+		for value, expected := range map[string]uint64{
+			"512": 512, "64k": 64 << 10, "2M": 2 << 20, "1GiB": 1 << 30, " 3 MB ": 3 << 20,
+		} {
+			size, err := ParseBytes(value)
+			So(err, ShouldBeNil)
+			So(size, ShouldEqual, expected)
+		}
+
+		_, err := ParseBytes("M")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func Test_Decisions(t *testing.T) {
+	Convey("ParseRateLimit()", t, func() {
+		Convey("defaults to requests per second", func() {
+			limit, err := ParseRateLimit(" 20 ")
+			So(err, ShouldBeNil)
+			So(limit, ShouldResemble, &RateLimit{Requests: 20, Per: time.Second})
+		})
+
+		Convey("takes the period as a unit or a duration", func() {
+			limit, err := ParseRateLimit("5/h")
+			So(err, ShouldBeNil)
+			So(limit.Per, ShouldEqual, time.Hour)
+
+			limit, err = ParseRateLimit("5 / 10s")
+			So(err, ShouldBeNil)
+			So(limit, ShouldResemble, &RateLimit{Requests: 5, Per: 10 * time.Second})
+		})
+
+		Convey("returns an error for invalid limits", func() {
+			for _, value := range []string{"", "0/s", "lots", "5/fortnight", "5/-1s"} {
+				_, err := ParseRateLimit(value)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+
+	Convey("ParseAllowedSources()", t, func() {
+		Convey("parses CIDRs and addresses, and reports the invalid ones", func() {
+			sources, err := ParseAllowedSources("10.1.2.3/16, 192.168.0.9,fd00::/8,10.2.0.0/33,")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "'10.2.0.0/33'")
+			So(len(sources), ShouldEqual, 3)
+			So(sources[0].String(), ShouldEqual, "10.1.0.0/16")
+			So(sources[1].String(), ShouldEqual, "192.168.0.9/32")
+			So(sources[2].String(), ShouldEqual, "fd00::/8")
+		})
+	})
+
+	Convey("WantsDecisions()", t, func() {
+		So((&Service{}).WantsDecisions(), ShouldBeFalse)
+		So((&Service{Metadata: map[string]string{"MaxConn": "10"}}).WantsDecisions(), ShouldBeFalse)
+		So((&Service{Metadata: map[string]string{"AllowedSources": "10.0.0.0/8"}}).WantsDecisions(), ShouldBeTrue)
+	})
+}
+
+func Test_VirtualHosts(t *testing.T) {
+	Convey("VirtualHosts()", t, func() {
+		Convey("leaves the port to the proxy when it isn't given", func() {
+			svc := &Service{Metadata: map[string]string{"VirtualHosts": "api"}}
+			hostnames, port, err := svc.VirtualHosts()
+			So(err, ShouldBeNil)
+			So(hostnames, ShouldResemble, []string{"api"})
+			So(port, ShouldEqual, 0)
+		})
+
+		Convey("returns an error for an invalid port", func() {
+			svc := &Service{Metadata: map[string]string{"VirtualHosts": "api", "VirtualHostPort": "http"}}
+			hostnames, port, err := svc.VirtualHosts()
+			So(err, ShouldNotBeNil)
+			So(hostnames, ShouldResemble, []string{"api"})
+			So(port, ShouldEqual, 0)
+		})
+
+		Convey("returns nothing for a service without them", func() {
+			hostnames, _, _ := (&Service{}).VirtualHosts()
+			So(hostnames, ShouldBeEmpty)
+		})
+	})
+
+	Convey("SNIHosts()", t, func() {
+		Convey("takes exact and wildcard hostnames and the port", func() {
+			svc := &Service{Metadata: map[string]string{"SNIHosts": "DB.example.com, *.db.example.com", "SNIPort": "5432"}}
+			hostnames, port, err := svc.SNIHosts()
+			So(err, ShouldBeNil)
+			So(hostnames, ShouldResemble, []string{"db.example.com", "*.db.example.com"})
+			So(port, ShouldEqual, 5432)
+		})
+
+		Convey("reports the invalid hostnames and port", func() {
+			svc := &Service{Metadata: map[string]string{"SNIHosts": "db,*.,db.*.example.com", "SNIPort": "tls"}}
+			hostnames, port, err := svc.SNIHosts()
+			So(err, ShouldNotBeNil)
+			So(hostnames, ShouldResemble, []string{"db"})
+			So(port, ShouldEqual, 0)
+
+			svc.Metadata["SNIPort"] = ""
+			_, _, err = svc.SNIHosts()
+			So(err.Error(), ShouldContainSubstring, "'*.', 'db.*.example.com'")
+		})
+	})
+
+	Convey("ParsePathPrefixes()", t, func() {
+		Convey("drops the trailing slashes", func() {
+			prefixes, err := ParsePathPrefixes("/api/v2/, /static,/,")
+			So(err, ShouldBeNil)
+			So(prefixes, ShouldResemble, []string{"/api/v2", "/static", "/"})
+		})
+
+		Convey("reports the invalid entries", func() {
+			prefixes, err := ParsePathPrefixes("api,/api/v2,/a b,/x?y")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "'api', '/a b', '/x?y'")
+			So(prefixes, ShouldResemble, []string{"/api/v2"})
+		})
+	})
+}
+
+func Test_TrafficSplit(t *testing.T) {
+	Convey("ParseTrafficSplit()", t, func() {
+		Convey("returns the shares largest first", func() {
+			shares, err := ParseTrafficSplit("v2=5%, v1=95, v0=0,")
+			So(err, ShouldBeNil)
+			So(shares, ShouldResemble, []VersionShare{{"v1", 95}, {"v2", 5}, {"v0", 0}})
+		})
+
+		Convey("returns nothing when the traffic isn't split", func() {
+			shares, err := ParseTrafficSplit("")
+			So(err, ShouldBeNil)
+			So(shares, ShouldBeNil)
+		})
+
+		Convey("rejects the whole split when an entry is invalid", func() {
+			shares, err := ParseTrafficSplit("v1=95,v2,v1=5,=1,v3=lots")
+			So(shares, ShouldBeNil)
+			So(err.Error(), ShouldContainSubstring, "'v2', 'v1=5', '=1', 'v3=lots'")
+		})
+
+		Convey("rejects a split that doesn't add up to 100", func() {
+			shares, err := ParseTrafficSplit("v1=90,v2=5")
+			So(shares, ShouldBeNil)
+			So(err.Error(), ShouldContainSubstring, "add up to 95")
+		})
+	})
+}
+
+func Test_Stickiness(t *testing.T) {
+	Convey("Stickiness()", t, func() {
+		Convey("defaults the cookie name", func() {
+			svc := &Service{Metadata: map[string]string{"Stickiness": "Cookie"}}
+			sticky, err := svc.Stickiness()
+			So(err, ShouldBeNil)
+			So(sticky, ShouldResemble, &Stickiness{Mode: StickyCookie, Cookie: DefaultStickyCookie})
+		})
+
+		Convey("takes the expiry of source stickiness", func() {
+			svc := &Service{Metadata: map[string]string{"Stickiness": "source", "StickyExpire": "2h"}}
+			sticky, err := svc.Stickiness()
+			So(err, ShouldBeNil)
+			So(sticky, ShouldResemble, &Stickiness{Mode: StickySource, Expire: 2 * time.Hour})
+		})
+
+		Convey("returns an error for invalid settings", func() {
+			for _, metadata := range []map[string]string{
+				{"Stickiness": "magic"},
+				{"Stickiness": "cookie", "StickyCookie": "a;b"},
+				{"Stickiness": "source", "StickyExpire": "10ms"},
+			} {
+				sticky, err := (&Service{Metadata: metadata}).Stickiness()
+				So(err, ShouldNotBeNil)
+				So(sticky, ShouldBeNil)
+			}
+		})
+
+		Convey("returns nothing for a service without it", func() {
+			sticky, err := (&Service{}).Stickiness()
+			So(err, ShouldBeNil)
+			So(sticky, ShouldBeNil)
+		})
+	})
+}
+
+func Test_ProxyCheck(t *testing.T) {
+	Convey("ProxyCheck()", t, func() {
+		Convey("parses the check the health monitor announced", func() {
+			svc := &Service{Metadata: map[string]string{
+				"ProxyCheckPath": "/status/check", "ProxyCheckPort": "8080", "ProxyCheckInterval": "3s",
+			}}
+			check, err := svc.ProxyCheck()
+			So(err, ShouldBeNil)
+			So(check, ShouldResemble, &ProxyCheck{Path: "/status/check", ServicePort: 8080, Interval: 3 * time.Second})
+		})
+
+		Convey("returns an error for invalid settings", func() {
+			for _, metadata := range []map[string]string{
+				{"ProxyCheckPath": "status", "ProxyCheckPort": "8080", "ProxyCheckInterval": "3s"},
+				{"ProxyCheckPath": "/status check", "ProxyCheckPort": "8080", "ProxyCheckInterval": "3s"},
+				{"ProxyCheckPath": "/status", "ProxyCheckPort": "http", "ProxyCheckInterval": "3s"},
+				{"ProxyCheckPath": "/status", "ProxyCheckPort": "8080"},
+			} {
+				check, err := (&Service{Metadata: metadata}).ProxyCheck()
+				So(err, ShouldNotBeNil)
+				So(check, ShouldBeNil)
+			}
+		})
+
+		Convey("returns nothing for a service without one", func() {
+			check, err := (&Service{}).ProxyCheck()
+			So(err, ShouldBeNil)
+			So(check, ShouldBeNil)
+		})
+	})
+}
+
+func Test_Timeouts(t *testing.T) {
+	Convey("Timeouts()", t, func() {
+		Convey("parses the timeouts and retries", func() {
+			svc := &Service{Metadata: map[string]string{
+				"ConnectTimeout": "2s", "ServerTimeout": "5m", "Retries": "0",
+			}}
+			timeouts, err := svc.Timeouts()
+			So(err, ShouldBeNil)
+			So(timeouts, ShouldResemble, Timeouts{Connect: 2 * time.Second, Server: 5 * time.Minute, Retries: 0})
+		})
+
+		Convey("keeps the valid ones when others are invalid", func() {
+			svc := &Service{Metadata: map[string]string{
+				"ConnectTimeout": "soon", "ClientTimeout": "30s", "Retries": "-1",
+			}}
+			timeouts, err := svc.Timeouts()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "ConnectTimeout 'soon', Retries '-1'")
+			So(timeouts, ShouldResemble, Timeouts{Client: 30 * time.Second, Retries: -1})
+		})
+
+		Convey("leaves everything unset for a service without them", func() {
+			timeouts, err := (&Service{}).Timeouts()
+			So(err, ShouldBeNil)
+			So(timeouts, ShouldResemble, Timeouts{Retries: -1})
+		})
+	})
+}
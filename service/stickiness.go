@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The Metadata keys, and Docker labels, that keep each client of a service
+// on the same instance
+const (
+	StickinessKey   = "Stickiness"
+	StickyCookieKey = "StickyCookie"
+	StickyExpireKey = "StickyExpire"
+)
+
+// StickinessKeys are all of the Metadata keys above
+var StickinessKeys = []string{StickinessKey, StickyCookieKey, StickyExpireKey}
+
+// The ways a client can be kept on an instance
+const (
+	StickyCookie = "cookie" // By a cookie the proxy sets, for HTTP services
+	StickySource = "source" // By the client's source address
+)
+
+const (
+	// The cookie the proxy sets when a service doesn't name one
+	DefaultStickyCookie = "SidecarServer"
+	// How long a client stays on an instance by its source address after it
+	// was last seen, when a service doesn't say
+	DefaultStickyExpire = 30 * time.Minute
+)
+
+var validStickyCookie = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Stickiness is how the proxy keeps the clients of a service on the same
+// instance
+type Stickiness struct {
+	Mode   string
+	Cookie string        // The name of the cookie, for StickyCookie
+	Expire time.Duration // How long a client is remembered, for StickySource
+}
+
+// Stickiness returns how the service's Metadata asks for its clients to be
+// kept on the same instance, or nil when they aren't
+func (svc *Service) Stickiness() (*Stickiness, error) {
+	mode := strings.ToLower(strings.TrimSpace(svc.Metadata[StickinessKey]))
+	switch mode {
+	case "":
+		return nil, nil
+	case StickyCookie:
+		cookie := strings.TrimSpace(svc.Metadata[StickyCookieKey])
+		if cookie == "" {
+			cookie = DefaultStickyCookie
+		}
+		if !validStickyCookie.MatchString(cookie) {
+			return nil, fmt.Errorf("Error parsing sticky cookie name '%s'", cookie)
+		}
+		return &Stickiness{Mode: StickyCookie, Cookie: cookie}, nil
+	case StickySource:
+		expire := DefaultStickyExpire
+		if value := strings.TrimSpace(svc.Metadata[StickyExpireKey]); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < time.Second {
+				return nil, fmt.Errorf("Error parsing sticky expiry '%s': must be a second or more", value)
+			}
+			expire = parsed
+		}
+		return &Stickiness{Mode: StickySource, Expire: expire}, nil
+	default:
+		return nil, fmt.Errorf("Error parsing stickiness '%s': must be %s or %s", mode, StickyCookie, StickySource)
+	}
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Metadata keys, and Docker labels, that override the proxy's timeouts
+// and retries for a service
+const (
+	ConnectTimeoutKey = "ConnectTimeout"
+	ClientTimeoutKey  = "ClientTimeout"
+	ServerTimeoutKey  = "ServerTimeout"
+	RetriesKey        = "Retries"
+)
+
+// TimeoutKeys are all of the Metadata keys above
+var TimeoutKeys = []string{ConnectTimeoutKey, ClientTimeoutKey, ServerTimeoutKey, RetriesKey}
+
+// Timeouts are how long the proxy waits on a service, and how many times it
+// retries a connection to it. Durations of zero and Retries of -1 are unset.
+type Timeouts struct {
+	Connect time.Duration // To connect to a server
+	Client  time.Duration // For a client that has gone quiet
+	Server  time.Duration // For a server that has gone quiet
+	Retries int
+}
+
+// Timeouts returns the timeouts and retries the service's Metadata sets.
+// The valid ones are returned along with an error about the others.
+func (svc *Service) Timeouts() (Timeouts, error) {
+	timeouts := Timeouts{Retries: -1}
+	var invalid []string
+
+	for _, setting := range []struct {
+		key     string
+		timeout *time.Duration
+	}{
+		{ConnectTimeoutKey, &timeouts.Connect},
+		{ClientTimeoutKey, &timeouts.Client},
+		{ServerTimeoutKey, &timeouts.Server},
+	} {
+		value := strings.TrimSpace(svc.Metadata[setting.key])
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < time.Millisecond {
+			invalid = append(invalid, setting.key+" '"+value+"'")
+			continue
+		}
+		*setting.timeout = parsed
+	}
+
+	if value := strings.TrimSpace(svc.Metadata[RetriesKey]); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			invalid = append(invalid, RetriesKey+" '"+value+"'")
+		} else {
+			timeouts.Retries = retries
+		}
+	}
+
+	if len(invalid) > 0 {
+		return timeouts, fmt.Errorf("Error parsing timeouts: %s", strings.Join(invalid, ", "))
+	}
+
+	return timeouts, nil
+}
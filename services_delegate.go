@@ -2,12 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/NinesStack/memberlist"
 	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/events"
 	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/wire"
 	metrics "github.com/armon/go-metrics"
 	"github.com/pquerna/ffjson/ffjson"
 	log "github.com/sirupsen/logrus"
@@ -24,11 +28,17 @@ type servicesDelegate struct {
 	Started           bool
 	StartedAt         time.Time
 	Metadata          NodeMetadata
+	Events            *events.Bus // Optional bus for hosts joining and leaving
+	// The format we'd rather gossip in, used once every peer reads it
+	WireEncoder wire.Encoder
+	peerFormats map[string][]string // What each peer reads, by name
+	formatsLock sync.Mutex
 }
 
 type NodeMetadata struct {
 	ClusterName string
 	State       string
+	Formats     []string `json:",omitempty"` // The wire formats it reads
 }
 
 func NewServicesDelegate(state *catalog.ServicesState) *servicesDelegate {
@@ -37,6 +47,7 @@ func NewServicesDelegate(state *catalog.ServicesState) *servicesDelegate {
 		pendingBroadcasts: make([][]byte, 0),
 		notifications:     make(chan []byte, 25),
 		Metadata:          NodeMetadata{ClusterName: "default"},
+		peerFormats:       make(map[string][]string),
 	}
 
 	return &delegate
@@ -147,7 +158,12 @@ func (d *servicesDelegate) LocalState(join bool) []byte {
 	log.Debugf("LocalState(): %t", join)
 	d.state.RLock()
 	defer d.state.RUnlock()
-	return d.state.Encode()
+
+	// A host that's joining may not have told us what it reads yet
+	if join {
+		return d.state.Encode()
+	}
+	return d.state.EncodeWith(d.state.WireEncoder())
 }
 
 func (d *servicesDelegate) MergeRemoteState(buf []byte, join bool) {
@@ -168,15 +184,63 @@ func (d *servicesDelegate) MergeRemoteState(buf []byte, join bool) {
 
 func (d *servicesDelegate) NotifyJoin(node *memberlist.Node) {
 	log.Debugf("NotifyJoin(): %s %s", node.Name, string(node.Meta))
+	d.recordFormats(node)
+	d.publishMembership("HostJoined", node, "%s joined the cluster")
 }
 
 func (d *servicesDelegate) NotifyLeave(node *memberlist.Node) {
 	log.Debugf("NotifyLeave(): %s", node.Name)
+	d.forgetFormats(node)
+	d.publishMembership("HostLeft", node, "%s left the cluster")
 	go d.state.ExpireServer(node.Name)
 }
 
+// recordFormats keeps the wire formats a peer reads, from its metadata, and
+// settles again on the one the services are broadcast in. Peers that don't
+// announce any only read JSON.
+func (d *servicesDelegate) recordFormats(node *memberlist.Node) {
+	var metadata NodeMetadata
+	if len(node.Meta) > 0 {
+		if err := json.Unmarshal(node.Meta, &metadata); err != nil {
+			log.Warnf("Can't read the metadata of %s, assuming it only reads JSON: %s", node.Name, err)
+		}
+	}
+
+	d.formatsLock.Lock()
+	defer d.formatsLock.Unlock()
+
+	d.peerFormats[node.Name] = metadata.Formats
+	d.state.SetWireEncoder(wire.Negotiate(d.WireEncoder, d.peerFormats))
+}
+
+// forgetFormats drops a peer that left from the negotiation
+func (d *servicesDelegate) forgetFormats(node *memberlist.Node) {
+	d.formatsLock.Lock()
+	defer d.formatsLock.Unlock()
+
+	delete(d.peerFormats, node.Name)
+	d.state.SetWireEncoder(wire.Negotiate(d.WireEncoder, d.peerFormats))
+}
+
+// publishMembership publishes an event about a host joining or leaving,
+// when there's a bus
+func (d *servicesDelegate) publishMembership(eventType string, node *memberlist.Node, format string) {
+	if d.Events == nil {
+		return
+	}
+
+	d.Events.Publish(events.Event{
+		Type:    eventType,
+		Source:  "memberlist",
+		Subject: node.Name,
+		Message: fmt.Sprintf(format, node.Name),
+		Details: map[string]string{"Hostname": node.Name, "Address": node.Address()},
+	})
+}
+
 func (d *servicesDelegate) NotifyUpdate(node *memberlist.Node) {
 	log.Debugf("NotifyUpdate(): %s", node.Name)
+	d.recordFormats(node)
 }
 
 // Try to pack as many messages into the packet as we can. Note that this
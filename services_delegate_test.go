@@ -1,9 +1,13 @@
 package main
 
 import (
+	"net"
 	"testing"
 
+	"github.com/NinesStack/memberlist"
 	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/wire"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -28,6 +32,33 @@ func Test_GetBroadcasts(t *testing.T) {
 			})
 		})
 
+		Convey("NotifyJoin()", func() {
+			Convey("Publishes an event when there's a bus", func() {
+				delegate.Events = events.NewBus(10)
+				delegate.NotifyJoin(&memberlist.Node{Name: "docker3", Addr: net.ParseIP("10.0.0.3"), Port: 7946})
+
+				recent := delegate.Events.Recent()
+				So(len(recent), ShouldEqual, 1)
+				So(recent[0].Type, ShouldEqual, "HostJoined")
+				So(recent[0].Subject, ShouldEqual, "docker3")
+			})
+
+			Convey("Gossips in the preferred format once every peer reads it", func() {
+				delegate.WireEncoder, _ = wire.ForName(wire.Msgpack)
+				withFormats := []byte(`{"ClusterName":"default","State":"Running","Formats":["msgpack","json"]}`)
+
+				delegate.NotifyJoin(&memberlist.Node{Name: "docker3", Meta: withFormats})
+				So(state.WireEncoder().Name(), ShouldEqual, wire.Msgpack)
+
+				old := &memberlist.Node{Name: "docker4", Meta: []byte(`{"ClusterName":"default","State":"Running"}`)}
+				delegate.NotifyJoin(old)
+				So(state.WireEncoder().Name(), ShouldEqual, wire.JSON)
+
+				delegate.NotifyLeave(old)
+				So(state.WireEncoder().Name(), ShouldEqual, wire.Msgpack)
+			})
+		})
+
 		Convey("NotifyMsg()", func() {
 			Convey("Pushes a message into the channel", func() {
 				delegate.NotifyMsg(bCast[0])
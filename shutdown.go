@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	shutdownHooks []func()
+	shutdownLock  sync.Mutex
+)
+
+// onShutdown registers a function to run before Sidecar exits on a signal.
+// Hooks are run in reverse order of registration.
+func onShutdown(fn func()) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// runShutdownHooks runs all the registered hooks, most recent first
+func runShutdownHooks() {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+
+	for i := len(shutdownHooks) - 1; i >= 0; i-- {
+		shutdownHooks[i]()
+	}
+	shutdownHooks = nil
+}
+
+// handleShutdownSignals captures SIGINT and SIGTERM, cleans up, and exits
+func handleShutdownSignals() {
+	sigChannel := make(chan os.Signal, 1)
+	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigChannel
+	log.Warnf("Captured %v, cleaning up and exiting..", sig)
+	runShutdownHooks()
+	os.Exit(0)
+}
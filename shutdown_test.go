@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ShutdownHooks(t *testing.T) {
+	Convey("Shutdown hooks", t, func() {
+		var order []int
+		onShutdown(func() { order = append(order, 1) })
+		onShutdown(func() { order = append(order, 2) })
+
+		Convey("run most recent first, only once", func() {
+			runShutdownHooks()
+			runShutdownHooks()
+			So(order, ShouldResemble, []int{2, 1})
+		})
+	})
+}
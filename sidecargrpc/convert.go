@@ -0,0 +1,98 @@
+package sidecargrpc
+
+import (
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/healthy"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// timestampToProto converts a time, leaving it out when it was never set
+func timestampToProto(t time.Time) *timestamp.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	ts, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil
+	}
+
+	return ts
+}
+
+// serviceToProto converts a service. The Status values are numbered the
+// same as the ones in the service package.
+func serviceToProto(svc *service.Service) *Service {
+	result := &Service{
+		Id:              svc.ID,
+		Name:            svc.Name,
+		Image:           svc.Image,
+		Created:         timestampToProto(svc.Created),
+		Hostname:        svc.Hostname,
+		Updated:         timestampToProto(svc.Updated),
+		ProxyMode:       svc.ProxyMode,
+		Status:          Status(svc.Status),
+		IpFamily:        svc.IPFamily,
+		TlsCert:         svc.TLSCert,
+		PublicHostnames: svc.PublicHostnames,
+		Metadata:        svc.Metadata,
+		Reporter:        svc.Reporter,
+	}
+
+	for _, port := range svc.Ports {
+		result.Ports = append(result.Ports, &Port{
+			Type:        port.Type,
+			Port:        port.Port,
+			ServicePort: port.ServicePort,
+			Ip:          port.IP,
+			Name:        port.Name,
+			Status:      Status(port.Status),
+		})
+	}
+
+	return result
+}
+
+func changeToProto(event *catalog.ChangeEvent) *StateChange {
+	return &StateChange{
+		Service:        serviceToProto(&event.Service),
+		PreviousStatus: Status(event.PreviousStatus),
+		Time:           timestampToProto(event.Time),
+		Version:        event.Version,
+	}
+}
+
+func checkToProto(check *healthy.CheckStatus) *Check {
+	return &Check{
+		Id:        check.ID,
+		Service:   check.Service,
+		Hostname:  check.Hostname,
+		Port:      check.Port,
+		Type:      check.Type,
+		Args:      check.Args,
+		Status:    check.Status,
+		Count:     int64(check.Count),
+		MaxCount:  int64(check.MaxCount),
+		LastError: check.LastError,
+		Latency:   ptypes.DurationProto(check.Latency),
+		LastRun:   timestampToProto(check.LastRun),
+		NextRun:   timestampToProto(check.NextRun),
+		Schedule:  check.Schedule,
+	}
+}
+
+func eventToProto(evt *events.Event) *Event {
+	return &Event{
+		Time:    timestampToProto(evt.Time),
+		Type:    evt.Type,
+		Source:  evt.Source,
+		Subject: evt.Subject,
+		Message: evt.Message,
+		Details: evt.Details,
+	}
+}
@@ -0,0 +1,218 @@
+package sidecargrpc
+
+//go:generate protoc --proto_path=.. --go_out=plugins=grpc,paths=source_relative:.. ../sidecargrpc/sidecar.proto
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/NinesStack/memberlist"
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/healthy"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A Server serves the Sidecar gRPC API from the same state, health checks,
+// and events as the HTTP API. The monitor and events may be nil when those
+// aren't running on this host, and the calls that need them fail.
+type Server struct {
+	UnimplementedSidecarServer
+
+	state   *catalog.ServicesState
+	list    *memberlist.Memberlist
+	monitor *healthy.Monitor
+	events  *events.Bus
+}
+
+func NewServer(state *catalog.ServicesState, list *memberlist.Memberlist,
+	monitor *healthy.Monitor, eventBus *events.Bus) *Server {
+
+	return &Server{state: state, list: list, monitor: monitor, events: eventBus}
+}
+
+// Serve registers the Server with a new gRPC server and serves it on the
+// listener until it fails
+func (s *Server) Serve(listener net.Listener) error {
+	grpcServer := grpc.NewServer()
+	RegisterSidecarServer(grpcServer, s)
+
+	return grpcServer.Serve(listener)
+}
+
+// ListServices returns the instances of every service in the cluster, or of
+// the one named in the request
+func (s *Server) ListServices(ctx context.Context, req *ListServicesRequest) (*ListServicesResponse, error) {
+	response := &ListServicesResponse{}
+	if s.list != nil {
+		response.ClusterName = s.list.ClusterName()
+	}
+
+	s.state.RLock()
+	response.Version = s.state.Version()
+	s.state.EachService(func(hostname *string, id *string, svc *service.Service) {
+		if req.GetName() == "" || svc.Name == req.GetName() {
+			response.Services = append(response.Services, serviceToProto(svc))
+		}
+	})
+	s.state.RUnlock()
+
+	sortServices(response.Services)
+
+	if req.GetName() != "" && len(response.Services) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no instances of %s found", req.GetName())
+	}
+
+	return response, nil
+}
+
+// ListChecks returns the health checks on this host
+func (s *Server) ListChecks(ctx context.Context, req *ListChecksRequest) (*ListChecksResponse, error) {
+	if s.monitor == nil {
+		return nil, status.Error(codes.Unavailable, "health checks aren't running on this host")
+	}
+
+	response := &ListChecksResponse{}
+	for _, check := range s.monitor.CheckStatuses() {
+		response.Checks = append(response.Checks, checkToProto(&check))
+	}
+
+	return response, nil
+}
+
+// ListEvents returns the most recent events on this host
+func (s *Server) ListEvents(ctx context.Context, req *ListEventsRequest) (*ListEventsResponse, error) {
+	if s.events == nil {
+		return nil, status.Error(codes.Unavailable, "events aren't kept on this host")
+	}
+
+	response := &ListEventsResponse{}
+	for _, evt := range s.events.Recent() {
+		response.Events = append(response.Events, eventToProto(&evt))
+	}
+
+	return response, nil
+}
+
+// Watch sends every instance in the state, and then each change as it
+// happens, until the client goes away. The listener is added before the
+// state is read, so a change in between may be sent twice but never missed.
+func (s *Server) Watch(req *WatchRequest, stream Sidecar_WatchServer) error {
+	listener := newWatchListener()
+	s.state.AddListener(listener)
+	defer func() {
+		if err := s.state.RemoveListener(listener.Name()); err != nil {
+			log.Warnf("Failed to remove gRPC listener: %s", err)
+		}
+	}()
+
+	wanted := make(map[string]bool, len(req.GetNames()))
+	for _, name := range req.GetNames() {
+		wanted[name] = true
+	}
+	matches := func(svc *service.Service) bool {
+		return len(wanted) == 0 || wanted[svc.Name]
+	}
+
+	var current []*Service
+	s.state.RLock()
+	version := s.state.Version()
+	s.state.EachService(func(hostname *string, id *string, svc *service.Service) {
+		if matches(svc) {
+			current = append(current, serviceToProto(svc))
+		}
+	})
+	s.state.RUnlock()
+
+	sortServices(current)
+	for _, svc := range current {
+		change := &StateChange{Service: svc, PreviousStatus: svc.Status, Time: svc.Updated, Version: version}
+		if err := stream.Send(change); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+
+		case event := <-listener.Chan():
+			if !matches(&event.Service) {
+				continue
+			}
+
+			if err := stream.Send(changeToProto(&event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// WatchEvents sends each new event as it happens, until the client goes away
+func (s *Server) WatchEvents(req *WatchEventsRequest, stream Sidecar_WatchEventsServer) error {
+	if s.events == nil {
+		return status.Error(codes.Unavailable, "events aren't kept on this host")
+	}
+
+	eventChan := s.events.Subscribe()
+	defer s.events.Unsubscribe(eventChan)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+
+		case evt := <-eventChan:
+			if err := stream.Send(eventToProto(&evt)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sortServices(services []*Service) {
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Name != services[j].Name {
+			return services[i].Name < services[j].Name
+		}
+		if services[i].Hostname != services[j].Hostname {
+			return services[i].Hostname < services[j].Hostname
+		}
+		return services[i].Id < services[j].Id
+	})
+}
+
+// A watchListener is the catalog.Listener for one Watch call
+type watchListener struct {
+	eventChan chan catalog.ChangeEvent
+	name      string
+}
+
+func newWatchListener() *watchListener {
+	return &watchListener{
+		name: fmt.Sprintf("grpcListener-%d", time.Now().UTC().UnixNano()),
+		// Listeners must have buffered channels. Like the HTTP watch, this
+		// is larger to give slow clients some room.
+		eventChan: make(chan catalog.ChangeEvent, 50),
+	}
+}
+
+func (w *watchListener) Chan() chan catalog.ChangeEvent {
+	return w.eventChan
+}
+
+func (w *watchListener) Name() string {
+	return w.name
+}
+
+func (w *watchListener) Managed() bool {
+	return false
+}
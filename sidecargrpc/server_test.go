@@ -0,0 +1,118 @@
+package sidecargrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/golang/protobuf/ptypes"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func Test_Server(t *testing.T) {
+	Convey("Server", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = "indomitable"
+		now := time.Now().UTC()
+
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef001", Name: "awesome-svc", Hostname: "indomitable", Updated: now,
+			Ports:    []service.Port{{Type: "tcp", Port: 32768, ServicePort: 8080, IP: "10.0.0.1"}},
+			Metadata: map[string]string{"team": "core"},
+		})
+		state.AddServiceEntry(service.Service{
+			ID: "deadbeef002", Name: "database", Hostname: "indomitable", Updated: now,
+			Status: service.UNHEALTHY,
+		})
+
+		bus := events.NewBus(10)
+		server := NewServer(state, nil, nil, bus)
+
+		listener := bufconn.Listen(1024 * 1024)
+		go server.Serve(listener)
+		defer listener.Close()
+
+		conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+				return listener.Dial()
+			}),
+		)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		client := NewSidecarClient(conn)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		Convey("lists the services", func() {
+			response, err := client.ListServices(ctx, &ListServicesRequest{})
+			So(err, ShouldBeNil)
+			So(response.Version, ShouldEqual, state.Version())
+			So(len(response.Services), ShouldEqual, 2)
+
+			svc := response.Services[0]
+			So(svc.Id, ShouldEqual, "deadbeef001")
+			So(svc.Metadata["team"], ShouldEqual, "core")
+			So(svc.Ports[0].ServicePort, ShouldEqual, 8080)
+			So(svc.Ports[0].Ip, ShouldEqual, "10.0.0.1")
+			updated, _ := ptypes.Timestamp(svc.Updated)
+			So(updated.Equal(now), ShouldBeTrue)
+			So(response.Services[1].Status, ShouldEqual, Status_UNHEALTHY)
+		})
+
+		Convey("lists one service by name, and none when it's unknown", func() {
+			response, err := client.ListServices(ctx, &ListServicesRequest{Name: "database"})
+			So(err, ShouldBeNil)
+			So(len(response.Services), ShouldEqual, 1)
+
+			_, err = client.ListServices(ctx, &ListServicesRequest{Name: "nope"})
+			So(status.Code(err), ShouldEqual, codes.NotFound)
+		})
+
+		Convey("says the checks are unavailable without a monitor", func() {
+			_, err := client.ListChecks(ctx, &ListChecksRequest{})
+			So(status.Code(err), ShouldEqual, codes.Unavailable)
+		})
+
+		Convey("lists the recent events", func() {
+			bus.Publish(events.Event{Time: now, Type: "SlowRequest", Source: "haproxy", Subject: "awesome-svc-8080"})
+
+			response, err := client.ListEvents(ctx, &ListEventsRequest{})
+			So(err, ShouldBeNil)
+			So(len(response.Events), ShouldEqual, 1)
+			So(response.Events[0].Subject, ShouldEqual, "awesome-svc-8080")
+		})
+
+		Convey("watches the services it's asked for", func() {
+			stream, err := client.Watch(ctx, &WatchRequest{Names: []string{"awesome-svc"}})
+			So(err, ShouldBeNil)
+
+			change, err := stream.Recv()
+			So(err, ShouldBeNil)
+			So(change.Service.Id, ShouldEqual, "deadbeef001")
+			So(change.PreviousStatus, ShouldEqual, Status_ALIVE)
+
+			state.AddServiceEntry(service.Service{
+				ID: "deadbeef003", Name: "database", Hostname: "indomitable", Updated: time.Now().UTC(),
+			})
+			state.AddServiceEntry(service.Service{
+				ID: "deadbeef001", Name: "awesome-svc", Hostname: "indomitable", Updated: time.Now().UTC(),
+				Status: service.DRAINING,
+			})
+
+			change, err = stream.Recv()
+			So(err, ShouldBeNil)
+			So(change.Service.Id, ShouldEqual, "deadbeef001")
+			So(change.Service.Status, ShouldEqual, Status_DRAINING)
+			So(change.Version, ShouldEqual, state.Version())
+		})
+	})
+}
@@ -1,21 +1,47 @@
 package sidecarhttp
 
 import (
+	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"time"
 
 	"github.com/NinesStack/memberlist"
+	"github.com/NinesStack/sidecar/affinity"
 	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/consistency"
+	"github.com/NinesStack/sidecar/discovery"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/haproxy"
+	"github.com/NinesStack/sidecar/healthy"
+	"github.com/NinesStack/sidecar/timeline"
+	"github.com/armon/go-metrics"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
+// ApiPort is the port the HTTP API and UI are served on
+const ApiPort = 7777
+
 type HttpConfig struct {
 	BindIP       string
 	UseHostnames bool
 }
 
+// ApiDeps holds the parts of Sidecar that the API reports on and controls,
+// beyond the memberlist and the state. Each of them is nil when the module
+// it belongs to is off.
+type ApiDeps struct {
+	Monitor   *healthy.Monitor
+	Metrics   *metrics.InmemSink
+	Events    *events.Bus
+	Timeline  *timeline.Timeline
+	Pins      *affinity.Store
+	Checker   *consistency.Checker
+	Proxy     *haproxy.HAproxy
+	Discovery *discovery.MultiDiscovery
+}
+
 func makeHandler(fn func(http.ResponseWriter, *http.Request,
 	*memberlist.Memberlist, *catalog.ServicesState, map[string]string),
 	list *memberlist.Memberlist, state *catalog.ServicesState) http.HandlerFunc {
@@ -53,12 +79,15 @@ func uiRedirectHandler(response http.ResponseWriter, req *http.Request) {
 	http.Redirect(response, req, "/ui/", 301)
 }
 
-func ServeHttp(list *memberlist.Memberlist, state *catalog.ServicesState, config *HttpConfig) {
+func ServeHttp(list *memberlist.Memberlist, state *catalog.ServicesState, deps *ApiDeps, config *HttpConfig) {
+
 	srvrsHandle := makeHandler(serversHandler, list, state)
 	staticFs := http.FileServer(http.Dir("views/static"))
 	uiFs := http.FileServer(http.Dir("ui/app"))
 
-	api := &SidecarApi{state: state, list: list}
+	api := &SidecarApi{state: state, list: list, monitor: deps.Monitor, metrics: deps.Metrics,
+		events: deps.Events, timeline: deps.Timeline, pins: deps.Pins, checker: deps.Checker,
+		proxy: deps.Proxy, discovery: deps.Discovery}
 	envoyApi := &EnvoyApi{state: state, list: list, config: config}
 
 	router := mux.NewRouter()
@@ -68,6 +97,8 @@ func ServeHttp(list *memberlist.Memberlist, state *catalog.ServicesState, config
 	router.PathPrefix("/ui").Handler(http.StripPrefix("/ui", uiFs))
 	router.PathPrefix("/api").Handler(http.StripPrefix("/api", api.HttpMux()))
 	router.PathPrefix("/v1").Handler(http.StripPrefix("/v1", envoyApi.HttpMux()))
+	router.HandleFunc("/status/runtime", wrap(api.runtimeHandler)).Methods("GET")
+	router.HandleFunc("/metrics", wrap(api.prometheusHandler)).Methods("GET")
 
 	// DEPRECATED - to be removed once common clients are updated
 	router.HandleFunc("/services.{extension}", wrap(api.servicesHandler)).Methods("GET")
@@ -77,7 +108,7 @@ func ServeHttp(list *memberlist.Memberlist, state *catalog.ServicesState, config
 
 	http.Handle("/", router)
 
-	err := http.ListenAndServe("0.0.0.0:7777", nil)
+	err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", ApiPort), nil)
 	if err != nil {
 		log.Fatalf("Can't start HTTP server: %s", err)
 	}
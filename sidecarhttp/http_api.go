@@ -6,15 +6,35 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/NinesStack/memberlist"
+	"github.com/NinesStack/sidecar/affinity"
 	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/consistency"
+	"github.com/NinesStack/sidecar/discovery"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/haproxy"
+	"github.com/NinesStack/sidecar/healthy"
 	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/timeline"
+	"github.com/armon/go-metrics"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// The response header carrying the state version, for blocking queries
+	IndexHeader = "X-Sidecar-Index"
+
+	DefaultBlockingWait = 5 * time.Minute
+	MaxBlockingWait     = 10 * time.Minute
+
+	// How many state changes are replayed at once unless the client says
+	DefaultChangesLimit = 1000
+)
+
 type ApiServer struct {
 	Name         string
 	LastUpdated  time.Time
@@ -25,19 +45,60 @@ type ApiServices struct {
 	Services       map[string][]*service.Service
 	ClusterMembers map[string]*ApiServer `json:",omitempty"`
 	ClusterName    string
+	Version        uint64
 }
 
 type SidecarApi struct {
-	list  *memberlist.Memberlist
-	state *catalog.ServicesState
+	list      *memberlist.Memberlist
+	state     *catalog.ServicesState
+	monitor   *healthy.Monitor
+	metrics   *metrics.InmemSink
+	events    *events.Bus
+	timeline  *timeline.Timeline
+	pins      *affinity.Store
+	checker   *consistency.Checker
+	proxy     *haproxy.HAproxy
+	discovery *discovery.MultiDiscovery
 }
 
 func (s *SidecarApi) HttpMux() http.Handler {
 	router := mux.NewRouter()
 	router.HandleFunc("/services/{name}.{extension}", wrap(s.oneServiceHandler)).Methods("GET")
 	router.HandleFunc("/services/{id}/drain", wrap(s.drainServiceHandler)).Methods("POST")
+	router.HandleFunc("/services/{name}/ready", wrap(s.readyHandler)).Methods("GET")
 	router.HandleFunc("/services.{extension}", wrap(s.servicesHandler)).Methods("GET")
 	router.HandleFunc("/state.{extension}", wrap(s.stateHandler)).Methods("GET")
+	router.HandleFunc("/opinions.{extension}", wrap(s.opinionsHandler)).Methods("GET")
+	router.HandleFunc("/checks.{extension}", wrap(s.checksHandler)).Methods("GET")
+	router.HandleFunc("/checks/by-{group}.{extension}", wrap(s.checkGroupsHandler)).Methods("GET")
+	router.HandleFunc("/checks/{id}/annotation", wrap(s.annotationHandler)).Methods("POST", "DELETE")
+	router.HandleFunc("/checks/{id}/history.{extension}", wrap(s.checkHistoryHandler)).Methods("GET")
+	router.HandleFunc("/reannounce", wrap(s.reannounceHandler)).Methods("POST")
+	router.HandleFunc("/pins.{extension}", wrap(s.pinsHandler)).Methods("GET")
+	router.HandleFunc("/pins", wrap(s.addPinHandler)).Methods("POST")
+	router.HandleFunc("/pins/{id}", wrap(s.removePinHandler)).Methods("DELETE")
+	router.HandleFunc("/quarantines.{extension}", wrap(s.quarantinesHandler)).Methods("GET")
+	router.HandleFunc("/quarantines", wrap(s.addQuarantineHandler)).Methods("POST")
+	router.HandleFunc("/quarantines/{hostname}", wrap(s.removeQuarantineHandler)).Methods("DELETE")
+	router.HandleFunc("/drains.{extension}", wrap(s.drainsHandler)).Methods("GET")
+	router.HandleFunc("/drains", wrap(s.scheduleDrainHandler)).Methods("POST")
+	router.HandleFunc("/drains/{id}", wrap(s.cancelDrainHandler)).Methods("DELETE")
+	router.HandleFunc("/consistency.{extension}", wrap(s.hashesHandler)).Methods("GET")
+	router.HandleFunc("/consistency/cluster.{extension}", wrap(s.consistencyHandler)).Methods("GET")
+	router.HandleFunc("/exclusions.{extension}", wrap(s.exclusionsHandler)).Methods("GET")
+	router.HandleFunc("/warnings.{extension}", wrap(s.warningsHandler)).Methods("GET")
+	router.HandleFunc("/timeouts.{extension}", wrap(s.timeoutsHandler)).Methods("GET")
+	router.HandleFunc("/traffic.{extension}", wrap(s.trafficHandler)).Methods("GET")
+	router.HandleFunc("/reloads.{extension}", wrap(s.reloadsHandler)).Methods("GET")
+	router.HandleFunc("/discovery.{extension}", wrap(s.discoveryHandler)).Methods("GET")
+	router.HandleFunc("/traefik.{extension}", wrap(s.traefikHandler)).Methods("GET")
+	router.HandleFunc("/changes.{extension}", wrap(s.changesHandler)).Methods("GET")
+	router.HandleFunc("/uptime.{extension}", wrap(s.uptimeHandler)).Methods("GET")
+	router.HandleFunc("/uptime/{name}.{extension}", wrap(s.uptimeHandler)).Methods("GET")
+	router.HandleFunc("/metrics.{extension}", wrap(s.metricsHandler)).Methods("GET")
+	router.HandleFunc("/events.{extension}", wrap(s.eventsHandler)).Methods("GET")
+	router.HandleFunc("/events", wrap(s.eventStreamHandler)).Methods("GET")
+	router.HandleFunc("/timeline.{extension}", wrap(s.timelineHandler)).Methods("GET")
 	router.HandleFunc("/watch", wrap(s.watchHandler)).Methods("GET")
 	router.HandleFunc("/{path}", s.optionsHandler).Methods("OPTIONS")
 
@@ -183,7 +244,9 @@ func (s *SidecarApi) oneServiceHandler(response http.ResponseWriter, req *http.R
 	result := ApiServices{
 		Services:    svcInstances,
 		ClusterName: clusterName,
+		Version:     s.state.Version(),
 	}
+	response.Header().Set(IndexHeader, strconv.FormatUint(result.Version, 10))
 
 	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
 	if err != nil {
@@ -198,6 +261,107 @@ func (s *SidecarApi) oneServiceHandler(response http.ResponseWriter, req *http.R
 	}
 }
 
+// ApiReadiness says whether a service has enough healthy instances
+type ApiReadiness struct {
+	Service  string
+	Healthy  int
+	Required int
+	Ready    bool
+}
+
+// readyHandler returns a 200 when at least the number of instances in the
+// "min" parameter (default 1) of a service are healthy across the cluster,
+// and a 503 when there are fewer. Deploy tools can wait on it before shifting
+// traffic. Endpoints that several hosts report on count once.
+func (s *SidecarApi) readyHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	name := params["name"]
+	if name == "" {
+		sendJsonError(response, 404, "Not Found - No service name provided")
+		return
+	}
+
+	required := 1
+	if value := req.URL.Query().Get("min"); value != "" {
+		var err error
+		required, err = strconv.Atoi(value)
+		if err != nil || required < 1 {
+			sendJsonError(response, 400, "Bad Request - Invalid min, must be at least 1")
+			return
+		}
+	}
+
+	if s.state == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	result := ApiReadiness{Service: name, Required: required}
+	s.state.RLock()
+	s.state.EachServiceMerged(func(hostname *string, id *string, svc *service.Service) {
+		if svc.Name == name && svc.IsAlive() {
+			result.Healthy++
+		}
+	})
+	s.state.RUnlock()
+	result.Ready = result.Healthy >= required
+
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling readiness in readyHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	if !result.Ready {
+		response.WriteHeader(503)
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing readiness response to client: %s", err)
+	}
+}
+
+// waitForIndex supports blocking queries. When the request has an "index"
+// parameter, it waits until the state version has moved past it, or for the
+// time in the "wait" parameter, whichever comes first. Returns false after
+// sending an error if the parameters are invalid.
+func (s *SidecarApi) waitForIndex(response http.ResponseWriter, req *http.Request) bool {
+	query := req.URL.Query()
+	if query.Get("index") == "" {
+		return true
+	}
+
+	index, err := strconv.ParseUint(query.Get("index"), 10, 64)
+	if err != nil {
+		sendJsonError(response, 400, "Bad Request - Invalid index")
+		return false
+	}
+
+	wait := DefaultBlockingWait
+	if query.Get("wait") != "" {
+		wait, err = time.ParseDuration(query.Get("wait"))
+		if err != nil || wait < 0 {
+			sendJsonError(response, 400, "Bad Request - Invalid wait")
+			return false
+		}
+	}
+
+	if wait > MaxBlockingWait {
+		wait = MaxBlockingWait
+	}
+
+	s.state.WaitForChange(index, wait)
+
+	return true
+}
+
 // serviceHandler returns the results for all the services we know about
 func (s *SidecarApi) servicesHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
 	defer req.Body.Close()
@@ -211,6 +375,10 @@ func (s *SidecarApi) servicesHandler(response http.ResponseWriter, req *http.Req
 		return
 	}
 
+	if !s.waitForIndex(response, req) {
+		return
+	}
+
 	response.Header().Set("Content-Type", "application/json")
 
 	var listMembers []*memberlist.Node
@@ -230,6 +398,8 @@ func (s *SidecarApi) servicesHandler(response http.ResponseWriter, req *http.Req
 		s.state.RLock()
 		defer s.state.RUnlock()
 
+		response.Header().Set(IndexHeader, strconv.FormatUint(s.state.Version(), 10))
+
 		for _, member := range listMembers {
 			if s.state.HasServer(member.Name) {
 				members[member.Name] = &ApiServer{
@@ -250,6 +420,7 @@ func (s *SidecarApi) servicesHandler(response http.ResponseWriter, req *http.Req
 			Services:       s.state.ByService(),
 			ClusterMembers: members,
 			ClusterName:    clusterName,
+			Version:        s.state.Version(),
 		}
 
 		jsonBytes, err = json.MarshalIndent(&result, "", "  ")
@@ -272,14 +443,19 @@ func (s *SidecarApi) servicesHandler(response http.ResponseWriter, req *http.Req
 func (s *SidecarApi) stateHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
 	defer req.Body.Close()
 
-	s.state.RLock()
-	defer s.state.RUnlock()
-
 	if params["extension"] != "json" {
 		sendJsonError(response, 404, "Not Found - Invalid content type extension")
 		return
 	}
 
+	if !s.waitForIndex(response, req) {
+		return
+	}
+
+	s.state.RLock()
+	defer s.state.RUnlock()
+
+	response.Header().Set(IndexHeader, strconv.FormatUint(s.state.Version(), 10))
 	response.Header().Set("Content-Type", "application/json")
 	response.Header().Set("Access-Control-Allow-Origin", "*")
 	response.Header().Set("Access-Control-Allow-Methods", "GET")
@@ -290,21 +466,17 @@ func (s *SidecarApi) stateHandler(response http.ResponseWriter, req *http.Reques
 	}
 }
 
-// drainServiceHandler instructs Sidecar to set the status of a given service
-// instance to DRAINING. This allows us to decomission the given service
-// instance and let it sit around for a short amount of time, so it can finish
-// processing the requests that are still in flight.
-func (s *SidecarApi) drainServiceHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+// opinionsHandler returns the merged view of the endpoints that several
+// hosts report on, e.g. "3 of 5 hosts see it down"
+func (s *SidecarApi) opinionsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
 	defer req.Body.Close()
 
-	if req.Method != http.MethodPost {
-		sendJsonError(response, 400, fmt.Sprintf("Bad request - Method %q not allowed", req.Method))
-		return
-	}
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
 
-	serviceID, ok := params["id"]
-	if !ok {
-		sendJsonError(response, 404, "Not Found - No service ID provided")
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
 		return
 	}
 
@@ -313,59 +485,1373 @@ func (s *SidecarApi) drainServiceHandler(response http.ResponseWriter, req *http
 		return
 	}
 
-	svc, err := s.state.GetLocalServiceByID(serviceID)
+	s.state.RLock()
+	result := struct {
+		Opinions []catalog.Opinion
+	}{
+		Opinions: s.state.Opinions(),
+	}
+	s.state.RUnlock()
+
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
 	if err != nil {
-		sendJsonError(response, 404, fmt.Sprintf("Not Found - Service ID %q not found", serviceID))
+		log.Errorf("Error marshaling opinions in opinionsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
 		return
 	}
 
-	svc.Updated = time.Now()
-	svc.Status = service.DRAINING
-	s.state.UpdateService(svc)
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing opinions response to client: %s", err)
+	}
+}
+
+// checksHandler returns the health checks for the services on this host,
+// including when each one last ran and when it is next scheduled to run.
+func (s *SidecarApi) checksHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.monitor == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
 
 	result := struct {
-		Message string
+		Checks []healthy.CheckStatus
 	}{
-		Message: fmt.Sprintf("Service %q instance %q set to DRAINING", svc.Name, svc.ID),
+		Checks: s.monitor.CheckStatuses(),
 	}
+
 	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
 	if err != nil {
-		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		log.Errorf("Error marshaling checks in checksHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
 		return
 	}
 
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing checks response to client: %s", err)
+	}
+}
+
+// checkGroupsHandler returns the health checks grouped by service or by host,
+// with a count of the checks in each status.
+func (s *SidecarApi) checkGroupsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
 	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(202)
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.monitor == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	var groups []healthy.CheckGroup
+	switch params["group"] {
+	case "service":
+		groups = s.monitor.ChecksByService()
+	case "host":
+		groups = s.monitor.ChecksByHost()
+	default:
+		sendJsonError(response, 404, "Not Found - Checks can be grouped by service or host")
+		return
+	}
+
+	result := struct {
+		Groups []healthy.CheckGroup
+	}{
+		Groups: groups,
+	}
+
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling checks in checkGroupsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
 	_, err = response.Write(jsonBytes)
 	if err != nil {
-		log.Errorf("Error writing drain service response to client: %s", err)
+		log.Errorf("Error writing checks response to client: %s", err)
 	}
 }
 
-// Send back a JSON encoded error and message
-func sendJsonError(response http.ResponseWriter, status int, message string) {
-	output := map[string]string{
-		"status":  "error",
-		"message": message,
+// An AnnotationRequest is the body POSTed to annotate a check. The expiry
+// can be given either as a time or as a duration from now, e.g. "2h".
+type AnnotationRequest struct {
+	Note      string
+	Author    string
+	Silence   bool
+	Expires   time.Time
+	ExpiresIn string
+}
+
+// checkHistoryHandler returns the recent results of one check
+func (s *SidecarApi) checkHistoryHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
 	}
 
-	jsonBytes, err := json.Marshal(output)
+	if s.monitor == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	history, err := s.monitor.History(params["id"])
 	if err != nil {
-		log.Errorf("Error encoding json error response: %s", err.Error())
-		http.Error(response, "Interval server error", 500)
+		sendJsonError(response, 404, fmt.Sprintf("Not Found - %s", err))
+		return
+	}
+
+	result := struct {
+		CheckID string
+		History []healthy.CheckResult
+	}{
+		CheckID: params["id"],
+		History: history,
+	}
+
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling history in checkHistoryHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
 		return
 	}
 
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing check history response to client: %s", err)
+	}
+}
+
+// annotationHandler attaches an annotation or silence to a check on POST,
+// and removes it on DELETE
+func (s *SidecarApi) annotationHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
 	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(status)
+
+	checkID, ok := params["id"]
+	if !ok {
+		sendJsonError(response, 404, "Not Found - No check ID provided")
+		return
+	}
+
+	if s.monitor == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	var message string
+	switch req.Method {
+	case http.MethodPost:
+		var annotationReq AnnotationRequest
+		if err := json.NewDecoder(req.Body).Decode(&annotationReq); err != nil {
+			sendJsonError(response, 400, fmt.Sprintf("Bad request - Unable to decode annotation: %s", err))
+			return
+		}
+
+		annotation := healthy.Annotation{
+			CheckID: checkID,
+			Note:    annotationReq.Note,
+			Author:  annotationReq.Author,
+			Silence: annotationReq.Silence,
+			Expires: annotationReq.Expires,
+		}
+
+		if annotationReq.ExpiresIn != "" {
+			expiresIn, err := time.ParseDuration(annotationReq.ExpiresIn)
+			if err != nil {
+				sendJsonError(response, 400, fmt.Sprintf("Bad request - Invalid ExpiresIn: %s", err))
+				return
+			}
+			annotation.Expires = time.Now().UTC().Add(expiresIn)
+		}
+
+		if err := s.monitor.Annotate(annotation); err != nil {
+			sendJsonError(response, 400, fmt.Sprintf("Bad request - %s", err))
+			return
+		}
+		message = fmt.Sprintf("Check %q annotated", checkID)
+
+	case http.MethodDelete:
+		if err := s.monitor.RemoveAnnotation(checkID); err != nil {
+			sendJsonError(response, 404, fmt.Sprintf("Not Found - %s", err))
+			return
+		}
+		message = fmt.Sprintf("Annotation removed from check %q", checkID)
+
+	default:
+		sendJsonError(response, 400, fmt.Sprintf("Bad request - Method %q not allowed", req.Method))
+		return
+	}
+
+	result := struct {
+		Message string
+	}{
+		Message: message,
+	}
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
 	_, err = response.Write(jsonBytes)
 	if err != nil {
-		log.Errorf("Unable to write JSON error: %s", err)
+		log.Errorf("Error writing annotation response to client: %s", err)
 	}
 }
 
-func wrap(fn func(http.ResponseWriter, *http.Request, map[string]string)) http.HandlerFunc {
-	return func(response http.ResponseWriter, req *http.Request) {
-		fn(response, req, mux.Vars(req))
+// reannounceHandler re-runs all the health checks and then re-announces all
+// of our local services to the cluster, without waiting for the next cycle.
+// The work happens in the background, so we return immediately.
+func (s *SidecarApi) reannounceHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Content-Type", "application/json")
+
+	if s.state == nil || (s.monitor == nil && s.discovery == nil) {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	// Without the healthy module, announce what discovery found, the same
+	// as on SIGUSR1
+	go func() {
+		if s.monitor == nil {
+			s.state.AnnounceServices(s.discovery.Services)
+			return
+		}
+		s.monitor.RunChecks()
+		s.state.AnnounceServices(s.monitor.Services)
+	}()
+
+	response.WriteHeader(202)
+	_, err := response.Write([]byte(`{"Message": "Re-announcing local services"}`))
+	if err != nil {
+		log.Errorf("Error writing reannounce response to client: %s", err)
+	}
+}
+
+// metricsHandler returns the recent in-memory metrics, including the
+// per-backend request metrics from HAproxy when the log receiver is running.
+func (s *SidecarApi) metricsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.metrics == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	summary, err := s.metrics.DisplayMetrics(response, req)
+	if err != nil {
+		log.Errorf("Error summarizing metrics in metricsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling metrics in metricsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing metrics response to client: %s", err)
+	}
+}
+
+// eventsHandler returns the most recent events, oldest first
+func (s *SidecarApi) eventsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.events == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	result := struct {
+		Events []events.Event
+	}{
+		Events: s.events.Recent(),
+	}
+
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling events in eventsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing events response to client: %s", err)
+	}
+}
+
+// timelineHandler returns the notable changes since the time in the since
+// parameter, an hour ago by default, newest first. They can be narrowed
+// down to a host, and to a minimum severity.
+func (s *SidecarApi) timelineHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.timeline == nil {
+		sendJsonError(response, 404, "Not Found - The timeline is not enabled")
+		return
+	}
+
+	since := time.Hour
+	if value := req.URL.Query().Get("since"); value != "" {
+		var err error
+		since, err = time.ParseDuration(value)
+		if err != nil || since <= 0 {
+			sendJsonError(response, 400, fmt.Sprintf("Bad request - Invalid since: %q", value))
+			return
+		}
+	}
+
+	severity := req.URL.Query().Get("severity")
+	if timeline.SeverityLevel(severity) < 0 {
+		sendJsonError(response, 400, fmt.Sprintf("Bad request - Invalid severity: %q", severity))
+		return
+	}
+
+	result := struct {
+		Since   time.Time
+		Entries []timeline.Entry
+	}{
+		Since: time.Now().UTC().Add(-since),
+	}
+	result.Entries = s.timeline.Entries(result.Since, req.URL.Query().Get("host"), severity)
+
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling timeline in timelineHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing timeline response to client: %s", err)
+	}
+}
+
+// eventStreamHandler streams new events as they happen, one JSON blob per
+// event, until the client goes away.
+func (s *SidecarApi) eventStreamHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Content-Type", "application/json")
+
+	if s.events == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	eventChan := s.events.Subscribe()
+	defer s.events.Unsubscribe(eventChan)
+
+	// Get the headers out to the client right away
+	if f, ok := response.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	for {
+		select {
+		// Find out when the http connection was closed so we can stop
+		case <-req.Context().Done():
+			return
+
+		case evt := <-eventChan:
+			jsonBytes, err := json.Marshal(&evt)
+			if err != nil {
+				log.Errorf("Error marshaling event in eventStreamHandler: %s", err.Error())
+				return
+			}
+
+			_, err = response.Write(append(jsonBytes, '\n'))
+			if err != nil {
+				log.Errorf("Unable to write eventStreamHandler response: %s", err)
+				return
+			}
+			if f, ok := response.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+}
+
+// drainServiceHandler instructs Sidecar to set the status of a given service
+// instance to DRAINING. This allows us to decomission the given service
+// instance and let it sit around for a short amount of time, so it can finish
+// processing the requests that are still in flight.
+func (s *SidecarApi) drainServiceHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	if req.Method != http.MethodPost {
+		sendJsonError(response, 400, fmt.Sprintf("Bad request - Method %q not allowed", req.Method))
+		return
+	}
+
+	serviceID, ok := params["id"]
+	if !ok {
+		sendJsonError(response, 404, "Not Found - No service ID provided")
+		return
+	}
+
+	if s.state == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	svc, err := s.state.GetLocalServiceByID(serviceID)
+	if err != nil {
+		sendJsonError(response, 404, fmt.Sprintf("Not Found - Service ID %q not found", serviceID))
+		return
+	}
+
+	svc.Updated = time.Now()
+	svc.Status = service.DRAINING
+	s.state.UpdateService(svc)
+
+	result := struct {
+		Message string
+	}{
+		Message: fmt.Sprintf("Service %q instance %q set to DRAINING", svc.Name, svc.ID),
+	}
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(202)
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing drain service response to client: %s", err)
+	}
+}
+
+// A DrainRequest is the body POSTed to schedule a drain of the local
+// instances of a service. The start can be given as a time or as a duration
+// from now, e.g. "2h", and the length as a duration. It starts now and lasts
+// 30 minutes when they aren't given.
+type DrainRequest struct {
+	Service  string
+	Author   string
+	Reason   string
+	Start    time.Time
+	StartIn  string
+	Duration string
+}
+
+// drainsHandler lists the scheduled drains on this host
+func (s *SidecarApi) drainsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.state == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	result := struct {
+		Drains []catalog.ScheduledDrain
+	}{
+		Drains: s.state.ScheduledDrains(),
+	}
+
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling drains in drainsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing drains response to client: %s", err)
+	}
+}
+
+// scheduleDrainHandler queues a drain of the local instances of a service
+func (s *SidecarApi) scheduleDrainHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Content-Type", "application/json")
+
+	if s.state == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	var drainReq DrainRequest
+	if err := json.NewDecoder(req.Body).Decode(&drainReq); err != nil {
+		sendJsonError(response, 400, fmt.Sprintf("Bad request - Unable to decode drain: %s", err))
+		return
+	}
+
+	drain := catalog.ScheduledDrain{
+		Service: drainReq.Service,
+		Author:  drainReq.Author,
+		Reason:  drainReq.Reason,
+		Start:   drainReq.Start,
+	}
+
+	if drainReq.StartIn != "" {
+		startIn, err := time.ParseDuration(drainReq.StartIn)
+		if err != nil {
+			sendJsonError(response, 400, fmt.Sprintf("Bad request - Invalid StartIn: %s", err))
+			return
+		}
+		drain.Start = time.Now().UTC().Add(startIn)
+	}
+
+	if drainReq.Duration != "" {
+		duration, err := time.ParseDuration(drainReq.Duration)
+		if err != nil {
+			sendJsonError(response, 400, fmt.Sprintf("Bad request - Invalid Duration: %s", err))
+			return
+		}
+		if drain.Start.IsZero() {
+			drain.Start = time.Now().UTC()
+		}
+		drain.End = drain.Start.Add(duration)
+	}
+
+	drain, err := s.state.ScheduleDrain(drain)
+	if err != nil {
+		sendJsonError(response, 400, fmt.Sprintf("Bad request - %s", err))
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(&drain, "", "  ")
+	if err != nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	response.WriteHeader(201)
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing drain response to client: %s", err)
+	}
+}
+
+// cancelDrainHandler removes a scheduled drain, ending it if it started
+func (s *SidecarApi) cancelDrainHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Content-Type", "application/json")
+
+	if s.state == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	if err := s.state.CancelDrain(params["id"]); err != nil {
+		sendJsonError(response, 404, fmt.Sprintf("Not Found - %s", err))
+		return
+	}
+
+	result := struct {
+		Message string
+	}{
+		Message: fmt.Sprintf("Drain %q cancelled", params["id"]),
+	}
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing drain response to client: %s", err)
+	}
+}
+
+// A PinRequest is the body POSTed to pin a client to a service instance.
+// The client is either a Source address or CIDR, or a Cookie value. The
+// expiry can be given as a time or as a duration from now, e.g. "30m".
+type PinRequest struct {
+	Service   string
+	ServerID  string
+	Source    string
+	Cookie    string
+	Author    string
+	Expires   time.Time
+	ExpiresIn string
+}
+
+// pinsHandler lists the affinity pins in effect on this host
+func (s *SidecarApi) pinsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.pins == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	result := struct {
+		Pins []affinity.Pin
+	}{
+		Pins: s.pins.Pins(),
+	}
+
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling pins in pinsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing pins response to client: %s", err)
+	}
+}
+
+// addPinHandler pins a client to an instance of a service. The instance
+// has to be one we know about.
+func (s *SidecarApi) addPinHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Content-Type", "application/json")
+
+	if s.pins == nil || s.state == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	var pinReq PinRequest
+	if err := json.NewDecoder(req.Body).Decode(&pinReq); err != nil {
+		sendJsonError(response, 400, fmt.Sprintf("Bad request - Unable to decode pin: %s", err))
+		return
+	}
+
+	var found bool
+	s.state.RLock()
+	for _, svc := range s.state.ByService()[pinReq.Service] {
+		if svc.ID == pinReq.ServerID && svc.IsAlive() {
+			found = true
+		}
+	}
+	s.state.RUnlock()
+
+	if !found {
+		sendJsonError(response, 404,
+			fmt.Sprintf("Not Found - No alive instance %q of service %q", pinReq.ServerID, pinReq.Service))
+		return
+	}
+
+	pin := affinity.Pin{
+		Service:  pinReq.Service,
+		ServerID: pinReq.ServerID,
+		Source:   pinReq.Source,
+		Cookie:   pinReq.Cookie,
+		Author:   pinReq.Author,
+		Expires:  pinReq.Expires,
+	}
+
+	if pinReq.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(pinReq.ExpiresIn)
+		if err != nil {
+			sendJsonError(response, 400, fmt.Sprintf("Bad request - Invalid ExpiresIn: %s", err))
+			return
+		}
+		pin.Expires = time.Now().UTC().Add(expiresIn)
+	}
+
+	pin, err := s.pins.Add(pin)
+	if err != nil {
+		sendJsonError(response, 400, fmt.Sprintf("Bad request - %s", err))
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(&pin, "", "  ")
+	if err != nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	response.WriteHeader(201)
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing pin response to client: %s", err)
+	}
+}
+
+// removePinHandler removes an affinity pin before it expires
+func (s *SidecarApi) removePinHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Content-Type", "application/json")
+
+	if s.pins == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	if err := s.pins.Remove(params["id"]); err != nil {
+		sendJsonError(response, 404, fmt.Sprintf("Not Found - %s", err))
+		return
+	}
+
+	result := struct {
+		Message string
+	}{
+		Message: fmt.Sprintf("Pin %q removed", params["id"]),
+	}
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing pin response to client: %s", err)
+	}
+}
+
+// A QuarantineRequest is the body POSTed to ignore the updates from a peer.
+// The expiry can be given as a time or as a duration from now, e.g. "2h".
+type QuarantineRequest struct {
+	Hostname  string
+	Reason    string
+	Author    string
+	Expires   time.Time
+	ExpiresIn string
+}
+
+// quarantinesHandler lists the peers whose updates are being ignored
+func (s *SidecarApi) quarantinesHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.state == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	result := struct {
+		Quarantines []catalog.Quarantine
+	}{
+		Quarantines: s.state.Quarantines(),
+	}
+
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling quarantines in quarantinesHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing quarantines response to client: %s", err)
+	}
+}
+
+// addQuarantineHandler starts ignoring the updates from a peer
+func (s *SidecarApi) addQuarantineHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Content-Type", "application/json")
+
+	if s.state == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	var quarantineReq QuarantineRequest
+	if err := json.NewDecoder(req.Body).Decode(&quarantineReq); err != nil {
+		sendJsonError(response, 400, fmt.Sprintf("Bad request - Unable to decode quarantine: %s", err))
+		return
+	}
+
+	quarantine := catalog.Quarantine{
+		Hostname: quarantineReq.Hostname,
+		Reason:   quarantineReq.Reason,
+		Author:   quarantineReq.Author,
+		Expires:  quarantineReq.Expires,
+	}
+
+	if quarantineReq.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(quarantineReq.ExpiresIn)
+		if err != nil {
+			sendJsonError(response, 400, fmt.Sprintf("Bad request - Invalid ExpiresIn: %s", err))
+			return
+		}
+		quarantine.Expires = time.Now().UTC().Add(expiresIn)
+	}
+
+	quarantine, err := s.state.QuarantinePeer(quarantine)
+	if err != nil {
+		sendJsonError(response, 400, fmt.Sprintf("Bad request - %s", err))
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(&quarantine, "", "  ")
+	if err != nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	response.WriteHeader(201)
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing quarantine response to client: %s", err)
+	}
+}
+
+// removeQuarantineHandler lifts the quarantine on a peer before it expires
+func (s *SidecarApi) removeQuarantineHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Content-Type", "application/json")
+
+	if s.state == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	if err := s.state.ReleasePeer(params["hostname"]); err != nil {
+		sendJsonError(response, 404, fmt.Sprintf("Not Found - %s", err))
+		return
+	}
+
+	result := struct {
+		Message string
+	}{
+		Message: fmt.Sprintf("Peer %q released from quarantine", params["hostname"]),
+	}
+	jsonBytes, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing quarantine response to client: %s", err)
+	}
+}
+
+// hashesHandler returns the hashes of our state and proxy config, for the
+// other cluster members to compare with theirs
+func (s *SidecarApi) hashesHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.checker == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(s.checker.Hashes(s.state), "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling hashes in hashesHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing hashes response to client: %s", err)
+	}
+}
+
+// consistencyHandler checks the hashes of all of the cluster members now,
+// and returns the hosts that differ from the rest
+func (s *SidecarApi) consistencyHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.checker == nil {
+		sendJsonError(response, 500, "Internal Server Error - Something went terribly wrong")
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(s.checker.Check(), "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling report in consistencyHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing consistency response to client: %s", err)
+	}
+}
+
+// Send back a JSON encoded error and message
+func sendJsonError(response http.ResponseWriter, status int, message string) {
+	output := map[string]string{
+		"status":  "error",
+		"message": message,
+	}
+
+	jsonBytes, err := json.Marshal(output)
+	if err != nil {
+		log.Errorf("Error encoding json error response: %s", err.Error())
+		http.Error(response, "Interval server error", 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Unable to write JSON error: %s", err)
+	}
+}
+
+func wrap(fn func(http.ResponseWriter, *http.Request, map[string]string)) http.HandlerFunc {
+	return func(response http.ResponseWriter, req *http.Request) {
+		fn(response, req, mux.Vars(req))
+	}
+}
+
+// exclusionsHandler returns the instances that HAproxy's backends leave
+// out, and why
+func (s *SidecarApi) exclusionsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.proxy == nil {
+		sendJsonError(response, 404, "Not Found - HAproxy is not enabled")
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(s.proxy.Exclusions(), "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling exclusions in exclusionsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing exclusions response to client: %s", err)
+	}
+}
+
+// warningsHandler returns the problems with the services that rendering the
+// HAproxy config keeps running into
+func (s *SidecarApi) warningsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.proxy == nil {
+		sendJsonError(response, 404, "Not Found - HAproxy is not enabled")
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(s.proxy.Warnings(), "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling config warnings in warningsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing config warnings response to client: %s", err)
+	}
+}
+
+// discoveryHandler returns whether each discovery source is degraded
+func (s *SidecarApi) discoveryHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.discovery == nil {
+		sendJsonError(response, 404, "Not Found - Discovery is not enabled")
+		return
+	}
+
+	sources := s.discovery.Sources()
+	if sources == nil {
+		sources = []discovery.SourceStatus{}
+	}
+
+	jsonBytes, err := json.MarshalIndent(sources, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling discovery sources in discoveryHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing discovery sources response to client: %s", err)
+	}
+}
+
+// timeoutsHandler returns the timeouts and retries each service's frontends
+// and backends were last rendered with, and where they came from
+func (s *SidecarApi) timeoutsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.proxy == nil {
+		sendJsonError(response, 404, "Not Found - HAproxy is not enabled")
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(s.proxy.Timeouts(), "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling timeouts in timeoutsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing timeouts response to client: %s", err)
+	}
+}
+
+// trafficHandler returns the traffic to each HAproxy backend and server from
+// the last time the stats were collected, with their services
+func (s *SidecarApi) trafficHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.proxy == nil || s.proxy.Traffic == nil {
+		sendJsonError(response, 404, "Not Found - Traffic stats are not enabled")
+		return
+	}
+
+	backends, collected := s.proxy.Traffic.Latest()
+	jsonBytes, err := json.MarshalIndent(struct {
+		Collected time.Time
+		Backends  []haproxy.BackendTraffic
+	}{collected, backends}, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling traffic in trafficHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing traffic response to client: %s", err)
+	}
+}
+
+// reloadsHandler returns how the HAproxy reloads are going
+func (s *SidecarApi) reloadsHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.proxy == nil {
+		sendJsonError(response, 404, "Not Found - HAproxy is not enabled")
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(s.proxy.ReloadStatus(), "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling reload status in reloadsHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing reload status response to client: %s", err)
+	}
+}
+
+// traefikHandler returns the state as the dynamic configuration for
+// Traefik's HTTP provider, so Traefik can poll Sidecar for its routes
+func (s *SidecarApi) traefikHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	jsonBytes, err := json.MarshalIndent(haproxy.Traefik(s.state), "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling config in traefikHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing Traefik config response to client: %s", err)
+	}
+}
+
+// uptimeHandler returns the availability and error budget of every service,
+// or of the one named in the path
+func (s *SidecarApi) uptimeHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.state == nil || s.state.Uptime == nil {
+		sendJsonError(response, 404, "Not Found - Uptime tracking is not enabled")
+		return
+	}
+
+	var result interface{}
+	if name, ok := params["name"]; ok {
+		report, found := s.state.Uptime.Report(name)
+		if !found {
+			sendJsonError(response, 404, fmt.Sprintf("no uptime for %s found", name))
+			return
+		}
+		result = report
+	} else {
+		result = struct {
+			Window   time.Duration
+			Services []catalog.UptimeReport
+		}{
+			Window:   s.state.Uptime.Window,
+			Services: s.state.Uptime.Reports(),
+		}
+	}
+
+	jsonBytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling uptime in uptimeHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing uptime response to client: %s", err)
+	}
+}
+
+// changesHandler replays the changes to the state from the ChangeLog,
+// starting at the index in the "from" parameter. It supports blocking
+// queries, so clients can follow the changes as they happen.
+func (s *SidecarApi) changesHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	if params["extension"] != "json" {
+		sendJsonError(response, 404, "Not Found - Invalid content type extension")
+		return
+	}
+
+	if s.state == nil || s.state.ChangeLog == nil {
+		sendJsonError(response, 404, "Not Found - The change log is not enabled")
+		return
+	}
+
+	query := req.URL.Query()
+
+	var from uint64
+	if value := query.Get("from"); value != "" {
+		var err error
+		from, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			sendJsonError(response, 400, "Bad Request - Invalid from")
+			return
+		}
+	}
+
+	limit := DefaultChangesLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			sendJsonError(response, 400, "Bad Request - Invalid limit, must be at least 1")
+			return
+		}
+	}
+
+	if !s.waitForIndex(response, req) {
+		return
+	}
+
+	replay, err := s.state.ChangeLog.Since(from, limit)
+	if err != nil {
+		log.Errorf("Error replaying changes in changesHandler: %s", err)
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	response.Header().Set(IndexHeader, strconv.FormatUint(replay.Latest, 10))
+
+	jsonBytes, err := json.MarshalIndent(replay, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling changes in changesHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing changes response to client: %s", err)
 	}
 }
@@ -7,11 +7,20 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/NinesStack/sidecar/affinity"
 	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/consistency"
+	"github.com/NinesStack/sidecar/discovery"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/haproxy"
+	"github.com/NinesStack/sidecar/healthy"
 	"github.com/NinesStack/sidecar/service"
+	"github.com/NinesStack/sidecar/timeline"
+	"github.com/armon/go-metrics"
 	director "github.com/relistan/go-director"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -183,8 +192,91 @@ func Test_stateHandler(t *testing.T) {
 			So(err, ShouldBeNil)
 			So(decoded, ShouldNotBeNil)
 			So(decoded.Servers, ShouldResemble, state.Servers)
+			So(resp.Header.Get(IndexHeader), ShouldEqual, "2")
 		})
 
+		Convey("blocks until the state changes past the index", func() {
+			req := httptest.NewRequest("GET", "/state.json?index=2&wait=5s", nil)
+
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				svc.Status = service.UNHEALTHY
+				svc.Updated = baseTime.Add(time.Second)
+				state.AddServiceEntry(svc)
+			}()
+
+			started := time.Now()
+			api.stateHandler(recorder, req, params)
+
+			So(time.Since(started), ShouldBeLessThan, 5*time.Second)
+			So(recorder.Result().Header.Get(IndexHeader), ShouldEqual, "3")
+		})
+
+		Convey("returns when the wait runs out", func() {
+			req := httptest.NewRequest("GET", "/state.json?index=2&wait=10ms", nil)
+			api.stateHandler(recorder, req, params)
+
+			So(recorder.Result().StatusCode, ShouldEqual, 200)
+			So(recorder.Result().Header.Get(IndexHeader), ShouldEqual, "2")
+		})
+
+		Convey("returns right away for an old index", func() {
+			req := httptest.NewRequest("GET", "/state.json?index=1", nil)
+			api.stateHandler(recorder, req, params)
+
+			So(recorder.Result().Header.Get(IndexHeader), ShouldEqual, "2")
+		})
+
+		Convey("rejects an invalid index", func() {
+			req := httptest.NewRequest("GET", "/state.json?index=bogus", nil)
+			api.stateHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 400)
+		})
+	})
+}
+
+func Test_opinionsHandler(t *testing.T) {
+	Convey("opinionsHandler", t, func() {
+		state := catalog.NewServicesState()
+		for i, reporter := range []string{"chaucer", "bocaccio", "dante"} {
+			state.AddServiceEntry(service.Service{
+				ID:       fmt.Sprintf("deadbeef10%d", i),
+				Name:     "postgres",
+				Hostname: "db-external",
+				Reporter: reporter,
+				Updated:  time.Now().UTC(),
+				Status:   service.ALIVE,
+			})
+		}
+
+		req := httptest.NewRequest("GET", "/opinions.json", nil)
+		recorder := httptest.NewRecorder()
+		api := &SidecarApi{state: state}
+		params := map[string]string{"extension": "json"}
+
+		Convey("returns the merged opinions", func() {
+			api.opinionsHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var result struct{ Opinions []catalog.Opinion }
+			err := json.Unmarshal([]byte(body), &result)
+			So(err, ShouldBeNil)
+			So(len(result.Opinions), ShouldEqual, 1)
+			So(result.Opinions[0].Alive, ShouldEqual, 3)
+			So(result.Opinions[0].Total, ShouldEqual, 3)
+		})
+
+		Convey("returns an error for unknown content types", func() {
+			params["extension"] = "xml"
+			api.opinionsHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
 	})
 }
 
@@ -254,6 +346,8 @@ func Test_servicesHandler(t *testing.T) {
 			err := json.Unmarshal(bodyBytes, &result)
 			So(err, ShouldBeNil)
 			So(len(result.Services), ShouldEqual, 2)
+			So(result.Version, ShouldEqual, state.Version())
+			So(resp.Header.Get(IndexHeader), ShouldEqual, fmt.Sprintf("%d", result.Version))
 		})
 	})
 }
@@ -409,3 +503,1165 @@ func Test_drainServiceHandler(t *testing.T) {
 		})
 	})
 }
+
+func Test_checksHandler(t *testing.T) {
+	Convey("When invoking the checks handler", t, func() {
+		monitor := healthy.NewMonitor("chaucer", "/")
+		lastRun := time.Now().UTC().Round(time.Second)
+		monitor.AddCheck(&healthy.Check{
+			ID:          "deadbeef123",
+			ServiceName: "bocaccio",
+			Hostname:    "chaucer",
+			Type:        "HttpGet",
+			Args:        "http://chaucer:1234/",
+			Status:      healthy.HEALTHY,
+			LastRun:     lastRun,
+			NextRun:     lastRun.Add(healthy.HEALTH_INTERVAL),
+		})
+
+		req := httptest.NewRequest("GET", "/checks.json", nil)
+		recorder := httptest.NewRecorder()
+		api := &SidecarApi{monitor: monitor}
+		params := map[string]string{"extension": "json"}
+
+		Convey("Returns the checks with their schedule", func() {
+			api.checksHandler(recorder, req, params)
+
+			status, headers, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+			So(headers.Get("Content-Type"), ShouldEqual, "application/json")
+
+			var result struct{ Checks []healthy.CheckStatus }
+			err := json.Unmarshal([]byte(body), &result)
+			So(err, ShouldBeNil)
+			So(len(result.Checks), ShouldEqual, 1)
+			So(result.Checks[0].Status, ShouldEqual, "Healthy")
+			So(result.Checks[0].LastRun, ShouldEqual, lastRun)
+			So(result.Checks[0].NextRun, ShouldEqual, lastRun.Add(healthy.HEALTH_INTERVAL))
+		})
+
+		Convey("Returns an error for unknown content types", func() {
+			params["extension"] = "asdf"
+			api.checksHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 404)
+			So(body, ShouldContainSubstring, "Invalid content type")
+		})
+
+		Convey("Returns an error if the monitor is nil", func() {
+			api.monitor = nil
+			api.checksHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 500)
+		})
+
+		Convey("Returns the checks grouped by service", func() {
+			params["group"] = "service"
+			api.checkGroupsHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var result struct{ Groups []healthy.CheckGroup }
+			err := json.Unmarshal([]byte(body), &result)
+			So(err, ShouldBeNil)
+			So(len(result.Groups), ShouldEqual, 1)
+			So(result.Groups[0].Name, ShouldEqual, "bocaccio")
+			So(result.Groups[0].Healthy, ShouldEqual, 1)
+		})
+
+		Convey("Annotates and silences a check", func() {
+			req := httptest.NewRequest("POST", "/checks/deadbeef123/annotation",
+				strings.NewReader(`{"Note": "Known issue", "Author": "jane", "Silence": true, "ExpiresIn": "1h"}`))
+			params["id"] = "deadbeef123"
+			api.annotationHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, "annotated")
+
+			annotations := monitor.Annotations()
+			So(len(annotations), ShouldEqual, 1)
+			So(annotations[0].Silence, ShouldBeTrue)
+			So(annotations[0].Expires, ShouldHappenAfter, time.Now().UTC().Add(59*time.Minute))
+
+			Convey("and removes the annotation", func() {
+				req := httptest.NewRequest("DELETE", "/checks/deadbeef123/annotation", nil)
+				recorder := httptest.NewRecorder()
+				api.annotationHandler(recorder, req, params)
+
+				status, _, _ := getResult(recorder)
+				So(status, ShouldEqual, 200)
+				So(monitor.Annotations(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("Rejects annotations for unknown checks", func() {
+			req := httptest.NewRequest("POST", "/checks/abba/annotation",
+				strings.NewReader(`{"Note": "Known issue", "Author": "jane"}`))
+			params["id"] = "abba"
+			api.annotationHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 400)
+			So(body, ShouldContainSubstring, "no such check")
+		})
+
+		Convey("Returns the history of a check", func() {
+			monitor.Checks["deadbeef123"].Command = &healthy.AlwaysSuccessfulCmd{}
+			monitor.RunChecks()
+			params["id"] = "deadbeef123"
+			api.checkHistoryHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var result struct{ History []healthy.CheckResult }
+			err := json.Unmarshal([]byte(body), &result)
+			So(err, ShouldBeNil)
+			So(len(result.History), ShouldEqual, 1)
+		})
+
+		Convey("Returns an error for the history of an unknown check", func() {
+			params["id"] = "abba"
+			api.checkHistoryHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+
+		Convey("Returns an error for unknown groupings", func() {
+			params["group"] = "planet"
+			api.checkGroupsHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 404)
+			So(body, ShouldContainSubstring, "service or host")
+		})
+	})
+}
+
+func Test_pinsHandlers(t *testing.T) {
+	Convey("When invoking the pins handlers", t, func() {
+		hostname := "chaucer"
+		state := catalog.NewServicesState()
+		state.Hostname = hostname
+
+		baseTime := time.Now().UTC().Add(0 - 1*time.Minute)
+		state.AddServiceEntry(service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Image:    "101deadbeef",
+			Created:  baseTime,
+			Hostname: hostname,
+			Updated:  baseTime,
+			Status:   service.ALIVE,
+		})
+
+		pins := affinity.NewStore()
+		api := &SidecarApi{state: state, pins: pins}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+
+		Convey("Pins a client to an instance", func() {
+			req := httptest.NewRequest("POST", "/pins", strings.NewReader(
+				`{"Service": "bocaccio", "ServerID": "deadbeef123", "Source": "10.0.0.9", "Author": "jane", "ExpiresIn": "1h"}`,
+			))
+			api.addPinHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 201)
+
+			var pin affinity.Pin
+			So(json.Unmarshal([]byte(body), &pin), ShouldBeNil)
+			So(pin.ID, ShouldEqual, "1")
+			So(pin.Source, ShouldEqual, "10.0.0.9/32")
+			So(pin.Expires, ShouldHappenAfter, time.Now().UTC().Add(59*time.Minute))
+
+			Convey("and lists it", func() {
+				req := httptest.NewRequest("GET", "/pins.json", nil)
+				recorder := httptest.NewRecorder()
+				api.pinsHandler(recorder, req, params)
+
+				status, _, body := getResult(recorder)
+				So(status, ShouldEqual, 200)
+				So(body, ShouldContainSubstring, "10.0.0.9/32")
+			})
+
+			Convey("and removes it", func() {
+				req := httptest.NewRequest("DELETE", "/pins/1", nil)
+				recorder := httptest.NewRecorder()
+				params["id"] = "1"
+				api.removePinHandler(recorder, req, params)
+
+				status, _, _ := getResult(recorder)
+				So(status, ShouldEqual, 200)
+				So(pins.Pins(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("Rejects pins to unknown instances", func() {
+			req := httptest.NewRequest("POST", "/pins", strings.NewReader(
+				`{"Service": "bocaccio", "ServerID": "abba", "Cookie": "tester", "Author": "jane"}`,
+			))
+			api.addPinHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 404)
+			So(body, ShouldContainSubstring, "No alive instance")
+			So(pins.Pins(), ShouldBeEmpty)
+		})
+
+		Convey("Rejects invalid pins", func() {
+			req := httptest.NewRequest("POST", "/pins", strings.NewReader(
+				`{"Service": "bocaccio", "ServerID": "deadbeef123", "Source": "10.0.0.9", "Cookie": "tester", "Author": "jane"}`,
+			))
+			api.addPinHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 400)
+		})
+
+		Convey("Returns a 404 when removing an unknown pin", func() {
+			req := httptest.NewRequest("DELETE", "/pins/99", nil)
+			params["id"] = "99"
+			api.removePinHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+// A Discoverer that always finds the same service
+type stubDiscoverer struct{}
+
+func (stubDiscoverer) Services() []service.Service {
+	return []service.Service{{ID: "deadbeef123", Hostname: "chaucer"}}
+}
+
+func (stubDiscoverer) HealthCheck(svc *service.Service) (string, string) {
+	return "", ""
+}
+
+func (stubDiscoverer) Listeners() []discovery.ChangeListener { return nil }
+
+func (stubDiscoverer) Run(looper director.Looper) {}
+
+func Test_reannounceHandler(t *testing.T) {
+	Convey("When invoking the reannounce handler", t, func() {
+		state := catalog.NewServicesState()
+		monitor := healthy.NewMonitor("chaucer", "/")
+		monitor.DiscoveryFn = func() []service.Service {
+			return []service.Service{{ID: "deadbeef123", Hostname: "chaucer"}}
+		}
+		state.Broadcasts = make(chan [][]byte, catalog.ALIVE_COUNT)
+
+		req := httptest.NewRequest("POST", "/reannounce", nil)
+		recorder := httptest.NewRecorder()
+		api := &SidecarApi{state: state, monitor: monitor}
+
+		Convey("Broadcasts the local services", func() {
+			api.reannounceHandler(recorder, req, nil)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 202)
+
+			var broadcast [][]byte
+			select {
+			case broadcast = <-state.Broadcasts:
+			case <-time.After(time.Second):
+			}
+			So(len(broadcast), ShouldEqual, 1)
+		})
+
+		Convey("Broadcasts the discovered services if the monitor is nil", func() {
+			api.monitor = nil
+			api.discovery = &discovery.MultiDiscovery{
+				Discoverers: []discovery.Discoverer{stubDiscoverer{}},
+			}
+			api.reannounceHandler(recorder, req, nil)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 202)
+
+			var broadcast [][]byte
+			select {
+			case broadcast = <-state.Broadcasts:
+			case <-time.After(time.Second):
+			}
+			So(len(broadcast), ShouldEqual, 1)
+		})
+
+		Convey("Returns an error if there is no monitor or discovery", func() {
+			api.monitor = nil
+			api.reannounceHandler(recorder, req, nil)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 500)
+		})
+	})
+}
+
+func Test_metricsHandler(t *testing.T) {
+	Convey("When invoking the metrics handler", t, func() {
+		sink := metrics.NewInmemSink(time.Minute, time.Minute)
+		sink.IncrCounter([]string{"haproxy", "backend", "web", "requests"}, 1)
+
+		req := httptest.NewRequest("GET", "/metrics.json", nil)
+		recorder := httptest.NewRecorder()
+		api := &SidecarApi{metrics: sink}
+		params := map[string]string{"extension": "json"}
+
+		Convey("Returns the metrics", func() {
+			api.metricsHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, "haproxy.backend.web.requests")
+		})
+
+		Convey("Returns an error if there's no sink", func() {
+			api.metrics = nil
+			api.metricsHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 500)
+		})
+	})
+}
+
+func Test_runtimeHandlers(t *testing.T) {
+	Convey("When asking for runtime telemetry", t, func() {
+		sink := metrics.NewInmemSink(time.Minute, time.Minute)
+		sink.SetGauge([]string{"sidecar", "some.gauge"}, 3)
+		sink.IncrCounter([]string{"haproxy", "backend", "web", "requests"}, 2)
+
+		recorder := httptest.NewRecorder()
+		api := &SidecarApi{metrics: sink}
+
+		Convey("Returns the runtime status", func() {
+			req := httptest.NewRequest("GET", "/status/runtime", nil)
+			api.runtimeHandler(recorder, req, nil)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var result RuntimeStatus
+			So(json.Unmarshal([]byte(body), &result), ShouldBeNil)
+			So(result.Goroutines, ShouldBeGreaterThan, 0)
+			So(result.HeapAlloc, ShouldBeGreaterThan, 0)
+			So(result.Build.GoVersion, ShouldNotBeEmpty)
+		})
+
+		Convey("Returns Prometheus output", func() {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			api.prometheusHandler(recorder, req, nil)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, "# TYPE sidecar_runtime_goroutines gauge")
+			So(body, ShouldContainSubstring, "sidecar_build_info{")
+			So(body, ShouldContainSubstring, "sidecar_some_gauge 3")
+			So(body, ShouldContainSubstring, "haproxy_backend_web_requests_count 1")
+			So(body, ShouldContainSubstring, "haproxy_backend_web_requests_sum 2")
+		})
+
+		Convey("Includes the health check metrics", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+
+			api.monitor = healthy.NewMonitor("chaucer", "/")
+			api.monitor.AddCheck(&healthy.Check{
+				ID: "deadbeef123", ServiceName: "bocaccio", Type: "HttpGet", Args: server.URL,
+				Command: &healthy.HttpGetCmd{Trace: true},
+			})
+			api.monitor.Run(director.NewFreeLooper(director.ONCE, nil))
+			traceID := api.monitor.Checks["deadbeef123"].LastResult.TraceID
+
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			api.prometheusHandler(recorder, req, nil)
+
+			_, _, body := getResult(recorder)
+			So(body, ShouldContainSubstring, "# TYPE sidecar_check_duration_seconds histogram")
+			So(body, ShouldContainSubstring, `sidecar_check_duration_seconds_bucket{check="deadbeef123",service="bocaccio",le="+Inf"} 1`+"\n")
+			So(body, ShouldContainSubstring, `sidecar_check_duration_seconds_count{check="deadbeef123",service="bocaccio"} 1`)
+			So(body, ShouldContainSubstring, "# TYPE sidecar_check_transitions_total counter")
+			So(body, ShouldNotContainSubstring, traceID)
+
+			Convey("with exemplars in the OpenMetrics format", func() {
+				recorder = httptest.NewRecorder()
+				req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+				api.prometheusHandler(recorder, req, nil)
+
+				_, headers, body := getResult(recorder)
+				So(headers.Get("Content-Type"), ShouldStartWith, "application/openmetrics-text")
+				So(body, ShouldContainSubstring, ` # {trace_id="`+traceID+`"} `)
+				So(body, ShouldContainSubstring, "# TYPE sidecar_check_transitions counter")
+				So(body, ShouldContainSubstring, "# TYPE sidecar_runtime_gc counter\nsidecar_runtime_gc_total ")
+				So(body, ShouldEndWith, "# EOF\n")
+			})
+		})
+
+		Convey("Includes the availability of each service", func() {
+			api.state = catalog.NewServicesState()
+			api.state.Uptime = catalog.NewUptimeTracker(time.Hour, 99.9)
+			api.state.AddServiceEntry(service.Service{
+				ID: "deadbeef123", Name: "bocaccio", Hostname: "chaucer", Updated: time.Now().UTC(),
+			})
+
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			api.prometheusHandler(recorder, req, nil)
+
+			_, _, body := getResult(recorder)
+			So(body, ShouldContainSubstring, "# TYPE sidecar_service_availability_percent gauge")
+			So(body, ShouldContainSubstring, `sidecar_service_availability_percent{service="bocaccio"} 100`)
+			So(body, ShouldContainSubstring, `sidecar_service_error_budget_remaining_percent{service="bocaccio"} 100`)
+		})
+	})
+}
+
+func Test_timelineHandler(t *testing.T) {
+	Convey("When asking for the timeline", t, func() {
+		recorder := httptest.NewRecorder()
+		api := &SidecarApi{}
+		params := map[string]string{"extension": "json"}
+
+		Convey("Returns the recent entries", func() {
+			api.timeline = timeline.NewTimeline()
+			api.timeline.RecordEvent(&events.Event{Time: time.Now().UTC().Add(-2 * time.Hour), Type: "HostJoined", Subject: "dante"})
+			api.timeline.RecordEvent(&events.Event{Time: time.Now().UTC(), Type: "HostLeft", Subject: "chaucer"})
+
+			req := httptest.NewRequest("GET", "/timeline.json", nil)
+			api.timelineHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var result struct {
+				Entries []timeline.Entry
+			}
+			So(json.Unmarshal([]byte(body), &result), ShouldBeNil)
+			So(len(result.Entries), ShouldEqual, 1)
+			So(result.Entries[0].Subject, ShouldEqual, "chaucer")
+
+			recorder = httptest.NewRecorder()
+			req = httptest.NewRequest("GET", "/timeline.json?since=3h&severity=warning", nil)
+			api.timelineHandler(recorder, req, params)
+
+			_, _, body = getResult(recorder)
+			So(json.Unmarshal([]byte(body), &result), ShouldBeNil)
+			So(len(result.Entries), ShouldEqual, 1)
+		})
+
+		Convey("Rejects an invalid since or severity", func() {
+			api.timeline = timeline.NewTimeline()
+			for _, query := range []string{"since=never", "since=-1h", "severity=loud"} {
+				recorder = httptest.NewRecorder()
+				api.timelineHandler(recorder, httptest.NewRequest("GET", "/timeline.json?"+query, nil), params)
+
+				status, _, _ := getResult(recorder)
+				So(status, ShouldEqual, 400)
+			}
+		})
+
+		Convey("Returns a 404 when the timeline isn't enabled", func() {
+			req := httptest.NewRequest("GET", "/timeline.json", nil)
+			api.timelineHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_eventsHandlers(t *testing.T) {
+	Convey("When asking for events", t, func() {
+		bus := events.NewBus(10)
+		bus.Publish(events.Event{Type: "SlowRequest", Subject: "web"})
+
+		recorder := httptest.NewRecorder()
+		api := &SidecarApi{events: bus}
+
+		Convey("Returns the recent events", func() {
+			req := httptest.NewRequest("GET", "/events.json", nil)
+			api.eventsHandler(recorder, req, map[string]string{"extension": "json"})
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var result struct{ Events []events.Event }
+			err := json.Unmarshal([]byte(body), &result)
+			So(err, ShouldBeNil)
+			So(len(result.Events), ShouldEqual, 1)
+			So(result.Events[0].Subject, ShouldEqual, "web")
+		})
+
+		Convey("Streams new events", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			req := httptest.NewRequest("GET", "/events", nil).WithContext(ctx)
+
+			done := make(chan struct{})
+			go func() {
+				api.eventStreamHandler(recorder, req, nil)
+				close(done)
+			}()
+
+			// Give the handler time to subscribe
+			time.Sleep(10 * time.Millisecond)
+
+			bus.Publish(events.Event{Type: "ServerError", Subject: "api"})
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+			<-done
+
+			So(recorder.Body.String(), ShouldContainSubstring, `"Subject":"api"`)
+			So(recorder.Body.String(), ShouldNotContainSubstring, `"Subject":"web"`)
+		})
+
+		Convey("Returns an error without a Bus", func() {
+			api.events = nil
+			req := httptest.NewRequest("GET", "/events.json", nil)
+			api.eventsHandler(recorder, req, map[string]string{"extension": "json"})
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 500)
+		})
+	})
+}
+
+func Test_consistencyHandlers(t *testing.T) {
+	Convey("When invoking the consistency handlers", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = "chaucer"
+		state.AddServiceEntry(service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Hostname: "chaucer",
+			Updated:  time.Now().UTC(),
+			Status:   service.ALIVE,
+		})
+
+		api := &SidecarApi{state: state}
+		server := httptest.NewServer(http.StripPrefix("/api", api.HttpMux()))
+		defer server.Close()
+
+		stale := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"Hostname": "gower", "StateHash": "abba", "ConfigHash": "cafe"}`)
+		}))
+		defer stale.Close()
+
+		api.checker = consistency.NewChecker(func() []consistency.Member {
+			return []consistency.Member{
+				{Name: "chaucer", URL: server.URL},
+				{Name: "langland", URL: server.URL},
+				{Name: "gower", URL: stale.URL},
+			}
+		})
+		api.checker.ConfigHash = func() string { return "cafe" }
+
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+
+		Convey("Returns our hashes", func() {
+			req := httptest.NewRequest("GET", "/consistency.json", nil)
+			api.hashesHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var hashes consistency.Hashes
+			So(json.Unmarshal([]byte(body), &hashes), ShouldBeNil)
+			So(hashes.Hostname, ShouldEqual, "chaucer")
+			So(hashes.StateHash, ShouldEqual, state.Hash())
+			So(hashes.ConfigHash, ShouldEqual, "cafe")
+		})
+
+		Convey("Reports the hosts that differ from the rest of the cluster", func() {
+			req := httptest.NewRequest("GET", "/consistency/cluster.json", nil)
+			api.consistencyHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var report consistency.Report
+			So(json.Unmarshal([]byte(body), &report), ShouldBeNil)
+			So(report.StateHash, ShouldEqual, state.Hash())
+			So(report.Divergent, ShouldResemble, []string{"gower"})
+		})
+	})
+}
+
+func Test_exclusionsHandler(t *testing.T) {
+	Convey("When invoking the exclusions handler", t, func() {
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Hostname: "chaucer",
+			Updated:  time.Now().UTC(),
+			Status:   service.DRAINING,
+			Ports:    []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "127.0.0.1"}},
+		})
+
+		api := &SidecarApi{state: state}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+		req := httptest.NewRequest("GET", "/exclusions.json", nil)
+
+		Convey("Returns the instances the last config left out", func() {
+			api.proxy = haproxy.New("tmpConfig", "tmpPid")
+			api.proxy.Template = "../views/haproxy.cfg"
+			So(api.proxy.WriteConfig(state, ioutil.Discard), ShouldBeNil)
+
+			api.exclusionsHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var exclusions []haproxy.Exclusion
+			So(json.Unmarshal([]byte(body), &exclusions), ShouldBeNil)
+			So(len(exclusions), ShouldEqual, 1)
+			So(exclusions[0].Server, ShouldEqual, "chaucer-deadbeef123")
+			So(exclusions[0].Reason, ShouldEqual, haproxy.ExcludedDraining)
+		})
+
+		Convey("Returns a 404 when HAproxy isn't enabled", func() {
+			api.exclusionsHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_warningsHandler(t *testing.T) {
+	Convey("When invoking the config warnings handler", t, func() {
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Hostname: "chaucer",
+			Updated:  time.Now().UTC(),
+			Ports:    []service.Port{{Type: "tcp", Port: 10450, IP: "127.0.0.1"}},
+		})
+
+		api := &SidecarApi{state: state}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+		req := httptest.NewRequest("GET", "/warnings.json", nil)
+
+		Convey("Returns the warnings the renders ran into", func() {
+			api.proxy = haproxy.New("tmpConfig", "tmpPid")
+			api.proxy.Template = "../views/haproxy.cfg"
+			So(api.proxy.WriteConfig(state, ioutil.Discard), ShouldBeNil)
+			So(api.proxy.WriteConfig(state, ioutil.Discard), ShouldBeNil)
+
+			api.warningsHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var warnings []haproxy.ConfigWarning
+			So(json.Unmarshal([]byte(body), &warnings), ShouldBeNil)
+			So(len(warnings), ShouldEqual, 1)
+			So(warnings[0].Service, ShouldEqual, "bocaccio")
+			So(warnings[0].Kind, ShouldEqual, haproxy.WarnNoServicePorts)
+			So(warnings[0].Count, ShouldEqual, 2)
+		})
+
+		Convey("Returns a 404 when HAproxy isn't enabled", func() {
+			api.warningsHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_discoveryHandler(t *testing.T) {
+	Convey("When invoking the discovery handler", t, func() {
+		api := &SidecarApi{}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+		req := httptest.NewRequest("GET", "/discovery.json", nil)
+
+		Convey("Returns the status of each discovery source", func() {
+			breaker := discovery.NewCircuitBreaker("static", &discovery.MultiDiscovery{}, time.Minute)
+			api.discovery = &discovery.MultiDiscovery{Discoverers: []discovery.Discoverer{breaker}}
+
+			api.discoveryHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var sources []discovery.SourceStatus
+			So(json.Unmarshal([]byte(body), &sources), ShouldBeNil)
+			So(sources, ShouldHaveLength, 1)
+			So(sources[0].Name, ShouldEqual, "static")
+			So(sources[0].Degraded, ShouldBeFalse)
+		})
+
+		Convey("Returns a 404 without discovery", func() {
+			api.discoveryHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_timeoutsHandler(t *testing.T) {
+	Convey("When invoking the timeouts handler", t, func() {
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Hostname: "chaucer",
+			Updated:  time.Now().UTC(),
+			Metadata: map[string]string{"ServerTimeout": "5m"},
+			Ports:    []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "127.0.0.1"}},
+		})
+
+		api := &SidecarApi{state: state}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+		req := httptest.NewRequest("GET", "/timeouts.json", nil)
+
+		Convey("Returns the timeouts the last render applied", func() {
+			api.proxy = haproxy.New("tmpConfig", "tmpPid")
+			api.proxy.Template = "../views/haproxy.cfg"
+			So(api.proxy.WriteConfig(state, ioutil.Discard), ShouldBeNil)
+
+			api.timeoutsHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var timeouts []haproxy.EffectiveTimeouts
+			So(json.Unmarshal([]byte(body), &timeouts), ShouldBeNil)
+			So(len(timeouts), ShouldEqual, 1)
+			So(timeouts[0].Service, ShouldEqual, "bocaccio")
+			So(timeouts[0].Server, ShouldEqual, "5m")
+			So(timeouts[0].Sources["ServerTimeout"], ShouldEqual, haproxy.TimeoutFromLabel)
+			So(timeouts[0].Sources["ConnectTimeout"], ShouldEqual, haproxy.TimeoutFromDefault)
+		})
+
+		Convey("Returns a 404 when HAproxy isn't enabled", func() {
+			api.timeoutsHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+// A TrafficSource with one backend and server
+type stubTrafficSource struct{}
+
+func (stubTrafficSource) Traffic() ([]haproxy.BackendTraffic, error) {
+	return []haproxy.BackendTraffic{{
+		Backend:         "bocaccio-8080",
+		TrafficCounters: haproxy.TrafficCounters{Status: "UP", Sessions: 3},
+		Servers:         []haproxy.ServerTraffic{{Server: "chaucer-deadbeef123"}},
+	}}, nil
+}
+
+func Test_trafficHandler(t *testing.T) {
+	Convey("When invoking the traffic handler", t, func() {
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID:       "deadbeef123",
+			Name:     "bocaccio",
+			Hostname: "chaucer",
+			Updated:  time.Now().UTC(),
+			Ports:    []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "127.0.0.1"}},
+		})
+
+		api := &SidecarApi{state: state, proxy: haproxy.New("tmpConfig", "tmpPid")}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+		req := httptest.NewRequest("GET", "/traffic.json", nil)
+
+		Convey("Returns the traffic last collected, with the services", func() {
+			api.proxy.Traffic = haproxy.NewTrafficCollector(stubTrafficSource{})
+			_, err := api.proxy.Traffic.Collect(state, time.Now().UTC())
+			So(err, ShouldBeNil)
+
+			api.trafficHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var traffic struct {
+				Collected time.Time
+				Backends  []haproxy.BackendTraffic
+			}
+			So(json.Unmarshal([]byte(body), &traffic), ShouldBeNil)
+			So(traffic.Collected.IsZero(), ShouldBeFalse)
+			So(len(traffic.Backends), ShouldEqual, 1)
+			So(traffic.Backends[0].Service, ShouldEqual, "bocaccio")
+			So(traffic.Backends[0].Sessions, ShouldEqual, 3)
+			So(traffic.Backends[0].Servers[0].ID, ShouldEqual, "deadbeef123")
+		})
+
+		Convey("Returns a 404 when the traffic stats aren't enabled", func() {
+			api.trafficHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_reloadsHandler(t *testing.T) {
+	Convey("When invoking the reloads handler", t, func() {
+		api := &SidecarApi{}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+		req := httptest.NewRequest("GET", "/reloads.json", nil)
+
+		Convey("Returns the reload status", func() {
+			api.proxy = haproxy.New("tmpConfig", "tmpPid")
+			api.reloadsHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var result haproxy.ReloadStatus
+			So(json.Unmarshal([]byte(body), &result), ShouldBeNil)
+			So(result.Failures, ShouldEqual, 0)
+		})
+
+		Convey("Returns a 404 when HAproxy isn't enabled", func() {
+			api.reloadsHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_traefikHandler(t *testing.T) {
+	Convey("When invoking the Traefik handler", t, func() {
+		state := catalog.NewServicesState()
+		state.AddServiceEntry(service.Service{
+			ID:        "deadbeef123",
+			Name:      "bocaccio",
+			Hostname:  "chaucer",
+			Updated:   time.Now().UTC(),
+			Status:    service.ALIVE,
+			ProxyMode: "http",
+			Ports:     []service.Port{{Type: "tcp", Port: 10450, ServicePort: 8080, IP: "127.0.0.1"}},
+		})
+
+		api := &SidecarApi{state: state}
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/traefik.json", nil)
+
+		Convey("Returns the routers and services", func() {
+			api.traefikHandler(recorder, req, map[string]string{"extension": "json"})
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var config haproxy.TraefikConfig
+			So(json.Unmarshal([]byte(body), &config), ShouldBeNil)
+			So(config.HTTP.Routers["bocaccio-8080"].EntryPoints, ShouldResemble, []string{"port-8080"})
+			So(config.HTTP.Services["bocaccio-8080"].LoadBalancer.Servers[0].URL, ShouldEqual, "http://127.0.0.1:10450")
+			So(config.TCP, ShouldBeNil)
+		})
+
+		Convey("Returns a 404 for other extensions", func() {
+			api.traefikHandler(recorder, req, map[string]string{"extension": "yaml"})
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_quarantineHandlers(t *testing.T) {
+	Convey("When invoking the quarantine handlers", t, func() {
+		state := catalog.NewServicesState()
+		state.Hostname = "chaucer"
+
+		api := &SidecarApi{state: state}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+
+		Convey("Quarantines a peer", func() {
+			req := httptest.NewRequest("POST", "/quarantines", strings.NewReader(
+				`{"Hostname": "gower", "Reason": "Clock is an hour ahead", "Author": "jane", "ExpiresIn": "2h"}`,
+			))
+			api.addQuarantineHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 201)
+
+			var quarantine catalog.Quarantine
+			So(json.Unmarshal([]byte(body), &quarantine), ShouldBeNil)
+			So(quarantine.Hostname, ShouldEqual, "gower")
+			So(quarantine.Expires, ShouldHappenAfter, time.Now().UTC().Add(119*time.Minute))
+
+			Convey("and lists it", func() {
+				req := httptest.NewRequest("GET", "/quarantines.json", nil)
+				recorder := httptest.NewRecorder()
+				api.quarantinesHandler(recorder, req, params)
+
+				status, _, body := getResult(recorder)
+				So(status, ShouldEqual, 200)
+				So(body, ShouldContainSubstring, "Clock is an hour ahead")
+			})
+
+			Convey("and releases it", func() {
+				req := httptest.NewRequest("DELETE", "/quarantines/gower", nil)
+				recorder := httptest.NewRecorder()
+				params["hostname"] = "gower"
+				api.removeQuarantineHandler(recorder, req, params)
+
+				status, _, _ := getResult(recorder)
+				So(status, ShouldEqual, 200)
+				So(state.Quarantines(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("Rejects quarantining this host", func() {
+			req := httptest.NewRequest("POST", "/quarantines", strings.NewReader(
+				`{"Hostname": "chaucer", "Author": "jane"}`,
+			))
+			api.addQuarantineHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 400)
+			So(state.Quarantines(), ShouldBeEmpty)
+		})
+
+		Convey("Returns a 404 releasing a peer that isn't quarantined", func() {
+			req := httptest.NewRequest("DELETE", "/quarantines/gower", nil)
+			params["hostname"] = "gower"
+			api.removeQuarantineHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_drainsHandlers(t *testing.T) {
+	Convey("When scheduling drains", t, func() {
+		state := catalog.NewServicesState()
+		api := &SidecarApi{state: state}
+		recorder := httptest.NewRecorder()
+
+		Convey("Schedules a drain and lists it", func() {
+			req := httptest.NewRequest("POST", "/drains",
+				strings.NewReader(`{"Service": "bocaccio", "Author": "jane", "StartIn": "2h", "Duration": "45m"}`))
+			api.scheduleDrainHandler(recorder, req, nil)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 201)
+
+			var drain catalog.ScheduledDrain
+			So(json.Unmarshal([]byte(body), &drain), ShouldBeNil)
+			So(drain.End.Sub(drain.Start), ShouldEqual, 45*time.Minute)
+			So(drain.Start.After(time.Now().Add(time.Hour)), ShouldBeTrue)
+
+			recorder = httptest.NewRecorder()
+			req = httptest.NewRequest("GET", "/drains.json", nil)
+			api.drainsHandler(recorder, req, map[string]string{"extension": "json"})
+
+			status, _, body = getResult(recorder)
+			So(status, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, `"Service": "bocaccio"`)
+
+			recorder = httptest.NewRecorder()
+			req = httptest.NewRequest("DELETE", "/drains/"+drain.ID, nil)
+			api.cancelDrainHandler(recorder, req, map[string]string{"id": drain.ID})
+
+			status, _, _ = getResult(recorder)
+			So(status, ShouldEqual, 200)
+			So(state.ScheduledDrains(), ShouldBeEmpty)
+		})
+
+		Convey("Rejects an invalid drain", func() {
+			req := httptest.NewRequest("POST", "/drains",
+				strings.NewReader(`{"Service": "bocaccio", "Author": "jane", "Duration": "48h"}`))
+			api.scheduleDrainHandler(recorder, req, nil)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 400)
+		})
+
+		Convey("Returns a 404 for a drain that isn't scheduled", func() {
+			req := httptest.NewRequest("DELETE", "/drains/12", nil)
+			api.cancelDrainHandler(recorder, req, map[string]string{"id": "12"})
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_changesHandler(t *testing.T) {
+	Convey("When invoking the changes handler", t, func() {
+		state := catalog.NewServicesState()
+		svc := service.Service{ID: "deadbeef123", Name: "bocaccio", Hostname: "chaucer", Updated: time.Now().UTC()}
+
+		api := &SidecarApi{state: state}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+
+		Convey("Replays the changes from an index", func() {
+			state.ChangeLog = catalog.NewChangeLog(10)
+			state.AddServiceEntry(svc)
+			svc.Status = service.DRAINING
+			svc.Updated = svc.Updated.Add(time.Second)
+			state.AddServiceEntry(svc)
+
+			req := httptest.NewRequest("GET", "/changes.json?from=2", nil)
+			api.changesHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var replay catalog.ChangeReplay
+			So(json.Unmarshal([]byte(body), &replay), ShouldBeNil)
+			So(len(replay.Changes), ShouldEqual, 1)
+			So(replay.Changes[0].Index, ShouldEqual, 2)
+			So(replay.Changes[0].Service.Status, ShouldEqual, service.DRAINING)
+			So(replay.Latest, ShouldEqual, 2)
+		})
+
+		Convey("Rejects an invalid limit", func() {
+			state.ChangeLog = catalog.NewChangeLog(10)
+			req := httptest.NewRequest("GET", "/changes.json?limit=0", nil)
+			api.changesHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 400)
+		})
+
+		Convey("Returns a 404 when the change log isn't enabled", func() {
+			req := httptest.NewRequest("GET", "/changes.json", nil)
+			api.changesHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_uptimeHandler(t *testing.T) {
+	Convey("When invoking the uptime handler", t, func() {
+		state := catalog.NewServicesState()
+		svc := service.Service{ID: "deadbeef123", Name: "bocaccio", Hostname: "chaucer", Updated: time.Now().UTC()}
+
+		api := &SidecarApi{state: state}
+		recorder := httptest.NewRecorder()
+		params := map[string]string{"extension": "json"}
+
+		Convey("Returns the uptime of every service", func() {
+			state.Uptime = catalog.NewUptimeTracker(time.Hour, 99.9)
+			state.AddServiceEntry(svc)
+
+			req := httptest.NewRequest("GET", "/uptime.json", nil)
+			api.uptimeHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var result struct {
+				Window   time.Duration
+				Services []catalog.UptimeReport
+			}
+			So(json.Unmarshal([]byte(body), &result), ShouldBeNil)
+			So(result.Window, ShouldEqual, time.Hour)
+			So(len(result.Services), ShouldEqual, 1)
+			So(result.Services[0].Service, ShouldEqual, "bocaccio")
+			So(result.Services[0].Target, ShouldEqual, 99.9)
+		})
+
+		Convey("Returns the uptime of one service, and a 404 for an unknown one", func() {
+			state.Uptime = catalog.NewUptimeTracker(time.Hour, 99.9)
+			state.AddServiceEntry(svc)
+
+			params["name"] = "bocaccio"
+			req := httptest.NewRequest("GET", "/uptime/bocaccio.json", nil)
+			api.uptimeHandler(recorder, req, params)
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+			So(body, ShouldContainSubstring, `"Service": "bocaccio"`)
+
+			recorder = httptest.NewRecorder()
+			params["name"] = "dante"
+			api.uptimeHandler(recorder, httptest.NewRequest("GET", "/uptime/dante.json", nil), params)
+
+			status, _, _ = getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+
+		Convey("Returns a 404 when uptime tracking isn't enabled", func() {
+			req := httptest.NewRequest("GET", "/uptime.json", nil)
+			api.uptimeHandler(recorder, req, params)
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 404)
+		})
+	})
+}
+
+func Test_readyHandler(t *testing.T) {
+	Convey("When invoking the readiness handler", t, func() {
+		state := catalog.NewServicesState()
+		for i, status := range []int{service.ALIVE, service.ALIVE, service.UNHEALTHY} {
+			state.AddServiceEntry(service.Service{
+				ID:       fmt.Sprintf("deadbeef%03d", i),
+				Name:     "bocaccio",
+				Hostname: fmt.Sprintf("chaucer%d", i),
+				Updated:  time.Now().UTC(),
+				Status:   status,
+			})
+		}
+
+		api := &SidecarApi{state: state}
+		mux := api.HttpMux()
+		recorder := httptest.NewRecorder()
+
+		Convey("Returns a 200 when enough instances are healthy", func() {
+			mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/services/bocaccio/ready?min=2", nil))
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 200)
+
+			var readiness ApiReadiness
+			So(json.Unmarshal([]byte(body), &readiness), ShouldBeNil)
+			So(readiness, ShouldResemble, ApiReadiness{Service: "bocaccio", Healthy: 2, Required: 2, Ready: true})
+		})
+
+		Convey("Returns a 503 when too few are", func() {
+			mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/services/bocaccio/ready?min=3", nil))
+
+			status, _, body := getResult(recorder)
+			So(status, ShouldEqual, 503)
+			So(body, ShouldContainSubstring, `"Healthy": 2`)
+		})
+
+		Convey("Needs one instance by default", func() {
+			mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/services/gower/ready", nil))
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 503)
+		})
+
+		Convey("Rejects an invalid min", func() {
+			mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/services/bocaccio/ready?min=none", nil))
+
+			status, _, _ := getResult(recorder)
+			So(status, ShouldEqual, 400)
+		})
+	})
+}
@@ -0,0 +1,230 @@
+package sidecarhttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/healthy"
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// The content type of the OpenMetrics text format, which is the only one
+// that can carry exemplars
+const openMetricsType = "application/openmetrics-text"
+
+// counterFamily returns the name a counter's HELP and TYPE go under. The
+// OpenMetrics format leaves off the _total its samples have.
+func counterFamily(name string, openMetrics bool) string {
+	if openMetrics {
+		return strings.TrimSuffix(name, "_total")
+	}
+	return name
+}
+
+// prometheusName converts a go-metrics key into a valid Prometheus name
+func prometheusName(key string) string {
+	return invalidMetricChars.ReplaceAllString(key, "_")
+}
+
+// prometheusLabels formats go-metrics labels in the Prometheus style
+func prometheusLabels(labels []metrics.Label) string {
+	if len(labels) < 1 {
+		return ""
+	}
+
+	var pairs []string
+	for _, label := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", prometheusName(label.Name), label.Value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeRuntimeMetrics writes the RuntimeStatus in the Prometheus text format
+func writeRuntimeMetrics(output io.Writer, status *RuntimeStatus, openMetrics bool) {
+	gauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"sidecar_runtime_goroutines", "Number of goroutines that currently exist.", float64(status.Goroutines)},
+		{"sidecar_runtime_heap_alloc_bytes", "Bytes of allocated heap objects.", float64(status.HeapAlloc)},
+		{"sidecar_runtime_heap_sys_bytes", "Bytes of heap memory obtained from the OS.", float64(status.HeapSys)},
+		{"sidecar_runtime_heap_objects", "Number of allocated heap objects.", float64(status.HeapObjects)},
+		{"sidecar_runtime_gc_last_pause_seconds", "Duration of the most recent GC pause.", status.LastGCPause.Seconds()},
+		{"sidecar_uptime_seconds", "Seconds since Sidecar started.", status.UptimeSeconds},
+	}
+
+	for _, gauge := range gauges {
+		fmt.Fprintf(output, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n",
+			gauge.name, gauge.help, gauge.name, gauge.name, gauge.value)
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"sidecar_runtime_alloc_bytes_total", "Total bytes allocated for heap objects.", float64(status.TotalAlloc)},
+		{"sidecar_runtime_gc_total", "Number of completed GC cycles.", float64(status.NumGC)},
+		{"sidecar_runtime_gc_pause_seconds_total", "Total time spent in GC pauses.", status.TotalGCPause.Seconds()},
+	}
+
+	for _, counter := range counters {
+		family := counterFamily(counter.name, openMetrics)
+		fmt.Fprintf(output, "# HELP %s %s\n# TYPE %s counter\n%s %v\n",
+			family, counter.help, family, counter.name, counter.value)
+	}
+
+	fmt.Fprintf(output, "# HELP sidecar_build_info Build information for Sidecar.\n# TYPE sidecar_build_info gauge\n")
+	fmt.Fprintf(output, "sidecar_build_info{go_version=%q,version=%q} 1\n",
+		status.Build.GoVersion, status.Build.Version)
+}
+
+// writeUptimeMetrics writes the availability and error budget of each
+// service in the Prometheus text format
+func writeUptimeMetrics(output io.Writer, reports []catalog.UptimeReport) {
+	fmt.Fprintf(output, "# HELP sidecar_service_availability_percent Percent of the uptime window the service was up.\n"+
+		"# TYPE sidecar_service_availability_percent gauge\n")
+	for _, report := range reports {
+		fmt.Fprintf(output, "sidecar_service_availability_percent{service=%q} %v\n", report.Service, report.Availability)
+	}
+
+	fmt.Fprintf(output, "# HELP sidecar_service_error_budget_remaining_percent Percent of the service's error budget left.\n"+
+		"# TYPE sidecar_service_error_budget_remaining_percent gauge\n")
+	for _, report := range reports {
+		fmt.Fprintf(output, "sidecar_service_error_budget_remaining_percent{service=%q} %v\n", report.Service, report.ErrorBudgetRemaining)
+	}
+}
+
+// writeCheckMetrics writes a histogram of how long each health check took,
+// and counters of its changes of status. In the OpenMetrics format, each
+// bucket has the latest traced run it counted as an exemplar.
+func writeCheckMetrics(output io.Writer, checks []healthy.CheckMetrics, openMetrics bool) {
+	fmt.Fprintf(output, "# HELP sidecar_check_duration_seconds How long each health check took to run.\n"+
+		"# TYPE sidecar_check_duration_seconds histogram\n")
+	for _, check := range checks {
+		labels := fmt.Sprintf("check=%q,service=%q", check.ID, check.ServiceName)
+
+		var cumulative uint64
+		for i, count := range check.Buckets {
+			cumulative += count
+
+			bound := "+Inf"
+			if i < len(healthy.DurationBuckets) {
+				bound = strconv.FormatFloat(healthy.DurationBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(output, "sidecar_check_duration_seconds_bucket{%s,le=%q} %d", labels, bound, cumulative)
+
+			if exemplar := check.Exemplars[i]; openMetrics && exemplar != nil {
+				fmt.Fprintf(output, " # {trace_id=%q} %v %.3f", exemplar.TraceID, exemplar.Duration,
+					float64(exemplar.Time.UnixNano())/1e9)
+			}
+			fmt.Fprintln(output)
+		}
+
+		fmt.Fprintf(output, "sidecar_check_duration_seconds_sum{%s} %v\n", labels, check.Sum)
+		fmt.Fprintf(output, "sidecar_check_duration_seconds_count{%s} %d\n", labels, check.Count)
+	}
+
+	family := counterFamily("sidecar_check_transitions_total", openMetrics)
+	fmt.Fprintf(output, "# HELP %s Times each health check changed status.\n# TYPE %s counter\n", family, family)
+	for _, check := range checks {
+		for _, transition := range check.Transitions {
+			fmt.Fprintf(output, "sidecar_check_transitions_total{check=%q,service=%q,from=%q,to=%q} %d\n",
+				check.ID, check.ServiceName, transition.From, transition.To, transition.Count)
+		}
+	}
+}
+
+// writeIntervalMetrics writes a go-metrics interval in the Prometheus text
+// format. Counters and samples only cover the interval, so they are reported
+// as gauges of their count and sum rather than as Prometheus counters.
+func writeIntervalMetrics(output io.Writer, interval *metrics.IntervalMetrics) {
+	interval.RLock()
+	defer interval.RUnlock()
+
+	var lines []string
+
+	for _, gauge := range interval.Gauges {
+		name := prometheusName(gauge.Name)
+		lines = append(lines, fmt.Sprintf("%s%s %v", name, prometheusLabels(gauge.Labels), gauge.Value))
+	}
+
+	sampled := func(values map[string]metrics.SampledValue) {
+		for _, value := range values {
+			name := prometheusName(value.Name)
+			labels := prometheusLabels(value.Labels)
+			lines = append(lines,
+				fmt.Sprintf("%s_count%s %d", name, labels, value.Count),
+				fmt.Sprintf("%s_sum%s %v", name, labels, value.Sum),
+			)
+		}
+	}
+	sampled(interval.Counters)
+	sampled(interval.Samples)
+
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(output, line)
+	}
+}
+
+// prometheusHandler returns the runtime status, the health check metrics,
+// and the most recent complete interval of in-memory metrics in the
+// Prometheus text format, or in the OpenMetrics one when it's asked for.
+func (s *SidecarApi) prometheusHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	openMetrics := strings.Contains(req.Header.Get("Accept"), openMetricsType)
+	if openMetrics {
+		response.Header().Set("Content-Type", openMetricsType+"; version=1.0.0; charset=utf-8")
+	} else {
+		response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	}
+
+	var output bytes.Buffer
+	writeRuntimeMetrics(&output, CurrentRuntimeStatus(), openMetrics)
+
+	if s.monitor != nil {
+		writeCheckMetrics(&output, s.monitor.CheckMetrics(), openMetrics)
+	}
+
+	if s.state != nil {
+		fmt.Fprintf(&output, "# HELP sidecar_state_version Local version of the services state.\n# TYPE sidecar_state_version gauge\n")
+		fmt.Fprintf(&output, "sidecar_state_version %d\n", s.state.Version())
+	}
+
+	if s.state != nil && s.state.Uptime != nil {
+		writeUptimeMetrics(&output, s.state.Uptime.Reports())
+	}
+
+	if s.metrics != nil {
+		intervals := s.metrics.Data()
+		// The last interval is still being filled in, so prefer the one before
+		interval := intervals[len(intervals)-1]
+		if len(intervals) > 1 {
+			interval = intervals[len(intervals)-2]
+		}
+		writeIntervalMetrics(&output, interval)
+	}
+
+	if openMetrics {
+		fmt.Fprintln(&output, "# EOF")
+	}
+
+	_, err := response.Write(output.Bytes())
+	if err != nil {
+		log.Errorf("Error writing Prometheus response to client: %s", err)
+	}
+}
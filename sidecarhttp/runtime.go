@@ -0,0 +1,95 @@
+package sidecarhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Used to report uptime. Close enough to process start for our purposes.
+var startTime = time.Now().UTC()
+
+type BuildInfo struct {
+	GoVersion string
+	Path      string `json:",omitempty"`
+	Version   string `json:",omitempty"`
+}
+
+// RuntimeStatus is a snapshot of the Go runtime's view of the process. It's
+// mostly useful for spotting goroutine and memory leaks in long-running
+// Sidecars.
+type RuntimeStatus struct {
+	StartTime     time.Time
+	Uptime        string
+	UptimeSeconds float64
+	Goroutines    int
+	HeapAlloc     uint64
+	HeapSys       uint64
+	HeapObjects   uint64
+	TotalAlloc    uint64
+	NumGC         uint32
+	LastGC        time.Time
+	LastGCPause   time.Duration
+	TotalGCPause  time.Duration
+	Build         BuildInfo
+}
+
+// CurrentRuntimeStatus collects the current RuntimeStatus
+func CurrentRuntimeStatus() *RuntimeStatus {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	uptime := time.Since(startTime)
+
+	status := &RuntimeStatus{
+		StartTime:     startTime,
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: uptime.Seconds(),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapSys:       mem.HeapSys,
+		HeapObjects:   mem.HeapObjects,
+		TotalAlloc:    mem.TotalAlloc,
+		NumGC:         mem.NumGC,
+		TotalGCPause:  time.Duration(mem.PauseTotalNs),
+		Build:         BuildInfo{GoVersion: runtime.Version()},
+	}
+
+	if mem.NumGC > 0 {
+		status.LastGC = time.Unix(0, int64(mem.LastGC)).UTC()
+		// PauseNs is a circular buffer, the most recent is at (NumGC+255)%256
+		status.LastGCPause = time.Duration(mem.PauseNs[(mem.NumGC+255)%256])
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		status.Build.Path = info.Main.Path
+		status.Build.Version = info.Main.Version
+	}
+
+	return status
+}
+
+// runtimeHandler returns the RuntimeStatus for this process
+func (s *SidecarApi) runtimeHandler(response http.ResponseWriter, req *http.Request, params map[string]string) {
+	defer req.Body.Close()
+
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Access-Control-Allow-Methods", "GET")
+	response.Header().Set("Content-Type", "application/json")
+
+	jsonBytes, err := json.MarshalIndent(CurrentRuntimeStatus(), "", "  ")
+	if err != nil {
+		log.Errorf("Error marshaling runtime status in runtimeHandler: %s", err.Error())
+		sendJsonError(response, 500, "Internal server error")
+		return
+	}
+
+	_, err = response.Write(jsonBytes)
+	if err != nil {
+		log.Errorf("Error writing runtime status response to client: %s", err)
+	}
+}
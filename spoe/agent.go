@@ -0,0 +1,311 @@
+// The spoe package is an agent for HAproxy's Stream Processing Offload
+// Engine. HAproxy asks it about each request to the services whose Metadata
+// wants decisions, e.g. a RateLimit or AllowedSources, and it answers by
+// setting a variable that the frontend's rules act on. It also sends copies
+// of the requests to services with a MirrorTo on to their shadow.
+package spoe
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// The decisions the agent sets in the txn.sidecar.decision variable
+const (
+	DecisionAllow     = "allow"
+	DecisionDeny      = "deny"
+	DecisionRateLimit = "rate-limit"
+)
+
+const (
+	// The message HAproxy sends for each request, with the service and src
+	// arguments
+	MessageName = "check-request"
+	// The variable the decision is set in, before HAproxy's var-prefix
+	DecisionVar = "decision"
+	// The message HAproxy sends for each request to copy to a shadow
+	// service, with the addr, method, path, ver, hdrs, and body arguments
+	MirrorMessageName = "mirror-request"
+
+	// The SPOP version we speak
+	protocolVersion = "2.0"
+
+	DefaultMaxFrameSize  = 16384
+	DefaultIdleTimeout   = 3 * time.Minute // Longer than HAproxy's idle timeout
+	DefaultMaxMirrors    = 100             // Mirrored requests in flight at once
+	DefaultMirrorTimeout = 10 * time.Second
+	pruneInterval        = time.Minute
+	listenerChannelSize  = 20
+)
+
+// What the agent decides a service's requests with
+type policy struct {
+	RateLimit      *service.RateLimit
+	AllowedSources []*net.IPNet
+}
+
+// A bucket holds the requests a client can still make to a service. It
+// refills at the service's rate, up to the whole RateLimit.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	per    time.Duration // How long it takes to refill
+}
+
+// An Agent answers HAproxy's questions about the requests, from the
+// policies in the services' Metadata
+type Agent struct {
+	MaxFrameSize uint32
+	IdleTimeout  time.Duration
+	Clock        clock.Clock
+	MirrorClient *http.Client // Sends the mirrored requests
+	mirrorSlots  chan struct{}
+	policies     map[string]*policy // By service name
+	buckets      map[string]*bucket // By service name and client address
+	lastPrune    time.Time
+	eventChan    chan catalog.ChangeEvent
+	sync.Mutex
+}
+
+// NewAgent returns an Agent with the defaults set
+func NewAgent() *Agent {
+	return &Agent{
+		MaxFrameSize: DefaultMaxFrameSize,
+		IdleTimeout:  DefaultIdleTimeout,
+		MirrorClient: &http.Client{Timeout: DefaultMirrorTimeout},
+		mirrorSlots:  make(chan struct{}, DefaultMaxMirrors),
+		policies:     make(map[string]*policy),
+		buckets:      make(map[string]*bucket),
+		eventChan:    make(chan catalog.ChangeEvent, listenerChannelSize),
+	}
+}
+
+// Watch keeps the policies up to date with the state. It runs until the
+// listener's channel is closed.
+func (a *Agent) Watch(state *catalog.ServicesState) {
+	state.AddListener(a)
+	a.UpdatePolicies(state)
+
+	for range a.eventChan {
+		// A deploy changes many services at once, so catch up on all of them
+	drain:
+		for {
+			select {
+			case _, ok := <-a.eventChan:
+				if !ok {
+					return
+				}
+			default:
+				break drain
+			}
+		}
+
+		a.UpdatePolicies(state)
+	}
+}
+
+// UpdatePolicies takes the policies from the Metadata of the newest alive
+// instance of each service
+func (a *Agent) UpdatePolicies(state *catalog.ServicesState) {
+	newest := make(map[string]*service.Service)
+
+	state.RLock()
+	state.EachService(func(hostname *string, serviceId *string, svc *service.Service) {
+		if !svc.IsAlive() {
+			return
+		}
+		if current, ok := newest[svc.Name]; !ok || svc.Updated.After(current.Updated) {
+			newest[svc.Name] = svc
+		}
+	})
+
+	policies := make(map[string]*policy, len(newest))
+	for svcName, svc := range newest {
+		if !svc.WantsDecisions() {
+			continue
+		}
+		limit, _ := svc.RateLimit()
+		policies[svcName] = &policy{RateLimit: limit, AllowedSources: svc.AllowedSources()}
+	}
+	state.RUnlock()
+
+	a.Lock()
+	a.policies = policies
+	a.Unlock()
+}
+
+// Decide says what to do with a request to a service from a client. The
+// requests to services without a policy are allowed.
+func (a *Agent) Decide(svcName string, src net.IP) string {
+	now := clock.OrReal(a.Clock).Now()
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.prune(now)
+
+	p, ok := a.policies[svcName]
+	if !ok {
+		return DecisionAllow
+	}
+
+	if len(p.AllowedSources) > 0 && !allowed(src, p.AllowedSources) {
+		return DecisionDeny
+	}
+
+	if p.RateLimit != nil && !a.take(svcName+"/"+src.String(), p.RateLimit, now) {
+		return DecisionRateLimit
+	}
+
+	return DecisionAllow
+}
+
+// allowed says whether a client is in one of the networks
+func allowed(src net.IP, sources []*net.IPNet) bool {
+	if src == nil {
+		return false
+	}
+	for _, network := range sources {
+		if network.Contains(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// take takes a request from the client's bucket, and says whether there was
+// one left. Must be called with the lock held.
+func (a *Agent) take(key string, limit *service.RateLimit, now time.Time) bool {
+	size := float64(limit.Requests)
+
+	b, ok := a.buckets[key]
+	if !ok {
+		b = &bucket{tokens: size, last: now}
+		a.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(size, b.tokens+elapsed*size/limit.Per.Seconds())
+	}
+	b.last = now
+	b.per = limit.Per
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops the buckets that have refilled, at most once a pruneInterval.
+// Must be called with the lock held.
+func (a *Agent) prune(now time.Time) {
+	if now.Sub(a.lastPrune) < pruneInterval {
+		return
+	}
+	a.lastPrune = now
+
+	for key, b := range a.buckets {
+		if now.Sub(b.last) >= b.per {
+			delete(a.buckets, key)
+		}
+	}
+}
+
+// handle decides the requests in the messages from a NOTIFY frame, and
+// returns the actions to send back
+func (a *Agent) handle(messages []message) []action {
+	var actions []action
+	for i := range messages {
+		msg := &messages[i]
+		if msg.Name == MirrorMessageName {
+			a.mirror(msg)
+			continue
+		}
+		if msg.Name != MessageName {
+			log.Debugf("Ignoring unknown SPOE message '%s'", msg.Name)
+			continue
+		}
+
+		svcName, _ := msg.Arg("service").(string)
+		src, _ := msg.Arg("src").(net.IP)
+
+		decision := a.Decide(svcName, src)
+		metrics.IncrCounter([]string{"spoe", "decisions", decision}, 1)
+
+		actions = append(actions, action{Scope: scopeTransaction, Name: DecisionVar, Value: decision})
+	}
+	return actions
+}
+
+// ListenAndServe answers HAproxy on an address
+func (a *Agent) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return a.Serve(listener)
+}
+
+// Serve answers the connections from HAproxy on a listener, until accepting
+// one fails
+func (a *Agent) Serve(listener net.Listener) error {
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go a.ServeConn(conn)
+	}
+}
+
+// ServeConn answers one connection from HAproxy until either end
+// disconnects
+func (a *Agent) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	c := &connection{agent: a, conn: conn, maxFrameSize: a.MaxFrameSize}
+	if err := c.serve(); err != nil {
+		log.Warnf("SPOE connection from %s failed: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// Name is part of the catalog.Listener interface
+func (a *Agent) Name() string {
+	return "SPOE"
+}
+
+// Managed is part of the catalog.Listener interface. The Agent stays for as
+// long as Sidecar runs.
+func (a *Agent) Managed() bool {
+	return false
+}
+
+// Chan is part of the catalog.Listener interface
+func (a *Agent) Chan() chan catalog.ChangeEvent {
+	return a.eventChan
+}
+
+// supportsVersion says whether HAproxy's supported-versions, e.g. "1.0, 2.0",
+// include ours
+func supportsVersion(versions string) bool {
+	for _, version := range strings.Split(versions, ",") {
+		if strings.TrimSpace(version) == protocolVersion {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package spoe
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Agent(t *testing.T) {
+	Convey("The Agent", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		baseTime := time.Now().UTC()
+		state := catalog.NewServicesState()
+		add := func(id string, name string, updated time.Time, metadata map[string]string) {
+			state.AddServiceEntry(service.Service{
+				ID: id, Name: name, Hostname: "indomitable", Updated: updated, Metadata: metadata,
+			})
+		}
+		add("deadbeef001", "web", baseTime, map[string]string{"RateLimit": "2/s"})
+		add("deadbeef002", "admin", baseTime, map[string]string{"AllowedSources": "10.1.0.0/16"})
+		add("deadbeef003", "api", baseTime, nil)
+
+		fakeClock := clock.NewFake(baseTime)
+		agent := NewAgent()
+		agent.Clock = fakeClock
+		agent.UpdatePolicies(state)
+
+		client := net.ParseIP("10.1.2.3")
+		other := net.ParseIP("10.2.0.1")
+
+		Convey("allows the requests to services without a policy", func() {
+			So(agent.Decide("api", client), ShouldEqual, DecisionAllow)
+			So(agent.Decide("missing", nil), ShouldEqual, DecisionAllow)
+		})
+
+		Convey("denies the clients that aren't from the AllowedSources", func() {
+			So(agent.Decide("admin", client), ShouldEqual, DecisionAllow)
+			So(agent.Decide("admin", other), ShouldEqual, DecisionDeny)
+			So(agent.Decide("admin", nil), ShouldEqual, DecisionDeny)
+		})
+
+		Convey("limits the rate of each client's requests", func() {
+			So(agent.Decide("web", client), ShouldEqual, DecisionAllow)
+			So(agent.Decide("web", client), ShouldEqual, DecisionAllow)
+			So(agent.Decide("web", client), ShouldEqual, DecisionRateLimit)
+			So(agent.Decide("web", other), ShouldEqual, DecisionAllow)
+
+			fakeClock.Advance(500 * time.Millisecond)
+			So(agent.Decide("web", client), ShouldEqual, DecisionAllow)
+			So(agent.Decide("web", client), ShouldEqual, DecisionRateLimit)
+
+			Convey("and drops the clients that stopped", func() {
+				fakeClock.Advance(2 * time.Minute)
+				agent.Decide("api", client)
+				So(agent.buckets, ShouldBeEmpty)
+			})
+		})
+
+		Convey("takes the policies from the newest instance", func() {
+			add("deadbeef004", "web", baseTime.Add(time.Second), nil)
+			agent.UpdatePolicies(state)
+
+			for i := 0; i < 5; i++ {
+				So(agent.Decide("web", client), ShouldEqual, DecisionAllow)
+			}
+		})
+
+		Convey("answers HAproxy", func() {
+			haproxy, agentConn := net.Pipe()
+			defer haproxy.Close()
+
+			done := make(chan struct{})
+			go func() {
+				agent.ServeConn(agentConn)
+				close(done)
+			}()
+
+			send := func(f *frame) {
+				So(writeFrame(haproxy, f), ShouldBeNil)
+			}
+			receive := func() *frame {
+				f, err := readFrame(haproxy, DefaultMaxFrameSize)
+				So(err, ShouldBeNil)
+				return f
+			}
+
+			hello, _ := appendKVList(nil, []kv{
+				{Name: "supported-versions", Value: "1.0, 2.0"},
+				{Name: "max-frame-size", Value: uint32(4096)},
+				{Name: "capabilities", Value: "pipelining,async"},
+			})
+			send(&frame{Type: frameHAproxyHello, Flags: flagFin, Payload: hello})
+
+			reply := receive()
+			So(reply.Type, ShouldEqual, frameAgentHello)
+			settings, err := decodeKVList(reply.Payload)
+			So(err, ShouldBeNil)
+			So(settings["version"], ShouldEqual, "2.0")
+			So(settings["max-frame-size"], ShouldEqual, uint32(4096))
+
+			notify := append(appendString(nil, MessageName), 2)
+			notify, _ = appendKVList(notify, []kv{{Name: "service", Value: "admin"}, {Name: "src", Value: other.To4()}})
+			send(&frame{Type: frameNotify, Flags: flagFin, StreamID: 12, FrameID: 1, Payload: notify})
+
+			ack := receive()
+			So(ack.Type, ShouldEqual, frameAck)
+			So(ack.StreamID, ShouldEqual, 12)
+			So(ack.FrameID, ShouldEqual, 1)
+
+			expected, _ := appendActions(nil, []action{{Scope: scopeTransaction, Name: "decision", Value: DecisionDeny}})
+			So(ack.Payload, ShouldResemble, expected)
+
+			disconnect, _ := appendKVList(nil, []kv{{Name: "status-code", Value: uint32(0)}, {Name: "message", Value: "bye"}})
+			send(&frame{Type: frameHAproxyDisconnect, Flags: flagFin, Payload: disconnect})
+
+			So(receive().Type, ShouldEqual, frameAgentDisconnect)
+			<-done
+		})
+
+		Convey("disconnects HAproxy when it doesn't speak our version", func() {
+			haproxy, agentConn := net.Pipe()
+			defer haproxy.Close()
+			go agent.ServeConn(agentConn)
+
+			hello, _ := appendKVList(nil, []kv{
+				{Name: "supported-versions", Value: "1.0"},
+				{Name: "max-frame-size", Value: uint32(4096)},
+			})
+			So(writeFrame(haproxy, &frame{Type: frameHAproxyHello, Flags: flagFin, Payload: hello}), ShouldBeNil)
+
+			reply, err := readFrame(haproxy, DefaultMaxFrameSize)
+			So(err, ShouldBeNil)
+			So(reply.Type, ShouldEqual, frameAgentDisconnect)
+			settings, _ := decodeKVList(reply.Payload)
+			So(settings["status-code"], ShouldEqual, uint32(statusUnsupportedVersion))
+		})
+	})
+}
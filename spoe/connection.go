@@ -0,0 +1,172 @@
+package spoe
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// A connection is one of HAproxy's connections to the agent
+type connection struct {
+	agent        *Agent
+	conn         net.Conn
+	reader       *bufio.Reader
+	maxFrameSize uint32
+}
+
+// serve does the handshake, then answers the NOTIFY frames until HAproxy
+// disconnects. HAproxy closing the connection isn't an error.
+func (c *connection) serve() error {
+	c.reader = bufio.NewReader(c.conn)
+
+	hello, err := c.read()
+	if err != nil {
+		return c.failed(err)
+	}
+	if hello.Type != frameHAproxyHello {
+		return c.disconnect(statusInvalidFrame, fmt.Sprintf("expected HAPROXY-HELLO, got frame type %d", hello.Type))
+	}
+
+	healthcheck, err := c.handshake(hello)
+	if err != nil || healthcheck {
+		return err
+	}
+
+	for {
+		f, err := c.read()
+		if err != nil {
+			return c.failed(err)
+		}
+
+		switch f.Type {
+		case frameNotify:
+			if f.Flags&flagFin == 0 {
+				return c.disconnect(statusNoFragmentation, "fragmentation is not supported")
+			}
+			if err := c.notify(f); err != nil {
+				return err
+			}
+		case frameHAproxyDisconnect:
+			return c.disconnect(statusNormal, "")
+		default:
+			return c.disconnect(statusInvalidFrame, fmt.Sprintf("unexpected frame type %d", f.Type))
+		}
+	}
+}
+
+// handshake answers the HAPROXY-HELLO, and says whether it was only a
+// health check
+func (c *connection) handshake(hello *frame) (bool, error) {
+	settings, err := decodeKVList(hello.Payload)
+	if err != nil {
+		return false, c.disconnect(statusInvalidFrame, err.Error())
+	}
+
+	versions, ok := settings["supported-versions"].(string)
+	if !ok {
+		return false, c.disconnect(statusNoVersion, "supported-versions is missing")
+	}
+	if !supportsVersion(versions) {
+		return false, c.disconnect(statusUnsupportedVersion, "only version "+protocolVersion+" is supported")
+	}
+
+	maxFrameSize, ok := settings["max-frame-size"].(uint32)
+	if !ok {
+		return false, c.disconnect(statusNoMaxFrameSize, "max-frame-size is missing")
+	}
+	if maxFrameSize < 256 {
+		return false, c.disconnect(statusBadMaxFrameSize, "max-frame-size is too small")
+	}
+	if maxFrameSize < c.maxFrameSize {
+		c.maxFrameSize = maxFrameSize
+	}
+
+	payload, err := appendKVList(nil, []kv{
+		{Name: "version", Value: protocolVersion},
+		{Name: "max-frame-size", Value: c.maxFrameSize},
+		{Name: "capabilities", Value: "pipelining"},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	err = c.write(&frame{Type: frameAgentHello, Flags: flagFin, Payload: payload})
+	if err != nil {
+		return false, c.failed(err)
+	}
+
+	healthcheck, _ := settings["healthcheck"].(bool)
+	return healthcheck, nil
+}
+
+// notify answers a NOTIFY frame with an ACK, in the same stream and frame
+func (c *connection) notify(f *frame) error {
+	messages, err := decodeMessages(f.Payload)
+	if err != nil {
+		return c.disconnect(statusInvalidFrame, err.Error())
+	}
+
+	payload, err := appendActions(nil, c.agent.handle(messages))
+	if err != nil {
+		return err
+	}
+
+	err = c.write(&frame{
+		Type: frameAck, Flags: flagFin, StreamID: f.StreamID, FrameID: f.FrameID, Payload: payload,
+	})
+	if err != nil {
+		return c.failed(err)
+	}
+	return nil
+}
+
+// disconnect sends an AGENT-DISCONNECT, and returns an error for any status
+// but a normal one
+func (c *connection) disconnect(status uint32, reason string) error {
+	message := reason
+	if message == "" {
+		message = "normal"
+	}
+
+	payload, err := appendKVList(nil, []kv{
+		{Name: "status-code", Value: status},
+		{Name: "message", Value: message},
+	})
+	if err == nil {
+		err = c.write(&frame{Type: frameAgentDisconnect, Flags: flagFin, Payload: payload})
+	}
+
+	if status != statusNormal {
+		return fmt.Errorf("Error from SPOE connection: %s", reason)
+	}
+	return err
+}
+
+// failed disconnects after an error reading or writing a frame. The
+// connection closing isn't an error.
+func (c *connection) failed(err error) error {
+	switch err {
+	case io.EOF:
+		return nil
+	case errFrameTooBig:
+		return c.disconnect(statusFrameTooBig, err.Error())
+	case errTruncated:
+		return c.disconnect(statusInvalidFrame, err.Error())
+	}
+
+	// An I/O error leaves nothing to send the disconnect on
+	return fmt.Errorf("Error from SPOE connection: %s", err)
+}
+
+func (c *connection) read() (*frame, error) {
+	if c.agent.IdleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.agent.IdleTimeout))
+	}
+	return readFrame(c.reader, c.maxFrameSize)
+}
+
+func (c *connection) write(f *frame) error {
+	return writeFrame(c.conn, f)
+}
@@ -0,0 +1,137 @@
+package spoe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/armon/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// The header on the requests the agent mirrors, so the shadow can tell
+const MirrorHeader = "X-Sidecar-Mirror"
+
+// The hop-by-hop headers, which are about HAproxy's connection to the
+// client and aren't copied to the mirrored request
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Content-Length":    true, // Set from the body we got
+}
+
+// mirror sends a copy of the request in a mirror message on to the address
+// in it, without waiting for the response. When there are already
+// MaxMirrors in flight, the copy is dropped rather than queued, so a slow
+// shadow can't build up a backlog.
+func (a *Agent) mirror(msg *message) {
+	req, err := mirrorRequest(msg)
+	if err != nil {
+		log.Debugf("Can't mirror the request: %s", err)
+		metrics.IncrCounter([]string{"spoe", "mirror", "errors"}, 1)
+		return
+	}
+
+	select {
+	case a.mirrorSlots <- struct{}{}:
+	default:
+		metrics.IncrCounter([]string{"spoe", "mirror", "dropped"}, 1)
+		return
+	}
+
+	go func() {
+		defer func() { <-a.mirrorSlots }()
+
+		resp, err := a.MirrorClient.Do(req)
+		if err != nil {
+			log.Debugf("Error mirroring the request to %s: %s", req.URL.Host, err)
+			metrics.IncrCounter([]string{"spoe", "mirror", "errors"}, 1)
+			return
+		}
+		// The responses are thrown away
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		metrics.IncrCounter([]string{"spoe", "mirror", "requests"}, 1)
+	}()
+}
+
+// mirrorRequest builds the copy of the request from the arguments of a
+// mirror message: addr, method, path, ver, hdrs, and body
+func mirrorRequest(msg *message) (*http.Request, error) {
+	addr, _ := msg.Arg("addr").(string)
+	method, _ := msg.Arg("method").(string)
+	path, _ := msg.Arg("path").(string)
+	if addr == "" || method == "" || path == "" {
+		return nil, fmt.Errorf("the addr, method, and path are required")
+	}
+	if !strings.HasPrefix(path, "/") {
+		// An absolute URI, e.g. from a proxy client. Keep its path.
+		uri, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		path = uri.RequestURI()
+	}
+
+	var headers http.Header
+	if hdrs, ok := msg.Arg("hdrs").([]byte); ok {
+		var err error
+		if headers, err = decodeHeaders(hdrs); err != nil {
+			return nil, err
+		}
+	}
+
+	body, _ := msg.Arg("body").([]byte)
+	req, err := http.NewRequest(method, "http://"+addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range headers {
+		if hopHeaders[name] {
+			continue
+		}
+		if name == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[name] = values
+	}
+	req.Header.Set(MirrorHeader, "true")
+
+	return req, nil
+}
+
+// decodeHeaders decodes HAproxy's req.hdrs_bin: a name and value string for
+// each header, ending with two empty ones
+func decodeHeaders(data []byte) (http.Header, error) {
+	headers := make(http.Header)
+	for len(data) > 0 {
+		name, rest, err := decodeString(data)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := decodeString(rest)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		if name == "" {
+			return headers, nil
+		}
+		headers.Add(name, value)
+	}
+
+	return headers, nil
+}
@@ -0,0 +1,102 @@
+package spoe
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Mirror(t *testing.T) {
+	Convey("Mirroring requests", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		var hdrs []byte
+		for _, header := range [][2]string{
+			{"Host", "web.example.com"},
+			{"Accept", "text/plain"},
+			{"Connection", "keep-alive"},
+			{"Content-Length", "5"},
+			{"", ""},
+		} {
+			hdrs = appendString(appendString(hdrs, header[0]), header[1])
+		}
+
+		msg := func(addr string, path string) *message {
+			return &message{Name: MirrorMessageName, Args: []kv{
+				{Name: "addr", Value: addr},
+				{Name: "method", Value: "POST"},
+				{Name: "path", Value: path},
+				{Name: "ver", Value: "1.1"},
+				{Name: "hdrs", Value: hdrs},
+				{Name: "body", Value: []byte("hello")},
+			}}
+		}
+
+		Convey("decodeHeaders() reads the names and values up to the empty one", func() {
+			headers, err := decodeHeaders(hdrs)
+			So(err, ShouldBeNil)
+			So(headers, ShouldResemble, http.Header{
+				"Host": {"web.example.com"}, "Accept": {"text/plain"},
+				"Connection": {"keep-alive"}, "Content-Length": {"5"},
+			})
+
+			_, err = decodeHeaders(hdrs[:3])
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("mirrorRequest()", func() {
+			Convey("copies the request without the hop-by-hop headers", func() {
+				req, err := mirrorRequest(msg("127.0.0.1:9080", "/search?q=beowulf"))
+				So(err, ShouldBeNil)
+				So(req.Method, ShouldEqual, "POST")
+				So(req.URL.String(), ShouldEqual, "http://127.0.0.1:9080/search?q=beowulf")
+				So(req.Host, ShouldEqual, "web.example.com")
+				So(req.Header, ShouldResemble, http.Header{"Accept": {"text/plain"}, MirrorHeader: {"true"}})
+				So(req.ContentLength, ShouldEqual, 5)
+			})
+
+			Convey("keeps the path of absolute URIs", func() {
+				req, err := mirrorRequest(msg("127.0.0.1:9080", "http://web.example.com/search?q=beowulf"))
+				So(err, ShouldBeNil)
+				So(req.URL.String(), ShouldEqual, "http://127.0.0.1:9080/search?q=beowulf")
+			})
+
+			Convey("needs an address", func() {
+				_, err := mirrorRequest(msg("", "/"))
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("the agent sends the copies on to the shadow", func() {
+			received := make(chan *http.Request, 1)
+			bodies := make(chan string, 1)
+			shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				received <- r
+				bodies <- string(body)
+			}))
+			defer shadow.Close()
+
+			agent := NewAgent()
+			actions := agent.handle([]message{*msg(strings.TrimPrefix(shadow.URL, "http://"), "/search")})
+			So(actions, ShouldBeEmpty)
+
+			req := <-received
+			So(req.URL.Path, ShouldEqual, "/search")
+			So(req.Host, ShouldEqual, "web.example.com")
+			So(req.Header.Get(MirrorHeader), ShouldEqual, "true")
+			So(<-bodies, ShouldEqual, "hello")
+
+			Convey("and drops them when too many are in flight", func() {
+				agent.mirrorSlots = make(chan struct{})
+				agent.handle([]message{*msg(strings.TrimPrefix(shadow.URL, "http://"), "/search")})
+				So(received, ShouldBeEmpty)
+			})
+		})
+	})
+}
@@ -0,0 +1,408 @@
+package spoe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The frame types of the Stream Processing Offload Protocol
+const (
+	frameHAproxyHello      = 1
+	frameHAproxyDisconnect = 2
+	frameNotify            = 3
+	frameAgentHello        = 101
+	frameAgentDisconnect   = 102
+	frameAck               = 103
+)
+
+// The frame flags. We don't announce fragmentation, so HAproxy always sets
+// FIN.
+const (
+	flagFin = 0x01
+)
+
+// The types of the typed data, in its low four bits. Booleans keep their
+// value in the high ones.
+const (
+	typeNull   = 0
+	typeBool   = 1
+	typeInt32  = 2
+	typeUint32 = 3
+	typeInt64  = 4
+	typeUint64 = 5
+	typeIPv4   = 6
+	typeIPv6   = 7
+	typeString = 8
+	typeBinary = 9
+	flagTrue   = 0x10
+)
+
+// The actions an agent can send back in an ACK, and the scopes of the
+// variables they set
+const (
+	actionSetVar   = 1
+	actionUnsetVar = 2
+
+	scopeProcess     = 0
+	scopeSession     = 1
+	scopeTransaction = 2
+	scopeRequest     = 3
+	scopeResponse    = 4
+)
+
+// The status codes of a disconnect
+const (
+	statusNormal             = 0
+	statusIO                 = 1
+	statusFrameTooBig        = 3
+	statusInvalidFrame       = 4
+	statusNoVersion          = 5
+	statusNoMaxFrameSize     = 6
+	statusUnsupportedVersion = 8
+	statusBadMaxFrameSize    = 9
+	statusNoFragmentation    = 10
+)
+
+// The length of a frame is four bytes, big endian
+const frameLengthSize = 4
+
+var (
+	errFrameTooBig = errors.New("frame is bigger than the max-frame-size")
+	errTruncated   = errors.New("frame is truncated")
+)
+
+// A frame is one SPOP frame, without its length
+type frame struct {
+	Type     byte
+	Flags    uint32
+	StreamID uint64
+	FrameID  uint64
+	Payload  []byte
+}
+
+// A message is one of the messages in a NOTIFY frame, with its arguments
+// in the order they were sent
+type message struct {
+	Name string
+	Args []kv
+}
+
+// Arg returns the value of the argument with a name, or nil
+func (m *message) Arg(name string) interface{} {
+	for _, arg := range m.Args {
+		if arg.Name == name {
+			return arg.Value
+		}
+	}
+	return nil
+}
+
+// A kv is a name and typed value, as in the payload of the hello and
+// disconnect frames and the arguments of messages
+type kv struct {
+	Name  string
+	Value interface{}
+}
+
+// An action is what the agent asks HAproxy to do after a NOTIFY. Only
+// setting variables is supported.
+type action struct {
+	Scope byte
+	Name  string
+	Value interface{}
+}
+
+// readFrame reads the next frame, which can't be bigger than maxSize
+func readFrame(r io.Reader, maxSize uint32) (*frame, error) {
+	var length [frameLengthSize]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxSize {
+		return nil, errFrameTooBig
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return decodeFrame(data)
+}
+
+// decodeFrame decodes a frame from the bytes after its length
+func decodeFrame(data []byte) (*frame, error) {
+	if len(data) < 5 {
+		return nil, errTruncated
+	}
+
+	f := &frame{Type: data[0], Flags: binary.BigEndian.Uint32(data[1:5])}
+	data = data[5:]
+
+	var err error
+	if f.StreamID, data, err = decodeVarint(data); err != nil {
+		return nil, err
+	}
+	if f.FrameID, data, err = decodeVarint(data); err != nil {
+		return nil, err
+	}
+	f.Payload = data
+
+	return f, nil
+}
+
+// writeFrame writes a frame with its length
+func writeFrame(w io.Writer, f *frame) error {
+	buf := make([]byte, frameLengthSize, frameLengthSize+16+len(f.Payload))
+	buf = append(buf, f.Type, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[frameLengthSize+1:], f.Flags)
+	buf = appendVarint(buf, f.StreamID)
+	buf = appendVarint(buf, f.FrameID)
+	buf = append(buf, f.Payload...)
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-frameLengthSize))
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// appendVarint encodes an integer the way SPOP does: values under 240 take
+// one byte, and the larger ones carry 4 bits in the first byte and 7 in each
+// of the rest.
+func appendVarint(buf []byte, i uint64) []byte {
+	if i < 240 {
+		return append(buf, byte(i))
+	}
+
+	buf = append(buf, byte(i)|240)
+	i = (i - 240) >> 4
+	for i >= 128 {
+		buf = append(buf, byte(i)|128)
+		i = (i - 128) >> 7
+	}
+
+	return append(buf, byte(i))
+}
+
+// decodeVarint decodes an integer encoded by appendVarint, and returns the
+// bytes after it
+func decodeVarint(data []byte) (uint64, []byte, error) {
+	if len(data) < 1 {
+		return 0, nil, errTruncated
+	}
+
+	i := uint64(data[0])
+	data = data[1:]
+	if i < 240 {
+		return i, data, nil
+	}
+
+	shift := uint(4)
+	for {
+		if len(data) < 1 {
+			return 0, nil, errTruncated
+		}
+		b := data[0]
+		data = data[1:]
+
+		i += uint64(b) << shift
+		shift += 7
+		if b < 128 {
+			return i, data, nil
+		}
+	}
+}
+
+func appendString(buf []byte, value string) []byte {
+	buf = appendVarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func decodeString(data []byte) (string, []byte, error) {
+	length, data, err := decodeVarint(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(data)) < length {
+		return "", nil, errTruncated
+	}
+
+	return string(data[:length]), data[length:], nil
+}
+
+// appendTypedData encodes a value with its type. Ints are sent as int64s.
+func appendTypedData(buf []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, typeNull), nil
+	case bool:
+		if v {
+			return append(buf, typeBool|flagTrue), nil
+		}
+		return append(buf, typeBool), nil
+	case int32:
+		return appendVarint(append(buf, typeInt32), uint64(v)), nil
+	case uint32:
+		return appendVarint(append(buf, typeUint32), uint64(v)), nil
+	case int:
+		return appendVarint(append(buf, typeInt64), uint64(v)), nil
+	case int64:
+		return appendVarint(append(buf, typeInt64), uint64(v)), nil
+	case uint64:
+		return appendVarint(append(buf, typeUint64), v), nil
+	case net.IP:
+		if ip4 := v.To4(); ip4 != nil {
+			return append(append(buf, typeIPv4), ip4...), nil
+		}
+		if ip6 := v.To16(); ip6 != nil {
+			return append(append(buf, typeIPv6), ip6...), nil
+		}
+		return nil, fmt.Errorf("Error encoding IP address '%s'", v)
+	case string:
+		return appendString(append(buf, typeString), v), nil
+	case []byte:
+		buf = appendVarint(append(buf, typeBinary), uint64(len(v)))
+		return append(buf, v...), nil
+	default:
+		return nil, fmt.Errorf("Error encoding value of type %T", value)
+	}
+}
+
+// decodeTypedData decodes a value encoded by appendTypedData, and returns
+// the bytes after it. Signed ints come back as int32 or int64.
+func decodeTypedData(data []byte) (interface{}, []byte, error) {
+	if len(data) < 1 {
+		return nil, nil, errTruncated
+	}
+
+	dataType := data[0] & 0x0f
+	flags := data[0] & 0xf0
+	data = data[1:]
+
+	switch dataType {
+	case typeNull:
+		return nil, data, nil
+	case typeBool:
+		return flags&flagTrue != 0, data, nil
+	case typeInt32, typeUint32, typeInt64, typeUint64:
+		i, rest, err := decodeVarint(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch dataType {
+		case typeInt32:
+			return int32(i), rest, nil
+		case typeUint32:
+			return uint32(i), rest, nil
+		case typeInt64:
+			return int64(i), rest, nil
+		default:
+			return i, rest, nil
+		}
+	case typeIPv4, typeIPv6:
+		size := net.IPv4len
+		if dataType == typeIPv6 {
+			size = net.IPv6len
+		}
+		if len(data) < size {
+			return nil, nil, errTruncated
+		}
+		ip := make(net.IP, size)
+		copy(ip, data[:size])
+		return ip, data[size:], nil
+	case typeString:
+		return decodeString(data)
+	case typeBinary:
+		length, rest, err := decodeVarint(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if uint64(len(rest)) < length {
+			return nil, nil, errTruncated
+		}
+		value := make([]byte, length)
+		copy(value, rest[:length])
+		return value, rest[length:], nil
+	default:
+		return nil, nil, fmt.Errorf("Error decoding data of unknown type %d", dataType)
+	}
+}
+
+// appendKVList encodes the payload of the hello and disconnect frames
+func appendKVList(buf []byte, list []kv) ([]byte, error) {
+	var err error
+	for _, item := range list {
+		buf = appendString(buf, item.Name)
+		if buf, err = appendTypedData(buf, item.Value); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// decodeKVList decodes the payload of the hello and disconnect frames
+func decodeKVList(data []byte) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	for len(data) > 0 {
+		name, rest, err := decodeString(data)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := decodeTypedData(rest)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = value
+		data = rest
+	}
+	return result, nil
+}
+
+// decodeMessages decodes the payload of a NOTIFY frame
+func decodeMessages(data []byte) ([]message, error) {
+	var messages []message
+	for len(data) > 0 {
+		name, rest, err := decodeString(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < 1 {
+			return nil, errTruncated
+		}
+
+		msg := message{Name: name}
+		count := int(rest[0])
+		rest = rest[1:]
+		for i := 0; i < count; i++ {
+			var arg kv
+			if arg.Name, rest, err = decodeString(rest); err != nil {
+				return nil, err
+			}
+			if arg.Value, rest, err = decodeTypedData(rest); err != nil {
+				return nil, err
+			}
+			msg.Args = append(msg.Args, arg)
+		}
+
+		messages = append(messages, msg)
+		data = rest
+	}
+	return messages, nil
+}
+
+// appendActions encodes the payload of an ACK frame
+func appendActions(buf []byte, actions []action) ([]byte, error) {
+	var err error
+	for _, act := range actions {
+		buf = append(buf, actionSetVar, 3, act.Scope)
+		buf = appendString(buf, act.Name)
+		if buf, err = appendTypedData(buf, act.Value); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
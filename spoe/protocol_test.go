@@ -0,0 +1,90 @@
+package spoe
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Protocol(t *testing.T) {
+	Convey("The varints", t, func() {
+		Convey("take one byte under 240", func() {
+			So(appendVarint(nil, 239), ShouldResemble, []byte{239})
+			So(appendVarint(nil, 240), ShouldResemble, []byte{240, 0})
+			So(appendVarint(nil, 300), ShouldResemble, []byte{252, 3})
+		})
+
+		Convey("decode to what was encoded", func() {
+			for _, i := range []uint64{0, 1, 239, 240, 2287, 2288, 16384, 1 << 32, 1<<64 - 1} {
+				buf := appendVarint(nil, i)
+				decoded, rest, err := decodeVarint(append(buf, 42))
+				So(err, ShouldBeNil)
+				So(decoded, ShouldEqual, i)
+				So(rest, ShouldResemble, []byte{42})
+			}
+		})
+
+		Convey("return an error when they're truncated", func() {
+			_, _, err := decodeVarint([]byte{252})
+			So(err, ShouldEqual, errTruncated)
+		})
+	})
+
+	Convey("The typed data decodes to what was encoded", t, func() {
+		values := []interface{}{
+			nil, true, false, int32(-5), uint32(16384), int64(-1 << 40), uint64(1 << 40),
+			net.ParseIP("10.1.2.3").To4(), net.ParseIP("fd00::1"), "web", []byte{0, 1, 2},
+		}
+		for _, value := range values {
+			buf, err := appendTypedData(nil, value)
+			So(err, ShouldBeNil)
+
+			decoded, rest, err := decodeTypedData(buf)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, value)
+			So(rest, ShouldBeEmpty)
+		}
+
+		_, err := appendTypedData(nil, 1.5)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("The frames", t, func() {
+		Convey("are read as they were written", func() {
+			var buf bytes.Buffer
+			sent := &frame{Type: frameAck, Flags: flagFin, StreamID: 7, FrameID: 300, Payload: []byte("payload")}
+			So(writeFrame(&buf, sent), ShouldBeNil)
+
+			received, err := readFrame(&buf, 1024)
+			So(err, ShouldBeNil)
+			So(received, ShouldResemble, sent)
+		})
+
+		Convey("can't be bigger than the max-frame-size", func() {
+			var buf bytes.Buffer
+			writeFrame(&buf, &frame{Type: frameNotify, Payload: make([]byte, 100)})
+
+			_, err := readFrame(&buf, 50)
+			So(err, ShouldEqual, errFrameTooBig)
+		})
+
+		Convey("decode the messages of a NOTIFY", func() {
+			buf := appendString(nil, "check-request")
+			buf = append(buf, 2)
+			buf, _ = appendKVList(buf, []kv{{Name: "service", Value: "web"}, {Name: "src", Value: net.IPv4(10, 0, 0, 1).To4()}})
+			buf = append(appendString(buf, "other"), 0)
+
+			messages, err := decodeMessages(buf)
+			So(err, ShouldBeNil)
+			So(len(messages), ShouldEqual, 2)
+			So(messages[0].Name, ShouldEqual, "check-request")
+			So(messages[0].Arg("service"), ShouldEqual, "web")
+			So(messages[0].Arg("src").(net.IP).String(), ShouldEqual, "10.0.0.1")
+			So(messages[0].Arg("missing"), ShouldBeNil)
+			So(messages[1].Name, ShouldEqual, "other")
+			So(messages[1].Args, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	startupInitialBackoff = 250 * time.Millisecond
+	startupMaxBackoff     = 5 * time.Second
+)
+
+// waitFor calls check until it succeeds or the timeout expires, backing off
+// between attempts. This lets us start before our dependencies at boot,
+// rather than crashing or spewing errors. A zero timeout skips the wait.
+func waitFor(name string, timeout time.Duration, check func() error) error {
+	if timeout <= 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	backoff := startupInitialBackoff
+
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("Timed out after %s waiting for %s: %s", timeout, name, err)
+		}
+
+		log.Warnf("Waiting for %s: %s (retrying in %s)", name, err, backoff)
+		time.Sleep(backoff)
+
+		backoff = backoff * 2
+		if backoff > startupMaxBackoff {
+			backoff = startupMaxBackoff
+		}
+	}
+}
+
+// commandAvailable returns an error if the binary that a shell command
+// starts with can't be found.
+func commandAvailable(command string) func() error {
+	return func() error {
+		fields := strings.Fields(command)
+		if len(fields) < 1 {
+			return fmt.Errorf("empty command")
+		}
+
+		_, err := exec.LookPath(fields[0])
+		return err
+	}
+}
+
+// dirAvailable returns an error if the directory containing a file doesn't
+// exist yet.
+func dirAvailable(file string) func() error {
+	return func() error {
+		dir := filepath.Dir(file)
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+
+		return nil
+	}
+}
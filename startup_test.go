@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_waitFor(t *testing.T) {
+	Convey("Waiting for dependencies", t, func() {
+		attempts := 0
+		check := func() error {
+			attempts++
+			if attempts < 2 {
+				return errors.New("not yet")
+			}
+			return nil
+		}
+
+		Convey("retries until the check succeeds", func() {
+			err := waitFor("something", time.Second, check)
+			So(err, ShouldBeNil)
+			So(attempts, ShouldEqual, 2)
+		})
+
+		Convey("gives up at the timeout", func() {
+			err := waitFor("something", 10*time.Millisecond, check)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not yet")
+		})
+
+		Convey("doesn't wait when the timeout is zero", func() {
+			err := waitFor("something", 0, check)
+			So(err, ShouldBeNil)
+			So(attempts, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Checking for HAproxy", t, func() {
+		Convey("finds the binary a command starts with", func() {
+			So(commandAvailable("sh -c true")(), ShouldBeNil)
+			So(commandAvailable("not-a-real-binary -c")(), ShouldNotBeNil)
+		})
+
+		Convey("checks that the config dir exists", func() {
+			dir, _ := ioutil.TempDir("", "sidecar")
+			defer os.RemoveAll(dir)
+
+			So(dirAvailable(filepath.Join(dir, "haproxy.cfg"))(), ShouldBeNil)
+			So(dirAvailable(filepath.Join(dir, "missing", "haproxy.cfg"))(), ShouldNotBeNil)
+		})
+	})
+}
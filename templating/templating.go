@@ -0,0 +1,219 @@
+// The templating package is the contract between Sidecar and the proxy
+// templates it renders, including site overlays. The functions available
+// to a template are versioned: the minor version goes up when functions are
+// added and the major version when any are removed or change behavior. A
+// template can declare the version it was written against with a comment:
+//
+//	{{/* funcmap: 1.2 */}}
+//
+// and rendering fails with a clear error if this Sidecar can't satisfy it,
+// rather than the template breaking in some less obvious way. Functions
+// that are on their way out are marked deprecated, and templates using them
+// get a warning in the logs.
+package templating
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"text/template/parse"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A Version of the template functions
+type Version struct {
+	Major int
+	Minor int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// Satisfies tells us whether templates written against the required version
+// work with this one
+func (v Version) Satisfies(required Version) bool {
+	return v.Major == required.Major && v.Minor >= required.Minor
+}
+
+// A Func describes one of the template functions
+type Func struct {
+	Since      Version
+	Deprecated string // What to use instead, when it is deprecated
+}
+
+// A Contract is the version of a set of template functions, and what each
+// of them is
+type Contract struct {
+	Version Version
+	Funcs   map[string]Func
+	warned  map[string]bool
+	sync.Mutex
+}
+
+var versionDirective = regexp.MustCompile(`\{\{-?\s*/\*\s*funcmap:\s*(\d+)\.(\d+)\s*\*/\s*-?\}\}`)
+
+// Required returns the version a template declares it needs, and whether it
+// declares one at all
+func Required(text string) (Version, bool) {
+	match := versionDirective.FindStringSubmatch(text)
+	if match == nil {
+		return Version{}, false
+	}
+
+	// The regex only matches digits, these can only fail on overflow
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+
+	return Version{Major: major, Minor: minor}, true
+}
+
+// Check validates a template against the contract before it is parsed. It
+// returns an error if the template needs a version we can't satisfy, and
+// warns once about each deprecated function the template uses.
+func (c *Contract) Check(file string, text string, funcMap template.FuncMap) error {
+	if required, ok := Required(text); ok && !c.Version.Satisfies(required) {
+		return fmt.Errorf("Template '%s' requires template functions version %s, but Sidecar provides %s",
+			file, required, c.Version)
+	}
+
+	// Parse errors are reported when the template is parsed for real
+	t, err := template.New(file).Funcs(funcMap).Parse(text)
+	if err != nil {
+		return nil
+	}
+
+	for _, name := range c.deprecatedIn(t) {
+		c.warnOnce(file, name)
+	}
+
+	return nil
+}
+
+// deprecatedIn returns the deprecated functions a template uses, sorted
+func (c *Contract) deprecatedIn(t *template.Template) []string {
+	used := make(map[string]bool)
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			identifiers(tmpl.Tree.Root, used)
+		}
+	}
+
+	var deprecated []string
+	for name := range used {
+		if fn, ok := c.Funcs[name]; ok && fn.Deprecated != "" {
+			deprecated = append(deprecated, name)
+		}
+	}
+	sort.Strings(deprecated)
+
+	return deprecated
+}
+
+func (c *Contract) warnOnce(file string, name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := file + ":" + name
+	if c.warned[key] {
+		return
+	}
+	if c.warned == nil {
+		c.warned = make(map[string]bool)
+	}
+	c.warned[key] = true
+
+	log.Warnf("Template '%s' uses deprecated function '%s': %s", file, name, c.Funcs[name].Deprecated)
+}
+
+// identifiers records the function names called anywhere under the node
+func identifiers(node parse.Node, used map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			identifiers(child, used)
+		}
+	case *parse.ActionNode:
+		identifiers(n.Pipe, used)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			identifiers(cmd, used)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			identifiers(arg, used)
+		}
+	case *parse.IdentifierNode:
+		used[n.Ident] = true
+	case *parse.ChainNode:
+		identifiers(n.Node, used)
+	case *parse.IfNode:
+		identifiers(&n.BranchNode, used)
+	case *parse.RangeNode:
+		identifiers(&n.BranchNode, used)
+	case *parse.WithNode:
+		identifiers(&n.BranchNode, used)
+	case *parse.BranchNode:
+		identifiers(n.Pipe, used)
+		identifiers(n.List, used)
+		identifiers(n.ElseList, used)
+	case *parse.TemplateNode:
+		identifiers(n.Pipe, used)
+	}
+}
+
+// ParseWithOverlay parses the base template and then, if there is one, the
+// site overlay on top of it. Any blocks the overlay defines replace those in
+// the base, and everything else comes from the base. Both are checked
+// against the contract first.
+func ParseWithOverlay(file string, overlayFile string, contract *Contract,
+	funcMap template.FuncMap) (*template.Template, error) {
+
+	base, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading template '%s': %s", file, err.Error())
+	}
+
+	if err := contract.Check(file, string(base), funcMap); err != nil {
+		return nil, err
+	}
+
+	t, err := template.New(path.Base(file)).Funcs(funcMap).Parse(string(base))
+	if err != nil {
+		return nil, fmt.Errorf("Error Parsing template '%s': %s", file, err.Error())
+	}
+
+	if overlayFile == "" {
+		return t, nil
+	}
+
+	overlay, err := ioutil.ReadFile(overlayFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading template overlay '%s': %s", overlayFile, err.Error())
+	}
+
+	if err := contract.Check(overlayFile, string(overlay), funcMap); err != nil {
+		return nil, err
+	}
+
+	// Parse it under its own name so it can't replace the base template
+	// itself, even when the files have the same name
+	_, err = t.New("overlay").Parse(string(overlay))
+	if err != nil {
+		return nil, fmt.Errorf("Error Parsing template overlay '%s': %s", overlayFile, err.Error())
+	}
+
+	return t, nil
+}
@@ -0,0 +1,109 @@
+package templating
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Contract(t *testing.T) {
+	Convey("Contract", t, func() {
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+
+		contract := &Contract{
+			Version: Version{Major: 1, Minor: 2},
+			Funcs: map[string]Func{
+				"bindIP":   {Since: Version{1, 0}, Deprecated: "use bindsFor"},
+				"bindsFor": {Since: Version{1, 1}},
+			},
+		}
+		funcMap := template.FuncMap{
+			"bindIP":   func() string { return "" },
+			"bindsFor": func(string) []string { return nil },
+		}
+
+		Convey("reads the version a template declares", func() {
+			version, ok := Required("{{/* funcmap: 1.12 */}}\nbind {{ bindIP }}")
+			So(ok, ShouldBeTrue)
+			So(version, ShouldResemble, Version{Major: 1, Minor: 12})
+
+			_, ok = Required("bind {{ bindIP }}")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("accepts templates for this or an earlier minor version", func() {
+			So(contract.Check("site.cfg", "{{/* funcmap: 1.2 */}}", funcMap), ShouldBeNil)
+			So(contract.Check("site.cfg", "{{- /* funcmap: 1.0 */ -}}", funcMap), ShouldBeNil)
+			So(contract.Check("site.cfg", "no declaration", funcMap), ShouldBeNil)
+		})
+
+		Convey("rejects templates for a later minor or another major version", func() {
+			err := contract.Check("site.cfg", "{{/* funcmap: 1.3 */}}", funcMap)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "requires template functions version 1.3")
+
+			So(contract.Check("site.cfg", "{{/* funcmap: 2.0 */}}", funcMap), ShouldNotBeNil)
+		})
+
+		Convey("warns once about deprecated functions in use", func() {
+			text := `{{ define "frontend" }}{{ range $a := bindsFor "web" }}{{ if true }}{{ bindIP }}{{ end }}{{ end }}{{ end }}`
+
+			So(contract.Check("site.cfg", text, funcMap), ShouldBeNil)
+			So(contract.Check("site.cfg", text, funcMap), ShouldBeNil)
+
+			So(logged.String(), ShouldContainSubstring, "deprecated function 'bindIP': use bindsFor")
+			So(bytes.Count(logged.Bytes(), []byte("deprecated")), ShouldEqual, 1)
+			So(logged.String(), ShouldNotContainSubstring, "'bindsFor'")
+		})
+
+		Convey("ParseWithOverlay()", func() {
+			dir, _ := ioutil.TempDir("", "templating")
+			defer os.RemoveAll(dir)
+
+			base := path.Join(dir, "proxy.cfg")
+			ioutil.WriteFile(base, []byte(`{{ block "greeting" . }}hello{{ end }} {{ bindsFor "web" }}`), 0644)
+			overlay := path.Join(dir, "site.cfg")
+
+			render := func(t *template.Template) string {
+				var buf bytes.Buffer
+				So(t.ExecuteTemplate(&buf, "proxy.cfg", nil), ShouldBeNil)
+				return buf.String()
+			}
+
+			Convey("parses the base template alone", func() {
+				t, err := ParseWithOverlay(base, "", contract, funcMap)
+				So(err, ShouldBeNil)
+				So(render(t), ShouldEqual, "hello []")
+			})
+
+			Convey("replaces the blocks the overlay defines", func() {
+				ioutil.WriteFile(overlay, []byte(`{{ define "greeting" }}howdy{{ end }}`), 0644)
+
+				t, err := ParseWithOverlay(base, overlay, contract, funcMap)
+				So(err, ShouldBeNil)
+				So(render(t), ShouldEqual, "howdy []")
+			})
+
+			Convey("checks the overlay against the contract", func() {
+				ioutil.WriteFile(overlay, []byte("{{/* funcmap: 1.3 */}}"), 0644)
+
+				_, err := ParseWithOverlay(base, overlay, contract, funcMap)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "requires template functions version 1.3")
+			})
+
+			Convey("reports the files it can't read", func() {
+				_, err := ParseWithOverlay(base, path.Join(dir, "missing.cfg"), contract, funcMap)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "Error reading template overlay")
+			})
+		})
+	})
+}
@@ -0,0 +1,160 @@
+package testhelpers
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/discovery"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// FakeDocker stands in for the Docker daemon. It implements the
+// discovery.DockerClient interface, keeps a list of running containers, and
+// sends start and die events to any event listeners when containers are
+// added or removed.
+type FakeDocker struct {
+	containers []docker.APIContainers
+	listeners  []chan<- *docker.APIEvents
+	PingError  error // Returned from Ping() when set
+	sync.Mutex
+}
+
+func NewFakeDocker() *FakeDocker {
+	return &FakeDocker{}
+}
+
+// ClientProvider can be assigned to DockerDiscovery.ClientProvider so that
+// discovery talks to this fake rather than the real daemon.
+func (f *FakeDocker) ClientProvider() (discovery.DockerClient, error) {
+	return f, nil
+}
+
+// AddContainer starts a container and sends a "start" event for it. The ID
+// should be at least 12 characters long, like a real container ID.
+func (f *FakeDocker) AddContainer(container docker.APIContainers) {
+	f.Lock()
+	if container.Created == 0 {
+		container.Created = time.Now().UTC().Unix()
+	}
+	if container.State == "" {
+		container.State = "running"
+	}
+	f.containers = append(f.containers, container)
+	f.Unlock()
+
+	f.Emit(&docker.APIEvents{Status: "start", ID: container.ID, From: container.Image})
+}
+
+// RemoveContainer stops the container with this ID and sends a "die" event
+// for it. It returns false if there was no such container.
+func (f *FakeDocker) RemoveContainer(id string) bool {
+	f.Lock()
+	var found *docker.APIContainers
+	for i, container := range f.containers {
+		if container.ID == id {
+			found = &container
+			f.containers = append(f.containers[:i], f.containers[i+1:]...)
+			break
+		}
+	}
+	f.Unlock()
+
+	if found == nil {
+		return false
+	}
+
+	f.Emit(&docker.APIEvents{Status: "die", ID: found.ID, From: found.Image})
+	return true
+}
+
+// Emit sends an event to all the event listeners. It blocks until each of
+// them has received it, so events arrive in the order they were emitted.
+func (f *FakeDocker) Emit(event *docker.APIEvents) {
+	f.Lock()
+	listeners := make([]chan<- *docker.APIEvents, len(f.listeners))
+	copy(listeners, f.listeners)
+	f.Unlock()
+
+	for _, listener := range listeners {
+		listener <- event
+	}
+}
+
+// InspectContainer is part of the discovery.DockerClient interface. It
+// matches on the full or the short container ID.
+func (f *FakeDocker) InspectContainer(id string) (*docker.Container, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, container := range f.containers {
+		if id == "" || !strings.HasPrefix(container.ID, id) {
+			continue
+		}
+
+		name := ""
+		if len(container.Names) > 0 {
+			name = container.Names[0]
+		}
+
+		return &docker.Container{
+			ID:      container.ID,
+			Name:    name,
+			Image:   container.Image,
+			Created: time.Unix(container.Created, 0).UTC(),
+			State:   docker.State{Running: true},
+			Config: &docker.Config{
+				Image:  container.Image,
+				Labels: container.Labels,
+			},
+		}, nil
+	}
+
+	return nil, &docker.NoSuchContainer{ID: id}
+}
+
+// ListContainers is part of the discovery.DockerClient interface
+func (f *FakeDocker) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	containers := make([]docker.APIContainers, len(f.containers))
+	copy(containers, f.containers)
+
+	return containers, nil
+}
+
+// AddEventListener is part of the discovery.DockerClient interface
+func (f *FakeDocker) AddEventListener(listener chan<- *docker.APIEvents) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.listeners = append(f.listeners, listener)
+	return nil
+}
+
+// RemoveEventListener is part of the discovery.DockerClient interface. Like
+// the real client, it closes the channel.
+func (f *FakeDocker) RemoveEventListener(listener chan *docker.APIEvents) error {
+	f.Lock()
+	defer f.Unlock()
+
+	for i, existing := range f.listeners {
+		if existing == listener {
+			f.listeners = append(f.listeners[:i], f.listeners[i+1:]...)
+			close(listener)
+			return nil
+		}
+	}
+
+	return errors.New("no such event listener")
+}
+
+// Ping is part of the discovery.DockerClient interface
+func (f *FakeDocker) Ping() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.PingError
+}
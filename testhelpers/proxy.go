@@ -0,0 +1,138 @@
+package testhelpers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProxyRecorder stands in for a proxy that Sidecar manages. Rather than
+// writing out a config file and running the reload command, it renders the
+// config into memory and records it. Render is usually the WriteConfig
+// method of an haproxy.HAproxy or the WriteStreamConfig method of an
+// nginx.Nginx, so the real templates are exercised.
+type ProxyRecorder struct {
+	Render       func(state *catalog.ServicesState, output io.Writer) error
+	configs      []string
+	eventChannel chan catalog.ChangeEvent
+	updated      chan struct{}
+	sync.Mutex
+}
+
+func NewProxyRecorder(render func(state *catalog.ServicesState, output io.Writer) error) *ProxyRecorder {
+	return &ProxyRecorder{
+		Render:       render,
+		eventChannel: make(chan catalog.ChangeEvent, 2),
+		updated:      make(chan struct{}),
+	}
+}
+
+// WriteAndReload renders the config for the current state and records it
+// as if the proxy had been reloaded with it.
+func (p *ProxyRecorder) WriteAndReload(state *catalog.ServicesState) error {
+	var output bytes.Buffer
+	if err := p.Render(state, &output); err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.configs = append(p.configs, output.String())
+	// Wake up anyone waiting in WaitForConfigs()
+	close(p.updated)
+	p.updated = make(chan struct{})
+	p.Unlock()
+
+	return nil
+}
+
+// Watch subscribes to the state and records a new config on every state
+// change event. Unlike the real proxies, it returns once the subscription
+// is in place, so tests can make changes right away without racing it.
+func (p *ProxyRecorder) Watch(state *catalog.ServicesState) {
+	state.AddListener(p)
+
+	go func() {
+		for range p.eventChannel {
+			err := p.WriteAndReload(state)
+			if err != nil {
+				log.Errorf("Error rendering proxy config: %s", err)
+			}
+		}
+	}()
+}
+
+// Configs returns all of the configs rendered so far, oldest first
+func (p *ProxyRecorder) Configs() []string {
+	p.Lock()
+	defer p.Unlock()
+
+	configs := make([]string, len(p.configs))
+	copy(configs, p.configs)
+
+	return configs
+}
+
+// LastConfig returns the most recently rendered config, or an empty string
+// if there hasn't been one yet.
+func (p *ProxyRecorder) LastConfig() string {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.configs) < 1 {
+		return ""
+	}
+
+	return p.configs[len(p.configs)-1]
+}
+
+// Reloads returns how many times the proxy would have been reloaded
+func (p *ProxyRecorder) Reloads() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return len(p.configs)
+}
+
+// WaitForConfigs waits until at least count configs have been rendered and
+// returns them. It returns an error if that doesn't happen within the
+// timeout.
+func (p *ProxyRecorder) WaitForConfigs(count int, timeout time.Duration) ([]string, error) {
+	deadline := time.After(timeout)
+
+	for {
+		p.Lock()
+		if len(p.configs) >= count {
+			p.Unlock()
+			return p.Configs(), nil
+		}
+		updated := p.updated
+		p.Unlock()
+
+		select {
+		case <-updated:
+		case <-deadline:
+			return nil, fmt.Errorf("Timed out waiting for %d configs, only got %d", count, p.Reloads())
+		}
+	}
+}
+
+// Name is part of the catalog.Listener interface. Returns the listener name.
+func (p *ProxyRecorder) Name() string {
+	return "ProxyRecorder"
+}
+
+// Managed is part of the catalog.Listener interface. The recorder is added
+// and removed by hand, like the real proxies.
+func (p *ProxyRecorder) Managed() bool {
+	return false
+}
+
+// Chan is part of the catalog.Listener interface. Returns the channel we listen on.
+func (p *ProxyRecorder) Chan() chan catalog.ChangeEvent {
+	return p.eventChannel
+}
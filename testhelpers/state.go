@@ -0,0 +1,83 @@
+package testhelpers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/service"
+)
+
+// StateBuilder builds up an in-memory ServicesState without needing any
+// discovery or gossip. The services are added with AddServiceEntry, so they
+// go through the same path as services received from the cluster.
+type StateBuilder struct {
+	state    *catalog.ServicesState
+	baseTime time.Time
+	count    int
+}
+
+// NewStateBuilder returns a StateBuilder for a state belonging to the host
+// with this name.
+func NewStateBuilder(hostname string) *StateBuilder {
+	state := catalog.NewServicesState()
+	state.Hostname = hostname
+
+	return &StateBuilder{
+		state:    state,
+		baseTime: time.Now().UTC().Round(time.Second),
+	}
+}
+
+// WithService adds an ALIVE service on the host, with a generated ID. The
+// service is in HTTP proxy mode.
+func (b *StateBuilder) WithService(hostname string, name string, ports ...service.Port) *StateBuilder {
+	return b.WithServiceStatus(hostname, name, service.ALIVE, ports...)
+}
+
+// WithServiceStatus adds a service on the host with the status passed in
+func (b *StateBuilder) WithServiceStatus(hostname string, name string, status int, ports ...service.Port) *StateBuilder {
+	b.count++
+
+	return b.WithServiceEntry(service.Service{
+		ID:        fmt.Sprintf("deadbeef%04d", b.count),
+		Name:      name,
+		Image:     name + ":latest",
+		Created:   b.baseTime,
+		Updated:   b.baseTime,
+		Hostname:  hostname,
+		ProxyMode: "http",
+		Status:    status,
+		Ports:     ports,
+	})
+}
+
+// WithServiceEntry adds a fully specified service. The Created and Updated
+// times default to when the builder was created.
+func (b *StateBuilder) WithServiceEntry(svc service.Service) *StateBuilder {
+	if svc.Created.IsZero() {
+		svc.Created = b.baseTime
+	}
+	if svc.Updated.IsZero() {
+		svc.Updated = b.baseTime
+	}
+
+	b.state.AddServiceEntry(svc)
+	return b
+}
+
+// Build returns the ServicesState. The builder can still be used to add
+// more services to the same state afterward.
+func (b *StateBuilder) Build() *catalog.ServicesState {
+	return b.state
+}
+
+// TCPPort returns a TCP port on this IP, mapped to the ServicePort
+func TCPPort(ip string, port int64, servicePort int64) service.Port {
+	return service.Port{Type: "tcp", IP: ip, Port: port, ServicePort: servicePort}
+}
+
+// UDPPort returns a UDP port on this IP, mapped to the ServicePort
+func UDPPort(ip string, port int64, servicePort int64) service.Port {
+	return service.Port{Type: "udp", IP: ip, Port: port, ServicePort: servicePort}
+}
@@ -0,0 +1,139 @@
+package testhelpers
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/discovery"
+	"github.com/NinesStack/sidecar/haproxy"
+	"github.com/NinesStack/sidecar/service"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return condition()
+}
+
+func Test_FakeDocker(t *testing.T) {
+	Convey("FakeDocker", t, func() {
+		fake := NewFakeDocker()
+		container := docker.APIContainers{
+			ID:     "deadbeef1234567890",
+			Names:  []string{"/web-deadbeef123"},
+			Image:  "web:latest",
+			Labels: map[string]string{"ServicePort_80": "8080", "HealthCheck": "HttpGet"},
+			Ports:  []docker.APIPort{{PrivatePort: 80, PublicPort: 32080, Type: "tcp", IP: "0.0.0.0"}},
+		}
+
+		Convey("lists and inspects the containers it has", func() {
+			fake.AddContainer(container)
+
+			containers, err := fake.ListContainers(docker.ListContainersOptions{})
+			So(err, ShouldBeNil)
+			So(len(containers), ShouldEqual, 1)
+
+			inspected, err := fake.InspectContainer("deadbeef1234")
+			So(err, ShouldBeNil)
+			So(inspected.Config.Labels["HealthCheck"], ShouldEqual, "HttpGet")
+
+			_, err = fake.InspectContainer("abba")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("drives DockerDiscovery with its containers and events", func() {
+			namer, err := discovery.NewRegexpNamer("^/(.+)(-[0-9a-z]{7,14})$")
+			So(err, ShouldBeNil)
+			disco := discovery.NewDockerDiscovery("", namer, "10.0.0.1")
+			disco.ClientProvider = fake.ClientProvider
+
+			looper := director.NewFreeLooper(director.FOREVER, make(chan error))
+			disco.Run(looper)
+			defer looper.Quit()
+
+			fake.AddContainer(container)
+			So(waitFor(3*time.Second, func() bool { return len(disco.Services()) == 1 }), ShouldBeTrue)
+
+			svc := disco.Services()[0]
+			So(svc.Name, ShouldEqual, "web")
+			So(svc.Ports[0].ServicePort, ShouldEqual, 8080)
+
+			So(fake.RemoveContainer(container.ID), ShouldBeTrue)
+			So(waitFor(3*time.Second, func() bool { return len(disco.Services()) == 0 }), ShouldBeTrue)
+		})
+
+		Convey("reports ping errors", func() {
+			fake.PingError = docker.ErrConnectionRefused
+			So(fake.Ping(), ShouldEqual, docker.ErrConnectionRefused)
+		})
+	})
+}
+
+func Test_StateBuilder(t *testing.T) {
+	Convey("StateBuilder builds a state with the services", t, func() {
+		state := NewStateBuilder("alpha").
+			WithService("alpha", "web", TCPPort("10.0.0.1", 32080, 8080)).
+			WithService("beta", "web", TCPPort("10.0.0.2", 32080, 8080)).
+			WithServiceStatus("beta", "dns", service.UNHEALTHY, UDPPort("10.0.0.2", 32053, 53)).
+			Build()
+
+		So(state.Hostname, ShouldEqual, "alpha")
+		So(len(state.Servers), ShouldEqual, 2)
+		So(len(state.ByService()["web"]), ShouldEqual, 2)
+		So(state.ByService()["dns"][0].Status, ShouldEqual, service.UNHEALTHY)
+		So(state.Version(), ShouldEqual, 3)
+	})
+}
+
+func Test_ProxyRecorder(t *testing.T) {
+	Convey("ProxyRecorder", t, func() {
+		proxy := haproxy.New("", "")
+		proxy.Template = "../views/haproxy.cfg"
+
+		builder := NewStateBuilder("alpha").
+			WithService("alpha", "web", TCPPort("10.0.0.1", 32080, 8080))
+		state := builder.Build()
+
+		recorder := NewProxyRecorder(proxy.WriteConfig)
+
+		Convey("records the configs it renders", func() {
+			So(recorder.WriteAndReload(state), ShouldBeNil)
+			So(recorder.Reloads(), ShouldEqual, 1)
+			So(recorder.LastConfig(), ShouldContainSubstring, "backend web-8080")
+		})
+
+		Convey("renders a new config when the state changes", func() {
+			recorder.Watch(state)
+			builder.WithService("beta", "api", TCPPort("10.0.0.2", 32090, 9090))
+
+			configs, err := recorder.WaitForConfigs(1, 3*time.Second)
+			So(err, ShouldBeNil)
+			So(configs[len(configs)-1], ShouldContainSubstring, "backend api-9090")
+		})
+
+		Convey("times out when no config shows up", func() {
+			_, err := recorder.WaitForConfigs(1, 10*time.Millisecond)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("returns render errors", func() {
+			recorder.Render = func(state *catalog.ServicesState, output io.Writer) error {
+				return errors.New("oh no")
+			}
+			So(recorder.WriteAndReload(state), ShouldNotBeNil)
+			So(recorder.Reloads(), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,308 @@
+// The timeline package keeps the notable changes around the cluster, as
+// seen from this host, with how much attention they need. It's meant as a
+// quick view of what changed lately for whoever responds to a problem.
+package timeline
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// How much attention an Entry needs
+const (
+	Info     = "info"
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+const (
+	DefaultRetention        = 24 * time.Hour // How long entries are kept
+	DefaultMaxEntries       = 1000           // How many entries are kept
+	DefaultMassFailures     = 3              // Failed checks that make a mass failure
+	DefaultMassFailureSpan  = time.Minute    // How close together they have to be
+	listenerChannelSize     = 50
+	failedCheckStatusString = "Failed" // As the healthy package publishes it
+)
+
+// The severity of each kind of event taken from the events Bus. The others
+// are left out.
+var eventSeverities = map[string]string{
+	"HostJoined":      Info,
+	"HostLeft":        Warning,
+	"Reloaded":        Info,
+	"ReloadFailed":    Critical,
+	"ConfigDivergent": Warning,
+	"OutlierLowered":  Warning,
+}
+
+// An Entry is one notable change
+type Entry struct {
+	Time     time.Time
+	Severity string
+	Kind     string // e.g. "ServiceDeployed"
+	Host     string // The host it happened on, or to
+	Subject  string // What it's about, e.g. a service name
+	Message  string
+	Count    int `json:",omitempty"` // How many things it rolls up, e.g. failed checks
+}
+
+// A Timeline collects the Entries from the state changes and the events
+// Bus, and keeps them for the Retention
+type Timeline struct {
+	Retention       time.Duration
+	MaxEntries      int
+	MassFailures    int
+	MassFailureSpan time.Duration
+	Clock           clock.Clock
+	hostname        string
+	entries         []*Entry // Oldest first
+	failures        []time.Time
+	mass            *Entry          // The mass failure still being added to
+	massLast        time.Time       // When the last check in it failed
+	deployed        map[string]bool // Instances we recorded as deployed, by ID
+	eventChan       chan catalog.ChangeEvent
+	sync.RWMutex
+}
+
+// NewTimeline returns a Timeline with the defaults set
+func NewTimeline() *Timeline {
+	return &Timeline{
+		Retention:       DefaultRetention,
+		MaxEntries:      DefaultMaxEntries,
+		MassFailures:    DefaultMassFailures,
+		MassFailureSpan: DefaultMassFailureSpan,
+		deployed:        make(map[string]bool),
+		eventChan:       make(chan catalog.ChangeEvent, listenerChannelSize),
+	}
+}
+
+// Watch records the entries from the state changes and the events on the
+// Bus, which may be nil. It runs until the listener's channel is closed.
+func (t *Timeline) Watch(state *catalog.ServicesState, bus *events.Bus) {
+	t.Lock()
+	t.hostname = state.Hostname
+	t.Unlock()
+
+	var eventChan chan events.Event
+	if bus != nil {
+		eventChan = bus.Subscribe()
+		defer bus.Unsubscribe(eventChan)
+	}
+
+	state.AddListener(t)
+
+	for {
+		select {
+		case change, ok := <-t.eventChan:
+			if !ok {
+				return
+			}
+			t.RecordChange(&change)
+		case evt := <-eventChan:
+			t.RecordEvent(&evt)
+		}
+	}
+}
+
+// RecordChange adds an entry for an instance that was deployed or removed
+func (t *Timeline) RecordChange(change *catalog.ChangeEvent) {
+	svc := &change.Service
+	now := t.now()
+
+	t.Lock()
+	defer t.Unlock()
+
+	switch {
+	// Instances we hear about for the first time are only new when their
+	// container is, otherwise we'd record the whole cluster at startup
+	case svc.Status == service.ALIVE && !t.deployed[svc.ID] &&
+		change.PreviousStatus == service.UNKNOWN && now.Sub(svc.Created) < t.Retention:
+
+		t.deployed[svc.ID] = true
+		t.add(&Entry{
+			Time:     change.Time,
+			Severity: Info,
+			Kind:     "ServiceDeployed",
+			Host:     svc.Hostname,
+			Subject:  svc.Name,
+			Message:  fmt.Sprintf("Deployed %s (%s) from %s", svc.Name, svc.ID, svc.Image),
+		})
+
+	case svc.IsTombstone() && change.PreviousStatus != service.TOMBSTONE &&
+		change.PreviousStatus != service.UNKNOWN:
+
+		delete(t.deployed, svc.ID)
+		t.add(&Entry{
+			Time:     change.Time,
+			Severity: Info,
+			Kind:     "ServiceRemoved",
+			Host:     svc.Hostname,
+			Subject:  svc.Name,
+			Message:  fmt.Sprintf("Removed %s (%s)", svc.Name, svc.ID),
+		})
+	}
+}
+
+// RecordEvent adds an entry for an event, if it's one of the notable kinds.
+// Failed checks are only added when enough of them fail together.
+func (t *Timeline) RecordEvent(evt *events.Event) {
+	t.Lock()
+	defer t.Unlock()
+
+	if evt.Type == "CheckStatusChanged" {
+		if evt.Details["Status"] == failedCheckStatusString {
+			t.checkFailed(evt)
+		}
+		return
+	}
+
+	severity, ok := eventSeverities[evt.Type]
+	if !ok {
+		return
+	}
+
+	host := evt.Details["Hostname"]
+	if host == "" {
+		host = t.hostname
+	}
+
+	t.add(&Entry{
+		Time:     evt.Time,
+		Severity: severity,
+		Kind:     evt.Type,
+		Host:     host,
+		Subject:  evt.Subject,
+		Message:  evt.Message,
+	})
+}
+
+// checkFailed counts a failed check, and adds a mass failure once there are
+// MassFailures of them within the MassFailureSpan. The ones that follow
+// close behind are rolled into it. Must be called with the lock held.
+func (t *Timeline) checkFailed(evt *events.Event) {
+	cutoff := evt.Time.Add(-t.MassFailureSpan)
+	var i int
+	for i < len(t.failures) && t.failures[i].Before(cutoff) {
+		i++
+	}
+	t.failures = append(t.failures[i:], evt.Time)
+
+	if t.mass != nil && !t.massLast.Before(cutoff) {
+		t.mass.Count++
+		t.massLast = evt.Time
+		t.mass.Message = fmt.Sprintf("%d health checks failed together", t.mass.Count)
+		return
+	}
+
+	if t.MassFailures < 1 || len(t.failures) < t.MassFailures {
+		return
+	}
+
+	t.mass = &Entry{
+		Time:     evt.Time,
+		Severity: Critical,
+		Kind:     "MassCheckFailure",
+		Host:     t.hostname,
+		Message:  fmt.Sprintf("%d health checks failed together", len(t.failures)),
+		Count:    len(t.failures),
+	}
+	t.massLast = evt.Time
+	t.add(t.mass)
+
+	log.Warnf("%d health checks failed within %s", len(t.failures), t.MassFailureSpan)
+}
+
+// add appends an entry and drops the ones that are too old, or too many.
+// Must be called with the lock held.
+func (t *Timeline) add(entry *Entry) {
+	t.entries = append(t.entries, entry)
+	t.prune(t.now())
+}
+
+// prune drops the entries older than the Retention, and the oldest ones
+// over MaxEntries. Must be called with the lock held.
+func (t *Timeline) prune(now time.Time) {
+	cutoff := now.Add(-t.Retention)
+
+	var i int
+	for i < len(t.entries) && t.entries[i].Time.Before(cutoff) {
+		i++
+	}
+	if t.MaxEntries > 0 && len(t.entries)-i > t.MaxEntries {
+		i = len(t.entries) - t.MaxEntries
+	}
+
+	for _, dropped := range t.entries[:i] {
+		if dropped == t.mass {
+			t.mass = nil
+		}
+	}
+	t.entries = t.entries[i:]
+}
+
+// Entries returns the entries since a time, newest first. Only the ones
+// about the host are returned when it's set, and only the ones at least as
+// severe as minSeverity when that's set.
+func (t *Timeline) Entries(since time.Time, host string, minSeverity string) []Entry {
+	t.RLock()
+	defer t.RUnlock()
+
+	result := make([]Entry, 0, len(t.entries))
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		entry := t.entries[i]
+		if entry.Time.Before(since) {
+			continue
+		}
+		if host != "" && entry.Host != host {
+			continue
+		}
+		if SeverityLevel(entry.Severity) < SeverityLevel(minSeverity) {
+			continue
+		}
+		result = append(result, *entry)
+	}
+
+	return result
+}
+
+// SeverityLevel orders the severities, from zero for Info or an empty one
+// up. It returns -1 for one it doesn't know.
+func SeverityLevel(severity string) int {
+	switch severity {
+	case Info, "":
+		return 0
+	case Warning:
+		return 1
+	case Critical:
+		return 2
+	default:
+		return -1
+	}
+}
+
+func (t *Timeline) now() time.Time {
+	return clock.OrReal(t.Clock).Now().UTC()
+}
+
+// Name is part of the catalog.Listener interface
+func (t *Timeline) Name() string {
+	return "Timeline"
+}
+
+// Managed is part of the catalog.Listener interface. The Timeline stays
+// for as long as Sidecar runs.
+func (t *Timeline) Managed() bool {
+	return false
+}
+
+// Chan is part of the catalog.Listener interface
+func (t *Timeline) Chan() chan catalog.ChangeEvent {
+	return t.eventChan
+}
@@ -0,0 +1,141 @@
+package timeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NinesStack/sidecar/catalog"
+	"github.com/NinesStack/sidecar/clock"
+	"github.com/NinesStack/sidecar/events"
+	"github.com/NinesStack/sidecar/service"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Timeline(t *testing.T) {
+	Convey("The Timeline", t, func() {
+		fake := clock.NewFake(time.Now().UTC())
+		timeline := NewTimeline()
+		timeline.Clock = fake
+		timeline.hostname = "chaucer"
+
+		svc := service.Service{
+			ID: "deadbeef123", Name: "bocaccio", Image: "bocaccio:1.2", Hostname: "dante",
+			Created: fake.Now().Add(-time.Minute),
+		}
+
+		// Records a change to the instance's status
+		change := func(status int, previous int) {
+			svc.Status = status
+			timeline.RecordChange(&catalog.ChangeEvent{Service: svc, PreviousStatus: previous, Time: fake.Now()})
+		}
+
+		// Records a check failing on this host
+		checkFailed := func(id string) {
+			timeline.RecordEvent(&events.Event{
+				Time: fake.Now(), Type: "CheckStatusChanged", Subject: id,
+				Details: map[string]string{"Status": "Failed"},
+			})
+		}
+
+		since := fake.Now().Add(-time.Hour)
+
+		Convey("records instances being deployed and removed", func() {
+			change(service.ALIVE, service.UNKNOWN)
+			change(service.UNHEALTHY, service.ALIVE)
+			change(service.ALIVE, service.UNKNOWN)
+			fake.Advance(time.Second)
+			change(service.TOMBSTONE, service.ALIVE)
+
+			entries := timeline.Entries(since, "", "")
+			So(len(entries), ShouldEqual, 2)
+			So(entries[0].Kind, ShouldEqual, "ServiceRemoved")
+			So(entries[1].Kind, ShouldEqual, "ServiceDeployed")
+			So(entries[1].Host, ShouldEqual, "dante")
+			So(entries[1].Message, ShouldContainSubstring, "bocaccio:1.2")
+		})
+
+		Convey("doesn't take old instances it hears about for the deployed ones", func() {
+			svc.Created = fake.Now().Add(-2 * DefaultRetention)
+			change(service.ALIVE, service.UNKNOWN)
+			change(service.TOMBSTONE, service.UNKNOWN)
+
+			So(timeline.Entries(since, "", ""), ShouldBeEmpty)
+		})
+
+		Convey("records the notable events with their severity", func() {
+			timeline.RecordEvent(&events.Event{
+				Time: fake.Now(), Type: "HostLeft", Subject: "dante",
+				Details: map[string]string{"Hostname": "dante"},
+			})
+			timeline.RecordEvent(&events.Event{Time: fake.Now(), Type: "ReloadFailed", Message: "nope"})
+			timeline.RecordEvent(&events.Event{Time: fake.Now(), Type: "SlowRequest"})
+
+			entries := timeline.Entries(since, "", "")
+			So(len(entries), ShouldEqual, 2)
+			So(entries[0].Severity, ShouldEqual, Critical)
+			So(entries[0].Host, ShouldEqual, "chaucer")
+			So(entries[1].Severity, ShouldEqual, Warning)
+			So(entries[1].Host, ShouldEqual, "dante")
+
+			So(len(timeline.Entries(since, "dante", "")), ShouldEqual, 1)
+			So(len(timeline.Entries(since, "", Critical)), ShouldEqual, 1)
+		})
+
+		Convey("rolls checks failing together into one entry", func() {
+			checkFailed("one")
+			checkFailed("two")
+			So(timeline.Entries(since, "", ""), ShouldBeEmpty)
+
+			checkFailed("three")
+			fake.Advance(30 * time.Second)
+			checkFailed("four")
+
+			entries := timeline.Entries(since, "", "")
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].Kind, ShouldEqual, "MassCheckFailure")
+			So(entries[0].Severity, ShouldEqual, Critical)
+			So(entries[0].Count, ShouldEqual, 4)
+
+			Convey("and starts another once they stop", func() {
+				fake.Advance(2 * time.Minute)
+				checkFailed("five")
+				checkFailed("six")
+				checkFailed("seven")
+
+				So(len(timeline.Entries(since, "", "")), ShouldEqual, 2)
+			})
+		})
+
+		Convey("doesn't count checks failing far apart", func() {
+			for _, id := range []string{"one", "two", "three"} {
+				checkFailed(id)
+				fake.Advance(time.Minute)
+			}
+
+			So(timeline.Entries(since, "", ""), ShouldBeEmpty)
+		})
+
+		Convey("drops the entries past the Retention or MaxEntries", func() {
+			timeline.MaxEntries = 2
+			timeline.RecordEvent(&events.Event{Time: fake.Now(), Type: "HostJoined", Subject: "one"})
+			fake.Advance(DefaultRetention + time.Minute)
+			timeline.RecordEvent(&events.Event{Time: fake.Now(), Type: "HostJoined", Subject: "two"})
+
+			entries := timeline.Entries(time.Time{}, "", "")
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].Subject, ShouldEqual, "two")
+
+			timeline.RecordEvent(&events.Event{Time: fake.Now(), Type: "HostJoined", Subject: "three"})
+			timeline.RecordEvent(&events.Event{Time: fake.Now(), Type: "HostJoined", Subject: "four"})
+			entries = timeline.Entries(time.Time{}, "", "")
+			So(len(entries), ShouldEqual, 2)
+			So(entries[1].Subject, ShouldEqual, "three")
+		})
+
+		Convey("orders the severities", func() {
+			So(SeverityLevel(""), ShouldEqual, 0)
+			So(SeverityLevel(Critical), ShouldBeGreaterThan, SeverityLevel(Warning))
+			So(SeverityLevel("loud"), ShouldEqual, -1)
+		})
+	})
+}
@@ -0,0 +1,106 @@
+// Package wire has the formats Sidecar gossips services and state in. JSON
+// is the default, and the one every Sidecar reads. Msgpack is more compact,
+// and is only sent once every peer says it can read it.
+package wire
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/pquerna/ffjson/ffjson"
+)
+
+// The names of the formats
+const (
+	JSON    = "json"
+	Msgpack = "msgpack"
+)
+
+// msgpackMarker starts every msgpack message. Msgpack never uses it, and no
+// JSON starts with it, so the format can be told from the data.
+const msgpackMarker = 0xc1
+
+// An Encoder turns values into messages for the wire, and back
+type Encoder interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Formats are the ones this Sidecar reads, announced to its peers
+var Formats = []string{Msgpack, JSON}
+
+// ForName returns the Encoder for a format
+func ForName(name string) (Encoder, error) {
+	switch name {
+	case JSON, "":
+		return jsonEncoder{}, nil
+	case Msgpack:
+		return msgpackEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown wire format '%s', expected one of %v", name, Formats)
+	}
+}
+
+// Detect returns the Encoder a message was written with
+func Detect(data []byte) Encoder {
+	if len(data) > 0 && data[0] == msgpackMarker {
+		return msgpackEncoder{}
+	}
+	return jsonEncoder{}
+}
+
+// Negotiate returns the preferred Encoder when every peer reads it, and JSON
+// otherwise. The peers are the formats each one announced, and those that
+// didn't announce any only read JSON.
+func Negotiate(preferred Encoder, peers map[string][]string) Encoder {
+	if preferred == nil || preferred.Name() == JSON {
+		return jsonEncoder{}
+	}
+
+next:
+	for _, formats := range peers {
+		for _, format := range formats {
+			if format == preferred.Name() {
+				continue next
+			}
+		}
+		return jsonEncoder{}
+	}
+
+	return preferred
+}
+
+// jsonEncoder uses the ffjson marshalers generated for the services and
+// state, so its buffers can go back to the ffjson pool
+type jsonEncoder struct{}
+
+func (jsonEncoder) Name() string { return JSON }
+
+func (jsonEncoder) Marshal(v interface{}) ([]byte, error) {
+	return ffjson.Marshal(v)
+}
+
+func (jsonEncoder) Unmarshal(data []byte, v interface{}) error {
+	return ffjson.Unmarshal(data, v)
+}
+
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) Name() string { return Msgpack }
+
+func (msgpackEncoder) Marshal(v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{msgpackMarker})
+	if err := codec.NewEncoder(buf, &codec.MsgpackHandle{}).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackEncoder) Unmarshal(data []byte, v interface{}) error {
+	if len(data) < 1 || data[0] != msgpackMarker {
+		return fmt.Errorf("Error decoding msgpack: missing the marker byte")
+	}
+	return codec.NewDecoder(bytes.NewReader(data[1:]), &codec.MsgpackHandle{}).Decode(v)
+}
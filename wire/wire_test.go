@@ -0,0 +1,72 @@
+package wire
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type message struct {
+	Name  string
+	Ports []int64
+}
+
+func Test_Encoders(t *testing.T) {
+	Convey("The wire formats", t, func() {
+		msg := message{Name: "awesome-svc", Ports: []int64{8080, 9000}}
+
+		Convey("are found by name", func() {
+			encoder, err := ForName(Msgpack)
+			So(err, ShouldBeNil)
+			So(encoder.Name(), ShouldEqual, Msgpack)
+
+			encoder, err = ForName("")
+			So(err, ShouldBeNil)
+			So(encoder.Name(), ShouldEqual, JSON)
+
+			_, err = ForName("xml")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("read back what they wrote, and are told apart", func() {
+			for _, name := range Formats {
+				encoder, _ := ForName(name)
+				data, err := encoder.Marshal(&msg)
+				So(err, ShouldBeNil)
+				So(Detect(data).Name(), ShouldEqual, name)
+
+				var decoded message
+				So(Detect(data).Unmarshal(data, &decoded), ShouldBeNil)
+				So(decoded, ShouldResemble, msg)
+			}
+		})
+
+		Convey("don't read msgpack without the marker", func() {
+			encoder, _ := ForName(Msgpack)
+			data, _ := encoder.Marshal(&msg)
+
+			var decoded message
+			So(encoder.Unmarshal(data[1:], &decoded), ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_Negotiate(t *testing.T) {
+	Convey("Negotiating the format", t, func() {
+		msgpack, _ := ForName(Msgpack)
+
+		Convey("picks the preferred one when every peer reads it", func() {
+			peers := map[string][]string{"alpha": Formats, "beta": {Msgpack}}
+			So(Negotiate(msgpack, peers).Name(), ShouldEqual, Msgpack)
+		})
+
+		Convey("falls back to JSON when a peer doesn't", func() {
+			peers := map[string][]string{"alpha": Formats, "beta": nil}
+			So(Negotiate(msgpack, peers).Name(), ShouldEqual, JSON)
+		})
+
+		Convey("uses JSON when nothing is preferred", func() {
+			So(Negotiate(nil, nil).Name(), ShouldEqual, JSON)
+		})
+	})
+}